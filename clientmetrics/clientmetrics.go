@@ -0,0 +1,129 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package clientmetrics is a registry of named counters and gauges
+// that the node agent's packages update as things happen, such as
+// packets sent through DERP or map responses from the control
+// server. It's one place to look for how often something happens,
+// where otherwise there'd only be log lines to count.
+//
+// Metrics are package-level variables, created once at init time,
+// and cheap enough to update on packet paths.
+package clientmetrics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Type is the kind of a Metric.
+type Type int
+
+const (
+	// Counter is a metric that only goes up, such as a count of
+	// packets sent. It starts at zero when the process does.
+	Counter Type = iota
+	// Gauge is a metric that goes up and down, such as a number of
+	// open connections.
+	Gauge
+)
+
+func (t Type) String() string {
+	switch t {
+	case Counter:
+		return "counter"
+	case Gauge:
+		return "gauge"
+	default:
+		return "unknown"
+	}
+}
+
+// Metric is a named value that's safe for concurrent use.
+type Metric struct {
+	v    int64 // first, for 64-bit alignment of atomic access on 32-bit systems
+	name string
+	typ  Type
+	help string
+}
+
+var (
+	mu      sync.Mutex
+	metrics = map[string]*Metric{}
+)
+
+// NewCounter registers and returns a new counter named name, with a
+// one-line description help. It panics if name is invalid or already
+// registered.
+func NewCounter(name, help string) *Metric {
+	return register(&Metric{name: name, typ: Counter, help: help})
+}
+
+// NewGauge registers and returns a new gauge, as for NewCounter.
+func NewGauge(name, help string) *Metric {
+	return register(&Metric{name: name, typ: Gauge, help: help})
+}
+
+func register(m *Metric) *Metric {
+	if !validName(m.name) {
+		panic(fmt.Sprintf("clientmetrics: invalid metric name %q", m.name))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := metrics[m.name]; dup {
+		panic(fmt.Sprintf("clientmetrics: metric %q registered twice", m.name))
+	}
+	metrics[m.name] = m
+	return m
+}
+
+// validName reports whether s is a valid metric name: lower-case
+// letters, digits and underscores, starting with a letter, so that it
+// can be exported to Prometheus as is.
+func validName(s string) bool {
+	if s == "" || s[0] < 'a' || s[0] > 'z' {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// Name returns m's name.
+func (m *Metric) Name() string { return m.name }
+
+// Add adds n to m. Counters should only be added to.
+func (m *Metric) Add(n int64) { atomic.AddInt64(&m.v, n) }
+
+// Set sets m to n. It's meant for gauges.
+func (m *Metric) Set(n int64) { atomic.StoreInt64(&m.v, n) }
+
+// Value returns m's current value.
+func (m *Metric) Value() int64 { return atomic.LoadInt64(&m.v) }
+
+// Value is a metric's value at one moment, as reported by Snapshot.
+type Value struct {
+	Name  string
+	Type  string // "counter" or "gauge"
+	Help  string
+	Value int64
+}
+
+// Snapshot returns the current value of every registered metric,
+// sorted by name.
+func Snapshot() []Value {
+	mu.Lock()
+	ret := make([]Value, 0, len(metrics))
+	for _, m := range metrics {
+		ret = append(ret, Value{Name: m.name, Type: m.typ.String(), Help: m.help, Value: m.Value()})
+	}
+	mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clientmetrics
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	c := NewCounter("test_packets", "Packets seen by the test.")
+	g := NewGauge("test_conns", "Connections open in the test.")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	g.Set(3)
+	g.Add(-1)
+
+	got := map[string]Value{}
+	for _, v := range Snapshot() {
+		got[v.Name] = v
+	}
+	if v := got["test_packets"]; v.Value != 1000 || v.Type != "counter" || v.Help == "" {
+		t.Errorf("test_packets = %+v, want a counter of 1000", v)
+	}
+	if v := got["test_conns"]; v.Value != 2 || v.Type != "gauge" {
+		t.Errorf("test_conns = %+v, want a gauge of 2", v)
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	NewCounter("test_dup", "")
+	for _, name := range []string{"test_dup", "", "Test", "1test", "test-dash", "test.dot"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewCounter(%q) didn't panic", name)
+				}
+			}()
+			NewCounter(name, "")
+		}()
+	}
+}
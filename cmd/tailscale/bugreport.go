@@ -0,0 +1,132 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/version"
+)
+
+// runBugreport is "tailscale bugreport": it has tailscaled log a
+// marker with a unique ID, and prints the ID for the user to quote
+// in a support request, so the right part of the logs can be found.
+//
+// With --diag, it also writes a zip file of local diagnostics, for
+// when the logs can't be uploaded.
+func runBugreport(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale bugreport")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	diag := set.StringLong("diag", 0, "", "also write a bundle of status, network check, recent logs and routes to this zip file")
+	set.Parse(append([]string{"tailscale bugreport"}, args...))
+	if len(set.Args()) > 0 {
+		log.Fatalf("too many non-flag arguments: %#v", set.Args()[0])
+	}
+
+	out, err := localAPIRaw(*socket, "POST", "bugreport", nil)
+	if err != nil {
+		log.Fatalf("bugreport: %v", err)
+	}
+	id := strings.TrimSpace(string(out))
+	if *diag != "" {
+		if err := writeDiagBundle(*diag, *socket, id); err != nil {
+			log.Fatalf("bugreport: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote diagnostics to %s\n", *diag)
+	}
+	fmt.Println(id)
+}
+
+// writeDiagBundle writes a zip file of diagnostics for the bug report
+// id to path. Parts that can't be collected, such as the logs for a
+// user other than the operator, are recorded as errors in the bundle
+// instead.
+func writeDiagBundle(path, socket, id string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	add := func(name string, get func() ([]byte, error)) error {
+		b, err := get()
+		if err != nil {
+			b = []byte(fmt.Sprintf("error: %v\n", err))
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	getJSON := func(path string, v interface{}) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			if err := localAPIGet(socket, path, v); err != nil {
+				return nil, err
+			}
+			return json.MarshalIndent(v, "", "\t")
+		}
+	}
+	parts := []struct {
+		name string
+		get  func() ([]byte, error)
+	}{
+		{"id.txt", func() ([]byte, error) {
+			return []byte(fmt.Sprintf("%s\nclient %s %s/%s\n%s\n", id, version.LONG, runtime.GOOS, runtime.GOARCH, time.Now().UTC().Format(time.RFC3339))), nil
+		}},
+		{"status.json", getJSON("status", new(ipnstate.Status))}, // includes the network check
+		{"prefs.json", getJSON("prefs", new(ipn.Prefs))},
+		{"logs.txt", func() ([]byte, error) { return localAPIRaw(socket, "GET", "logs", nil) }},
+		{"routes.txt", osRoutes},
+	}
+	for _, p := range parts {
+		if err := add(p.name, p.get); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// osRoutes returns the OS routing table, as printed by the platform's
+// usual tool.
+func osRoutes() ([]byte, error) {
+	var cmds [][]string
+	switch runtime.GOOS {
+	case "linux":
+		cmds = [][]string{{"ip", "rule", "show"}, {"ip", "route", "show", "table", "all"}, {"ip", "-6", "route", "show", "table", "all"}}
+	case "windows":
+		cmds = [][]string{{"route", "print"}}
+	default:
+		cmds = [][]string{{"netstat", "-rn"}}
+	}
+	var sb strings.Builder
+	for _, c := range cmds {
+		fmt.Fprintf(&sb, "$ %s\n", strings.Join(c, " "))
+		out, err := exec.Command(c[0], c[1:]...).CombinedOutput()
+		sb.Write(out)
+		if err != nil {
+			fmt.Fprintf(&sb, "error: %v\n", err)
+		}
+		sb.WriteString("\n")
+	}
+	return []byte(sb.String()), nil
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// completionCommand is a subcommand, and its flags, as offered by
+// shell completion.
+type completionCommand struct {
+	name  string
+	flags []string
+}
+
+// completionCommands are the subcommands other than up, whose flags
+// come from getopt.CommandLine. Keep them in sync with the flags the
+// run functions define. The hidden debug command is left out.
+var completionCommands = []completionCommand{
+	{"status", []string{"socket", "json", "format", "active"}},
+	{"ping", []string{"socket", "count", "until-direct", "json", "type"}},
+	{"down", []string{"socket"}},
+	{"set", []string{"socket", "exit-node", "hostname", "accept-routes", "accept-dns", "shields-up", "advertise-routes", "advertise-exit-node", "operator", "check-updates"}},
+	{"logout", []string{"socket"}},
+	{"netcheck", []string{"socket", "json", "monitor", "every"}},
+	{"metrics", []string{"socket", "json", "format"}},
+	{"bugreport", []string{"socket", "diag"}},
+	{"version", []string{"socket", "client", "json"}},
+	{"update", []string{"socket", "check", "json", "yes", "track"}},
+	{"ip", []string{"socket", "ipv4", "ipv6", "json"}},
+	{"file", []string{"socket"}},
+	{"ssh", []string{"socket", "no-pin"}},
+	{"instances", []string{"json"}},
+	{"completion", nil},
+}
+
+// runCompletion is "tailscale completion <bash|zsh|fish>": it prints
+// a completion script for the shell. The scripts complete peer names
+// by running "tailscale completion __peers", and exit nodes with
+// "__exit-nodes".
+//
+// It must run after up's flags are defined on getopt.CommandLine,
+// and before they're parsed.
+func runCompletion(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: tailscale completion <bash|zsh|fish>\n")
+		os.Exit(2)
+	}
+	var upFlags []string
+	getopt.VisitAll(func(o getopt.Option) {
+		if o.LongName() != "" {
+			upFlags = append(upFlags, o.LongName())
+		}
+	})
+	cmds := append([]completionCommand{{"up", upFlags}}, completionCommands...)
+
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout, cmds)
+	case "zsh":
+		// zsh runs bash completion functions through bashcompinit.
+		fmt.Fprintf(os.Stdout, "autoload -U +X bashcompinit && bashcompinit\n")
+		writeBashCompletion(os.Stdout, cmds)
+	case "fish":
+		writeFishCompletion(os.Stdout, cmds)
+	case "__peers", "__exit-nodes":
+		printCompletionPeers(args[0] == "__exit-nodes")
+	default:
+		log.Fatalf("unknown shell %q; want bash, zsh or fish", args[0])
+	}
+}
+
+// printCompletionPeers prints the names the CLI accepts for peers,
+// one per line: nicknames, and host names or, for exit nodes, which
+// are only accepted by IP or nickname, Tailscale IPs. Errors print
+// nothing, so as not to garble the user's command line.
+func printCompletionPeers(exitNodes bool) {
+	st := new(ipnstate.Status)
+	// Completion scripts can't pass --socket, so use the default.
+	if err := localAPIGet(defaultSocket, "status", st); err != nil {
+		return
+	}
+	names := map[string]bool{}
+	for _, ps := range st.Peers() {
+		if exitNodes && !ps.ExitNodeOption {
+			continue
+		}
+		if ps.Nickname != "" {
+			names[ps.Nickname] = true
+		}
+		switch {
+		case !exitNodes && ps.HostName != "":
+			names[ps.HostName] = true
+		case len(ps.TailAddrs) > 0:
+			names[ps.TailAddrs[0]] = true
+		}
+	}
+	var sorted []string
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+	for _, n := range sorted {
+		fmt.Println(n)
+	}
+}
+
+func dashed(flags []string) string {
+	var ret []string
+	for _, f := range flags {
+		ret = append(ret, "--"+f)
+	}
+	return strings.Join(ret, " ")
+}
+
+func writeBashCompletion(w io.Writer, cmds []completionCommand) {
+	var names []string
+	for _, c := range cmds {
+		names = append(names, c.name)
+	}
+	fmt.Fprintf(w, `_tailscale() {
+	local cur prev cmd
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+	if [ "$prev" = "=" ]; then
+		prev="${COMP_WORDS[COMP_CWORD-2]}"
+	fi
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	if [ "$prev" = "--exit-node" ]; then
+		COMPREPLY=($(compgen -W "$(tailscale completion __exit-nodes 2>/dev/null)" -- "$cur"))
+		return
+	fi
+	cmd="${COMP_WORDS[1]}"
+	if { [ "$cmd" = "ping" ] || [ "$cmd" = "ip" ] || [ "$cmd" = "ssh" ]; } && [[ "$cur" != -* ]]; then
+		COMPREPLY=($(compgen -W "$(tailscale completion __peers 2>/dev/null)" -- "$cur"))
+		return
+	fi
+	case "$cmd" in
+`, strings.Join(names, " "))
+	for _, c := range cmds {
+		if c.name == "completion" {
+			fmt.Fprintf(w, "\tcompletion) COMPREPLY=($(compgen -W \"bash zsh fish\" -- \"$cur\")) ;;\n")
+			continue
+		}
+		if c.name == "file" {
+			fmt.Fprintf(w, "\tfile) if [ \"$COMP_CWORD\" -eq 2 ]; then COMPREPLY=($(compgen -W \"cp get\" -- \"$cur\")); else COMPREPLY=($(compgen -f -- \"$cur\")); fi ;;\n")
+			continue
+		}
+		fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n", c.name, dashed(c.flags))
+	}
+	fmt.Fprintf(w, "\tesac\n}\ncomplete -F _tailscale tailscale\n")
+}
+
+func writeFishCompletion(w io.Writer, cmds []completionCommand) {
+	fmt.Fprintf(w, "complete -c tailscale -f\n")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "complete -c tailscale -n __fish_use_subcommand -a %s\n", c.name)
+	}
+	for _, c := range cmds {
+		cond := "__fish_seen_subcommand_from " + c.name
+		for _, f := range c.flags {
+			fmt.Fprintf(w, "complete -c tailscale -n '%s' -l %s\n", cond, f)
+		}
+	}
+	fmt.Fprintf(w, "complete -c tailscale -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'\n")
+	fmt.Fprintf(w, "complete -c tailscale -n '__fish_seen_subcommand_from file; and not __fish_seen_subcommand_from cp get' -a 'cp get'\n")
+	fmt.Fprintf(w, "complete -c tailscale -n '__fish_seen_subcommand_from cp get' -F\n")
+	fmt.Fprintf(w, "complete -c tailscale -n '__fish_seen_subcommand_from ping ip ssh' -a '(tailscale completion __peers 2>/dev/null)'\n")
+	fmt.Fprintf(w, "complete -c tailscale -n '__fish_seen_subcommand_from up set' -l exit-node -x -a '(tailscale completion __exit-nodes 2>/dev/null)'\n")
+}
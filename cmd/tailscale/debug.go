@@ -0,0 +1,99 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn"
+)
+
+// runDebug is "tailscale debug <action>", for developers and support.
+// It isn't listed in the usage, and its actions may change between
+// releases. Most of them need root.
+//
+//	rebind       rebind the UDP socket and rediscover endpoints
+//	restun       rediscover public endpoints with STUN
+//	dump         write the engine state and netmap to tailscaled's log
+//	verbose on   log every packet received through DERP
+//	verbose off  stop that
+//	loglevel [l] print tailscaled's log levels, or set them to l, such
+//	             as "1" or "magicsock=2,control=1"
+//	netmap       print the current network map as JSON
+//	derpmap      print the DERP map in use as JSON
+//	prefs        print the current prefs as JSON
+func runDebug(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale debug")
+	set.SetParameters("<rebind|restun|dump|verbose on|verbose off|loglevel [levels]|netmap|derpmap|prefs>")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	set.Parse(append([]string{"tailscale debug"}, args...))
+	args = set.Args()
+	if len(args) == 0 {
+		set.PrintUsage(os.Stderr)
+		os.Exit(2)
+	}
+
+	action := args[0]
+	var dump interface{}
+	switch action {
+	case "rebind", "restun", "dump":
+		debugAction(*socket, ipn.DebugAction(action), args[1:])
+		return
+	case "verbose":
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			log.Fatalf("usage: tailscale debug verbose <on|off>")
+		}
+		debugAction(*socket, ipn.DebugAction("verbose-"+args[1]), nil)
+		return
+	case "loglevel":
+		var levels string
+		var err error
+		switch len(args) {
+		case 1:
+			err = localAPIGet(*socket, "loglevel", &levels)
+		case 2:
+			err = localAPIPost(*socket, "loglevel?levels="+url.QueryEscape(args[1]), nil, &levels)
+		default:
+			log.Fatalf("usage: tailscale debug loglevel [levels]")
+		}
+		if err != nil {
+			log.Fatalf("debug loglevel: %v", err)
+		}
+		fmt.Println(levels)
+		return
+	case "netmap", "derpmap":
+		dump = new(json.RawMessage)
+	case "prefs":
+		dump = new(ipn.Prefs)
+	default:
+		log.Fatalf("unknown debug action %q", action)
+	}
+	if len(args) > 1 {
+		log.Fatalf("too many non-flag arguments: %#v", args[1])
+	}
+	if err := localAPIGet(*socket, action, dump); err != nil {
+		log.Fatalf("debug %s: %v", action, err)
+	}
+	printJSON(dump)
+}
+
+// debugAction asks tailscaled to perform action.
+func debugAction(socket string, action ipn.DebugAction, extra []string) {
+	if len(extra) > 0 {
+		log.Fatalf("too many non-flag arguments: %#v", extra[0])
+	}
+	if err := localAPIPost(socket, "debug?action="+url.QueryEscape(string(action)), nil, nil); err != nil {
+		log.Fatalf("debug %s: %v", action, err)
+	}
+	if action == ipn.DebugDump {
+		fmt.Fprintf(os.Stderr, "Dumped to tailscaled's log.\n")
+	}
+}
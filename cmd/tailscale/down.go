@@ -0,0 +1,41 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn"
+)
+
+// runDown is "tailscale down": it turns off WantRunning, which stops
+// WireGuard and removes Tailscale's routes and DNS settings, but
+// keeps the node logged in and tailscaled running. "tailscale up"
+// brings it back.
+func runDown(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale down")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	set.Parse(append([]string{"tailscale down"}, args...))
+	if len(set.Args()) > 0 {
+		log.Fatalf("too many non-flag arguments: %#v", set.Args()[0])
+	}
+
+	prefs := new(ipn.Prefs)
+	if err := localAPIGet(*socket, "prefs", prefs); err != nil {
+		log.Fatalf("down: %v", err)
+	}
+	if !prefs.WantRunning {
+		fmt.Fprintf(os.Stderr, "Tailscale is already down.\n")
+		return
+	}
+	prefs.WantRunning = false
+	if err := localAPIPost(*socket, "prefs", prefs, nil); err != nil {
+		log.Fatalf("down: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// runFile is "tailscale file <cp|get>", for sending files between
+// the user's own nodes:
+//
+//	tailscale file cp <file>... <peer>:  send files to peer's inbox
+//	tailscale file get <dir>             move received files to dir
+//
+// Files go directly over the tunnel to the peer's tailscaled, which
+// keeps them until "tailscale file get". Running an interrupted "cp"
+// again resumes it.
+func runFile(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: tailscale file <cp|get> ...\n")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "cp":
+		runFileCp(args[1:])
+	case "get":
+		runFileGet(args[1:])
+	default:
+		log.Fatalf("unknown file command %q; want cp or get", args[0])
+	}
+}
+
+func runFileCp(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale file cp")
+	set.SetParameters("<file>... <peer>:")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	set.Parse(append([]string{"tailscale file cp"}, args...))
+	args = set.Args()
+	if len(args) < 2 || !strings.HasSuffix(args[len(args)-1], ":") {
+		set.PrintUsage(os.Stderr)
+		os.Exit(2)
+	}
+	name := strings.TrimSuffix(args[len(args)-1], ":")
+	files := args[:len(args)-1]
+
+	st := new(ipnstate.Status)
+	if err := localAPIGet(*socket, "status", st); err != nil {
+		log.Fatalf("file cp: %v", err)
+	}
+	ps := findPeer(st, name)
+	if ps == nil {
+		log.Fatalf("file cp: no peer named %q", name)
+	}
+	if ps.UserID != st.Self.UserID {
+		log.Fatalf("file cp: %s belongs to another user; files can only be sent to your own nodes", name)
+	}
+	ip := preferredIP(ps)
+	if ip == "" {
+		log.Fatalf("file cp: %s has no Tailscale IP", name)
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(ipnstate.PeerAPIPort))
+	for _, path := range files {
+		if err := sendFile(addr, path); err != nil {
+			log.Fatalf("file cp: %s: %v", path, err)
+		}
+	}
+}
+
+// sendFile sends the file at path to the peer API at addr, from
+// wherever an earlier attempt stopped.
+func sendFile(addr, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+	size := fi.Size()
+	base := fmt.Sprintf("http://%s/v0/put/%s", addr, url.PathEscape(filepath.Base(path)))
+
+	hc := &http.Client{Timeout: 30 * time.Second}
+	res, err := hc.Get(base)
+	if err != nil {
+		return err
+	}
+	var off ipnstate.FileOffset
+	err = peerAPIResult(res, &off)
+	if err != nil {
+		return err
+	}
+	if off.Offset > size {
+		return fmt.Errorf("peer already has %d bytes, more than the file's %d", off.Offset, size)
+	}
+	if _, err := f.Seek(off.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	pr := &progressReader{r: f, name: filepath.Base(path), n: off.Offset, size: size}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s?offset=%d&size=%d", base, off.Offset, size), pr)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size - off.Offset
+	// Large files take as long as they take.
+	res, err = (&http.Client{}).Do(req)
+	pr.done()
+	if err != nil {
+		return fmt.Errorf("%v; run the same command again to resume", err)
+	}
+	return peerAPIResult(res, nil)
+}
+
+// peerAPIResult checks the peer API's reply res, and decodes it into
+// v unless v is nil.
+func peerAPIResult(res *http.Response, v interface{}) error {
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("peer: %s", strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// progressReader reports a transfer's progress on stderr as it reads
+// from r.
+type progressReader struct {
+	r        io.Reader
+	name     string
+	n, size  int64
+	lastShow time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.lastShow) > 250*time.Millisecond {
+		p.lastShow = now
+		p.show()
+	}
+	return n, err
+}
+
+func (p *progressReader) show() {
+	pct := 100
+	if p.size > 0 {
+		pct = int(p.n * 100 / p.size)
+	}
+	fmt.Fprintf(os.Stderr, "\r%s: %s / %s (%d%%)", p.name, formatBytes(p.n), formatBytes(p.size), pct)
+}
+
+func (p *progressReader) done() {
+	p.show()
+	fmt.Fprintf(os.Stderr, "\n")
+}
+
+func runFileGet(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale file get")
+	set.SetParameters("<target-directory>")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	set.Parse(append([]string{"tailscale file get"}, args...))
+	if len(set.Args()) != 1 {
+		set.PrintUsage(os.Stderr)
+		os.Exit(2)
+	}
+	dir := set.Args()[0]
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		log.Fatalf("file get: %s is not a directory", dir)
+	}
+
+	var files []ipnstate.WaitingFile
+	if err := localAPIGet(*socket, "files", &files); err != nil {
+		log.Fatalf("file get: %v", err)
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "No files waiting.\n")
+		return
+	}
+	failed := false
+	for _, wf := range files {
+		if err := receiveFile(*socket, dir, wf.Name); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", wf.Name, err)
+			failed = true
+			continue
+		}
+		fmt.Println(filepath.Join(dir, wf.Name))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// receiveFile moves the waiting file name into dir, without
+// replacing a file already there.
+func receiveFile(socket, dir, name string) error {
+	dst := filepath.Join(dir, name)
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	res, err := localAPIStream(socket, "GET", "files/"+url.PathEscape(name), nil, 0)
+	if err == nil {
+		_, err = io.Copy(f, res.Body)
+		res.Body.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	_, err = localAPIRaw(socket, "DELETE", "files/"+url.PathEscape(name), nil)
+	return err
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/safesocket"
+)
+
+// parseGlobalFlags handles the flags that may come before the
+// command to choose which tailscaled it talks to: --socket=path, or
+// --instance=name for an instance started with tailscaled's
+// --instance. It sets defaultSocket, and returns args without them.
+func parseGlobalFlags(args []string) []string {
+	for len(args) > 1 && strings.HasPrefix(args[1], "--") {
+		flag, val := args[1][2:], ""
+		n := 2
+		if i := strings.Index(flag, "="); i >= 0 {
+			flag, val = flag[:i], flag[i+1:]
+		} else if len(args) > 2 {
+			val, n = args[2], 3
+		}
+		switch flag {
+		case "socket":
+			defaultSocket = val
+		case "instance":
+			if err := safesocket.CheckInstanceName(val); err != nil {
+				log.Fatalf("--instance: %v", err)
+			}
+			defaultSocket = safesocket.InstanceSocket(val)
+		default:
+			return args
+		}
+		if val == "" {
+			log.Fatalf("--%s needs a value", flag)
+		}
+		args = append(args[:1], args[n:]...)
+	}
+	return args
+}
+
+// instanceInfo is an instance in the --json output of "tailscale
+// instances".
+type instanceInfo struct {
+	Name      string   // empty for the default instance
+	Socket    string   // path of its socket
+	State     string   `json:",omitempty"` // its ipn.State, if it's running
+	TailAddrs []string `json:",omitempty"`
+	Err       string   `json:",omitempty"` // why it couldn't be asked
+}
+
+// runInstances is "tailscale instances": it lists the tailscaled
+// instances on this machine, the default one and those started with
+// --instance, and the state of each, so that one can be picked with
+// "tailscale --instance=name".
+func runInstances(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale instances")
+	asJSON := set.BoolLong("json", 0, "print the instances as JSON")
+	set.Parse(append([]string{"tailscale instances"}, args...))
+	if len(set.Args()) > 0 {
+		log.Fatalf("too many non-flag arguments: %#v", set.Args()[0])
+	}
+
+	names, err := safesocket.Instances()
+	if err != nil {
+		log.Fatalf("instances: %v", err)
+	}
+	list := []instanceInfo{{Socket: platformSocket()}}
+	for _, name := range names {
+		list = append(list, instanceInfo{Name: name, Socket: safesocket.InstanceSocket(name)})
+	}
+	for i := range list {
+		in := &list[i]
+		// A named instance's socket may be left from before it
+		// stopped, and the default instance may not exist.
+		c, err := safesocket.Connect(in.Socket, 0)
+		if err != nil {
+			in.Err = "not running"
+			continue
+		}
+		c.Close()
+		st := new(ipnstate.Status)
+		if err := localAPIGet(in.Socket, "status", st); err != nil {
+			in.Err = err.Error()
+			continue
+		}
+		in.State, in.TailAddrs = st.BackendState, st.TailAddrs
+	}
+
+	if *asJSON {
+		printJSON(list)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSOCKET\tSTATE\tIP")
+	for _, in := range list {
+		state := in.State
+		if in.Err != "" {
+			state = "(" + in.Err + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", orDash(in.Name), in.Socket, state, firstOr(in.TailAddrs, "-"))
+	}
+	tw.Flush()
+}
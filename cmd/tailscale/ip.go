@@ -0,0 +1,104 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// runIP is "tailscale ip [-4|-6] [peer]": it prints the Tailscale IPs
+// of this node, or of the named peer, one per line, for scripts such
+// as "ssh $(tailscale ip -4 server1)". With --json, it prints them as
+// a JSON array of strings.
+func runIP(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale ip")
+	set.SetParameters("[hostname|IP|nickname]")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	only4 := set.BoolLong("ipv4", '4', "only print IPv4 addresses")
+	only6 := set.BoolLong("ipv6", '6', "only print IPv6 addresses")
+	asJSON := set.BoolLong("json", 0, "print the addresses as a JSON array")
+	set.Parse(append([]string{"tailscale ip"}, args...))
+	if len(set.Args()) > 1 {
+		log.Fatalf("too many non-flag arguments: %#v", set.Args()[1])
+	}
+	if *only4 && *only6 {
+		log.Fatalf("-4 and -6 are mutually exclusive")
+	}
+
+	st := new(ipnstate.Status)
+	if err := localAPIGet(*socket, "status", st); err != nil {
+		log.Fatalf("ip: %v", err)
+	}
+	addrs := st.TailAddrs
+	if len(set.Args()) == 1 {
+		name := set.Args()[0]
+		ps := findPeer(st, name)
+		if ps == nil {
+			log.Fatalf("ip: no peer named %q", name)
+		}
+		addrs = ps.TailAddrs
+	}
+
+	var out []string
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		is4 := ip != nil && ip.To4() != nil
+		if (*only4 && !is4) || (*only6 && is4) {
+			continue
+		}
+		out = append(out, a)
+	}
+	if *asJSON {
+		if out == nil {
+			out = []string{}
+		}
+		printJSON(out)
+		return
+	}
+	if len(out) == 0 {
+		fmt.Fprintf(os.Stderr, "no matching addresses\n")
+		os.Exit(1)
+	}
+	for _, a := range out {
+		fmt.Println(a)
+	}
+}
+
+// preferredIP returns the Tailscale IP to reach ps on: its first
+// IPv4 address if it has one, else its first address, or "" if it
+// has none.
+func preferredIP(ps *ipnstate.PeerStatus) string {
+	for _, a := range ps.TailAddrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+			return a
+		}
+	}
+	return firstOr(ps.TailAddrs, "")
+}
+
+// findPeer returns the peer in st that name refers to, by nickname,
+// host name, DNS name or Tailscale IP, or nil if there's none.
+func findPeer(st *ipnstate.Status, name string) *ipnstate.PeerStatus {
+	for _, ps := range st.Peers() {
+		if ps.Nickname == name || strings.EqualFold(ps.HostName, name) ||
+			strings.EqualFold(strings.TrimSuffix(ps.DNSName, "."), strings.TrimSuffix(name, ".")) {
+			return ps
+		}
+		for _, a := range ps.TailAddrs {
+			if a == name {
+				return ps
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pborman/getopt/v2"
+)
+
+// runLogout is "tailscale logout": it expires the node's key on the
+// control server and forgets it, so that the node leaves the network
+// until someone logs in again with "tailscale up". Unlike "tailscale
+// down", which only disconnects, this can't be undone without
+// logging in.
+func runLogout(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale logout")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	set.Parse(append([]string{"tailscale logout"}, args...))
+	if len(set.Args()) > 0 {
+		log.Fatalf("too many non-flag arguments: %#v", set.Args()[0])
+	}
+
+	if err := localAPIPost(*socket, "logout", nil, nil); err != nil {
+		log.Fatalf("logout: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Logged out. Run \"tailscale up\" to log in again.\n")
+}
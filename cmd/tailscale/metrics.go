@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/clientmetrics"
+)
+
+// runMetrics is "tailscale metrics [prefix...]": it prints tailscaled's
+// counters and gauges, see package clientmetrics, optionally only
+// those whose names start with one of the prefixes, such as
+// "magicsock_". Like status, any local user may run it.
+func runMetrics(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale metrics")
+	set.SetParameters("[prefix...]")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	asJSON := set.BoolLong("json", 0, "print the metrics as JSON; same as --format=json")
+	format := set.StringLong("format", 0, "text", "output format: text, json, or prometheus for metrics scrapers")
+	set.Parse(append([]string{"tailscale metrics"}, args...))
+	if *asJSON {
+		*format = "json"
+	}
+	switch *format {
+	case "text", "json", "prometheus":
+	default:
+		log.Fatalf("--format: unknown format %q; want text, json or prometheus", *format)
+	}
+
+	var all []clientmetrics.Value
+	err := localAPIGet(*socket, "metrics", &all)
+	if e, ok := err.(*localAPIError); ok && e.code == http.StatusNotFound {
+		err = fmt.Errorf("tailscaled is too old to report metrics")
+	}
+	if err != nil {
+		log.Fatalf("metrics: %v", err)
+	}
+	ms := all[:0]
+	for _, m := range all {
+		if hasAnyPrefix(m.Name, set.Args()) {
+			ms = append(ms, m)
+		}
+	}
+
+	switch *format {
+	case "json":
+		printJSON(ms)
+	case "prometheus":
+		writeMetricsPrometheus(os.Stdout, ms)
+	default:
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, m := range ms {
+			fmt.Fprintf(tw, "%s\t%d\n", m.Name, m.Value)
+		}
+		tw.Flush()
+	}
+}
+
+// hasAnyPrefix reports whether s starts with one of prefixes, or
+// prefixes is empty.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return len(prefixes) == 0
+}
+
+// writeMetricsPrometheus writes ms as Prometheus metrics, for
+// "tailscale metrics --format=prometheus". Names are prefixed with
+// "tailscaled_", and counters get the "_total" suffix Prometheus
+// expects.
+func writeMetricsPrometheus(w io.Writer, ms []clientmetrics.Value) {
+	writeMetrics(&promWriter{w: w, seen: map[string]bool{}}, ms)
+}
+
+// writeMetrics writes ms to p, named as for writeMetricsPrometheus.
+func writeMetrics(p *promWriter, ms []clientmetrics.Value) {
+	for _, m := range ms {
+		name := "tailscaled_" + m.Name
+		if m.Type == "counter" {
+			name += "_total"
+		}
+		p.sample(name, m.Type, m.Help, float64(m.Value))
+	}
+}
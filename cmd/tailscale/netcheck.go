@@ -0,0 +1,262 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+// runNetcheck is "tailscale netcheck": it prints the result of
+// tailscaled's latest check of the local network's conditions, the
+// same one it reports to the control server. With --json, it prints
+// it as a tailcfg.NetInfo.
+//
+// With --monitor or --every, it has tailscaled check again and again,
+// and prints a line per check, marking what changed since the one
+// before. That shows up problems that come and go, such as UDP being
+// blocked now and then, a NAT remapping the node's address, or a
+// captive portal.
+func runNetcheck(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale netcheck")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	asJSON := set.BoolLong("json", 0, "print the report as JSON; with --monitor, a line per check")
+	monitor := set.BoolLong("monitor", 0, "keep checking, every 30s unless --every says otherwise")
+	everyStr := set.StringLong("every", 0, "", "keep checking at this interval, e.g. 1m (implies --monitor)")
+	set.Parse(append([]string{"tailscale netcheck"}, args...))
+	if len(set.Args()) > 0 {
+		log.Fatalf("too many non-flag arguments: %#v", set.Args()[0])
+	}
+	if *monitor || *everyStr != "" {
+		every := defaultNetcheckEvery
+		if *everyStr != "" {
+			var err error
+			every, err = time.ParseDuration(*everyStr)
+			if err != nil {
+				log.Fatalf("--every: %v", err)
+			}
+			if every < minNetcheckEvery {
+				log.Fatalf("--every must be at least %v", minNetcheckEvery)
+			}
+		}
+		monitorNetcheck(*socket, every, *asJSON)
+		return
+	}
+
+	st := new(ipnstate.Status)
+	if err := localAPIGet(*socket, "status", st); err != nil {
+		log.Fatalf("netcheck: %v", err)
+	}
+	if st.NetInfo == nil {
+		log.Fatalf("netcheck: tailscaled hasn't finished a network check yet")
+	}
+	if *asJSON {
+		printJSON(st.NetInfo)
+		return
+	}
+	printNetcheck(os.Stdout, st)
+}
+
+const (
+	defaultNetcheckEvery = 30 * time.Second
+	// minNetcheckEvery is how often tailscaled checks at most, for
+	// any number of callers.
+	minNetcheckEvery = 5 * time.Second
+)
+
+// netcheckRecord is a line of "tailscale netcheck --monitor --json".
+type netcheckRecord struct {
+	Time        time.Time
+	Error       string   `json:",omitempty"`
+	DERPHome    string   `json:",omitempty"`
+	MappedAddrs []string `json:",omitempty"`
+	*tailcfg.NetInfo
+}
+
+// monitorNetcheck has tailscaled check the network every interval,
+// forever, and prints a line about each check.
+func monitorNetcheck(socket string, every time.Duration, asJSON bool) {
+	var prev *ipnstate.Status
+	for {
+		now := time.Now()
+		st, err := netcheckOnce(socket)
+		switch {
+		case asJSON && err != nil:
+			printJSONLine(netcheckRecord{Time: now, Error: err.Error()})
+		case asJSON:
+			printJSONLine(netcheckRecord{Time: now, DERPHome: st.DERPHome, MappedAddrs: mappedAddrs(st), NetInfo: st.NetInfo})
+		case err != nil:
+			fmt.Printf("%s  error: %v\n", now.Format("15:04:05"), err)
+		default:
+			printNetcheckLine(os.Stdout, now, st, prev)
+		}
+		if err == nil {
+			prev = st
+		}
+		time.Sleep(time.Until(now.Add(every)))
+	}
+}
+
+// netcheckOnce has tailscaled check the network, and returns its
+// status afterwards.
+func netcheckOnce(socket string) (*ipnstate.Status, error) {
+	// tailscaled gives up on the check before this.
+	res, err := localAPIStream(socket, "POST", "netcheck", nil, 20*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	st := new(ipnstate.Status)
+	if err := json.NewDecoder(res.Body).Decode(st); err != nil {
+		return nil, err
+	}
+	if st.NetInfo == nil {
+		return nil, errors.New("no result")
+	}
+	return st, nil
+}
+
+// printNetcheckLine writes a line to w about st, the result of the
+// check at now, ending with what changed since prev, if non-nil.
+func printNetcheckLine(w io.Writer, now time.Time, st, prev *ipnstate.Status) {
+	ni := st.NetInfo
+	udp := "ok"
+	if ni.UDPBlocked {
+		udp = "BLOCKED"
+	}
+	mapped := mappedAddrs(st)
+	fmt.Fprintf(w, "%s  UDP %s  NAT %s  mapped %s  DERP %s  %s",
+		now.Format("15:04:05"), udp, orDash(ni.NATType), orDash(strings.Join(mapped, ",")),
+		orDash(st.DERPHome), fastestSTUN(ni, 3))
+	if prev != nil {
+		var changes []string
+		if ni.UDPBlocked != prev.NetInfo.UDPBlocked {
+			changes = append(changes, "UDP "+udp)
+		}
+		if ni.NATType != prev.NetInfo.NATType {
+			changes = append(changes, "NAT type")
+		}
+		if strings.Join(mapped, ",") != strings.Join(mappedAddrs(prev), ",") {
+			changes = append(changes, "mapped address")
+		}
+		if st.DERPHome != prev.DERPHome {
+			changes = append(changes, "DERP home")
+		}
+		if len(changes) > 0 {
+			fmt.Fprintf(w, "  <- changed: %s", strings.Join(changes, ", "))
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// fastestSTUN returns the latencies of the n STUN servers that
+// replied fastest, for a line of output.
+func fastestSTUN(ni *tailcfg.NetInfo, n int) string {
+	servers := stunByLatency(ni)
+	if len(servers) > n {
+		servers = servers[:n]
+	}
+	var ret []string
+	for _, s := range servers {
+		host := s
+		if h, _, err := net.SplitHostPort(s); err == nil {
+			host = h
+		}
+		ret = append(ret, fmt.Sprintf("%s %v", host, stunLatency(ni, s)))
+	}
+	return strings.Join(ret, " ")
+}
+
+// stunByLatency returns the STUN servers that replied in ni, fastest
+// first.
+func stunByLatency(ni *tailcfg.NetInfo) []string {
+	var servers []string
+	for s := range ni.STUNLatency {
+		servers = append(servers, s)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return ni.STUNLatency[servers[i]] < ni.STUNLatency[servers[j]]
+	})
+	return servers
+}
+
+func stunLatency(ni *tailcfg.NetInfo, server string) time.Duration {
+	d := time.Duration(ni.STUNLatency[server] * float64(time.Second))
+	return d.Round(100 * time.Microsecond)
+}
+
+// nonPublicNets are private address ranges. Endpoints in them are
+// local addresses, rather than ones a NAT mapped the node to.
+var nonPublicNets = []string{
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7",
+}
+
+// mappedAddrs returns this node's public endpoints in st, which the
+// STUN servers saw it at.
+func mappedAddrs(st *ipnstate.Status) []string {
+	var ret []string
+	for _, ep := range st.Self.Endpoints {
+		host, _, err := net.SplitHostPort(ep)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			continue
+		}
+		public := true
+		for _, s := range nonPublicNets {
+			if _, n, _ := net.ParseCIDR(s); n.Contains(ip) {
+				public = false
+			}
+		}
+		if public {
+			ret = append(ret, ep)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func printNetcheck(w io.Writer, st *ipnstate.Status) {
+	ni := st.NetInfo
+	fmt.Fprintf(w, "Report:\n")
+	fmt.Fprintf(w, "\t* UDP: %v\n", !ni.UDPBlocked)
+	fmt.Fprintf(w, "\t* NAT type: %s\n", orDash(ni.NATType))
+	fmt.Fprintf(w, "\t* Mapped address: %s\n", orDash(strings.Join(mappedAddrs(st), ", ")))
+	fmt.Fprintf(w, "\t* Nearest DERP: %s\n", orDash(st.DERPHome))
+	if len(ni.DERPLatency) > 0 {
+		fmt.Fprintf(w, "\t* DERP latencies:\n")
+		var ids []int
+		for id := range ni.DERPLatency {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			d := time.Duration(ni.DERPLatency[id] * float64(time.Second))
+			fmt.Fprintf(w, "\t\t- region %d: %v\n", id, d.Round(100*time.Microsecond))
+		}
+	}
+	if len(ni.STUNLatency) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\t* STUN latencies:\n")
+	for _, s := range stunByLatency(ni) {
+		fmt.Fprintf(w, "\t\t- %s: %v\n", s, stunLatency(ni, s))
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// runPing is "tailscale ping <peer>": it pings a peer and prints each
+// reply. Like status, any local user may run it. --type picks what
+// kind of ping, each answering a different question:
+//
+//	disco  path pings beneath WireGuard: is there a path to the
+//	       peer, and is it direct or through DERP? The default.
+//	tsmp   requests over the tunnel to the peer's tailscaled: does
+//	       WireGuard work both ways, does the peer know us, and
+//	       what does its packet filter let through?
+//	icmp   ICMP echo requests over the tunnel: does ordinary
+//	       traffic get through, past the peer's own firewall?
+//
+// With --json, it prints each result as an ipnstate.PingResult on a
+// line of its own, with Err set for pings that failed.
+func runPing(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale ping")
+	set.SetParameters("<hostname|IP|nickname>")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	count := set.IntLong("count", 'c', 10, "number of pings to send, or with --until-direct the most to send (0=unlimited)")
+	untilDirect := set.BoolLong("until-direct", 0, "keep pinging until a direct path is established")
+	asJSON := set.BoolLong("json", 0, "print each result as a line of JSON")
+	typ := set.StringLong("type", 0, "disco", "kind of ping: disco, tsmp or icmp")
+	set.Parse(append([]string{"tailscale ping"}, args...))
+	if len(set.Args()) != 1 {
+		set.PrintUsage(os.Stderr)
+		os.Exit(2)
+	}
+	peer := set.Args()[0]
+	switch *typ {
+	case "disco", "tsmp", "icmp":
+	default:
+		log.Fatalf("ping: unknown --type %q; want disco, tsmp or icmp", *typ)
+	}
+	if *untilDirect && *typ != "disco" {
+		log.Fatalf("ping: --until-direct needs --type=disco")
+	}
+	path := "ping?peer=" + url.QueryEscape(peer) + "&type=" + *typ
+	resType := *typ // as in PingResult.Type
+	if resType == "disco" {
+		resType = ""
+	}
+
+	direct, replied := false, false
+	for i := 0; *count == 0 || i < *count; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		res := new(ipnstate.PingResult)
+		err := localAPIGet(*socket, path, res)
+		if e, ok := err.(*localAPIError); ok && e.code == http.StatusGatewayTimeout {
+			if *asJSON {
+				printJSONLine(&ipnstate.PingResult{IP: peer, Type: resType, Err: "timeout"})
+			} else {
+				fmt.Printf("timeout waiting for %s\n", peer)
+			}
+			continue
+		}
+		if err != nil {
+			log.Fatalf("ping: %v", err)
+		}
+		if res.DERP == "" {
+			direct = true
+		}
+		if *asJSON {
+			printJSONLine(res)
+		} else {
+			printPong(res, !replied)
+		}
+		replied = true
+		if direct && *untilDirect {
+			return
+		}
+	}
+	if *untilDirect && !direct {
+		fmt.Fprintf(os.Stderr, "no direct path to %s after %d pings\n", peer, *count)
+		os.Exit(1)
+	}
+}
+
+// printPong prints the ping result res in the form for its type. For
+// TSMP pings, which all get the same verdicts, it prints those only
+// if verdicts is set.
+func printPong(res *ipnstate.PingResult, verdicts bool) {
+	latency := res.Latency.Round(100 * time.Microsecond)
+	switch res.Type {
+	case "tsmp":
+		fmt.Printf("pong from %s (%s) in %v; it sees us as %s\n", res.HostName, res.IP, latency, orDash(res.SeenAs))
+		if !verdicts {
+			return
+		}
+		var probes []string
+		for p := range res.Verdicts {
+			probes = append(probes, p)
+		}
+		sort.Strings(probes)
+		for _, p := range probes {
+			fmt.Printf("  %-10s %s\n", p, res.Verdicts[p])
+		}
+	case "icmp":
+		fmt.Printf("pong from %s (%s) via ICMP in %v\n", res.HostName, res.IP, latency)
+	default:
+		via := "DERP(" + res.DERP + ")"
+		if res.DERP == "" {
+			via = res.Endpoint
+		}
+		fmt.Printf("pong from %s (%s) via %s in %v\n", res.HostName, res.IP, via, latency)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tailscale.com/clientmetrics"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// promWriter writes metrics in the Prometheus text exposition
+// format, giving each metric's HELP and TYPE before its first sample.
+// All samples of a metric must be written together.
+type promWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+// sample writes one sample of metric name, of type typ with the given
+// help, and labels given as name, value pairs.
+func (p *promWriter) sample(name, typ, help string, v float64, labels ...string) {
+	if !p.seen[name] {
+		p.seen[name] = true
+		fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	var ls []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		ls = append(ls, fmt.Sprintf("%s=%q", labels[i], promEscape(labels[i+1])))
+	}
+	if len(ls) > 0 {
+		name += "{" + strings.Join(ls, ",") + "}"
+	}
+	fmt.Fprintf(p.w, "%s %v\n", name, v)
+}
+
+// promEscape prepares label value s for %q, which escapes
+// backslashes and quotes the way Prometheus wants, by dropping
+// control characters, which %q would escape in ways it doesn't.
+func promEscape(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writePrometheus writes st as Prometheus metrics, for
+// "tailscale status --format=prometheus", followed by the DERP
+// counters and gauges among ms, tailscaled's metrics. Metric and
+// label names are kept stable for dashboards and alerts.
+func writePrometheus(w io.Writer, st *ipnstate.Status, ms []clientmetrics.Value) {
+	p := &promWriter{w: w, seen: map[string]bool{}}
+
+	p.sample("tailscale_up", "gauge", "Whether the node is connected to the tailnet.", boolFloat(st.BackendState == "Running"))
+	p.sample("tailscale_backend_state", "gauge", "The backend's state, as a label.", 1, "state", st.BackendState)
+	p.sample("tailscale_paused", "gauge", "Whether network activity is paused.", boolFloat(st.Paused))
+	p.sample("tailscale_health_problems", "gauge", "Number of current health problems.", float64(len(st.Health)))
+	if st.KeyExpiresIn != 0 {
+		p.sample("tailscale_key_expiry_seconds", "gauge", "Seconds until the node key expires, negative once expired.", st.KeyExpiresIn.Seconds())
+	}
+	if st.DERPHome != "" {
+		p.sample("tailscale_derp_home", "gauge", "The DERP server this node is reachable through, as a label.", 1, "derp", st.DERPHome)
+	}
+	if ni := st.NetInfo; ni != nil {
+		p.sample("tailscale_udp_blocked", "gauge", "Whether the latest network check found UDP blocked.", boolFloat(ni.UDPBlocked))
+		var servers []string
+		for s := range ni.STUNLatency {
+			servers = append(servers, s)
+		}
+		sort.Strings(servers)
+		for _, s := range servers {
+			p.sample("tailscale_stun_latency_seconds", "gauge", "Round-trip time to each STUN server in the latest network check.", ni.STUNLatency[s], "server", s)
+		}
+		var regions []int
+		for id := range ni.DERPLatency {
+			regions = append(regions, id)
+		}
+		sort.Ints(regions)
+		for _, id := range regions {
+			p.sample("tailscale_derp_latency_seconds", "gauge", "Round-trip time to each DERP region in the latest network check.", ni.DERPLatency[id], "region", strconv.Itoa(id))
+		}
+	}
+
+	peers := st.Peers()
+	online := 0
+	relayed := 0
+	for _, ps := range peers {
+		if ps.Online {
+			online++
+		}
+		if ps.Relay != "" {
+			relayed++
+		}
+	}
+	p.sample("tailscale_peers", "gauge", "Number of peers in the network map.", float64(len(peers)))
+	p.sample("tailscale_peers_online", "gauge", "Number of peers that are online.", float64(online))
+	p.sample("tailscale_peers_relayed", "gauge", "Number of peers that packets go to through DERP.", float64(relayed))
+	perPeer := []struct {
+		name, typ, help string
+		value           func(*ipnstate.PeerStatus) (float64, bool)
+	}{
+		{"tailscale_peer_online", "gauge", "Whether the peer is online.", func(ps *ipnstate.PeerStatus) (float64, bool) {
+			return boolFloat(ps.Online), true
+		}},
+		{"tailscale_peer_direct", "gauge", "Whether packets to the peer go directly rather than through DERP.", func(ps *ipnstate.PeerStatus) (float64, bool) {
+			return boolFloat(ps.Direct()), true
+		}},
+		{"tailscale_peer_rx_bytes_total", "counter", "Bytes received from the peer.", func(ps *ipnstate.PeerStatus) (float64, bool) {
+			return float64(ps.RxBytes), true
+		}},
+		{"tailscale_peer_tx_bytes_total", "counter", "Bytes sent to the peer.", func(ps *ipnstate.PeerStatus) (float64, bool) {
+			return float64(ps.TxBytes), true
+		}},
+		{"tailscale_peer_last_handshake_timestamp_seconds", "gauge", "Unix time of the last WireGuard handshake with the peer.", func(ps *ipnstate.PeerStatus) (float64, bool) {
+			return float64(ps.LastHandshake.Unix()), !ps.LastHandshake.IsZero()
+		}},
+	}
+	for _, m := range perPeer {
+		for _, ps := range peers {
+			if v, ok := m.value(ps); ok {
+				p.sample(m.name, m.typ, m.help, v, "peer", ps.HostName, "ip", firstOr(ps.TailAddrs, ""))
+			}
+		}
+	}
+
+	var derp []clientmetrics.Value
+	for _, m := range ms {
+		if strings.Contains(m.Name, "derp") {
+			derp = append(derp, m)
+		}
+	}
+	writeMetrics(p, derp)
+}
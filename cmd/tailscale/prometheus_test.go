@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"tailscale.com/clientmetrics"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	st := &ipnstate.Status{
+		BackendState: "Running",
+		DERPHome:     "derp1.example.com",
+		NetInfo: &tailcfg.NetInfo{
+			DERPLatency: map[int]float64{2: 0.03, 1: 0.01},
+		},
+		Peer: map[tailcfg.NodeKey]*ipnstate.PeerStatus{
+			{1}: {HostName: "direct", TailAddrs: []string{"100.64.0.1"}, Online: true, CurAddr: "1.2.3.4:41641"},
+			{2}: {HostName: "relayed", TailAddrs: []string{"100.64.0.2"}, Online: true, CurAddr: "127.3.3.40:1", Relay: "derp1.example.com"},
+		},
+	}
+	ms := []clientmetrics.Value{
+		{Name: "derp_client_connects", Type: "counter", Help: "Connections made to DERP servers.", Value: 3},
+		{Name: "magicsock_derp_connections", Type: "gauge", Help: "Open connections to DERP servers.", Value: 1},
+		{Name: "magicsock_send_udp", Type: "counter", Help: "Packets sent directly to peers over UDP.", Value: 9},
+	}
+	var buf bytes.Buffer
+	writePrometheus(&buf, st, ms)
+	got := buf.String()
+
+	for _, want := range []string{
+		"tailscale_up 1\n",
+		`tailscale_derp_home{derp="derp1.example.com"} 1` + "\n",
+		`tailscale_derp_latency_seconds{region="1"} 0.01` + "\n",
+		`tailscale_derp_latency_seconds{region="2"} 0.03` + "\n",
+		"tailscale_peers_relayed 1\n",
+		`tailscale_peer_direct{peer="relayed",ip="100.64.0.2"} 0` + "\n",
+		"# TYPE tailscaled_derp_client_connects_total counter\n",
+		"tailscaled_derp_client_connects_total 3\n",
+		"# TYPE tailscaled_magicsock_derp_connections gauge\n",
+		"tailscaled_magicsock_derp_connections 1\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "magicsock_send_udp") {
+		t.Errorf("non-DERP metric written:\n%s", got)
+	}
+	if strings.Index(got, `region="1"`) > strings.Index(got, `region="2"`) {
+		t.Errorf("DERP regions out of order:\n%s", got)
+	}
+	if n := strings.Count(got, "# HELP tailscale_derp_latency_seconds "); n != 1 {
+		t.Errorf("HELP for tailscale_derp_latency_seconds written %d times", n)
+	}
+}
+
+func TestWritePrometheusNoMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	writePrometheus(&buf, &ipnstate.Status{BackendState: "Stopped"}, nil)
+	got := buf.String()
+	if !strings.Contains(got, "tailscale_up 0\n") {
+		t.Errorf("missing tailscale_up in:\n%s", got)
+	}
+	if strings.Contains(got, "tailscaled_") {
+		t.Errorf("metrics written without any:\n%s", got)
+	}
+}
+
+func TestPromEscape(t *testing.T) {
+	var buf bytes.Buffer
+	p := &promWriter{w: &buf, seen: map[string]bool{}}
+	p.sample("m", "gauge", "help", 1, "l", "a\"b\\c\nd")
+	want := "# HELP m help\n# TYPE m gauge\n" + `m{l="a\"b\\cd"} 1` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pborman/getopt/v2"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/ipn"
+)
+
+// runSet is "tailscale set": it changes only the settings whose flags
+// are given, leaving the rest as they are. "tailscale up" instead
+// sets every setting from its flags, so changing one setting with it
+// means repeating all the others.
+func runSet(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale set")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	exitNode := set.StringLong("exit-node", 0, "", "Tailscale IP, node ID or nickname of a peer to route Internet traffic through; empty for none")
+	hostname := set.StringLong("hostname", 0, "", "hostname to use instead of the one provided by the OS; empty for the OS's")
+	advroutes := set.ListLong("advertise-routes", 0, "routes to advertise to other nodes (comma-separated); empty for none")
+	operator := set.StringLong("operator", 0, "", "local user, other than root, allowed to change settings; empty for none (needs root)")
+	var acceptRoutes, acceptDNS, shieldsUp, advexit, checkUpdates, exitNodeDNS bool
+	set.FlagLong(&acceptRoutes, "accept-routes", 0, "accept subnet routes advertised by other nodes")
+	set.FlagLong(&acceptDNS, "accept-dns", 0, "apply DNS settings from the control server to the OS")
+	set.FlagLong(&shieldsUp, "shields-up", 0, "block all incoming connections")
+	set.FlagLong(&advexit, "advertise-exit-node", 0, "offer to be an exit node for other nodes' Internet traffic")
+	set.FlagLong(&checkUpdates, "check-updates", 0, "check daily for a newer release, shown in status; see 'tailscale update'")
+	set.FlagLong(&exitNodeDNS, "exit-node-dns", 0, "resolve names outside the tailnet through the exit node")
+	set.Parse(append([]string{"tailscale set"}, args...))
+	if len(set.Args()) > 0 {
+		log.Fatalf("too many non-flag arguments: %#v", set.Args()[0])
+	}
+	changed := false
+	set.Visit(func(o getopt.Option) {
+		if o.LongName() != "socket" {
+			changed = true
+		}
+	})
+	if !changed {
+		set.PrintUsage(os.Stderr)
+		os.Exit(2)
+	}
+
+	prefs := new(ipn.Prefs)
+	if err := localAPIGet(*socket, "prefs", prefs); err != nil {
+		log.Fatalf("set: %v", err)
+	}
+
+	if set.IsSet("exit-node") {
+		prefs.ExitNodeID, prefs.ExitNodeIP = 0, ""
+		if *exitNode != "" {
+			peer := *exitNode
+			if p, ok := prefs.Nicknames[peer]; ok {
+				peer = p
+			}
+			var ok bool
+			prefs.ExitNodeID, prefs.ExitNodeIP, ok = parsePeer(peer)
+			if !ok {
+				log.Fatalf("--exit-node: %q is not an IP address, node ID or nickname", *exitNode)
+			}
+		}
+	}
+	if set.IsSet("exit-node-dns") {
+		prefs.ExitNodeDNS = exitNodeDNS
+	}
+	if set.IsSet("hostname") {
+		if *hostname != "" {
+			if err := ipn.CheckHostname(*hostname); err != nil {
+				log.Fatalf("--hostname: %v", err)
+			}
+		}
+		prefs.Hostname = *hostname
+	}
+	if set.IsSet("operator") {
+		if *operator != "" {
+			if err := checkOperator(*operator); err != nil {
+				log.Fatal(err)
+			}
+		}
+		prefs.OperatorUser = *operator
+	}
+	if set.IsSet("accept-routes") {
+		prefs.RouteAll = acceptRoutes
+	}
+	if set.IsSet("accept-dns") {
+		prefs.CorpDNS = acceptDNS
+	}
+	if set.IsSet("shields-up") {
+		prefs.ShieldsUp = shieldsUp
+	}
+	if set.IsSet("check-updates") {
+		prefs.CheckUpdates = checkUpdates
+	}
+	if set.IsSet("advertise-routes") || set.IsSet("advertise-exit-node") {
+		// The two flags share AdvertiseRoutes, so each keeps
+		// what the other one said.
+		var routes []wgcfg.CIDR
+		for _, r := range prefs.AdvertiseRoutes {
+			if r.Mask != 0 {
+				routes = append(routes, r)
+			}
+		}
+		exit := prefs.AdvertisesExitNode()
+		if set.IsSet("advertise-routes") {
+			routes = nil
+			for _, s := range *advroutes {
+				if s == "" {
+					continue
+				}
+				cidr, err := wgcfg.ParseCIDR(s)
+				if err != nil {
+					log.Fatalf("%q is not a valid CIDR prefix: %v", s, err)
+				}
+				routes = append(routes, *cidr)
+			}
+			if err := checkAdvertiseRoutes(routes); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if set.IsSet("advertise-exit-node") {
+			exit = advexit
+		}
+		if exit {
+			for _, s := range exitNodeRoutes {
+				cidr, _ := wgcfg.ParseCIDR(s)
+				routes = append(routes, *cidr)
+			}
+		}
+		prefs.AdvertiseRoutes = routes
+	}
+	if prefs.AdvertisesExitNode() && (prefs.ExitNodeID != 0 || prefs.ExitNodeIP != "") {
+		log.Fatal("an exit node can't use another exit node: clear --exit-node or --advertise-exit-node")
+	}
+
+	if err := localAPIPost(*socket, "prefs", prefs, nil); err != nil {
+		log.Fatalf("set: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// runSSH is "tailscale ssh [user@]<peer> [ssh args...]": it runs the
+// system ssh to the peer's Tailscale IP, found by the names
+// findPeer accepts, so tailnet hosts need no /etc/hosts entries.
+//
+// Unless --no-pin is given, host keys are learned on first use and
+// then pinned to the peer's node ID, in a known_hosts file of their
+// own, rather than to an IP or name, which may change hands, or to
+// its node key, which changes when the key is rotated.
+func runSSH(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale ssh")
+	set.SetParameters("[user@]<peer> [ssh args...]")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	noPin := set.BoolLong("no-pin", 0, "check host keys against ssh's usual known_hosts instead of pinning them per node")
+	set.Parse(append([]string{"tailscale ssh"}, args...))
+	if len(set.Args()) == 0 {
+		set.PrintUsage(os.Stderr)
+		os.Exit(2)
+	}
+	target, rest := set.Args()[0], set.Args()[1:]
+	user, name := "", target
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		user, name = target[:i+1], target[i+1:]
+	}
+
+	st := new(ipnstate.Status)
+	if err := localAPIGet(*socket, "status", st); err != nil {
+		log.Fatalf("ssh: %v", err)
+	}
+	ps := findPeer(st, name)
+	if ps == nil {
+		log.Fatalf("ssh: no peer named %q", name)
+	}
+	ip := preferredIP(ps)
+	if ip == "" {
+		log.Fatalf("ssh: %s has no Tailscale IP", name)
+	}
+
+	sshPath, err := exec.LookPath("ssh")
+	if err != nil {
+		log.Fatalf("ssh: %v", err)
+	}
+	var sshArgs []string
+	if !*noPin {
+		if ps.ID == 0 {
+			log.Fatalf("ssh: tailscaled didn't report %s's node ID to pin its host key to; upgrade it, or use --no-pin", name)
+		}
+		knownHosts, err := sshKnownHostsFile()
+		if err != nil {
+			log.Fatalf("ssh: %v", err)
+		}
+		sshArgs = append(sshArgs,
+			"-o", "UserKnownHostsFile="+sshQuote(knownHosts),
+			"-o", fmt.Sprintf("HostKeyAlias=tailscale-node-%d", ps.ID),
+			"-o", "StrictHostKeyChecking=accept-new",
+		)
+	}
+	sshArgs = append(sshArgs, user+ip)
+	sshArgs = append(sshArgs, rest...)
+
+	cmd := exec.Command(sshPath, sshArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			os.Exit(ee.ExitCode())
+		}
+		log.Fatalf("ssh: %v", err)
+	}
+}
+
+// sshQuote returns s quoted, if need be, for ssh's parsing of an -o
+// option's value, which splits it at spaces and takes double quotes
+// and backslash escapes. The value is its own argument to ssh, so no
+// shell sees it.
+func sshQuote(s string) string {
+	if !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		if r == '"' || r == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// sshKnownHostsFile returns the path of the known_hosts file for
+// host keys pinned by "tailscale ssh", creating its directory.
+func sshKnownHostsFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "tailscale")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ssh_known_hosts"), nil
+}
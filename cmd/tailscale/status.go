@@ -0,0 +1,311 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/clientmetrics"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/safesocket"
+)
+
+// runStatus is "tailscale status": it prints this node's peers, as
+// reported by tailscaled's LocalAPI. It changes nothing, so any local
+// user may run it.
+func runStatus(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale status")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	asJSON := set.BoolLong("json", 0, "print the full status as JSON; same as --format=json")
+	format := set.StringLong("format", 0, "text", "output format: text, json, or prometheus for metrics scrapers")
+	active := set.BoolLong("active", 0, "only list peers that are online")
+	set.Parse(append([]string{"tailscale status"}, args...))
+	if len(set.Args()) > 0 {
+		log.Fatalf("too many non-flag arguments: %#v", set.Args()[0])
+	}
+	if *asJSON {
+		*format = "json"
+	}
+	switch *format {
+	case "text", "json", "prometheus":
+	default:
+		log.Fatalf("--format: unknown format %q; want text, json or prometheus", *format)
+	}
+
+	st := new(ipnstate.Status)
+	if err := localAPIGet(*socket, "status", st); err != nil {
+		log.Fatalf("status: %v", err)
+	}
+	switch *format {
+	case "json":
+		printJSON(st)
+	case "prometheus":
+		// DERP counters come from tailscaled's metrics, which
+		// older versions don't have; leave them out then.
+		var ms []clientmetrics.Value
+		if err := localAPIGet(*socket, "metrics", &ms); err != nil {
+			ms = nil
+		}
+		writePrometheus(os.Stdout, st, ms)
+	default:
+		printStatus(os.Stdout, st, *active, time.Now())
+	}
+}
+
+// printJSON writes v to stdout as indented JSON, for --json.
+//
+// The JSON output of the CLI commands is their result type from
+// ipnstate or tailcfg, whose documented fields are kept stable for
+// scripts: fields may be added, but not renamed or removed.
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
+
+// printJSONLine writes v to stdout as JSON on a single line, for the
+// --json output of commands that print a stream of results.
+func printJSONLine(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
+
+// localAPIGet fetches the LocalAPI resource path, relative to
+// /localapi/v0/, from tailscaled's socket, and decodes it into v.
+func localAPIGet(socket, path string, v interface{}) error {
+	return localAPIDo(socket, "GET", path, nil, v)
+}
+
+// localAPIPost POSTs body, JSON-encoded unless nil, to the LocalAPI
+// resource path, and decodes the reply into v unless v is nil.
+func localAPIPost(socket, path string, body, v interface{}) error {
+	return localAPIDo(socket, "POST", path, body, v)
+}
+
+func localAPIDo(socket, method, path string, body, v interface{}) error {
+	var rb io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rb = bytes.NewReader(bs)
+	}
+	out, err := localAPIRaw(socket, method, path, rb)
+	if err != nil {
+		return err
+	}
+	if v == nil || len(out) == 0 {
+		return nil
+	}
+	return json.Unmarshal(out, v)
+}
+
+// localAPIRaw sends a LocalAPI request and returns the reply's body
+// as is.
+func localAPIRaw(socket, method, path string, body io.Reader) ([]byte, error) {
+	res, err := localAPIStream(socket, method, path, body, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// localAPIStream sends a LocalAPI request and returns the successful
+// reply, for the caller to read and close. A timeout of zero means
+// none, for replies that may take a while to read.
+func localAPIStream(socket, method, path string, body io.Reader, timeout time.Duration) (*http.Response, error) {
+	var dialErr error
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				c, err := connect(socket)
+				dialErr = err
+				return c, err
+			},
+		},
+		Timeout: timeout,
+	}
+	// The host is ignored, the socket is dialed regardless.
+	req, err := http.NewRequest(method, "http://local-tailscaled.sock/localapi/v0/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := hc.Do(req)
+	if dialErr != nil {
+		// Already explained, and the URL would only confuse.
+		return nil, dialErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return nil, &localAPIError{res.StatusCode, strings.TrimSpace(string(msg))}
+	}
+	return res, nil
+}
+
+// connect connects to tailscaled's socket, explaining the usual
+// reasons it can't.
+func connect(socket string) (net.Conn, error) {
+	c, err := safesocket.Connect(socket, 0)
+	switch {
+	case err == nil:
+		return c, nil
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ECONNREFUSED):
+		return nil, fmt.Errorf("can't reach tailscaled at %s; is it running?", socket)
+	case errors.Is(err, os.ErrPermission):
+		return nil, fmt.Errorf("permission denied opening %s, tailscaled's socket; try again with sudo, or check the socket's permissions", socket)
+	}
+	return nil, err
+}
+
+// localAPIError is a LocalAPI request's failure status and message.
+type localAPIError struct {
+	code int
+	msg  string
+}
+
+func (e *localAPIError) Error() string { return e.msg }
+
+// printStatus writes st to w as a summary line and a table of peers,
+// all of them or, if activeOnly, those that are online.
+func printStatus(w io.Writer, st *ipnstate.Status, activeOnly bool, now time.Time) {
+	state := st.BackendState
+	if st.Paused {
+		state += " (paused)"
+	}
+	fmt.Fprintf(w, "%s %s %s\n", firstOr(st.Self.TailAddrs, "-"), st.Self.HostName, state)
+	for _, h := range st.Health {
+		fmt.Fprintf(w, "# health: %s\n", h)
+	}
+	if u := st.Update; u != nil && u.Available {
+		fmt.Fprintf(w, "# update: %s is available (running %s); see 'tailscale update'\n", u.Latest, u.Current)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tHOSTNAME\tOWNER\tOS\tPATH\tRX\tTX\tLAST SEEN")
+	for _, ps := range st.Peers() {
+		if activeOnly && !ps.Online {
+			continue
+		}
+		name := ps.HostName
+		if ps.Nickname != "" {
+			name = ps.Nickname + " (" + ps.HostName + ")"
+		}
+		if ps.ExitNode {
+			name += " [exit]"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			firstOr(ps.TailAddrs, "-"), name, peerOwner(st, ps), orDash(ps.OS),
+			peerPath(ps), formatBytes(ps.RxBytes), formatBytes(ps.TxBytes), lastSeen(ps, now))
+	}
+	tw.Flush()
+}
+
+// peerOwner is who ps belongs to: its tags if it has any, as tagged
+// nodes belong to no one in particular, or else its user's login
+// name.
+func peerOwner(st *ipnstate.Status, ps *ipnstate.PeerStatus) string {
+	if len(ps.Tags) > 0 {
+		return strings.Join(ps.Tags, ",")
+	}
+	if u, ok := st.User[ps.UserID]; ok && u.LoginName != "" {
+		return u.LoginName
+	}
+	if ps.UserID != 0 {
+		return fmt.Sprintf("user %d", ps.UserID)
+	}
+	return "-"
+}
+
+// peerPath is how packets get to ps: directly to an endpoint, or
+// through a DERP relay.
+func peerPath(ps *ipnstate.PeerStatus) string {
+	switch {
+	case ps.Direct():
+		return "direct " + ps.CurAddr
+	case ps.Relay != "":
+		return "relay " + ps.Relay
+	}
+	return "-"
+}
+
+// lastSeen is when ps was last known to be connected, by handshake
+// or by the control server's word.
+func lastSeen(ps *ipnstate.PeerStatus, now time.Time) string {
+	if ps.Online {
+		return "now"
+	}
+	t := ps.LastHandshake
+	if ps.LastSeen.After(t) {
+		t = ps.LastSeen
+	}
+	if t.IsZero() {
+		return "never"
+	}
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d/time.Minute))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d/time.Hour))
+	}
+	return fmt.Sprintf("%dd ago", int(d/(24*time.Hour)))
+}
+
+// formatBytes formats n with a binary unit suffix, such as "1.5MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func firstOr(ss []string, def string) string {
+	if len(ss) == 0 {
+		return def
+	}
+	return ss[0]
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
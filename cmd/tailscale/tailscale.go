@@ -13,16 +13,37 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/apenwarr/fixconsole"
 	"github.com/pborman/getopt/v2"
 	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn"
 	"tailscale.com/logpolicy"
+	"tailscale.com/nas"
 	"tailscale.com/safesocket"
+	"tailscale.com/tailcfg"
 )
 
+// defaultSocket is where the commands find tailscaled unless given
+// --socket: the default instance's socket, or another chosen with
+// the global flags, see parseGlobalFlags.
+var defaultSocket = platformSocket()
+
+// platformSocket returns the default instance's socket: where its NAS
+// package puts it on Synology and QNAP, see package nas, and
+// otherwise where the Linux packages do.
+func platformSocket() string {
+	if s := nas.Detect().SocketPath(); s != "" {
+		return s
+	}
+	return safesocket.InstanceSocket("")
+}
+
 // globalStateKey is the ipn.StateKey that tailscaled loads on
 // startup.
 //
@@ -46,18 +67,117 @@ func pump(ctx context.Context, bc *ipn.BackendClient, conn net.Conn) {
 	}
 }
 
+// parsePeer parses s, a reference to a peer by one of its Tailscale
+// IPs or its node ID, returning whichever it is.
+func parsePeer(s string) (id tailcfg.NodeID, ip string, ok bool) {
+	if pip := net.ParseIP(s); pip != nil {
+		return 0, pip.String(), true
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+		return tailcfg.NodeID(n), "", true
+	}
+	return 0, "", false
+}
+
 func main() {
 	err := fixconsole.FixConsoleIfNeeded()
 	if err != nil {
 		log.Printf("fixConsoleOutput: %v\n", err)
 	}
 
-	socket := getopt.StringLong("socket", 0, "/run/tailscale/tailscaled.sock", "path of tailscaled's unix socket")
-	server := getopt.StringLong("server", 's', "https://login.tailscale.com", "URL to tailcontrol server")
+	os.Args = parseGlobalFlags(os.Args)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "status":
+			runStatus(os.Args[2:])
+			return
+		case "ping":
+			runPing(os.Args[2:])
+			return
+		case "down":
+			runDown(os.Args[2:])
+			return
+		case "set":
+			runSet(os.Args[2:])
+			return
+		case "logout":
+			runLogout(os.Args[2:])
+			return
+		case "netcheck":
+			runNetcheck(os.Args[2:])
+			return
+		case "metrics":
+			runMetrics(os.Args[2:])
+			return
+		case "bugreport":
+			runBugreport(os.Args[2:])
+			return
+		case "version":
+			runVersion(os.Args[2:])
+			return
+		case "update":
+			runUpdate(os.Args[2:])
+			return
+		case "debug":
+			runDebug(os.Args[2:])
+			return
+		case "ip":
+			runIP(os.Args[2:])
+			return
+		case "file":
+			runFile(os.Args[2:])
+			return
+		case "ssh":
+			runSSH(os.Args[2:])
+			return
+		case "instances":
+			runInstances(os.Args[2:])
+			return
+		case "up":
+			// Plain "tailscale" with flags is "tailscale up".
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
+	socket := getopt.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	loginServer := getopt.StringLong("login-server", 0, ipn.DefaultControlURL, "base URL of the control server, for self-hosted control")
+	server := getopt.StringLong("server", 's', "", "deprecated alias for --login-server")
+	proxy := getopt.StringLong("proxy", 0, "", "HTTP(S) proxy for reaching the tailcontrol server (default: $HTTPS_PROXY)")
+	controlPins := getopt.ListLong("login-server-pins", 0, "TLS key pins for the control server, a primary and a backup (comma-separated sha256/<base64> hashes)")
 	nuroutes := getopt.BoolLong("no-single-routes", 'N', "disallow (non-subnet) routes to single nodes")
-	routeall := getopt.BoolLong("remote-routes", 'R', "accept routes advertised by remote nodes")
+	acceptRoutes := getopt.BoolLong("accept-routes", 0, "accept subnet routes advertised by other nodes")
+	routeall := getopt.BoolLong("remote-routes", 'R', "deprecated alias for --accept-routes")
+	routeAllow := getopt.ListLong("route-allow", 0, "with --accept-routes, only accept routes within these prefixes (comma-separated, e.g. 10.0.0.0/8)")
+	routeDeny := getopt.ListLong("route-deny", 0, "with --accept-routes, never accept routes overlapping these prefixes (comma-separated)")
+	exitNode := getopt.StringLong("exit-node", 0, "", "Tailscale IP, node ID or nickname of a peer to route Internet traffic through")
+	exitNodeDNS := getopt.BoolLong("exit-node-dns", 0, "with --exit-node, resolve names outside the tailnet through the exit node; the ACLs must accept this node's traffic to the exit node's port 53")
+	nicknames := getopt.ListLong("nickname", 0, "local names for peers (comma-separated name=IP or name=node ID, e.g. nas=100.101.102.103)")
+	acceptDNS := true
+	getopt.FlagLong(&acceptDNS, "accept-dns", 0, "apply DNS settings from the control server to the OS (--accept-dns=false to keep your own resolvers)")
 	nopf := getopt.BoolLong("no-packet-filter", 'F', "disable packet filter")
-	advroutes := getopt.ListLong("routes", 'r', "routes to advertise to other nodes (comma-separated, e.g. 10.0.0.0/8,192.168.1.0/24)")
+	shieldsUp := getopt.BoolLong("shields-up", 0, "block all incoming connections")
+	advroutes := getopt.ListLong("advertise-routes", 0, "routes to advertise to other nodes (comma-separated, e.g. 10.0.0.0/8,192.168.1.0/24)")
+	oldroutes := getopt.ListLong("routes", 'r', "deprecated alias for --advertise-routes")
+	advexit := getopt.BoolLong("advertise-exit-node", 0, "offer to be an exit node for other nodes' Internet traffic")
+	advtags := getopt.ListLong("advertise-tags", 0, "ACL tags to request for this node (comma-separated, e.g. tag:server)")
+	authkey := getopt.StringLong("authkey", 0, "", "node authorization key, to log in without a browser")
+	ephemeral := getopt.BoolLong("ephemeral", 0, "register as an ephemeral node, removed when it goes offline")
+	peertags := getopt.ListLong("peer-tags", 0, "only talk to peers with one of these tags (comma-separated, e.g. tag:server)")
+	peerusers := getopt.ListLong("peer-users", 0, "only talk to peers owned by one of these users (comma-separated login names)")
+	hostname := getopt.StringLong("hostname", 0, "", "hostname to use instead of the one provided by the OS")
+	hideServices := getopt.BoolLong("hide-services", 0, "don't report this node's listening services to the control server")
+	svcInclude := getopt.ListLong("services-include", 0, "only report services matching these rules (comma-separated, e.g. tcp:22,8000-8999,proc:nginx)")
+	svcExclude := getopt.ListLong("services-exclude", 0, "never report services matching these rules (comma-separated, e.g. udp:*,proc:postgres)")
+	reportHealth := getopt.BoolLong("report-health", 0, "periodically send health and connectivity stats to the control server")
+	checkUpdates := getopt.BoolLong("check-updates", 0, "check daily for a newer release, shown in status; see 'tailscale update'")
+	operator := getopt.StringLong("operator", 0, "", "local user, other than root, allowed to change settings through tailscaled")
+	unattended := getopt.BoolLong("unattended", 0, "keep running after the GUI quits or the user logs out (Windows)")
+	reset := getopt.BoolLong("reset", 0, "reset settings whose flags are left out to their defaults, instead of refusing to change them")
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		// Handled here, to see up's flags.
+		runCompletion(os.Args[2:])
+		return
+	}
 	getopt.Parse()
 	pol := logpolicy.New("tailnode.log.tailscale.io")
 	if len(getopt.Args()) > 0 {
@@ -66,28 +186,146 @@ func main() {
 
 	defer pol.Close()
 
-	var adv []wgcfg.CIDR
-	for _, s := range *advroutes {
-		cidr, err := wgcfg.ParseCIDR(s)
-		if err != nil {
-			log.Fatalf("%q is not a valid CIDR prefix: %v", s, err)
+	parseCIDRs := func(ss []string) []wgcfg.CIDR {
+		var ret []wgcfg.CIDR
+		for _, s := range ss {
+			cidr, err := wgcfg.ParseCIDR(s)
+			if err != nil {
+				log.Fatalf("%q is not a valid CIDR prefix: %v", s, err)
+			}
+			ret = append(ret, *cidr)
+		}
+		return ret
+	}
+	adv := parseCIDRs(append(*advroutes, *oldroutes...))
+	if err := checkAdvertiseRoutes(adv); err != nil {
+		log.Fatal(err)
+	}
+	if *advexit {
+		adv = append(adv, parseCIDRs(exitNodeRoutes)...)
+	}
+
+	for _, tag := range *advtags {
+		if err := tailcfg.CheckTag(tag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	nicks := map[string]string{}
+	for _, nn := range *nicknames {
+		i := strings.Index(nn, "=")
+		if i < 0 {
+			log.Fatalf("--nickname: %q is not of the form name=peer", nn)
+		}
+		name, peer := nn[:i], nn[i+1:]
+		if err := ipn.CheckNickname(name); err != nil {
+			log.Fatalf("--nickname: %v", err)
+		}
+		if _, _, ok := parsePeer(peer); !ok {
+			log.Fatalf("--nickname: %q is neither an IP address nor a node ID", peer)
+		}
+		nicks[name] = peer
+	}
+
+	var exitNodeID tailcfg.NodeID
+	var exitNodeIP string
+	if *exitNode != "" {
+		peer := *exitNode
+		if p, ok := nicks[peer]; ok {
+			peer = p
+		}
+		var ok bool
+		exitNodeID, exitNodeIP, ok = parsePeer(peer)
+		if !ok {
+			log.Fatalf("--exit-node: %q is not an IP address, node ID or nickname", *exitNode)
+		}
+		if *advexit {
+			log.Fatal("--exit-node and --advertise-exit-node can't be used together: an exit node must reach the Internet itself")
+		}
+	}
+	if *hostname != "" {
+		if err := ipn.CheckHostname(*hostname); err != nil {
+			log.Fatalf("--hostname: %v", err)
+		}
+	}
+
+	for _, rule := range append(*svcInclude, *svcExclude...) {
+		if err := ipn.CheckServiceRule(rule); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *server != "" {
+		*loginServer = *server
+	}
+	if err := controlclient.CheckServerURL(*loginServer); err != nil {
+		log.Fatal(err)
+	}
+	if len(*controlPins) == 1 {
+		log.Fatal("--login-server-pins needs a backup pin as well as the primary one")
+	}
+	for _, pin := range *controlPins {
+		if err := controlclient.CheckPin(pin); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *operator != "" {
+		if err := checkOperator(*operator); err != nil {
+			log.Fatal(err)
 		}
-		adv = append(adv, *cidr)
 	}
 
 	// TODO(apenwarr): fix different semantics between prefs and uflags
-	// TODO(apenwarr): allow setting/using CorpDNS
 	prefs := ipn.NewPrefs()
-	prefs.ControlURL = *server
+	prefs.ControlURL = strings.TrimRight(*loginServer, "/")
+	prefs.ControlProxy = *proxy
+	prefs.ControlPins = *controlPins
 	prefs.WantRunning = true
-	prefs.RouteAll = *routeall
+	prefs.RouteAll = *acceptRoutes || *routeall
+	prefs.RouteAllow = parseCIDRs(*routeAllow)
+	prefs.RouteDeny = parseCIDRs(*routeDeny)
+	prefs.ExitNodeID = exitNodeID
+	prefs.ExitNodeIP = exitNodeIP
+	prefs.ExitNodeDNS = *exitNodeDNS
 	prefs.AllowSingleHosts = !*nuroutes
+	prefs.CorpDNS = acceptDNS
 	prefs.UsePacketFilter = !*nopf
+	prefs.ShieldsUp = *shieldsUp
 	prefs.AdvertiseRoutes = adv
+	prefs.AdvertiseTags = *advtags
+	prefs.PeerTags = *peertags
+	prefs.PeerUsers = *peerusers
+	prefs.Nicknames = nicks
+	prefs.Hostname = *hostname
+	prefs.HideServices = *hideServices
+	prefs.ServiceInclude = *svcInclude
+	prefs.ServiceExclude = *svcExclude
+	prefs.ReportHealth = *reportHealth
+	prefs.CheckUpdates = *checkUpdates
+	prefs.OperatorUser = *operator
+	prefs.ForceDaemon = *unattended
+
+	if !*reset {
+		// A backend that hasn't started yet has no prefs to lose.
+		cur := new(ipn.Prefs)
+		if localAPIGet(*socket, "prefs", cur) == nil {
+			if onlySocketFlag() {
+				// A bare "tailscale up", such as after
+				// "tailscale down", keeps every setting.
+				prefs = cur
+				prefs.WantRunning = true
+			} else {
+				isSet := func(flag string) bool { return getopt.IsSet(flag) }
+				if err := checkReverts(cur, prefs, isSet); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
 
-	c, err := safesocket.Connect(*socket, 0)
+	c, err := connect(*socket)
 	if err != nil {
-		log.Fatalf("safesocket.Connect: %v\n", err)
+		log.Fatal(err)
 	}
 	clientToServer := func(b []byte) {
 		ipn.WriteMsg(c, b)
@@ -106,23 +344,38 @@ func main() {
 	bc := ipn.NewBackendClient(log.Printf, clientToServer)
 	bc.SetPrefs(prefs)
 	opts := ipn.Options{
-		StateKey: globalStateKey,
+		StateKey:  globalStateKey,
+		AuthKey:   *authkey,
+		Ephemeral: *ephemeral,
 		Notify: func(n ipn.Notify) {
 			if n.ErrMessage != nil {
 				log.Fatalf("backend error: %v\n", *n.ErrMessage)
 			}
+			if e := n.Error; e != nil && !e.Critical && e.Code != ipn.ErrAuthExpired {
+				// Key expiry has its own message below.
+				fmt.Fprintf(os.Stderr, "\nWarning: %s\n\n", e.Message)
+			}
 			if s := n.State; s != nil {
 				switch *s {
 				case ipn.NeedsLogin:
-					bc.StartLoginInteractive()
+					if *authkey == "" {
+						bc.StartLoginInteractive()
+					}
 				case ipn.NeedsMachineAuth:
-					fmt.Fprintf(os.Stderr, "\nTo authorize your machine, visit (as admin):\n\n\t%s/admin/machines\n\n", *server)
+					fmt.Fprintf(os.Stderr, "\nTo authorize your machine, visit (as admin):\n\n\t%s/admin/machines\n\n", prefs.ControlURL)
 				case ipn.Starting, ipn.Running:
 					// Done full authentication process
 					fmt.Fprintf(os.Stderr, "\ntailscaled is authenticated, nothing more to do.\n\n")
 					cancel()
 				}
 			}
+			if e := n.KeyExpiry; e != nil {
+				if time.Until(*e) > 0 {
+					fmt.Fprintf(os.Stderr, "\nWarning: this node's key expires at %v. Re-authenticate before then to stay connected.\n\n", e.Local().Format(time.RFC1123))
+				} else {
+					fmt.Fprintf(os.Stderr, "\nThis node's key has expired; log in again to reconnect.\n\n")
+				}
+			}
 			if url := n.BrowseToURL; url != nil {
 				fmt.Fprintf(os.Stderr, "\nTo authenticate, visit:\n\n\t%s\n\n", *url)
 			}
@@ -0,0 +1,116 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/pborman/getopt/v2"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/ipn"
+)
+
+// exitNodeRoutes are what --advertise-exit-node advertises: default
+// routes for IPv4 and IPv6.
+var exitNodeRoutes = []string{"0.0.0.0/0", "::/0"}
+
+// checkAdvertiseRoutes returns an error if routes, from
+// --advertise-routes, has a route that is better said another way.
+func checkAdvertiseRoutes(routes []wgcfg.CIDR) error {
+	for _, r := range routes {
+		if r.Mask == 0 {
+			return fmt.Errorf("--advertise-routes: use --advertise-exit-node to advertise the default route %v", r)
+		}
+		n := r.IPNet()
+		if base := n.IP.Mask(n.Mask); !base.Equal(n.IP) {
+			return fmt.Errorf("--advertise-routes: %v has bits set past its prefix; did you mean %v/%d?", r, base, r.Mask)
+		}
+	}
+	return nil
+}
+
+// checkOperator returns an error unless name, from --operator, is a
+// local user's name or ID.
+func checkOperator(name string) error {
+	if _, err := user.Lookup(name); err == nil {
+		return nil
+	}
+	if _, err := user.LookupId(name); err == nil {
+		return nil
+	}
+	return fmt.Errorf("--operator: no such user %q", name)
+}
+
+// upSetting is a pref that "tailscale up" sets from a flag, and which
+// it resets to the flag's default whenever the flag is left out.
+type upSetting struct {
+	flag    string
+	aliases []string                  // deprecated names of flag
+	value   func(p *ipn.Prefs) string // the flag's value that gives p
+}
+
+var upSettings = []upSetting{
+	{"advertise-routes", []string{"routes"}, func(p *ipn.Prefs) string {
+		var rs []string
+		for _, r := range p.AdvertiseRoutes {
+			if r.Mask != 0 {
+				rs = append(rs, r.String())
+			}
+		}
+		return strings.Join(rs, ",")
+	}},
+	{"advertise-exit-node", nil, func(p *ipn.Prefs) string { return strconv.FormatBool(p.AdvertisesExitNode()) }},
+	{"exit-node", nil, func(p *ipn.Prefs) string {
+		if p.ExitNodeID != 0 {
+			return strconv.FormatInt(int64(p.ExitNodeID), 10)
+		}
+		return p.ExitNodeIP
+	}},
+	{"exit-node-dns", nil, func(p *ipn.Prefs) string { return strconv.FormatBool(p.ExitNodeDNS) }},
+	{"hostname", nil, func(p *ipn.Prefs) string { return p.Hostname }},
+	{"accept-routes", []string{"remote-routes"}, func(p *ipn.Prefs) string { return strconv.FormatBool(p.RouteAll) }},
+	{"accept-dns", nil, func(p *ipn.Prefs) string { return strconv.FormatBool(p.CorpDNS) }},
+	{"shields-up", nil, func(p *ipn.Prefs) string { return strconv.FormatBool(p.ShieldsUp) }},
+}
+
+// checkReverts returns an error if prefs, built from "tailscale up"'s
+// flags, would silently change one of the upSettings in cur, the
+// backend's current prefs, because its flag was left out. isSet
+// reports whether a flag was given.
+func checkReverts(cur, prefs *ipn.Prefs, isSet func(flag string) bool) error {
+	var missing []string
+	for _, s := range upSettings {
+		given := isSet(s.flag)
+		for _, a := range s.aliases {
+			given = given || isSet(a)
+		}
+		if given {
+			continue
+		}
+		if v := s.value(cur); v != s.value(prefs) {
+			missing = append(missing, fmt.Sprintf("--%s=%s", s.flag, v))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("'tailscale up' sets every setting, and leaving out these flags would change the current ones:\n\n\t%s\n\nGive them again to keep the current settings, pass --reset to change them to the defaults, or use 'tailscale set' to change only some settings", strings.Join(missing, " "))
+}
+
+// onlySocketFlag reports whether "tailscale up" was run with no flags
+// besides --socket, meaning the user wants to bring the node back up
+// as it was.
+func onlySocketFlag() bool {
+	only := true
+	getopt.Visit(func(o getopt.Option) {
+		if o.LongName() != "socket" {
+			only = false
+		}
+	})
+	return only
+}
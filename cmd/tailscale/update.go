@@ -0,0 +1,91 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/updates"
+)
+
+// runUpdate is "tailscale update": it asks tailscaled whether a newer
+// release is out and, unless only checking, installs it the way
+// tailscale was installed, such as with the package manager. Checking
+// is open to anyone; installing needs root.
+func runUpdate(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale update")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	checkOnly := set.BoolLong("check", 0, "only say whether an update is available, without installing it")
+	asJSON := set.BoolLong("json", 0, "print the check's result as JSON; implies --check")
+	yes := set.BoolLong("yes", 'y', "install the update without asking first")
+	track := set.StringLong("track", 0, "", "release track to update from, stable or unstable (default: the running version's)")
+	set.Parse(append([]string{"tailscale update"}, args...))
+	if len(set.Args()) > 0 {
+		log.Fatalf("too many non-flag arguments: %#v", set.Args()[0])
+	}
+	path := "update/check"
+	if *track != "" {
+		if err := updates.CheckTrack(*track); err != nil {
+			log.Fatalf("--track: %v", err)
+		}
+		path += "?track=" + url.QueryEscape(*track)
+	}
+
+	info := new(ipnstate.UpdateInfo)
+	err := localAPIPost(*socket, path, nil, info)
+	if e, ok := err.(*localAPIError); ok && e.code == http.StatusNotFound {
+		err = fmt.Errorf("tailscaled is too old to check for updates")
+	}
+	if err != nil {
+		log.Fatalf("update: %v", err)
+	}
+	if *asJSON {
+		printJSON(info)
+		return
+	}
+	if !info.Available {
+		fmt.Printf("No update available: running %s, and the latest %s release is %s.\n", info.Current, info.Track, info.Latest)
+		return
+	}
+	fmt.Printf("Update available: %s to %s (%s).\n", info.Current, info.Latest, info.Track)
+	if *checkOnly {
+		return
+	}
+
+	if runtime.GOOS != "windows" && os.Geteuid() != 0 {
+		log.Fatal("installing updates needs root; run 'sudo tailscale update'")
+	}
+	if !*yes && !confirm("Install it?") {
+		fmt.Println("Not updated.")
+		return
+	}
+	if err := updates.Install(context.Background(), info, os.Stdout); err != nil {
+		log.Fatalf("update: %v", err)
+	}
+	fmt.Println("Update installed. 'tailscale version' shows the version tailscaled now runs.")
+}
+
+// confirm asks the user question on stdout, and reports whether they
+// answered yes.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
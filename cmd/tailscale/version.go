@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+
+	"github.com/pborman/getopt/v2"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/version"
+)
+
+// versionReport is the --json output of "tailscale version".
+type versionReport struct {
+	Client ipnstate.VersionInfo
+	// Daemon is the running tailscaled's version, or nil if it
+	// couldn't be asked; then DaemonErr says why.
+	Daemon    *ipnstate.VersionInfo `json:",omitempty"`
+	DaemonErr string                `json:",omitempty"`
+	// Mismatch is set if the client and daemon versions differ.
+	Mismatch bool
+}
+
+// runVersion is "tailscale version": it prints the versions of the
+// CLI and of the running tailscaled, and warns if they differ, as a
+// mismatched pair is behind many confusing protocol errors.
+func runVersion(args []string) {
+	set := getopt.New()
+	set.SetProgram("tailscale version")
+	socket := set.StringLong("socket", 0, defaultSocket, "path of tailscaled's unix socket")
+	clientOnly := set.BoolLong("client", 0, "only print the CLI's version, without asking tailscaled")
+	asJSON := set.BoolLong("json", 0, "print the versions as JSON")
+	set.Parse(append([]string{"tailscale version"}, args...))
+	if len(set.Args()) > 0 {
+		log.Fatalf("too many non-flag arguments: %#v", set.Args()[0])
+	}
+
+	r := versionReport{
+		Client: ipnstate.VersionInfo{
+			Version:         version.LONG,
+			ProtocolVersion: ipn.ProtocolVersion,
+			OS:              runtime.GOOS,
+			Arch:            runtime.GOARCH,
+		},
+	}
+	if !*clientOnly {
+		dv := new(ipnstate.VersionInfo)
+		err := localAPIGet(*socket, "version", dv)
+		if e, ok := err.(*localAPIError); ok && e.code == http.StatusNotFound {
+			err = fmt.Errorf("tailscaled is too old to report its version")
+		}
+		if err != nil {
+			r.DaemonErr = err.Error()
+		} else {
+			r.Daemon = dv
+			r.Mismatch = dv.Version != r.Client.Version
+		}
+	}
+
+	if *asJSON {
+		printJSON(&r)
+	} else {
+		fmt.Printf("client: %s (%s/%s)\n", r.Client.Version, r.Client.OS, r.Client.Arch)
+		switch {
+		case r.Daemon != nil:
+			fmt.Printf("daemon: %s (%s/%s)\n", r.Daemon.Version, r.Daemon.OS, r.Daemon.Arch)
+		case r.DaemonErr != "":
+			fmt.Printf("daemon: unknown (%s)\n", r.DaemonErr)
+		}
+	}
+	if r.Mismatch {
+		msg := "tailscale and tailscaled versions differ; upgrade the older one so that they match."
+		if r.Daemon.ProtocolVersion != r.Client.ProtocolVersion {
+			msg = fmt.Sprintf("tailscale and tailscaled speak different protocol versions (%d and %d), so most commands will fail; upgrade the older one so that they match.", r.Client.ProtocolVersion, r.Daemon.ProtocolVersion)
+		}
+		fmt.Fprintf(os.Stderr, "\nWARNING: %s\n\n", msg)
+	}
+}
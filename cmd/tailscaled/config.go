@@ -0,0 +1,119 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+// daemonConfig is the --config file, a JSON object such as:
+//
+//	{
+//		"Port": 41641,
+//		"State": "/var/lib/tailscale/tailscaled.state",
+//		"Tun": "tailscale0",
+//		"Debug": "127.0.0.1:8080",
+//		"Prefs": {"RouteAll": true, "AdvertiseTags": ["tag:server"]}
+//	}
+//
+// Every field is optional, and flags given on the command line
+// override the file. Prefs are the ipn.Prefs a node starts with when
+// it has no saved state; after that, "tailscale up" changes them.
+//
+// On SIGHUP the daemon re-reads the file. Debug and Prefs take effect
+// at once: the debug server moves, starts or stops, and a node that
+// hasn't saved its state yet switches to the new Prefs. Port, State,
+// Tun and Socket only change on restart.
+type daemonConfig struct {
+	Port   *uint16 // nil to keep the flag's default, as 0 means autoselect
+	State  string
+	Tun    string
+	Socket string
+	Debug  string
+	Prefs  *ipn.Prefs
+}
+
+// loadConfig reads the daemonConfig in the file at path. Unknown
+// fields are an error, so that typos don't go unnoticed.
+func loadConfig(path string) (*daemonConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Decode Prefs on top of the defaults, so that the file only
+	// needs to list the ones it changes.
+	cfg := &daemonConfig{Prefs: ipn.NewPrefs()}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if cfg.Prefs != nil && cfg.Prefs.Persist != nil {
+		return nil, fmt.Errorf("%s: Prefs can't hold node keys", path)
+	}
+	return cfg, nil
+}
+
+// reloadConfig re-reads the config file at path on SIGHUP, and returns
+// it, or old if it's no longer valid, for the caller to apply Debug
+// and Prefs. The other settings can't change while the daemon runs,
+// so it only logs those that differ from old and wait for a restart.
+func reloadConfig(logf logger.Logf, path string, old *daemonConfig) *daemonConfig {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		logf("config: not reloaded: %v\n", err)
+		return old
+	}
+	var restart []string
+	if (cfg.Port == nil) != (old.Port == nil) || (cfg.Port != nil && *cfg.Port != *old.Port) {
+		restart = append(restart, "Port")
+	}
+	for _, f := range []struct {
+		name     string
+		old, new string
+	}{
+		{"State", old.State, cfg.State},
+		{"Tun", old.Tun, cfg.Tun},
+		{"Socket", old.Socket, cfg.Socket},
+	} {
+		if f.old != f.new {
+			restart = append(restart, f.name)
+		}
+	}
+	if len(restart) > 0 {
+		logf("config: %v changed, and take effect on restart\n", restart)
+	}
+	if !cfg.Prefs.Equals(old.Prefs) {
+		logf("config: Prefs changed; they only apply to a node without saved state, use \"tailscale up\" to change saved ones\n")
+	}
+	return cfg
+}
+
+// sets reports whether c, which may be nil, gives the setting of the
+// command-line flag named flag.
+func (c *daemonConfig) sets(flag string) bool {
+	if c == nil {
+		return false
+	}
+	switch flag {
+	case "port":
+		return c.Port != nil
+	case "state":
+		return c.State != ""
+	case "tun":
+		return c.Tun != ""
+	case "socket":
+		return c.Socket != ""
+	case "debug":
+		return c.Debug != ""
+	}
+	return false
+}
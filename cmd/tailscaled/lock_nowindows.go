@@ -0,0 +1,37 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockState takes an exclusive lock on the state file at path, by
+// locking a file next to it, so that two tailscaleds can't share
+// state: they'd fight over the node's keys. The lock goes away with
+// the process, however it exits. The returned func releases it
+// earlier.
+func lockState(path string) (unlock func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("state %s is in use by another tailscaled; give each one its own --state, or use --instance", path)
+		}
+		return nil, fmt.Errorf("locking state %s: %v", path, err)
+	}
+	return func() { f.Close() }, nil
+}
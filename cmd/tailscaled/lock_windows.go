@@ -0,0 +1,11 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// lockState does nothing on Windows, where tailscaled runs once, as
+// the service.
+func lockState(path string) (unlock func(), err error) {
+	return func() {}, nil
+}
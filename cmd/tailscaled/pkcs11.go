@@ -0,0 +1,34 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build cgo
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"tailscale.com/control/controlclient"
+)
+
+// registerPKCS11 registers the token labeled token, in the PKCS#11
+// library module, as the "pkcs11" key store. Without a pinFile, the
+// token is used with an empty PIN, as some with a PIN pad want.
+func registerPKCS11(module, token, pinFile string) error {
+	var pin string
+	if pinFile != "" {
+		b, err := ioutil.ReadFile(pinFile)
+		if err != nil {
+			return err
+		}
+		pin = strings.TrimRight(string(b), "\r\n")
+	}
+	controlclient.RegisterKeyStore("pkcs11", &controlclient.PKCS11KeyStore{
+		Module: module,
+		Token:  token,
+		PIN:    pin,
+	})
+	return nil
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !cgo
+
+package main
+
+import "errors"
+
+func registerPKCS11(module, token, pinFile string) error {
+	return errors.New("this tailscaled was built without cgo, which PKCS#11 needs")
+}
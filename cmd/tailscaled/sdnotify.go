@@ -0,0 +1,49 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+)
+
+// sdNotify sends state, such as "READY=1", to systemd, if tailscaled
+// runs as a Type=notify service. Otherwise it does nothing. See
+// sd_notify(3).
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// A leading '@' is an abstract socket, which the net package
+	// handles.
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogEnabled reports whether systemd expects WATCHDOG=1
+// keepalives from this process, because the unit has WatchdogSec.
+func sdWatchdogEnabled() bool {
+	if os.Getenv("WATCHDOG_USEC") == "" {
+		return false
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	return pid == "" || pid == strconv.Itoa(os.Getpid())
+}
+
+// controlStatus returns the systemd status line for the health of the
+// connection to the control server.
+func controlStatus(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "Connected to the control server"
+}
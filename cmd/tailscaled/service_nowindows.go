@@ -0,0 +1,26 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"tailscale.com/types/logger"
+)
+
+var errNotWindows = errors.New("service mode is only supported on Windows")
+
+func isWindowsService() bool { return false }
+
+func runWindowsService(logf logger.Logf, run func(context.Context) error) error {
+	return errNotWindows
+}
+
+func installService(args []string) error { return errNotWindows }
+
+func uninstallService() error { return errNotWindows }
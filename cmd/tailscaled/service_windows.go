@@ -0,0 +1,168 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"tailscale.com/types/logger"
+)
+
+// serviceName is the name tailscaled is registered under with the
+// Windows service control manager.
+const serviceName = "Tailscale"
+
+// serviceStopTimeout is how long a stopping service waits for the
+// backend to shut down before exiting anyway.
+const serviceStopTimeout = 10 * time.Second
+
+// isWindowsService reports whether tailscaled was started by the
+// service control manager.
+func isWindowsService() bool {
+	interactive, err := svc.IsAnInteractiveSession()
+	return err == nil && !interactive
+}
+
+// runWindowsService runs the backend, using run, as the tailscaled
+// service until the service control manager stops it.
+func runWindowsService(logf logger.Logf, run func(context.Context) error) error {
+	return svc.Run(serviceName, &ipnService{logf: logf, run: run})
+}
+
+type ipnService struct {
+	logf logger.Logf
+	run  func(context.Context) error
+}
+
+// sessionEvents names the session change events we log.
+var sessionEvents = map[uint32]string{
+	windows.WTS_SESSION_LOGON:  "logon",
+	windows.WTS_SESSION_LOGOFF: "logoff",
+	windows.WTS_SESSION_LOCK:   "lock",
+	windows.WTS_SESSION_UNLOCK: "unlock",
+}
+
+func (s *ipnService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.run(ctx) }()
+
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptSessionChange
+	changes <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case err := <-done:
+			// Exit without telling the service control manager,
+			// which counts as a crash and triggers the recovery
+			// actions set by installService.
+			s.logf("service: backend stopped: %v\n", err)
+			os.Exit(1)
+		case req := <-r:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s.logf("service: stopping\n")
+				changes <- svc.Status{State: svc.StopPending}
+				cancel()
+				select {
+				case <-done:
+				case <-time.After(serviceStopTimeout):
+					s.logf("service: backend didn't stop in %v\n", serviceStopTimeout)
+				}
+				return false, 0
+			case svc.SessionChange:
+				// The backend doesn't belong to any user
+				// session, so the tunnel stays up across
+				// logoffs; the GUI of the next user to log on
+				// reconnects to the pipe.
+				if name, ok := sessionEvents[req.EventType]; ok {
+					s.logf("service: session %s\n", name)
+				}
+			}
+		}
+	}
+}
+
+// installService registers tailscaled as an automatically started
+// service, run with args, that's restarted if it crashes, and starts
+// it.
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %q is already installed", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Tailscale",
+		Description: "Connects this computer to others on the Tailscale network.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("creating service: %v", err)
+	}
+	defer s.Close()
+
+	// Restart quickly at first, then back off. Failures are
+	// forgotten after a day without any.
+	actions := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: time.Second},
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}
+	if err := s.SetRecoveryActions(actions, uint32((24 * time.Hour).Seconds())); err != nil {
+		return fmt.Errorf("setting recovery actions: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("starting service: %v", err)
+	}
+	return nil
+}
+
+// uninstallService stops and removes the tailscaled service.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %q is not installed", serviceName)
+	}
+	defer s.Close()
+	// It's fine if the service isn't running. If it is, wait for it
+	// to stop, so that the executable can be replaced or removed
+	// right after.
+	if st, err := s.Control(svc.Stop); err == nil {
+		deadline := time.Now().Add(serviceStopTimeout + 5*time.Second)
+		for st.State != svc.Stopped && time.Now().Before(deadline) {
+			time.Sleep(300 * time.Millisecond)
+			if st, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	return s.Delete()
+}
@@ -6,21 +6,46 @@
 // and controlled via the tailscale CLI program.
 //
 // It primarily supports Linux, though other systems will likely be
-// supported in the future.
+// supported in the future. On Windows, it runs as a service (see
+// --install-service) and frontends connect over a named pipe. On
+// Synology and QNAP NAS devices it knows where its package keeps its
+// state and socket, see package nas.
 package main // import "tailscale.com/cmd/tailscaled"
 
 import (
+	"bytes"
 	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/apenwarr/fixconsole"
 	"github.com/pborman/getopt/v2"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
+	"tailscale.com/nas"
+	"tailscale.com/safesocket"
+	"tailscale.com/socks5"
+	"tailscale.com/types/logger"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/magicsock"
+	"tailscale.com/wgengine/netstack"
 )
 
 // globalStateKey is the ipn.StateKey that tailscaled loads on
@@ -33,81 +58,603 @@ import (
 const globalStateKey = "_daemon"
 
 func main() {
+	configPath := getopt.StringLong("config", 0, "", "JSON file of settings and default prefs; flags override it")
 	fake := getopt.BoolLong("fake", 0, "fake tunnel+routing instead of tuntap")
-	debug := getopt.StringLong("debug", 0, "", "Address of debug server")
-	tunname := getopt.StringLong("tun", 0, "tailscale0", "tunnel interface name")
+	debug := getopt.StringLong("debug", 0, "", "loopback address of a debug HTTP server, e.g. 127.0.0.1:8080")
+	tunname := getopt.StringLong("tun", 0, "tailscale0", "tunnel interface name, or \"userspace-networking\" for none, reaching the tailnet only through --socks5-server")
 	listenport := getopt.Uint16Long("port", 'p', magicsock.DefaultPort, "WireGuard port (0=autoselect)")
-	statepath := getopt.StringLong("state", 0, "", "Path of state file")
+	statepath := getopt.StringLong("state", 0, "", "Path of state file, \"kube:<secret>\" for a Kubernetes Secret, or \"mem:\" for an ephemeral node that keeps nothing on disk")
+	statePassFile := getopt.StringLong("state-passphrase-file", 0, "", "encrypt the state file with the passphrase in this file")
+	stateKeystore := getopt.BoolLong("state-keystore", 0, "encrypt the state file with a key from the OS keystore (DPAPI on Windows, Keychain on macOS; not available on Linux, use --state-passphrase-file)")
 	socketpath := getopt.StringLong("socket", 's', "tailscaled.sock", "Path of the service unix socket")
+	ipforward := getopt.BoolLong("enable-ip-forwarding", 0, "turn on kernel IP forwarding when advertising routes")
+	sockbuf := getopt.IntLong("socket-buffer", 0, 0, "UDP socket buffer size in bytes (0=default, -1=OS default)")
+	derpMap := getopt.StringLong("derp-map", 0, "", "JSON file of DERP servers to use instead of those from the control server")
+	dscp := getopt.IntLong("dscp", 0, 0, "DSCP value (0-63) to mark outgoing tunnel packets with (0=none)")
+	machineKeyStore := getopt.StringLong("machine-key-store", 0, "", "keep new machine keys in this key store instead of the state file: \"file\", a machine-keys directory beside it, or \"pkcs11\", the token given by --pkcs11-module")
+	pkcs11Module := getopt.StringLong("pkcs11-module", 0, "", "PKCS#11 library of a token that can hold X25519 keys, for --machine-key-store=pkcs11")
+	pkcs11Token := getopt.StringLong("pkcs11-token", 0, "", "label of the token in --pkcs11-module")
+	pkcs11PINFile := getopt.StringLong("pkcs11-pin-file", 0, "", "file holding the user PIN of the token in --pkcs11-module")
+	installSvc := getopt.BoolLong("install-service", 0, "install and start a Windows service run with the other flags given, and exit")
+	uninstallSvc := getopt.BoolLong("uninstall-service", 0, "stop and remove the Windows service, and exit")
+	webAddr := getopt.StringLong("web", 0, "", "loopback or Tailscale address to serve a web UI on, e.g. 127.0.0.1:8088; anyone on this machine can use it")
+	socksAddr := getopt.StringLong("socks5-server", 0, "", "loopback address to run a SOCKS5 proxy into the tailnet on, e.g. localhost:1055")
+	socksRemote := getopt.BoolLong("socks5-server-allow-remote", 0, "let --socks5-server listen on a non-loopback address; the proxy has no authentication, so anyone who reaches it can use the tailnet as this node")
+	cleanup := getopt.BoolLong("cleanup", 0, "remove the interface, routes and DNS settings left by an unclean shutdown, and exit")
+	verbose := getopt.StringLong("verbose", 0, "0", "log level, for every component or per component, e.g. 1 or magicsock=2,control=1; see also \"tailscale debug loglevel\"")
+	logFile := getopt.StringLong("log-file", 0, "", "also write logs to this local file, whether or not they're uploaded")
+	logFileSize := getopt.IntLong("log-file-size", 0, 10, "size in MB past which --log-file is rotated; 3 old files are kept")
+	instance := getopt.StringLong("instance", 0, "", "name of this tailscaled, to run several side by side, each in its own tailnet; it defaults --socket, --state, --tun and --port, and \"tailscale --instance=name\" finds it")
 
-	logf := wgengine.RusagePrefixLog(log.Printf)
+	// The levels are set once the flags are parsed.
+	levels := new(logger.Levels)
+	logf := levels.Filter(wgengine.RusagePrefixLog(log.Printf))
 
 	err := fixconsole.FixConsoleIfNeeded()
 	if err != nil {
 		logf("fixConsoleOutput: %v\n", err)
 	}
-	pol := logpolicy.New("tailnode.log.tailscale.io")
 
+	// "tailscaled install-service" and "uninstall-service" are
+	// spellings of the flags, as used with service managers.
+	if len(os.Args) > 1 && (os.Args[1] == "install-service" || os.Args[1] == "uninstall-service") {
+		os.Args[1] = "--" + os.Args[1]
+	}
 	getopt.Parse()
 	if len(getopt.Args()) > 0 {
 		log.Fatalf("too many non-flag arguments: %#v", getopt.Args()[0])
 	}
+	if err := levels.Set(*verbose); err != nil {
+		log.Fatalf("--verbose: %v", err)
+	}
+
+	var defaultPrefs *ipn.Prefs
+	var cfg *daemonConfig
+	if *configPath != "" {
+		var err error
+		cfg, err = loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("--config: %v", err)
+		}
+		fromFile := func(flag string, dst *string, v string) {
+			if v != "" && !getopt.IsSet(flag) {
+				*dst = v
+			}
+		}
+		fromFile("state", statepath, cfg.State)
+		fromFile("tun", tunname, cfg.Tun)
+		fromFile("socket", socketpath, cfg.Socket)
+		fromFile("debug", debug, cfg.Debug)
+		if cfg.Port != nil && !getopt.IsSet("port") {
+			*listenport = *cfg.Port
+		}
+		defaultPrefs = cfg.Prefs
+	}
+
+	// A named instance gets its own socket, state, interface and
+	// port, unless told otherwise, so as not to collide with the
+	// default one or other instances.
+	if *instance != "" {
+		if err := safesocket.CheckInstanceName(*instance); err != nil {
+			log.Fatalf("--instance: %v", err)
+		}
+		if runtime.GOOS == "windows" {
+			log.Fatalf("--instance isn't supported on Windows, where tailscaled runs as the service")
+		}
+		unset := func(flag string) bool { return !getopt.IsSet(flag) && !cfg.sets(flag) }
+		if unset("socket") {
+			*socketpath = safesocket.InstanceSocket(*instance)
+			os.MkdirAll(filepath.Dir(*socketpath), 0755)
+		}
+		if unset("state") {
+			*statepath = filepath.Join("/var/lib/tailscale", *instance, "tailscaled.state")
+		}
+		if unset("tun") {
+			*tunname = "ts-" + *instance
+		}
+		if unset("port") {
+			*listenport = 0
+		}
+	}
+
+	// A node whose state is in memory is ephemeral, and its logs
+	// don't touch the disk either.
+	inMemory := *statepath == "mem:"
+	var pol *logpolicy.Policy
+	if inMemory {
+		pol = logpolicy.NewInMemory("tailnode.log.tailscale.io")
+	} else if *instance != "" {
+		pol = logpolicy.NewNamed("tailnode.log.tailscale.io", "tailscaled-"+*instance)
+	} else {
+		pol = logpolicy.New("tailnode.log.tailscale.io")
+	}
+	if *logFile != "" {
+		if *logFileSize <= 0 {
+			log.Fatalf("--log-file-size must be positive")
+		}
+		if err := pol.TeeToFile(*logFile, int64(*logFileSize)<<20); err != nil {
+			log.Fatalf("--log-file: %v", err)
+		}
+	}
+
+	if *uninstallSvc {
+		if err := uninstallService(); err != nil {
+			log.Fatalf("uninstalling service: %v", err)
+		}
+		logf("Removed the service.\n")
+		return
+	}
+
+	if *cleanup {
+		if *tunname != userspaceNetworking {
+			wgengine.Cleanup(logf, *tunname)
+		}
+		return
+	}
+
+	// On a NAS, the package's files have fixed places, so that
+	// its start script needn't say where.
+	plat := nas.Detect()
+	if plat != nas.None && *instance == "" {
+		logf("Running on %s.\n", plat)
+		if *statepath == "" {
+			*statepath = plat.StatePath()
+			os.MkdirAll(filepath.Dir(*statepath), 0700)
+		}
+		if !getopt.IsSet("socket") && !cfg.sets("socket") {
+			*socketpath = plat.SocketPath()
+			os.MkdirAll(filepath.Dir(*socketpath), 0755)
+		}
+	}
 
 	if *statepath == "" {
 		log.Fatalf("--state is required")
 	}
 
+	// Without a TUN device, the daemon has its own TCP/IP stack, and
+	// only the SOCKS5 proxy reaches the tailnet.
+	var stack *netstack.Stack
+	if *tunname == userspaceNetworking {
+		if *fake {
+			log.Fatalf("--fake and --tun=%s are mutually exclusive", userspaceNetworking)
+		}
+		if *socksAddr == "" {
+			logf("--tun=%s without --socks5-server: nothing on this machine can reach the tailnet\n", userspaceNetworking)
+		}
+		stack = netstack.NewStack(logf)
+	}
+
 	if *socketpath == "" {
 		log.Fatalf("--socket is required")
 	}
 
-	if *debug != "" {
-		go runDebugServer(*debug)
+	var sealer ipn.Sealer
+	switch {
+	case *statePassFile != "" && *stateKeystore:
+		log.Fatalf("--state-passphrase-file and --state-keystore are mutually exclusive")
+	case *statePassFile != "":
+		pass, err := ioutil.ReadFile(*statePassFile)
+		if err != nil {
+			log.Fatalf("--state-passphrase-file: %v", err)
+		}
+		sealer, err = ipn.NewPassphraseSealer(bytes.TrimRight(pass, "\r\n"))
+		if err != nil {
+			log.Fatalf("--state-passphrase-file: %v", err)
+		}
+	case *stateKeystore:
+		sealer, err = ipn.NewKeystoreSealer()
+		if err == ipn.ErrNoKeystore {
+			log.Fatalf("--state-keystore: %v on %s; use --state-passphrase-file", err, runtime.GOOS)
+		}
+		if err != nil {
+			log.Fatalf("--state-keystore: %v", err)
+		}
 	}
 
-	var e wgengine.Engine
-	if *fake {
-		e, err = wgengine.NewFakeUserspaceEngine(logf, 0)
-	} else {
-		e, err = wgengine.NewUserspaceEngine(logf, *tunname, *listenport)
+	if *dscp < 0 || *dscp > 63 {
+		log.Fatalf("--dscp must be between 0 and 63")
 	}
-	if err != nil {
-		log.Fatalf("wgengine.New: %v\n", err)
+	if *machineKeyStore != "" {
+		if !inMemory && !strings.HasPrefix(*statepath, "kube:") {
+			controlclient.RegisterKeyStore("file", controlclient.FileKeyStore(filepath.Join(filepath.Dir(*statepath), "machine-keys")))
+		}
+		if *pkcs11Module != "" {
+			if err := registerPKCS11(*pkcs11Module, *pkcs11Token, *pkcs11PINFile); err != nil {
+				log.Fatalf("--pkcs11-module: %v", err)
+			}
+		}
+		if err := controlclient.CheckKeyStore(*machineKeyStore); err != nil {
+			log.Fatalf("--machine-key-store: %v; available: %v", err, controlclient.KeyStores())
+		}
+	}
+
+	if *installSvc {
+		if err := installService(serviceArgs(os.Args[1:])); err != nil {
+			log.Fatalf("installing service: %v", err)
+		}
+		logf("Installed and started the service.\n")
+		return
+	}
+
+	if !inMemory && !strings.HasPrefix(*statepath, "kube:") {
+		unlock, err := lockState(*statepath)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer unlock()
 	}
-	e = wgengine.NewWatchdog(e)
 
-	opts := ipnserver.Options{
-		SocketPath:         *socketpath,
-		StatePath:          *statepath,
-		AutostartStateKey:  globalStateKey,
-		LegacyConfigPath:   "/var/lib/tailscale/relay.conf",
-		SurviveDisconnects: true,
+	// With a config file, SIGHUP can start the debug server later,
+	// so its mux is there from the start.
+	var debugMux *http.ServeMux
+	var dbg *debugServer
+	if *debug != "" || *configPath != "" {
+		debugMux = newDebugMux()
+		dbg = &debugServer{mux: debugMux}
+		if err := dbg.listen(*debug); err != nil {
+			log.Fatalf("--debug: %v", err)
+		}
+	}
+
+	var webMux *http.ServeMux
+	if *webAddr != "" {
+		// The daemon doesn't need the web UI to carry on.
+		if err := checkWebAddr(*webAddr); err != nil {
+			logf("--web: %v; not serving the web UI\n", err)
+		} else {
+			webMux = http.NewServeMux()
+			go runWebServer(logf, webMux, *webAddr)
+		}
+	}
+
+	if *socksAddr != "" {
+		if !*socksRemote {
+			if err := checkDebugAddr(*socksAddr); err != nil {
+				log.Fatalf("--socks5-server: %v; see --socks5-server-allow-remote", err)
+			}
+		}
+		ln, err := net.Listen("tcp", *socksAddr)
+		if err != nil {
+			log.Fatalf("--socks5-server: %v", err)
+		}
+		logf("SOCKS5 proxy listening on %v\n", ln.Addr())
+		// With a TUN device, connections go through the kernel, and
+		// so over the tunnel to tailnet addresses.
+		s := &socks5.Server{Logf: logf}
+		if stack != nil {
+			s.Dial = userspaceDial(stack)
+		}
+		go func() {
+			logf("SOCKS5 proxy: %v\n", s.Serve(ln))
+		}()
+	}
+
+	run := func(ctx context.Context) error {
+		var e wgengine.Engine
+		var err error
+		tuning := wgengine.Tuning{
+			DSCP:             uint8(*dscp),
+			SocketBufferSize: *sockbuf,
+		}
+		switch {
+		case *fake:
+			e, err = wgengine.NewFakeUserspaceEngine(logf, 0)
+		case stack != nil:
+			e, err = wgengine.NewUserspaceEngineAdvancedWithTuning(logf, stack, stack.Router, *listenport, tuning)
+		default:
+			if plat != nas.None {
+				if err := nas.EnsureTUN(logf); err != nil {
+					return err
+				}
+				defer nas.AllowFirewall(logf, *tunname, *listenport)()
+			}
+			e, err = wgengine.NewUserspaceEngineWithTuning(logf, *tunname, *listenport, tuning)
+		}
+		if err != nil {
+			return fmt.Errorf("wgengine.New: %v", err)
+		}
+		e = wgengine.NewWatchdog(e)
+		// Coalesce the netmap updates that arrive while a slow router
+		// or DNS change is being applied, applying only the latest.
+		e = wgengine.NewAsyncReconfig(logf, e)
+		defer e.Close()
+
+		opts := ipnserver.Options{
+			SocketPath:         *socketpath,
+			StatePath:          *statepath,
+			StateSealer:        sealer,
+			AutostartStateKey:  globalStateKey,
+			LegacyConfigPath:   "/var/lib/tailscale/relay.conf",
+			DefaultPrefs:       defaultPrefs,
+			SurviveDisconnects: true,
+			Ephemeral:          inMemory,
+			EnableIPForwarding: *ipforward,
+			DERPMapPath:        *derpMap,
+			MachineKeyStore:    *machineKeyStore,
+			DebugMux:           debugMux,
+			WebMux:             webMux,
+			LogLevels:          levels,
+		}
+		// Files from the user's other nodes wait next to the state
+		// file. Nodes without one on disk don't receive files.
+		if !inMemory && !strings.HasPrefix(*statepath, "kube:") {
+			opts.FileInboxDir = filepath.Join(filepath.Dir(*statepath), "files")
+		}
+		// Under systemd, report readiness once the backend has
+		// started, without waiting for the network, which a machine
+		// may boot without. Whether the control server is reachable
+		// goes in the unit's status line instead. The backend's
+		// liveness watchdog feeds systemd's, so that a wedged
+		// daemon gets restarted.
+		opts.OnReady = func() {
+			if err := sdNotify("READY=1"); err != nil {
+				logf("sd_notify READY: %v\n", err)
+			}
+		}
+		unwatch := health.RegisterWatcher(func(sys health.Subsystem, err error) {
+			if sys == health.SysControl {
+				sdNotify("STATUS=" + controlStatus(err))
+			}
+		})
+		defer unwatch()
+		if sdWatchdogEnabled() {
+			opts.OnLive = func() {
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+					logf("sd_notify WATCHDOG: %v\n", err)
+				}
+			}
+		}
+		if *configPath != "" {
+			opts.OnReload = func(b *ipn.LocalBackend) {
+				cfg = reloadConfig(logf, *configPath, cfg)
+				// The --debug flag overrides the file, as at startup.
+				if !getopt.IsSet("debug") {
+					if err := dbg.listen(cfg.Debug); err != nil {
+						logf("config: Debug: %v\n", err)
+					}
+				}
+				b.SetDefaultPrefs(cfg.Prefs)
+			}
+		}
+		err = ipnserver.Run(ctx, logf, pol.PublicID.String(), opts, e)
+		sdNotify("STOPPING=1")
+		if ctx.Err() != nil {
+			// Asked to stop.
+			return nil
+		}
+		return err
+	}
+	if isWindowsService() {
+		err = runWindowsService(logf, run)
+	} else {
+		err = runUntilSignal(logf, run)
 	}
-	err = ipnserver.Run(context.Background(), logf, pol.PublicID.String(), opts, e)
 	if err != nil {
 		log.Fatalf("tailscaled: %v\n", err)
 	}
 
-	// TODO(crawshaw): It would be nice to start a timeout context the moment a signal
-	// is received and use that timeout to give us a moment to finish uploading logs
-	// here. But the signal is handled inside ipnserver.Run, so some plumbing is needed.
+	// Give the last log lines, those about shutting down, a moment
+	// to upload.
+	ctx, cancel := context.WithTimeout(context.Background(), logFlushTimeout)
+	defer cancel()
+	pol.Shutdown(ctx)
+}
+
+const (
+	// shutdownTimeout is how long tailscaled waits, after SIGINT or
+	// SIGTERM, for the backend to tear down before exiting anyway.
+	// Anything left behind can be removed with --cleanup.
+	shutdownTimeout = 10 * time.Second
+	// logFlushTimeout is how long tailscaled then waits for its
+	// logs to upload.
+	logFlushTimeout = 2 * time.Second
+)
+
+// runUntilSignal calls run, and when tailscaled gets SIGINT or
+// SIGTERM, cancels run's context and waits up to shutdownTimeout for
+// it to return. A second signal stops the wait.
+func runUntilSignal(logf logger.Logf, run func(context.Context) error) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- run(ctx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case sig := <-sigs:
+		logf("tailscaled: got %v, shutting down\n", sig)
+	}
 	cancel()
-	pol.Shutdown(ctx)
+	timer := time.NewTimer(shutdownTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case sig := <-sigs:
+		return fmt.Errorf("got %v while shutting down; exiting now", sig)
+	case <-timer.C:
+		return fmt.Errorf("shutdown didn't finish in %v; exiting anyway", shutdownTimeout)
+	}
 }
 
-func runDebugServer(addr string) {
+// serviceArgs returns args, tailscaled's command line arguments, as
+// the arguments to run the installed service with.
+func serviceArgs(args []string) []string {
+	var ret []string
+	for _, a := range args {
+		if a == "--install-service" || strings.HasPrefix(a, "--install-service=") {
+			continue
+		}
+		ret = append(ret, a)
+	}
+	return ret
+}
+
+// checkDebugAddr returns an error if addr, the --debug address, isn't
+// a loopback one. The debug server has no access control, and shows
+// profiles and the network map.
+func checkDebugAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%q is not a loopback address", host)
+	}
+	return nil
+}
+
+// tailscaleRanges are the addresses control hands out to nodes.
+var tailscaleRanges = []string{"100.64.0.0/10", "fd7a:115c:a1e0::/48"}
+
+// checkWebAddr returns an error if addr, the --web address, isn't a
+// loopback or Tailscale one, so that the web UI is never served to
+// the LAN.
+func checkWebAddr(addr string) error {
+	if checkDebugAddr(addr) == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, r := range tailscaleRanges {
+			_, n, _ := net.ParseCIDR(r)
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%q is not a loopback or Tailscale address", host)
+}
+
+// userspaceNetworking is the --tun name for running without a TUN
+// device.
+const userspaceNetworking = "userspace-networking"
+
+// userspaceDial returns the SOCKS5 proxy's Dial for
+// --tun=userspace-networking. It connects over stack to addresses the
+// tunnel reaches, and from the host to the rest, as the kernel would
+// route them with a TUN device.
+func userspaceDial(stack *netstack.Stack) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range addrs {
+				ips = append(ips, a.IP)
+			}
+		}
+		for _, ip := range ips {
+			if stack.Reaches(ip) {
+				return stack.Dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			}
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// runWebServer serves the web UI on addr. A Tailscale address only
+// exists once the node is up, so listening is retried until then.
+func runWebServer(logf logger.Logf, mux *http.ServeMux, addr string) {
+	for warned := false; ; warned = true {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			if !warned {
+				logf("web: %v; retrying\n", err)
+			}
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		logf("web UI on http://%v/\n", ln.Addr())
+		srv := &http.Server{Handler: mux, ConnContext: ipnserver.WebConnContext}
+		logf("web UI stopped: %v\n", srv.Serve(ln))
+		return
+	}
+}
+
+// newDebugMux returns the debug server's mux, with the process-wide
+// pages. ipnserver.Run adds the backend's.
+func newDebugMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-	srv := http.Server{
-		Addr:    addr,
-		Handler: mux,
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		problems := health.Problems()
+		if len(problems) == 0 {
+			io.WriteString(w, "ok\n")
+			return
+		}
+		for _, p := range problems {
+			fmt.Fprintf(w, "%s\n", p)
+		}
+	})
+	return mux
+}
+
+// debugServer is the --debug HTTP server, which SIGHUP can start,
+// stop or move to another address.
+type debugServer struct {
+	mux *http.ServeMux
+
+	mu   sync.Mutex
+	addr string       // where srv listens, or empty
+	srv  *http.Server // nil if not serving
+}
+
+// listen serves s.mux on addr instead of its current address, or
+// stops serving if addr is empty. If the new address can't be used,
+// the server is left stopped.
+func (s *debugServer) listen(addr string) error {
+	if addr != "" {
+		if err := checkDebugAddr(addr); err != nil {
+			return err
+		}
 	}
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if addr == s.addr {
+		return nil
+	}
+	// Close the old server first, as the new address may well
+	// have the same port.
+	if s.srv != nil {
+		s.srv.Close()
+		s.srv, s.addr = nil, ""
+	}
+	if addr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
+	srv := &http.Server{Handler: s.mux}
+	go srv.Serve(ln)
+	s.srv, s.addr = srv, addr
+	return nil
 }
@@ -17,8 +17,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/tailscale/wireguard-go/wgcfg"
 	"golang.org/x/oauth2"
-	"tailscale.com/logtail/backoff"
+	"tailscale.com/health"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/empty"
 	"tailscale.com/types/logger"
@@ -113,12 +114,17 @@ type Client struct {
 	statusFunc func(Status) // called to update Client status
 
 	loggedIn     bool       // true if currently logged in
+	failingSince time.Time  // when requests to control started failing, or zero
 	loginGoal    *LoginGoal // non-nil if some login activity is desired
 	synced       bool       // true if our netmap is up-to-date
 	hostinfo     tailcfg.Hostinfo
 	inPollNetMap bool // true if currently running a PollNetMap
 	inSendStatus int  // number of sendStatus calls currently in progress
 	state        state
+	loggedOut    bool // a logout just finished; the next status carries the cleared Persist
+
+	paused         bool            // no requests to control, see SetPaused
+	unpauseWaiters []chan struct{} // closed when the client is unpaused
 
 	authCtx    context.Context // context used for auth requests
 	mapCtx     context.Context // context used for netmap requests
@@ -127,8 +133,18 @@ type Client struct {
 	quit       chan struct{}   // when closed, goroutines should all exit
 	authDone   chan struct{}   // when closed, auth goroutine is done
 	mapDone    chan struct{}   // when closed, map goroutine is done
+
+	epTimer   *time.Timer // pending flushEndpoints, or nil
+	epSent    bool        // UpdateEndpoints has been called before
+	epPort    uint16      // latest localPort given to UpdateEndpoints
+	epPending []string    // latest endpoints given to UpdateEndpoints
 }
 
+// endpointBatchDelay is how long UpdateEndpoints collects endpoint
+// changes before passing the latest ones on, so that the burst of
+// changes while STUN results come in costs a single map request.
+const endpointBatchDelay = 500 * time.Millisecond
+
 // New creates and starts a new Client.
 func New(opts Options) (*Client, error) {
 	c, err := NewNoStart(opts)
@@ -147,6 +163,9 @@ func NewNoStart(opts Options) (*Client, error) {
 	if opts.Logf == nil {
 		opts.Logf = func(fmt string, args ...interface{}) {}
 	}
+	if opts.TimeNow == nil {
+		opts.TimeNow = time.Now
+	}
 	c := &Client{
 		direct:   direct,
 		timeNow:  opts.TimeNow,
@@ -171,13 +190,17 @@ func (c *Client) Start() {
 
 func (c *Client) cancelAuth() {
 	c.mu.Lock()
+	c.cancelAuthLocked()
+	c.mu.Unlock()
+}
+
+func (c *Client) cancelAuthLocked() {
 	if c.authCancel != nil {
 		c.authCancel()
 	}
 	if !c.closed {
 		c.authCtx, c.authCancel = context.WithCancel(context.Background())
 	}
-	c.mu.Unlock()
 }
 
 func (c *Client) cancelMapLocked() {
@@ -199,7 +222,7 @@ func (c *Client) cancelMapSafely() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.logf("cancelMapSafely: synced=%v\n", c.synced)
+	c.logf("[v1] cancelMapSafely: synced=%v\n", c.synced)
 
 	if c.inPollNetMap {
 		// received at least one netmap since the last
@@ -221,21 +244,25 @@ func (c *Client) cancelMapSafely() {
 		// request.
 		select {
 		case c.newMapCh <- struct{}{}:
-			c.logf("cancelMapSafely: wrote to channel\n")
+			c.logf("[v1] cancelMapSafely: wrote to channel\n")
 		default:
 			// if channel write failed, then there was already
 			// an outstanding newMapCh request. One is enough,
 			// since it'll always use the latest endpoints.
-			c.logf("cancelMapSafely: channel was full\n")
+			c.logf("[v1] cancelMapSafely: channel was full\n")
 		}
 	}
 }
 
 func (c *Client) authRoutine() {
 	defer close(c.authDone)
-	bo := backoff.Backoff{Name: "authRoutine"}
+	bo := retrier{name: "authRoutine", logf: c.logf}
 
 	for {
+		if !c.waitUnpause("authRoutine") {
+			c.logf("authRoutine: quit\n")
+			return
+		}
 		c.mu.Lock()
 		c.logf("authRoutine: %s\n", c.state)
 		expiry := c.expiry
@@ -257,6 +284,7 @@ func (c *Client) authRoutine() {
 			// don't send status updates for context errors,
 			// since context cancelation is always on purpose.
 			if ctx.Err() == nil {
+				c.noteControlErr(err)
 				c.sendStatus("authRoutine1", err, "", nil)
 			}
 		}
@@ -288,7 +316,7 @@ func (c *Client) authRoutine() {
 				// So we have to do some hackery with c.expiry
 				// in here.
 				// TODO(apenwarr): add a key expiry field in RegisterResponse.
-				c.logf("authRoutine: key expiration check.\n")
+				c.logf("[v1] authRoutine: key expiration check.\n")
 				if synced && expiry != nil && !expiry.IsZero() && expiry.Before(c.timeNow()) {
 					c.logf("Key expired; setting loggedIn=false.")
 
@@ -310,8 +338,10 @@ func (c *Client) authRoutine() {
 			}
 
 			// success
+			c.noteControlErr(nil)
 			c.mu.Lock()
 			c.loggedIn = false
+			c.loggedOut = true
 			c.loginGoal = nil
 			c.state = stateNotAuthenticated
 			c.synced = false
@@ -363,6 +393,7 @@ func (c *Client) authRoutine() {
 			}
 
 			// success
+			c.noteControlErr(nil)
 			c.mu.Lock()
 			c.loggedIn = true
 			c.loginGoal = nil
@@ -378,9 +409,13 @@ func (c *Client) authRoutine() {
 
 func (c *Client) mapRoutine() {
 	defer close(c.mapDone)
-	bo := backoff.Backoff{Name: "mapRoutine"}
+	bo := retrier{name: "mapRoutine", logf: c.logf}
 
 	for {
+		if !c.waitUnpause("mapRoutine") {
+			c.logf("mapRoutine: quit\n")
+			return
+		}
 		c.mu.Lock()
 		c.logf("mapRoutine: %s\n", c.state)
 		loggedIn := c.loggedIn
@@ -400,6 +435,7 @@ func (c *Client) mapRoutine() {
 			// don't send status updates for context errors,
 			// since context cancelation is always on purpose.
 			if ctx.Err() == nil {
+				c.noteControlErr(err)
 				c.sendStatus("mapRoutine1", err, "", nil)
 			}
 		}
@@ -453,6 +489,7 @@ func (c *Client) mapRoutine() {
 				c.mu.Unlock()
 
 				c.logf("mapRoutine: netmap received: %s\n", state)
+				c.noteControlErr(nil)
 				if stillAuthed {
 					c.sendStatus("mapRoutine2", nil, "", nm)
 				}
@@ -466,6 +503,13 @@ func (c *Client) mapRoutine() {
 			}
 			c.mu.Unlock()
 
+			if err == errMapPollSilent {
+				// The stream went quiet, which is most likely a
+				// dead connection. Reconnect right away rather
+				// than backing off.
+				c.logf("mapRoutine: %v; reconnecting\n", err)
+				continue
+			}
 			if err != nil {
 				report(err, "PollNetMap")
 				bo.BackOff(ctx, err)
@@ -476,6 +520,86 @@ func (c *Client) mapRoutine() {
 	}
 }
 
+// noteControlErr records the outcome of the latest request to the
+// control server in the health registry. A nil err means it worked.
+// SetPaused stops or restarts the client's requests to the control
+// server. Pausing aborts the requests in flight, including the
+// long-poll for network map updates, and starts no new ones, but the
+// client keeps its login state and pending work, and picks it up
+// again once unpaused.
+func (c *Client) SetPaused(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if paused == c.paused {
+		return
+	}
+	c.logf("client.SetPaused(%v)\n", paused)
+	c.paused = paused
+	if paused {
+		// The routines notice on their next time around the loop.
+		c.cancelAuthLocked()
+		c.cancelMapLocked()
+		return
+	}
+	for _, ch := range c.unpauseWaiters {
+		close(ch)
+	}
+	c.unpauseWaiters = nil
+}
+
+// waitUnpause blocks the named routine while the client is paused.
+// It reports false if the client shut down in the meantime.
+func (c *Client) waitUnpause(routine string) bool {
+	c.mu.Lock()
+	if !c.paused {
+		c.mu.Unlock()
+		return true
+	}
+	unpaused := make(chan struct{})
+	c.unpauseWaiters = append(c.unpauseWaiters, unpaused)
+	c.mu.Unlock()
+
+	c.logf("%s: paused\n", routine)
+	select {
+	case <-unpaused:
+		c.logf("%s: unpaused\n", routine)
+		return true
+	case <-c.quit:
+		return false
+	}
+}
+
+func (c *Client) noteControlErr(err error) {
+	c.mu.Lock()
+	if err == nil {
+		c.failingSince = time.Time{}
+	} else if c.failingSince.IsZero() {
+		c.failingSince = c.timeNow()
+	}
+	since := c.failingSince
+	c.mu.Unlock()
+
+	switch {
+	case err == nil:
+		health.Set(health.SysControl, nil)
+	case isAuthError(err):
+		health.Set(health.SysControl, fmt.Errorf("control server rejected us since %s: %v", since.Format("15:04"), err))
+	default:
+		health.Set(health.SysControl, fmt.Errorf("can't reach control server since %s: %v", since.Format("15:04"), err))
+	}
+}
+
+// CheckLiveness returns once the client's locks are free. It's for
+// watchdogs: if the client has deadlocked, it never returns.
+func (c *Client) CheckLiveness() {
+	c.mu.Lock()
+	//lint:ignore SA2001 getting the lock is the check.
+	c.mu.Unlock()
+	c.direct.mu.Lock()
+	//lint:ignore SA2001 likewise.
+	c.direct.mu.Unlock()
+}
+
 func (c *Client) AuthCantContinue() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -489,12 +613,44 @@ func (c *Client) SetStatusFunc(fn func(Status)) {
 	c.mu.Unlock()
 }
 
+// Reload switches the client to the given control proxy and TLS key
+// pins, as in Options, and starts a new map request, which fetches a
+// full network map. The login and the current map poll's results are
+// kept.
+func (c *Client) Reload(proxyURL string, pins []string) error {
+	if err := c.direct.SetTransport(proxyURL, pins); err != nil {
+		return err
+	}
+	c.cancelMapSafely()
+	return nil
+}
+
 func (c *Client) SetHostinfo(hi tailcfg.Hostinfo) {
 	c.direct.SetHostinfo(hi)
 	// Send new Hostinfo to server
 	c.cancelMapSafely()
 }
 
+// SetHealthReport sets the health report to send to the control
+// server, at most once per healthReportInterval. It goes with the next
+// map request, whatever starts that; the current one isn't cut short
+// for it. A nil report stops reporting.
+func (c *Client) SetHealthReport(r *tailcfg.HealthReport) {
+	c.direct.SetHealthReport(r)
+}
+
+// SetNetInfo sets the network conditions to report to the server,
+// starting a new map request if they changed significantly.
+func (c *Client) SetNetInfo(ni *tailcfg.NetInfo) {
+	if ni == nil {
+		return
+	}
+	if c.direct.SetNetInfo(ni) {
+		c.logf("client.SetNetInfo: %+v\n", *ni)
+		c.cancelMapSafely()
+	}
+}
+
 func (c *Client) sendStatus(who string, err error, url string, nm *NetworkMap) {
 	c.mu.Lock()
 	state := c.state
@@ -502,10 +658,12 @@ func (c *Client) sendStatus(who string, err error, url string, nm *NetworkMap) {
 	synced := c.synced
 	statusFunc := c.statusFunc
 	hi := c.hostinfo
+	loggedOut := c.loggedOut
+	c.loggedOut = false
 	c.inSendStatus++
 	c.mu.Unlock()
 
-	c.logf("sendStatus: %s: %v\n", who, state)
+	c.logf("[v1] sendStatus: %s: %v\n", who, state)
 
 	var p *Persist
 	var fin *empty.Message
@@ -520,6 +678,12 @@ func (c *Client) sendStatus(who string, err error, url string, nm *NetworkMap) {
 		// not logged in.
 		nm = nil
 	}
+	if loggedOut {
+		// The logout removed the node key from Persist; send it
+		// for the caller to save.
+		pp := c.direct.GetPersist()
+		p = &pp
+	}
 	new := Status{
 		LoginFinished: fin,
 		URL:           url,
@@ -556,6 +720,7 @@ func (c *Client) Login(t *oauth2.Token, flags LoginFlags) {
 
 func (c *Client) Logout() {
 	c.logf("client.Logout()\n")
+	c.direct.markLogoutPending()
 
 	c.mu.Lock()
 	c.loginGoal = &LoginGoal{
@@ -566,9 +731,65 @@ func (c *Client) Logout() {
 	c.cancelAuth()
 }
 
+// RotateMachineKey replaces the machine key with k. If logged in,
+// the client logs in again to tell the control server about the new
+// key, then restarts its map poll under it. Otherwise the rotation
+// finishes with the next login.
+func (c *Client) RotateMachineKey(k wgcfg.PrivateKey) {
+	c.logf("client.RotateMachineKey()\n")
+	c.direct.SetNewMachineKey(k)
+
+	c.mu.Lock()
+	relogin := c.loginGoal == nil && c.loggedIn
+	if relogin {
+		c.loginGoal = &LoginGoal{
+			wantLoggedIn: true,
+		}
+	}
+	c.mu.Unlock()
+
+	if relogin {
+		c.cancelAuth()
+	}
+}
+
+// UpdateEndpoints sets the local port and endpoints to advertise.
+// The first set is used right away; later ones are batched for
+// endpointBatchDelay and only sent if they differ from the last.
 func (c *Client) UpdateEndpoints(localPort uint16, endpoints []string) {
-	changed := c.direct.SetEndpoints(localPort, endpoints)
-	if changed {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	if c.epSent {
+		c.epPort = localPort
+		c.epPending = append(c.epPending[:0], endpoints...)
+		if c.epTimer == nil {
+			c.epTimer = time.AfterFunc(endpointBatchDelay, c.flushEndpoints)
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.epSent = true
+	c.mu.Unlock()
+
+	if c.direct.SetEndpoints(localPort, endpoints) {
+		c.cancelMapSafely()
+	}
+}
+
+// flushEndpoints passes the endpoints batched by UpdateEndpoints on
+// to the server.
+func (c *Client) flushEndpoints() {
+	c.mu.Lock()
+	c.epTimer = nil
+	localPort, endpoints := c.epPort, c.epPending
+	c.epPending = nil
+	closed := c.closed
+	c.mu.Unlock()
+
+	if !closed && c.direct.SetEndpoints(localPort, endpoints) {
 		c.cancelMapSafely()
 	}
 }
@@ -582,6 +803,10 @@ func (c *Client) Shutdown() {
 	if !closed {
 		c.closed = true
 		c.statusFunc = nil
+		if c.epTimer != nil {
+			c.epTimer.Stop()
+			c.epTimer = nil
+		}
 	}
 	c.mu.Unlock()
 
@@ -592,6 +817,7 @@ func (c *Client) Shutdown() {
 		<-c.authDone
 		c.cancelMapUnsafely()
 		<-c.mapDone
+		health.Set(health.SysControl, nil)
 		c.logf("Client.Shutdown done.\n")
 	}
 }
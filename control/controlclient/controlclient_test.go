@@ -5,9 +5,19 @@
 package controlclient
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/empty"
 )
 
@@ -68,3 +78,357 @@ func TestStatusEqual(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckServerURL(t *testing.T) {
+	for _, s := range []string{"https://login.tailscale.com", "http://localhost:8080", "https://control.example.com/prefix"} {
+		if err := CheckServerURL(s); err != nil {
+			t.Errorf("CheckServerURL(%q) = %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "login.tailscale.com", "ftp://example.com", "https://", "https://%zz"} {
+		if err := CheckServerURL(s); err == nil {
+			t.Errorf("CheckServerURL(%q) = nil, want error", s)
+		}
+	}
+}
+
+func TestTryLogout(t *testing.T) {
+	serverPriv, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPub := serverPriv.Public()
+	machinePriv, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machinePub := machinePriv.Public()
+	nodePriv, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *tailcfg.RegisterRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/key":
+			w.Write([]byte(serverPub.HexString()))
+		case strings.HasPrefix(r.URL.Path, "/machine/"):
+			msg, _ := ioutil.ReadAll(r.Body)
+			req := new(tailcfg.RegisterRequest)
+			if err := decodeMsg(msg, req, &machinePub, &serverPriv); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			got = req
+			b, _ := encode(tailcfg.RegisterResponse{}, &machinePub, &serverPriv)
+			w.Write(b)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewDirect(Options{
+		ServerURL: srv.URL,
+		Logf:      t.Logf,
+		Persist: Persist{
+			PrivateMachineKey: machinePriv,
+			PrivateNodeKey:    nodePriv,
+			LoginName:         "user@example.com",
+			LogoutPending:     true, // as if resumed after a restart
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.TryLogout(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil {
+		t.Fatal("server got no logout request")
+	}
+	if want := tailcfg.NodeKey(nodePriv.Public()); got.NodeKey != want {
+		t.Errorf("logout NodeKey = %v, want %v", got.NodeKey, want)
+	}
+	if !got.Expiry.Before(time.Now()) {
+		t.Errorf("logout Expiry = %v, want a time in the past", got.Expiry)
+	}
+	if p := c.GetPersist(); p.PrivateNodeKey != (wgcfg.PrivateKey{}) || p.PrivateMachineKey != machinePriv || p.LogoutPending {
+		t.Errorf("after logout, persist = %+v; want only the machine key", p)
+	}
+
+	// With the server gone, logout must fail and keep the node key,
+	// rather than silently leaving it valid on the server.
+	c.persist.PrivateNodeKey = nodePriv
+	c.markLogoutPending()
+	srv.Close()
+	if err := c.TryLogout(context.Background()); err == nil {
+		t.Error("logout with no server succeeded")
+	}
+	if p := c.GetPersist(); p.PrivateNodeKey != nodePriv || !p.LogoutPending {
+		t.Errorf("after failed logout, persist = %+v; want the node key, pending logout", p)
+	}
+}
+
+func TestCapabilityVersion(t *testing.T) {
+	serverPriv, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPub := serverPriv.Public()
+	machinePriv, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machinePub := machinePriv.Public()
+	nodePriv, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotCap tailcfg.CapabilityVersion
+	minCap := tailcfg.CurrentCapabilityVersion + 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/key":
+			w.Write([]byte(serverPub.HexString()))
+		case strings.HasPrefix(r.URL.Path, "/machine/"):
+			msg, _ := ioutil.ReadAll(r.Body)
+			req := new(tailcfg.RegisterRequest)
+			if err := decodeMsg(msg, req, &machinePub, &serverPriv); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			gotCap = req.Capability
+			b, _ := encode(tailcfg.RegisterResponse{MinCapability: minCap}, &machinePub, &serverPriv)
+			w.Write(b)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewDirect(Options{
+		ServerURL: srv.URL,
+		Logf:      t.Logf,
+		Persist: Persist{
+			PrivateMachineKey: machinePriv,
+			PrivateNodeKey:    nodePriv,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.TryLogout(context.Background())
+	var tooOld *TooOldError
+	if !errors.As(err, &tooOld) {
+		t.Fatalf("logout error = %v, want a TooOldError", err)
+	}
+	if tooOld.Have != tailcfg.CurrentCapabilityVersion || tooOld.Min != minCap {
+		t.Errorf("TooOldError = %+v, want Have=%d Min=%d", tooOld, tailcfg.CurrentCapabilityVersion, minCap)
+	}
+	if gotCap != tailcfg.CurrentCapabilityVersion {
+		t.Errorf("request Capability = %d, want %d", gotCap, tailcfg.CurrentCapabilityVersion)
+	}
+	if err := checkCapability(tailcfg.CurrentCapabilityVersion); err != nil {
+		t.Errorf("checkCapability(current) = %v", err)
+	}
+}
+
+func TestFinishMachineKeyRotation(t *testing.T) {
+	newKey := func() wgcfg.PrivateKey {
+		k, err := wgcfg.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	serverPriv := newKey()
+	serverPub := serverPriv.Public()
+	oldMachine, newMachine, node := newKey(), newKey(), newKey()
+	oldMachinePub := oldMachine.Public()
+
+	status := 200
+	var got *tailcfg.RegisterRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/machine/"+oldMachinePub.HexString() {
+			http.NotFound(w, r)
+			return
+		}
+		if status != 200 {
+			http.Error(w, "unknown machine", status)
+			return
+		}
+		msg, _ := ioutil.ReadAll(r.Body)
+		req := new(tailcfg.RegisterRequest)
+		if err := decodeMsg(msg, req, &oldMachinePub, &serverPriv); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		got = req
+		b, _ := encode(tailcfg.RegisterResponse{}, &oldMachinePub, &serverPriv)
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	start := Persist{
+		PrivateMachineKey:    oldMachine,
+		NewPrivateMachineKey: newMachine,
+		PrivateNodeKey:       node,
+	}
+	c, err := NewDirect(Options{ServerURL: srv.URL, Logf: t.Logf, Persist: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := start
+	want.PrivateMachineKey = newMachine
+	want.NewPrivateMachineKey = wgcfg.PrivateKey{}
+
+	p, err := c.finishMachineKeyRotation(context.Background(), start, serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp := c.GetPersist(); !p.Equals(&want) || !cp.Equals(&want) {
+		t.Errorf("after rotation persist = %v, want %v", p.Pretty(), want.Pretty())
+	}
+	if got == nil || got.NewMachineKey == nil || *got.NewMachineKey != tailcfg.MachineKey(newMachine.Public()) {
+		t.Errorf("server got rotation request %+v, want NewMachineKey %v", got, newMachine.Public())
+	}
+
+	// An earlier attempt got through: the server refuses the old
+	// key, and the client carries on with the new one.
+	status = http.StatusForbidden
+	if p, err = c.finishMachineKeyRotation(context.Background(), start, serverPub); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Equals(&want) {
+		t.Errorf("after refused rotation persist = %v, want %v", p.Pretty(), want.Pretty())
+	}
+
+	// A server error leaves the rotation pending.
+	status = http.StatusInternalServerError
+	c.persist = start
+	if _, err := c.finishMachineKeyRotation(context.Background(), start, serverPub); err == nil {
+		t.Error("rotation with server error succeeded")
+	}
+	if got := c.GetPersist(); !got.Equals(&start) {
+		t.Errorf("after failed rotation persist = %v, want %v", got.Pretty(), start.Pretty())
+	}
+}
+
+func TestHealthReportInterval(t *testing.T) {
+	now := time.Unix(1580000000, 0)
+	c := &Direct{timeNow: func() time.Time { return now }}
+	r := &tailcfg.HealthReport{Version: "1.0"}
+
+	c.SetHealthReport(nil)
+	if got := c.takeHealthReportLocked(); got != nil {
+		t.Errorf("took %v with no report set", got)
+	}
+	c.SetHealthReport(r)
+	if got := c.takeHealthReportLocked(); got != r {
+		t.Fatalf("took %v, want %v", got, r)
+	}
+	if got := c.takeHealthReportLocked(); got != nil {
+		t.Errorf("took %v again right after sending", got)
+	}
+
+	now = now.Add(healthReportInterval / 2)
+	if got := c.takeHealthReportLocked(); got != nil {
+		t.Errorf("took %v before healthReportInterval", got)
+	}
+	now = now.Add(healthReportInterval / 2)
+	r2 := &tailcfg.HealthReport{Version: "1.1"}
+	c.SetHealthReport(r2)
+	if got := c.takeHealthReportLocked(); got != r2 {
+		t.Errorf("took %v after healthReportInterval, want the latest, %v", got, r2)
+	}
+	now = now.Add(healthReportInterval)
+	c.SetHealthReport(nil)
+	if got := c.takeHealthReportLocked(); got != nil {
+		t.Errorf("took %v after reporting was turned off", got)
+	}
+}
+
+func TestUpdateEndpointsBatching(t *testing.T) {
+	c := &Client{
+		direct:   &Direct{logf: t.Logf},
+		logf:     t.Logf,
+		newMapCh: make(chan struct{}, 1),
+	}
+	endpoints := func() []string {
+		c.direct.mu.Lock()
+		defer c.direct.mu.Unlock()
+		return append([]string(nil), c.direct.endpoints...)
+	}
+
+	c.UpdateEndpoints(1234, []string{"1.2.3.4:1234"})
+	if got := endpoints(); !reflect.DeepEqual(got, []string{"1.2.3.4:1234"}) {
+		t.Fatalf("first endpoints = %v, want them set right away", got)
+	}
+	<-c.newMapCh
+
+	// A burst of changes ends in one update with the last endpoints.
+	eps := []string{"1.2.3.4:1234", ""}
+	for i := 0; i < 10; i++ {
+		eps[1] = fmt.Sprintf("5.6.7.8:%d", 2000+i)
+		c.UpdateEndpoints(1234, eps)
+	}
+	if got := endpoints(); len(got) != 1 {
+		t.Fatalf("endpoints = %v before the batch delay", got)
+	}
+	select {
+	case <-c.newMapCh:
+	case <-time.After(10 * endpointBatchDelay):
+		t.Fatal("batched endpoints never sent")
+	}
+	if got, want := endpoints(), []string{"1.2.3.4:1234", "5.6.7.8:2009"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("endpoints = %v, want %v", got, want)
+	}
+
+	// The same endpoints in another order aren't a change.
+	c.UpdateEndpoints(1234, []string{"5.6.7.8:2009", "1.2.3.4:1234"})
+	time.Sleep(2 * endpointBatchDelay)
+	select {
+	case <-c.newMapCh:
+		t.Error("reordered endpoints restarted the map request")
+	default:
+	}
+}
+
+func TestSetPaused(t *testing.T) {
+	c := &Client{
+		logf: t.Logf,
+		quit: make(chan struct{}),
+	}
+	c.authCtx, c.authCancel = context.WithCancel(context.Background())
+	c.mapCtx, c.mapCancel = context.WithCancel(context.Background())
+	if !c.waitUnpause("test") {
+		t.Fatal("waitUnpause = false while not paused")
+	}
+
+	mapCtx := c.mapCtx
+	c.SetPaused(true)
+	if mapCtx.Err() == nil {
+		t.Error("pausing didn't cancel the map request")
+	}
+	done := make(chan bool)
+	go func() { done <- c.waitUnpause("test") }()
+	select {
+	case <-done:
+		t.Fatal("waitUnpause returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.SetPaused(false)
+	if !<-done {
+		t.Error("waitUnpause = false after unpause")
+	}
+
+	c.SetPaused(true)
+	go func() { done <- c.waitUnpause("test") }()
+	close(c.quit)
+	if <-done {
+		t.Error("waitUnpause = true after quit")
+	}
+}
@@ -16,8 +16,10 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +28,7 @@ import (
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/oauth2"
+	"tailscale.com/clientmetrics"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/version"
@@ -33,11 +36,23 @@ import (
 )
 
 type Persist struct {
-	PrivateMachineKey wgcfg.PrivateKey
-	PrivateNodeKey    wgcfg.PrivateKey
-	OldPrivateNodeKey wgcfg.PrivateKey // needed to request key rotation
-	Provider          string
-	LoginName         string
+	PrivateMachineKey    wgcfg.PrivateKey
+	NewPrivateMachineKey wgcfg.PrivateKey // machine key rotation in progress, not yet confirmed by control
+	PrivateNodeKey       wgcfg.PrivateKey
+	OldPrivateNodeKey    wgcfg.PrivateKey // needed to request key rotation
+	Provider             string
+	LoginName            string
+
+	// MachineKeyStore, if set, names the KeyStore holding the machine
+	// key, which it knows as MachineKeyRef. PrivateMachineKey is then
+	// unused.
+	MachineKeyStore string `json:",omitempty"`
+	MachineKeyRef   string `json:",omitempty"`
+
+	// LogoutPending is set by a logout that the control server
+	// hasn't yet confirmed. PrivateNodeKey is kept until it does,
+	// so that the key can still be expired after a restart.
+	LogoutPending bool `json:",omitempty"`
 }
 
 func (p *Persist) Equals(p2 *Persist) bool {
@@ -49,10 +64,14 @@ func (p *Persist) Equals(p2 *Persist) bool {
 	}
 
 	return p.PrivateMachineKey.Equal(p2.PrivateMachineKey) &&
+		p.NewPrivateMachineKey.Equal(p2.NewPrivateMachineKey) &&
 		p.PrivateNodeKey.Equal(p2.PrivateNodeKey) &&
 		p.OldPrivateNodeKey.Equal(p2.OldPrivateNodeKey) &&
 		p.Provider == p2.Provider &&
-		p.LoginName == p2.LoginName
+		p.LoginName == p2.LoginName &&
+		p.MachineKeyStore == p2.MachineKeyStore &&
+		p.MachineKeyRef == p2.MachineKeyRef &&
+		p.LogoutPending == p2.LogoutPending
 }
 
 func (p *Persist) Pretty() string {
@@ -66,21 +85,28 @@ func (p *Persist) Pretty() string {
 	if !p.PrivateNodeKey.IsZero() {
 		nk = p.PrivateNodeKey.Public()
 	}
+	m := mk.ShortString()
+	if p.MachineKeyStore != "" {
+		m = p.MachineKeyStore + ":" + p.MachineKeyRef
+	}
 	return fmt.Sprintf("Persist{m=%v, o=%v, n=%v u=%#v}",
-		mk.ShortString(), ok.ShortString(), nk.ShortString(),
+		m, ok.ShortString(), nk.ShortString(),
 		p.LoginName)
 }
 
 // Direct is the client that connects to a tailcontrol server for a node.
 type Direct struct {
-	httpc           *http.Client // HTTP client used to talk to tailcontrol
-	serverURL       string       // URL of the tailcontrol server
+	serverURL       string // URL of the tailcontrol server
 	timeNow         func() time.Time
 	newDecompressor func() (Decompressor, error)
 	keepAlive       bool
 	logf            logger.Logf
+	authKey         string
+	ephemeral       bool
+	keyStore        string // KeyStore for new machine keys, or empty
 
-	mu           sync.Mutex // mutex guards the following fields
+	mu           sync.Mutex   // mutex guards the following fields
+	httpc        *http.Client // HTTP client used to talk to tailcontrol
 	serverKey    wgcfg.Key
 	persist      Persist
 	tryingNewKey wgcfg.PrivateKey
@@ -88,17 +114,30 @@ type Direct struct {
 	hostinfo     tailcfg.Hostinfo
 	endpoints    []string
 	localPort    uint16 // or zero to mean auto
+	netinfo      *tailcfg.NetInfo
+
+	health     *tailcfg.HealthReport // latest health report, or nil to send none
+	healthSent time.Time             // when a health report last went out
 }
 
+// healthReportInterval is the minimum time between health reports
+// sent to the control server.
+const healthReportInterval = 10 * time.Minute
+
 type Options struct {
 	Persist         Persist          // initial persistent data
 	HTTPC           *http.Client     // HTTP client used to talk to tailcontrol
+	ProxyURL        string           // optional HTTP(S) proxy for tailcontrol, overriding $HTTPS_PROXY etc; ignored if HTTPC is set
+	ControlPins     []string         // optional TLS key pins for tailcontrol, see CheckPin; ignored if HTTPC is set
 	ServerURL       string           // URL of the tailcontrol server
 	TimeNow         func() time.Time // time.Now implementation used by Client
 	Hostinfo        *tailcfg.Hostinfo
 	NewDecompressor func() (Decompressor, error)
 	KeepAlive       bool
 	Logf            logger.Logf
+	AuthKey         string // optional pre-authorized key for non-interactive login
+	Ephemeral       bool   // ask the server to remove the node when it goes offline
+	KeyStore        string // optional registered KeyStore to generate new machine keys in
 }
 
 type Decompressor interface {
@@ -106,14 +145,24 @@ type Decompressor interface {
 	Close()
 }
 
+// mapPollTimeout is how long a streaming map poll that asked for
+// keep-alives waits without hearing anything from the server before
+// giving up on the connection. Servers send a keep-alive every
+// minute.
+var mapPollTimeout = 120 * time.Second
+
+// errMapPollSilent is returned by PollNetMap when the server stopped
+// sending keep-alives.
+var errMapPollSilent = errors.New("map poll: no keep-alive from server")
+
 // NewDirect returns a new Direct client.
 func NewDirect(opts Options) (*Direct, error) {
 	if opts.ServerURL == "" {
 		return nil, errors.New("controlclient.New: no server URL specified")
 	}
 	opts.ServerURL = strings.TrimRight(opts.ServerURL, "/")
-	if opts.HTTPC == nil {
-		opts.HTTPC = http.DefaultClient
+	if err := CheckServerURL(opts.ServerURL); err != nil {
+		return nil, fmt.Errorf("controlclient.New: %v", err)
 	}
 	if opts.TimeNow == nil {
 		opts.TimeNow = time.Now
@@ -122,6 +171,16 @@ func NewDirect(opts Options) (*Direct, error) {
 		// TODO(apenwarr): remove this default and fail instead.
 		opts.Logf = log.Printf
 	}
+	if opts.HTTPC == nil {
+		httpc, err := newHTTPClient(opts.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		if err := pinTransport(httpc.Transport.(*http.Transport), opts.ServerURL, opts.ControlPins, opts.Logf); err != nil {
+			return nil, err
+		}
+		opts.HTTPC = httpc
+	}
 
 	c := &Direct{
 		httpc:           opts.HTTPC,
@@ -131,6 +190,9 @@ func NewDirect(opts Options) (*Direct, error) {
 		newDecompressor: opts.NewDecompressor,
 		keepAlive:       opts.KeepAlive,
 		persist:         opts.Persist,
+		authKey:         opts.AuthKey,
+		ephemeral:       opts.Ephemeral,
+		keyStore:        opts.KeyStore,
 	}
 	if opts.Hostinfo == nil {
 		c.SetHostinfo(NewHostinfo())
@@ -141,6 +203,29 @@ func NewDirect(opts Options) (*Direct, error) {
 	return c, nil
 }
 
+// SetTransport replaces the HTTP client used to talk to tailcontrol
+// with one using proxyURL and pins, as in Options. Requests in flight
+// finish with the old one.
+func (c *Direct) SetTransport(proxyURL string, pins []string) error {
+	httpc, err := newHTTPClient(proxyURL)
+	if err != nil {
+		return err
+	}
+	if err := pinTransport(httpc.Transport.(*http.Transport), c.serverURL, pins, c.logf); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.httpc = httpc
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Direct) httpClient() *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.httpc
+}
+
 func NewHostinfo() tailcfg.Hostinfo {
 	hostname, _ := os.Hostname()
 	os := runtime.GOOS
@@ -169,6 +254,37 @@ func (c *Direct) SetHostinfo(hi tailcfg.Hostinfo) {
 	c.hostinfo = hi
 }
 
+// SetHealthReport sets the health report to send to the control
+// server with the next map request, or nil to stop sending one.
+func (c *Direct) SetHealthReport(r *tailcfg.HealthReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.health = r
+}
+
+// SetNetInfo sets the network conditions to send to the control
+// server with each map request. It reports whether they changed
+// enough to be worth a new map request; latencies alone don't.
+func (c *Direct) SetNetInfo(ni *tailcfg.NetInfo) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := !c.netinfo.BasicallyEqual(ni)
+	c.netinfo = ni
+	return changed
+}
+
+// takeHealthReportLocked returns the health report to include in a
+// map request, if one is due. c.mu must be held.
+func (c *Direct) takeHealthReportLocked() *tailcfg.HealthReport {
+	now := c.timeNow()
+	if c.health == nil || now.Sub(c.healthSent) < healthReportInterval {
+		return nil
+	}
+	c.healthSent = now
+	return c.health
+}
+
 func (c *Direct) GetPersist() Persist {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -182,22 +298,164 @@ const (
 	LoginInteractive = LoginFlags(1 << iota) // force user login and key refresh
 )
 
+// TryLogout asks the control server to expire the current node key
+// and then forgets it. The local state is kept until the server
+// acknowledges, so that a copy of the state file can't be used to
+// bring the node back after logging out.
 func (c *Direct) TryLogout(ctx context.Context) error {
 	c.logf("direct.TryLogout()\n")
 
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	persist := c.persist
+	serverKey := c.serverKey
+	c.mu.Unlock()
 
-	// TODO(crawshaw): Tell the server. This node key should be
-	// immediately invalidated.
-	//if c.persist.PrivateNodeKey != (wgcfg.PrivateKey{}) {
-	//}
+	if persist.PrivateNodeKey != (wgcfg.PrivateKey{}) && persist.hasMachineKey() {
+		if serverKey == (wgcfg.Key{}) {
+			var err error
+			serverKey, err = loadServerKey(ctx, c.httpClient(), c.serverURL)
+			if err != nil {
+				return err
+			}
+			c.mu.Lock()
+			c.serverKey = serverKey
+			c.mu.Unlock()
+		}
+		request := tailcfg.RegisterRequest{
+			Version:    1,
+			NodeKey:    tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
+			Hostinfo:   c.hostinfo,
+			Capability: tailcfg.CurrentCapabilityVersion,
+			// Any time in the past expires the key now.
+			Expiry: time.Unix(123, 0),
+		}
+		request.Auth.Provider = persist.Provider
+		request.Auth.LoginName = persist.LoginName
+		c.logf("LogoutReq: node=%v\n", request.NodeKey.AbbrevString())
+		mkey, err := machineKeyOf(&persist)
+		if err != nil {
+			return fmt.Errorf("logout: %w", err)
+		}
+		if _, err := c.register(ctx, &request, serverKey, mkey); err != nil {
+			return fmt.Errorf("logout: %w", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.persist = Persist{
 		PrivateMachineKey: c.persist.PrivateMachineKey,
+		MachineKeyStore:   c.persist.MachineKeyStore,
+		MachineKeyRef:     c.persist.MachineKeyRef,
 	}
+	c.tryingNewKey = wgcfg.PrivateKey{}
+	c.expiry = nil
 	return nil
 }
 
+// markLogoutPending sets Persist.LogoutPending, until TryLogout
+// succeeds or a login abandons the logout.
+func (c *Direct) markLogoutPending() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.persist.LogoutPending = true
+}
+
+// SetNewMachineKey starts replacing the machine key with k. The
+// switch happens on the next login, which tells the control server
+// about k before using it. Until then, k is reported as
+// Persist.NewPrivateMachineKey, so that callers that save Persist can
+// resume an interrupted rotation.
+func (c *Direct) SetNewMachineKey(k wgcfg.PrivateKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.persist.NewPrivateMachineKey = k
+}
+
+// finishMachineKeyRotation moves the node to persist's new machine
+// key, telling the control server if it knows the node already.
+func (c *Direct) finishMachineKeyRotation(ctx context.Context, persist Persist, serverKey wgcfg.Key) (Persist, error) {
+	newKey := tailcfg.MachineKey(persist.NewPrivateMachineKey.Public())
+	if persist.hasMachineKey() && !persist.PrivateNodeKey.IsZero() {
+		mkey, err := machineKeyOf(&persist)
+		if err != nil {
+			return persist, fmt.Errorf("machine key rotation: %w", err)
+		}
+		request := tailcfg.RegisterRequest{
+			Version:       1,
+			NodeKey:       tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
+			Hostinfo:      c.hostinfo,
+			NewMachineKey: &newKey,
+			Capability:    tailcfg.CurrentCapabilityVersion,
+		}
+		request.Auth.Provider = persist.Provider
+		request.Auth.LoginName = persist.LoginName
+		c.logf("RotateMachineKeyReq: new=%v\n", newKey)
+		_, err = c.register(ctx, &request, serverKey, mkey)
+		var he *httpError
+		switch {
+		case err == nil:
+		case errors.As(err, &he) && he.StatusCode >= 400 && he.StatusCode < 500:
+			// The server no longer accepts the old key. Most
+			// likely an earlier attempt got through but we
+			// didn't hear back. Carry on with the new key; if
+			// that's wrong, logging in with it will say so.
+			c.logf("machine key rotation: old key refused (%v), using new key\n", err)
+		default:
+			return persist, fmt.Errorf("machine key rotation: %w", err)
+		}
+	}
+
+	persist.PrivateMachineKey = persist.NewPrivateMachineKey
+	persist.NewPrivateMachineKey = wgcfg.PrivateKey{}
+	persist.MachineKeyStore = ""
+	persist.MachineKeyRef = ""
+	c.mu.Lock()
+	c.persist = persist
+	c.mu.Unlock()
+	c.logf("machine key rotated to %v\n", newKey)
+	return persist, nil
+}
+
+// register sends request to the control server's registration
+// endpoint on behalf of machine key mkey.
+func (c *Direct) register(ctx context.Context, request *tailcfg.RegisterRequest, serverKey wgcfg.Key, mkey machineKey) (*tailcfg.RegisterResponse, error) {
+	mpub, err := mkey.public()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := mkey.sharedKey(serverKey)
+	if err != nil {
+		return nil, err
+	}
+	bodyData, err := sealMsg(request, shared)
+	if err != nil {
+		return nil, err
+	}
+	body := bytes.NewReader(bodyData)
+
+	u := fmt.Sprintf("%s/machine/%s", c.serverURL, mpub.HexString())
+	req, err := http.NewRequest("POST", u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("register request: %v", err)
+	}
+	c.logf("RegisterReq: returned.\n")
+	resp := &tailcfg.RegisterResponse{}
+	if err := decode(res, resp, shared); err != nil {
+		return nil, fmt.Errorf("register request: %w", err)
+	}
+	if err := checkCapability(resp.MinCapability); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
 func (c *Direct) TryLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags) (url string, err error) {
 	c.logf("direct.TryLogin(%v, %v)\n", t != nil, flags)
 	return c.doLoginOrRegen(ctx, t, flags, false, "")
@@ -227,7 +485,20 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 	expired := c.expiry != nil && !c.expiry.IsZero() && c.expiry.Before(c.timeNow())
 	c.mu.Unlock()
 
-	if persist.PrivateMachineKey == (wgcfg.PrivateKey{}) {
+	if !persist.hasMachineKey() && c.keyStore != "" {
+		c.logf("Generating a new machinekey in key store %q.\n", c.keyStore)
+		ks, err := lookupKeyStore(c.keyStore)
+		if err != nil {
+			return regen, url, err
+		}
+		ref, err := ks.GenerateKey()
+		if err != nil {
+			return regen, url, fmt.Errorf("key store %q: %v", c.keyStore, err)
+		}
+		persist.MachineKeyStore = c.keyStore
+		persist.MachineKeyRef = ref
+	}
+	if !persist.hasMachineKey() {
 		c.logf("Generating a new machinekey.\n")
 		mkey, err := wgcfg.NewPrivateKey()
 		if err != nil {
@@ -248,7 +519,7 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 	c.logf("doLogin(regen=%v, hasUrl=%v)\n", regen, url != "")
 	if serverKey == (wgcfg.Key{}) {
 		var err error
-		serverKey, err = loadServerKey(ctx, c.httpc, c.serverURL)
+		serverKey, err = loadServerKey(ctx, c.httpClient(), c.serverURL)
 		if err != nil {
 			return regen, url, err
 		}
@@ -257,6 +528,12 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 		c.serverKey = serverKey
 		c.mu.Unlock()
 	}
+	if !persist.NewPrivateMachineKey.IsZero() {
+		persist, err = c.finishMachineKeyRotation(ctx, persist, serverKey)
+		if err != nil {
+			return regen, url, err
+		}
+	}
 
 	var oldNodeKey wgcfg.Key
 	if url != "" {
@@ -290,6 +567,8 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 		NodeKey:    tailcfg.NodeKey(tryingNewKey.Public()),
 		Hostinfo:   c.hostinfo,
 		Followup:   url,
+		Ephemeral:  c.ephemeral,
+		Capability: tailcfg.CurrentCapabilityVersion,
 	}
 	c.logf("RegisterReq: onode=%v node=%v fup=%v\n",
 		request.OldNodeKey.AbbrevString(),
@@ -297,28 +576,15 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 	request.Auth.Oauth2Token = t
 	request.Auth.Provider = persist.Provider
 	request.Auth.LoginName = persist.LoginName
-	bodyData, err := encode(request, &serverKey, &persist.PrivateMachineKey)
+	request.Auth.AuthKey = c.authKey
+	mkey, err := machineKeyOf(&persist)
 	if err != nil {
 		return regen, url, err
 	}
-	body := bytes.NewReader(bodyData)
-
-	u := fmt.Sprintf("%s/machine/%s", c.serverURL, persist.PrivateMachineKey.Public().HexString())
-	req, err := http.NewRequest("POST", u, body)
+	resp, err := c.register(ctx, &request, serverKey, mkey)
 	if err != nil {
 		return regen, url, err
 	}
-	req = req.WithContext(ctx)
-
-	res, err := c.httpc.Do(req)
-	if err != nil {
-		return regen, url, fmt.Errorf("register request: %v", err)
-	}
-	c.logf("RegisterReq: returned.\n")
-	resp := tailcfg.RegisterResponse{}
-	if err := decode(res, &resp, &serverKey, &persist.PrivateMachineKey); err != nil {
-		return regen, url, fmt.Errorf("register request: %v", err)
-	}
 
 	if resp.NodeKeyExpired {
 		if regen {
@@ -351,6 +617,8 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 	if resp.AuthURL == "" {
 		// key rotation is complete
 		persist.PrivateNodeKey = tryingNewKey
+		// Logging in again abandons any logout in progress.
+		persist.LogoutPending = false
 	} else {
 		// save it for the retry-with-URL
 		c.tryingNewKey = tryingNewKey
@@ -367,10 +635,36 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 	return false, resp.AuthURL, nil
 }
 
-func sameStrings(a, b []string) bool {
+// TooOldError is returned when the control server no longer supports
+// this client's capability version.
+type TooOldError struct {
+	Have tailcfg.CapabilityVersion // this client's
+	Min  tailcfg.CapabilityVersion // the server's minimum
+}
+
+func (e *TooOldError) Error() string {
+	return fmt.Sprintf("this client is too old for the control server (capability version %d, server requires %d); please update Tailscale", e.Have, e.Min)
+}
+
+// checkCapability returns a *TooOldError if min, from a server
+// response, is newer than this client.
+func checkCapability(min tailcfg.CapabilityVersion) error {
+	if min > tailcfg.CurrentCapabilityVersion {
+		return &TooOldError{Have: tailcfg.CurrentCapabilityVersion, Min: min}
+	}
+	return nil
+}
+
+// sameEndpoints reports whether a and b hold the same endpoints, in
+// any order.
+func sameEndpoints(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
 	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
 	for i := range a {
 		if a[i] != b[i] {
 			return false
@@ -388,10 +682,10 @@ func (c *Direct) newEndpoints(localPort uint16, endpoints []string) (changed boo
 	defer c.mu.Unlock()
 
 	// Nothing new?
-	if c.localPort == localPort && sameStrings(c.endpoints, endpoints) {
+	if c.localPort == localPort && sameEndpoints(c.endpoints, endpoints) {
 		return false // unchanged
 	}
-	c.logf("client.newEndpoints(%v, %v)\n", localPort, endpoints)
+	c.logf("[v1] client.newEndpoints(%v, %v)\n", localPort, endpoints)
 	c.localPort = localPort
 	c.endpoints = append(c.endpoints[:0], endpoints...)
 	return true // changed
@@ -406,6 +700,12 @@ func (c *Direct) SetEndpoints(localPort uint16, endpoints []string) (changed boo
 	return c.newEndpoints(localPort, endpoints)
 }
 
+var (
+	metricMapPolls      = clientmetrics.NewCounter("controlclient_map_polls", "Map requests made to the control server.")
+	metricMapResponses  = clientmetrics.NewCounter("controlclient_map_responses", "Map responses received from the control server, other than keep-alives.")
+	metricMapKeepAlives = clientmetrics.NewCounter("controlclient_map_keepalives", "Keep-alives received on map long-polls.")
+)
+
 func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkMap)) error {
 	c.mu.Lock()
 	persist := c.persist
@@ -414,6 +714,8 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 	hostinfo := c.hostinfo
 	localPort := c.localPort
 	ep := append([]string(nil), c.endpoints...)
+	health := c.takeHealthReportLocked()
+	netinfo := c.netinfo
 	c.mu.Unlock()
 
 	if hostinfo.BackendLogID == "" {
@@ -421,26 +723,41 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 	}
 
 	allowStream := maxPolls != 1
-	c.logf("PollNetMap: stream=%v :%v %v\n", maxPolls, localPort, ep)
+	c.logf("[v1] PollNetMap: stream=%v :%v %v\n", maxPolls, localPort, ep)
+	metricMapPolls.Add(1)
 
 	request := tailcfg.MapRequest{
-		Version:   4,
+		Version:   tailcfg.CurrentCapabilityVersion,
 		KeepAlive: c.keepAlive,
 		NodeKey:   tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
 		Endpoints: ep,
 		Stream:    allowStream,
 		Hostinfo:  hostinfo,
+		Health:    health,
+		NetInfo:   netinfo,
 	}
 	if c.newDecompressor != nil {
 		request.Compress = "zstd"
 	}
 
-	bodyData, err := encode(request, &serverKey, &persist.PrivateMachineKey)
+	mkey, err := machineKeyOf(&persist)
+	if err != nil {
+		return err
+	}
+	mpub, err := mkey.public()
+	if err != nil {
+		return err
+	}
+	shared, err := mkey.sharedKey(serverKey)
+	if err != nil {
+		return err
+	}
+	bodyData, err := sealMsg(request, shared)
 	if err != nil {
 		return err
 	}
 
-	u := fmt.Sprintf("%s/machine/%s/map", serverURL, persist.PrivateMachineKey.Public().HexString())
+	u := fmt.Sprintf("%s/machine/%s/map", serverURL, mpub.HexString())
 	req, err := http.NewRequest("POST", u, bytes.NewReader(bodyData))
 	if err != nil {
 		return err
@@ -449,43 +766,64 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 	defer cancel()
 	req = req.WithContext(ctx)
 
-	res, err := c.httpc.Do(req)
+	res, err := c.httpClient().Do(req)
 	if err != nil {
 		return err
 	}
 	if res.StatusCode != 200 {
 		msg, _ := ioutil.ReadAll(res.Body)
 		res.Body.Close()
-		return fmt.Errorf("initial fetch failed %d: %s",
-			res.StatusCode, strings.TrimSpace(string(msg)))
+		return fmt.Errorf("initial fetch failed: %w",
+			&httpError{StatusCode: res.StatusCode, Msg: strings.TrimSpace(string(msg))})
 	}
 	defer res.Body.Close()
 
-	// If we go more than pollTimeout without hearing from the server,
-	// end the long poll. We should be receiving a keep alive ping
-	// every minute.
-	const pollTimeout = 120 * time.Second
-	timeout := time.NewTimer(pollTimeout)
-	timeoutReset := make(chan struct{})
-	defer close(timeoutReset)
-	go func() {
-		for {
+	// If we asked for keep-alives and go more than mapPollTimeout
+	// without hearing from the server, the connection is probably
+	// dead even if TCP hasn't noticed yet: end the long poll so that
+	// the caller reconnects. Without keep-alives, the server may
+	// legitimately stay silent for as long as nothing changes.
+	resetTimeout := func() {}
+	silent := make(chan struct{}) // closed when the poll times out
+	if c.keepAlive && allowStream {
+		timeoutReset := make(chan struct{})
+		defer close(timeoutReset)
+		resetTimeout = func() {
 			select {
-			case <-timeout.C:
-				c.logf("map response long-poll timed out!")
-				cancel()
-				return
-			case _, ok := <-timeoutReset:
-				if !ok {
-					return // channel closed, shut down goroutine
-				}
-				if !timeout.Stop() {
-					<-timeout.C
+			case timeoutReset <- struct{}{}:
+			case <-silent: // timer goroutine is gone
+			}
+		}
+		timeout := time.NewTimer(mapPollTimeout)
+		go func() {
+			defer timeout.Stop()
+			for {
+				select {
+				case <-timeout.C:
+					c.logf("map response long-poll timed out!")
+					close(silent)
+					cancel()
+					return
+				case _, ok := <-timeoutReset:
+					if !ok {
+						return // channel closed, shut down goroutine
+					}
+					if !timeout.Stop() {
+						<-timeout.C
+					}
+					timeout.Reset(mapPollTimeout)
 				}
-				timeout.Reset(pollTimeout)
 			}
+		}()
+	}
+	readErr := func(err error) error {
+		select {
+		case <-silent:
+			return errMapPollSilent
+		default:
+			return err
 		}
-	}()
+	}
 
 	// If allowStream, then the server will use an HTTP long poll to
 	// return incremental results. There is always one response right
@@ -494,16 +832,23 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 	// the same format before just closing the connection.
 	// We can use this same read loop either way.
 	var msg []byte
+	var peers []tailcfg.Node                                // patched by delta responses
+	var userProfiles map[tailcfg.UserID]tailcfg.UserProfile // likewise
+	var derpMap *tailcfg.DERPMap                            // last one sent
+	first := true
 	for i := 0; i < maxPolls || maxPolls < 0; i++ {
 		var siz [4]byte
 		if _, err := io.ReadFull(res.Body, siz[:]); err != nil {
-			return err
+			return readErr(err)
 		}
 		size := binary.LittleEndian.Uint32(siz[:])
 		msg = append(msg[:0], make([]byte, size)...)
 		if _, err := io.ReadFull(res.Body, msg); err != nil {
-			return err
+			return readErr(err)
 		}
+		// Any message, not just a keep-alive, shows the stream is
+		// still alive.
+		resetTimeout()
 
 		var resp tailcfg.MapResponse
 
@@ -514,30 +859,50 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 		// TODO(apenwarr 2020-02-01): remove after tailcontrol is fully deployed.
 		resp.PacketFilter = filter.MatchAllowAll
 
-		if err := c.decodeMsg(msg, &resp); err != nil {
+		if err := c.decodeMsg(msg, &resp, shared); err != nil {
 			return err
 		}
 		if resp.KeepAlive {
-			c.logf("map response keep alive received")
-			timeoutReset <- struct{}{}
+			c.logf("[v1] map response keep alive received")
+			metricMapKeepAlives.Add(1)
 			continue
 		}
+		metricMapResponses.Add(1)
+		if err := checkCapability(resp.MinCapability); err != nil {
+			return err
+		}
+		if isDelta(&resp, first) {
+			c.logf("[v1] map response delta: %d changed, %d removed", len(resp.PeersChanged), len(resp.PeersRemoved))
+		}
+		peers = updatePeers(peers, &resp, first)
+		userProfiles = updateUserProfiles(userProfiles, &resp, first)
+		first = false
+		if resp.DERPMap != nil {
+			c.logf("map response: new DERP map with %d regions", len(resp.DERPMap.Regions))
+			derpMap = resp.DERPMap
+		}
 
 		nm := &NetworkMap{
 			NodeKey:      tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
+			Name:         resp.Node.Name,
 			PrivateKey:   persist.PrivateNodeKey,
 			Expiry:       resp.Node.KeyExpiry,
 			Addresses:    resp.Node.Addresses,
-			Peers:        resp.Peers,
+			Peers:        append([]tailcfg.Node(nil), peers...),
 			LocalPort:    localPort,
 			User:         resp.Node.User,
-			UserProfiles: make(map[tailcfg.UserID]tailcfg.UserProfile),
+			UserProfiles: userProfiles,
 			Domain:       resp.Domain,
 			Roles:        resp.Roles,
 			DNS:          resp.DNS,
 			DNSDomains:   resp.SearchPaths,
 			Hostinfo:     resp.Node.Hostinfo,
 			PacketFilter: resp.PacketFilter,
+			Tags:         resp.Node.Tags,
+			DERPMap:      derpMap,
+		}
+		if resp.DNSConfig != nil {
+			nm.DNSConfig = *resp.DNSConfig
 		}
 		// Temporary (2020-02-21) knob to force debug, during DERP testing:
 		if ok, _ := strconv.ParseBool(os.Getenv("DEBUG_FORCE_DERP")); ok {
@@ -547,9 +912,6 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 				peer.Endpoints = append([]string{"127.3.3.40:1"}, peer.Endpoints...)
 			}
 		}
-		for _, profile := range resp.UserProfiles {
-			nm.UserProfiles[profile.ID] = profile
-		}
 		if resp.Node.MachineAuthorized {
 			nm.MachineStatus = tailcfg.MachineAuthorized
 		} else {
@@ -564,28 +926,25 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 		cb(nm)
 	}
 	if ctx.Err() != nil {
-		return ctx.Err()
+		return readErr(ctx.Err())
 	}
 	return nil
 }
 
-func decode(res *http.Response, v interface{}, serverKey *wgcfg.Key, mkey *wgcfg.PrivateKey) error {
+func decode(res *http.Response, v interface{}, shared *[32]byte) error {
 	defer res.Body.Close()
 	msg, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
 	if err != nil {
 		return err
 	}
 	if res.StatusCode != 200 {
-		return fmt.Errorf("%d: %v", res.StatusCode, string(msg))
+		return &httpError{StatusCode: res.StatusCode, Msg: string(msg)}
 	}
-	return decodeMsg(msg, v, serverKey, mkey)
+	return decodeShared(msg, v, shared)
 }
 
-func (c *Direct) decodeMsg(msg []byte, v interface{}) error {
-	mkey := c.persist.PrivateMachineKey
-	serverKey := c.serverKey
-
-	decrypted, err := decryptMsg(msg, &serverKey, &mkey)
+func (c *Direct) decodeMsg(msg []byte, v interface{}, shared *[32]byte) error {
+	decrypted, err := openMsg(msg, shared)
 	if err != nil {
 		return err
 	}
@@ -612,7 +971,11 @@ func (c *Direct) decodeMsg(msg []byte, v interface{}) error {
 }
 
 func decodeMsg(msg []byte, v interface{}, serverKey *wgcfg.Key, mkey *wgcfg.PrivateKey) error {
-	decrypted, err := decryptMsg(msg, serverKey, mkey)
+	return decodeShared(msg, v, precompute(serverKey, mkey))
+}
+
+func decodeShared(msg []byte, v interface{}, shared *[32]byte) error {
+	decrypted, err := openMsg(msg, shared)
 	if err != nil {
 		return err
 	}
@@ -622,7 +985,8 @@ func decodeMsg(msg []byte, v interface{}, serverKey *wgcfg.Key, mkey *wgcfg.Priv
 	return nil
 }
 
-func decryptMsg(msg []byte, serverKey *wgcfg.Key, mkey *wgcfg.PrivateKey) ([]byte, error) {
+// openMsg opens msg, sealed with the box shared key.
+func openMsg(msg []byte, shared *[32]byte) ([]byte, error) {
 	var nonce [24]byte
 	if len(msg) < len(nonce)+1 {
 		return nil, fmt.Errorf("response missing nonce, len=%d", len(msg))
@@ -630,8 +994,7 @@ func decryptMsg(msg []byte, serverKey *wgcfg.Key, mkey *wgcfg.PrivateKey) ([]byt
 	copy(nonce[:], msg)
 	msg = msg[len(nonce):]
 
-	pub, pri := (*[32]byte)(serverKey), (*[32]byte)(mkey)
-	decrypted, ok := box.Open(nil, msg, &nonce, pub, pri)
+	decrypted, ok := box.OpenAfterPrecomputation(nil, msg, &nonce, shared)
 	if !ok {
 		return nil, fmt.Errorf("cannot decrypt response")
 	}
@@ -639,6 +1002,11 @@ func decryptMsg(msg []byte, serverKey *wgcfg.Key, mkey *wgcfg.PrivateKey) ([]byt
 }
 
 func encode(v interface{}, serverKey *wgcfg.Key, mkey *wgcfg.PrivateKey) ([]byte, error) {
+	return sealMsg(v, precompute(serverKey, mkey))
+}
+
+// sealMsg encodes v and seals it with the box shared key.
+func sealMsg(v interface{}, shared *[32]byte) ([]byte, error) {
 	b, err := json.Marshal(v)
 	if err != nil {
 		return nil, err
@@ -647,11 +1015,34 @@ func encode(v interface{}, serverKey *wgcfg.Key, mkey *wgcfg.PrivateKey) ([]byte
 	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
 		panic(err)
 	}
-	pub, pri := (*[32]byte)(serverKey), (*[32]byte)(mkey)
-	msg := box.Seal(nonce[:], b, &nonce, pub, pri)
+	msg := box.SealAfterPrecomputation(nonce[:], b, &nonce, shared)
 	return msg, nil
 }
 
+// precompute returns the box shared key of pub and priv.
+func precompute(pub *wgcfg.Key, priv *wgcfg.PrivateKey) *[32]byte {
+	var shared [32]byte
+	box.Precompute(&shared, (*[32]byte)(pub), (*[32]byte)(priv))
+	return &shared
+}
+
+// CheckServerURL reports whether s is a usable control server URL:
+// an http or https URL with a host. Any server implementing the
+// control protocol can be used, not just Tailscale's.
+func CheckServerURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid server URL %q: %v", s, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("server URL %q: scheme must be http or https", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("server URL %q: missing host", s)
+	}
+	return nil
+}
+
 func loadServerKey(ctx context.Context, httpc *http.Client, serverURL string) (wgcfg.Key, error) {
 	req, err := http.NewRequest("GET", serverURL+"/key", nil)
 	if err != nil {
@@ -670,7 +1061,9 @@ func loadServerKey(ctx context.Context, httpc *http.Client, serverURL string) (w
 	if res.StatusCode != 200 {
 		return wgcfg.Key{}, fmt.Errorf("fetch control key: %d: %s", res.StatusCode, string(b))
 	}
-	key, err := wgcfg.ParseHexKey(string(b))
+	// Be lenient about surrounding whitespace, which other server
+	// implementations commonly add.
+	key, err := wgcfg.ParseHexKey(strings.TrimSpace(string(b)))
 	if err != nil {
 		return wgcfg.Key{}, fmt.Errorf("fetch control key: %v", err)
 	}
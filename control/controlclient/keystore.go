@@ -0,0 +1,131 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// A KeyStore keeps machine keys outside of Persist, so that a copied
+// state file doesn't carry the machine's identity with it.
+// FileKeyStore keeps them in files of their own; PKCS11KeyStore keeps
+// them on a hardware token, which never lets them out.
+//
+// Messages to and from the control server are sealed with NaCl box,
+// which only needs the shared key of the machine key and the server's
+// public key, so a store never has to give up a private key. That
+// takes X25519, which PKCS#11 3.0 tokens can do, but TPMs and the
+// Secure Enclave can't (their ECDH is on P-256), so they can't hold
+// machine keys. Node keys can't be kept in a KeyStore, as wireguard
+// needs their bytes.
+type KeyStore interface {
+	// GenerateKey creates a new machine key that can't be exported,
+	// and returns the reference by which the store finds it again.
+	GenerateKey() (ref string, err error)
+	// PublicKey returns the public half of the key ref.
+	PublicKey(ref string) (wgcfg.Key, error)
+	// SharedKey returns what box.Precompute computes from peer and
+	// the private half of the key ref.
+	SharedKey(ref string, peer wgcfg.Key) ([32]byte, error)
+}
+
+var (
+	keyStoresMu sync.Mutex
+	keyStores   = map[string]KeyStore{}
+)
+
+// RegisterKeyStore makes ks available under name, for
+// Options.KeyStore and Persist.MachineKeyStore. tailscaled registers
+// a FileKeyStore as "file", and a PKCS11KeyStore as "pkcs11".
+func RegisterKeyStore(name string, ks KeyStore) {
+	keyStoresMu.Lock()
+	defer keyStoresMu.Unlock()
+	if _, dup := keyStores[name]; dup {
+		panic("controlclient: duplicate key store " + name)
+	}
+	keyStores[name] = ks
+}
+
+// KeyStores returns the names of the registered key stores, sorted.
+func KeyStores() []string {
+	keyStoresMu.Lock()
+	defer keyStoresMu.Unlock()
+	var names []string
+	for name := range keyStores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupKeyStore(name string) (KeyStore, error) {
+	keyStoresMu.Lock()
+	defer keyStoresMu.Unlock()
+	ks, ok := keyStores[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown key store %q", name)
+	}
+	return ks, nil
+}
+
+// CheckKeyStore returns an error if no key store name is registered.
+func CheckKeyStore(name string) error {
+	_, err := lookupKeyStore(name)
+	return err
+}
+
+var errNoMachineKey = errors.New("no machine key")
+
+// machineKey is a node's machine key, either in Persist or in a
+// KeyStore.
+type machineKey struct {
+	priv wgcfg.PrivateKey // if ks is nil
+	ks   KeyStore
+	ref  string
+}
+
+// machineKeyOf returns p's machine key.
+func machineKeyOf(p *Persist) (machineKey, error) {
+	if p.MachineKeyStore == "" {
+		if p.PrivateMachineKey.IsZero() {
+			return machineKey{}, errNoMachineKey
+		}
+		return machineKey{priv: p.PrivateMachineKey}, nil
+	}
+	ks, err := lookupKeyStore(p.MachineKeyStore)
+	if err != nil {
+		return machineKey{}, fmt.Errorf("machine key: %v", err)
+	}
+	return machineKey{ks: ks, ref: p.MachineKeyRef}, nil
+}
+
+// hasMachineKey reports whether p has a machine key, wherever it's
+// kept.
+func (p *Persist) hasMachineKey() bool {
+	return p.MachineKeyStore != "" || !p.PrivateMachineKey.IsZero()
+}
+
+func (k machineKey) public() (wgcfg.Key, error) {
+	if k.ks == nil {
+		return k.priv.Public(), nil
+	}
+	return k.ks.PublicKey(k.ref)
+}
+
+func (k machineKey) sharedKey(peer wgcfg.Key) (*[32]byte, error) {
+	if k.ks == nil {
+		return precompute(&peer, &k.priv), nil
+	}
+	shared, err := k.ks.SharedKey(k.ref, peer)
+	if err != nil {
+		return nil, fmt.Errorf("machine key: %v", err)
+	}
+	return &shared, nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/atomicfile"
+)
+
+// FileKeyStore is a KeyStore that keeps each machine key in a file of
+// its own in the directory it names, readable only by its owner. It
+// keeps the machine's identity out of the state file, so that a state
+// file copied elsewhere, or to a backup, can't log in as this machine.
+type FileKeyStore string
+
+// GenerateKey writes a new key to a file named by a random ref.
+func (dir FileKeyStore) GenerateKey() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	ref := hex.EncodeToString(b[:])
+	k, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(string(dir), 0700); err != nil {
+		return "", err
+	}
+	if err := atomicfile.WriteFile(dir.path(ref), []byte(hex.EncodeToString(k[:])+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+func (dir FileKeyStore) PublicKey(ref string) (wgcfg.Key, error) {
+	k, err := dir.key(ref)
+	if err != nil {
+		return wgcfg.Key{}, err
+	}
+	return k.Public(), nil
+}
+
+func (dir FileKeyStore) SharedKey(ref string, peer wgcfg.Key) ([32]byte, error) {
+	k, err := dir.key(ref)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return *precompute(&peer, k), nil
+}
+
+func (dir FileKeyStore) path(ref string) string {
+	return filepath.Join(string(dir), ref+".key")
+}
+
+// key reads the key ref from its file.
+func (dir FileKeyStore) key(ref string) (*wgcfg.PrivateKey, error) {
+	if ref == "" || strings.ContainsAny(ref, `/\.`) {
+		return nil, fmt.Errorf("invalid key ref %q", ref)
+	}
+	b, err := ioutil.ReadFile(dir.path(ref))
+	if os.IsNotExist(err) {
+		return nil, errors.New("key file is gone; this state file may have been copied from another machine")
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("key file %s is corrupt", dir.path(ref))
+	}
+	var priv wgcfg.PrivateKey
+	copy(priv[:], raw)
+	return &priv, nil
+}
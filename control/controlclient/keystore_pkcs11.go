@@ -0,0 +1,253 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package controlclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/crypto/salsa20/salsa"
+)
+
+// PKCS#11 3.0 names for X25519 keys, which pkcs11 predates.
+const (
+	ckkECMontgomery           = 0x41
+	ckmECMontgomeryKeyPairGen = 0x1056
+)
+
+// x25519Params is CKA_EC_PARAMS for X25519: the DER encoding of its
+// object identifier, 1.3.101.110 (RFC 8410).
+var x25519Params = []byte{0x06, 0x03, 0x2b, 0x65, 0x6e}
+
+// PKCS11KeyStore is a KeyStore that keeps machine keys on a PKCS#11
+// token, such as a smart card or an HSM, which must support X25519
+// keys (CKK_EC_MONTGOMERY, from PKCS#11 3.0). The keys are generated
+// on the token as sensitive and non-extractable: only the X25519
+// shared secret with the control server's key ever leaves it.
+type PKCS11KeyStore struct {
+	Module string // path of the token's PKCS#11 library
+	Token  string // label of the token
+	PIN    string // the token's user PIN
+
+	mu  sync.Mutex
+	ctx *pkcs11.Ctx          // nil until first used
+	sh  pkcs11.SessionHandle // logged-in session, if ctx is set
+}
+
+// GenerateKey creates a key pair on the token, and returns its
+// CKA_ID, in hex, as the ref.
+func (s *PKCS11KeyStore) GenerateKey() (string, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	pub := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id[:]),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, x25519Params),
+	}
+	priv := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id[:]),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true),
+	}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmECMontgomeryKeyPairGen, nil)}
+	err := s.do(func(ctx *pkcs11.Ctx, sh pkcs11.SessionHandle) error {
+		_, _, err := ctx.GenerateKeyPair(sh, mech, pub, priv)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("pkcs11: generating X25519 key: %v", err)
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+func (s *PKCS11KeyStore) PublicKey(ref string) (wgcfg.Key, error) {
+	var k wgcfg.Key
+	err := s.do(func(ctx *pkcs11.Ctx, sh pkcs11.SessionHandle) error {
+		o, err := findKey(ctx, sh, pkcs11.CKO_PUBLIC_KEY, ref)
+		if err != nil {
+			return err
+		}
+		attrs, err := ctx.GetAttributeValue(sh, o, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return err
+		}
+		point, err := montgomeryPoint(attrs[0].Value)
+		if err != nil {
+			return err
+		}
+		copy(k[:], point)
+		return nil
+	})
+	if err != nil {
+		return wgcfg.Key{}, fmt.Errorf("pkcs11: public key %s: %v", ref, err)
+	}
+	return k, nil
+}
+
+// SharedKey has the token derive the X25519 shared secret of the key
+// ref and peer, and finishes box.Precompute's work on it here.
+func (s *PKCS11KeyStore) SharedKey(ref string, peer wgcfg.Key) ([32]byte, error) {
+	var shared [32]byte
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE,
+		pkcs11.NewECDH1DeriveParams(pkcs11.CKD_NULL, nil, peer[:]))}
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, len(shared)),
+	}
+	err := s.do(func(ctx *pkcs11.Ctx, sh pkcs11.SessionHandle) error {
+		o, err := findKey(ctx, sh, pkcs11.CKO_PRIVATE_KEY, ref)
+		if err != nil {
+			return err
+		}
+		secret, err := ctx.DeriveKey(sh, mech, o, tmpl)
+		if err != nil {
+			return err
+		}
+		defer ctx.DestroyObject(sh, secret)
+		attrs, err := ctx.GetAttributeValue(sh, secret, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if err != nil {
+			return err
+		}
+		if len(attrs[0].Value) != len(shared) {
+			return fmt.Errorf("derived %d bytes, want %d", len(attrs[0].Value), len(shared))
+		}
+		copy(shared[:], attrs[0].Value)
+		return nil
+	})
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("pkcs11: shared key %s: %v", ref, err)
+	}
+	// As box.Precompute does after its scalar multiplication.
+	var zeros [16]byte
+	salsa.HSalsa20(&shared, &zeros, &shared, &salsa.Sigma)
+	return shared, nil
+}
+
+// do runs f on a logged-in session, opening one first if need be.
+// After an error, the session is closed, so that the next call starts
+// afresh, say once the token is plugged back in.
+func (s *PKCS11KeyStore) do(f func(*pkcs11.Ctx, pkcs11.SessionHandle) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if err := f(s.ctx, s.sh); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+// open loads the module and logs in to the token. s.mu must be held.
+func (s *PKCS11KeyStore) open() error {
+	ctx := pkcs11.New(s.Module)
+	if ctx == nil {
+		return fmt.Errorf("can't load %s", s.Module)
+	}
+	if err := ctx.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return err
+	}
+	fail := func(err error) error {
+		ctx.Finalize()
+		ctx.Destroy()
+		return err
+	}
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return fail(err)
+	}
+	slot, found := uint(0), false
+	for _, id := range slots {
+		info, err := ctx.GetTokenInfo(id)
+		if err == nil && info.Label == s.Token {
+			slot, found = id, true
+			break
+		}
+	}
+	if !found {
+		return fail(fmt.Errorf("no token labeled %q", s.Token))
+	}
+	sh, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return fail(err)
+	}
+	if err := ctx.Login(sh, pkcs11.CKU_USER, s.PIN); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		ctx.CloseSession(sh)
+		return fail(fmt.Errorf("login: %v", err))
+	}
+	s.ctx, s.sh = ctx, sh
+	return nil
+}
+
+// close undoes open. s.mu must be held.
+func (s *PKCS11KeyStore) close() {
+	s.ctx.CloseSession(s.sh)
+	s.ctx.Finalize()
+	s.ctx.Destroy()
+	s.ctx = nil
+}
+
+// findKey returns the object of class class whose CKA_ID is ref, in
+// hex.
+func findKey(ctx *pkcs11.Ctx, sh pkcs11.SessionHandle, class uint, ref string) (pkcs11.ObjectHandle, error) {
+	id, err := hex.DecodeString(ref)
+	if err != nil || len(id) == 0 {
+		return 0, fmt.Errorf("invalid key ref %q", ref)
+	}
+	if err := ctx.FindObjectsInit(sh, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkECMontgomery),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}); err != nil {
+		return 0, err
+	}
+	objs, _, err := ctx.FindObjects(sh, 1)
+	ctx.FindObjectsFinal(sh)
+	if err != nil {
+		return 0, err
+	}
+	if len(objs) == 0 {
+		return 0, errors.New("no such key on the token; the state file may have been copied from another machine")
+	}
+	return objs[0], nil
+}
+
+// montgomeryPoint returns the 32-byte X25519 public key in v, a
+// CKA_EC_POINT, which tokens give either raw, as PKCS#11 3.0 says, or
+// DER-wrapped in an OCTET STRING, as for other curves.
+func montgomeryPoint(v []byte) ([]byte, error) {
+	if len(v) == 34 && v[0] == 0x04 && v[1] == 32 {
+		v = v[2:]
+	}
+	if len(v) != 32 {
+		return nil, fmt.Errorf("CKA_EC_POINT of %d bytes isn't an X25519 key", len(v))
+	}
+	return v, nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build cgo
+
+package controlclient
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestMontgomeryPoint(t *testing.T) {
+	raw := bytes.Repeat([]byte{7}, 32)
+	tests := []struct {
+		in  []byte
+		err bool
+	}{
+		{raw, false},
+		{append([]byte{0x04, 32}, raw...), false},
+		{append([]byte{0x03, 32}, raw...), true},
+		{raw[:31], true},
+		{nil, true},
+	}
+	for _, tt := range tests {
+		got, err := montgomeryPoint(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("montgomeryPoint(%x) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && !bytes.Equal(got, raw) {
+			t.Errorf("montgomeryPoint(%x) = %x, want %x", tt.in, got, raw)
+		}
+	}
+}
+
+// TestPKCS11KeyStore runs against a real token, such as SoftHSM's
+// (softhsm2-util --init-token --free --label test --pin 1234 --so-pin
+// 1234), named by TS_TEST_PKCS11_MODULE, TS_TEST_PKCS11_TOKEN and
+// TS_TEST_PKCS11_PIN.
+func TestPKCS11KeyStore(t *testing.T) {
+	module := os.Getenv("TS_TEST_PKCS11_MODULE")
+	if module == "" {
+		t.Skip("TS_TEST_PKCS11_MODULE not set")
+	}
+	ks := &PKCS11KeyStore{
+		Module: module,
+		Token:  os.Getenv("TS_TEST_PKCS11_TOKEN"),
+		PIN:    os.Getenv("TS_TEST_PKCS11_PIN"),
+	}
+
+	ref, err := ks.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ks.PublicKey(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As with FileKeyStore, the token's shared key with a peer is
+	// the one the peer computes from the token's public key.
+	peerPriv, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ks.SharedKey(ref, peerPriv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := precompute(&pub, &peerPriv); got != *want {
+		t.Error("SharedKey differs from the peer's")
+	}
+
+	for _, bad := range []string{"", "zz", "0000000000000000"} {
+		if _, err := ks.PublicKey(bad); err == nil {
+			t.Errorf("PublicKey(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+)
+
+// memKeyStore is a KeyStore that keeps its keys in memory.
+type memKeyStore struct {
+	keys []wgcfg.PrivateKey
+}
+
+func (ks *memKeyStore) GenerateKey() (string, error) {
+	k, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	ks.keys = append(ks.keys, k)
+	return fmt.Sprint(len(ks.keys) - 1), nil
+}
+
+func (ks *memKeyStore) key(ref string) (*wgcfg.PrivateKey, error) {
+	for i := range ks.keys {
+		if fmt.Sprint(i) == ref {
+			return &ks.keys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no key %q", ref)
+}
+
+func (ks *memKeyStore) PublicKey(ref string) (wgcfg.Key, error) {
+	k, err := ks.key(ref)
+	if err != nil {
+		return wgcfg.Key{}, err
+	}
+	return k.Public(), nil
+}
+
+func (ks *memKeyStore) SharedKey(ref string, peer wgcfg.Key) ([32]byte, error) {
+	k, err := ks.key(ref)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return *precompute(&peer, k), nil
+}
+
+var testKeyStore = new(memKeyStore)
+
+func init() {
+	RegisterKeyStore("test", testKeyStore)
+}
+
+func TestKeyStoreLogin(t *testing.T) {
+	serverPriv, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPub := serverPriv.Public()
+
+	var gotMachine string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/key":
+			w.Write([]byte(serverPub.HexString()))
+		case strings.HasPrefix(r.URL.Path, "/machine/"):
+			gotMachine = strings.TrimPrefix(r.URL.Path, "/machine/")
+			machinePub, err := wgcfg.ParseHexKey(gotMachine)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			msg, _ := ioutil.ReadAll(r.Body)
+			req := new(tailcfg.RegisterRequest)
+			if err := decodeMsg(msg, req, &machinePub, &serverPriv); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			b, _ := encode(tailcfg.RegisterResponse{}, &machinePub, &serverPriv)
+			w.Write(b)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewDirect(Options{
+		ServerURL: srv.URL,
+		Logf:      t.Logf,
+		Hostinfo:  &tailcfg.Hostinfo{BackendLogID: "test"},
+		KeyStore:  "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.TryLogin(context.Background(), nil, LoginDefault); err != nil {
+		t.Fatal(err)
+	}
+	p := c.GetPersist()
+	if p.MachineKeyStore != "test" || !p.PrivateMachineKey.IsZero() {
+		t.Fatalf("persist = %+v; want a machine key in the test store only", p)
+	}
+	pub, err := testKeyStore.PublicKey(p.MachineKeyRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotMachine != pub.HexString() {
+		t.Errorf("registered machine %s, want %s", gotMachine, pub.HexString())
+	}
+
+	// Logging out keeps the key where it is.
+	if err := c.TryLogout(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if p2 := c.GetPersist(); p2.MachineKeyStore != p.MachineKeyStore || p2.MachineKeyRef != p.MachineKeyRef {
+		t.Errorf("after logout, persist = %+v; want machine key %s:%s", p2, p.MachineKeyStore, p.MachineKeyRef)
+	}
+
+	if err := CheckKeyStore("nonexistent"); err == nil {
+		t.Error("CheckKeyStore(nonexistent) = nil, want error")
+	}
+}
+
+func TestFileKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ks := FileKeyStore(filepath.Join(dir, "keys"))
+
+	ref, err := ks.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ks.PublicKey(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(ks.path(ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, want 0600", fi.Mode().Perm())
+	}
+
+	// The store's shared key with a peer is the one the peer
+	// computes from the store's public key.
+	peerPriv, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerPub := peerPriv.Public()
+	got, err := ks.SharedKey(ref, peerPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := precompute(&pub, &peerPriv); got != *want {
+		t.Error("SharedKey differs from the peer's")
+	}
+
+	for _, bad := range []string{"", "../x", "missing"} {
+		if _, err := ks.PublicKey(bad); err == nil {
+			t.Errorf("PublicKey(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"tailscale.com/tailcfg"
+)
+
+// isDelta reports whether resp's peers are changes to those of the
+// previous map response in the same poll, rather than the full list.
+// If first is set, resp is the first response of the poll, which is
+// always the full list.
+func isDelta(resp *tailcfg.MapResponse, first bool) bool {
+	return !first && resp.PeersDelta
+}
+
+// updatePeers returns the peer list that results from applying resp
+// to prev, the peer list of the previous map response in the same
+// poll, with first as for isDelta.
+//
+// The result never shares memory with prev, because prev may still
+// be referenced by NetworkMaps handed out earlier.
+func updatePeers(prev []tailcfg.Node, resp *tailcfg.MapResponse, first bool) []tailcfg.Node {
+	var peers []tailcfg.Node
+	if isDelta(resp, first) {
+		peers = changePeers(prev, resp)
+	} else {
+		peers = append([]tailcfg.Node(nil), resp.Peers...)
+	}
+
+	// The nodes in peers may still share pointers with prev, so
+	// replace rather than modify what they point to.
+	for i := range peers {
+		p := &peers[i]
+		if online, ok := resp.OnlineChange[p.Key]; ok {
+			p.Online = &online
+		}
+		if seen, ok := resp.LastSeenChange[p.Key]; ok {
+			p.LastSeen = &seen
+		}
+	}
+	return peers
+}
+
+// updateUserProfiles returns the user profiles that result from
+// applying resp to prev, the profiles of the previous map response
+// in the same poll. As with updatePeers, a full response replaces
+// them all and the result never shares memory with prev.
+func updateUserProfiles(prev map[tailcfg.UserID]tailcfg.UserProfile, resp *tailcfg.MapResponse, first bool) map[tailcfg.UserID]tailcfg.UserProfile {
+	profiles := make(map[tailcfg.UserID]tailcfg.UserProfile)
+	if isDelta(resp, first) {
+		for id, up := range prev {
+			profiles[id] = up
+		}
+	}
+	for _, up := range resp.UserProfiles {
+		profiles[up.ID] = up
+	}
+	return profiles
+}
+
+// changePeers applies resp's PeersChanged and PeersRemoved to prev.
+func changePeers(prev []tailcfg.Node, resp *tailcfg.MapResponse) []tailcfg.Node {
+
+	changed := make(map[tailcfg.NodeKey]*tailcfg.Node, len(resp.PeersChanged))
+	for i := range resp.PeersChanged {
+		changed[resp.PeersChanged[i].Key] = &resp.PeersChanged[i]
+	}
+	removed := make(map[tailcfg.NodeKey]bool, len(resp.PeersRemoved))
+	for _, k := range resp.PeersRemoved {
+		removed[k] = true
+	}
+
+	// Keep the existing order, replacing changed peers in place,
+	// then add any new ones in the order the server sent them.
+	peers := make([]tailcfg.Node, 0, len(prev)+len(resp.PeersChanged))
+	for _, p := range prev {
+		if removed[p.Key] {
+			continue
+		}
+		if n, ok := changed[p.Key]; ok {
+			peers = append(peers, *n)
+			delete(changed, p.Key)
+			continue
+		}
+		peers = append(peers, p)
+	}
+	for _, n := range resp.PeersChanged {
+		if _, ok := changed[n.Key]; ok && !removed[n.Key] {
+			peers = append(peers, n)
+		}
+	}
+	return peers
+}
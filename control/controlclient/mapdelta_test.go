@@ -0,0 +1,188 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestUpdatePeers(t *testing.T) {
+	node := func(k byte, name string) tailcfg.Node {
+		return tailcfg.Node{Key: tailcfg.NodeKey{k}, Name: name}
+	}
+	names := func(peers []tailcfg.Node) []string {
+		ret := []string{}
+		for _, p := range peers {
+			ret = append(ret, p.Name)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name  string
+		prev  []tailcfg.Node
+		resp  tailcfg.MapResponse
+		first bool
+		want  []string
+	}{
+		{
+			name:  "first_full",
+			prev:  []tailcfg.Node{node(9, "stale")},
+			resp:  tailcfg.MapResponse{Peers: []tailcfg.Node{node(1, "a"), node(2, "b")}},
+			first: true,
+			want:  []string{"a", "b"},
+		},
+		{
+			name:  "first_empty",
+			prev:  []tailcfg.Node{node(9, "stale")},
+			first: true,
+			want:  []string{},
+		},
+		{
+			name: "later_full",
+			prev: []tailcfg.Node{node(1, "a")},
+			resp: tailcfg.MapResponse{Peers: []tailcfg.Node{}},
+			want: []string{},
+		},
+		{
+			name: "later_full_nil",
+			prev: []tailcfg.Node{node(1, "a")},
+			want: []string{},
+		},
+		{
+			name: "no_change",
+			prev: []tailcfg.Node{node(1, "a"), node(2, "b")},
+			resp: tailcfg.MapResponse{PeersDelta: true},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "delta",
+			prev: []tailcfg.Node{node(1, "a"), node(2, "b"), node(3, "c")},
+			resp: tailcfg.MapResponse{
+				PeersDelta:   true,
+				PeersChanged: []tailcfg.Node{node(4, "d"), node(2, "b2")},
+				PeersRemoved: []tailcfg.NodeKey{{1}},
+			},
+			want: []string{"b2", "c", "d"},
+		},
+		{
+			name: "changed_and_removed",
+			prev: []tailcfg.Node{node(1, "a")},
+			resp: tailcfg.MapResponse{
+				PeersDelta:   true,
+				PeersChanged: []tailcfg.Node{node(2, "b")},
+				PeersRemoved: []tailcfg.NodeKey{{2}},
+			},
+			want: []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prevNames := names(tt.prev)
+			got := updatePeers(tt.prev, &tt.resp, tt.first)
+			if !reflect.DeepEqual(names(got), tt.want) {
+				t.Errorf("got %v, want %v", names(got), tt.want)
+			}
+			if !reflect.DeepEqual(names(tt.prev), prevNames) {
+				t.Errorf("prev modified: %v, was %v", names(tt.prev), prevNames)
+			}
+		})
+	}
+}
+
+func TestUpdatePeersOnline(t *testing.T) {
+	seen := time.Unix(1580000000, 0)
+	yes := true
+	prev := []tailcfg.Node{
+		{Key: tailcfg.NodeKey{1}, Online: &yes},
+		{Key: tailcfg.NodeKey{2}},
+	}
+	resp := &tailcfg.MapResponse{
+		PeersDelta:     true,
+		OnlineChange:   map[tailcfg.NodeKey]bool{{1}: false, {2}: true},
+		LastSeenChange: map[tailcfg.NodeKey]time.Time{{1}: seen},
+	}
+	got := updatePeers(prev, resp, false)
+	if len(got) != 2 {
+		t.Fatalf("got %d peers, want 2", len(got))
+	}
+	if o := got[0].Online; o == nil || *o {
+		t.Errorf("peer 1 Online = %v, want false", o)
+	}
+	if ls := got[0].LastSeen; ls == nil || !ls.Equal(seen) {
+		t.Errorf("peer 1 LastSeen = %v, want %v", ls, seen)
+	}
+	if o := got[1].Online; o == nil || !*o {
+		t.Errorf("peer 2 Online = %v, want true", o)
+	}
+	if !*prev[0].Online || prev[1].Online != nil {
+		t.Error("updatePeers modified prev")
+	}
+}
+
+func TestUpdateUserProfiles(t *testing.T) {
+	up := func(id tailcfg.UserID, login string) tailcfg.UserProfile {
+		return tailcfg.UserProfile{ID: id, LoginName: login}
+	}
+	logins := func(m map[tailcfg.UserID]tailcfg.UserProfile) map[tailcfg.UserID]string {
+		ret := map[tailcfg.UserID]string{}
+		for id, up := range m {
+			ret[id] = up.LoginName
+		}
+		return ret
+	}
+	prev := map[tailcfg.UserID]tailcfg.UserProfile{
+		1: up(1, "alice@example.com"),
+		2: up(2, "bob@example.com"),
+	}
+
+	tests := []struct {
+		name  string
+		resp  tailcfg.MapResponse
+		first bool
+		want  map[tailcfg.UserID]string
+	}{
+		{
+			name:  "first_full",
+			resp:  tailcfg.MapResponse{UserProfiles: []tailcfg.UserProfile{up(3, "carol@example.com")}},
+			first: true,
+			want:  map[tailcfg.UserID]string{3: "carol@example.com"},
+		},
+		{
+			name: "later_full",
+			resp: tailcfg.MapResponse{
+				UserProfiles: []tailcfg.UserProfile{up(1, "alice@example.com")},
+			},
+			want: map[tailcfg.UserID]string{1: "alice@example.com"},
+		},
+		{
+			name: "delta",
+			resp: tailcfg.MapResponse{PeersDelta: true, UserProfiles: []tailcfg.UserProfile{
+				up(2, "robert@example.com"),
+				up(3, "carol@example.com"),
+			}},
+			want: map[tailcfg.UserID]string{
+				1: "alice@example.com",
+				2: "robert@example.com",
+				3: "carol@example.com",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := updateUserProfiles(prev, &tt.resp, tt.first)
+			if !reflect.DeepEqual(logins(got), tt.want) {
+				t.Errorf("got %v, want %v", logins(got), tt.want)
+			}
+			if prev[2].LoginName != "bob@example.com" || len(prev) != 2 {
+				t.Error("updateUserProfiles modified prev")
+			}
+		})
+	}
+}
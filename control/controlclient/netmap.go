@@ -24,6 +24,7 @@ type NetworkMap struct {
 	// Core networking
 
 	NodeKey       tailcfg.NodeKey
+	Name          string // this node's DNS name
 	PrivateKey    wgcfg.PrivateKey
 	Expiry        time.Time
 	Addresses     []wgcfg.CIDR
@@ -32,8 +33,13 @@ type NetworkMap struct {
 	Peers         []tailcfg.Node
 	DNS           []wgcfg.IP
 	DNSDomains    []string
+	DNSConfig     tailcfg.DNSConfig // zero if the server sent none
 	Hostinfo      tailcfg.Hostinfo
 	PacketFilter  filter.Matches
+	Tags          []string // ACL tags the server applied to this node
+	// DERPMap is the DERP servers to use, or nil if the server
+	// hasn't sent any.
+	DERPMap *tailcfg.DERPMap
 
 	// ACLs
 
@@ -84,7 +90,9 @@ func (nm *NetworkMap) Concise() string {
 			aip[i] = fmt.Sprint(a)
 		}
 		u := fmt.Sprint(p.User)
-		if strings.HasPrefix(u, "userid:") {
+		if up, ok := nm.UserProfiles[p.User]; ok && up.LoginName != "" {
+			u = up.LoginName
+		} else if strings.HasPrefix(u, "userid:") {
 			u = "u:" + u[7:]
 		}
 		f1 := fmt.Sprintf(" %v %-6v %v",
@@ -12,7 +12,7 @@ import (
 )
 
 func TestPersistEqual(t *testing.T) {
-	persistHandles := []string{"PrivateMachineKey", "PrivateNodeKey", "OldPrivateNodeKey", "Provider", "LoginName"}
+	persistHandles := []string{"PrivateMachineKey", "NewPrivateMachineKey", "PrivateNodeKey", "OldPrivateNodeKey", "Provider", "LoginName", "MachineKeyStore", "MachineKeyRef", "LogoutPending"}
 	if have := fieldsOf(reflect.TypeOf(Persist{})); !reflect.DeepEqual(have, persistHandles) {
 		t.Errorf("Persist.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, persistHandles)
@@ -46,6 +46,17 @@ func TestPersistEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Persist{NewPrivateMachineKey: k1},
+			&Persist{NewPrivateMachineKey: newPrivate()},
+			false,
+		},
+		{
+			&Persist{NewPrivateMachineKey: k1},
+			&Persist{NewPrivateMachineKey: k1},
+			true,
+		},
+
 		{
 			&Persist{PrivateNodeKey: k1},
 			&Persist{PrivateNodeKey: newPrivate()},
@@ -84,11 +95,32 @@ func TestPersistEqual(t *testing.T) {
 			&Persist{LoginName: "bar@tailscale.com"},
 			false,
 		},
+
+		{
+			&Persist{MachineKeyStore: "file", MachineKeyRef: "1"},
+			&Persist{MachineKeyStore: "file", MachineKeyRef: "2"},
+			false,
+		},
+		{
+			&Persist{MachineKeyStore: "file", MachineKeyRef: "1"},
+			&Persist{MachineKeyStore: "pkcs11", MachineKeyRef: "1"},
+			false,
+		},
+		{
+			&Persist{MachineKeyStore: "file", MachineKeyRef: "1"},
+			&Persist{MachineKeyStore: "file", MachineKeyRef: "1"},
+			true,
+		},
 		{
 			&Persist{LoginName: "foo@tailscale.com"},
 			&Persist{LoginName: "foo@tailscale.com"},
 			true,
 		},
+		{
+			&Persist{PrivateNodeKey: k1},
+			&Persist{PrivateNodeKey: k1, LogoutPending: true},
+			false,
+		},
 	}
 	for i, test := range tests {
 		if got := test.a.Equals(test.b); got != test.want {
@@ -0,0 +1,138 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"tailscale.com/types/logger"
+)
+
+// A key pin is "sha256/" followed by the base64 SHA-256 hash of a
+// DER-encoded SubjectPublicKeyInfo, as in HTTP Public Key Pinning.
+// It can be computed with:
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der |
+//	    openssl dgst -sha256 -binary | base64
+const pinPrefix = "sha256/"
+
+// ignorePinsEnv is the escape hatch for pins that no longer match
+// after a botched key rotation: if set to true, pins are logged and
+// ignored, and the public CAs alone are trusted again.
+const ignorePinsEnv = "DEBUG_IGNORE_CONTROL_PINS"
+
+// pin is the SHA-256 hash of a public key.
+type pin [sha256.Size]byte
+
+// CheckPin reports whether s is a valid key pin such as
+// "sha256/YLh1dUR9y6Kja30RrAn7JKnbQG/uEtLMkBgFF2Fuihg=".
+func CheckPin(s string) error {
+	_, err := parsePin(s)
+	return err
+}
+
+func parsePin(s string) (pin, error) {
+	var p pin
+	if !strings.HasPrefix(s, pinPrefix) {
+		return p, fmt.Errorf("key pin %q: missing %q prefix", s, pinPrefix)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, pinPrefix))
+	if err != nil || len(b) != len(p) {
+		return p, fmt.Errorf("key pin %q: not a base64 SHA-256 hash", s)
+	}
+	copy(p[:], b)
+	return p, nil
+}
+
+// pinOf returns the pin of cert's public key.
+func pinOf(cert *x509.Certificate) pin {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// pinSet is the set of keys trusted for one host.
+type pinSet struct {
+	host string
+	pins map[pin]bool
+}
+
+// newPinSet parses pins for host. At least two are required, so that
+// one can be a backup key kept offline: every client has the pins
+// in its prefs, and would be locked out if the only pinned key had
+// to be replaced.
+func newPinSet(host string, pins []string) (*pinSet, error) {
+	if len(pins) < 2 {
+		return nil, errors.New("control key pins: need a backup pin as well as the primary one")
+	}
+	ps := &pinSet{host: host, pins: map[pin]bool{}}
+	for _, s := range pins {
+		p, err := parsePin(s)
+		if err != nil {
+			return nil, err
+		}
+		ps.pins[p] = true
+	}
+	return ps, nil
+}
+
+// verify is a tls.Config.VerifyPeerCertificate func. It runs after
+// the usual verification against the system roots, and additionally
+// requires a pinned key somewhere in the verified chain. Pinning a
+// CA's key, rather than the server's, lets the server rotate its
+// certificate freely within that CA.
+//
+// Certificates for other names, such as an HTTPS proxy's, aren't
+// checked.
+func (ps *pinSet) verify(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return errors.New("control key pins: no verified certificate chain")
+	}
+	if chains[0][0].VerifyHostname(ps.host) != nil {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if ps.pins[pinOf(cert)] {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("control key pins: no pinned key in the certificate chain of %q", ps.host)
+}
+
+// pinTransport makes tr, a transport that talks to serverURL,
+// require one of pins. With no pins, or with the escape hatch set,
+// it leaves tr alone.
+func pinTransport(tr *http.Transport, serverURL string, pins []string, logf logger.Logf) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	if ignore, _ := strconv.ParseBool(os.Getenv(ignorePinsEnv)); ignore {
+		logf("WARNING: %s is set, ignoring control key pins %v\n", ignorePinsEnv, pins)
+		return nil
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Scheme != "https" {
+		return fmt.Errorf("control key pins: server URL %q isn't https", serverURL)
+	}
+	ps, err := newPinSet(u.Hostname(), pins)
+	if err != nil {
+		return err
+	}
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	tr.TLSClientConfig.VerifyPeerCertificate = ps.verify
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestCheckPin(t *testing.T) {
+	good := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{good, true},
+		{"sha1/AAAA", false},
+		{"sha256/AAAA", false},
+		{"sha256/not base64!", false},
+	}
+	for _, tt := range tests {
+		if err := CheckPin(tt.in); (err == nil) != tt.ok {
+			t.Errorf("CheckPin(%q) = %v, want ok=%v", tt.in, err, tt.ok)
+		}
+	}
+}
+
+func TestPinTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	pinString := func(cert *x509.Certificate) string {
+		p := pinOf(cert)
+		return pinPrefix + base64.StdEncoding.EncodeToString(p[:])
+	}
+	serverPin := pinString(srv.Certificate())
+	otherPin := pinPrefix + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	get := func(pins []string) error {
+		tr := srv.Client().Transport.(*http.Transport).Clone()
+		if err := pinTransport(tr, srv.URL, pins, t.Logf); err != nil {
+			t.Fatal(err)
+		}
+		httpc := &http.Client{Transport: tr}
+		res, err := httpc.Get(srv.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(nil); err != nil {
+		t.Errorf("no pins: %v", err)
+	}
+	// The server's key as the backup pin must do.
+	if err := get([]string{otherPin, serverPin}); err != nil {
+		t.Errorf("matching pin: %v", err)
+	}
+	if err := get([]string{otherPin, otherPin}); err == nil {
+		t.Error("no matching pin, but the request succeeded")
+	}
+
+	os.Setenv(ignorePinsEnv, "1")
+	defer os.Unsetenv(ignorePinsEnv)
+	if err := get([]string{otherPin, otherPin}); err != nil {
+		t.Errorf("with %s set: %v", ignorePinsEnv, err)
+	}
+	os.Unsetenv(ignorePinsEnv)
+
+	tr := &http.Transport{}
+	if err := pinTransport(tr, srv.URL, []string{serverPin}, t.Logf); err == nil {
+		t.Error("a single pin was accepted")
+	}
+	if err := pinTransport(tr, "http://example.com", []string{serverPin, otherPin}, t.Logf); err == nil {
+		t.Error("pins for an http server URL were accepted")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// newHTTPClient returns an HTTP client for talking to the control
+// server. If proxyURL is non-empty, all connections go through that
+// proxy. Otherwise the proxy, if any, comes from the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables.
+//
+// Long-poll map requests go through the same proxy as everything
+// else, so the proxy must not cut off long-lived responses.
+func newHTTPClient(proxyURL string) (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := parseProxyURL(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// parseProxyURL parses an HTTP(S) proxy URL. As with HTTP_PROXY, a
+// bare "host:port" means an http:// proxy.
+func parseProxyURL(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", s)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("proxy URL %q: unsupported scheme %q", s, u.Scheme)
+	}
+	return u, nil
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseProxyURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // empty means error
+	}{
+		{"http://proxy.example:3128", "http://proxy.example:3128"},
+		{"https://proxy.example", "https://proxy.example"},
+		{"proxy.example:3128", "http://proxy.example:3128"},
+		{"socks5://proxy.example:1080", ""},
+		{"http://", ""},
+	}
+	for _, tt := range tests {
+		u, err := parseProxyURL(tt.in)
+		var got string
+		if err == nil {
+			got = u.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseProxyURL(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewHTTPClientProxy(t *testing.T) {
+	c, err := newHTTPClient("proxy.example:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "https://login.tailscale.com/", nil)
+	u, err := c.Transport.(*http.Transport).Proxy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == nil || u.Host != "proxy.example:3128" {
+		t.Errorf("proxy = %v, want proxy.example:3128", u)
+	}
+
+	if _, err := newHTTPClient("ftp://proxy.example"); err == nil {
+		t.Error("newHTTPClient accepted an ftp proxy")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// Delays between attempts to reach the control server. Network
+// errors back off exponentially from retryMinDelay to retryMaxDelay.
+// Auth errors, and the server deeming the client too old, won't go
+// away by retrying quickly, so they always wait authRetryDelay.
+const (
+	retryMinDelay  = 100 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+	authRetryDelay = 60 * time.Second
+)
+
+// httpError is a non-200 response from the control server.
+type httpError struct {
+	StatusCode int
+	Msg        string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.Msg)
+}
+
+// isAuthError reports whether err is the control server refusing
+// our credentials or our version, rather than a failure to reach it.
+func isAuthError(err error) bool {
+	var tooOld *TooOldError
+	if errors.As(err, &tooOld) {
+		return true
+	}
+	var he *httpError
+	if !errors.As(err, &he) {
+		return false
+	}
+	return he.StatusCode == http.StatusUnauthorized || he.StatusCode == http.StatusForbidden
+}
+
+// retrier is the reconnect policy for requests to the control
+// server: exponential backoff with jitter, reset by a success.
+type retrier struct {
+	name     string
+	logf     logger.Logf
+	newTimer func(d time.Duration) *time.Timer // or nil for time.NewTimer
+
+	n int // consecutive failures
+}
+
+// retryDelay returns the wait before the next attempt, after the n'th
+// consecutive failure, before jitter.
+func retryDelay(n int, authErr bool) time.Duration {
+	if authErr {
+		return authRetryDelay
+	}
+	d := retryMinDelay
+	for i := 1; i < n && d < retryMaxDelay; i++ {
+		d *= 2
+	}
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d
+}
+
+// BackOff waits before retrying an attempt that failed with err, or
+// resets the backoff if err is nil. It returns early if ctx is done.
+func (r *retrier) BackOff(ctx context.Context, err error) {
+	if err == nil || ctx.Err() != nil {
+		r.n = 0
+		return
+	}
+	r.n++
+	d := retryDelay(r.n, isAuthError(err))
+	// Randomize the delay to 0.5-1x, so that many clients don't
+	// come back in lockstep after a control server outage.
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	r.logf("%s: backoff: %v (attempt %d)\n", r.name, d.Round(time.Millisecond), r.n)
+
+	newTimer := r.newTimer
+	if newTimer == nil {
+		newTimer = time.NewTimer
+	}
+	t := newTimer(d)
+	select {
+	case <-ctx.Done():
+		t.Stop()
+	case <-t.C:
+	}
+}
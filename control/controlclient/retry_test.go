@@ -0,0 +1,81 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		n       int
+		authErr bool
+		want    time.Duration
+	}{
+		{1, false, 100 * time.Millisecond},
+		{2, false, 200 * time.Millisecond},
+		{5, false, 1600 * time.Millisecond},
+		{9, false, 25600 * time.Millisecond},
+		{10, false, retryMaxDelay},
+		{1000, false, retryMaxDelay},
+		{1, true, authRetryDelay},
+		{50, true, authRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.n, tt.authErr); got != tt.want {
+			t.Errorf("retryDelay(%d, %v) = %v, want %v", tt.n, tt.authErr, got, tt.want)
+		}
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection refused"), false},
+		{&httpError{StatusCode: 500, Msg: "oops"}, false},
+		{&httpError{StatusCode: 401, Msg: "bad key"}, true},
+		{fmt.Errorf("register request: %w", &httpError{StatusCode: 403}), true},
+		{&TooOldError{Have: 9, Min: 10}, true},
+	}
+	for _, tt := range tests {
+		if got := isAuthError(tt.err); got != tt.want {
+			t.Errorf("isAuthError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetrierBackOff(t *testing.T) {
+	var waits []time.Duration
+	r := &retrier{
+		name: "test",
+		logf: t.Logf,
+		newTimer: func(d time.Duration) *time.Timer {
+			waits = append(waits, d)
+			return time.NewTimer(0)
+		},
+	}
+	ctx := context.Background()
+	netErr := errors.New("no route to host")
+
+	r.BackOff(ctx, netErr)
+	r.BackOff(ctx, netErr)
+	r.BackOff(ctx, nil)
+	r.BackOff(ctx, netErr)
+	if len(waits) != 3 {
+		t.Fatalf("got %d waits, want 3", len(waits))
+	}
+	for i, n := range []int{1, 2, 1} {
+		max := retryDelay(n, false)
+		if waits[i] < max/2 || waits[i] > max {
+			t.Errorf("wait %d = %v, want in [%v, %v]", i, waits[i], max/2, max)
+		}
+	}
+}
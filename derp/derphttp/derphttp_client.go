@@ -23,11 +23,17 @@ import (
 	"net/url"
 	"sync"
 
+	"tailscale.com/clientmetrics"
 	"tailscale.com/derp"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 )
 
+var (
+	metricConnects      = clientmetrics.NewCounter("derp_client_connects", "Connections made to DERP servers.")
+	metricConnectErrors = clientmetrics.NewCounter("derp_client_connect_errors", "Failed attempts to connect to DERP servers.")
+)
+
 // Client is a DERP-over-HTTP client.
 //
 // It automatically reconnects on error retry. That is, a failed Send or
@@ -92,6 +98,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	var netConn net.Conn
 	defer func() {
 		if err != nil {
+			metricConnectErrors.Add(1)
 			err = fmt.Errorf("%s connect: %v", caller, err)
 			if netConn != nil {
 				netConn.Close()
@@ -153,6 +160,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	}
 	c.resp = resp
 	c.client = derpClient
+	metricConnects.Add(1)
 	return c.client, nil
 }
 
@@ -179,6 +187,14 @@ func (c *Client) Recv(b []byte) (derp.ReceivedMessage, error) {
 	return m, err
 }
 
+// Reconnect drops the current connection to the server, if any.
+// The next Send or Recv dials a new one. It's useful after the
+// local network changed, when the old TCP connection is likely
+// dead but would take a long time to time out.
+func (c *Client) Reconnect() {
+	c.close()
+}
+
 // Close closes the client. It will not automatically reconnect after
 // being closed.
 func (c *Client) Close() error {
@@ -0,0 +1,122 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package health is a registry for other packages to report and
+// check the health of the subsystems that make up the node agent.
+//
+// Problems reported here are not fatal; they are conditions that
+// the user should know about (e.g. "subnet routes are advertised but
+// this machine doesn't forward packets") and that frontends can
+// display.
+package health
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Subsystem is the name of a component whose health is tracked.
+type Subsystem string
+
+const (
+	// SysIPForwarding is the state of the kernel's IP forwarding
+	// setting, which subnet routers need in order to work.
+	SysIPForwarding = Subsystem("ip-forwarding")
+	// SysControl is the node's connection to the control server.
+	SysControl = Subsystem("control")
+	// SysExitNode is the peer selected to route Internet traffic
+	// through, see ipn.Prefs.ExitNodeID.
+	SysExitNode = Subsystem("exit-node")
+)
+
+var (
+	mu       sync.Mutex
+	sysErr   = map[Subsystem]error{}
+	watchers = map[*watchHandle]func(Subsystem, error){}
+)
+
+type watchHandle byte
+
+// RegisterWatcher adds a function that will be called whenever the
+// health of a subsystem changes. The returned func unregisters it.
+//
+// cb is called without any locks held, but may be called
+// concurrently from multiple goroutines.
+func RegisterWatcher(cb func(sys Subsystem, err error)) (unregister func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	h := new(watchHandle)
+	watchers[h] = cb
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(watchers, h)
+	}
+}
+
+// Set records the health of sys. A nil err means sys is healthy.
+func Set(sys Subsystem, err error) {
+	mu.Lock()
+	old, had := sysErr[sys]
+	if had && errString(old) == errString(err) {
+		mu.Unlock()
+		return
+	}
+	if err == nil {
+		delete(sysErr, sys)
+	} else {
+		sysErr[sys] = err
+	}
+	var cbs []func(Subsystem, error)
+	if had || err != nil {
+		for _, cb := range watchers {
+			cbs = append(cbs, cb)
+		}
+	}
+	mu.Unlock()
+
+	for _, cb := range cbs {
+		cb(sys, err)
+	}
+}
+
+// Get returns the last error reported for sys, or nil if sys is
+// healthy.
+func Get(sys Subsystem) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return sysErr[sys]
+}
+
+// OverallError returns a summary of all unhealthy subsystems, or
+// nil if everything is healthy.
+func OverallError() error {
+	errs := Problems()
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// Problems returns a sorted description of each unhealthy subsystem,
+// in the form "subsystem: error".
+func Problems() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var errs []string
+	for sys, err := range sysErr {
+		errs = append(errs, fmt.Sprintf("%s: %v", sys, err))
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
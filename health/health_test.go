@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSetAndWatch(t *testing.T) {
+	const sys = Subsystem("test")
+	var calls int
+	unregister := RegisterWatcher(func(s Subsystem, err error) {
+		if s == sys {
+			calls++
+		}
+	})
+	defer unregister()
+
+	Set(sys, nil)
+	if calls != 0 {
+		t.Errorf("healthy->healthy: got %d watcher calls, want 0", calls)
+	}
+	Set(sys, errors.New("broken"))
+	Set(sys, errors.New("broken"))
+	if calls != 1 {
+		t.Errorf("after repeated error: got %d watcher calls, want 1", calls)
+	}
+	if err := Get(sys); err == nil || err.Error() != "broken" {
+		t.Errorf("Get = %v; want broken", err)
+	}
+	if err := OverallError(); err == nil {
+		t.Errorf("OverallError = nil; want error")
+	}
+	if got, want := Problems(), []string{"test: broken"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Problems = %q; want %q", got, want)
+	}
+	Set(sys, nil)
+	if calls != 2 {
+		t.Errorf("after recovery: got %d watcher calls, want 2", calls)
+	}
+	if err := Get(sys); err != nil {
+		t.Errorf("Get after recovery = %v; want nil", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/empty"
 	"tailscale.com/wgengine"
@@ -33,6 +34,10 @@ type EngineStatus struct {
 	RBytes, WBytes wgengine.ByteCount
 	NumLive        int
 	LivePeers      map[tailcfg.NodeKey]wgengine.PeerStatus
+	NATType        string // see wgengine.Status.NATType
+	DERPHome       string // see wgengine.Status.DERPHome
+	NetInfo        *tailcfg.NetInfo
+	LocalAddrs     []string // this node's endpoints, see wgengine.Status.LocalAddrs
 }
 
 type NetworkMap = controlclient.NetworkMap
@@ -40,15 +45,69 @@ type NetworkMap = controlclient.NetworkMap
 // In any given notification, any or all of these may be nil, meaning
 // that they have not changed.
 type Notify struct {
-	Version       string         // version number of IPN backend
-	ErrMessage    *string        // critical error message, if any
-	LoginFinished *empty.Message // event: non-nil when login process succeeded
-	State         *State         // current IPN state has changed
-	Prefs         *Prefs         // preferences were changed
-	NetMap        *NetworkMap    // new netmap received
-	Engine        *EngineStatus  // wireguard engine stats
-	BrowseToURL   *string        // UI should open a browser right now
-	BackendLogID  *string        // public logtail id used by backend
+	Version       string           // version number of IPN backend
+	ErrMessage    *string          // critical error message, if any; see Error
+	Error         *NotifyError     // error or warning, with a code
+	LoginFinished *empty.Message   // event: non-nil when login process succeeded
+	State         *State           // current IPN state has changed
+	Prefs         *Prefs           // preferences were changed
+	NetMap        *NetworkMap      // new netmap received
+	Engine        *EngineStatus    // wireguard engine stats
+	BrowseToURL   *string          // UI should open a browser right now
+	BackendLogID  *string          // public logtail id used by backend
+	Profiles      *Profiles        // saved login profiles
+	Status        *ipnstate.Status // full status, see Backend.RequestStatus
+	KeyExpiry     *time.Time       // warning: node key expires (or expired) at this time
+	PeerChanges   []PeerChange     // event: peers went online or offline
+
+	// ProtocolVersion is the backend's ipn.ProtocolVersion.
+	ProtocolVersion int        `json:",omitempty"`
+	Hello           *HelloArgs // answer to Command.Hello
+
+	// UpdateAvailable is an event: a newer release is out, as found
+	// by the update checks that Prefs.CheckUpdates turns on.
+	UpdateAvailable *ipnstate.UpdateInfo `json:",omitempty"`
+}
+
+// ErrCode identifies the kind of problem in a NotifyError, so that
+// frontends can show their own message for it, localized and saying
+// what to do, rather than the backend's English text. More codes may
+// be added later; frontends should treat unknown ones as ErrUnknown.
+type ErrCode string
+
+const (
+	ErrUnknown            = ErrCode("unknown")             // none of the below
+	ErrVersionMismatch    = ErrCode("version-mismatch")    // frontend and backend versions differ; upgrade one
+	ErrUnsupportedCommand = ErrCode("unsupported-command") // the backend is older than the frontend
+	ErrPermissionDenied   = ErrCode("permission-denied")   // the local user isn't allowed to do that
+	ErrOperationFailed    = ErrCode("operation-failed")    // a requested operation, such as a profile switch, failed
+	ErrAuthExpired        = ErrCode("auth-expired")        // the node key expires soon, or has expired; log in again
+	ErrControlUnreachable = ErrCode("control-unreachable") // requests to the control server are failing
+	ErrRouteConflict      = ErrCode("route-conflict")      // an accepted subnet route overlaps a local network
+	ErrTUNFailed          = ErrCode("tun-failed")          // configuring the tunnel device or its routes failed
+	ErrDNSProxyFailed     = ErrCode("dns-proxy-failed")    // as an exit node, answering other nodes' DNS queries failed
+)
+
+// NotifyError is a problem reported in Notify.Error.
+type NotifyError struct {
+	Code    ErrCode
+	Message string // English description, for logs and unknown codes
+	// Critical is set if an operation failed outright. Otherwise the
+	// error is a warning about a condition the user may want to fix,
+	// and the backend carries on.
+	Critical bool `json:",omitempty"`
+}
+
+func (e *NotifyError) Error() string { return e.Message }
+
+// errNotify returns a notification of a problem. Critical ones also
+// set ErrMessage, for frontends that predate Notify.Error.
+func errNotify(code ErrCode, critical bool, msg string) Notify {
+	n := Notify{Error: &NotifyError{Code: code, Message: msg, Critical: critical}}
+	if critical {
+		n.ErrMessage = &msg
+	}
+	return n
 }
 
 // StateKey is an opaque identifier for a set of LocalBackend state
@@ -69,6 +128,27 @@ type Notify struct {
 // different opaque state keys (and no access to each others's keys).
 type StateKey string
 
+// DebugAction is a runtime debugging operation that a frontend can
+// ask the backend to perform. See Backend.Debug.
+type DebugAction string
+
+const (
+	// DebugRebind forces the engine to rebind its UDP socket and
+	// rediscover its endpoints, as if the network link changed.
+	DebugRebind = DebugAction("rebind")
+	// DebugReSTUN forces the engine to rediscover its public
+	// endpoints via STUN, without rebinding.
+	DebugReSTUN = DebugAction("restun")
+	// DebugDump writes the engine state, the recent state changes
+	// and the current network map to the backend's log.
+	DebugDump = DebugAction("dump")
+	// DebugVerboseOn and DebugVerboseOff turn on and off the
+	// logging of every packet received through DERP. For the
+	// other verbose logs, set the log levels instead.
+	DebugVerboseOn  = DebugAction("verbose-on")
+	DebugVerboseOff = DebugAction("verbose-off")
+)
+
 type Options struct {
 	// FrontendLogID is the public logtail id used by the frontend.
 	FrontendLogID string
@@ -90,6 +170,16 @@ type Options struct {
 	// TODO(danderson): remove some time after the transition to
 	// tailscaled is done.
 	LegacyConfigPath string
+	// DefaultPrefs optionally specifies the prefs to start with if
+	// there is no state yet for StateKey, instead of NewPrefs.
+	DefaultPrefs *Prefs `json:",omitempty"`
+	// AuthKey optionally specifies a pre-authorized key, which lets
+	// the backend register the node without an interactive login.
+	AuthKey string `json:",omitempty"`
+	// Ephemeral registers the node as ephemeral: the server removes
+	// it once it goes offline, and the backend never saves its keys,
+	// so a restarted node registers as a new one.
+	Ephemeral bool `json:",omitempty"`
 	// Notify is called when backend events happen.
 	Notify func(Notify) `json:"-"`
 }
@@ -113,9 +203,36 @@ type Backend interface {
 	// counts. Connection events are emitted automatically without
 	// polling.
 	RequestEngineStatus()
+	// RequestStatus requests a full status report of this node and
+	// its peers, which is delivered in a Status notification.
+	RequestStatus()
 	// FakeExpireAfter pretends that the current key is going to
 	// expire after duration x. This is useful for testing GUIs to
 	// make sure they react properly with keys that are going to
 	// expire.
 	FakeExpireAfter(x time.Duration)
+	// Debug performs the given runtime debugging action, such as
+	// forcing a socket rebind. Unknown actions are logged and
+	// otherwise ignored.
+	Debug(action DebugAction)
+	// ListProfiles requests the saved login profiles, which are
+	// delivered in a Profiles notification.
+	ListProfiles()
+	// SwitchProfile saves the current login profile and switches to
+	// the named one, creating it if needed. The backend restarts
+	// with the profile's prefs and keys; a new profile needs to log
+	// in.
+	SwitchProfile(name string)
+	// DeleteProfile removes a saved login profile, other than the
+	// current one, along with its keys.
+	DeleteProfile(name string)
+	// RotateMachineKey replaces the machine key with a fresh one and
+	// re-registers the node under it, keeping the node and its
+	// login.
+	RotateMachineKey()
+	// SetPaused pauses or resumes all of the backend's network
+	// activity: control polling, DERP, STUN and WireGuard. Unlike
+	// Logout or WantRunning=false, it keeps the keys, network map
+	// and configuration, so that resuming is immediate.
+	SetPaused(paused bool)
 }
@@ -0,0 +1,42 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"net"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/wgengine/tsdns"
+)
+
+// resolverConfig returns the configuration of the engine's DNS
+// resolver for nm: the names of this node and its peers, answered
+// locally, and the routes, nameservers, search domains and restricted
+// domains from nm's DNSConfig.
+func resolverConfig(nm *NetworkMap) *tsdns.Config {
+	hosts := make(map[string][]net.IP)
+	add := func(name string, addrs []wgcfg.CIDR) {
+		if name == "" {
+			return
+		}
+		for _, a := range addrs {
+			ip := a.IP // IP returns a slice of its receiver
+			hosts[name] = append(hosts[name], ip.IP())
+		}
+	}
+	add(nm.Name, nm.Addresses)
+	for _, p := range nm.Peers {
+		add(p.Name, p.Addresses)
+	}
+	return &tsdns.Config{
+		Hosts:         hosts,
+		LocalDomains:  nm.DNSConfig.Domains,
+		Routes:        nm.DNSConfig.Routes,
+		Nameservers:   nm.DNSConfig.Nameservers,
+		SearchDomains: nm.DNSConfig.SearchDomains,
+
+		RestrictedDomains: nm.DNSConfig.RestrictedDomains,
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+)
+
+func TestResolverConfig(t *testing.T) {
+	cidr := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *c
+	}
+	nm := &NetworkMap{
+		Name:      "self.example.com.beta.tailscale.net",
+		Addresses: []wgcfg.CIDR{cidr("100.64.0.1/32")},
+		Peers: []tailcfg.Node{
+			{Name: "peer.example.com.beta.tailscale.net", Addresses: []wgcfg.CIDR{cidr("100.64.0.2/32"), cidr("fd7a:115c:a1e0::2/128")}},
+			{Addresses: []wgcfg.CIDR{cidr("100.64.0.3/32")}}, // no name
+		},
+		DNSConfig: tailcfg.DNSConfig{
+			Proxied: true,
+			Domains: []string{"example.com.beta.tailscale.net"},
+			Routes:  map[string][]string{"corp.example.com": {"100.64.0.10"}},
+
+			SearchDomains:     []string{"example.com.beta.tailscale.net", "corp.example.com"},
+			RestrictedDomains: []string{"corp.example.com"},
+		},
+	}
+	cfg := resolverConfig(nm)
+	wantHosts := map[string][]net.IP{
+		"self.example.com.beta.tailscale.net": {net.ParseIP("100.64.0.1")},
+		"peer.example.com.beta.tailscale.net": {net.ParseIP("100.64.0.2"), net.ParseIP("fd7a:115c:a1e0::2")},
+	}
+	if len(cfg.Hosts) != len(wantHosts) {
+		t.Fatalf("hosts = %v, want %v", cfg.Hosts, wantHosts)
+	}
+	for name, want := range wantHosts {
+		got := cfg.Hosts[name]
+		if len(got) != len(want) {
+			t.Errorf("hosts[%q] = %v, want %v", name, got, want)
+			continue
+		}
+		for i := range want {
+			if !got[i].Equal(want[i]) {
+				t.Errorf("hosts[%q] = %v, want %v", name, got, want)
+			}
+		}
+	}
+	if !reflect.DeepEqual(cfg.LocalDomains, nm.DNSConfig.Domains) || !reflect.DeepEqual(cfg.Routes, nm.DNSConfig.Routes) ||
+		!reflect.DeepEqual(cfg.SearchDomains, nm.DNSConfig.SearchDomains) ||
+		!reflect.DeepEqual(cfg.RestrictedDomains, nm.DNSConfig.RestrictedDomains) {
+		t.Errorf("config = %+v, want nm's domains, routes, search domains and restricted domains", cfg)
+	}
+}
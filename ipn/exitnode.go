@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+)
+
+// findExitNode returns the peer in nm that prefs selects as the exit
+// node, or nil if prefs doesn't select one. It's an error for the
+// selected node to be missing from nm or not to offer a default
+// route.
+func findExitNode(nm *NetworkMap, prefs *Prefs) (*tailcfg.Node, error) {
+	if prefs == nil || !prefs.HasExitNode() {
+		return nil, nil
+	}
+	var want string // canonical form of prefs.ExitNodeIP
+	if prefs.ExitNodeID == 0 {
+		ip := net.ParseIP(prefs.ExitNodeIP)
+		if ip == nil {
+			return nil, fmt.Errorf("exit node IP %q is invalid", prefs.ExitNodeIP)
+		}
+		want = ip.String()
+	}
+	if nm != nil {
+		for i := range nm.Peers {
+			p := &nm.Peers[i]
+			if want == "" && p.ID != prefs.ExitNodeID {
+				continue
+			}
+			if want != "" && !hasAddr(p, want) {
+				continue
+			}
+			if !hasDefaultRoute(p) {
+				return nil, fmt.Errorf("exit node %s doesn't offer a default route", p.Hostinfo.Hostname)
+			}
+			return p, nil
+		}
+	}
+	if want != "" {
+		return nil, fmt.Errorf("exit node %s is not in the network map", want)
+	}
+	return nil, fmt.Errorf("exit node %d is not in the network map", prefs.ExitNodeID)
+}
+
+func hasAddr(p *tailcfg.Node, ip string) bool {
+	for _, a := range p.Addresses {
+		if a.IP.String() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDefaultRoute(p *tailcfg.Node) bool {
+	for _, aip := range p.AllowedIPs {
+		if aip.Mask == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// routeViaExitNode returns nm with default routes removed from all
+// peers except exit, so that the engine sends Internet traffic only
+// to exit. The result is a shallow copy of nm; nm is not modified.
+func routeViaExitNode(nm *NetworkMap, exit *tailcfg.Node) *NetworkMap {
+	ret := *nm
+	ret.Peers = make([]tailcfg.Node, 0, len(nm.Peers))
+	for _, p := range nm.Peers {
+		if p.ID != exit.ID && hasDefaultRoute(&p) {
+			var aips []wgcfg.CIDR
+			for _, aip := range p.AllowedIPs {
+				if aip.Mask != 0 {
+					aips = append(aips, aip)
+				}
+			}
+			p.AllowedIPs = aips
+		}
+		ret.Peers = append(ret.Peers, p)
+	}
+	return &ret
+}
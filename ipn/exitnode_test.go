@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+)
+
+func TestExitNode(t *testing.T) {
+	cidr := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *c
+	}
+	nm := &NetworkMap{
+		Peers: []tailcfg.Node{
+			{ID: 1, Addresses: []wgcfg.CIDR{cidr("100.64.0.1/32")},
+				AllowedIPs: []wgcfg.CIDR{cidr("100.64.0.1/32"), cidr("0.0.0.0/0")}},
+			{ID: 2, Addresses: []wgcfg.CIDR{cidr("100.64.0.2/32")},
+				AllowedIPs: []wgcfg.CIDR{cidr("100.64.0.2/32"), cidr("0.0.0.0/0"), cidr("10.0.0.0/8")}},
+			{ID: 3, Addresses: []wgcfg.CIDR{cidr("100.64.0.3/32")},
+				AllowedIPs: []wgcfg.CIDR{cidr("100.64.0.3/32")}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		prefs   *Prefs
+		want    tailcfg.NodeID // 0 for none
+		wantErr bool
+	}{
+		{"none", &Prefs{}, 0, false},
+		{"by_id", &Prefs{ExitNodeID: 2}, 2, false},
+		{"by_ip", &Prefs{ExitNodeIP: "100.64.0.1"}, 1, false},
+		{"id_wins", &Prefs{ExitNodeID: 2, ExitNodeIP: "100.64.0.1"}, 2, false},
+		{"no_default_route", &Prefs{ExitNodeID: 3}, 0, true},
+		{"missing", &Prefs{ExitNodeIP: "100.64.0.9"}, 0, true},
+		{"bad_ip", &Prefs{ExitNodeIP: "bogus"}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exit, err := findExitNode(nm, tt.prefs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got tailcfg.NodeID
+			if exit != nil {
+				got = exit.ID
+			}
+			if got != tt.want {
+				t.Errorf("exit node = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	exit := &nm.Peers[1]
+	routed := routeViaExitNode(nm, exit)
+	for _, p := range routed.Peers {
+		if got, want := hasDefaultRoute(&p), p.ID == exit.ID; got != want {
+			t.Errorf("peer %d has default route = %v, want %v", p.ID, got, want)
+		}
+	}
+	if n := len(routed.Peers[0].AllowedIPs); n != 1 {
+		t.Errorf("peer 1 kept %d routes, want 1", n)
+	}
+	if len(routed.Peers[1].AllowedIPs) != 3 {
+		t.Errorf("exit node lost routes: %v", routed.Peers[1].AllowedIPs)
+	}
+	if !hasDefaultRoute(&nm.Peers[0]) {
+		t.Error("routeViaExitNode modified its input")
+	}
+}
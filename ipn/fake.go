@@ -7,6 +7,8 @@ package ipn
 import (
 	"log"
 	"time"
+
+	"tailscale.com/ipn/ipnstate"
 )
 
 type FakeBackend struct {
@@ -71,6 +73,27 @@ func (b *FakeBackend) RequestEngineStatus() {
 	b.notify(Notify{Engine: &EngineStatus{}})
 }
 
+func (b *FakeBackend) RequestStatus() {
+	b.notify(Notify{Status: &ipnstate.Status{BackendState: NeedsLogin.String()}})
+}
+
 func (b *FakeBackend) FakeExpireAfter(x time.Duration) {
 	b.notify(Notify{NetMap: &NetworkMap{}})
 }
+
+func (b *FakeBackend) Debug(action DebugAction) {}
+
+func (b *FakeBackend) ListProfiles() {
+	b.notify(Notify{Profiles: &Profiles{Current: DefaultProfile, Names: []string{DefaultProfile}}})
+}
+
+func (b *FakeBackend) SwitchProfile(name string) {
+	b.notify(Notify{Profiles: &Profiles{Current: name, Names: []string{DefaultProfile, name}}})
+	b.newState(NeedsLogin)
+}
+
+func (b *FakeBackend) DeleteProfile(name string) {}
+
+func (b *FakeBackend) RotateMachineKey() {}
+
+func (b *FakeBackend) SetPaused(paused bool) {}
@@ -161,6 +161,34 @@ func (h *Handle) RequestEngineStatus() {
 	h.b.RequestEngineStatus()
 }
 
+func (h *Handle) RequestStatus() {
+	h.b.RequestStatus()
+}
+
 func (h *Handle) FakeExpireAfter(x time.Duration) {
 	h.b.FakeExpireAfter(x)
 }
+
+func (h *Handle) Debug(action DebugAction) {
+	h.b.Debug(action)
+}
+
+func (h *Handle) ListProfiles() {
+	h.b.ListProfiles()
+}
+
+func (h *Handle) SwitchProfile(name string) {
+	h.b.SwitchProfile(name)
+}
+
+func (h *Handle) DeleteProfile(name string) {
+	h.b.DeleteProfile(name)
+}
+
+func (h *Handle) RotateMachineKey() {
+	h.b.RotateMachineKey()
+}
+
+func (h *Handle) SetPaused(paused bool) {
+	h.b.SetPaused(paused)
+}
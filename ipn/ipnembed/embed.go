@@ -0,0 +1,252 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ipnembed runs a Tailscale node inside the current process.
+//
+// It wires up a wireguard engine and an ipn.LocalBackend, the same
+// way tailscaled does, but hands the backend to Go code directly
+// rather than serving it on a local socket, so that programs can
+// embed Tailscale connectivity and drive it with plain method calls.
+package ipnembed
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine"
+)
+
+// DefaultStateKey is the StateKey used when Config.StateKey is empty.
+const DefaultStateKey = ipn.StateKey("_embedded")
+
+// Config configures an embedded node.
+type Config struct {
+	// Logf is where the node logs. If nil, logs are discarded.
+	Logf logger.Logf
+	// LogID is the public logtail ID reported to the control
+	// server. It may be empty.
+	LogID string
+	// Store persists the node's prefs and keys. If nil, they're
+	// kept in memory and the node is a new one each run.
+	Store ipn.StateStore
+	// StateKey names the node's state in Store. If empty,
+	// DefaultStateKey is used.
+	StateKey ipn.StateKey
+	// Prefs, if non-nil, replaces the stored prefs on start.
+	// Otherwise the stored ones are used, or ipn.NewPrefs for a new
+	// node.
+	Prefs *ipn.Prefs
+	// AuthKey optionally registers a new node without interactive
+	// login.
+	AuthKey string
+
+	// Engine is the wireguard engine to use. If nil, Start creates
+	// a userspace engine on TUNName and ListenPort, wrapped in a
+	// watchdog. Either way the node takes ownership of the engine:
+	// Node.Close closes it, as does Start if it fails.
+	Engine wgengine.Engine
+	// TUNName is the tunnel interface to create. If empty, the
+	// engine uses a fake tunnel and doesn't touch the OS network
+	// config, which needs no privileges.
+	TUNName string
+	// ListenPort is the UDP port for wireguard, or 0 to pick one.
+	ListenPort uint16
+}
+
+// Node is a Tailscale node running in the current process.
+type Node struct {
+	b *ipn.LocalBackend
+	n notifier
+
+	closeOnce sync.Once
+}
+
+// Start starts a node configured by cfg. It returns once the
+// backend is running; use Node.WaitState to wait for it to connect.
+func Start(cfg Config) (*Node, error) {
+	logf := cfg.Logf
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	store := cfg.Store
+	if store == nil {
+		store = &ipn.MemoryStore{}
+	}
+	key := cfg.StateKey
+	if key == "" {
+		key = DefaultStateKey
+	}
+
+	e := cfg.Engine
+	if e == nil {
+		var err error
+		if cfg.TUNName == "" {
+			e, err = wgengine.NewFakeUserspaceEngine(logf, cfg.ListenPort)
+		} else {
+			e, err = wgengine.NewUserspaceEngine(logf, cfg.TUNName, cfg.ListenPort)
+		}
+		if err != nil {
+			return nil, err
+		}
+		e = wgengine.NewWatchdog(e)
+	}
+
+	b, err := ipn.NewLocalBackend(logf, cfg.LogID, store, e)
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+	b.SetDecompressor(func() (controlclient.Decompressor, error) {
+		return zstd.NewReader(nil)
+	})
+	b.SetCmpDiff(func(x, y interface{}) string { return cmp.Diff(x, y) })
+
+	n := &Node{b: b}
+	n.n.init()
+	err = b.Start(ipn.Options{
+		FrontendLogID: cfg.LogID,
+		StateKey:      key,
+		Prefs:         cfg.Prefs,
+		AuthKey:       cfg.AuthKey,
+		Notify:        n.n.notify,
+	})
+	if err != nil {
+		b.Shutdown()
+		return nil, err
+	}
+	return n, nil
+}
+
+// Backend returns the node's backend, for anything not covered by
+// Node's own methods.
+func (n *Node) Backend() *ipn.LocalBackend { return n.b }
+
+// Subscribe calls fn with every notification from the backend, until
+// the returned function is called. fn runs on the backend's
+// goroutines, so it must not block, and must not call back into the
+// Node synchronously.
+func (n *Node) Subscribe(fn func(ipn.Notify)) (unsubscribe func()) {
+	return n.n.subscribe(fn)
+}
+
+// State returns the backend's current state.
+func (n *Node) State() ipn.State { return n.b.State() }
+
+// WaitState blocks until the backend is in state want, or ctx is
+// done.
+func (n *Node) WaitState(ctx context.Context, want ipn.State) error {
+	return n.n.waitState(ctx, n.b.State, want)
+}
+
+// Status returns the node's current status and peers.
+func (n *Node) Status() *ipnstate.Status { return n.b.Status() }
+
+// Login starts an interactive login. The URL to visit arrives as a
+// BrowseToURL notification.
+func (n *Node) Login() { n.b.StartLoginInteractive() }
+
+// Logout logs the node out, forgetting its keys.
+func (n *Node) Logout() { n.b.Logout() }
+
+// Up connects the node to the network.
+func (n *Node) Up() error {
+	return n.EditPrefs(func(p *ipn.Prefs) { p.WantRunning = true })
+}
+
+// Down disconnects the node from the network, keeping it logged in.
+func (n *Node) Down() error {
+	return n.EditPrefs(func(p *ipn.Prefs) { p.WantRunning = false })
+}
+
+// errNoPrefs is returned by EditPrefs if the backend has no prefs,
+// which only happens before Start.
+var errNoPrefs = errors.New("ipnembed: backend has no prefs")
+
+// EditPrefs applies edit to a copy of the current prefs, and
+// installs the result.
+func (n *Node) EditPrefs(edit func(*ipn.Prefs)) error {
+	p := n.b.Prefs()
+	if p == nil {
+		return errNoPrefs
+	}
+	p = p.Copy()
+	edit(p)
+	n.b.SetPrefs(p)
+	return nil
+}
+
+// Close stops the node and its engine.
+func (n *Node) Close() error {
+	n.closeOnce.Do(n.b.Shutdown)
+	return nil
+}
+
+// notifier fans backend notifications out to subscribers, and wakes
+// up waitState calls on state changes.
+type notifier struct {
+	mu      sync.Mutex
+	subs    map[int]func(ipn.Notify)
+	nextSub int
+	changed chan struct{} // closed and replaced on each state change
+}
+
+func (nf *notifier) init() {
+	nf.subs = map[int]func(ipn.Notify){}
+	nf.changed = make(chan struct{})
+}
+
+func (nf *notifier) subscribe(fn func(ipn.Notify)) func() {
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+	id := nf.nextSub
+	nf.nextSub++
+	nf.subs[id] = fn
+	return func() {
+		nf.mu.Lock()
+		defer nf.mu.Unlock()
+		delete(nf.subs, id)
+	}
+}
+
+func (nf *notifier) notify(n ipn.Notify) {
+	nf.mu.Lock()
+	subs := make([]func(ipn.Notify), 0, len(nf.subs))
+	for _, fn := range nf.subs {
+		subs = append(subs, fn)
+	}
+	if n.State != nil {
+		close(nf.changed)
+		nf.changed = make(chan struct{})
+	}
+	nf.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(n)
+	}
+}
+
+// waitState waits until state returns want, checking after each
+// state change notification.
+func (nf *notifier) waitState(ctx context.Context, state func() ipn.State, want ipn.State) error {
+	for {
+		nf.mu.Lock()
+		changed := nf.changed
+		nf.mu.Unlock()
+		if state() == want {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnembed
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+func TestNotifier(t *testing.T) {
+	var nf notifier
+	nf.init()
+
+	var mu sync.Mutex
+	var got []ipn.State
+	unsub := nf.subscribe(func(n ipn.Notify) {
+		mu.Lock()
+		defer mu.Unlock()
+		if n.State != nil {
+			got = append(got, *n.State)
+		}
+	})
+
+	var stateMu sync.Mutex
+	cur := ipn.NoState
+	state := func() ipn.State {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		return cur
+	}
+	setState := func(s ipn.State) {
+		stateMu.Lock()
+		cur = s
+		stateMu.Unlock()
+		nf.notify(ipn.Notify{State: &s})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- nf.waitState(ctx, state, ipn.Running)
+	}()
+	setState(ipn.Starting)
+	setState(ipn.Running)
+	if err := <-done; err != nil {
+		t.Fatalf("waitState: %v", err)
+	}
+
+	unsub()
+	setState(ipn.Stopped)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 || got[0] != ipn.Starting || got[1] != ipn.Running {
+		t.Errorf("subscriber got %v, want [Starting Running]", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := nf.waitState(ctx, state, ipn.Running); err != context.DeadlineExceeded {
+		t.Errorf("waitState for a state never reached = %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/user"
+	"runtime"
+	"strings"
+
+	"tailscale.com/ipn"
+	"tailscale.com/safesocket"
+)
+
+// access is how far the backend trusts a local socket client.
+type access int
+
+const (
+	accessReadOnly access = iota // may only read status and prefs
+	accessOperator               // may also change prefs and log in or out
+	accessOwner                  // may do anything
+)
+
+func (a access) String() string {
+	switch a {
+	case accessReadOnly:
+		return "read-only"
+	case accessOperator:
+		return "operator"
+	case accessOwner:
+		return "owner"
+	}
+	return "unknown"
+}
+
+var (
+	errReadOnly  = errors.New("permission denied: only root or the operator user may change the backend")
+	errOwnerOnly = errors.New("permission denied: only root may do that")
+)
+
+// deniedError returns the error for client p, which lacked access
+// min: errReadOnly or errOwnerOnly, wrapped with who p is and how it
+// could get that access. operator is the current operator user.
+func deniedError(operator string, p peer, min access) error {
+	if p.err != nil || p.creds == nil {
+		base := errReadOnly
+		if min == accessOwner {
+			base = errOwnerOnly
+		}
+		return fmt.Errorf("%w, and tailscaled couldn't tell which user this is", base)
+	}
+	who := userName(p.creds.UID)
+	if min == accessOwner {
+		return fmt.Errorf("%w, and this is %s; try again with sudo", errOwnerOnly, who)
+	}
+	if operator == "" {
+		return fmt.Errorf("%w, and none is set; try again with sudo, or have root run \"tailscale set --operator=%s\" to let %s make changes", errReadOnly, who, who)
+	}
+	return fmt.Errorf("%w (%s), and this is %s; try again with sudo", errReadOnly, operator, who)
+}
+
+// userName returns the name of the user with uid, or uid itself if
+// it has none.
+func userName(uid string) string {
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
+
+// peer is the identity of a local socket client, from
+// safesocket.PeerCreds.
+type peer struct {
+	creds *safesocket.Creds
+	err   error
+}
+
+// connPeer identifies the client on the other end of c.
+func connPeer(c net.Conn) peer {
+	if bc, ok := c.(*bufConn); ok {
+		c = bc.Conn
+	}
+	creds, err := safesocket.PeerCreds(c)
+	return peer{creds: creds, err: err}
+}
+
+// accessOf returns what p may do, given the backend's current prefs.
+//
+// Root, and the user running the backend, own it. The operator user
+// from the prefs may change prefs. Anyone else only gets read-only
+// status, as do peers that can't be identified, such as those on the
+// TCP port on Windows or from another host to the web UI.
+func accessOf(b *ipn.LocalBackend, self *safesocket.Creds, p peer) access {
+	if p.err != nil || p.creds == nil {
+		return accessReadOnly
+	}
+	if p.creds.Admin || (self != nil && p.creds.UID == self.UID) {
+		return accessOwner
+	}
+	if prefs := b.Prefs(); prefs != nil && isUser(p.creds.UID, prefs.OperatorUser) {
+		return accessOperator
+	}
+	return accessReadOnly
+}
+
+// isUser reports whether uid is the user named name, a username or
+// uid.
+func isUser(uid, name string) bool {
+	if name == "" {
+		return false
+	}
+	if name == uid {
+		return true
+	}
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// Windows usernames are case-insensitive, and may or
+		// may not be given with their domain.
+		if strings.EqualFold(u.Username, name) {
+			return true
+		}
+		if i := strings.LastIndexByte(u.Username, '\\'); i >= 0 {
+			return strings.EqualFold(u.Username[i+1:], name)
+		}
+		return false
+	}
+	return u.Username == name
+}
+
+// checkCommand returns an error if p, the client of the backend b
+// whose process has credentials self, may not run cmd. Operators may
+// change every pref but OperatorUser, which checkCommand resets in
+// cmd to its current value.
+func checkCommand(b *ipn.LocalBackend, self *safesocket.Creds, p peer, cmd *ipn.Command) error {
+	a := accessOf(b, self, p)
+	if a == accessOwner {
+		return nil
+	}
+	if a < accessOperator {
+		// Read-only clients use the LocalAPI, see Run.
+		return deniedError(operatorOf(b), p, accessOperator)
+	}
+	if cmd.Debug != nil || cmd.FakeExpireAfter != nil || cmd.RotateMachineKey != nil {
+		return deniedError(operatorOf(b), p, accessOwner)
+	}
+	if c := cmd.Start; c != nil && c.Opts.Prefs != nil {
+		c.Opts.Prefs = keepOperator(b, c.Opts.Prefs)
+	}
+	if c := cmd.SetPrefs; c != nil && c.New != nil {
+		c.New = keepOperator(b, c.New)
+	}
+	return nil
+}
+
+// operatorOf returns the operator user in b's current prefs, if any.
+func operatorOf(b *ipn.LocalBackend) string {
+	if prefs := b.Prefs(); prefs != nil {
+		return prefs.OperatorUser
+	}
+	return ""
+}
+
+// keepOperator returns a copy of new with the operator user of b's
+// current prefs.
+func keepOperator(b *ipn.LocalBackend, new *ipn.Prefs) *ipn.Prefs {
+	op := operatorOf(b)
+	if new.OperatorUser == op {
+		return new
+	}
+	new = new.Copy()
+	new.OperatorUser = op
+	return new
+}
+
+type peerKey struct{}
+
+// withPeer returns ctx carrying p, for the LocalAPI handlers.
+func withPeer(ctx context.Context, p peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// ctxPeer returns the peer stored in ctx by withPeer. A missing peer
+// is treated as an unidentifiable one that can't be trusted.
+func ctxPeer(ctx context.Context) peer {
+	p, ok := ctx.Value(peerKey{}).(peer)
+	if !ok {
+		return peer{err: errors.New("no peer")}
+	}
+	return p
+}
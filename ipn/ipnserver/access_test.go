@@ -0,0 +1,55 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"tailscale.com/safesocket"
+)
+
+func TestDeniedError(t *testing.T) {
+	// A uid with no user, which userName leaves as is.
+	const uid = "4242424"
+	known := peer{creds: &safesocket.Creds{UID: uid}}
+	tests := []struct {
+		name     string
+		operator string
+		p        peer
+		min      access
+		is       error
+		contains []string
+	}{
+		{"no operator", "", known, accessOperator, errReadOnly, []string{uid, "tailscale set --operator=" + uid}},
+		{"other operator", "alice", known, accessOperator, errReadOnly, []string{"(alice)", "this is " + uid, "sudo"}},
+		{"root only", "alice", known, accessOwner, errOwnerOnly, []string{"this is " + uid, "sudo"}},
+		{"unknown peer", "", peer{err: errors.New("no creds")}, accessOperator, errReadOnly, []string{"couldn't tell which user"}},
+	}
+	for _, tt := range tests {
+		err := deniedError(tt.operator, tt.p, tt.min)
+		if !errors.Is(err, tt.is) {
+			t.Errorf("%s: error %q isn't %q", tt.name, err, tt.is)
+		}
+		for _, s := range tt.contains {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("%s: error %q doesn't mention %q", tt.name, err, s)
+			}
+		}
+	}
+}
+
+func TestAccessOfUnidentified(t *testing.T) {
+	for _, p := range []peer{
+		{err: safesocket.ErrNoCreds},
+		{err: errors.New("no creds")},
+		{},
+	} {
+		if a := accessOf(nil, nil, p); a != accessReadOnly {
+			t.Errorf("accessOf(%+v) = %v, want %v", p, a, accessReadOnly)
+		}
+	}
+}
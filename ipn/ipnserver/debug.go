@@ -0,0 +1,53 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"text/tabwriter"
+
+	"tailscale.com/ipn"
+)
+
+// registerDebugHandlers adds pages showing b's live state to mux, for
+// tailscaled's loopback-only debug server:
+//
+//	/debug/netmap    the current network map, with keys abbreviated
+//	/debug/magicsock the engine's NAT traversal state and peer paths
+//	/debug/status    the full ipnstate.Status, as JSON
+func registerDebugHandlers(mux *http.ServeMux, b *ipn.LocalBackend) {
+	mux.HandleFunc("/debug/netmap", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		nm := b.NetMap()
+		if nm == nil {
+			io.WriteString(w, "no netmap\n")
+			return
+		}
+		// Concise leaves out the private key and shortens the
+		// public ones.
+		io.WriteString(w, nm.Concise())
+	})
+	mux.HandleFunc("/debug/magicsock", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		st := b.Status()
+		fmt.Fprintf(w, "DERP home: %s\nNAT type: %s\n", st.DERPHome, st.NATType)
+		if ni := st.NetInfo; ni != nil {
+			fmt.Fprintf(w, "UDP blocked: %v\nDERP latency: %v\nSTUN latency: %v\n", ni.UDPBlocked, ni.DERPLatency, ni.STUNLatency)
+		}
+		io.WriteString(w, "\n")
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "PEER\tHOSTNAME\tCUR ADDR\tRELAY\tENDPOINTS\tLAST HANDSHAKE")
+		for _, ps := range st.Peers() {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\t%v\n",
+				ps.PublicKey.AbbrevString(), ps.HostName, ps.CurAddr, ps.Relay, ps.Endpoints, ps.LastHandshake)
+		}
+		tw.Flush()
+	})
+	mux.HandleFunc("/debug/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, b.Status())
+	})
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"tailscale.com/tailcfg"
+)
+
+// loadDERPMap reads a DERP map from the JSON file at path, as set by
+// Options.DERPMapPath.
+func loadDERPMap(path string) (*tailcfg.DERPMap, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dm := new(tailcfg.DERPMap)
+	if err := json.Unmarshal(bs, dm); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := checkDERPMap(dm); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return dm, nil
+}
+
+// checkDERPMap reports whether dm is usable: it has at least one
+// region, and every region has a matching ID and a named server.
+func checkDERPMap(dm *tailcfg.DERPMap) error {
+	if len(dm.Regions) == 0 {
+		return fmt.Errorf("no DERP regions")
+	}
+	for id, r := range dm.Regions {
+		if r == nil {
+			return fmt.Errorf("region %d is null", id)
+		}
+		if id < 1 || r.RegionID != id {
+			return fmt.Errorf("region key %d doesn't match its RegionID %d", id, r.RegionID)
+		}
+		if len(r.Nodes) == 0 {
+			return fmt.Errorf("region %d has no nodes", id)
+		}
+		for _, n := range r.Nodes {
+			if n == nil || n.HostName == "" {
+				return fmt.Errorf("region %d has a node without a HostName", id)
+			}
+		}
+	}
+	return nil
+}
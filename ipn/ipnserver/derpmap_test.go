@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDERPMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "derpmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		json    string
+		wantErr bool
+	}{
+		{"good", `{"Regions": {"1": {"RegionID": 1, "RegionCode": "home", "Nodes": [{"Name": "1a", "HostName": "derp.example.com"}]}}}`, false},
+		{"empty", `{"Regions": {}}`, true},
+		{"id_mismatch", `{"Regions": {"1": {"RegionID": 2, "Nodes": [{"HostName": "derp.example.com"}]}}}`, true},
+		{"no_nodes", `{"Regions": {"1": {"RegionID": 1}}}`, true},
+		{"no_host", `{"Regions": {"1": {"RegionID": 1, "Nodes": [{"Name": "1a"}]}}}`, true},
+		{"bad_json", `{"Regions": `, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".json")
+		if err := ioutil.WriteFile(path, []byte(tt.json), 0600); err != nil {
+			t.Fatal(err)
+		}
+		dm, err := loadDERPMap(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && dm.Regions[1].Nodes[0].HostName != "derp.example.com" {
+			t.Errorf("%s: loaded %+v", tt.name, dm)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// partialSuffix marks files in the inbox that are still arriving.
+// Their names also hold the sender's IP, so that two peers sending
+// files of the same name don't mix them up.
+const partialSuffix = ".partial"
+
+var (
+	errBadFileName = errors.New("invalid file name")
+	errFileBusy    = errors.New("file is already being received")
+)
+
+// offsetError is returned by fileInbox.put when the sender's offset
+// isn't where the partial file ends.
+type offsetError struct {
+	have int64
+}
+
+func (e offsetError) Error() string {
+	return fmt.Sprintf("have %d bytes, not the offset given", e.have)
+}
+
+// fileInbox is the directory where files received from peers wait
+// until "tailscale file get" collects them.
+type fileInbox struct {
+	dir string
+
+	mu   sync.Mutex
+	busy map[string]bool // partial files being written
+}
+
+func newFileInbox(dir string) *fileInbox {
+	return &fileInbox{dir: dir, busy: map[string]bool{}}
+}
+
+// validFileName reports whether name is acceptable as the name of a
+// received file: a plain name, without any directory.
+func validFileName(name string) bool {
+	if name == "" || len(name) > 255 || strings.HasPrefix(name, ".") ||
+		strings.HasSuffix(name, partialSuffix) || strings.ContainsAny(name, `/\:`) {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (in *fileInbox) partialPath(name, from string) string {
+	// IPv6 colons aren't allowed in Windows file names.
+	from = strings.Replace(from, ":", "-", -1)
+	return filepath.Join(in.dir, name+"."+from+partialSuffix)
+}
+
+// offset returns how many bytes of name from the peer with IP from
+// have been received.
+func (in *fileInbox) offset(name, from string) (int64, error) {
+	if !validFileName(name) {
+		return 0, errBadFileName
+	}
+	fi, err := os.Stat(in.partialPath(name, from))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// put writes the bytes of name from the peer with IP from, starting
+// at offset, from r. Once all size bytes have arrived, the file is
+// moved into place, with a new name if the inbox already has one
+// called name. An error leaves what has arrived, to resume from.
+func (in *fileInbox) put(name, from string, offset, size int64, r io.Reader) error {
+	if !validFileName(name) {
+		return errBadFileName
+	}
+	if offset < 0 || offset > size {
+		return offsetError{have: 0}
+	}
+	partial := in.partialPath(name, from)
+	in.mu.Lock()
+	if in.busy[partial] {
+		in.mu.Unlock()
+		return errFileBusy
+	}
+	in.busy[partial] = true
+	in.mu.Unlock()
+	defer func() {
+		in.mu.Lock()
+		delete(in.busy, partial)
+		in.mu.Unlock()
+	}()
+
+	if err := os.MkdirAll(in.dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if fi.Size() != offset {
+		f.Close()
+		return offsetError{have: fi.Size()}
+	}
+	n, err := io.Copy(f, io.LimitReader(r, size-offset))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if offset+n < size {
+		return io.ErrUnexpectedEOF
+	}
+	return in.finish(partial, name)
+}
+
+// finish moves the complete file partial into place as name, or as
+// "name (1)" and so on if that's taken.
+func (in *fileInbox) finish(partial, name string) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		dst := filepath.Join(in.dir, name)
+		if i > 0 {
+			dst = filepath.Join(in.dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			return os.Rename(partial, dst)
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// list returns the complete files waiting in the inbox, by name.
+func (in *fileInbox) list() ([]ipnstate.WaitingFile, error) {
+	fis, err := ioutil.ReadDir(in.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []ipnstate.WaitingFile
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), partialSuffix) {
+			continue
+		}
+		ret = append(ret, ipnstate.WaitingFile{Name: fi.Name(), Size: fi.Size()})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+// open opens the waiting file name.
+func (in *fileInbox) open(name string) (*os.File, error) {
+	if !validFileName(name) {
+		return nil, errBadFileName
+	}
+	return os.Open(filepath.Join(in.dir, name))
+}
+
+// remove deletes the waiting file name, once it's been collected.
+func (in *fileInbox) remove(name string) error {
+	if !validFileName(name) {
+		return errBadFileName
+	}
+	return os.Remove(filepath.Join(in.dir, name))
+}
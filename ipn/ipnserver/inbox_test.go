@@ -0,0 +1,90 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+func TestValidFileName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"report.pdf":       true,
+		"My Photo (2).jpg": true,
+		"":                 false,
+		".bashrc":          false,
+		"..":               false,
+		"a/b":              false,
+		`a\b`:              false,
+		"c:foo":            false,
+		"x.partial":        false,
+		"bell\a":           false,
+	} {
+		if got := validFileName(name); got != want {
+			t.Errorf("validFileName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestFileInbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := newFileInbox(filepath.Join(dir, "files"))
+	const from = "100.64.0.2"
+
+	// An interrupted transfer keeps what arrived.
+	if err := in.put("a.txt", from, 0, 10, strings.NewReader("hello")); err == nil {
+		t.Fatal("short put succeeded")
+	}
+	off, err := in.offset("a.txt", from)
+	if err != nil || off != 5 {
+		t.Fatalf("offset = %d, %v; want 5", off, err)
+	}
+	if err := in.put("a.txt", from, 0, 10, strings.NewReader("hello")); err == nil {
+		t.Fatal("put at the wrong offset succeeded")
+	} else if oe, ok := err.(offsetError); !ok || oe.have != 5 {
+		t.Fatalf("put at the wrong offset: %v", err)
+	}
+	if err := in.put("a.txt", from, 5, 10, strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+	// A second file of the same name doesn't replace the first.
+	if err := in.put("a.txt", "100.64.0.3", 0, 2, strings.NewReader("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := in.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ipnstate.WaitingFile{{Name: "a (1).txt", Size: 2}, {Name: "a.txt", Size: 10}}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("list = %v, want %v", files, want)
+	}
+	f, err := in.open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(b) != "helloworld" {
+		t.Errorf("a.txt = %q", b)
+	}
+	if err := in.remove("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.remove("../files/a (1).txt"); err != errBadFileName {
+		t.Errorf("remove outside the inbox: %v", err)
+	}
+}
@@ -0,0 +1,541 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/clientmetrics"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/safesocket"
+	"tailscale.com/types/logger"
+	"tailscale.com/updates"
+	"tailscale.com/version"
+)
+
+// The LocalAPI is a small HTTP API served on the same socket as the
+// framed ipn protocol. It lets tools and GUIs that don't import the
+// ipn package query and drive the backend using plain JSON.
+//
+//	GET    /localapi/v0/status                current ipnstate.Status
+//	GET    /localapi/v0/prefs                 current Prefs, without keys
+//	GET    /localapi/v0/whois?ip=a            ipnstate.WhoIsResponse for Tailscale IP a
+//	GET    /localapi/v0/ping?peer=p&type=t    ipnstate.PingResult of an ipn.PingType t ping to peer p
+//	GET    /localapi/v0/metrics               []clientmetrics.Value, tailscaled's counters and gauges
+//	GET    /localapi/v0/version               ipnstate.VersionInfo of tailscaled
+//	GET    /localapi/v0/netmap                current network map, without the private key
+//	GET    /localapi/v0/derpmap               tailcfg.DERPMap in use, null if the built-in one
+//	GET    /localapi/v0/logs                  recent backend log lines, secrets redacted
+//	GET    /localapi/v0/files                 []ipnstate.WaitingFile received from peers
+//	GET    /localapi/v0/files/name            contents of the received file name
+//	DELETE /localapi/v0/files/name            delete the received file name
+//	GET    /localapi/v0/loglevel              log levels, in the form logger.ParseLevels takes
+//	POST   /localapi/v0/prefs                 replace Prefs with the body
+//	POST   /localapi/v0/login                 start interactive login
+//	POST   /localapi/v0/logout                log out
+//	POST   /localapi/v0/pause                 pause the engine
+//	POST   /localapi/v0/resume                resume the paused engine
+//	POST   /localapi/v0/debug?action=a        run ipn.DebugAction a
+//	POST   /localapi/v0/rotate-machine-key    replace the machine key
+//	POST   /localapi/v0/bugreport             log a bug report marker, reply with its ID
+//	POST   /localapi/v0/netcheck              check the network again, reply with the new Status
+//	POST   /localapi/v0/update/check?track=t  check for a newer release on track t, reply with ipnstate.UpdateInfo
+//	POST   /localapi/v0/loglevel?levels=l     replace the log levels with l
+//
+// Anyone may GET, except as follows. Logs and files, like changing
+// prefs, pausing and logging in or out, need the operator user.
+// Netmap, debug, rotate-machine-key, setting the log levels and
+// changing the operator user need root. Who is which is decided by
+// accessOf. Anyone may file a bug report, run a network check, which
+// is rate-limited, and check for updates. Refusals say who the client
+// is and what it would need, see deniedError.
+const localAPIPrefix = "/localapi/v0/"
+
+// maxPrefsBody bounds the size of a POSTed Prefs document.
+const maxPrefsBody = 1 << 20
+
+// maxPingWait is how long a ping request waits for the reply.
+const maxPingWait = 5 * time.Second
+
+// maxNetcheckWait is how long a netcheck request waits for the
+// engine to finish checking.
+const maxNetcheckWait = 10 * time.Second
+
+// maxUpdateCheckWait is how long an update check waits for the
+// package server.
+const maxUpdateCheckWait = 30 * time.Second
+
+// errNotStarted is returned by LocalAPI calls which need a running
+// backend, before any frontend has started it.
+var errNotStarted = errors.New("backend not started")
+
+// errNoInbox is returned by the files calls when tailscaled doesn't
+// receive files.
+var errNoInbox = errors.New("receiving files is off")
+
+// errFixedLevels is returned by the loglevel calls when tailscaled's
+// log levels can't be changed.
+var errFixedLevels = errors.New("log levels can't be changed")
+
+// localAPIHandler returns the LocalAPI handler for b, whose process
+// has credentials self. The backend logs to logf, filtered by levels
+// if non-nil, and its recent lines are kept in logs. Files from peers
+// arrive in inbox, or nil if they aren't received.
+func localAPIHandler(b *ipn.LocalBackend, self *safesocket.Creds, logf logger.Logf, levels *logger.Levels, logs *logRing, inbox *fileInbox) http.Handler {
+	mux := http.NewServeMux()
+	// allowed reports whether the client of r has at least access
+	// min, and otherwise fails the request.
+	allowed := func(w http.ResponseWriter, r *http.Request, min access) bool {
+		if accessOf(b, self, ctxPeer(r.Context())) >= min {
+			return true
+		}
+		http.Error(w, deniedError(operatorOf(b), ctxPeer(r.Context()), min).Error(), http.StatusForbidden)
+		return false
+	}
+	mux.HandleFunc(localAPIPrefix+"status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, b.Status())
+	})
+	mux.HandleFunc(localAPIPrefix+"whois", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		// Accept "ip:port" too, as callers have it from the
+		// connection they want to identify.
+		s := r.FormValue("ip")
+		if host, _, err := net.SplitHostPort(s); err == nil {
+			s = host
+		}
+		ip := wgcfg.ParseIP(s)
+		if ip == nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+		res := b.WhoIs(*ip)
+		if res == nil {
+			http.Error(w, "no node with that IP", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, res)
+	})
+	mux.HandleFunc(localAPIPrefix+"ping", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		typ, err := ipn.ParsePingType(r.FormValue("type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), maxPingWait)
+		defer cancel()
+		res, err := b.Ping(ctx, r.FormValue("peer"), typ)
+		switch {
+		case err == context.DeadlineExceeded:
+			http.Error(w, "no reply", http.StatusGatewayTimeout)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, res)
+	})
+	mux.HandleFunc(localAPIPrefix+"metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, clientmetrics.Snapshot())
+	})
+	mux.HandleFunc(localAPIPrefix+"version", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, &ipnstate.VersionInfo{
+			Version:         version.LONG,
+			ProtocolVersion: ipn.ProtocolVersion,
+			OS:              runtime.GOOS,
+			Arch:            runtime.GOARCH,
+		})
+	})
+	mux.HandleFunc(localAPIPrefix+"netmap", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		if !allowed(w, r, accessOwner) {
+			return
+		}
+		nm := b.NetMap()
+		if nm == nil {
+			http.Error(w, "no netmap yet", http.StatusServiceUnavailable)
+			return
+		}
+		redacted := *nm
+		redacted.PrivateKey = wgcfg.PrivateKey{}
+		writeJSON(w, &redacted)
+	})
+	mux.HandleFunc(localAPIPrefix+"derpmap", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, b.DERPMap())
+	})
+	mux.HandleFunc(localAPIPrefix+"logs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		if !allowed(w, r, accessOperator) {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, l := range logs.Lines() {
+			io.WriteString(w, l+"\n")
+		}
+	})
+	mux.HandleFunc(localAPIPrefix+"files", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		if !allowed(w, r, accessOperator) {
+			return
+		}
+		if inbox == nil {
+			http.Error(w, errNoInbox.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		files, err := inbox.list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if files == nil {
+			files = []ipnstate.WaitingFile{}
+		}
+		writeJSON(w, files)
+	})
+	mux.HandleFunc(localAPIPrefix+"files/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(w, r, accessOperator) {
+			return
+		}
+		if inbox == nil {
+			http.Error(w, errNoInbox.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, localAPIPrefix+"files/")
+		switch r.Method {
+		case "GET":
+			f, err := inbox.open(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			defer f.Close()
+			w.Header().Set("Content-Type", "application/octet-stream")
+			if fi, err := f.Stat(); err == nil {
+				w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+			}
+			io.Copy(w, f)
+		case "DELETE":
+			if err := inbox.remove(name); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "want GET or DELETE", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc(localAPIPrefix+"bugreport", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := newBugReportID(time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The marker goes to the log server along with the rest
+		// of the log, where support can search for the ID.
+		logf("user bugreport: %s\n", id)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, id+"\n")
+	})
+	mux.HandleFunc(localAPIPrefix+"prefs", func(w http.ResponseWriter, r *http.Request) {
+		prefs := b.Prefs()
+		if prefs == nil {
+			http.Error(w, errNotStarted.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "POST", "PUT":
+			if !allowed(w, r, accessOperator) {
+				return
+			}
+			bs, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPrefsBody))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			prefs, err = ipn.PrefsFromBytes(bs, false)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Unlike the framed protocol's full prefs from
+			// "tailscale up", a LocalAPI client changes the
+			// operator only on purpose, so tell it that it can't.
+			if p := ctxPeer(r.Context()); prefs.OperatorUser != operatorOf(b) && accessOf(b, self, p) < accessOwner {
+				http.Error(w, deniedError(operatorOf(b), p, accessOwner).Error(), http.StatusForbidden)
+				return
+			}
+			b.SetPrefs(prefs)
+			prefs = b.Prefs()
+		default:
+			http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+			return
+		}
+		// Never hand out the node keys.
+		prefs = prefs.Copy()
+		prefs.Persist = nil
+		writeJSON(w, prefs)
+	})
+	action := func(path string, min access, fn func(r *http.Request) error) {
+		mux.HandleFunc(localAPIPrefix+path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "want POST", http.StatusMethodNotAllowed)
+				return
+			}
+			if !allowed(w, r, min) {
+				return
+			}
+			if b.Prefs() == nil {
+				http.Error(w, errNotStarted.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			if err := fn(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	action("login", accessOperator, func(r *http.Request) error {
+		b.StartLoginInteractive()
+		return nil
+	})
+	action("logout", accessOperator, func(r *http.Request) error {
+		b.Logout()
+		return nil
+	})
+	action("pause", accessOperator, func(r *http.Request) error {
+		b.SetPaused(true)
+		return nil
+	})
+	action("resume", accessOperator, func(r *http.Request) error {
+		b.SetPaused(false)
+		return nil
+	})
+	action("rotate-machine-key", accessOwner, func(r *http.Request) error {
+		b.RotateMachineKey()
+		return nil
+	})
+	mux.HandleFunc(localAPIPrefix+"netcheck", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), maxNetcheckWait)
+		defer cancel()
+		if _, err := b.Netcheck(ctx); err != nil {
+			if err == context.DeadlineExceeded {
+				http.Error(w, "the network check didn't finish", http.StatusGatewayTimeout)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, b.Status())
+	})
+	mux.HandleFunc(localAPIPrefix+"update/check", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		track := r.FormValue("track")
+		if track != "" {
+			if err := updates.CheckTrack(track); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), maxUpdateCheckWait)
+		defer cancel()
+		info, err := b.CheckUpdate(ctx, track)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, info)
+	})
+	mux.HandleFunc(localAPIPrefix+"loglevel", func(w http.ResponseWriter, r *http.Request) {
+		if levels == nil {
+			http.Error(w, errFixedLevels.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "POST":
+			if !allowed(w, r, accessOwner) {
+				return
+			}
+			if err := levels.Set(r.FormValue("levels")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logf("log levels set to %v\n", levels)
+		default:
+			http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, levels.String())
+	})
+	action("debug", accessOwner, func(r *http.Request) error {
+		switch a := ipn.DebugAction(r.FormValue("action")); a {
+		case ipn.DebugRebind, ipn.DebugReSTUN, ipn.DebugDump, ipn.DebugVerboseOn, ipn.DebugVerboseOff:
+			b.Debug(a)
+			return nil
+		case "":
+			return errors.New("missing action")
+		default:
+			return errors.New("unknown action " + string(a))
+		}
+	})
+	return mux
+}
+
+// newBugReportID returns a unique ID for a bug report filed at now.
+func newBugReportID(now time.Time) (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("BUG-%x-%s", b, now.UTC().Format("20060102150405Z")), nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+// sniffTimeout is how long a new connection has to send its first
+// bytes before it's assumed to be a framed-protocol frontend that's
+// waiting for the backend to speak first.
+const sniffTimeout = 5 * time.Second
+
+// isHTTP reports whether the connection buffered in br opens with an
+// HTTP request rather than a framed ipn message.
+//
+// Framed messages start with a little-endian uint32 length which is
+// always at most ipn.MSG_MAX, so its fourth byte is zero. Every
+// HTTP request line has a non-zero fourth byte.
+func isHTTP(br *bufio.Reader) bool {
+	hdr, err := br.Peek(4)
+	return err == nil && hdr[3] != 0
+}
+
+// sniffConn reads the start of c and reports whether it's an HTTP
+// client. The returned conn must be used in place of c, since it
+// holds the bytes that were read.
+func sniffConn(c net.Conn) (net.Conn, bool) {
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	isH := isHTTP(br)
+	c.SetReadDeadline(time.Time{})
+	return &bufConn{Conn: c, r: br}, isH
+}
+
+// bufConn is a net.Conn whose reads come through a bufio.Reader
+// that may already hold some of the connection's data.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// connListener is a net.Listener that yields connections handed to
+// it by push, so that an http.Server can serve connections accepted
+// elsewhere.
+type connListener struct {
+	addr net.Addr
+	ch   chan net.Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		ch:     make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// push hands c to the listener's Accept, or closes c if the listener
+// is closed.
+func (ln *connListener) push(c net.Conn) {
+	select {
+	case ln.ch <- c:
+	case <-ln.closed:
+		c.Close()
+	}
+}
+
+func (ln *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.ch:
+		return c, nil
+	case <-ln.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (ln *connListener) Close() error {
+	ln.closeOnce.Do(func() { close(ln.closed) })
+	return nil
+}
+
+func (ln *connListener) Addr() net.Addr { return ln.addr }
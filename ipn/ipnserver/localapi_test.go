@@ -0,0 +1,82 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestSniffConn(t *testing.T) {
+	var framed bytes.Buffer
+	ipn.WriteMsg(&framed, []byte(`{"Quit":{}}`))
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"framed", framed.Bytes(), false},
+		{"get", []byte("GET /localapi/v0/status HTTP/1.1\r\n"), true},
+		{"post", []byte("POST /localapi/v0/login HTTP/1.1\r\n"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go client.Write(tt.data)
+
+			c, got := sniffConn(server)
+			if got != tt.want {
+				t.Errorf("isHTTP = %v, want %v", got, tt.want)
+			}
+			// The sniffed bytes must still be readable.
+			buf := make([]byte, len(tt.data))
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, tt.data) {
+				t.Errorf("read %q, want %q", buf, tt.data)
+			}
+		})
+	}
+}
+
+func TestConnListener(t *testing.T) {
+	ln := newConnListener(nil)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	})}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go ln.push(server)
+
+	req, _ := http.NewRequest("GET", "http://local"+localAPIPrefix+"status", nil)
+	go req.Write(client)
+	res, err := http.ReadResponse(bufio.NewReader(client), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if want := localAPIPrefix + "status"; string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+
+	ln.Close()
+	if err := <-done; err == nil {
+		t.Error("Serve returned nil after Close")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// logRingSize is how many recent log lines a logRing keeps for bug
+// reports.
+const logRingSize = 1000
+
+// logRing keeps the most recent lines logged by the backend, so that
+// "tailscale bugreport" can bundle them without access to the log
+// files or the log server.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string // oldest first
+}
+
+// wrap returns a logger that logs to logf and records each line in r.
+func (r *logRing) wrap(logf logger.Logf) logger.Logf {
+	return func(format string, args ...interface{}) {
+		logf(format, args...)
+		r.add(fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *logRing) add(msg string) {
+	line := time.Now().Format("2006-01-02 15:04:05.000 ") + strings.TrimRight(msg, "\n")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) == logRingSize {
+		copy(r.lines, r.lines[1:])
+		r.lines = r.lines[:logRingSize-1]
+	}
+	r.lines = append(r.lines, line)
+}
+
+// secretRx matches secrets that may turn up in log lines: auth keys
+// and WireGuard private keys in UAPI form.
+var secretRx = regexp.MustCompile(`tskey-[A-Za-z0-9-]+|private_key=[0-9a-f]+`)
+
+// Lines returns the recorded lines, oldest first, with secrets
+// redacted.
+func (r *logRing) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make([]string, len(r.lines))
+	for i, l := range r.lines {
+		ret[i] = secretRx.ReplaceAllStringFunc(l, func(s string) string {
+			if i := strings.IndexAny(s, "-="); i >= 0 {
+				return s[:i+1] + "[redacted]"
+			}
+			return "[redacted]"
+		})
+	}
+	return ret
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLogRing(t *testing.T) {
+	r := new(logRing)
+	var logged int
+	logf := r.wrap(func(string, ...interface{}) { logged++ })
+	for i := 0; i < logRingSize+5; i++ {
+		logf("line %d\n", i)
+	}
+	if logged != logRingSize+5 {
+		t.Errorf("underlying logger got %d lines, want %d", logged, logRingSize+5)
+	}
+	lines := r.Lines()
+	if len(lines) != logRingSize {
+		t.Fatalf("kept %d lines, want %d", len(lines), logRingSize)
+	}
+	if want := "line 5"; !strings.HasSuffix(lines[0], want) {
+		t.Errorf("oldest line = %q, want suffix %q", lines[0], want)
+	}
+	if want := fmt.Sprintf("line %d", logRingSize+4); !strings.HasSuffix(lines[len(lines)-1], want) {
+		t.Errorf("newest line = %q, want suffix %q", lines[len(lines)-1], want)
+	}
+}
+
+func TestLogRingRedacts(t *testing.T) {
+	r := new(logRing)
+	r.add("login with tskey-abc123-DEF")
+	r.add("uapi: private_key=0123abcd listen_port=41641")
+	lines := r.Lines()
+	for _, l := range lines {
+		if strings.Contains(l, "abc123") || strings.Contains(l, "0123abcd") {
+			t.Errorf("secret not redacted: %q", l)
+		}
+	}
+	if !strings.HasSuffix(lines[0], "tskey-[redacted]") {
+		t.Errorf("got %q, want tskey-[redacted]", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "private_key=[redacted] listen_port=41641") {
+		t.Errorf("got %q, want private_key=[redacted]", lines[1])
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/logger"
+)
+
+// The peer API is an HTTP service that tailscaled offers other nodes
+// on its Tailscale IPs, at ipnstate.PeerAPIPort. Only nodes of the
+// same user may use it.
+//
+//	GET /v0/ping                      ipnstate.PeerPingReply to a TSMP ping
+//	GET /v0/put/name                  ipnstate.FileOffset received so far of file name
+//	PUT /v0/put/name?offset=o&size=s  bytes o and on of file name, s bytes long
+//
+// A sender resumes an interrupted transfer by asking for the offset,
+// and sending the rest from there. Any node the packet filter lets
+// reach this one may ping, so that a ping shows how this node sees
+// it. The filter exempts the port, see LocalBackend.updateFilter.
+const peerAPIPutPrefix = "/v0/put/"
+
+// servePeerAPI serves the peer API for b, with received files going
+// to inbox, until ctx is done.
+//
+// It listens on every address, as the node's Tailscale IPs come and
+// go, and refuses connections that didn't arrive on one of them.
+func servePeerAPI(ctx context.Context, logf logger.Logf, b *ipn.LocalBackend, inbox *fileInbox) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", ipnstate.PeerAPIPort))
+	if err != nil {
+		logf("peerapi: %v; receiving files is off\n", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	srv := &http.Server{
+		Handler:           peerAPIHandler(b, inbox, logf),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	if err := srv.Serve(ln); err != nil && ctx.Err() == nil {
+		logf("peerapi: %v\n", err)
+	}
+}
+
+// peerIP returns the IP of the "ip:port" addr.
+func peerIP(addr string) *wgcfg.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return wgcfg.ParseIP(host)
+}
+
+// tunnelAddrs returns the source and destination Tailscale IPs of r,
+// or nils if r didn't arrive on one of b's Tailscale IPs.
+func tunnelAddrs(b *ipn.LocalBackend, r *http.Request) (src, dst *wgcfg.IP) {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local == nil {
+		return nil, nil
+	}
+	dst = peerIP(local.String())
+	if dst == nil {
+		return nil, nil
+	}
+	mine := false
+	for _, a := range b.LocalAddrs() {
+		if a.IP.Equal(dst) {
+			mine = true
+		}
+	}
+	src = peerIP(r.RemoteAddr)
+	if !mine || src == nil {
+		return nil, nil
+	}
+	return src, dst
+}
+
+// peerAllowed reports whether r came over the tunnel, to one of b's
+// Tailscale IPs, from a node of the same user.
+func peerAllowed(b *ipn.LocalBackend, r *http.Request) bool {
+	src, _ := tunnelAddrs(b, r)
+	nm := b.NetMap()
+	if src == nil || nm == nil {
+		return false
+	}
+	who := b.WhoIs(*src)
+	return who != nil && who.Node.User == nm.User
+}
+
+func peerAPIHandler(b *ipn.LocalBackend, inbox *fileInbox, logf logger.Logf) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ipnstate.PeerAPIPingPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		src, dst := tunnelAddrs(b, r)
+		if src == nil {
+			http.Error(w, "not allowed", http.StatusForbidden)
+			return
+		}
+		reply, err := b.PeerPing(*src, *dst)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%v: %v", src, err), http.StatusForbidden)
+			return
+		}
+		writeJSON(w, reply)
+	})
+	mux.HandleFunc(peerAPIPutPrefix, func(w http.ResponseWriter, r *http.Request) {
+		if !peerAllowed(b, r) {
+			http.Error(w, "not allowed", http.StatusForbidden)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, peerAPIPutPrefix)
+		from := peerIP(r.RemoteAddr).String()
+		switch r.Method {
+		case "GET":
+			off, err := inbox.offset(name, from)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, &ipnstate.FileOffset{Offset: off})
+		case "PUT":
+			offset, err1 := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+			size, err2 := strconv.ParseInt(r.FormValue("size"), 10, 64)
+			if err1 != nil || err2 != nil {
+				http.Error(w, "bad offset or size", http.StatusBadRequest)
+				return
+			}
+			err := inbox.put(name, from, offset, size, r.Body)
+			switch err.(type) {
+			case nil:
+				logf("peerapi: received %q (%d bytes) from %v\n", name, size, from)
+				w.WriteHeader(http.StatusNoContent)
+			case offsetError:
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				if err == errBadFileName || err == errFileBusy {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				logf("peerapi: receiving %q from %v: %v\n", name, from, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		default:
+			http.Error(w, "want GET or PUT", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
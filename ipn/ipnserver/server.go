@@ -7,9 +7,11 @@ package ipnserver
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -24,6 +26,7 @@ import (
 	"tailscale.com/ipn"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/safesocket"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/version"
 	"tailscale.com/wgengine"
@@ -32,13 +35,19 @@ import (
 // Options is the configuration of the Tailscale node agent.
 type Options struct {
 	// SocketPath, on unix systems, is the unix socket path to listen
-	// on for frontend connections.
+	// on for frontend connections. On windows, it names the named
+	// pipe to listen on instead, see safesocket.Listen.
 	SocketPath string
-	// Port, on windows, is the localhost TCP port to listen on for
-	// frontend connections.
+	// Port, on windows, if non-zero, is a localhost TCP port to
+	// listen on for frontend connections instead of the named pipe.
 	Port int
-	// StatePath is the path to the stored agent state.
+	// StatePath is the path to the stored agent state, or another
+	// state store, see ipn.NewStateStore. If empty, state is kept
+	// in memory.
 	StatePath string
+	// StateSealer, if non-nil, encrypts the state file at StatePath.
+	// A plaintext state file is encrypted on startup.
+	StateSealer ipn.Sealer
 	// AutostartStateKey, if non-empty, immediately starts the agent
 	// using the given StateKey. If empty, the agent stays idle and
 	// waits for a frontend to start it.
@@ -52,14 +61,65 @@ type Options struct {
 	// TODO(danderson): remove some time after the transition to
 	// tailscaled is done.
 	LegacyConfigPath string
+	// DefaultPrefs optionally specifies the prefs that the agent
+	// started with AutostartStateKey uses when it has no state yet.
+	DefaultPrefs *ipn.Prefs
 	// SurviveDisconnects specifies how the server reacts to its
 	// frontend disconnecting. If true, the server keeps running on
 	// its existing state, and accepts new frontend connections. If
-	// false, the server dumps its state and becomes idle.
+	// false, the server dumps its state and becomes idle, unless
+	// the prefs have ForceDaemon set; then it keeps running, and
+	// restarts on those prefs the next time it's run.
 	SurviveDisconnects bool
+	// EnableIPForwarding specifies whether the backend may turn on
+	// the kernel's IP forwarding when subnet routes are advertised.
+	// If false, disabled forwarding is only reported as a warning.
+	EnableIPForwarding bool
+	// DERPMapPath optionally names a JSON file holding a
+	// tailcfg.DERPMap, which replaces the DERP servers sent by the
+	// control server, for self-hosted DERP.
+	DERPMapPath string
+	// MachineKeyStore optionally names a controlclient.KeyStore to
+	// generate new machine keys in, instead of the state file.
+	MachineKeyStore string
+	// DebugMux, if non-nil, is the mux of a debug HTTP server, on
+	// which Run adds pages showing the backend's live state.
+	DebugMux *http.ServeMux
+	// WebMux, if non-nil, is the mux of the web UI's HTTP server,
+	// on which Run adds its pages. The server's ConnContext must be
+	// WebConnContext.
+	WebMux *http.ServeMux
+	// OnReload, if non-nil, is called on SIGHUP, before Run reloads
+	// the DERP map and the backend, for the daemon to re-read its
+	// own configuration and apply what it can, such as b's default
+	// prefs.
+	OnReload func(b *ipn.LocalBackend)
+	// OnReady, if non-nil, is called once Run is listening and has
+	// started the backend, if it autostarts one. It doesn't wait for
+	// the control server, which may be unreachable for a long time;
+	// health.SysControl reports that.
+	OnReady func()
+	// OnLive, if non-nil, is called each time the backend's liveness
+	// watchdog finds it responsive, see
+	// ipn.LocalBackend.SetLiveCallback.
+	OnLive func()
+	// Ephemeral specifies that the node registers as ephemeral
+	// whenever it starts, whatever the frontend asks, so that the
+	// control server removes it once it goes offline. It's meant
+	// for a StatePath of "mem:".
+	Ephemeral bool
+	// FileInboxDir, if non-empty, is the directory where files sent
+	// by the user's other nodes wait to be collected. If empty, the
+	// node doesn't receive files.
+	FileInboxDir string
+	// LogLevels, if non-nil, are the verbosity levels that the
+	// daemon's logf filters by, which Run also applies, and which
+	// the LocalAPI lets root change at runtime.
+	LogLevels *logger.Levels
 }
 
-func pump(logf logger.Logf, ctx context.Context, bs *ipn.BackendServer, s net.Conn) {
+// pump runs the commands read from s, after check allows them.
+func pump(logf logger.Logf, ctx context.Context, bs *ipn.BackendServer, s net.Conn, check func(*ipn.Command) error) {
 	defer logf("Control connection done.\n")
 
 	for ctx.Err() == nil && !bs.GotQuit {
@@ -68,7 +128,17 @@ func pump(logf logger.Logf, ctx context.Context, bs *ipn.BackendServer, s net.Co
 			logf("ReadMsg: %v\n", err)
 			break
 		}
-		err = bs.GotCommandMsg(msg)
+		cmd := new(ipn.Command)
+		if err := json.Unmarshal(msg, cmd); err != nil {
+			logf("GotCommandMsg: %v\n", err)
+			break
+		}
+		if err := check(cmd); err != nil {
+			logf("refused command: %v\n", err)
+			bs.SendErrorMessage(ipn.ErrPermissionDenied, err.Error())
+			continue
+		}
+		err = bs.GotCommand(cmd)
 		if err != nil {
 			logf("GotCommandMsg: %v\n", err)
 			break
@@ -76,8 +146,33 @@ func pump(logf logger.Logf, ctx context.Context, bs *ipn.BackendServer, s net.Co
 	}
 }
 
+// refuse tells the framed-protocol frontend on c why it can't
+// connect, and hangs up.
+func refuse(c net.Conn, err error) {
+	msg := err.Error()
+	b, _ := json.Marshal(ipn.Notify{
+		Version:         version.LONG,
+		ProtocolVersion: ipn.ProtocolVersion,
+		ErrMessage:      &msg,
+		Error: &ipn.NotifyError{
+			Code:     ipn.ErrPermissionDenied,
+			Message:  msg,
+			Critical: true,
+		},
+	})
+	ipn.WriteMsg(c, b)
+	c.Close()
+}
+
+// Run runs a backend on engine e, serving frontends as opts says,
+// until rctx is done. It then shuts the backend down, which closes e,
+// see ipn.LocalBackend.Shutdown.
 func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e wgengine.Engine) error {
 	bo := backoff.Backoff{Name: "ipnserver"}
+	logs := new(logRing)
+	// Filter before the ring too, so that it only holds lines that
+	// were logged.
+	logf = opts.LogLevels.Filter(logs.wrap(logf))
 
 	listen, _, err := safesocket.Listen(opts.SocketPath, uint16(opts.Port))
 	if err != nil {
@@ -90,11 +185,19 @@ func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e w
 	}()
 	logf("Listening on %v\n", listen.Addr())
 
+	var derpMap *tailcfg.DERPMap
+	if opts.DERPMapPath != "" {
+		derpMap, err = loadDERPMap(opts.DERPMapPath)
+		if err != nil {
+			return fmt.Errorf("DERP map: %v", err)
+		}
+	}
+
 	var store ipn.StateStore
 	if opts.StatePath != "" {
-		store, err = ipn.NewFileStore(opts.StatePath)
+		store, err = ipn.NewStateStore(opts.StatePath, opts.StateSealer)
 		if err != nil {
-			return fmt.Errorf("ipn.NewFileStore(%q): %v", opts.StatePath, err)
+			return fmt.Errorf("ipn.NewStateStore(%q): %v", opts.StatePath, err)
 		}
 	} else {
 		store = &ipn.MemoryStore{}
@@ -108,6 +211,33 @@ func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e w
 		return zstd.NewReader(nil)
 	})
 	b.SetCmpDiff(func(x, y interface{}) string { return cmp.Diff(x, y) })
+	b.SetEnableIPForwarding(opts.EnableIPForwarding)
+	b.SetDERPMapOverride(derpMap)
+	b.SetMachineKeyStore(opts.MachineKeyStore)
+	b.SetAlwaysEphemeral(opts.Ephemeral)
+	if opts.OnLive != nil {
+		b.SetLiveCallback(opts.OnLive)
+	}
+	if opts.DebugMux != nil {
+		registerDebugHandlers(opts.DebugMux, b)
+	}
+	go reloadOnHUP(rctx, logf, opts, b)
+
+	var inbox *fileInbox
+	if opts.FileInboxDir != "" {
+		inbox = newFileInbox(opts.FileInboxDir)
+		go servePeerAPI(rctx, logf, b, inbox)
+	}
+
+	// Clients running as the same user as the backend own it, see
+	// accessOf.
+	self, err := safesocket.SelfCreds()
+	if err != nil {
+		logf("SelfCreds: %v\n", err)
+	}
+	if opts.WebMux != nil {
+		registerWebHandlers(opts.WebMux, b, self, logf)
+	}
 
 	var s net.Conn
 	serverToClient := func(b []byte) {
@@ -118,6 +248,17 @@ func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e w
 
 	bs := ipn.NewBackendServer(logf, b, serverToClient)
 
+	// HTTP clients of the LocalAPI share the socket with the framed
+	// protocol, and aren't subject to the one-frontend limit.
+	apiLn := newConnListener(listen.Addr())
+	defer apiLn.Close()
+	go (&http.Server{
+		Handler: localAPIHandler(b, self, logf, opts.LogLevels, logs, inbox),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return withPeer(ctx, connPeer(c))
+		},
+	}).Serve(apiLn)
+
 	if opts.AutostartStateKey != "" {
 		bs.GotCommand(&ipn.Command{
 			Version: version.LONG,
@@ -125,9 +266,21 @@ func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e w
 				Opts: ipn.Options{
 					StateKey:         opts.AutostartStateKey,
 					LegacyConfigPath: opts.LegacyConfigPath,
+					DefaultPrefs:     opts.DefaultPrefs,
 				},
 			},
 		})
+	} else if key := serverModeStart(store); key != "" && !opts.SurviveDisconnects {
+		logf("Starting unattended on %q.\n", key)
+		bs.GotCommand(&ipn.Command{
+			Version: version.LONG,
+			Start: &ipn.StartArgs{
+				Opts: ipn.Options{StateKey: key},
+			},
+		})
+	}
+	if opts.OnReady != nil {
+		opts.OnReady()
 	}
 
 	var oldS net.Conn
@@ -145,30 +298,81 @@ func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e w
 		// that right now.
 		if oldS != nil {
 			cancel()
-			safesocket.ConnCloseRead(oldS)
-			safesocket.ConnCloseWrite(oldS)
+			safesocket.ConnCloseRead(oldS.(*bufConn).Conn)
+			safesocket.ConnCloseWrite(oldS.(*bufConn).Conn)
 		}
 	}
 
+	// Telling LocalAPI clients from frontends waits for a client's
+	// first bytes, so it's done on each connection's own goroutine,
+	// lest one slow or silent client hold up everyone else's.
+	// Frontends come back to the loop below.
+	frontends := make(chan net.Conn)
+	go func() {
+		bo := backoff.Backoff{Name: "ipnserver accept"}
+		for rctx.Err() == nil {
+			c, err := listen.Accept()
+			if err != nil {
+				logf("Accept: %v\n", err)
+				bo.BackOff(rctx, err)
+				continue
+			}
+			go func() {
+				c, isAPI := sniffConn(c)
+				if isAPI {
+					apiLn.push(c)
+					return
+				}
+				select {
+				case frontends <- c:
+				case <-rctx.Done():
+					c.Close()
+				}
+			}()
+		}
+	}()
+
 	for i := 1; rctx.Err() == nil; i++ {
-		s, err = listen.Accept()
-		if err != nil {
-			logf("%d: Accept: %v\n", i, err)
-			bo.BackOff(rctx, err)
+		var c net.Conn
+		select {
+		case c = <-frontends:
+		case <-rctx.Done():
+			continue
+		}
+		p := connPeer(c)
+		if a := accessOf(b, self, p); a < accessOperator {
+			// Don't let a read-only client kick out the
+			// current frontend; it can use the LocalAPI.
+			logf("%d: Refused %v control connection.\n", i, a)
+			refuse(c, deniedError(operatorOf(b), p, accessOperator))
 			continue
 		}
 		logf("%d: Incoming control connection.\n", i)
 		stopAll()
 
 		ctx, cancel = context.WithCancel(context.Background())
+		s = c
 		oldS = s
 
 		go func(ctx context.Context, bs *ipn.BackendServer, s net.Conn, i int) {
 			si := fmt.Sprintf("%d: ", i)
+			check := func(cmd *ipn.Command) error {
+				return checkCommand(b, self, p, cmd)
+			}
 			pump(func(fmt string, args ...interface{}) {
 				logf(si+fmt, args...)
-			}, ctx, bs, s)
-			if !opts.SurviveDisconnects || bs.GotQuit {
+			}, ctx, bs, s, check)
+			unattended := false
+			if !opts.SurviveDisconnects && !bs.GotQuit {
+				var err error
+				unattended, err = saveServerMode(store, b.Prefs(), b.StateKey())
+				if err != nil {
+					logf("%sserver mode: %v\n", si, err)
+				}
+			}
+			if unattended {
+				logf("%sFrontend gone, staying up unattended.\n", si)
+			} else if !opts.SurviveDisconnects || bs.GotQuit {
 				bs.Reset()
 				s.Close()
 			}
@@ -180,9 +384,45 @@ func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e w
 	}
 	stopAll()
 
+	// Tear down before returning, so that the process can exit
+	// without leaving routes or DNS settings behind.
+	logf("Shutting down.\n")
+	b.Shutdown()
+	logf("Shutdown complete.\n")
 	return rctx.Err()
 }
 
+// reloadOnHUP reloads b each time the process gets SIGHUP, until ctx
+// is done: it calls opts.OnReload, re-reads opts.DERPMapPath, and
+// re-applies the prefs and re-syncs with the control server. The
+// engine and its tunnels stay up.
+func reloadOnHUP(ctx context.Context, logf logger.Logf, opts Options, b *ipn.LocalBackend) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		logf("SIGHUP: reloading\n")
+		if opts.OnReload != nil {
+			opts.OnReload(b)
+		}
+		if opts.DERPMapPath != "" {
+			// A broken file keeps the DERP map in use, rather than
+			// falling back to control's.
+			if derpMap, err := loadDERPMap(opts.DERPMapPath); err != nil {
+				logf("SIGHUP: DERP map not reloaded: %v\n", err)
+			} else {
+				b.SetDERPMapOverride(derpMap)
+			}
+		}
+		b.Reload()
+	}
+}
+
 func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
 
 	executable, err := os.Executable()
@@ -0,0 +1,49 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"tailscale.com/ipn"
+)
+
+// Unattended ("server mode") operation, for Prefs.ForceDaemon.
+//
+// When the last frontend disconnects from a server that doesn't
+// survive disconnects, prefs with ForceDaemon set keep the backend
+// running, and the state key it runs on is recorded in the store
+// under serverModeKey, so that the next Run starts it again without
+// waiting for a frontend.
+const (
+	serverModeKey = ipn.StateKey("server-mode-start-key")
+	// serverModeStateKey holds a copy of frontend-owned prefs, which
+	// the backend otherwise has nowhere to restart from.
+	serverModeStateKey = ipn.StateKey("_server-mode")
+)
+
+// saveServerMode records in store whether the backend, now running
+// prefs on state key, should carry on unattended, and reports
+// whether it should.
+func saveServerMode(store ipn.StateStore, prefs *ipn.Prefs, key ipn.StateKey) (bool, error) {
+	if prefs == nil || !prefs.ForceDaemon {
+		return false, store.WriteState(serverModeKey, nil)
+	}
+	if key == "" {
+		key = serverModeStateKey
+		if err := store.WriteState(key, prefs.ToBytes()); err != nil {
+			return true, err
+		}
+	}
+	return true, store.WriteState(serverModeKey, []byte(key))
+}
+
+// serverModeStart returns the state key that saveServerMode recorded
+// for store, or the empty string if there's none.
+func serverModeStart(store ipn.StateStore) ipn.StateKey {
+	bs, err := store.ReadState(serverModeKey)
+	if err != nil {
+		return ""
+	}
+	return ipn.StateKey(bs)
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestServerMode(t *testing.T) {
+	store := &ipn.MemoryStore{}
+	if key := serverModeStart(store); key != "" {
+		t.Fatalf("empty store: start key %q, want none", key)
+	}
+
+	prefs := ipn.NewPrefs()
+	prefs.ForceDaemon = true
+	if ok, err := saveServerMode(store, prefs, "user-1"); !ok || err != nil {
+		t.Fatalf("saveServerMode = %v, %v; want true, nil", ok, err)
+	}
+	if key := serverModeStart(store); key != "user-1" {
+		t.Errorf("start key %q, want %q", key, "user-1")
+	}
+
+	// Frontend-owned prefs get a copy in the store to start from.
+	prefs.Hostname = "server"
+	if ok, err := saveServerMode(store, prefs, ""); !ok || err != nil {
+		t.Fatalf("saveServerMode = %v, %v; want true, nil", ok, err)
+	}
+	key := serverModeStart(store)
+	if key != serverModeStateKey {
+		t.Fatalf("start key %q, want %q", key, serverModeStateKey)
+	}
+	bs, err := store.ReadState(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ipn.PrefsFromBytes(bs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Equals(prefs) {
+		t.Errorf("saved prefs %v, want %v", saved.Pretty(), prefs.Pretty())
+	}
+
+	prefs.ForceDaemon = false
+	if ok, err := saveServerMode(store, prefs, "user-1"); ok || err != nil {
+		t.Fatalf("saveServerMode = %v, %v; want false, nil", ok, err)
+	}
+	if key := serverModeStart(store); key != "" {
+		t.Errorf("after ForceDaemon off: start key %q, want none", key)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/safesocket"
+	"tailscale.com/types/logger"
+)
+
+// The web UI is a small page for managing the node from a browser,
+// for NAS and appliance installs where using the CLI is awkward. It
+// shows the node's status and peers, and lets the user log in,
+// connect or disconnect, accept subnet routes and pick an exit node.
+//
+// It may be used from the machine itself, with the access the
+// LocalAPI would give the same local user, or over the tunnel by the
+// node's own user. Its forms carry a per-process token, so that
+// other web pages can't submit them, and it only answers requests for
+// localhost or an IP address, so that a page can't rebind its own
+// name to the UI's address to read the token.
+
+// authURLWait is how long the login button waits for the control
+// server to hand out a login URL to redirect to.
+const authURLWait = 5 * time.Second
+
+var webTemplate = template.Must(template.New("web").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Tailscale</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 0.2em 0.5em; border-bottom: 1px solid #ddd; }
+.problem { color: #a00; }
+</style></head><body>
+<h1>{{with .St.Self.HostName}}{{.}}{{else}}Tailscale{{end}}</h1>
+<p>State: <b>{{.St.BackendState}}</b>{{range .St.TailAddrs}} &middot; {{.}}{{end}}</p>
+{{range .St.Health}}<p class="problem">{{.}}</p>{{end}}
+{{if .NeedsLogin}}
+<form method="POST" action="/login"><input type="hidden" name="token" value="{{.Token}}">
+{{if .AuthURL}}<p><a href="{{.AuthURL}}">Finish logging in</a></p>{{end}}
+<button>Log in</button></form>
+{{end}}
+{{with .Prefs}}
+<form method="POST" action="/prefs"><input type="hidden" name="token" value="{{$.Token}}">
+<p><label><input type="checkbox" name="want_running" {{if .WantRunning}}checked{{end}}> Connected</label></p>
+<p><label><input type="checkbox" name="route_all" {{if .RouteAll}}checked{{end}}> Use subnet routes from other nodes</label></p>
+<p>Exit node: <select name="exit_node">
+<option value="">None</option>
+{{range $.ExitNodes}}<option value="{{.IP}}" {{if .Selected}}selected{{end}}>{{.Name}} ({{.IP}})</option>{{end}}
+</select></p>
+<button>Save</button></form>
+{{end}}
+<h2>Peers</h2>
+<table><tr><th>Name</th><th>IP</th><th>OS</th><th>Online</th></tr>
+{{range .Peers}}<tr><td>{{.HostName}}</td><td>{{range .TailAddrs}}{{.}} {{end}}</td><td>{{.OS}}</td><td>{{if .Online}}yes{{else}}no{{end}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+// webExitNode is a choice in the web UI's exit node menu.
+type webExitNode struct {
+	Name     string
+	IP       string
+	Selected bool
+}
+
+// WebConnContext is the ConnContext of the web UI's http.Server. It
+// identifies the local user on the other end of c, for the same
+// access checks as the LocalAPI's.
+func WebConnContext(ctx context.Context, c net.Conn) context.Context {
+	return withPeer(ctx, connPeer(c))
+}
+
+// webHostAllowed reports whether r was sent to a name that can't have
+// been rebound to the web UI's address by another site: localhost,
+// or an IP address.
+func webHostAllowed(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return host == "localhost" || net.ParseIP(host) != nil
+}
+
+// webAccess returns what the client of r may do with the web UI, of
+// the backend b whose process has credentials self: from a loopback
+// address, what accessOf gives its user; over the tunnel, from the
+// node's own user, change prefs. Other clients aren't allowed at all.
+func webAccess(b *ipn.LocalBackend, self *safesocket.Creds, r *http.Request) (access, error) {
+	if !webHostAllowed(r) {
+		return 0, errors.New("the web UI only answers to localhost or an IP address")
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return 0, err
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return accessOf(b, self, ctxPeer(r.Context())), nil
+	}
+	if peerAllowed(b, r) {
+		return accessOperator, nil
+	}
+	return 0, errors.New("not allowed")
+}
+
+// registerWebHandlers adds the web UI for b, whose process has
+// credentials self, to mux.
+func registerWebHandlers(mux *http.ServeMux, b *ipn.LocalBackend, self *safesocket.Creds, logf logger.Logf) {
+	var tok [16]byte
+	if _, err := rand.Read(tok[:]); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(tok[:])
+
+	// check fails the request unless it's allowed: GETs for any
+	// allowed client, and POSTs for those who may change prefs, if
+	// they carry the token.
+	check := func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("X-Frame-Options", "DENY")
+		a, err := webAccess(b, self, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return false
+		}
+		if r.Method == "GET" {
+			return true
+		}
+		if r.Method != "POST" {
+			http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+			return false
+		}
+		if a < accessOperator {
+			http.Error(w, deniedError(operatorOf(b), ctxPeer(r.Context()), accessOperator).Error(), http.StatusForbidden)
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(r.FormValue("token")), []byte(token)) != 1 {
+			http.Error(w, "invalid form token; reload the page", http.StatusForbidden)
+			return false
+		}
+		if b.Prefs() == nil {
+			http.Error(w, errNotStarted.Error(), http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	}
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if !check(w, r) {
+			return
+		}
+		st := b.Status()
+		a, _ := webAccess(b, self, r)
+		data := struct {
+			St         *ipnstate.Status
+			Prefs      *ipn.Prefs
+			Peers      []*ipnstate.PeerStatus
+			ExitNodes  []webExitNode
+			NeedsLogin bool
+			AuthURL    string
+			Token      string
+		}{
+			St:         st,
+			Peers:      st.Peers(),
+			NeedsLogin: st.BackendState == ipn.NeedsLogin.String() && a >= accessOperator,
+			AuthURL:    b.AuthURL(),
+			Token:      token,
+		}
+		if a >= accessOperator {
+			// Only those who may change them get the forms.
+			data.Prefs = b.Prefs()
+		}
+		for _, ps := range data.Peers {
+			if ps.ExitNodeOption && len(ps.TailAddrs) > 0 {
+				data.ExitNodes = append(data.ExitNodes, webExitNode{
+					Name:     ps.HostName,
+					IP:       ps.TailAddrs[0],
+					Selected: ps.ExitNode,
+				})
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := webTemplate.Execute(w, data); err != nil {
+			logf("web: %v\n", err)
+		}
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if !check(w, r) {
+			return
+		}
+		b.StartLoginInteractive()
+		// Send the browser straight to the login page, once the
+		// control server has said where it is.
+		for deadline := time.Now().Add(authURLWait); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			if u := b.AuthURL(); u != "" {
+				http.Redirect(w, r, u, http.StatusSeeOther)
+				return
+			}
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/prefs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if !check(w, r) {
+			return
+		}
+		prefs := b.Prefs().Copy()
+		prefs.WantRunning = r.FormValue("want_running") != ""
+		prefs.RouteAll = r.FormValue("route_all") != ""
+		if exit := r.FormValue("exit_node"); exit != prefs.ExitNodeIP || prefs.ExitNodeID != 0 {
+			if exit != "" && net.ParseIP(exit) == nil {
+				http.Error(w, "invalid exit node", http.StatusBadRequest)
+				return
+			}
+			prefs.ExitNodeID = 0
+			prefs.ExitNodeIP = exit
+		}
+		b.SetPrefs(prefs)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebHostAllowed(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"localhost:8088", true},
+		{"127.0.0.1:8088", true},
+		{"[::1]:8088", true},
+		{"100.101.102.103:8088", true},
+		{"localhost", true},
+		{"evil.example.com:8088", false},
+		{"localhost.evil.example.com:8088", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = tt.host
+		if got := webHostAllowed(r); got != tt.want {
+			t.Errorf("webHostAllowed(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
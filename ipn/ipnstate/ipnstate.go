@@ -0,0 +1,195 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ipnstate captures the entire state of the Tailscale network.
+//
+// It is a leaf package, so that ipn and its frontends can share it.
+package ipnstate
+
+import (
+	"sort"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// Status represents the entire state of the IPN network.
+type Status struct {
+	BackendState string   // ipn.State, as a string
+	TailAddrs    []string // Tailscale IP addresses assigned to this node
+	DERPHome     string   // hostname of the DERP server we're reachable through
+	NATType      string   // "none", "easy", "hard" or "unknown"
+	Paused       bool     // network activity is paused, see ipn.Backend.SetPaused
+
+	// NetInfo is the result of the engine's latest network check,
+	// or nil if it hasn't finished one.
+	NetInfo *tailcfg.NetInfo `json:",omitempty"`
+
+	// KeyExpiresIn is the time left until Self.KeyExpiry, negative
+	// once it has passed. It's zero if the key doesn't expire.
+	KeyExpiresIn time.Duration
+
+	// Health lists the node's current problems, such as being
+	// unable to reach the control server. It's empty when all is
+	// well.
+	Health []string
+
+	// Update is the result of the latest check for a newer release,
+	// if the prefs ask for them, or nil if there's none yet.
+	Update *UpdateInfo `json:",omitempty"`
+
+	Self PeerStatus
+	Peer map[tailcfg.NodeKey]*PeerStatus
+	User map[tailcfg.UserID]tailcfg.UserProfile
+}
+
+// Peers returns the peers in s, sorted by host name and then by key.
+func (s *Status) Peers() []*PeerStatus {
+	ret := make([]*PeerStatus, 0, len(s.Peer))
+	for _, ps := range s.Peer {
+		ret = append(ret, ps)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].HostName != ret[j].HostName {
+			return ret[i].HostName < ret[j].HostName
+		}
+		return ret[i].PublicKey.String() < ret[j].PublicKey.String()
+	})
+	return ret
+}
+
+// PeerStatus describes this node or one of its peers.
+type PeerStatus struct {
+	// ID is control's ID for the node, which unlike PublicKey
+	// stays the same when the node's key is rotated. It's zero for
+	// Self.
+	ID        tailcfg.NodeID `json:",omitempty"`
+	PublicKey tailcfg.NodeKey
+	HostName  string // host's own name, from its Hostinfo
+	DNSName   string // name assigned by control
+	OS        string
+	Nickname  string // local name given in the prefs, if any
+	UserID    tailcfg.UserID
+	TailAddrs []string // Tailscale IP addresses
+	Tags      []string // ACL tags granted by control, e.g. "tag:server"
+	KeyExpiry time.Time
+
+	// Endpoints are the "ip:port" addresses the node advertised,
+	// public and local.
+	Endpoints []string
+
+	// CurAddr is the "ip:port" we currently send the peer's
+	// packets to, empty if no path has been established. If the
+	// path goes through a DERP server, Relay is its hostname, and
+	// CurAddr is a fake address for it.
+	CurAddr string
+	Relay   string
+
+	RxBytes       int64
+	TxBytes       int64
+	LastHandshake time.Time // zero if never
+	LastSeen      time.Time // when control last saw the peer connected; zero if unknown
+
+	// Online reports whether the peer is reachable: either the
+	// WireGuard tunnel to it is up, meaning a handshake completed
+	// recently, or the control server reports it connected.
+	Online bool
+
+	// ExitNode reports whether this node's Internet traffic is
+	// routed through the peer.
+	ExitNode bool
+	// ExitNodeOption reports whether the peer offers to be an exit
+	// node, by advertising a default route.
+	ExitNodeOption bool
+}
+
+// WhoIsResponse is the node and user owning a Tailscale IP, as
+// returned by LocalBackend.WhoIs.
+type WhoIsResponse struct {
+	Node        *tailcfg.Node
+	UserProfile *tailcfg.UserProfile // nil if the network map lacks the profile
+}
+
+// PingResult is the answer to a ping of a peer, see
+// ipn.LocalBackend.Ping.
+type PingResult struct {
+	IP       string // the peer's first Tailscale IP
+	HostName string
+	Type     string `json:",omitempty"` // the ipn.PingType; empty means "disco"
+	Latency  time.Duration
+	// Endpoint is the peer's "ip:port" that the reply came from,
+	// or empty if it came through DERP; then DERP is the relay's
+	// hostname. They're only set for disco pings, which answer
+	// beneath WireGuard.
+	Endpoint string
+	DERP     string
+	// SeenAs and Verdicts are set for TSMP pings, from the peer's
+	// PeerPingReply.
+	SeenAs   string            `json:",omitempty"`
+	Verdicts map[string]string `json:",omitempty"`
+	// Err is why the ping failed, such as a timeout. The fields
+	// above other than IP and Type are then unset.
+	Err string `json:",omitempty"`
+}
+
+// PeerPingReply is a node's answer to a TSMP ping from a peer, sent
+// over the tunnel to its peer API.
+type PeerPingReply struct {
+	HostName string // of the answering node
+	// SeenAs is the name of the node that the pinging peer's
+	// Tailscale IP belongs to, in the answering node's network map.
+	SeenAs string
+	// Verdicts is what the answering node's packet filter does with
+	// new connections from the pinging peer, keyed by "icmp" and
+	// "tcp/port" or "udp/port" for the ports asked about: "accept"
+	// or "drop".
+	Verdicts map[string]string
+}
+
+// VersionInfo identifies a build of tailscale or tailscaled.
+type VersionInfo struct {
+	Version         string // release version, version.LONG
+	ProtocolVersion int    // ipn.ProtocolVersion of the frontend/backend protocol
+	OS              string // runtime.GOOS
+	Arch            string // runtime.GOARCH
+}
+
+// UpdateInfo is the result of checking for a newer release, see
+// package updates.
+type UpdateInfo struct {
+	Current   string // the running version
+	Latest    string // the newest release on Track
+	Track     string // release track, "stable" or "unstable"
+	Available bool   // Latest is newer than Current
+	CheckedAt time.Time
+}
+
+// PeerAPIPort is the TCP port on which tailscaled serves the peer
+// API, such as file transfers, on its Tailscale IPs. The packet
+// filter always lets connections to it in; the API checks who's
+// asking itself.
+const PeerAPIPort = 41642
+
+// PeerAPIPingPath is the peer API path that answers TSMP pings with a
+// PeerPingReply.
+const PeerAPIPingPath = "/v0/ping"
+
+// WaitingFile is a file received from a peer, waiting in tailscaled's
+// inbox for "tailscale file get".
+type WaitingFile struct {
+	Name string
+	Size int64
+}
+
+// FileOffset is how much of a file a peer has received so far, for
+// the sender to resume from.
+type FileOffset struct {
+	Offset int64
+}
+
+// Direct reports whether packets to ps go directly to one of its
+// endpoints, rather than through a DERP relay.
+func (ps *PeerStatus) Direct() bool {
+	return ps.CurAddr != "" && ps.Relay == ""
+}
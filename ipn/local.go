@@ -5,22 +5,29 @@
 package ipn
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/portlist"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/empty"
 	"tailscale.com/types/logger"
+	"tailscale.com/updates"
 	"tailscale.com/version"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/magicsock"
+	"tailscale.com/wgengine/tsdns"
 )
 
 // LocalBackend is the scaffolding between the Tailscale cloud control
@@ -36,19 +43,51 @@ type LocalBackend struct {
 	portpoll        *portlist.Poller // may be nil
 	newDecompressor func() (controlclient.Decompressor, error)
 	cmpDiff         func(x, y interface{}) string
+	enableIPForward bool             // turn on kernel IP forwarding if routes are advertised
+	alwaysEphemeral bool             // Start as ephemeral whatever the options say
+	ephemeral       bool             // set by Start; don't save node keys
+	startOpts       Options          // most recent Start options, for profile switches
+	derpMapOverride *tailcfg.DERPMap // replaces control's DERP map, if non-nil
+	machineKeyStore string           // controlclient.KeyStore for new machine keys, if any
+	timeNow         func() time.Time // time.Now, or a fake clock in tests
+	updateCheck     func(ctx context.Context, current, track string) (*ipnstate.UpdateInfo, error)
+	watchdog        *livenessWatchdog
+	unwatchHealth   func()
 
 	// The mutex protects the following elements.
 	mu           sync.Mutex
 	stateKey     StateKey
 	prefs        *Prefs
 	state        State
+	stateLog     stateLog // recent state changes, for debugging
 	hiCache      tailcfg.Hostinfo
+	services     []tailcfg.Service // from portpoll, before filtering by prefs
 	netMapCache  *controlclient.NetworkMap
 	engineStatus EngineStatus
 	endPoints    []string
 	blocked      bool
 	authURL      string
 	interact     int
+	loggedOut    bool           // Logout was called, and no login has finished since
+	expiryTimer  *time.Timer    // wakes up checkKeyExpiry; nil if none pending
+	expiryWarned time.Time      // key expiry we've already warned about
+	lastNetcheck time.Time      // when Netcheck last started a check
+	filt         *filter.Filter // the packet filter last given to the engine
+	updateTimer  *time.Timer    // wakes up periodicUpdateCheck; nil if checks are off
+	updateInfo   *ipnstate.UpdateInfo
+	updateChecks map[string]updateCheck // latest CheckUpdate by track
+
+	peerOnline map[tailcfg.NodeKey]string // online peers' host names, as last notified
+	peerTimer  *time.Timer                // refreshes engine status when a peer times out
+
+	engineErrs    int    // engine status errors, for health reports
+	lastEngineErr string // the most recent of those
+	engineCB      bool   // Start has set the engine's status callback
+
+	derpMap *tailcfg.DERPMap // last DERP map given to the engine
+	paused  bool             // SetPaused(true) is in effect
+
+	warned map[ErrCode]string // last warning sent for each code; see warn
 
 	// statusLock must be held before calling statusChanged.Lock() or
 	// statusChanged.Broadcast().
@@ -78,8 +117,16 @@ func NewLocalBackend(logf logger.Logf, logid string, store StateStore, e wgengin
 		backendLogID: logid,
 		state:        NoState,
 		portpoll:     portpoll,
+		timeNow:      time.Now,
+		updateCheck:  updates.Check,
 	}
 	b.statusChanged = sync.NewCond(&b.statusLock)
+	b.watchdog = newLivenessWatchdog(logf,
+		livenessProbe{"control client", b.checkControlLiveness, b.restartControl},
+		livenessProbe{"engine", b.probeEngine, b.restartEngine},
+	)
+	go b.watchdog.run()
+	b.unwatchHealth = health.RegisterWatcher(b.healthChanged)
 
 	if b.portpoll != nil {
 		go b.portpoll.Run()
@@ -89,13 +136,159 @@ func NewLocalBackend(logf logger.Logf, logid string, store StateStore, e wgengin
 	return &b, nil
 }
 
+// Shutdown stops the backend for good, in order: it disconnects from
+// the control server, closes the engine, which disconnects from peers
+// and DERP and removes the routes and DNS settings it added, and
+// finally writes the state out one last time.
 func (b *LocalBackend) Shutdown() {
+	b.watchdog.close()
+	b.unwatchHealth()
+	b.mu.Lock()
+	if b.expiryTimer != nil {
+		b.expiryTimer.Stop()
+		b.expiryTimer = nil
+	}
+	if b.peerTimer != nil {
+		b.peerTimer.Stop()
+		b.peerTimer = nil
+	}
+	if b.updateTimer != nil {
+		b.updateTimer.Stop()
+		b.updateTimer = nil
+	}
+	cli := b.c
+	b.mu.Unlock()
 	if b.portpoll != nil {
 		b.portpoll.Close()
 	}
-	b.c.Shutdown()
+	if cli != nil {
+		cli.Shutdown()
+	}
 	b.e.Close()
 	b.e.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stateKey != "" && b.prefs != nil {
+		if err := b.store.WriteState(b.stateKey, b.prefsToStore()); err != nil {
+			b.logf("Shutdown: saving state: %v\n", err)
+		}
+	}
+}
+
+// checkControlLiveness returns once the control client's locks are
+// free. It reports false, at once, if there's no client yet.
+func (b *LocalBackend) checkControlLiveness() bool {
+	b.mu.Lock()
+	cli := b.c
+	b.mu.Unlock()
+	if cli == nil {
+		return false
+	}
+	cli.CheckLiveness()
+	return true
+}
+
+// probeEngine returns once the engine has delivered a status update
+// it was asked for. Before Start sets the status callback, there's
+// none to wait for, and it reports false at once.
+func (b *LocalBackend) probeEngine() bool {
+	b.mu.Lock()
+	started := b.engineCB
+	b.mu.Unlock()
+	if !started {
+		return false
+	}
+	b.requestEngineStatusAndWait()
+	return true
+}
+
+// restartControl replaces a stalled control client with a new one,
+// as if a frontend had reconnected with the current prefs.
+func (b *LocalBackend) restartControl() {
+	b.mu.Lock()
+	old := b.c
+	opts := b.startOpts
+	opts.StateKey = b.stateKey
+	opts.Prefs = nil
+	if opts.StateKey == "" {
+		opts.Prefs = b.prefs.Copy()
+	}
+	opts.LegacyConfigPath = ""
+	opts.AuthKey = ""
+	b.mu.Unlock()
+	if old == nil {
+		return
+	}
+
+	// The old client stays in place until the new one replaces it,
+	// and its Shutdown, which waits for its goroutines, might never
+	// finish.
+	if err := b.start(opts, true); err != nil {
+		b.opErr("restartControl", err)
+	}
+}
+
+// Reload re-applies the current prefs, re-evaluating the exit node,
+// routes and filters against the network map, and has the control
+// client re-read its settings, such as the pinned TLS keys and proxy,
+// and fetch a full network map. It happens in place: the network map
+// and packet filter in use stay until the new map replaces them, and
+// the engine and its tunnels stay up throughout.
+func (b *LocalBackend) Reload() {
+	prefs := b.Prefs()
+	if prefs == nil {
+		// Not started yet, there's nothing to reload.
+		return
+	}
+	b.logf("Reload\n")
+	b.SetPrefs(prefs.Copy())
+	b.mu.Lock()
+	cli := b.c
+	b.mu.Unlock()
+	if cli == nil {
+		return
+	}
+	if err := cli.Reload(prefs.ControlProxy, prefs.ControlPins); err != nil {
+		// The client carries on with its old settings.
+		b.opErr("Reload", err)
+	}
+}
+
+// SetDefaultPrefs sets the prefs that state created from now on, such
+// as a new profile's, starts with, in place of those Start was given.
+// If the current state hasn't been saved yet, the backend switches to
+// them too; saved prefs are left alone.
+func (b *LocalBackend) SetDefaultPrefs(p *Prefs) {
+	b.mu.Lock()
+	b.startOpts.DefaultPrefs = p
+	key := b.stateKey
+	unsaved := false
+	if key != "" && b.prefs != nil {
+		_, err := b.store.ReadState(key)
+		unsaved = err == ErrStateNotExist
+	}
+	b.mu.Unlock()
+	if unsaved && p != nil {
+		b.logf("SetDefaultPrefs: no saved state for %q, using the new defaults\n", key)
+		b.SetPrefs(p.Copy())
+	}
+}
+
+// restartEngine restarts a stalled engine's WireGuard device, DERP
+// connections and endpoint discovery. If the engine is deadlocked
+// past that, this blocks, and the engine's own watchdog, if any,
+// kills the process.
+func (b *LocalBackend) restartEngine() {
+	b.mu.Lock()
+	paused := b.paused
+	b.mu.Unlock()
+	if paused {
+		// Resume would undo SetPaused.
+		return
+	}
+	b.e.Pause()
+	b.e.Resume()
 }
 
 // SetDecompressor sets a decompression function, which must be a zstd
@@ -119,12 +312,62 @@ func (b *LocalBackend) SetCmpDiff(cmpDiff func(x, y interface{}) string) {
 	b.cmpDiff = cmpDiff
 }
 
+// SetEnableIPForwarding controls whether the backend turns on the
+// operating system's IP forwarding when the prefs advertise subnet
+// routes and forwarding is found to be disabled. If false, the
+// backend only reports the problem.
+func (b *LocalBackend) SetEnableIPForwarding(enable bool) {
+	b.enableIPForward = enable
+}
+
+// SetAlwaysEphemeral makes every Start register the node as
+// ephemeral, as if Options.Ephemeral were set, for daemons whose
+// state only lives in memory: their keys can't outlive the process,
+// so neither should the node. It must be called before Start.
+func (b *LocalBackend) SetAlwaysEphemeral(on bool) {
+	b.alwaysEphemeral = on
+}
+
+// SetLiveCallback sets a function that the liveness watchdog calls
+// each time it finds every subsystem responding, about once a
+// minute. It isn't called while a subsystem is stalled, or before
+// Start has brought them all up, so a supervisor can restart the
+// process if the calls stop.
+func (b *LocalBackend) SetLiveCallback(cb func()) {
+	b.watchdog.setOnAlive(cb)
+}
+
+// SetDERPMapOverride sets a DERP map to use instead of the one from
+// the control server, for nodes using their own DERP servers. After
+// Start, it takes effect with the next network map.
+func (b *LocalBackend) SetDERPMapOverride(dm *tailcfg.DERPMap) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.derpMapOverride = dm
+}
+
+// SetMachineKeyStore sets the registered controlclient.KeyStore that
+// new machine keys are generated in. Existing keys stay where they
+// are. It must be called before Start.
+func (b *LocalBackend) SetMachineKeyStore(name string) {
+	b.machineKeyStore = name
+}
+
 func (b *LocalBackend) Start(opts Options) error {
+	return b.start(opts, false)
+}
+
+// start is Start. With asyncShutdown, it shuts the current control
+// client down on another goroutine, as a stalled one may never finish.
+func (b *LocalBackend) start(opts Options, asyncShutdown bool) error {
 	if opts.Prefs == nil && opts.StateKey == "" {
 		return errors.New("no state key or prefs provided")
 	}
 
-	if b.c != nil {
+	b.mu.Lock()
+	old := b.c
+	b.mu.Unlock()
+	if old != nil {
 		// TODO(apenwarr): avoid the need to reinit controlclient.
 		// This will trigger a full relogin/reconfigure cycle every
 		// time a Handle reconnects to the backend. Ideally, we
@@ -132,7 +375,11 @@ func (b *LocalBackend) Start(opts Options) error {
 		// into sync with the minimal changes. But that's not how it
 		// is right now, which is a sign that the code is still too
 		// complicated.
-		b.c.Shutdown()
+		if asyncShutdown {
+			go old.Shutdown()
+		} else {
+			old.Shutdown()
+		}
 	}
 
 	if opts.Prefs != nil {
@@ -141,28 +388,60 @@ func (b *LocalBackend) Start(opts Options) error {
 		b.logf("Start\n")
 	}
 
+	if b.alwaysEphemeral {
+		opts.Ephemeral = true
+	}
+
 	hi := controlclient.NewHostinfo()
 	hi.BackendLogID = b.backendLogID
 	hi.FrontendLogID = opts.FrontendLogID
 
 	b.mu.Lock()
-	hi.Services = b.hiCache.Services // keep any previous session
 	b.hiCache = hi
 	b.state = NoState
 
-	if err := b.loadStateWithLock(opts.StateKey, opts.Prefs, opts.LegacyConfigPath); err != nil {
+	// An ephemeral node keeps its keys in memory only, across
+	// reconnecting frontends but not across restarts.
+	var ephemeralPersist *controlclient.Persist
+	if opts.Ephemeral && b.ephemeral && b.prefs != nil {
+		ephemeralPersist = b.prefs.Persist
+	}
+
+	if err := b.loadStateWithLock(opts.StateKey, opts.Prefs, opts.DefaultPrefs, opts.LegacyConfigPath); err != nil {
 		b.mu.Unlock()
 		return fmt.Errorf("loading requested state: %v", err)
 	}
 
+	b.startOpts = opts
+	b.ephemeral = opts.Ephemeral
+	if b.ephemeral {
+		if ephemeralPersist == nil && b.prefs.Persist != nil {
+			b.logf("Start: ephemeral node, discarding saved keys\n")
+		}
+		b.prefs.Persist = ephemeralPersist
+	}
+
 	b.serverURL = b.prefs.ControlURL
 	hi.RoutableIPs = append(hi.RoutableIPs, b.prefs.AdvertiseRoutes...)
+	hi.RequestTags = append(hi.RequestTags, b.prefs.AdvertiseTags...)
+	if b.prefs.Hostname != "" {
+		hi.Hostname = b.prefs.Hostname
+	}
+	hi.Services = filterServices(b.services, b.prefs)
+	b.hiCache = hi
 
 	b.notify = opts.Notify
 	b.netMapCache = nil
+	logoutPending := b.prefs.Persist != nil && b.prefs.Persist.LogoutPending
+	if logoutPending {
+		b.loggedOut = true
+	}
+	prefs := b.prefs
 	b.mu.Unlock()
 
+	b.checkIPForwarding(prefs)
 	b.updateFilter()
+	b.scheduleUpdateChecks()
 
 	var err error
 	persist := b.prefs.Persist
@@ -170,15 +449,20 @@ func (b *LocalBackend) Start(opts Options) error {
 		// let controlclient initialize it
 		persist = &controlclient.Persist{}
 	}
-	cli, err := controlclient.New(controlclient.Options{
+	cli, err := controlclient.NewNoStart(controlclient.Options{
 		Logf: func(fmt string, args ...interface{}) {
 			b.logf("control: "+fmt, args...)
 		},
 		Persist:         *persist,
 		ServerURL:       b.serverURL,
+		ProxyURL:        b.prefs.ControlProxy,
+		ControlPins:     b.prefs.ControlPins,
 		Hostinfo:        &hi,
 		KeepAlive:       true,
 		NewDecompressor: b.newDecompressor,
+		AuthKey:         opts.AuthKey,
+		Ephemeral:       opts.Ephemeral,
+		KeyStore:        b.machineKeyStore,
 	})
 	if err != nil {
 		return err
@@ -186,7 +470,10 @@ func (b *LocalBackend) Start(opts Options) error {
 
 	b.mu.Lock()
 	b.c = cli
+	paused := b.paused
 	b.mu.Unlock()
+	cli.SetPaused(paused)
+	cli.Start()
 
 	if b.endPoints != nil {
 		cli.UpdateEndpoints(0, b.endPoints)
@@ -194,6 +481,9 @@ func (b *LocalBackend) Start(opts Options) error {
 
 	cli.SetStatusFunc(func(new controlclient.Status) {
 		if new.LoginFinished != nil {
+			b.mu.Lock()
+			b.loggedOut = false
+			b.mu.Unlock()
 			// Auth completed, unblock the engine
 			b.blockEngineUpdates(false)
 			b.authReconfig()
@@ -203,7 +493,7 @@ func (b *LocalBackend) Start(opts Options) error {
 			persist := *new.Persist // copy
 			b.prefs.Persist = &persist
 			if b.stateKey != "" {
-				if err := b.store.WriteState(b.stateKey, b.prefs.ToBytes()); err != nil {
+				if err := b.store.WriteState(b.stateKey, b.prefsToStore()); err != nil {
 					b.logf("Failed to save new controlclient state: %v", err)
 				}
 			}
@@ -216,8 +506,11 @@ func (b *LocalBackend) Start(opts Options) error {
 				b.logf("netmap diff:\n%v\n", b.cmpDiff(s1, s2))
 			}
 			b.netMapCache = new.NetMap
-			b.send(Notify{NetMap: new.NetMap})
+			b.send(Notify{NetMap: scopePeers(new.NetMap, b.Prefs())})
 			b.updateFilter()
+			b.updateDERPMap(new.NetMap)
+			b.checkKeyExpiry()
+			b.checkPeerChanges()
 		}
 		if new.URL != "" {
 			b.logf("Received auth URL: %.20v...\n", new.URL)
@@ -248,6 +541,10 @@ func (b *LocalBackend) Start(opts Options) error {
 	b.e.SetStatusCallback(func(s *wgengine.Status, err error) {
 		if err != nil {
 			b.logf("wgengine status error: %#v", err)
+			b.mu.Lock()
+			b.engineErrs++
+			b.lastEngineErr = err.Error()
+			b.mu.Unlock()
 			return
 		}
 		if s == nil {
@@ -256,12 +553,12 @@ func (b *LocalBackend) Start(opts Options) error {
 
 		b.mu.Lock()
 		es := b.parseWgStatus(s)
-		b.mu.Unlock()
-
 		b.engineStatus = es
+		b.mu.Unlock()
 
 		if b.c != nil {
 			b.c.UpdateEndpoints(0, s.LocalAddrs)
+			b.c.SetNetInfo(s.NetInfo)
 		}
 		b.endPoints = append([]string{}, s.LocalAddrs...)
 		b.stateMachine()
@@ -271,27 +568,77 @@ func (b *LocalBackend) Start(opts Options) error {
 		b.statusLock.Unlock()
 
 		b.send(Notify{Engine: &es})
+		b.checkPeerChanges()
+		b.sendHealthReport()
 	})
+	b.mu.Lock()
+	b.engineCB = true
+	b.mu.Unlock()
 
 	blid := b.backendLogID
 	b.logf("Backend: logs: be:%v fe:%v\n", blid, opts.FrontendLogID)
 	b.send(Notify{BackendLogID: &blid})
 	b.send(Notify{Prefs: b.prefs.Copy()})
 
-	cli.Login(nil, controlclient.LoginDefault)
+	if logoutPending {
+		b.logf("Start: finishing an interrupted logout\n")
+		cli.Logout()
+	} else {
+		cli.Login(nil, controlclient.LoginDefault)
+	}
 	return nil
 }
 
 func (b *LocalBackend) updateFilter() {
-	if !b.Prefs().UsePacketFilter {
-		b.e.SetFilter(filter.NewAllowAll())
+	var filt *filter.Filter
+	if b.Prefs().ShieldsUp {
+		// Block all new inbound connections. The filter still
+		// lets in TCP and UDP replies to outgoing traffic.
+		b.logf("shields up, blocking inbound connections\n")
+		filt = filter.NewAllowNone()
+	} else if !b.Prefs().UsePacketFilter {
+		filt = filter.NewAllowAll()
 	} else if b.netMapCache == nil {
 		// Not configured yet, block everything
-		b.e.SetFilter(filter.NewAllowNone())
+		filt = filter.NewAllowNone()
 	} else {
 		b.logf("netmap packet filter: %v\n", b.netMapCache.PacketFilter)
-		b.e.SetFilter(filter.New(b.netMapCache.PacketFilter))
+		filt = filter.New(b.netMapCache.PacketFilter)
+		// The peer API answers pings from nodes that may reach
+		// this one, and files only from the same user, so it
+		// needn't be in the netmap's filter too.
+		var local []filter.IP
+		for _, a := range b.netMapCache.Addresses {
+			if ip4 := a.IP.IP().To4(); ip4 != nil {
+				local = append(local, filter.NewIP(ip4))
+			}
+		}
+		filt.Exempt(local, ipnstate.PeerAPIPort)
 	}
+	b.mu.Lock()
+	b.filt = filt
+	b.mu.Unlock()
+	b.e.SetFilter(filt)
+}
+
+// updateDERPMap gives the engine the DERP map to use: the local
+// override if there is one, else the one in nm from control. The
+// engine keeps its built-in map until there's either.
+func (b *LocalBackend) updateDERPMap(nm *controlclient.NetworkMap) {
+	b.mu.Lock()
+	dm := b.derpMapOverride
+	if dm == nil {
+		dm = nm.DERPMap
+	}
+	if dm == nil || reflect.DeepEqual(dm, b.derpMap) {
+		b.mu.Unlock()
+		return
+	}
+	b.derpMap = dm
+	b.mu.Unlock()
+
+	b.logf("DERP map: %d regions\n", len(dm.Regions))
+	b.e.SetDERPMap(dm)
 }
 
 func (b *LocalBackend) runPoller() {
@@ -322,8 +669,9 @@ func (b *LocalBackend) runPoller() {
 		}
 
 		b.mu.Lock()
+		b.services = sl
 		hi := b.hiCache
-		hi.Services = sl
+		hi.Services = filterServices(sl, b.prefs)
 		b.hiCache = hi
 		cli := b.c
 		b.mu.Unlock()
@@ -353,12 +701,12 @@ func (b *LocalBackend) popBrowserAuthNow() {
 	b.blockEngineUpdates(true)
 	b.stopEngineAndWait()
 	b.send(Notify{BrowseToURL: &url})
-	if b.State() == Running {
-		b.enterState(Starting)
-	}
+	// Re-authenticating while running: the tunnel is down until the
+	// new key is in.
+	b.enterState(Running, Starting, "re-authenticating")
 }
 
-func (b *LocalBackend) loadStateWithLock(key StateKey, prefs *Prefs, legacyPath string) error {
+func (b *LocalBackend) loadStateWithLock(key StateKey, prefs, defaultPrefs *Prefs, legacyPath string) error {
 	if prefs == nil && key == "" {
 		panic("state key and prefs are both unset")
 	}
@@ -392,6 +740,9 @@ func (b *LocalBackend) loadStateWithLock(key StateKey, prefs *Prefs, legacyPath
 				} else {
 					b.logf("Imported state from relaynode for %q", key)
 				}
+			} else if defaultPrefs != nil {
+				b.prefs = defaultPrefs.Copy()
+				b.logf("Created state for %q from the default prefs", key)
 			} else {
 				b.prefs = NewPrefs()
 				b.logf("Created empty state for %q", key)
@@ -423,6 +774,14 @@ func (b *LocalBackend) EngineStatus() EngineStatus {
 	return b.engineStatus
 }
 
+// AuthURL returns the URL at which the user can finish logging in,
+// or "" if there's no login waiting for them.
+func (b *LocalBackend) AuthURL() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.authURL
+}
+
 func (b *LocalBackend) StartLoginInteractive() {
 	b.assertClient()
 	b.mu.Lock()
@@ -442,10 +801,294 @@ func (b *LocalBackend) FakeExpireAfter(x time.Duration) {
 	b.logf("FakeExpireAfter: %v\n", x)
 	if b.netMapCache != nil {
 		e := b.netMapCache.Expiry
-		if e.IsZero() || time.Until(e) > x {
-			b.netMapCache.Expiry = time.Now().Add(x)
+		now := b.timeNow()
+		if e.IsZero() || e.Sub(now) > x {
+			b.netMapCache.Expiry = now.Add(x)
 		}
 		b.send(Notify{NetMap: b.netMapCache})
+		b.checkKeyExpiry()
+	}
+}
+
+// keyExpiryWarning is how long before the node key expires that the
+// backend warns frontends about it, so that users can re-authenticate
+// before they get disconnected.
+const keyExpiryWarning = 24 * time.Hour
+
+// checkKeyExpiry warns frontends if the node key of the current
+// netmap is about to expire, and arranges to be called again when
+// the warning or the expiry itself is due. Once the key has expired,
+// the state machine moves to NeedsLogin.
+func (b *LocalBackend) checkKeyExpiry() {
+	b.mu.Lock()
+	if b.expiryTimer != nil {
+		b.expiryTimer.Stop()
+		b.expiryTimer = nil
+	}
+	var expiry time.Time
+	if b.netMapCache != nil {
+		expiry = b.netMapCache.Expiry
+	}
+	if expiry.IsZero() {
+		b.mu.Unlock()
+		return
+	}
+
+	left := expiry.Sub(b.timeNow())
+	warn := left <= keyExpiryWarning && !b.expiryWarned.Equal(expiry)
+	if warn {
+		b.expiryWarned = expiry
+	}
+	var wake time.Duration
+	switch {
+	case left > keyExpiryWarning:
+		wake = left - keyExpiryWarning
+	case left > 0:
+		wake = left
+	}
+	if wake > 0 {
+		b.expiryTimer = time.AfterFunc(wake, func() {
+			b.checkKeyExpiry()
+			b.stateMachine()
+		})
+	}
+	b.mu.Unlock()
+
+	if warn {
+		var msg string
+		if left > 0 {
+			msg = fmt.Sprintf("node key expires in %v, at %v", left.Round(time.Second), expiry)
+		} else {
+			msg = fmt.Sprintf("node key expired at %v", expiry)
+		}
+		b.logf("%s\n", msg)
+		n := errNotify(ErrAuthExpired, false, msg)
+		n.KeyExpiry = &expiry
+		b.send(n)
+	}
+}
+
+// warn tells the frontend about a problem to show the user, unless
+// the last warning with the same code said the same thing. An empty
+// msg means the problem went away, so that it's reported again if it
+// comes back.
+func (b *LocalBackend) warn(code ErrCode, msg string) {
+	b.mu.Lock()
+	if b.warned[code] == msg {
+		b.mu.Unlock()
+		return
+	}
+	if b.warned == nil {
+		b.warned = make(map[ErrCode]string)
+	}
+	b.warned[code] = msg
+	b.mu.Unlock()
+
+	if msg == "" {
+		return
+	}
+	b.logf("warning: %s\n", msg)
+	b.send(errNotify(code, false, msg))
+}
+
+// healthChanged is the health watcher that passes problems reaching
+// the control server on to the frontend.
+func (b *LocalBackend) healthChanged(sys health.Subsystem, err error) {
+	if sys != health.SysControl {
+		return
+	}
+	var msg string
+	if err != nil {
+		msg = err.Error()
+	}
+	b.warn(ErrControlUnreachable, msg)
+}
+
+func (b *LocalBackend) Debug(action DebugAction) {
+	b.logf("Debug: %v\n", action)
+	switch action {
+	case DebugRebind:
+		b.e.LinkChange(false)
+	case DebugReSTUN:
+		b.e.ReSTUN()
+	case DebugVerboseOn, DebugVerboseOff:
+		magicsock.SetVerboseLogging(action == DebugVerboseOn)
+	case DebugDump:
+		b.e.LogState()
+		b.mu.Lock()
+		nm := b.netMapCache
+		history := b.stateLog.String()
+		b.mu.Unlock()
+		b.logf("Debug: state changes:\n%s", history)
+		if nm == nil {
+			b.logf("Debug: no netmap\n")
+		} else {
+			b.logf("Debug: netmap:\n%s", nm.Concise())
+		}
+	default:
+		b.logf("Debug: unknown action %q\n", action)
+	}
+}
+
+// opErr reports a failed backend operation to the log and the
+// frontend.
+func (b *LocalBackend) opErr(op string, err error) {
+	msg := fmt.Sprintf("%s: %v", op, err)
+	b.logf("%s\n", msg)
+	b.send(errNotify(ErrOperationFailed, true, msg))
+}
+
+func (b *LocalBackend) ListProfiles() {
+	b.mu.Lock()
+	key := b.stateKey
+	b.mu.Unlock()
+	if key == "" {
+		b.opErr("ListProfiles", errors.New("frontend owns the state, no profiles"))
+		return
+	}
+	p, err := loadProfiles(b.store, key)
+	if err != nil {
+		b.opErr("ListProfiles", err)
+		return
+	}
+	b.send(Notify{Profiles: &p})
+}
+
+func (b *LocalBackend) SwitchProfile(name string) {
+	b.assertClient()
+	b.mu.Lock()
+	key := b.stateKey
+	opts := b.startOpts
+	var cur []byte
+	var err error
+	switch {
+	case key == "":
+		err = errors.New("frontend owns the state, no profiles")
+	case b.ephemeral:
+		err = errors.New("ephemeral nodes don't save keys, no profiles")
+	default:
+		cur = b.prefsToStore()
+	}
+	b.mu.Unlock()
+	if err != nil {
+		b.opErr("SwitchProfile", err)
+		return
+	}
+
+	next, p, err := switchProfile(b.store, key, cur, name)
+	if err != nil {
+		b.opErr("SwitchProfile", err)
+		return
+	}
+	b.send(Notify{Profiles: &p})
+	if len(next) == 0 {
+		b.logf("SwitchProfile: created profile %q\n", name)
+	} else {
+		b.logf("SwitchProfile: switched to profile %q\n", name)
+	}
+
+	// Restart with the new profile's keys, which are now stored
+	// under our state key. Saved keys let control log us back in
+	// without any interaction.
+	b.stopEngineAndWait()
+	opts.StateKey = key
+	opts.Prefs = nil
+	opts.LegacyConfigPath = ""
+	opts.AuthKey = ""
+	if err := b.Start(opts); err != nil {
+		b.opErr("SwitchProfile", err)
+	}
+}
+
+func (b *LocalBackend) DeleteProfile(name string) {
+	b.mu.Lock()
+	key := b.stateKey
+	b.mu.Unlock()
+	if key == "" {
+		b.opErr("DeleteProfile", errors.New("frontend owns the state, no profiles"))
+		return
+	}
+	p, err := deleteProfile(b.store, key, name)
+	if err != nil {
+		b.opErr("DeleteProfile", err)
+		return
+	}
+	b.logf("DeleteProfile: deleted profile %q\n", name)
+	b.send(Notify{Profiles: &p})
+}
+
+// RotateMachineKey generates a new machine key and moves this node to
+// it. The new key is saved as pending before the control server is
+// told about it, so that a crash or network failure part way through
+// resumes the rotation on the next login instead of losing the key
+// the server now expects.
+func (b *LocalBackend) RotateMachineKey() {
+	b.assertClient()
+	k, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		b.opErr("RotateMachineKey", err)
+		return
+	}
+
+	b.mu.Lock()
+	if b.prefs.Persist == nil {
+		b.mu.Unlock()
+		b.opErr("RotateMachineKey", errors.New("no machine key yet"))
+		return
+	}
+	if ks := b.prefs.Persist.MachineKeyStore; ks != "" {
+		b.mu.Unlock()
+		b.opErr("RotateMachineKey", fmt.Errorf("the machine key is in key store %q, which doesn't support rotation", ks))
+		return
+	}
+	old := *b.prefs.Persist
+	b.prefs.Persist.NewPrivateMachineKey = k
+	key := b.stateKey
+	bs := b.prefsToStore()
+	prefs := b.prefs.Copy()
+	b.mu.Unlock()
+
+	if key != "" {
+		if err := b.store.WriteState(key, bs); err != nil {
+			b.mu.Lock()
+			*b.prefs.Persist = old
+			b.mu.Unlock()
+			b.opErr("RotateMachineKey", fmt.Errorf("saving new key: %v", err))
+			return
+		}
+	}
+	b.send(Notify{Prefs: prefs})
+	pub := k.Public()
+	b.logf("RotateMachineKey: new key %v pending\n", pub.ShortString())
+	b.c.RotateMachineKey(k)
+}
+
+// SetPaused pauses or resumes the node's network activity. The
+// backend state, network map and engine configuration stay as they
+// are, so that a paused node shows as connected but is unreachable
+// until resumed. Pausing survives Start, which restarts the control
+// client.
+func (b *LocalBackend) SetPaused(paused bool) {
+	b.mu.Lock()
+	if b.paused == paused {
+		b.mu.Unlock()
+		return
+	}
+	b.paused = paused
+	cli := b.c
+	b.mu.Unlock()
+
+	b.logf("SetPaused(%v)\n", paused)
+	if paused {
+		if cli != nil {
+			cli.SetPaused(true)
+		}
+		b.e.Pause()
+		return
+	}
+	b.e.Resume()
+	if cli != nil {
+		cli.SetPaused(false)
 	}
 }
 
@@ -484,10 +1127,14 @@ func (b *LocalBackend) parseWgStatus(s *wgengine.Status) EngineStatus {
 	}
 	b.logf("v%v peers: %v\n", version.LONG, strings.Join(ss, " "))
 	return EngineStatus{
-		RBytes:    rx,
-		WBytes:    tx,
-		NumLive:   live,
-		LivePeers: peers,
+		RBytes:     rx,
+		WBytes:     tx,
+		NumLive:    live,
+		LivePeers:  peers,
+		NATType:    s.NATType,
+		DERPHome:   s.DERPHome,
+		NetInfo:    s.NetInfo,
+		LocalAddrs: s.LocalAddrs,
 	}
 }
 
@@ -502,6 +1149,25 @@ func (b *LocalBackend) Prefs() *Prefs {
 	return b.prefs
 }
 
+// WhoIs returns the node and user owning the Tailscale IP ip, from
+// the current network map. It returns nil if ip isn't in the map.
+func (b *LocalBackend) WhoIs(ip wgcfg.IP) *ipnstate.WhoIsResponse {
+	b.mu.Lock()
+	nm := b.netMapCache
+	b.mu.Unlock()
+
+	return whoIs(nm, ip)
+}
+
+// StateKey returns the key of the backend's state in its store, or
+// the empty string if the frontend owns the state.
+func (b *LocalBackend) StateKey() StateKey {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.stateKey
+}
+
 func (b *LocalBackend) SetPrefs(new *Prefs) {
 	if new == nil {
 		panic("SetPrefs got nil prefs")
@@ -510,15 +1176,35 @@ func (b *LocalBackend) SetPrefs(new *Prefs) {
 	b.mu.Lock()
 	old := b.prefs
 	new.Persist = old.Persist // caller isn't allowed to override this
+	if new.ControlURL != old.ControlURL && old.Persist != nil {
+		// The node is registered with the old server only. Keep
+		// the machine key, but log in afresh to the new server.
+		b.logf("SetPrefs: control server changed to %q, need to log in again\n", new.ControlURL)
+		new.Persist = &controlclient.Persist{
+			PrivateMachineKey: old.Persist.PrivateMachineKey,
+			MachineKeyStore:   old.Persist.MachineKeyStore,
+			MachineKeyRef:     old.Persist.MachineKeyRef,
+		}
+	}
 	b.prefs = new
 	if b.stateKey != "" {
-		if err := b.store.WriteState(b.stateKey, b.prefs.ToBytes()); err != nil {
+		if err := b.store.WriteState(b.stateKey, b.prefsToStore()); err != nil {
 			b.logf("Failed to save new controlclient state: %v", err)
 		}
 	}
 	oldHi := b.hiCache
 	newHi := oldHi.Copy()
 	newHi.RoutableIPs = append([]wgcfg.CIDR(nil), b.prefs.AdvertiseRoutes...)
+	newHi.RequestTags = append([]string(nil), b.prefs.AdvertiseTags...)
+	// Offered again once authReconfig has the resolver serving peers.
+	newHi.DNSProxy = oldHi.DNSProxy && new.AdvertisesExitNode()
+	newHi.Services = filterServices(b.services, new)
+	if new.Hostname != "" {
+		newHi.Hostname = new.Hostname
+	} else if old.Hostname != "" {
+		// Override removed, go back to the OS hostname.
+		newHi.Hostname = controlclient.NewHostinfo().Hostname
+	}
 	b.hiCache = *newHi
 	cli := b.c
 	b.mu.Unlock()
@@ -526,6 +1212,22 @@ func (b *LocalBackend) SetPrefs(new *Prefs) {
 	if cli != nil && !oldHi.Equal(newHi) {
 		cli.SetHostinfo(*newHi)
 	}
+	b.checkIPForwarding(new)
+	if old.ReportHealth != new.ReportHealth {
+		b.sendHealthReport()
+	}
+	if old.CheckUpdates != new.CheckUpdates {
+		b.scheduleUpdateChecks()
+	}
+	if old.ExitNodeID != new.ExitNodeID || old.ExitNodeIP != new.ExitNodeIP {
+		b.checkExitNode(b.Status())
+	}
+	if old.ControlURL != new.ControlURL || old.ControlProxy != new.ControlProxy || !compareStrings(old.ControlPins, new.ControlPins) {
+		b.logf("SetPrefs: new control server settings take effect when the backend restarts, or, but for the URL, reloads\n")
+	}
+	if old.ShieldsUp != new.ShieldsUp || old.UsePacketFilter != new.UsePacketFilter {
+		b.updateFilter()
+	}
 
 	if old.WantRunning != new.WantRunning {
 		b.stateMachine()
@@ -535,6 +1237,58 @@ func (b *LocalBackend) SetPrefs(new *Prefs) {
 
 	b.logf("SetPrefs: %v\n", new.Pretty())
 	b.send(Notify{Prefs: new})
+
+	if !compareStrings(old.PeerTags, new.PeerTags) || !compareStrings(old.PeerUsers, new.PeerUsers) {
+		b.mu.Lock()
+		nm := b.netMapCache
+		b.mu.Unlock()
+		if nm != nil {
+			b.send(Notify{NetMap: scopePeers(nm, new)})
+		}
+	}
+}
+
+// checkIPForwarding verifies that the kernel will forward packets
+// for the subnet routes advertised in prefs, and records the result
+// in the health registry. If b is configured to do so, it tries to
+// fix a disabled forwarding setting.
+func (b *LocalBackend) checkIPForwarding(prefs *Prefs) {
+	if len(prefs.AdvertiseRoutes) == 0 {
+		health.Set(health.SysIPForwarding, nil)
+		return
+	}
+	err := wgengine.CheckIPForwarding()
+	if err != nil && b.enableIPForward {
+		b.logf("IP forwarding: %v; enabling it.\n", err)
+		if err2 := wgengine.EnableIPForwarding(); err2 != nil {
+			b.logf("IP forwarding: %v\n", err2)
+		}
+		err = wgengine.CheckIPForwarding()
+	}
+	if err != nil {
+		b.logf("Warning: advertising routes, but %v\n", err)
+	}
+	health.Set(health.SysIPForwarding, err)
+}
+
+// prefsToStore returns the serialized form of b.prefs to save in the
+// state store. Ephemeral nodes never save their keys, so that a
+// restarted node registers afresh instead of reusing its identity.
+func (b *LocalBackend) prefsToStore() []byte {
+	if !b.ephemeral {
+		return b.prefs.ToBytes()
+	}
+	p := b.prefs.Copy()
+	p.Persist = nil
+	return p.ToBytes()
+}
+
+// DERPMap returns the DERP map last given to the engine, or nil if
+// the engine still uses its built-in one.
+func (b *LocalBackend) DERPMap() *tailcfg.DERPMap {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.derpMap
 }
 
 // Note: return value may be nil, if we haven't received a netmap yet.
@@ -562,6 +1316,10 @@ func (b *LocalBackend) authReconfig() {
 		b.logf("authReconfig: blocked, skipping.\n")
 		return
 	}
+	if scoped := scopePeers(nm, uc); scoped != nm {
+		b.logf("authReconfig: peer scope keeps %d of %d peers.\n", len(scoped.Peers), len(nm.Peers))
+		nm = scoped
+	}
 	if nm == nil {
 		b.logf("authReconfig: netmap not yet valid. Skipping.\n")
 		return
@@ -587,48 +1345,140 @@ func (b *LocalBackend) authReconfig() {
 	if uc.AllowSingleHosts {
 		uflags |= controlclient.UAllowSingleHosts
 	}
+	nm = filterRoutes(nm, uc, b.logf)
+	var conflicts []string
+	if uc.RouteAll {
+		conflicts = routeConflicts(nm, localNetworks(b.logf))
+	}
+	b.warn(ErrRouteConflict, strings.Join(conflicts, "; "))
+	exit, err := findExitNode(nm, uc)
+	if err != nil {
+		b.logf("authReconfig: %v; not using an exit node.\n", err)
+	}
+	if exit != nil {
+		b.logf("authReconfig: routing Internet traffic via exit node %s.\n", exit.Hostinfo.Hostname)
+		nm = routeViaExitNode(nm, exit)
+		uflags |= controlclient.UAllowDefaultRoute
+		// The user asked for a real default route.
+		uflags &^= controlclient.UHackDefaultRoute
+	}
+	var exitDNS string // the exit node's DNS proxy, if used
+	if exit != nil && uc.ExitNodeDNS && uc.CorpDNS {
+		if exit.Hostinfo.DNSProxy && len(exit.Addresses) > 0 {
+			exitDNS = exit.Addresses[0].IP.String()
+		} else {
+			b.logf("authReconfig: exit node %s has no DNS proxy; not sending it DNS.\n", exit.Hostinfo.Hostname)
+		}
+	}
 	b.logf("reconfig: ra=%v dns=%v 0x%02x\n", uc.RouteAll, uc.CorpDNS, uflags)
 
 	if nm != nil {
 		dns := nm.DNS
 		dom := nm.DNSDomains
+		var dnsCfg *tsdns.Config
 		if !uc.CorpDNS {
 			dns = []wgcfg.IP{}
 			dom = []string{}
+		} else if (nm.DNSConfig.Proxied || exitDNS != "") && len(nm.Addresses) > 0 {
+			// The OS asks the engine's resolver, at our own
+			// address, which answers or forwards per nm, and
+			// sends the rest to the exit node if asked to.
+			dnsCfg = &tsdns.Config{}
+			if nm.DNSConfig.Proxied {
+				dnsCfg = resolverConfig(nm)
+				dom = nm.DNSConfig.SearchDomains
+			}
+			if exitDNS != "" {
+				dnsCfg.Nameservers = []string{exitDNS}
+			}
+			dns = []wgcfg.IP{nm.Addresses[0].IP}
 		}
+		if uc.AdvertisesExitNode() && len(nm.Addresses) > 0 {
+			// Be the DNS proxy that Hostinfo.DNSProxy offers,
+			// whether or not the OS uses the resolver too.
+			if dnsCfg == nil {
+				dnsCfg = &tsdns.Config{}
+			}
+			dnsCfg.ServePeers = true
+		}
+		b.e.SetDNSConfig(dnsCfg)
 		cfg, err := nm.WGCfg(uflags, dns)
 		if err != nil {
 			log.Fatalf("WGCfg: %v\n", err)
 		}
 
 		err = b.e.Reconfig(cfg, dom)
-		if err != nil {
+		servingPeers := dnsCfg != nil && dnsCfg.ServePeers
+		switch {
+		case errors.Is(err, wgengine.ErrDNSProxyFailed):
 			b.logf("reconfig: %v", err)
+			b.warn(ErrTUNFailed, "")
+			b.warn(ErrDNSProxyFailed, fmt.Sprintf("serving DNS to exit node users: %v", err))
+			servingPeers = false
+		case err != nil:
+			b.logf("reconfig: %v", err)
+			b.warn(ErrTUNFailed, fmt.Sprintf("configuring the tunnel: %v", err))
+			servingPeers = false
+		default:
+			b.warn(ErrTUNFailed, "")
+			b.warn(ErrDNSProxyFailed, "")
 		}
+		b.setDNSProxy(servingPeers)
+	}
+}
+
+// setDNSProxy sets Hostinfo.DNSProxy, offering the engine's resolver
+// to the nodes using this one as an exit node, or not, once it is or
+// isn't listening for them.
+func (b *LocalBackend) setDNSProxy(on bool) {
+	b.mu.Lock()
+	if b.hiCache.DNSProxy == on {
+		b.mu.Unlock()
+		return
+	}
+	hi := b.hiCache.Copy()
+	hi.DNSProxy = on
+	b.hiCache = *hi
+	cli := b.c
+	b.mu.Unlock()
+
+	if cli != nil {
+		cli.SetHostinfo(*hi)
 	}
 }
 
-func (b *LocalBackend) enterState(newState State) {
+// enterState moves the backend from state from to newState, for the
+// reason why, and reports whether it was still in from. If it wasn't,
+// another transition won the race, and enterState does nothing.
+func (b *LocalBackend) enterState(from, newState State, why string) bool {
 	b.mu.Lock()
 	state := b.state
 	prefs := b.prefs
+	if state != from {
+		b.mu.Unlock()
+		return false
+	}
+	if state != newState {
+		b.state = newState
+		b.stateLog.add(stateEvent{When: b.timeNow(), From: state, To: newState, Why: why})
+	}
 	b.mu.Unlock()
 
 	if state == newState {
-		return
+		return true
 	}
-	b.logf("Switching ipn state %v -> %v (WantRunning=%v)\n",
-		state, newState, prefs.WantRunning)
+	b.logf("Switching ipn state %v -> %v (%s, WantRunning=%v)\n",
+		state, newState, why, prefs.WantRunning)
 	if b.notify != nil {
 		b.send(Notify{State: &newState})
 	}
 
-	b.state = newState
 	switch newState {
 	case NeedsLogin:
 		b.blockEngineUpdates(true)
 		fallthrough
 	case Stopped:
+		b.e.SetDNSConfig(nil)
 		err := b.e.Reconfig(&wgcfg.Config{}, nil)
 		if err != nil {
 			b.logf("Reconfig(down): %v\n", err)
@@ -642,57 +1492,148 @@ func (b *LocalBackend) enterState(newState State) {
 	default:
 		b.logf("Weird: unknown newState %#v\n", newState)
 	}
-
+	return true
 }
 
-func (b *LocalBackend) nextState() State {
+// stateInputs returns the current state, and the inputs the state
+// machine decides the next one from.
+func (b *LocalBackend) stateInputs() (State, stateInputs) {
 	b.assertClient()
-	state := b.State()
+	// Auth was interrupted or is waiting for a URL visit, so it
+	// won't proceed without human help.
+	authCantContinue := b.c.AuthCantContinue()
 
-	if b.netMapCache == nil {
-		if b.c.AuthCantContinue() {
-			// Auth was interrupted or waiting for URL visit,
-			// so it won't proceed without human help.
-			return NeedsLogin
-		} else {
-			// Auth or map request needs to finish
-			return state
-		}
-	} else if !b.prefs.WantRunning {
-		return Stopped
-	} else if e := b.netMapCache.Expiry; !e.IsZero() && time.Until(e) <= 0 {
-		return NeedsLogin
-	} else if b.netMapCache.MachineStatus != tailcfg.MachineAuthorized {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	in := stateInputs{
+		authCantContinue: authCantContinue,
+		loggedOut:        b.loggedOut,
+		wantRunning:      b.prefs != nil && b.prefs.WantRunning,
+		liveEngine:       b.engineStatus.NumLive > 0,
+	}
+	if nm := b.netMapCache; nm != nil {
+		in.haveNetMap = true
+		in.keyExpired = !nm.Expiry.IsZero() && !b.timeNow().Before(nm.Expiry)
 		// TODO(crawshaw): handle tailcfg.MachineInvalid
-		return NeedsMachineAuth
-	} else if state == NeedsMachineAuth {
-		// (if we get here, we know MachineAuthorized == true)
-		return Starting
-	} else if state == Starting {
-		if b.EngineStatus().NumLive > 0 {
-			return Running
-		} else {
-			return state
-		}
-	} else if state == Running {
-		return Running
-	} else {
-		return Starting
+		in.machineAuthorized = nm.MachineStatus == tailcfg.MachineAuthorized
 	}
+	return b.state, in
 }
 
 func (b *LocalBackend) RequestEngineStatus() {
 	b.e.RequestStatus()
 }
 
-// TODO(apenwarr): use a channel or something to prevent re-entrancy?
-//  Or maybe just call the state machine from fewer places.
+// Status returns the current state of this node and its peers.
+func (b *LocalBackend) Status() *ipnstate.Status {
+	b.mu.Lock()
+	state := b.state
+	prefs := b.prefs
+	nm := scopePeers(b.netMapCache, prefs)
+	es := b.engineStatus
+	paused := b.paused
+	update := b.updateInfo
+	b.mu.Unlock()
+	st := buildStatus(state, nm, es, b.timeNow())
+	st.Paused = paused
+	st.Update = update
+	if exit, _ := findExitNode(nm, prefs); exit != nil {
+		if ps := st.Peer[exit.Key]; ps != nil {
+			ps.ExitNode = true
+		}
+	}
+	setNicknames(st, nm, prefs)
+	st.Health = health.Problems()
+	return st
+}
+
+// checkExitNode reports to package health whether the exit node
+// selected in the prefs is usable, given status st.
+func (b *LocalBackend) checkExitNode(st *ipnstate.Status) {
+	b.mu.Lock()
+	nm := b.netMapCache
+	prefs := b.prefs
+	b.mu.Unlock()
+
+	if nm == nil {
+		// Nothing to check against until logged in.
+		health.Set(health.SysExitNode, nil)
+		return
+	}
+	exit, err := findExitNode(scopePeers(nm, prefs), prefs)
+	if err == nil && exit != nil {
+		if ps := st.Peer[exit.Key]; ps == nil || !ps.Online {
+			err = fmt.Errorf("exit node %s is offline", exit.Hostinfo.Hostname)
+		}
+	}
+	health.Set(health.SysExitNode, err)
+}
+
+// sendHealthReport hands the control client a fresh health report
+// to pass on to the control server, if the prefs allow it.
+func (b *LocalBackend) sendHealthReport() {
+	b.mu.Lock()
+	cli := b.c
+	var r *tailcfg.HealthReport
+	if b.prefs != nil && b.prefs.ReportHealth {
+		r = healthReport(b.engineStatus, health.Problems(), b.engineErrs, b.lastEngineErr)
+	}
+	b.mu.Unlock()
+
+	if cli != nil {
+		cli.SetHealthReport(r)
+	}
+}
+
+// checkPeerChanges notifies the frontend of peers that went online
+// or offline since the last check. When an online peer is due to
+// time out, it asks the engine for fresh status then, which checks
+// again.
+func (b *LocalBackend) checkPeerChanges() {
+	st := b.Status()
+
+	b.mu.Lock()
+	changes, cur := peerChanges(b.peerOnline, st)
+	b.peerOnline = cur
+	if b.peerTimer != nil {
+		b.peerTimer.Stop()
+		b.peerTimer = nil
+	}
+	now := b.timeNow()
+	if t := nextPeerTimeout(st, now); !t.IsZero() {
+		b.peerTimer = time.AfterFunc(t.Sub(now)+time.Second, b.RequestEngineStatus)
+	}
+	b.mu.Unlock()
+
+	b.checkExitNode(st)
+	for _, c := range changes {
+		b.logf("peer %v (%s) online=%v\n", c.Key.AbbrevString(), c.HostName, c.Online)
+	}
+	if len(changes) > 0 {
+		b.send(Notify{PeerChanges: changes})
+	}
+}
+
+func (b *LocalBackend) RequestStatus() {
+	b.send(Notify{Status: b.Status()})
+}
+
+// stateMachine moves the backend to the state that stateRules pick.
+// It may be called from any goroutine, at any time: if another
+// transition happens while it decides, it decides again.
 func (b *LocalBackend) stateMachine() {
-	b.enterState(b.nextState())
+	for {
+		cur, in := b.stateInputs()
+		next, why := nextState(cur, in)
+		if b.enterState(cur, next, why) {
+			return
+		}
+	}
 }
 
 func (b *LocalBackend) stopEngineAndWait() {
 	b.logf("stopEngineAndWait...\n")
+	b.e.SetDNSConfig(nil)
 	b.e.Reconfig(&wgcfg.Config{}, nil)
 	b.requestEngineStatusAndWait()
 	b.logf("stopEngineAndWait: done.\n")
@@ -701,24 +1642,49 @@ func (b *LocalBackend) stopEngineAndWait() {
 // Requests the wgengine status, and does not return until the status
 // was delivered (to the usual callback).
 func (b *LocalBackend) requestEngineStatusAndWait() {
-	b.logf("requestEngineStatusAndWait\n")
+	b.logf("[v1] requestEngineStatusAndWait\n")
 
 	b.statusLock.Lock()
 	go b.e.RequestStatus()
-	b.logf("requestEngineStatusAndWait: waiting...\n")
+	b.logf("[v1] requestEngineStatusAndWait: waiting...\n")
 	b.statusChanged.Wait() // temporarily releases lock while waiting
-	b.logf("requestEngineStatusAndWait: got status update.\n")
+	b.logf("[v1] requestEngineStatusAndWait: got status update.\n")
 	b.statusLock.Unlock()
 }
 
-// NOTE(apenwarr): No easy way to persist logged-out status.
-//  Maybe that's for the better; if someone logs out accidentally,
-//  rebooting will fix it.
+// Logout expires the node key on the control server, forgets it,
+// and moves the backend to NeedsLogin until the user logs in again.
+// Unlike turning off WantRunning, this survives a restart, as the
+// saved state no longer holds a node key. The machine key is kept.
 func (b *LocalBackend) Logout() {
 	b.assertClient()
+	b.mu.Lock()
 	b.netMapCache = nil
+	b.loggedOut = true
+	b.authURL = ""
+	var prefs *Prefs
+	if b.prefs != nil && b.prefs.Persist != nil {
+		// The node key stays until the control server has expired
+		// it, which may take retries, or a restart if the server
+		// can't be reached now; Start resumes the logout. The
+		// control client then reports Persist without the key,
+		// which is saved like any other.
+		persist := *b.prefs.Persist
+		persist.LogoutPending = true
+		b.prefs.Persist = &persist
+		if b.stateKey != "" {
+			if err := b.store.WriteState(b.stateKey, b.prefsToStore()); err != nil {
+				b.logf("Logout: failed to save state: %v", err)
+			}
+		}
+		prefs = b.prefs.Copy()
+	}
+	b.mu.Unlock()
+
 	b.c.Logout()
-	b.netMapCache = nil
+	if prefs != nil {
+		b.send(Notify{Prefs: prefs})
+	}
 	b.stateMachine()
 }
 
@@ -11,14 +11,43 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync"
 	"time"
 
 	"tailscale.com/types/logger"
 	"tailscale.com/version"
 )
 
+// ProtocolVersion is the version of the frontend/backend message
+// protocol. It changes only when a change to Command or Notify would
+// break the other side, so that frontends and backends from
+// different releases can still talk as long as it matches.
+//
+// Messages from before protocol versioning have ProtocolVersion 0,
+// and must match the exact release version instead.
+const ProtocolVersion = 1
+
+// Capabilities of this backend, which frontends can check for with
+// BackendClient.HasCapability before using optional features.
+const (
+	CapStatus           = "status"             // Command.RequestStatus
+	CapProfiles         = "profiles"           // Command.ListProfiles, SwitchProfile, DeleteProfile
+	CapDebug            = "debug"              // Command.Debug
+	CapRotateMachineKey = "rotate-machine-key" // Command.RotateMachineKey
+	CapPause            = "pause"              // Command.SetPaused
+)
+
+var backendCapabilities = []string{CapStatus, CapProfiles, CapDebug, CapRotateMachineKey, CapPause}
+
 type NoArgs struct{}
 
+// HelloArgs is the protocol handshake, sent by a frontend in
+// Command.Hello and answered by the backend in Notify.Hello.
+type HelloArgs struct {
+	ProtocolVersion int
+	Capabilities    []string // optional features the sender supports
+}
+
 type StartArgs struct {
 	Opts Options
 }
@@ -31,19 +60,40 @@ type FakeExpireAfterArgs struct {
 	Duration time.Duration
 }
 
+type DebugArgs struct {
+	Action DebugAction
+}
+
+type ProfileArgs struct {
+	Name string
+}
+
+type SetPausedArgs struct {
+	Paused bool
+}
+
 // Command is a command message that is JSON encoded and sent by a
 // frontend to a backend.
 type Command struct {
-	Version string
+	Version         string
+	ProtocolVersion int `json:",omitempty"`
 
 	// Exactly one of the following must be non-nil.
 	Quit                  *NoArgs
+	Hello                 *HelloArgs
 	Start                 *StartArgs
 	StartLoginInteractive *NoArgs
 	Logout                *NoArgs
 	SetPrefs              *SetPrefsArgs
 	RequestEngineStatus   *NoArgs
+	RequestStatus         *NoArgs
 	FakeExpireAfter       *FakeExpireAfterArgs
+	Debug                 *DebugArgs
+	ListProfiles          *NoArgs
+	SwitchProfile         *ProfileArgs
+	DeleteProfile         *ProfileArgs
+	RotateMachineKey      *NoArgs
+	SetPaused             *SetPausedArgs
 }
 
 type BackendServer struct {
@@ -51,6 +101,8 @@ type BackendServer struct {
 	b             Backend        // the Backend we are serving up
 	sendNotifyMsg func(b []byte) // send a notification message
 	GotQuit       bool           // a Quit command was received
+
+	warnedVersion bool // logged a release version mismatch
 }
 
 func NewBackendServer(logf logger.Logf, b Backend, sendNotifyMsg func(b []byte)) *BackendServer {
@@ -63,6 +115,7 @@ func NewBackendServer(logf logger.Logf, b Backend, sendNotifyMsg func(b []byte))
 
 func (bs *BackendServer) send(n Notify) {
 	n.Version = version.LONG
+	n.ProtocolVersion = ProtocolVersion
 	b, err := json.Marshal(n)
 	if err != nil {
 		log.Fatalf("Failed json.Marshal(notify): %v\n%#v\n", err, n)
@@ -80,17 +133,21 @@ func (bs *BackendServer) GotCommandMsg(b []byte) error {
 }
 
 func (bs *BackendServer) GotCommand(cmd *Command) error {
-	if cmd.Version != version.LONG {
-		vs := fmt.Sprintf("Version mismatch! frontend=%#v backend=%#v\n",
-			cmd.Version, version.LONG)
+	if cmd.Version != version.LONG && cmd.ProtocolVersion == ProtocolVersion {
+		if !bs.warnedVersion {
+			bs.logf("frontend version %#v differs from backend %#v, protocol %d matches\n",
+				cmd.Version, version.LONG, ProtocolVersion)
+			bs.warnedVersion = true
+		}
+	} else if cmd.Version != version.LONG {
+		vs := fmt.Sprintf("Version mismatch! frontend=%#v/%d backend=%#v/%d\n",
+			cmd.Version, cmd.ProtocolVersion, version.LONG, ProtocolVersion)
 		bs.logf("%s\n", vs)
 		// ignore the command, but send a message back to the
 		// caller so it can realize the version mismatch too.
 		// We don't want to exit because it might cause a crash
 		// loop, and restarting won't fix the problem.
-		bs.send(Notify{
-			ErrMessage: &vs,
-		})
+		bs.send(errNotify(ErrVersionMismatch, true, vs))
 		return nil
 	}
 	if cmd.Quit != nil {
@@ -98,7 +155,14 @@ func (bs *BackendServer) GotCommand(cmd *Command) error {
 		return errors.New("Quit command received")
 	}
 
-	if c := cmd.Start; c != nil {
+	if c := cmd.Hello; c != nil {
+		bs.logf("frontend hello: protocol %d, capabilities %v\n", c.ProtocolVersion, c.Capabilities)
+		bs.send(Notify{Hello: &HelloArgs{
+			ProtocolVersion: ProtocolVersion,
+			Capabilities:    backendCapabilities,
+		}})
+		return nil
+	} else if c := cmd.Start; c != nil {
 		opts := c.Opts
 		opts.Notify = bs.send
 		return bs.b.Start(opts)
@@ -114,14 +178,46 @@ func (bs *BackendServer) GotCommand(cmd *Command) error {
 	} else if c := cmd.RequestEngineStatus; c != nil {
 		bs.b.RequestEngineStatus()
 		return nil
+	} else if c := cmd.RequestStatus; c != nil {
+		bs.b.RequestStatus()
+		return nil
 	} else if c := cmd.FakeExpireAfter; c != nil {
 		bs.b.FakeExpireAfter(c.Duration)
 		return nil
+	} else if c := cmd.Debug; c != nil {
+		bs.b.Debug(c.Action)
+		return nil
+	} else if c := cmd.ListProfiles; c != nil {
+		bs.b.ListProfiles()
+		return nil
+	} else if c := cmd.SwitchProfile; c != nil {
+		bs.b.SwitchProfile(c.Name)
+		return nil
+	} else if c := cmd.DeleteProfile; c != nil {
+		bs.b.DeleteProfile(c.Name)
+		return nil
+	} else if c := cmd.RotateMachineKey; c != nil {
+		bs.b.RotateMachineKey()
+		return nil
+	} else if c := cmd.SetPaused; c != nil {
+		bs.b.SetPaused(c.Paused)
+		return nil
+	} else if cmd.ProtocolVersion > 0 {
+		// Probably a command from a newer frontend that we don't
+		// know about. Tell it, rather than dropping the connection.
+		bs.send(errNotify(ErrUnsupportedCommand, true, "unsupported command"))
+		return nil
 	} else {
 		return fmt.Errorf("BackendServer.Do: no command specified")
 	}
 }
 
+// SendErrorMessage sends msg to the frontend as a critical error
+// with the given code.
+func (bs *BackendServer) SendErrorMessage(code ErrCode, msg string) {
+	bs.send(errNotify(code, true, msg))
+}
+
 func (bs *BackendServer) Reset() error {
 	// Tell the backend we got a Logout command, which will cause it
 	// to forget all its authentication information.
@@ -132,6 +228,9 @@ type BackendClient struct {
 	logf           logger.Logf
 	sendCommandMsg func(b []byte)
 	notify         func(n Notify)
+
+	mu   sync.Mutex
+	caps map[string]bool // from the backend's Hello; nil until then
 }
 
 func NewBackendClient(logf logger.Logf, sendCommandMsg func(b []byte)) *BackendClient {
@@ -146,16 +245,24 @@ func (bc *BackendClient) GotNotifyMsg(b []byte) {
 	if err := json.Unmarshal(b, &n); err != nil {
 		log.Fatalf("BackendClient.Notify: cannot decode message")
 	}
-	if n.Version != version.LONG {
-		vs := fmt.Sprintf("Version mismatch! frontend=%#v backend=%#v",
-			version.LONG, n.Version)
+	if n.Version != version.LONG && n.ProtocolVersion != ProtocolVersion {
+		vs := fmt.Sprintf("Version mismatch! frontend=%#v/%d backend=%#v/%d",
+			version.LONG, ProtocolVersion, n.Version, n.ProtocolVersion)
 		bc.logf("%s\n", vs)
 		// delete anything in the notification except the version,
 		// to prevent incorrect operation.
-		n = Notify{
-			Version:    n.Version,
-			ErrMessage: &vs,
+		ver := n.Version
+		n = errNotify(ErrVersionMismatch, true, vs)
+		n.Version = ver
+	}
+	if h := n.Hello; h != nil {
+		caps := make(map[string]bool)
+		for _, c := range h.Capabilities {
+			caps[c] = true
 		}
+		bc.mu.Lock()
+		bc.caps = caps
+		bc.mu.Unlock()
 	}
 	if bc.notify != nil {
 		bc.notify(n)
@@ -164,6 +271,7 @@ func (bc *BackendClient) GotNotifyMsg(b []byte) {
 
 func (bc *BackendClient) send(cmd Command) {
 	cmd.Version = version.LONG
+	cmd.ProtocolVersion = ProtocolVersion
 	b, err := json.Marshal(cmd)
 	if err != nil {
 		log.Fatalf("Failed json.Marshal(cmd): %v\n%#v\n", err, cmd)
@@ -171,6 +279,22 @@ func (bc *BackendClient) send(cmd Command) {
 	bc.sendCommandMsg(b)
 }
 
+// Hello sends the protocol handshake. The backend answers with its
+// capabilities in a Hello notification; older backends that don't
+// know the handshake answer with an error or not at all.
+func (bc *BackendClient) Hello() {
+	bc.send(Command{Hello: &HelloArgs{ProtocolVersion: ProtocolVersion}})
+}
+
+// HasCapability reports whether the backend advertised capability c
+// in its answer to Hello. Before that answer arrives, or if the
+// backend predates capabilities, it reports false.
+func (bc *BackendClient) HasCapability(c string) bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.caps[c]
+}
+
 func (bc *BackendClient) Quit() error {
 	bc.send(Command{Quit: &NoArgs{}})
 	return nil
@@ -199,10 +323,38 @@ func (bc *BackendClient) RequestEngineStatus() {
 	bc.send(Command{RequestEngineStatus: &NoArgs{}})
 }
 
+func (bc *BackendClient) RequestStatus() {
+	bc.send(Command{RequestStatus: &NoArgs{}})
+}
+
 func (bc *BackendClient) FakeExpireAfter(x time.Duration) {
 	bc.send(Command{FakeExpireAfter: &FakeExpireAfterArgs{Duration: x}})
 }
 
+func (bc *BackendClient) Debug(action DebugAction) {
+	bc.send(Command{Debug: &DebugArgs{Action: action}})
+}
+
+func (bc *BackendClient) ListProfiles() {
+	bc.send(Command{ListProfiles: &NoArgs{}})
+}
+
+func (bc *BackendClient) SwitchProfile(name string) {
+	bc.send(Command{SwitchProfile: &ProfileArgs{Name: name}})
+}
+
+func (bc *BackendClient) DeleteProfile(name string) {
+	bc.send(Command{DeleteProfile: &ProfileArgs{Name: name}})
+}
+
+func (bc *BackendClient) RotateMachineKey() {
+	bc.send(Command{RotateMachineKey: &NoArgs{}})
+}
+
+func (bc *BackendClient) SetPaused(paused bool) {
+	bc.send(Command{SetPaused: &SetPausedArgs{Paused: paused}})
+}
+
 const MSG_MAX = 1024 * 1024
 
 // TODO(apenwarr): incremental json decode?
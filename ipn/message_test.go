@@ -180,3 +180,62 @@ func TestClientServer(t *testing.T) {
 	h.Logout()
 	flushUntil(NeedsLogin)
 }
+
+func TestHello(t *testing.T) {
+	var bc *BackendClient
+	var notes []Notify
+	bs := NewBackendServer(t.Logf, &FakeBackend{}, func(b []byte) {
+		bc.GotNotifyMsg(b)
+	})
+	bc = NewBackendClient(t.Logf, func(b []byte) {
+		if err := bs.GotCommandMsg(b); err != nil {
+			t.Errorf("GotCommandMsg: %v", err)
+		}
+	})
+	bc.Start(Options{
+		Prefs:  NewPrefs(),
+		Notify: func(n Notify) { notes = append(notes, n) },
+	})
+
+	if bc.HasCapability(CapStatus) {
+		t.Error("HasCapability before Hello")
+	}
+	bc.Hello()
+	if !bc.HasCapability(CapStatus) || !bc.HasCapability(CapProfiles) {
+		t.Error("missing capabilities after Hello")
+	}
+	if bc.HasCapability("bogus") {
+		t.Error("has bogus capability")
+	}
+
+	// A frontend from another release, speaking the same protocol,
+	// is served normally.
+	notes = nil
+	if err := bs.GotCommand(&Command{
+		Version:         "0.0.0-other",
+		ProtocolVersion: ProtocolVersion,
+		RequestStatus:   &NoArgs{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Status == nil {
+		t.Errorf("same protocol, other version: got %+v, want status", notes)
+	}
+
+	// But an old frontend without a protocol version isn't.
+	notes = nil
+	bs.GotCommand(&Command{Version: "0.0.0-other", RequestStatus: &NoArgs{}})
+	if len(notes) != 1 || notes[0].ErrMessage == nil || notes[0].Error == nil || notes[0].Error.Code != ErrVersionMismatch {
+		t.Errorf("unversioned mismatch: got %+v, want error", notes)
+	}
+
+	// Unknown commands from versioned frontends get an error
+	// reply, not a dropped connection.
+	notes = nil
+	if err := bs.GotCommandMsg([]byte(`{"Version": "x", "ProtocolVersion": 1, "SomethingNew": {}}`)); err != nil {
+		t.Errorf("unknown command: %v", err)
+	}
+	if len(notes) != 1 || notes[0].ErrMessage == nil || notes[0].Error == nil || notes[0].Error.Code != ErrUnsupportedCommand {
+		t.Errorf("unknown command: got %+v, want error", notes)
+	}
+}
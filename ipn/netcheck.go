@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// minNetcheckInterval is how often Netcheck starts a new check at
+// most. Callers in between get the latest result, so that local
+// users can't make the node flood STUN servers.
+const minNetcheckInterval = 5 * time.Second
+
+// netcheckPoll is how often Netcheck asks the engine whether the
+// check has finished.
+const netcheckPoll = time.Second
+
+var errPaused = errors.New("network activity is paused")
+
+// Netcheck checks the local network's conditions again, by
+// rediscovering the node's endpoints with STUN, and returns the
+// result once the engine reports it, or ctx's error if that takes
+// too long.
+func (b *LocalBackend) Netcheck(ctx context.Context) (*tailcfg.NetInfo, error) {
+	b.mu.Lock()
+	paused := b.paused
+	old := b.engineStatus.NetInfo
+	now := b.timeNow()
+	recent := now.Sub(b.lastNetcheck) < minNetcheckInterval
+	if !recent {
+		b.lastNetcheck = now
+	}
+	b.mu.Unlock()
+	if paused {
+		return nil, errPaused
+	}
+	if recent && old != nil {
+		return old, nil
+	}
+
+	b.e.ReSTUN()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(netcheckPoll):
+		}
+		b.e.RequestStatus()
+		b.mu.Lock()
+		ni := b.engineStatus.NetInfo
+		b.mu.Unlock()
+		if ni != nil && ni != old {
+			return ni, nil
+		}
+	}
+}
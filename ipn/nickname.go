@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+// CheckNickname reports whether name can be a peer nickname: it must
+// be non-empty, must not contain spaces, commas or '=', which the CLI
+// uses as separators, and must not look like the IP addresses and
+// node IDs that it stands in for.
+func CheckNickname(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty nickname")
+	}
+	if strings.ContainsAny(name, " \t,=") {
+		return fmt.Errorf("nickname %q contains a space, comma or '='", name)
+	}
+	if net.ParseIP(name) != nil {
+		return fmt.Errorf("nickname %q is an IP address", name)
+	}
+	if _, err := strconv.ParseInt(name, 10, 64); err == nil {
+		return fmt.Errorf("nickname %q is a node ID", name)
+	}
+	return nil
+}
+
+// peerByRef returns the peer in nm that ref refers to, by node ID or
+// by one of its Tailscale IPs, or nil if there's no such peer.
+func peerByRef(nm *NetworkMap, ref string) *tailcfg.Node {
+	if nm == nil {
+		return nil
+	}
+	var id tailcfg.NodeID
+	ip := net.ParseIP(ref)
+	if ip == nil {
+		n, err := strconv.ParseInt(ref, 10, 64)
+		if err != nil {
+			return nil
+		}
+		id = tailcfg.NodeID(n)
+	}
+	for i := range nm.Peers {
+		p := &nm.Peers[i]
+		if ip != nil && hasAddr(p, ip.String()) || ip == nil && p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// setNicknames fills in the nicknames from prefs of the peers in st,
+// which was built from nm. A peer with several nicknames gets the
+// first in sorted order.
+func setNicknames(st *ipnstate.Status, nm *NetworkMap, prefs *Prefs) {
+	if prefs == nil || len(prefs.Nicknames) == 0 {
+		return
+	}
+	names := make([]string, 0, len(prefs.Nicknames))
+	for name := range prefs.Nicknames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := peerByRef(nm, prefs.Nicknames[name])
+		if p == nil {
+			continue
+		}
+		if ps := st.Peer[p.Key]; ps != nil && ps.Nickname == "" {
+			ps.Nickname = name
+		}
+	}
+}
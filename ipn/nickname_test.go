@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+)
+
+func TestCheckNickname(t *testing.T) {
+	for _, name := range []string{"nas", "alices-laptop", "db.prod"} {
+		if err := CheckNickname(name); err != nil {
+			t.Errorf("CheckNickname(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "my nas", "a,b", "a=b", "100.64.0.1", "fd7a::1", "123"} {
+		if err := CheckNickname(name); err == nil {
+			t.Errorf("CheckNickname(%q) = nil, want error", name)
+		}
+	}
+}
+
+func TestSetNicknames(t *testing.T) {
+	cidr := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *c
+	}
+	nm := &NetworkMap{
+		Peers: []tailcfg.Node{
+			{ID: 2, Key: tailcfg.NodeKey{2}, Addresses: []wgcfg.CIDR{cidr("100.64.0.2/32")}},
+			{ID: 3, Key: tailcfg.NodeKey{3}, Addresses: []wgcfg.CIDR{cidr("100.64.0.3/32")}},
+			{ID: 4, Key: tailcfg.NodeKey{4}, Addresses: []wgcfg.CIDR{cidr("100.64.0.4/32")}},
+		},
+	}
+	prefs := &Prefs{Nicknames: map[string]string{
+		"nas":    "100.64.0.2",
+		"db":     "3",
+		"backup": "100.64.0.3", // another name for 3, sorts first
+		"gone":   "100.64.0.9",
+	}}
+	st := buildStatus(Running, nm, EngineStatus{}, time.Now())
+	setNicknames(st, nm, prefs)
+
+	want := map[tailcfg.NodeKey]string{
+		{2}: "nas",
+		{3}: "backup",
+		{4}: "",
+	}
+	for k, name := range want {
+		if got := st.Peer[k].Nickname; got != name {
+			t.Errorf("peer %v nickname = %q, want %q", k, got, name)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"tailscale.com/tailcfg"
+)
+
+// scopePeers returns nm restricted to the peers allowed by
+// prefs.PeerTags and prefs.PeerUsers. If prefs doesn't restrict
+// peers, nm is returned unchanged. Otherwise the result is a
+// shallow copy of nm with a new Peers slice; nm is not modified.
+func scopePeers(nm *NetworkMap, prefs *Prefs) *NetworkMap {
+	if nm == nil || prefs == nil || !prefs.HasPeerScope() {
+		return nm
+	}
+	ret := *nm
+	ret.Peers = make([]tailcfg.Node, 0, len(nm.Peers))
+	for _, p := range nm.Peers {
+		if peerInScope(nm, prefs, &p) {
+			ret.Peers = append(ret.Peers, p)
+		}
+	}
+	return &ret
+}
+
+func peerInScope(nm *NetworkMap, prefs *Prefs, p *tailcfg.Node) bool {
+	for _, want := range prefs.PeerTags {
+		for _, tag := range p.Tags {
+			if tag == want {
+				return true
+			}
+		}
+	}
+	if len(prefs.PeerUsers) > 0 {
+		if up, ok := nm.UserProfiles[p.User]; ok {
+			for _, want := range prefs.PeerUsers {
+				if up.LoginName == want {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestScopePeers(t *testing.T) {
+	nm := &NetworkMap{
+		Peers: []tailcfg.Node{
+			{ID: 1, User: 10, Tags: []string{"tag:server"}},
+			{ID: 2, User: 10},
+			{ID: 3, User: 20},
+			{ID: 4, User: 30, Tags: []string{"tag:laptop"}},
+		},
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			10: {ID: 10, LoginName: "alice@example.com"},
+			20: {ID: 20, LoginName: "bob@example.com"},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		prefs *Prefs
+		want  []tailcfg.NodeID
+	}{
+		{"no_scope", &Prefs{}, []tailcfg.NodeID{1, 2, 3, 4}},
+		{"tag", &Prefs{PeerTags: []string{"tag:server"}}, []tailcfg.NodeID{1}},
+		{"user", &Prefs{PeerUsers: []string{"bob@example.com"}}, []tailcfg.NodeID{3}},
+		{"tag_or_user", &Prefs{
+			PeerTags:  []string{"tag:laptop"},
+			PeerUsers: []string{"alice@example.com"},
+		}, []tailcfg.NodeID{1, 2, 4}},
+		{"none_match", &Prefs{PeerTags: []string{"tag:nope"}}, []tailcfg.NodeID{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []tailcfg.NodeID{}
+			for _, p := range scopePeers(nm, tt.prefs).Peers {
+				got = append(got, p.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("peers = %v; want %v", got, tt.want)
+			}
+		})
+	}
+	if len(nm.Peers) != 4 {
+		t.Errorf("scopePeers modified its input")
+	}
+}
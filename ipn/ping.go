@@ -0,0 +1,321 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/packet"
+)
+
+// findPeer returns the peer in nm that s names: a nickname from
+// prefs, one of the peer's Tailscale IPs, its node ID, or its host
+// name, which must be unique.
+func findPeer(nm *NetworkMap, prefs *Prefs, s string) (*tailcfg.Node, error) {
+	ref := s
+	if prefs != nil {
+		if r, ok := prefs.Nicknames[s]; ok {
+			ref = r
+		}
+	}
+	if p := peerByRef(nm, ref); p != nil {
+		return p, nil
+	}
+	var found *tailcfg.Node
+	for i := range nm.Peers {
+		p := &nm.Peers[i]
+		if !strings.EqualFold(p.Hostinfo.Hostname, s) && !strings.EqualFold(dnsLabel(p.Name), s) {
+			continue
+		}
+		if found != nil && found != p {
+			return nil, fmt.Errorf("%q names more than one peer; use its IP", s)
+		}
+		found = p
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no peer %q", s)
+	}
+	return found, nil
+}
+
+// dnsLabel returns the first label of name.
+func dnsLabel(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+var errNoNetMap = errors.New("no network map yet")
+
+// PingType is a kind of ping, each answering a different question
+// about a peer. See LocalBackend.Ping.
+type PingType string
+
+const (
+	// PingDisco is a path ping beneath WireGuard, answered by the
+	// peer's magicsock on whichever path it arrived. It tests the
+	// paths to the peer, direct and through DERP.
+	PingDisco = PingType("disco")
+	// PingTSMP is a request over the tunnel to the peer's tailscaled,
+	// at its peer API, which the peer's packet filter exempts. It
+	// confirms that WireGuard works both ways and that the peer knows
+	// this node, and reports what the peer's packet filter does with
+	// traffic from it. Peers whose filter lets nothing in from this
+	// node refuse it.
+	PingTSMP = PingType("tsmp")
+	// PingICMP is an ICMP echo request over the tunnel to the peer's
+	// Tailscale IP, answered by its OS. It tests what ordinary
+	// traffic sees, firewalls included.
+	PingICMP = PingType("icmp")
+)
+
+// ParsePingType returns the PingType named s, or PingDisco if s is
+// empty.
+func ParsePingType(s string) (PingType, error) {
+	switch t := PingType(s); t {
+	case "":
+		return PingDisco, nil
+	case PingDisco, PingTSMP, PingICMP:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown ping type %q; want disco, tsmp or icmp", s)
+}
+
+// Ping sends a ping of type typ to peer, named as for findPeer, and
+// reports how long the reply took. For disco pings it reports the
+// path the reply came back on: directly from one of the peer's
+// endpoints, or through DERP. For TSMP pings it reports how the peer
+// sees this node. It waits until ctx is done for the reply.
+func (b *LocalBackend) Ping(ctx context.Context, peer string, typ PingType) (*ipnstate.PingResult, error) {
+	b.mu.Lock()
+	nm := b.netMapCache
+	prefs := b.prefs
+	b.mu.Unlock()
+	if nm == nil {
+		return nil, errNoNetMap
+	}
+	p, err := findPeer(nm, prefs, peer)
+	if err != nil {
+		return nil, err
+	}
+	res := &ipnstate.PingResult{
+		HostName: p.Hostinfo.Hostname,
+	}
+	if typ != PingDisco {
+		res.Type = string(typ)
+	}
+	if len(p.Addresses) > 0 {
+		res.IP = p.Addresses[0].IP.String()
+	} else if typ != PingDisco {
+		return nil, fmt.Errorf("peer %q has no Tailscale IP", peer)
+	}
+
+	switch typ {
+	case PingDisco:
+		pr, err := b.e.Ping(ctx, wgcfg.Key(p.Key))
+		if err != nil {
+			return nil, err
+		}
+		res.Latency = pr.Latency
+		res.DERP = pr.DERP
+		if pr.DERP == "" {
+			res.Endpoint = pr.Addr
+		}
+	case PingTSMP:
+		reply, latency, err := pingTSMP(ctx, res.IP)
+		if err != nil {
+			return nil, err
+		}
+		res.Latency = latency
+		res.SeenAs = reply.SeenAs
+		res.Verdicts = reply.Verdicts
+	case PingICMP:
+		latency, err := pingICMP(ctx, p.Addresses[0].IP.IP())
+		if err != nil {
+			return nil, err
+		}
+		res.Latency = latency
+	default:
+		return nil, fmt.Errorf("unknown ping type %q", typ)
+	}
+	return res, nil
+}
+
+var (
+	errUnknownPeer    = errors.New("not a node in the network map")
+	errPingNotAllowed = errors.New("packet filter allows no traffic from this node")
+)
+
+// PeerPing answers a TSMP ping that arrived over the tunnel from the
+// Tailscale IP src for this node's Tailscale IP dst. It says which node
+// src belongs to, and what the packet filter does with new
+// connections from it: ICMP, and to each of the services this node
+// advertises. It refuses nodes the packet filter lets nothing in
+// from, which only reach the peer API because the filter exempts it.
+func (b *LocalBackend) PeerPing(src, dst wgcfg.IP) (*ipnstate.PeerPingReply, error) {
+	b.mu.Lock()
+	nm := b.netMapCache
+	filt := b.filt
+	hostname := b.hiCache.Hostname
+	services := append([]tailcfg.Service(nil), b.hiCache.Services...)
+	b.mu.Unlock()
+
+	who := whoIs(nm, src)
+	if who == nil {
+		return nil, errUnknownPeer
+	}
+	src4, dst4 := src.IP().To4(), dst.IP().To4()
+	if filt == nil || src4 == nil || dst4 == nil {
+		// The filter only handles IPv4.
+		return nil, errPingNotAllowed
+	}
+	fsrc, fdst := filter.NewIP(src4), filter.NewIP(dst4)
+	verdict := func(proto packet.IPProto, port uint16) string {
+		return strings.ToLower(filt.Check(proto, fsrc, fdst, port).String())
+	}
+	// The filter lets ICMP in from src if it lets anything in, so
+	// a node that may not reach this one learns nothing here.
+	if filt.Check(packet.ICMP, fsrc, fdst, 0) != filter.Accept {
+		return nil, errPingNotAllowed
+	}
+	reply := &ipnstate.PeerPingReply{
+		HostName: hostname,
+		SeenAs:   who.Node.Name,
+		Verdicts: map[string]string{},
+	}
+	reply.Verdicts["icmp"] = verdict(packet.ICMP, 0)
+	for _, s := range services {
+		proto := packet.TCP
+		if s.Proto == tailcfg.UDP {
+			proto = packet.UDP
+		}
+		reply.Verdicts[fmt.Sprintf("%s/%d", s.Proto, s.Port)] = verdict(proto, s.Port)
+	}
+	return reply, nil
+}
+
+// tsmpClient makes TSMP pings. Each one takes a new connection, so
+// that its SYN has to get through the peer's packet filter.
+var tsmpClient = &http.Client{
+	Transport: &http.Transport{DisableKeepAlives: true},
+}
+
+// pingTSMP sends a TSMP ping to the peer API of the node at Tailscale
+// IP ip, and returns its reply and how long it took.
+func pingTSMP(ctx context.Context, ip string) (*ipnstate.PeerPingReply, time.Duration, error) {
+	u := "http://" + net.JoinHostPort(ip, strconv.Itoa(ipnstate.PeerAPIPort)) + ipnstate.PeerAPIPingPath
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	res, err := tsmpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	latency := time.Since(start)
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, 0, fmt.Errorf("peer refused: %s", strings.TrimSpace(string(msg)))
+	}
+	reply := new(ipnstate.PeerPingReply)
+	if err := json.NewDecoder(res.Body).Decode(reply); err != nil {
+		return nil, 0, fmt.Errorf("bad reply from peer: %v", err)
+	}
+	return reply, latency, nil
+}
+
+// pingICMP sends an ICMP echo request to ip and waits for the reply,
+// or for ctx to be done. It needs a raw socket, and so root.
+func pingICMP(ctx context.Context, ip net.IP) (time.Duration, error) {
+	c, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return 0, fmt.Errorf("ICMP ping: %v", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		c.Close()
+	}()
+
+	var idseq [4]byte
+	if _, err := rand.Read(idseq[:]); err != nil {
+		return 0, err
+	}
+	req := icmpEcho(packet.EchoRequest, idseq)
+	start := time.Now()
+	if _, err := c.WriteTo(req, &net.IPAddr{IP: ip}); err != nil {
+		return 0, fmt.Errorf("ICMP ping: %v", err)
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, fmt.Errorf("ICMP ping: %v", err)
+		}
+		// Raw ICMP sockets see every reply to this host, not just
+		// ours, so check it's from ip and for this request.
+		a, ok := from.(*net.IPAddr)
+		if !ok || !a.IP.Equal(ip) || n < 8 || buf[0] != packet.EchoReply {
+			continue
+		}
+		if bytes.Equal(buf[4:8], idseq[:]) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// icmpEcho returns an ICMP echo message of type typ, with identifier
+// and sequence number idseq.
+func icmpEcho(typ uint8, idseq [4]byte) []byte {
+	b := make([]byte, 8, 8+len(pingPayload))
+	b[0] = typ
+	copy(b[4:], idseq[:])
+	b = append(b, pingPayload...)
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(b[2:], ^uint16(sum))
+	return b
+}
+
+// pingPayload is the data in the ICMP pings pingICMP sends.
+const pingPayload = "tailscale ping"
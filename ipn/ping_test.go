@@ -0,0 +1,145 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/packet"
+)
+
+func TestFindPeer(t *testing.T) {
+	cidr := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *c
+	}
+	nm := &NetworkMap{
+		Peers: []tailcfg.Node{
+			{ID: 2, Name: "nas.example.com", Addresses: []wgcfg.CIDR{cidr("100.64.0.2/32")},
+				Hostinfo: tailcfg.Hostinfo{Hostname: "Storage"}},
+			{ID: 3, Name: "laptop.example.com", Addresses: []wgcfg.CIDR{cidr("100.64.0.3/32")},
+				Hostinfo: tailcfg.Hostinfo{Hostname: "laptop"}},
+			{ID: 4, Name: "laptop-2.example.com", Addresses: []wgcfg.CIDR{cidr("100.64.0.4/32")},
+				Hostinfo: tailcfg.Hostinfo{Hostname: "laptop"}},
+		},
+	}
+	prefs := &Prefs{Nicknames: map[string]string{"db": "4"}}
+
+	tests := []struct {
+		s      string
+		wantID tailcfg.NodeID // 0 for an error
+	}{
+		{"db", 4},
+		{"100.64.0.3", 3},
+		{"2", 2},
+		{"storage", 2},
+		{"nas", 2},
+		{"LAPTOP-2", 4},
+		{"laptop", 0}, // ambiguous
+		{"100.64.0.9", 0},
+		{"nope", 0},
+	}
+	for _, tt := range tests {
+		p, err := findPeer(nm, prefs, tt.s)
+		if tt.wantID == 0 {
+			if err == nil {
+				t.Errorf("findPeer(%q) = node %d, want error", tt.s, p.ID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("findPeer(%q): %v", tt.s, err)
+			continue
+		}
+		if p.ID != tt.wantID {
+			t.Errorf("findPeer(%q) = node %d, want %d", tt.s, p.ID, tt.wantID)
+		}
+	}
+}
+
+func TestPeerPing(t *testing.T) {
+	ip := func(s string) wgcfg.IP {
+		return *wgcfg.ParseIP(s)
+	}
+	cidr, _ := wgcfg.ParseCIDR("100.64.0.2/32")
+	cidr3, _ := wgcfg.ParseCIDR("100.64.0.3/32")
+	b := &LocalBackend{
+		netMapCache: &NetworkMap{
+			Peers: []tailcfg.Node{
+				{ID: 2, Name: "nas.example.com", Addresses: []wgcfg.CIDR{*cidr}},
+				{ID: 3, Name: "guest.example.com", Addresses: []wgcfg.CIDR{*cidr3}},
+			},
+		},
+		hiCache: tailcfg.Hostinfo{
+			Hostname: "laptop",
+			Services: []tailcfg.Service{{Proto: tailcfg.TCP, Port: 22}, {Proto: tailcfg.UDP, Port: 53}},
+		},
+		filt: filter.New(filter.Matches{
+			{SrcIPs: []filter.IP{filter.NewIP(net.ParseIP("100.64.0.2"))}, DstPorts: []filter.IPPortRange{
+				{IP: filter.IPAny, Ports: filter.PortRange{First: 22, Last: 22}},
+			}},
+		}),
+	}
+
+	reply, err := b.PeerPing(ip("100.64.0.2"), ip("100.64.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.HostName != "laptop" || reply.SeenAs != "nas.example.com" {
+		t.Errorf("reply from %q seeing us as %q, want laptop and nas.example.com", reply.HostName, reply.SeenAs)
+	}
+	want := map[string]string{"icmp": "accept", "tcp/22": "accept", "udp/53": "drop"}
+	if !reflect.DeepEqual(reply.Verdicts, want) {
+		t.Errorf("verdicts = %v, want %v", reply.Verdicts, want)
+	}
+
+	if _, err := b.PeerPing(ip("100.64.0.9"), ip("100.64.0.1")); err != errUnknownPeer {
+		t.Errorf("PeerPing from unknown peer: err = %v, want errUnknownPeer", err)
+	}
+	if _, err := b.PeerPing(ip("100.64.0.3"), ip("100.64.0.1")); err != errPingNotAllowed {
+		t.Errorf("PeerPing from filtered peer: err = %v, want errPingNotAllowed", err)
+	}
+}
+
+func TestICMPEcho(t *testing.T) {
+	b := icmpEcho(packet.EchoRequest, [4]byte{1, 2, 3, 4})
+	if b[0] != packet.EchoRequest || b[1] != 0 || string(b[4:8]) != "\x01\x02\x03\x04" {
+		t.Fatalf("bad header: % x", b[:8])
+	}
+	// A message with a correct checksum sums to all ones.
+	if len(b)%2 == 1 {
+		b = append(b, 0)
+	}
+	var sum uint32
+	for i := 0; i < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	if sum != 0xffff {
+		t.Errorf("checksum doesn't verify: sum = %#x", sum)
+	}
+}
+
+func TestParsePingType(t *testing.T) {
+	for s, want := range map[string]PingType{"": PingDisco, "disco": PingDisco, "tsmp": PingTSMP, "icmp": PingICMP} {
+		if got, err := ParsePingType(s); err != nil || got != want {
+			t.Errorf("ParsePingType(%q) = %q, %v; want %q", s, got, err, want)
+		}
+	}
+	if _, err := ParsePingType("udp"); err == nil {
+		t.Errorf("ParsePingType(udp) succeeded")
+	}
+}
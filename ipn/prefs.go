@@ -11,19 +11,54 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"tailscale.com/atomicfile"
 	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
 )
 
 // Prefs are the user modifiable settings of the Tailscale node agent.
 type Prefs struct {
-	// ControlURL is the URL of the control server to use.
+	// ControlURL is the URL of the control server to use. It
+	// defaults to DefaultControlURL, but can point to any server
+	// implementing the control protocol.
 	ControlURL string
+	// ControlProxy, if non-empty, is the URL of an HTTP(S) proxy
+	// through which to reach the control server. If empty, the
+	// proxy settings come from the HTTPS_PROXY, HTTP_PROXY and
+	// NO_PROXY environment variables.
+	ControlProxy string
+	// ControlPins, if non-empty, are TLS key pins for the control
+	// server, at least two, one of which must be in the server's
+	// certificate chain. They guard against a public CA issuing a
+	// certificate for the control server to someone else. See
+	// controlclient.CheckPin for the format.
+	ControlPins []string
 	// RouteAll specifies whether to accept subnet and default routes
 	// advertised by other nodes on the Tailscale network.
 	RouteAll bool
+	// RouteAllow and RouteDeny limit the subnet routes accepted
+	// under RouteAll: if RouteAllow is non-empty, only routes
+	// within one of its prefixes are installed, and routes
+	// overlapping any prefix in RouteDeny never are.
+	RouteAllow []wgcfg.CIDR
+	RouteDeny  []wgcfg.CIDR
+	// ExitNodeID and ExitNodeIP select a peer, by node ID or by one
+	// of its Tailscale IPs, to route all of this node's Internet
+	// traffic through. The peer must offer a default route. If both
+	// are set, ExitNodeID wins.
+	ExitNodeID tailcfg.NodeID
+	ExitNodeIP string
+	// ExitNodeDNS, with an exit node in use and CorpDNS, sends DNS
+	// queries for names outside the tailnet through the exit node's
+	// DNS proxy, so that they leave from where the traffic does
+	// rather than from the local network. It needs an exit node
+	// that offers a proxy, see tailcfg.Hostinfo.DNSProxy, and ACLs
+	// that let this node reach the exit node's port 53; otherwise
+	// names outside the tailnet fail to resolve.
+	ExitNodeDNS bool
 	// AllowSingleHosts specifies whether to install routes for each
 	// node IP on the tailscale network, in addition to a route for
 	// the whole network.
@@ -34,7 +69,9 @@ type Prefs struct {
 	// packets stop flowing. What's up with that?
 	AllowSingleHosts bool
 	// CorpDNS specifies whether to install the Tailscale network's
-	// DNS configuration, if it exists.
+	// DNS configuration, if it exists. If false, the OS resolver
+	// settings are left alone (and restored, if they were replaced
+	// earlier), while the rest of the network still works.
 	CorpDNS bool
 	// WantRunning indicates whether networking should be active on
 	// this node.
@@ -43,9 +80,65 @@ type Prefs struct {
 	// on this node. If false, all traffic in and out of this node is
 	// allowed.
 	UsePacketFilter bool
+	// ShieldsUp indicates whether to block all incoming connections,
+	// whatever the packet filter from the control server allows.
+	// Replies to connections this node initiates still get through.
+	ShieldsUp bool
 	// AdvertiseRoutes specifies CIDR prefixes to advertise into the
 	// Tailscale network as reachable through the current node.
 	AdvertiseRoutes []wgcfg.CIDR
+	// AdvertiseTags specifies ACL tags to request for this node,
+	// such as "tag:server". The control server grants only the tags
+	// the node's owner may use; the result is in the netmap.
+	AdvertiseTags []string
+	// PeerTags and PeerUsers, if either is non-empty, restrict the
+	// peers this node will talk to: only peers carrying one of
+	// PeerTags, or owned by a user whose login name is in
+	// PeerUsers, are kept. All other peers are removed from the
+	// network map before the engine is configured, so no packets
+	// are exchanged with them, whatever the server-side ACLs say.
+	PeerTags  []string
+	PeerUsers []string
+	// Nicknames are local names for peers, mapping each nickname to
+	// a peer's node ID or one of its Tailscale IPs. They show up in
+	// status and can stand in for the peer in CLI commands,
+	// whatever names the control server assigns. See CheckNickname.
+	Nicknames map[string]string
+	// Hostname, if non-empty, is reported to the control server as
+	// this node's hostname instead of the operating system's. See
+	// CheckHostname.
+	Hostname string
+	// HideServices stops this node from reporting its listening
+	// services (open ports and their processes) to the control
+	// server.
+	HideServices bool
+	// ServiceInclude and ServiceExclude filter the services that
+	// are reported: if ServiceInclude is non-empty, only services
+	// matching one of its rules are reported, and services matching
+	// a rule in ServiceExclude never are. See CheckServiceRule for
+	// the rule syntax.
+	ServiceInclude []string
+	ServiceExclude []string
+	// ReportHealth, if true, periodically sends a summary of this
+	// node's health (errors, connectivity, version) to the control
+	// server.
+	ReportHealth bool
+	// CheckUpdates, if true, periodically checks whether a newer
+	// release of Tailscale is out on this version's release track,
+	// and tells frontends if so. See package updates.
+	CheckUpdates bool
+	// OperatorUser is a local user, named by username or uid (a SID
+	// on Windows), who may change prefs and log in or out through
+	// the local socket without being root. Other non-root users
+	// only get read-only status. Only the owner may change it.
+	OperatorUser string
+	// ForceDaemon keeps the backend running after its last frontend
+	// disconnects, on platforms where it normally stops then, such
+	// as Windows, where the GUI owns the connection. It's for
+	// machines used as servers, which must stay reachable when no
+	// user is logged in. The backend also starts up by itself after
+	// a restart.
+	ForceDaemon bool
 
 	// NotepadURLs is a debugging setting that opens OAuth URLs in
 	// notepad.exe on Windows, rather than loading them in a browser.
@@ -71,13 +164,119 @@ func (p *Prefs) Pretty() string {
 	} else {
 		pp = "Persist=nil"
 	}
-	return fmt.Sprintf("Prefs{ra=%v mesh=%v dns=%v want=%v notepad=%v pf=%v routes=%v %v}",
-		p.RouteAll, p.AllowSingleHosts, p.CorpDNS, p.WantRunning,
-		p.NotepadURLs, p.UsePacketFilter, p.AdvertiseRoutes, pp)
+	var scope string
+	if p.HasPeerScope() {
+		scope = fmt.Sprintf(" peers=tags%v+users%v", p.PeerTags, p.PeerUsers)
+	}
+	var nicks string
+	if len(p.Nicknames) > 0 {
+		nicks = fmt.Sprintf(" nicknames=%v", p.Nicknames)
+	}
+	var accept string
+	if len(p.RouteAllow) > 0 || len(p.RouteDeny) > 0 {
+		accept = fmt.Sprintf(" accept=+%v-%v", p.RouteAllow, p.RouteDeny)
+	}
+	var exit string
+	if p.ExitNodeID != 0 {
+		exit = fmt.Sprintf(" exit=%d", p.ExitNodeID)
+	} else if p.ExitNodeIP != "" {
+		exit = " exit=" + p.ExitNodeIP
+	}
+	if exit != "" && p.ExitNodeDNS {
+		exit += "+dns"
+	}
+	var tags string
+	if len(p.AdvertiseTags) > 0 {
+		tags = fmt.Sprintf(" tags=%v", p.AdvertiseTags)
+	}
+	var shields string
+	if p.ShieldsUp {
+		shields = " shields=up"
+	}
+	var host string
+	if p.Hostname != "" {
+		host = fmt.Sprintf(" host=%q", p.Hostname)
+	}
+	var services string
+	if p.HideServices {
+		services = " services=hidden"
+	} else if len(p.ServiceInclude) > 0 || len(p.ServiceExclude) > 0 {
+		services = fmt.Sprintf(" services=+%v-%v", p.ServiceInclude, p.ServiceExclude)
+	}
+	var health string
+	if p.ReportHealth {
+		health = " health=report"
+	}
+	var updates string
+	if p.CheckUpdates {
+		updates = " updates=check"
+	}
+	var operator string
+	if p.OperatorUser != "" {
+		operator = fmt.Sprintf(" operator=%q", p.OperatorUser)
+	}
+	var daemon string
+	if p.ForceDaemon {
+		daemon = " unattended"
+	}
+	return fmt.Sprintf("Prefs{ra=%v%s%s mesh=%v dns=%v want=%v notepad=%v pf=%v%s routes=%v%s%s%s%s%s%s%s%s%s %v}",
+		p.RouteAll, accept, exit, p.AllowSingleHosts, p.CorpDNS, p.WantRunning,
+		p.NotepadURLs, p.UsePacketFilter, shields, p.AdvertiseRoutes, tags, scope, nicks, host, services, health, updates, operator, daemon, pp)
 }
 
+// HasPeerScope reports whether p restricts the set of allowed peers.
+// See Prefs.PeerTags.
+func (p *Prefs) HasPeerScope() bool {
+	return len(p.PeerTags) > 0 || len(p.PeerUsers) > 0
+}
+
+// HasExitNode reports whether p selects an exit node.
+// See Prefs.ExitNodeID.
+func (p *Prefs) HasExitNode() bool {
+	return p.ExitNodeID != 0 || p.ExitNodeIP != ""
+}
+
+// AdvertisesExitNode reports whether p offers this node as an exit
+// node, by advertising a default route.
+func (p *Prefs) AdvertisesExitNode() bool {
+	for _, r := range p.AdvertiseRoutes {
+		if r.Mask == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckHostname reports whether name can be Prefs.Hostname: since
+// the control server makes it a DNS label, it must be 1 to 63 ASCII
+// letters, digits and hyphens, and not start or end with a hyphen.
+func CheckHostname(name string) error {
+	if name == "" || len(name) > 63 {
+		return fmt.Errorf("hostname %q must be 1 to 63 characters long", name)
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return fmt.Errorf("hostname %q may only contain letters, digits and hyphens", name)
+		}
+	}
+	if strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") {
+		return fmt.Errorf("hostname %q must not start or end with a hyphen", name)
+	}
+	return nil
+}
+
+// prefsJSON is Prefs without its methods, so it can be embedded for
+// encoding.
+type prefsJSON Prefs
+
+// ToBytes returns the JSON encoding of p for persistent storage,
+// tagged with the current encoding version.
 func (p *Prefs) ToBytes() []byte {
-	data, err := json.MarshalIndent(p, "", "\t")
+	v := struct {
+		Version int
+		*prefsJSON
+	}{prefsVersion(), (*prefsJSON)(p)}
+	data, err := json.MarshalIndent(v, "", "\t")
 	if err != nil {
 		log.Fatalf("Prefs marshal: %v\n", err)
 	}
@@ -94,16 +293,60 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 
 	return p != nil && p2 != nil &&
 		p.ControlURL == p2.ControlURL &&
+		p.ControlProxy == p2.ControlProxy &&
+		compareStrings(p.ControlPins, p2.ControlPins) &&
 		p.RouteAll == p2.RouteAll &&
+		compareIPNets(p.RouteAllow, p2.RouteAllow) &&
+		compareIPNets(p.RouteDeny, p2.RouteDeny) &&
+		p.ExitNodeID == p2.ExitNodeID &&
+		p.ExitNodeIP == p2.ExitNodeIP &&
+		p.ExitNodeDNS == p2.ExitNodeDNS &&
 		p.AllowSingleHosts == p2.AllowSingleHosts &&
 		p.CorpDNS == p2.CorpDNS &&
 		p.WantRunning == p2.WantRunning &&
 		p.NotepadURLs == p2.NotepadURLs &&
 		p.UsePacketFilter == p2.UsePacketFilter &&
+		p.ShieldsUp == p2.ShieldsUp &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
+		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
+		compareStrings(p.PeerTags, p2.PeerTags) &&
+		compareStrings(p.PeerUsers, p2.PeerUsers) &&
+		compareStringMaps(p.Nicknames, p2.Nicknames) &&
+		p.Hostname == p2.Hostname &&
+		p.HideServices == p2.HideServices &&
+		compareStrings(p.ServiceInclude, p2.ServiceInclude) &&
+		compareStrings(p.ServiceExclude, p2.ServiceExclude) &&
+		p.ReportHealth == p2.ReportHealth &&
+		p.CheckUpdates == p2.CheckUpdates &&
+		p.OperatorUser == p2.OperatorUser &&
+		p.ForceDaemon == p2.ForceDaemon &&
 		p.Persist.Equals(p2.Persist)
 }
 
+func compareStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func compareStringMaps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if v2, ok := b[k]; !ok || v2 != v {
+			return false
+		}
+	}
+	return true
+}
+
 func compareIPNets(a, b []wgcfg.CIDR) bool {
 	if len(a) != len(b) {
 		return false
@@ -116,12 +359,15 @@ func compareIPNets(a, b []wgcfg.CIDR) bool {
 	return true
 }
 
+// DefaultControlURL is the URL of Tailscale's own control server.
+const DefaultControlURL = "https://login.tailscale.com"
+
 func NewPrefs() *Prefs {
 	return &Prefs{
 		// Provide default values for options which might be missing
 		// from the json data for any reason. The json can still
 		// override them to false.
-		ControlURL:       "https://login.tailscale.com",
+		ControlURL:       DefaultControlURL,
 		RouteAll:         true,
 		AllowSingleHosts: true,
 		CorpDNS:          true,
@@ -144,7 +390,11 @@ func PrefsFromBytes(b []byte, enforceDefaults bool) (*Prefs, error) {
 		// old-style relaynode config; import it
 		p.Persist = persist
 	} else {
-		err = json.Unmarshal(b, &p)
+		var mb []byte
+		mb, err = migratePrefs(b, prefsMigrations)
+		if err == nil {
+			err = json.Unmarshal(mb, &p)
+		}
 		if err != nil {
 			log.Printf("Prefs parse: %v: %v\n", err, b)
 		}
@@ -6,6 +6,7 @@ package ipn
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
@@ -20,7 +21,7 @@ func fieldsOf(t reflect.Type) (fields []string) {
 }
 
 func TestPrefsEqual(t *testing.T) {
-	prefsHandles := []string{"ControlURL", "RouteAll", "AllowSingleHosts", "CorpDNS", "WantRunning", "UsePacketFilter", "AdvertiseRoutes", "NotepadURLs", "Persist"}
+	prefsHandles := []string{"ControlURL", "ControlProxy", "ControlPins", "RouteAll", "RouteAllow", "RouteDeny", "ExitNodeID", "ExitNodeIP", "ExitNodeDNS", "AllowSingleHosts", "CorpDNS", "WantRunning", "UsePacketFilter", "ShieldsUp", "AdvertiseRoutes", "AdvertiseTags", "PeerTags", "PeerUsers", "Nicknames", "Hostname", "HideServices", "ServiceInclude", "ServiceExclude", "ReportHealth", "CheckUpdates", "OperatorUser", "ForceDaemon", "NotepadURLs", "Persist"}
 	if have := fieldsOf(reflect.TypeOf(Prefs{})); !reflect.DeepEqual(have, prefsHandles) {
 		t.Errorf("Prefs.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, prefsHandles)
@@ -77,6 +78,21 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{RouteAll: true},
 			true,
 		},
+		{
+			&Prefs{ExitNodeID: 1},
+			&Prefs{ExitNodeID: 2},
+			false,
+		},
+		{
+			&Prefs{ExitNodeIP: "100.64.0.1"},
+			&Prefs{ExitNodeIP: "100.64.0.1"},
+			true,
+		},
+		{
+			&Prefs{ExitNodeIP: "100.64.0.1", ExitNodeDNS: true},
+			&Prefs{ExitNodeIP: "100.64.0.1"},
+			false,
+		},
 
 		{
 			&Prefs{AllowSingleHosts: true},
@@ -148,6 +164,16 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{AdvertiseRoutes: nets("192.168.1.0/24", "10.2.0.0/16")},
 			false,
 		},
+		{
+			&Prefs{RouteAllow: nets("10.0.0.0/8")},
+			&Prefs{RouteAllow: nets("10.0.0.0/8")},
+			true,
+		},
+		{
+			&Prefs{RouteDeny: nets("10.0.0.0/8")},
+			&Prefs{RouteDeny: nets("10.0.0.0/16")},
+			false,
+		},
 		{
 			&Prefs{AdvertiseRoutes: nets("192.168.0.0/24", "10.1.0.0/16")},
 			&Prefs{AdvertiseRoutes: nets("192.168.0.0/24", "10.2.0.0/16")},
@@ -159,6 +185,107 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{PeerTags: []string{"tag:a"}},
+			&Prefs{PeerTags: []string{"tag:b"}},
+			false,
+		},
+		{
+			&Prefs{PeerTags: []string{"tag:a"}},
+			&Prefs{PeerTags: []string{"tag:a"}},
+			true,
+		},
+		{
+			&Prefs{PeerUsers: []string{"alice@example.com"}},
+			&Prefs{PeerUsers: nil},
+			false,
+		},
+		{
+			&Prefs{Nicknames: map[string]string{"nas": "100.101.102.103"}},
+			&Prefs{Nicknames: map[string]string{"nas": "100.101.102.104"}},
+			false,
+		},
+		{
+			&Prefs{Nicknames: map[string]string{"nas": "12"}},
+			&Prefs{Nicknames: map[string]string{"nas": "12"}},
+			true,
+		},
+		{
+			&Prefs{Nicknames: map[string]string{}},
+			&Prefs{Nicknames: nil},
+			true,
+		},
+		{
+			&Prefs{ControlProxy: "http://proxy:3128"},
+			&Prefs{ControlProxy: ""},
+			false,
+		},
+		{
+			&Prefs{ControlPins: []string{"sha256/a", "sha256/b"}},
+			&Prefs{ControlPins: []string{"sha256/a", "sha256/c"}},
+			false,
+		},
+		{
+			&Prefs{ShieldsUp: true},
+			&Prefs{ShieldsUp: false},
+			false,
+		},
+		{
+			&Prefs{AdvertiseTags: []string{"tag:a"}},
+			&Prefs{AdvertiseTags: []string{"tag:b"}},
+			false,
+		},
+		{
+			&Prefs{AdvertiseTags: []string{"tag:a"}},
+			&Prefs{AdvertiseTags: []string{"tag:a"}},
+			true,
+		},
+		{
+			&Prefs{Hostname: "foo"},
+			&Prefs{Hostname: "bar"},
+			false,
+		},
+		{
+			&Prefs{Hostname: "foo"},
+			&Prefs{Hostname: "foo"},
+			true,
+		},
+		{
+			&Prefs{HideServices: false},
+			&Prefs{HideServices: true},
+			false,
+		},
+		{
+			&Prefs{ServiceInclude: []string{"22"}},
+			&Prefs{ServiceInclude: []string{"22"}},
+			true,
+		},
+		{
+			&Prefs{ServiceExclude: []string{"proc:sshd"}},
+			&Prefs{ServiceExclude: []string{"tcp:22"}},
+			false,
+		},
+		{
+			&Prefs{ReportHealth: true},
+			&Prefs{ReportHealth: false},
+			false,
+		},
+		{
+			&Prefs{CheckUpdates: true},
+			&Prefs{CheckUpdates: false},
+			false,
+		},
+		{
+			&Prefs{OperatorUser: "alice"},
+			&Prefs{OperatorUser: "bob"},
+			false,
+		},
+		{
+			&Prefs{ForceDaemon: true},
+			&Prefs{ForceDaemon: false},
+			false,
+		},
+
 		{
 			&Prefs{Persist: &controlclient.Persist{}},
 			&Prefs{Persist: &controlclient.Persist{LoginName: "dave"}},
@@ -226,6 +353,19 @@ func TestBasicPrefs(t *testing.T) {
 	checkPrefs(t, p)
 }
 
+func TestCheckHostname(t *testing.T) {
+	for _, name := range []string{"nas", "Alices-Laptop", "db2", strings.Repeat("a", 63)} {
+		if err := CheckHostname(name); err != nil {
+			t.Errorf("CheckHostname(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "my nas", "nas.local", "-nas", "nas-", "caf\u00e9", strings.Repeat("a", 64)} {
+		if err := CheckHostname(name); err == nil {
+			t.Errorf("CheckHostname(%q) = nil, want error", name)
+		}
+	}
+}
+
 func TestPrefsPersist(t *testing.T) {
 	c := controlclient.Persist{
 		LoginName: "test@example.com",
@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// prefsMigration rewrites the JSON encoding of Prefs, given as its
+// top-level object, from one version to the next. It may rename,
+// re-encode or remove fields; fields it doesn't touch carry over
+// unchanged.
+type prefsMigration func(m map[string]json.RawMessage) error
+
+// prefsMigrations[i] migrates persisted Prefs from version i to
+// version i+1, so the current version is len(prefsMigrations).
+//
+// To change the encoding of a field, append a migration here; never
+// edit or remove an existing one, since state files of any older
+// version may still be around.
+var prefsMigrations = []prefsMigration{
+	// 0 -> 1: files written before Prefs were versioned. The
+	// encoding itself didn't change.
+	func(m map[string]json.RawMessage) error { return nil },
+}
+
+// prefsVersion returns the version of the Prefs encoding written by
+// this code.
+func prefsVersion() int {
+	return len(prefsMigrations)
+}
+
+// migratePrefs upgrades the JSON-encoded Prefs b to the newest
+// version known to migrations, which is len(migrations).
+func migratePrefs(b []byte, migrations []prefsMigration) ([]byte, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	v := 0
+	if raw, ok := m["Version"]; ok {
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("prefs version: %v", err)
+		}
+	}
+
+	want := len(migrations)
+	switch {
+	case v == want:
+		return b, nil
+	case v > want || v < 0:
+		// Written by a newer version. Keep the fields we know
+		// about rather than failing, since the alternative is
+		// discarding the user's state altogether.
+		log.Printf("Prefs: unknown version %d (want <= %d), loading anyway\n", v, want)
+		return b, nil
+	}
+	for ; v < want; v++ {
+		if err := migrations[v](m); err != nil {
+			return nil, fmt.Errorf("migrating prefs from version %d: %v", v, err)
+		}
+	}
+	delete(m, "Version")
+	return json.Marshal(m)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMigratePrefs(t *testing.T) {
+	// A made-up history: version 1 renamed Old to New, version 2
+	// turned New into a list.
+	migrations := []prefsMigration{
+		func(m map[string]json.RawMessage) error {
+			if v, ok := m["Old"]; ok {
+				m["New"] = v
+				delete(m, "Old")
+			}
+			return nil
+		},
+		func(m map[string]json.RawMessage) error {
+			if v, ok := m["New"]; ok {
+				m["New"] = json.RawMessage("[" + string(v) + "]")
+			}
+			return nil
+		},
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		want map[string]interface{}
+	}{
+		{"unversioned", `{"Old": "x", "Keep": true}`, map[string]interface{}{"New": []interface{}{"x"}, "Keep": true}},
+		{"v1", `{"Version": 1, "New": "x"}`, map[string]interface{}{"New": []interface{}{"x"}}},
+		{"current", `{"Version": 2, "New": ["x"]}`, map[string]interface{}{"Version": 2.0, "New": []interface{}{"x"}}},
+		{"newer", `{"Version": 7, "Future": 1}`, map[string]interface{}{"Version": 7.0, "Future": 1.0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := migratePrefs([]byte(tt.in), migrations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := migratePrefs([]byte(`{"Version": "one"}`), migrations); err == nil {
+		t.Error("bad version accepted")
+	}
+}
+
+func TestPrefsVersioned(t *testing.T) {
+	p := NewPrefs()
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(p.ToBytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(m["Version"]), fmt.Sprint(prefsVersion()); got != want {
+		t.Errorf("Version = %s, want %s", got, want)
+	}
+
+	// State files from before versioning still load.
+	p2, err := PrefsFromBytes([]byte(`{"ControlURL": "https://example.com", "WantRunning": false}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.ControlURL != "https://example.com" || p2.WantRunning || !p2.RouteAll {
+		t.Errorf("unversioned prefs loaded as %v", p2.Pretty())
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultProfile is the name of the profile that holds the state
+// which existed before any other profile was created.
+const DefaultProfile = "default"
+
+// Profiles describes the login profiles saved under a StateKey.
+//
+// A profile is a complete set of backend state (prefs and node
+// keys), typically for a different account or tailnet. Exactly one
+// profile is current at any time; switching between them does not
+// require logging out or re-authenticating.
+type Profiles struct {
+	Current string   // name of the profile in use
+	Names   []string // all profile names, in creation order
+}
+
+func (p *Profiles) has(name string) bool {
+	for _, n := range p.Names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The current profile's state always lives under the frontend's own
+// StateKey, so that a single-profile setup is stored exactly as
+// before. The other profiles are parked under derived keys, and the
+// list of profiles lives under the index key.
+
+func profilesKey(base StateKey) StateKey {
+	return base + "-profiles"
+}
+
+func profileKey(base StateKey, name string) StateKey {
+	return StateKey(fmt.Sprintf("%s-profile-%s", base, name))
+}
+
+func checkProfileName(name string) error {
+	if name == "" {
+		return errors.New("empty profile name")
+	}
+	if strings.ContainsAny(name, " \t\r\n/\\") {
+		return fmt.Errorf("invalid profile name %q", name)
+	}
+	return nil
+}
+
+// loadProfiles reads the profile index for base from store. If there
+// is none, the existing state is the sole, default profile.
+func loadProfiles(store StateStore, base StateKey) (Profiles, error) {
+	bs, err := store.ReadState(profilesKey(base))
+	if err == ErrStateNotExist {
+		return Profiles{Current: DefaultProfile, Names: []string{DefaultProfile}}, nil
+	}
+	if err != nil {
+		return Profiles{}, err
+	}
+	var p Profiles
+	if err := json.Unmarshal(bs, &p); err != nil {
+		return Profiles{}, fmt.Errorf("profile index: %v", err)
+	}
+	return p, nil
+}
+
+func saveProfiles(store StateStore, base StateKey, p Profiles) error {
+	bs, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return store.WriteState(profilesKey(base), bs)
+}
+
+// switchProfile parks cur, the serialized state of the current
+// profile, and makes name the current profile, creating it if it
+// doesn't exist yet. It returns the state of the new current profile,
+// which is nil for a newly created one.
+func switchProfile(store StateStore, base StateKey, cur []byte, name string) (next []byte, p Profiles, err error) {
+	if err := checkProfileName(name); err != nil {
+		return nil, Profiles{}, err
+	}
+	p, err = loadProfiles(store, base)
+	if err != nil {
+		return nil, Profiles{}, err
+	}
+	if name == p.Current {
+		return cur, p, nil
+	}
+
+	if p.has(name) {
+		next, err = store.ReadState(profileKey(base, name))
+		if err != nil && err != ErrStateNotExist {
+			return nil, Profiles{}, err
+		}
+	} else {
+		p.Names = append(p.Names, name)
+	}
+
+	if err := store.WriteState(profileKey(base, p.Current), cur); err != nil {
+		return nil, Profiles{}, err
+	}
+	if err := store.WriteState(base, next); err != nil {
+		return nil, Profiles{}, err
+	}
+	p.Current = name
+	if err := saveProfiles(store, base, p); err != nil {
+		return nil, Profiles{}, err
+	}
+	return next, p, nil
+}
+
+// deleteProfile removes the named profile and its keys from store.
+// The current profile can't be deleted.
+func deleteProfile(store StateStore, base StateKey, name string) (Profiles, error) {
+	p, err := loadProfiles(store, base)
+	if err != nil {
+		return Profiles{}, err
+	}
+	if name == p.Current {
+		return Profiles{}, fmt.Errorf("can't delete current profile %q", name)
+	}
+	if !p.has(name) {
+		return Profiles{}, fmt.Errorf("no profile %q", name)
+	}
+
+	// StateStore can't remove keys, but overwriting the state is
+	// enough to forget the profile's node keys.
+	if err := store.WriteState(profileKey(base, name), nil); err != nil {
+		return Profiles{}, err
+	}
+	names := p.Names[:0]
+	for _, n := range p.Names {
+		if n != name {
+			names = append(names, n)
+		}
+	}
+	p.Names = names
+	if err := saveProfiles(store, base, p); err != nil {
+		return Profiles{}, err
+	}
+	return p, nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	store := &MemoryStore{}
+	const base = StateKey("user")
+
+	check := func(name string, got Profiles, want Profiles) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+	mustRead := func(id StateKey, want string) {
+		t.Helper()
+		bs, err := store.ReadState(id)
+		if err != nil {
+			t.Fatalf("ReadState(%q): %v", id, err)
+		}
+		if string(bs) != want {
+			t.Errorf("ReadState(%q) = %q, want %q", id, bs, want)
+		}
+	}
+
+	p, err := loadProfiles(store, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("initial", p, Profiles{Current: "default", Names: []string{"default"}})
+
+	next, p, err := switchProfile(store, base, []byte("state-default"), "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != nil {
+		t.Errorf("new profile state = %q, want nil", next)
+	}
+	check("create work", p, Profiles{Current: "work", Names: []string{"default", "work"}})
+	mustRead(profileKey(base, "default"), "state-default")
+
+	next, p, err = switchProfile(store, base, []byte("state-work"), "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(next) != "state-default" {
+		t.Errorf("switch back got state %q, want %q", next, "state-default")
+	}
+	check("switch back", p, Profiles{Current: "default", Names: []string{"default", "work"}})
+	mustRead(base, "state-default")
+	mustRead(profileKey(base, "work"), "state-work")
+
+	if _, err := deleteProfile(store, base, "default"); err == nil {
+		t.Error("deleting the current profile succeeded")
+	}
+	if _, err := deleteProfile(store, base, "nope"); err == nil {
+		t.Error("deleting an unknown profile succeeded")
+	}
+	p, err = deleteProfile(store, base, "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("delete work", p, Profiles{Current: "default", Names: []string{"default"}})
+	mustRead(profileKey(base, "work"), "")
+
+	if _, _, err := switchProfile(store, base, nil, "has space"); err == nil {
+		t.Error("switching to an invalid profile name succeeded")
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// filterRoutes returns nm with the peers' subnet routes limited by
+// prefs.RouteAllow and prefs.RouteDeny. A peer's own addresses and
+// default routes are always kept; default routes are governed by
+// RouteAll and the exit node instead. If prefs has no route lists,
+// nm is returned unchanged. Otherwise the result is a shallow copy
+// of nm; nm is not modified.
+func filterRoutes(nm *NetworkMap, prefs *Prefs, logf logger.Logf) *NetworkMap {
+	if nm == nil || prefs == nil || (len(prefs.RouteAllow) == 0 && len(prefs.RouteDeny) == 0) {
+		return nm
+	}
+	ret := *nm
+	ret.Peers = make([]tailcfg.Node, 0, len(nm.Peers))
+	for _, p := range nm.Peers {
+		var aips []wgcfg.CIDR
+		for _, aip := range p.AllowedIPs {
+			if aip.Mask == 0 || isNodeAddr(&p, aip) || routeAllowed(prefs, aip) {
+				aips = append(aips, aip)
+			} else {
+				logf("filterRoutes: %v: dropping route %v\n", p.Key.AbbrevString(), aip)
+			}
+		}
+		p.AllowedIPs = aips
+		ret.Peers = append(ret.Peers, p)
+	}
+	return &ret
+}
+
+// routeAllowed reports whether r lies within one of prefs.RouteAllow
+// (if there are any) and overlaps none of prefs.RouteDeny.
+func routeAllowed(prefs *Prefs, r wgcfg.CIDR) bool {
+	for _, d := range prefs.RouteDeny {
+		if cidrContains(d, r) || cidrContains(r, d) {
+			return false
+		}
+	}
+	if len(prefs.RouteAllow) == 0 {
+		return true
+	}
+	for _, a := range prefs.RouteAllow {
+		if cidrContains(a, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNodeAddr(p *tailcfg.Node, r wgcfg.CIDR) bool {
+	for _, a := range p.Addresses {
+		if a.Mask == r.Mask && a.IP.Equal(&r.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// cidrContains reports whether every address in b is also in a.
+func cidrContains(a, b wgcfg.CIDR) bool {
+	if a.IP.Is4() != b.IP.Is4() || a.Mask > b.Mask {
+		return false
+	}
+	return a.Contains(&b.IP)
+}
+
+// routeConflicts describes each of nm's peers' subnet routes that
+// overlaps one of the local networks. Such a route either takes over
+// part of the LAN, or is itself shadowed by the LAN's more specific
+// route; either way, some traffic won't go where the user expects.
+// Peer addresses and default routes aren't subnet routes, and local
+// networks holding one of nm's own addresses are the tunnel's.
+func routeConflicts(nm *NetworkMap, local []wgcfg.CIDR) []string {
+	if nm == nil {
+		return nil
+	}
+	var ret []string
+	for _, l := range local {
+		if isOwnNet(nm, l) {
+			continue
+		}
+		for i := range nm.Peers {
+			p := &nm.Peers[i]
+			for _, r := range p.AllowedIPs {
+				if r.Mask == 0 || isNodeAddr(p, r) {
+					continue
+				}
+				if cidrContains(l, r) || cidrContains(r, l) {
+					ret = append(ret, fmt.Sprintf("route %v via %s overlaps local network %v", r, p.Hostinfo.Hostname, l))
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func isOwnNet(nm *NetworkMap, l wgcfg.CIDR) bool {
+	for _, a := range nm.Addresses {
+		if l.Contains(&a.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// localNetworks returns the networks of the up, non-loopback
+// interfaces' addresses.
+func localNetworks(logf logger.Logf) []wgcfg.CIDR {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		logf("localNetworks: %v\n", err)
+		return nil
+	}
+	var ret []wgcfg.CIDR
+	for _, iface := range ifs {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			n := net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}
+			c, err := wgcfg.ParseCIDR(n.String())
+			if err != nil {
+				continue
+			}
+			ret = append(ret, *c)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+)
+
+func TestFilterRoutes(t *testing.T) {
+	nets := func(strs ...string) (ns []wgcfg.CIDR) {
+		for _, s := range strs {
+			n, err := wgcfg.ParseCIDR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns = append(ns, *n)
+		}
+		return ns
+	}
+	nm := &NetworkMap{
+		Peers: []tailcfg.Node{{
+			ID:         1,
+			Addresses:  nets("100.64.0.1/32"),
+			AllowedIPs: nets("100.64.0.1/32", "0.0.0.0/0", "10.1.0.0/16", "10.2.0.0/16", "192.168.0.0/24"),
+		}},
+	}
+
+	tests := []struct {
+		name  string
+		prefs *Prefs
+		want  []wgcfg.CIDR
+	}{
+		{"no_lists", &Prefs{}, nm.Peers[0].AllowedIPs},
+		{"allow", &Prefs{RouteAllow: nets("10.0.0.0/8")},
+			nets("100.64.0.1/32", "0.0.0.0/0", "10.1.0.0/16", "10.2.0.0/16")},
+		{"allow_too_narrow", &Prefs{RouteAllow: nets("10.1.2.0/24")},
+			nets("100.64.0.1/32", "0.0.0.0/0")},
+		{"deny", &Prefs{RouteDeny: nets("10.2.3.0/24")},
+			nets("100.64.0.1/32", "0.0.0.0/0", "10.1.0.0/16", "192.168.0.0/24")},
+		{"allow_and_deny", &Prefs{RouteAllow: nets("10.0.0.0/8"), RouteDeny: nets("10.1.0.0/16")},
+			nets("100.64.0.1/32", "0.0.0.0/0", "10.2.0.0/16")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterRoutes(nm, tt.prefs, t.Logf)
+			if !reflect.DeepEqual(got.Peers[0].AllowedIPs, tt.want) {
+				t.Errorf("routes = %v, want %v", got.Peers[0].AllowedIPs, tt.want)
+			}
+		})
+	}
+	if len(nm.Peers[0].AllowedIPs) != 5 {
+		t.Error("filterRoutes modified its input")
+	}
+}
+
+func TestRouteConflicts(t *testing.T) {
+	nets := func(strs ...string) (ns []wgcfg.CIDR) {
+		for _, s := range strs {
+			n, err := wgcfg.ParseCIDR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns = append(ns, *n)
+		}
+		return ns
+	}
+	nm := &NetworkMap{
+		Addresses: nets("100.64.0.2/32"),
+		Peers: []tailcfg.Node{{
+			ID:         1,
+			Addresses:  nets("100.64.0.1/32"),
+			AllowedIPs: nets("100.64.0.1/32", "0.0.0.0/0", "10.1.0.0/16", "192.168.0.0/24"),
+			Hostinfo:   tailcfg.Hostinfo{Hostname: "router"},
+		}},
+	}
+
+	tests := []struct {
+		name  string
+		local []wgcfg.CIDR
+		want  []string
+	}{
+		{"none", nets("172.16.0.0/12"), nil},
+		{"route_inside_lan", nets("10.0.0.0/8"), []string{"route 10.1.0.0/16 via router overlaps local network 10.0.0.0/8"}},
+		{"lan_inside_route", nets("192.168.0.128/25"), []string{"route 192.168.0.0/24 via router overlaps local network 192.168.0.128/25"}},
+		{"tunnel", nets("100.64.0.0/10"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := routeConflicts(nm, tt.local)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// A Sealer encrypts a FileStore's state file at rest, so the node
+// keys in it are safe even if the file's permissions aren't.
+type Sealer interface {
+	// Name identifies the sealer in the state file, so a file
+	// sealed by one kind of sealer isn't fed to another.
+	Name() string
+	// Seal encrypts and authenticates b.
+	Seal(b []byte) ([]byte, error)
+	// Unseal decrypts b, which was returned by Seal.
+	Unseal(b []byte) ([]byte, error)
+}
+
+// ErrNoKeystore is returned by NewKeystoreSealer on platforms with
+// no keystore to keep state keys in.
+var ErrNoKeystore = errors.New("no platform keystore available")
+
+// sealedMagic starts a sealed state file, followed by the sealer
+// name and a newline. Plaintext state files are JSON objects, which
+// never start with it.
+const sealedMagic = "tailscale-sealed-state:"
+
+// sealFile returns the sealed state file holding b.
+func sealFile(s Sealer, b []byte) ([]byte, error) {
+	sealed, err := s.Seal(b)
+	if err != nil {
+		return nil, fmt.Errorf("sealing state with %s: %v", s.Name(), err)
+	}
+	return append([]byte(sealedMagic+s.Name()+"\n"), sealed...), nil
+}
+
+// isSealedFile reports whether the state file b is sealed.
+func isSealedFile(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(sealedMagic))
+}
+
+// unsealFile returns the contents of the sealed state file b.
+func unsealFile(s Sealer, b []byte) ([]byte, error) {
+	b = b[len(sealedMagic):]
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return nil, errors.New("truncated sealed state file")
+	}
+	name := string(b[:i])
+	if s == nil {
+		return nil, fmt.Errorf("state file is sealed with %s, but no sealer is configured", name)
+	}
+	if name != s.Name() {
+		return nil, fmt.Errorf("state file is sealed with %s, not %s", name, s.Name())
+	}
+	ret, err := s.Unseal(b[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("unsealing state with %s: %v", name, err)
+	}
+	return ret, nil
+}
+
+// Parameters of the passphrase sealer's scrypt key derivation,
+// costing around 100ms on a laptop.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptSalt   = 16
+	aesKeyLength = 32
+)
+
+// passphraseSealer is a Sealer using AES-GCM with a key derived from
+// a passphrase.
+type passphraseSealer struct {
+	passphrase []byte
+
+	mu   sync.Mutex
+	salt []byte // salt of key
+	key  []byte // derived from passphrase and salt, or nil
+}
+
+// NewPassphraseSealer returns a Sealer that encrypts with a key
+// derived from passphrase.
+func NewPassphraseSealer(passphrase []byte) (Sealer, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return &passphraseSealer{passphrase: append([]byte(nil), passphrase...)}, nil
+}
+
+func (s *passphraseSealer) Name() string { return "passphrase" }
+
+// keyFor returns the key for salt, deriving it only when the salt
+// changes: each state write reuses the salt of the last one.
+func (s *passphraseSealer) keyFor(salt []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key != nil && bytes.Equal(s.salt, salt) {
+		return s.key, nil
+	}
+	key, err := scrypt.Key(s.passphrase, salt, scryptN, scryptR, scryptP, aesKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	s.salt = append([]byte(nil), salt...)
+	s.key = key
+	return key, nil
+}
+
+// Seal returns the salt, then the output of sealGCM.
+func (s *passphraseSealer) Seal(b []byte) ([]byte, error) {
+	s.mu.Lock()
+	salt := s.salt
+	s.mu.Unlock()
+	if salt == nil {
+		salt = make([]byte, scryptSalt)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, err
+		}
+	}
+	key, err := s.keyFor(salt)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealGCM(key, b)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), salt...), sealed...), nil
+}
+
+func (s *passphraseSealer) Unseal(b []byte) ([]byte, error) {
+	if len(b) < scryptSalt {
+		return nil, errors.New("sealed data too short")
+	}
+	key, err := s.keyFor(b[:scryptSalt])
+	if err != nil {
+		return nil, err
+	}
+	return openGCM(key, b[scryptSalt:])
+}
+
+// sealGCM encrypts b with AES-GCM under key, returning the random
+// nonce followed by the ciphertext.
+func sealGCM(key, b []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, b, nil), nil
+}
+
+// openGCM reverses sealGCM.
+func openGCM(key, b []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	ret, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		// The error from cipher is the unhelpful "message
+		// authentication failed".
+		return nil, errors.New("wrong key, or corrupt data")
+	}
+	return ret, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
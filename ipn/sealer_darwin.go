@@ -0,0 +1,73 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// The keychain item holding the state key.
+const (
+	keychainService = "Tailscale state key"
+	keychainAccount = "tailscaled"
+	keychainPath    = "/Library/Keychains/System.keychain"
+)
+
+// keychainSealer is a Sealer using AES-GCM with a random key kept in
+// the system keychain.
+type keychainSealer struct {
+	key []byte
+}
+
+// NewKeystoreSealer returns a Sealer that keeps its key in the
+// platform keystore: the system keychain on macOS. The key is
+// created on first use.
+func NewKeystoreSealer() (Sealer, error) {
+	key, err := keychainKey()
+	if err != nil {
+		return nil, fmt.Errorf("keychain: %v", err)
+	}
+	return keychainSealer{key: key}, nil
+}
+
+func (keychainSealer) Name() string                      { return "keychain" }
+func (s keychainSealer) Seal(b []byte) ([]byte, error)   { return sealGCM(s.key, b) }
+func (s keychainSealer) Unseal(b []byte) ([]byte, error) { return openGCM(s.key, b) }
+
+// keychainKey returns the state key from the keychain, adding a new
+// one if there isn't one yet.
+func keychainKey() ([]byte, error) {
+	out, err := exec.Command("security", "find-generic-password",
+		"-s", keychainService, "-a", keychainAccount, "-w", keychainPath).Output()
+	if err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(out)))
+	}
+	if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != 44 {
+		// 44 is errSecItemNotFound; anything else is a real failure.
+		return nil, err
+	}
+
+	key := make([]byte, aesKeyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	// Pass the key on stdin in interactive mode, rather than in
+	// argv where other users could see it.
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -s %q -a %q -w %s %s\n",
+		keychainService, keychainAccount, hex.EncodeToString(key), keychainPath))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("adding key: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return key, nil
+}
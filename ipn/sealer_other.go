@@ -0,0 +1,16 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows,!darwin
+
+package ipn
+
+// NewKeystoreSealer returns a Sealer that keeps its key in the
+// platform keystore. There's none here that outlives a reboot (the
+// Linux kernel keyring is in memory only, so a key kept there would
+// leave the state unreadable after a restart), so it returns
+// ErrNoKeystore; use NewPassphraseSealer instead.
+func NewKeystoreSealer() (Sealer, error) {
+	return nil, ErrNoKeystore
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// dpapiSealer is a Sealer using DPAPI, which ties the data to the
+// user running tailscaled, usually LocalSystem.
+type dpapiSealer struct{}
+
+// NewKeystoreSealer returns a Sealer that keeps its key in the
+// platform keystore: DPAPI on Windows.
+func NewKeystoreSealer() (Sealer, error) {
+	return dpapiSealer{}, nil
+}
+
+func (dpapiSealer) Name() string { return "dpapi" }
+
+func (dpapiSealer) Seal(b []byte) ([]byte, error) {
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(newBlob(b), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, err
+	}
+	return takeBlob(&out), nil
+}
+
+func (dpapiSealer) Unseal(b []byte) ([]byte, error) {
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(newBlob(b), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, err
+	}
+	return takeBlob(&out), nil
+}
+
+func newBlob(b []byte) *windows.DataBlob {
+	if len(b) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(b)), Data: &b[0]}
+}
+
+// takeBlob copies out the contents of a DataBlob returned by DPAPI,
+// and frees it.
+func takeBlob(blob *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(blob.Data)))
+	if blob.Size == 0 {
+		return nil
+	}
+	return append([]byte(nil), (*[1 << 30]byte)(unsafe.Pointer(blob.Data))[:blob.Size:blob.Size]...)
+}
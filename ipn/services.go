@@ -0,0 +1,115 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+// serviceRule matches listening services, either by protocol and
+// port range or by process name.
+type serviceRule struct {
+	proto   tailcfg.ServiceProto // "" matches any protocol
+	lo, hi  uint16               // inclusive port range
+	process string               // if non-empty, match by process instead
+}
+
+// CheckServiceRule validates a rule for Prefs.ServiceInclude and
+// Prefs.ServiceExclude. A rule is a port ("22"), a port range
+// ("8000-8999"), either of those restricted to one protocol
+// ("udp:5000-5010", "tcp:*"), or a process name ("proc:postgres").
+func CheckServiceRule(s string) error {
+	_, err := parseServiceRule(s)
+	return err
+}
+
+func parseServiceRule(s string) (serviceRule, error) {
+	var r serviceRule
+	if strings.HasPrefix(s, "proc:") {
+		r.process = strings.TrimPrefix(s, "proc:")
+		if r.process == "" {
+			return r, fmt.Errorf("service rule %q: empty process name", s)
+		}
+		return r, nil
+	}
+
+	ports := s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		r.proto = tailcfg.ServiceProto(s[:i])
+		ports = s[i+1:]
+		if r.proto != tailcfg.TCP && r.proto != tailcfg.UDP {
+			return r, fmt.Errorf("service rule %q: protocol must be tcp or udp", s)
+		}
+	}
+	if ports == "*" {
+		r.lo, r.hi = 0, 65535
+		return r, nil
+	}
+	lo, hi := ports, ports
+	if i := strings.IndexByte(ports, '-'); i >= 0 {
+		lo, hi = ports[:i], ports[i+1:]
+	}
+	l, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return r, fmt.Errorf("service rule %q: invalid port %q", s, lo)
+	}
+	h, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return r, fmt.Errorf("service rule %q: invalid port %q", s, hi)
+	}
+	if l > h {
+		return r, fmt.Errorf("service rule %q: empty port range", s)
+	}
+	r.lo, r.hi = uint16(l), uint16(h)
+	return r, nil
+}
+
+func (r serviceRule) match(s tailcfg.Service) bool {
+	if r.process != "" {
+		return strings.EqualFold(r.process, s.Description)
+	}
+	if r.proto != "" && r.proto != s.Proto {
+		return false
+	}
+	return r.lo <= s.Port && s.Port <= r.hi
+}
+
+// matchAny reports whether s matches any of rules, ignoring rules
+// that don't parse.
+func matchAny(rules []string, s tailcfg.Service) bool {
+	for _, rs := range rules {
+		r, err := parseServiceRule(rs)
+		if err == nil && r.match(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterServices returns the services from sl that prefs allow
+// reporting to the control server. A nil prefs allows them all.
+func filterServices(sl []tailcfg.Service, prefs *Prefs) []tailcfg.Service {
+	if prefs == nil {
+		return sl
+	}
+	if prefs.HideServices {
+		return nil
+	}
+	var ret []tailcfg.Service
+	for _, s := range sl {
+		if len(prefs.ServiceInclude) > 0 && !matchAny(prefs.ServiceInclude, s) {
+			continue
+		}
+		if matchAny(prefs.ServiceExclude, s) {
+			continue
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
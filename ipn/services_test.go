@@ -0,0 +1,55 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestCheckServiceRule(t *testing.T) {
+	for _, s := range []string{"22", "8000-8999", "tcp:22", "udp:*", "*", "proc:nginx"} {
+		if err := CheckServiceRule(s); err != nil {
+			t.Errorf("CheckServiceRule(%q) = %v, want nil", s, err)
+		}
+	}
+	for _, s := range []string{"", "x", "70000", "9-1", "icmp:1", "tcp:", "proc:", "1-"} {
+		if err := CheckServiceRule(s); err == nil {
+			t.Errorf("CheckServiceRule(%q) = nil, want error", s)
+		}
+	}
+}
+
+func TestFilterServices(t *testing.T) {
+	ssh := tailcfg.Service{Proto: tailcfg.TCP, Port: 22, Description: "sshd"}
+	web := tailcfg.Service{Proto: tailcfg.TCP, Port: 8080, Description: "nginx"}
+	dns := tailcfg.Service{Proto: tailcfg.UDP, Port: 5353, Description: "avahi"}
+	all := []tailcfg.Service{ssh, web, dns}
+
+	tests := []struct {
+		name  string
+		prefs *Prefs
+		want  []tailcfg.Service
+	}{
+		{"nil_prefs", nil, all},
+		{"no_rules", &Prefs{}, all},
+		{"hidden", &Prefs{HideServices: true, ServiceInclude: []string{"*"}}, nil},
+		{"include_port", &Prefs{ServiceInclude: []string{"22"}}, []tailcfg.Service{ssh}},
+		{"include_range", &Prefs{ServiceInclude: []string{"8000-8999"}}, []tailcfg.Service{web}},
+		{"include_proto", &Prefs{ServiceInclude: []string{"udp:*"}}, []tailcfg.Service{dns}},
+		{"exclude_proc", &Prefs{ServiceExclude: []string{"proc:NGINX"}}, []tailcfg.Service{ssh, dns}},
+		{"include_and_exclude", &Prefs{ServiceInclude: []string{"tcp:*"}, ServiceExclude: []string{"22"}}, []tailcfg.Service{web}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterServices(all, tt.prefs)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
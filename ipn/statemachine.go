@@ -0,0 +1,120 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// stateInputs is everything the state machine looks at to pick the
+// backend's next state. LocalBackend.stateInputs gathers them, so
+// that nextState itself is a pure function.
+type stateInputs struct {
+	haveNetMap        bool // a network map arrived since the last login or logout
+	authCantContinue  bool // login is waiting for the user
+	loggedOut         bool // the user logged out, and hasn't logged in since
+	wantRunning       bool // Prefs.WantRunning
+	keyExpired        bool // the network map's node key expiry has passed
+	machineAuthorized bool // the control server authorized this machine
+	liveEngine        bool // the engine has a peer with a recent handshake
+}
+
+// keepState, as a stateRule's next state, leaves the state alone.
+const keepState = State(-1)
+
+// stateRule is one row of the state machine: in any of the states
+// from, or in any state at all if from is empty, if when holds for
+// the inputs, the backend goes to next.
+type stateRule struct {
+	name string
+	from []State
+	when func(stateInputs) bool
+	next State
+}
+
+func always(stateInputs) bool { return true }
+
+// stateRules is the state machine. The first rule that matches
+// picks the next state, so the rules that apply in every state come
+// first, and within one state the more specific ones win.
+var stateRules = []stateRule{
+	{"logged out", nil, func(in stateInputs) bool { return !in.haveNetMap && in.loggedOut }, NeedsLogin},
+	{"login needs the user", nil, func(in stateInputs) bool { return !in.haveNetMap && in.authCantContinue }, NeedsLogin},
+	{"waiting for login", nil, func(in stateInputs) bool { return !in.haveNetMap }, keepState},
+	{"stopped by prefs", nil, func(in stateInputs) bool { return !in.wantRunning }, Stopped},
+	{"node key expired", nil, func(in stateInputs) bool { return in.keyExpired }, NeedsLogin},
+	{"machine not authorized", nil, func(in stateInputs) bool { return !in.machineAuthorized }, NeedsMachineAuth},
+	{"machine authorized", []State{NeedsMachineAuth}, always, Starting},
+	{"tunnel up", []State{Starting}, func(in stateInputs) bool { return in.liveEngine }, Running},
+	{"waiting for tunnel", []State{Starting}, always, keepState},
+	{"still running", []State{Running}, always, keepState},
+	{"ready", nil, always, Starting},
+}
+
+// nextState returns the state that the backend in state cur moves to
+// given in, and the name of the rule that decided it.
+func nextState(cur State, in stateInputs) (State, string) {
+	for _, r := range stateRules {
+		if !r.applies(cur) || !r.when(in) {
+			continue
+		}
+		if r.next == keepState {
+			return cur, r.name
+		}
+		return r.next, r.name
+	}
+	// Unreachable, the last rule always matches.
+	return cur, "no rule"
+}
+
+func (r *stateRule) applies(s State) bool {
+	if len(r.from) == 0 {
+		return true
+	}
+	for _, f := range r.from {
+		if f == s {
+			return true
+		}
+	}
+	return false
+}
+
+// stateEvent is a state change, as recorded in the event log.
+type stateEvent struct {
+	When     time.Time
+	From, To State
+	Why      string // the stateRule's name, or what forced the change
+}
+
+func (ev stateEvent) String() string {
+	return fmt.Sprintf("%s %v -> %v (%s)", ev.When.Format("15:04:05.000"), ev.From, ev.To, ev.Why)
+}
+
+// stateLogSize is how many state changes the event log keeps.
+const stateLogSize = 32
+
+// stateLog is the recent history of state changes, oldest first, for
+// debugging transitions after the fact.
+type stateLog struct {
+	events []stateEvent
+}
+
+func (l *stateLog) add(ev stateEvent) {
+	if len(l.events) == stateLogSize {
+		copy(l.events, l.events[1:])
+		l.events = l.events[:stateLogSize-1]
+	}
+	l.events = append(l.events, ev)
+}
+
+func (l *stateLog) String() string {
+	var sb strings.Builder
+	for _, ev := range l.events {
+		fmt.Fprintf(&sb, "%v\n", ev)
+	}
+	return sb.String()
+}
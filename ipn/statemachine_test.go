@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextState(t *testing.T) {
+	// ready is a logged-in, authorized node that wants to run.
+	ready := stateInputs{haveNetMap: true, wantRunning: true, machineAuthorized: true}
+	with := func(f func(*stateInputs)) stateInputs {
+		in := ready
+		f(&in)
+		return in
+	}
+	tests := []struct {
+		name string
+		cur  State
+		in   stateInputs
+		want State
+	}{
+		{"fresh start waits for login", NoState, stateInputs{wantRunning: true}, NoState},
+		{"interactive login", NoState, stateInputs{authCantContinue: true}, NeedsLogin},
+		{"logged in", NeedsLogin, ready, Starting},
+		{"tunnel comes up", Starting, with(func(in *stateInputs) { in.liveEngine = true }), Running},
+		{"no peers yet", Starting, ready, Starting},
+		{"peers go idle", Running, ready, Running},
+		{"stopped", Running, with(func(in *stateInputs) { in.wantRunning = false }), Stopped},
+		{"restarted", Stopped, ready, Starting},
+		{"needs machine auth", Starting, with(func(in *stateInputs) { in.machineAuthorized = false }), NeedsMachineAuth},
+		{"machine authorized", NeedsMachineAuth, ready, Starting},
+		{"expiry while running", Running, with(func(in *stateInputs) { in.keyExpired = true }), NeedsLogin},
+		{"expiry while starting", Starting, with(func(in *stateInputs) { in.keyExpired = true; in.liveEngine = true }), NeedsLogin},
+		{"expiry beats machine auth", Starting, with(func(in *stateInputs) { in.keyExpired = true; in.machineAuthorized = false }), NeedsLogin},
+		// Re-authenticating while running keeps the old network
+		// map until the new one arrives.
+		{"re-auth while running", Running, with(func(in *stateInputs) { in.authCantContinue = true }), Running},
+		{"re-auth after logout", Running, stateInputs{authCantContinue: true, wantRunning: true}, NeedsLogin},
+		{"logout, login pending", Running, stateInputs{wantRunning: true}, Running},
+		{"explicit logout", Running, stateInputs{loggedOut: true, wantRunning: true}, NeedsLogin},
+		{"logged out, stopped", Stopped, stateInputs{loggedOut: true}, NeedsLogin},
+		{"login after logout", NeedsLogin, with(func(in *stateInputs) { in.loggedOut = true }), Starting},
+	}
+	for _, tt := range tests {
+		got, why := nextState(tt.cur, tt.in)
+		if got != tt.want {
+			t.Errorf("%s: nextState(%v, %+v) = %v (%s), want %v", tt.name, tt.cur, tt.in, got, why, tt.want)
+		}
+	}
+}
+
+func TestStateLog(t *testing.T) {
+	var l stateLog
+	now := time.Unix(1580000000, 0)
+	for i := 0; i < stateLogSize+5; i++ {
+		l.add(stateEvent{When: now.Add(time.Duration(i) * time.Second), From: Starting, To: Running, Why: "test"})
+	}
+	if len(l.events) != stateLogSize {
+		t.Fatalf("log holds %d events, want %d", len(l.events), stateLogSize)
+	}
+	if first := l.events[0].When; !first.Equal(now.Add(5 * time.Second)) {
+		t.Errorf("oldest event at %v, want the first 5 dropped", first)
+	}
+	if s := l.String(); strings.Count(s, "\n") != stateLogSize || !strings.Contains(s, "Starting -> Running (test)") {
+		t.Errorf("String() = %q", s)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/version"
+)
+
+// onlineHandshakeAge is how recent a peer's last WireGuard handshake
+// must be for it to count as online. WireGuard rekeys active
+// sessions every two minutes and drops keys after three.
+const onlineHandshakeAge = 3 * time.Minute
+
+// buildStatus assembles an ipnstate.Status from the backend state,
+// the latest network map (which may be nil) and engine status.
+func buildStatus(state State, nm *NetworkMap, es EngineStatus, now time.Time) *ipnstate.Status {
+	st := &ipnstate.Status{
+		BackendState: state.String(),
+		DERPHome:     es.DERPHome,
+		NATType:      es.NATType,
+		NetInfo:      es.NetInfo,
+		Peer:         make(map[tailcfg.NodeKey]*ipnstate.PeerStatus),
+		User:         make(map[tailcfg.UserID]tailcfg.UserProfile),
+	}
+	if nm == nil {
+		return st
+	}
+
+	st.TailAddrs = cidrAddrs(nm.Addresses)
+	st.Self = ipnstate.PeerStatus{
+		PublicKey: nm.NodeKey,
+		HostName:  nm.Hostinfo.Hostname,
+		OS:        nm.Hostinfo.OS,
+		UserID:    nm.User,
+		TailAddrs: st.TailAddrs,
+		Tags:      nm.Tags,
+		KeyExpiry: nm.Expiry,
+		Endpoints: append([]string(nil), es.LocalAddrs...),
+		Online:    state == Running,
+	}
+	if !nm.Expiry.IsZero() {
+		st.KeyExpiresIn = nm.Expiry.Sub(now)
+	}
+	for id, up := range nm.UserProfiles {
+		st.User[id] = up
+	}
+
+	for i := range nm.Peers {
+		p := &nm.Peers[i]
+		ps := &ipnstate.PeerStatus{
+			ID:        p.ID,
+			PublicKey: p.Key,
+			HostName:  p.Hostinfo.Hostname,
+			DNSName:   p.Name,
+			OS:        p.Hostinfo.OS,
+			UserID:    p.User,
+			TailAddrs: cidrAddrs(p.Addresses),
+			Tags:      p.Tags,
+			KeyExpiry: p.KeyExpiry,
+			Endpoints: append([]string(nil), p.Endpoints...),
+			Online:    p.Online != nil && *p.Online,
+
+			ExitNodeOption: hasDefaultRoute(p),
+		}
+		if p.LastSeen != nil {
+			ps.LastSeen = *p.LastSeen
+		}
+		if ws, ok := es.LivePeers[p.Key]; ok {
+			ps.CurAddr = ws.CurAddr
+			ps.Relay = ws.DERP
+			ps.RxBytes = int64(ws.RxBytes)
+			ps.TxBytes = int64(ws.TxBytes)
+			ps.LastHandshake = ws.LastHandshake
+			if now.Sub(ws.LastHandshake) < onlineHandshakeAge {
+				ps.Online = true
+			}
+		}
+		st.Peer[p.Key] = ps
+	}
+	return st
+}
+
+// whoIs returns the node in nm, the node itself or one of its peers,
+// that has the Tailscale IP ip, and the user owning it. It returns
+// nil if no node has ip.
+func whoIs(nm *NetworkMap, ip wgcfg.IP) *ipnstate.WhoIsResponse {
+	if nm == nil {
+		return nil
+	}
+	// The network map doesn't carry our own tailcfg.Node, so make
+	// one up from the parts it does have.
+	self := &tailcfg.Node{
+		Key:       nm.NodeKey,
+		User:      nm.User,
+		Addresses: append([]wgcfg.CIDR(nil), nm.Addresses...),
+		Hostinfo:  *nm.Hostinfo.Copy(),
+		KeyExpiry: nm.Expiry,
+		Tags:      append([]string(nil), nm.Tags...),
+	}
+	var n *tailcfg.Node
+	if hasAddr(self, ip.String()) {
+		n = self
+	}
+	for i := 0; n == nil && i < len(nm.Peers); i++ {
+		if hasAddr(&nm.Peers[i], ip.String()) {
+			n = nm.Peers[i].Copy()
+		}
+	}
+	if n == nil {
+		return nil
+	}
+	res := &ipnstate.WhoIsResponse{Node: n}
+	if up, ok := nm.UserProfiles[n.User]; ok {
+		res.UserProfile = &up
+	}
+	return res
+}
+
+// PeerChange is a peer going online or offline.
+// See Notify.PeerChanges.
+type PeerChange struct {
+	Key      tailcfg.NodeKey
+	HostName string
+	Online   bool
+}
+
+// peerChanges compares the online peers in st with prev, the host
+// names of the peers that were online before, keyed by node key. It
+// returns the transitions, sorted by host name, and the new set of
+// online peers. A peer dropped from the network map goes offline.
+func peerChanges(prev map[tailcfg.NodeKey]string, st *ipnstate.Status) ([]PeerChange, map[tailcfg.NodeKey]string) {
+	cur := make(map[tailcfg.NodeKey]string)
+	var changes []PeerChange
+	for k, ps := range st.Peer {
+		if !ps.Online {
+			continue
+		}
+		cur[k] = ps.HostName
+		if _, ok := prev[k]; !ok {
+			changes = append(changes, PeerChange{Key: k, HostName: ps.HostName, Online: true})
+		}
+	}
+	for k, name := range prev {
+		if _, ok := cur[k]; !ok {
+			changes = append(changes, PeerChange{Key: k, HostName: name, Online: false})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].HostName != changes[j].HostName {
+			return changes[i].HostName < changes[j].HostName
+		}
+		return changes[i].Key.String() < changes[j].Key.String()
+	})
+	return changes, cur
+}
+
+// nextPeerTimeout returns when the first handshake of st's online
+// peers gets too old to count, or the zero time if no peer is online
+// by handshake as of now.
+func nextPeerTimeout(st *ipnstate.Status, now time.Time) time.Time {
+	var next time.Time
+	for _, ps := range st.Peer {
+		if !ps.Online || ps.LastHandshake.IsZero() {
+			continue
+		}
+		t := ps.LastHandshake.Add(onlineHandshakeAge)
+		if !t.After(now) {
+			continue
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// healthReport summarizes the backend's health for the control
+// server.
+func healthReport(es EngineStatus, problems []string, engineErrs int, lastEngineErr string) *tailcfg.HealthReport {
+	r := &tailcfg.HealthReport{
+		Version:         version.LONG,
+		Problems:        problems,
+		EngineErrors:    engineErrs,
+		LastEngineError: lastEngineErr,
+		LivePeers:       es.NumLive,
+		NATType:         es.NATType,
+		DERPHome:        es.DERPHome,
+	}
+	for _, p := range es.LivePeers {
+		if p.DERP != "" {
+			r.DERPPeers++
+		}
+	}
+	return r
+}
+
+func cidrAddrs(cidrs []wgcfg.CIDR) []string {
+	var ret []string
+	for _, c := range cidrs {
+		ret = append(ret, c.IP.String())
+	}
+	return ret
+}
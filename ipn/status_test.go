@@ -0,0 +1,227 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine"
+)
+
+func TestBuildStatus(t *testing.T) {
+	now := time.Unix(1580000000, 0)
+	cidr := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *c
+	}
+	self := tailcfg.NodeKey{1}
+	direct := tailcfg.NodeKey{2}
+	relayed := tailcfg.NodeKey{3}
+	idle := tailcfg.NodeKey{4}
+	connected := tailcfg.NodeKey{5}
+	yes := true
+	lastSeen := now.Add(-time.Second)
+
+	nm := &NetworkMap{
+		NodeKey:   self,
+		Addresses: []wgcfg.CIDR{cidr("100.64.0.1/32")},
+		Hostinfo:  tailcfg.Hostinfo{Hostname: "self", OS: "linux"},
+		Peers: []tailcfg.Node{
+			{Key: direct, Name: "direct.example", Addresses: []wgcfg.CIDR{cidr("100.64.0.2/32")}, Endpoints: []string{"1.2.3.4:41641"}, Hostinfo: tailcfg.Hostinfo{Hostname: "direct"}},
+			{Key: relayed, Hostinfo: tailcfg.Hostinfo{Hostname: "relayed"}},
+			{Key: idle, Hostinfo: tailcfg.Hostinfo{Hostname: "idle"}, AllowedIPs: []wgcfg.CIDR{cidr("0.0.0.0/0")}},
+			{Key: connected, Hostinfo: tailcfg.Hostinfo{Hostname: "connected"}, Online: &yes, LastSeen: &lastSeen},
+		},
+	}
+	es := EngineStatus{
+		NATType:    "easy",
+		DERPHome:   "derp.example",
+		LocalAddrs: []string{"5.6.7.8:41641", "192.168.1.2:41641"},
+		LivePeers: map[tailcfg.NodeKey]wgengine.PeerStatus{
+			direct:  {NodeKey: direct, RxBytes: 10, TxBytes: 20, LastHandshake: now.Add(-time.Minute), CurAddr: "1.2.3.4:41641"},
+			relayed: {NodeKey: relayed, LastHandshake: now.Add(-time.Minute), CurAddr: "127.3.3.40:1", DERP: "derp.example"},
+			idle:    {NodeKey: idle, LastHandshake: now.Add(-time.Hour)},
+		},
+	}
+
+	st := buildStatus(Running, nm, es, now)
+	if st.BackendState != "Running" || st.NATType != "easy" || st.DERPHome != "derp.example" {
+		t.Errorf("status header = %q, %q, %q", st.BackendState, st.NATType, st.DERPHome)
+	}
+	if want := []string{"100.64.0.1"}; !reflect.DeepEqual(st.TailAddrs, want) {
+		t.Errorf("TailAddrs = %v, want %v", st.TailAddrs, want)
+	}
+	if st.Self.HostName != "self" || !st.Self.Online {
+		t.Errorf("Self = %+v", st.Self)
+	}
+	if !reflect.DeepEqual(st.Self.Endpoints, es.LocalAddrs) {
+		t.Errorf("Self.Endpoints = %v, want %v", st.Self.Endpoints, es.LocalAddrs)
+	}
+
+	var names []string
+	for _, ps := range st.Peers() {
+		names = append(names, ps.HostName)
+	}
+	if want := []string{"connected", "direct", "idle", "relayed"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Peers() = %v, want %v", names, want)
+	}
+
+	d := st.Peer[direct]
+	if !d.Direct() || !d.Online || d.RxBytes != 10 || d.TxBytes != 20 || d.DNSName != "direct.example" {
+		t.Errorf("direct peer = %+v", d)
+	}
+	if r := st.Peer[relayed]; r.Direct() || r.Relay != "derp.example" || !r.Online {
+		t.Errorf("relayed peer = %+v", r)
+	}
+	if i := st.Peer[idle]; i.Online || !i.ExitNodeOption {
+		t.Errorf("idle peer = %+v, want offline exit node option", i)
+	}
+	if d.ExitNodeOption {
+		t.Errorf("direct peer = %+v, want no exit node option", d)
+	}
+	if c := st.Peer[connected]; !c.Online || !c.LastSeen.Equal(lastSeen) {
+		t.Errorf("peer connected to control = %+v, want online, seen at %v", c, lastSeen)
+	}
+
+	st = buildStatus(NeedsLogin, nil, EngineStatus{}, now)
+	if st.BackendState != "NeedsLogin" || len(st.Peer) != 0 {
+		t.Errorf("status without netmap = %+v", st)
+	}
+}
+
+func TestBuildStatusKeyExpiry(t *testing.T) {
+	now := time.Unix(1580000000, 0)
+	nm := &NetworkMap{Expiry: now.Add(time.Hour)}
+	if got := buildStatus(Running, nm, EngineStatus{}, now).KeyExpiresIn; got != time.Hour {
+		t.Errorf("KeyExpiresIn = %v, want 1h", got)
+	}
+	nm.Expiry = time.Time{}
+	if got := buildStatus(Running, nm, EngineStatus{}, now).KeyExpiresIn; got != 0 {
+		t.Errorf("KeyExpiresIn without expiry = %v, want 0", got)
+	}
+}
+
+func TestWhoIs(t *testing.T) {
+	cidr := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *c
+	}
+	nm := &NetworkMap{
+		NodeKey:   tailcfg.NodeKey{1},
+		Addresses: []wgcfg.CIDR{cidr("100.64.0.1/32")},
+		User:      10,
+		Hostinfo:  tailcfg.Hostinfo{Hostname: "self"},
+		Peers: []tailcfg.Node{
+			{Key: tailcfg.NodeKey{2}, User: 20, Addresses: []wgcfg.CIDR{cidr("100.64.0.2/32")}},
+			{Key: tailcfg.NodeKey{3}, User: 30, Addresses: []wgcfg.CIDR{cidr("100.64.0.3/32"), cidr("fd7a::3/128")}},
+		},
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			10: {ID: 10, LoginName: "me@example.com"},
+			20: {ID: 20, LoginName: "alice@example.com"},
+		},
+	}
+	tests := []struct {
+		ip    string
+		key   tailcfg.NodeKey
+		login string // "" for no profile
+	}{
+		{"100.64.0.1", tailcfg.NodeKey{1}, "me@example.com"},
+		{"100.64.0.2", tailcfg.NodeKey{2}, "alice@example.com"},
+		{"fd7a::3", tailcfg.NodeKey{3}, ""},
+	}
+	for _, tt := range tests {
+		res := whoIs(nm, *wgcfg.ParseIP(tt.ip))
+		if res == nil {
+			t.Errorf("whoIs(%s) = nil", tt.ip)
+			continue
+		}
+		if res.Node.Key != tt.key {
+			t.Errorf("whoIs(%s).Node.Key = %v, want %v", tt.ip, res.Node.Key, tt.key)
+		}
+		var login string
+		if res.UserProfile != nil {
+			login = res.UserProfile.LoginName
+		}
+		if login != tt.login {
+			t.Errorf("whoIs(%s) login = %q, want %q", tt.ip, login, tt.login)
+		}
+	}
+	if res := whoIs(nm, *wgcfg.ParseIP("100.64.0.9")); res != nil {
+		t.Errorf("whoIs(unknown IP) = %+v, want nil", res)
+	}
+	if res := whoIs(nil, *wgcfg.ParseIP("100.64.0.1")); res != nil {
+		t.Errorf("whoIs with no netmap = %+v, want nil", res)
+	}
+}
+
+func TestPeerChanges(t *testing.T) {
+	now := time.Unix(1580000000, 0)
+	a, b, c := tailcfg.NodeKey{1}, tailcfg.NodeKey{2}, tailcfg.NodeKey{3}
+	st := &ipnstate.Status{Peer: map[tailcfg.NodeKey]*ipnstate.PeerStatus{
+		a: {HostName: "a", Online: true, LastHandshake: now.Add(-time.Minute)},
+		b: {HostName: "b", Online: true, LastHandshake: now.Add(-2 * time.Minute)},
+		c: {HostName: "c"},
+	}}
+
+	changes, online := peerChanges(nil, st)
+	want := []PeerChange{{Key: a, HostName: "a", Online: true}, {Key: b, HostName: "b", Online: true}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("first changes = %+v, want %+v", changes, want)
+	}
+	if got, want := nextPeerTimeout(st, now), now.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("nextPeerTimeout = %v, want %v", got, want)
+	}
+
+	if changes, _ := peerChanges(online, st); len(changes) != 0 {
+		t.Errorf("unchanged status gave changes %+v", changes)
+	}
+
+	// b times out, c comes online, and a leaves the network map.
+	st.Peer[b].Online = false
+	st.Peer[c].Online = true
+	delete(st.Peer, a)
+	changes, _ = peerChanges(online, st)
+	want = []PeerChange{{Key: a, HostName: "a", Online: false}, {Key: b, HostName: "b", Online: false}, {Key: c, HostName: "c", Online: true}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %+v, want %+v", changes, want)
+	}
+	if got := nextPeerTimeout(st, now); !got.IsZero() {
+		t.Errorf("nextPeerTimeout without handshakes = %v, want zero", got)
+	}
+}
+
+func TestHealthReport(t *testing.T) {
+	es := EngineStatus{
+		NumLive: 3,
+		LivePeers: map[tailcfg.NodeKey]wgengine.PeerStatus{
+			{1}: {CurAddr: "1.2.3.4:41641"},
+			{2}: {CurAddr: "127.3.3.40:1", DERP: "derp1.tailscale.com"},
+			{3}: {CurAddr: "127.3.3.40:2", DERP: "derp2.tailscale.com"},
+		},
+		NATType:  "hard",
+		DERPHome: "derp1.tailscale.com",
+	}
+	r := healthReport(es, []string{"control: unreachable"}, 2, "boom")
+	if r.LivePeers != 3 || r.DERPPeers != 2 {
+		t.Errorf("peers = %d live, %d DERP; want 3, 2", r.LivePeers, r.DERPPeers)
+	}
+	if r.NATType != "hard" || r.DERPHome != "derp1.tailscale.com" {
+		t.Errorf("netcheck = %q, %q", r.NATType, r.DERPHome)
+	}
+	if r.EngineErrors != 2 || r.LastEngineError != "boom" || len(r.Problems) != 1 || r.Version == "" {
+		t.Errorf("report = %+v", r)
+	}
+}
@@ -7,8 +7,10 @@ package ipn
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 
 	"tailscale.com/atomicfile"
@@ -27,6 +29,30 @@ type StateStore interface {
 	WriteState(id StateKey, bs []byte) error
 }
 
+// NewStateStore returns the StateStore described by spec:
+//
+//	mem:           state kept in memory only, and lost on exit
+//	kube:<secret>  the Kubernetes Secret <secret>, see KubeStore
+//	<path>         a JSON file at <path>, see FileStore
+//
+// If sealer is non-nil, it encrypts the state; only file stores
+// support that.
+func NewStateStore(spec string, sealer Sealer) (StateStore, error) {
+	switch {
+	case spec == "mem:":
+		if sealer != nil {
+			return nil, errors.New("memory state stores aren't sealed")
+		}
+		return &MemoryStore{}, nil
+	case strings.HasPrefix(spec, "kube:"):
+		if sealer != nil {
+			return nil, errors.New("kube: state stores can't be sealed; the Secret is encrypted by the cluster, if configured to")
+		}
+		return NewKubeStore(strings.TrimPrefix(spec, "kube:"))
+	}
+	return NewSealedFileStore(spec, sealer)
+}
+
 // MemoryStore is a store that keeps state in memory only.
 type MemoryStore struct {
 	mu    sync.Mutex
@@ -58,9 +84,11 @@ func (s *MemoryStore) WriteState(id StateKey, bs []byte) error {
 	return nil
 }
 
-// FileStore is a StateStore that uses a JSON file for persistence.
+// FileStore is a StateStore that uses a JSON file for persistence,
+// optionally sealed with a Sealer.
 type FileStore struct {
-	path string
+	path   string
+	sealer Sealer // or nil, to store plaintext
 
 	mu    sync.RWMutex
 	cache map[StateKey][]byte
@@ -68,29 +96,46 @@ type FileStore struct {
 
 // NewFileStore returns a new file store that persists to path.
 func NewFileStore(path string) (*FileStore, error) {
+	return NewSealedFileStore(path, nil)
+}
+
+// NewSealedFileStore returns a new file store that persists to path,
+// encrypted by sealer. If sealer is nil, the state is stored in
+// plaintext. An existing plaintext file is sealed right away.
+func NewSealedFileStore(path string, sealer Sealer) (*FileStore, error) {
+	ret := &FileStore{
+		path:   path,
+		sealer: sealer,
+		cache:  map[StateKey][]byte{},
+	}
 	bs, err := ioutil.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Write out an initial file, to verify that we can write
 			// to the path.
-			if err = atomicfile.WriteFile(path, []byte("{}"), 0600); err != nil {
+			if err := ret.writeLocked(); err != nil {
 				return nil, err
 			}
-			return &FileStore{
-				path:  path,
-				cache: map[StateKey][]byte{},
-			}, nil
+			return ret, nil
 		}
 		return nil, err
 	}
 
-	ret := &FileStore{
-		path:  path,
-		cache: map[StateKey][]byte{},
+	sealed := isSealedFile(bs)
+	if sealed {
+		if bs, err = unsealFile(sealer, bs); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
 	}
 	if err := json.Unmarshal(bs, &ret.cache); err != nil {
 		return nil, err
 	}
+	if sealer != nil && !sealed {
+		// Migrate from plaintext.
+		if err := ret.writeLocked(); err != nil {
+			return nil, err
+		}
+	}
 
 	return ret, nil
 }
@@ -111,9 +156,20 @@ func (s *FileStore) WriteState(id StateKey, bs []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.cache[id] = append([]byte(nil), bs...)
+	return s.writeLocked()
+}
+
+// writeLocked writes s.cache out to s.path. s.mu must be held, or s
+// not yet shared.
+func (s *FileStore) writeLocked() error {
 	bs, err := json.MarshalIndent(s.cache, "", "  ")
 	if err != nil {
 		return err
 	}
+	if s.sealer != nil {
+		if bs, err = sealFile(s.sealer, bs); err != nil {
+			return err
+		}
+	}
 	return atomicfile.WriteFile(s.path, bs, 0600)
 }
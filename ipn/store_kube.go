@@ -0,0 +1,212 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The in-cluster service account credentials, mounted into every pod.
+const (
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeRequestTimeout    = 10 * time.Second
+)
+
+// KubeStore is a StateStore that keeps state in a Kubernetes Secret,
+// so that a containerized node keeps its identity when its pod is
+// replaced. Each StateKey is a key in the Secret's data.
+//
+// The pod's service account needs permission to get, create and
+// patch the Secret.
+type KubeStore struct {
+	secretURL string // the Secret's API URL
+	secret    string // the Secret's name
+	tokenPath string // file holding the bearer token
+	client    *http.Client
+
+	mu sync.Mutex // serializes WriteState's create-or-patch
+}
+
+// NewKubeStore returns a store that keeps state in the Secret named
+// secret, in the namespace of the pod it runs in. It uses the pod's
+// service account to talk to the API server.
+func NewKubeStore(secret string) (*KubeStore, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod: KUBERNETES_SERVICE_HOST and _PORT unset")
+	}
+	ns, err := ioutil.ReadFile(kubeServiceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(kubeServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in the service account ca.crt")
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+		Timeout: kubeRequestTimeout,
+	}
+	api := "https://" + net.JoinHostPort(host, port)
+	return newKubeStore(api, strings.TrimSpace(string(ns)), secret, kubeServiceAccountDir+"/token", client)
+}
+
+func newKubeStore(api, namespace, secret, tokenPath string, client *http.Client) (*KubeStore, error) {
+	if secret == "" {
+		return nil, errors.New("empty Kubernetes secret name")
+	}
+	return &KubeStore{
+		secretURL: fmt.Sprintf("%s/api/v1/namespaces/%s/secrets/", api, url.PathEscape(namespace)),
+		secret:    secret,
+		tokenPath: tokenPath,
+		client:    client,
+	}, nil
+}
+
+// kubeSecret is the part of a v1.Secret that KubeStore uses.
+type kubeSecret struct {
+	APIVersion string            `json:"apiVersion,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Metadata   kubeObjectMeta    `json:"metadata"`
+	Data       map[string][]byte `json:"data"`
+}
+
+type kubeObjectMeta struct {
+	Name string `json:"name,omitempty"`
+}
+
+// kubeStatusError is an unsuccessful response from the API server.
+type kubeStatusError struct {
+	Code int
+	Body string
+}
+
+func (e *kubeStatusError) Error() string {
+	return fmt.Sprintf("kubernetes API: %d %s: %s", e.Code, http.StatusText(e.Code), e.Body)
+}
+
+func isKubeNotFound(err error) bool {
+	se, ok := err.(*kubeStatusError)
+	return ok && se.Code == http.StatusNotFound
+}
+
+// do sends a request with body (if non-nil) to the API server, and
+// decodes the response into out (if non-nil).
+func (s *KubeStore) do(method, u, contentType string, body, out interface{}) error {
+	token, err := ioutil.ReadFile(s.tokenPath)
+	if err != nil {
+		return err
+	}
+	var r io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(bs)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubeRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return &kubeStatusError{Code: res.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// ReadState implements the StateStore interface.
+func (s *KubeStore) ReadState(id StateKey) ([]byte, error) {
+	var sec kubeSecret
+	if err := s.do("GET", s.secretURL+url.PathEscape(s.secret), "", nil, &sec); err != nil {
+		if isKubeNotFound(err) {
+			return nil, ErrStateNotExist
+		}
+		return nil, err
+	}
+	bs, ok := sec.Data[kubeDataKey(id)]
+	if !ok {
+		return nil, ErrStateNotExist
+	}
+	return bs, nil
+}
+
+// WriteState implements the StateStore interface.
+func (s *KubeStore) WriteState(id StateKey, bs []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := map[string][]byte{kubeDataKey(id): bs}
+	patch := struct {
+		Data map[string][]byte `json:"data"`
+	}{data}
+	err := s.do("PATCH", s.secretURL+url.PathEscape(s.secret), "application/merge-patch+json", patch, nil)
+	if !isKubeNotFound(err) {
+		return err
+	}
+	// First write: create the Secret.
+	sec := kubeSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   kubeObjectMeta{Name: s.secret},
+		Data:       data,
+	}
+	return s.do("POST", s.secretURL, "application/json", sec, nil)
+}
+
+// kubeDataKey returns the Secret data key for id. Data keys may only
+// hold alphanumerics, '-', '_' and '.', so other bytes, and '.'
+// itself, are escaped as '.' and two hex digits.
+func kubeDataKey(id StateKey) string {
+	var b strings.Builder
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, ".%02x", c)
+		}
+	}
+	return b.String()
+}
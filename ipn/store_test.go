@@ -5,8 +5,14 @@
 package ipn
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -119,3 +125,151 @@ func TestFileStore(t *testing.T) {
 		}
 	}
 }
+
+func TestSealedFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_ipn_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/state"
+
+	// Start out with a plaintext store.
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteState("nodekey", []byte("secret-key")); err != nil {
+		t.Fatal(err)
+	}
+
+	sealer, err := NewPassphraseSealer([]byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sstore, err := NewSealedFileStore(path, sealer)
+	if err != nil {
+		t.Fatalf("migrating to sealed store: %v", err)
+	}
+	if bs, err := sstore.ReadState("nodekey"); err != nil || string(bs) != "secret-key" {
+		t.Errorf("ReadState after migration = %q, %v", bs, err)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealedFile(raw) || bytes.Contains(raw, []byte("nodekey")) {
+		t.Fatalf("state file not sealed after migration: %q", raw)
+	}
+	testStoreSemantics(t, sstore)
+
+	// Reopen with a fresh sealer, to derive the key again.
+	sealer, _ = NewPassphraseSealer([]byte("hunter2"))
+	sstore, err = NewSealedFileStore(path, sealer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := sstore.ReadState("baz"); err != nil || string(bs) != "quux" {
+		t.Errorf("ReadState after reopening = %q, %v", bs, err)
+	}
+
+	if _, err := NewFileStore(path); err == nil {
+		t.Error("opened sealed store without a sealer")
+	}
+	wrong, _ := NewPassphraseSealer([]byte("hunter3"))
+	if _, err := NewSealedFileStore(path, wrong); err == nil {
+		t.Error("opened sealed store with the wrong passphrase")
+	}
+}
+
+// fakeKubeAPI serves the Secrets API for a single namespace.
+type fakeKubeAPI struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	secrets map[string]map[string][]byte
+}
+
+func (f *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer tok" {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+	const prefix = "/api/v1/namespaces/ns/secrets/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	var sec kubeSecret
+	switch r.Method {
+	case "GET":
+		data, ok := f.secrets[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(kubeSecret{Metadata: kubeObjectMeta{Name: name}, Data: data})
+	case "PATCH":
+		if ct := r.Header.Get("Content-Type"); ct != "application/merge-patch+json" {
+			f.t.Errorf("PATCH Content-Type = %q", ct)
+		}
+		data, ok := f.secrets[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&sec)
+		for k, v := range sec.Data {
+			data[k] = v
+		}
+	case "POST":
+		json.NewDecoder(r.Body).Decode(&sec)
+		if name != "" || sec.Metadata.Name == "" {
+			http.Error(w, "bad create", http.StatusBadRequest)
+			return
+		}
+		if _, ok := f.secrets[sec.Metadata.Name]; ok {
+			http.Error(w, "exists", http.StatusConflict)
+			return
+		}
+		f.secrets[sec.Metadata.Name] = sec.Data
+	}
+}
+
+func TestKubeStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_ipn_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenPath := dir + "/token"
+	if err := ioutil.WriteFile(tokenPath, []byte("tok\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	api := &fakeKubeAPI{t: t, secrets: map[string]map[string][]byte{}}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	store, err := newKubeStore(srv.URL, "ns", "tailscale", tokenPath, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStoreSemantics(t, store)
+
+	if _, err := store.ReadState("_daemon-profile-a.b"); err != ErrStateNotExist {
+		t.Errorf("ReadState of missing key: %v", err)
+	}
+	if err := store.WriteState("_daemon-profile-a.b", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	api.mu.Lock()
+	got := api.secrets["tailscale"]["_daemon-profile-a.2eb"]
+	api.mu.Unlock()
+	if string(got) != "x" {
+		t.Errorf("escaped key not stored, secret = %v", api.secrets)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/updates"
+	"tailscale.com/version"
+)
+
+const (
+	// updateCheckDelay is how long after starting, or after the
+	// prefs turn update checks on, the first check is made, so as
+	// not to compete with connecting.
+	updateCheckDelay = time.Minute
+	// updateCheckInterval is how often the backend checks for a
+	// newer release when the prefs ask it to.
+	updateCheckInterval = 24 * time.Hour
+	// updateCheckTimeout bounds each periodic check.
+	updateCheckTimeout = time.Minute
+	// minUpdateCheckInterval is how often CheckUpdate asks for the
+	// latest release on each track at most. Callers in between get
+	// the latest result, or error, so that local users can't make
+	// the node flood the package server.
+	minUpdateCheckInterval = time.Minute
+)
+
+// updateCheck is the result of a check for updates on one track.
+type updateCheck struct {
+	at   time.Time // when the check started
+	info *ipnstate.UpdateInfo
+	err  error
+}
+
+// CheckUpdate checks whether a release newer than the running one is
+// out on track, or on the running version's own track if track is
+// empty, unless it did less than minUpdateCheckInterval ago. If the
+// prefs ask for update checks, a check on the node's own track is
+// kept for Status, and frontends are told when it finds a new
+// release.
+func (b *LocalBackend) CheckUpdate(ctx context.Context, track string) (*ipnstate.UpdateInfo, error) {
+	if track == "" {
+		track = updates.TrackOf(version.LONG)
+	}
+	if err := updates.CheckTrack(track); err != nil {
+		return nil, err
+	}
+	own := track == updates.TrackOf(version.LONG)
+	now := b.timeNow()
+	b.mu.Lock()
+	last := b.updateInfo
+	recent, ok := b.updateChecks[track]
+	if !ok || now.Sub(recent.at) >= minUpdateCheckInterval {
+		// Claim the check before making it, so that callers
+		// meanwhile don't make their own.
+		if b.updateChecks == nil {
+			b.updateChecks = make(map[string]updateCheck)
+		}
+		b.updateChecks[track] = updateCheck{at: now, err: errUpdateCheckPending}
+		recent = updateCheck{}
+	}
+	b.mu.Unlock()
+
+	info, err := recent.info, recent.err
+	if recent.at.IsZero() {
+		info, err = b.updateCheck(ctx, version.LONG, track)
+		b.mu.Lock()
+		b.updateChecks[track] = updateCheck{at: now, info: info, err: err}
+		b.mu.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !own {
+		return info, nil
+	}
+	b.mu.Lock()
+	if b.prefs == nil || !b.prefs.CheckUpdates {
+		b.mu.Unlock()
+		return info, nil
+	}
+	b.updateInfo = info
+	b.mu.Unlock()
+
+	if info.Available && (last == nil || !last.Available || last.Latest != info.Latest) {
+		b.logf("update available: %s is out; running %s\n", info.Latest, info.Current)
+		b.send(Notify{UpdateAvailable: info})
+	}
+	return info, nil
+}
+
+// errUpdateCheckPending is what CheckUpdate returns while another
+// caller's check of the same track is under way.
+var errUpdateCheckPending = errors.New("an update check is already under way; try again in a minute")
+
+// scheduleUpdateChecks starts or stops the periodic update checks,
+// as the prefs say.
+func (b *LocalBackend) scheduleUpdateChecks() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.prefs == nil || !b.prefs.CheckUpdates {
+		if b.updateTimer != nil {
+			b.updateTimer.Stop()
+			b.updateTimer = nil
+		}
+		b.updateInfo = nil
+		return
+	}
+	if b.updateTimer == nil {
+		b.updateTimer = time.AfterFunc(updateCheckDelay, b.periodicUpdateCheck)
+	}
+}
+
+// periodicUpdateCheck checks for updates, and schedules the next
+// check unless they've been turned off since.
+func (b *LocalBackend) periodicUpdateCheck() {
+	ctx, cancel := context.WithTimeout(context.Background(), updateCheckTimeout)
+	defer cancel()
+	if _, err := b.CheckUpdate(ctx, ""); err != nil {
+		b.logf("[v1] update check: %v\n", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.updateTimer != nil {
+		b.updateTimer.Reset(updateCheckInterval)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+func TestCheckUpdate(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	latest := "1.4.2"
+	checks := 0
+	var notified []string
+	b := &LocalBackend{
+		logf:    t.Logf,
+		prefs:   &Prefs{},
+		timeNow: func() time.Time { return now },
+		notify: func(n Notify) {
+			if n.UpdateAvailable != nil {
+				notified = append(notified, n.UpdateAvailable.Latest)
+			}
+		},
+		updateCheck: func(ctx context.Context, current, track string) (*ipnstate.UpdateInfo, error) {
+			checks++
+			return &ipnstate.UpdateInfo{Current: "1.4.0", Latest: latest, Track: track, Available: true, CheckedAt: now}, nil
+		},
+	}
+	ctx := context.Background()
+	check := func(track string) *ipnstate.UpdateInfo {
+		t.Helper()
+		info, err := b.CheckUpdate(ctx, track)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	// Without the pref, checks are answered but not kept.
+	if info := check(""); info.Latest != "1.4.2" || info.Track != "stable" {
+		t.Errorf("got %+v, want 1.4.2 on stable", info)
+	}
+	if b.Status().Update != nil || len(notified) != 0 {
+		t.Errorf("check without the pref was kept")
+	}
+
+	b.prefs.CheckUpdates = true
+	check("")
+	if st := b.Status(); st.Update == nil || st.Update.Latest != "1.4.2" {
+		t.Errorf("status update = %+v, want 1.4.2", st.Update)
+	}
+	checks = 0
+	check("")
+	if checks != 0 {
+		t.Errorf("a check within minUpdateCheckInterval wasn't answered from the last one")
+	}
+	now = now.Add(2 * minUpdateCheckInterval)
+	check("")
+	latest = "1.4.4"
+	now = now.Add(2 * minUpdateCheckInterval)
+	check("")
+	if want := []string{"1.4.2", "1.4.4"}; len(notified) != 2 || notified[0] != want[0] || notified[1] != want[1] {
+		t.Errorf("notified of %q, want %q", notified, want)
+	}
+
+	// Another track's result doesn't replace the node's own.
+	latest = "1.5.1"
+	if info := check("unstable"); info.Latest != "1.5.1" {
+		t.Errorf("unstable check = %+v, want 1.5.1", info)
+	}
+	if st := b.Status(); st.Update.Latest != "1.4.4" || len(notified) != 2 {
+		t.Errorf("unstable check was kept: status %+v, notified %q", st.Update, notified)
+	}
+
+	// Checks of other tracks are rate-limited too.
+	checks = 0
+	latest = "1.5.2"
+	if info := check("unstable"); info.Latest != "1.5.1" || checks != 0 {
+		t.Errorf("unstable check within minUpdateCheckInterval = %+v after %d checks, want the last one", info, checks)
+	}
+	if _, err := b.CheckUpdate(ctx, "nightly"); err == nil {
+		t.Errorf("check of an unknown track succeeded")
+	}
+	if checks != 0 {
+		t.Errorf("unknown track was checked")
+	}
+}
+
+func TestCheckUpdateErrorRateLimited(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	checks := 0
+	b := &LocalBackend{
+		logf:    t.Logf,
+		timeNow: func() time.Time { return now },
+		updateCheck: func(ctx context.Context, current, track string) (*ipnstate.UpdateInfo, error) {
+			checks++
+			return nil, errors.New("no network")
+		},
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := b.CheckUpdate(context.Background(), "stable"); err == nil {
+			t.Fatal("CheckUpdate succeeded")
+		}
+	}
+	if checks != 1 {
+		t.Errorf("failing check made %d times within minUpdateCheckInterval, want 1", checks)
+	}
+	now = now.Add(minUpdateCheckInterval)
+	b.CheckUpdate(context.Background(), "stable")
+	if checks != 2 {
+		t.Errorf("check not retried after minUpdateCheckInterval")
+	}
+}
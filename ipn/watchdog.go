@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// The liveness watchdog.
+//
+// The backend relies on goroutines in the control client and the
+// engine. If a bug deadlocks one of them, the node quietly stops
+// working until someone restarts the daemon. The watchdog instead
+// probes each of them periodically, and treats a probe that doesn't
+// return in time as a stall: it logs every goroutine's stack, for
+// debugging, and restarts the stalled subsystem. A restart can block
+// on the subsystem it's recovering too, so it runs on its own
+// goroutine, which the watchdog waits for no longer than a probe.
+//
+// Only probes that complete count as progress: a probe that returns
+// early, because its subsystem isn't running yet, doesn't show that
+// anything works, so a round with one doesn't call onAlive.
+const (
+	livenessInterval = time.Minute
+	livenessTimeout  = 30 * time.Second
+)
+
+// livenessProbe is a subsystem that the watchdog checks.
+type livenessProbe struct {
+	name    string
+	probe   func() bool // returns once the subsystem has made progress, or false if there was nothing to check
+	restart func()      // recovers a stalled subsystem
+}
+
+type livenessWatchdog struct {
+	logf     logger.Logf
+	probes   []livenessProbe
+	interval time.Duration
+	timeout  time.Duration
+	quit     chan struct{}
+
+	mu         sync.Mutex
+	onAlive    func()          // called after each round in which every probe completed
+	restarting map[string]bool // probes whose restart hasn't returned
+}
+
+func newLivenessWatchdog(logf logger.Logf, probes ...livenessProbe) *livenessWatchdog {
+	return &livenessWatchdog{
+		logf:     logf,
+		probes:   probes,
+		interval: livenessInterval,
+		timeout:  livenessTimeout,
+		quit:     make(chan struct{}),
+
+		restarting: make(map[string]bool),
+	}
+}
+
+// run checks every probe each interval, until close.
+func (w *livenessWatchdog) run() {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-t.C:
+		}
+		alive := true
+		for _, p := range w.probes {
+			if !w.check(p) {
+				alive = false
+			}
+		}
+		w.mu.Lock()
+		onAlive := w.onAlive
+		w.mu.Unlock()
+		if alive && onAlive != nil {
+			onAlive()
+		}
+	}
+}
+
+func (w *livenessWatchdog) setOnAlive(fn func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onAlive = fn
+}
+
+func (w *livenessWatchdog) close() {
+	close(w.quit)
+}
+
+// check runs p's probe, and restarts its subsystem if the probe
+// doesn't return within the timeout. It reports whether the probe
+// returned in time and found the subsystem making progress.
+//
+// A stalled probe's goroutine stays blocked, as there's no way to
+// interrupt it, but the restart replaces what it's blocked on.
+func (w *livenessWatchdog) check(p livenessProbe) bool {
+	done := make(chan bool, 1)
+	go func() {
+		done <- p.probe()
+	}()
+	t := time.NewTimer(w.timeout)
+	defer t.Stop()
+	select {
+	case ok := <-done:
+		return ok
+	case <-w.quit:
+		return false
+	case <-t.C:
+	}
+
+	buf := new(strings.Builder)
+	pprof.Lookup("goroutine").WriteTo(buf, 1)
+	w.logf("watchdog: %s stalled for %v, stacks:\n%s", p.name, w.timeout, buf.String())
+	w.restart(p)
+	return false
+}
+
+// restart runs p's restart on its own goroutine, and waits for it to
+// return, up to the timeout. If an earlier restart of p still hasn't
+// returned, it doesn't start another.
+func (w *livenessWatchdog) restart(p livenessProbe) {
+	w.mu.Lock()
+	if w.restarting[p.name] {
+		w.mu.Unlock()
+		w.logf("watchdog: %s still restarting\n", p.name)
+		return
+	}
+	w.restarting[p.name] = true
+	w.mu.Unlock()
+
+	w.logf("watchdog: restarting %s\n", p.name)
+	done := make(chan struct{})
+	go func() {
+		p.restart()
+		w.mu.Lock()
+		delete(w.restarting, p.name)
+		w.mu.Unlock()
+		close(done)
+	}()
+	t := time.NewTimer(w.timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-w.quit:
+	case <-t.C:
+		w.logf("watchdog: restarting %s hasn't finished after %v\n", p.name, w.timeout)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLivenessWatchdog(t *testing.T) {
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, format)
+	}
+	w := newLivenessWatchdog(logf)
+	w.timeout = 50 * time.Millisecond
+	defer w.close()
+
+	restarts := 0
+	ok := livenessProbe{"ok", func() bool { return true }, func() { restarts++ }}
+	if !w.check(ok) {
+		t.Error("check of a live probe = false")
+	}
+	idle := livenessProbe{"idle", func() bool { return false }, func() { restarts++ }}
+	if w.check(idle) {
+		t.Error("check of a probe with nothing to check = true")
+	}
+	if restarts != 0 {
+		t.Errorf("live probes restarted %d times", restarts)
+	}
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	stalled := livenessProbe{"stalled", func() bool { <-stuck; return true }, func() { restarts++ }}
+	if w.check(stalled) {
+		t.Error("check of a stalled probe = true")
+	}
+	if restarts != 1 {
+		t.Errorf("stalled probe restarted %d times, want 1", restarts)
+	}
+	mu.Lock()
+	if len(logs) == 0 || !strings.Contains(logs[0], "stacks") {
+		t.Errorf("no goroutine dump logged: %q", logs)
+	}
+	mu.Unlock()
+
+	// A restart that blocks doesn't block the watchdog past the
+	// timeout, and isn't started again while it's blocked.
+	var restartMu sync.Mutex
+	stuckRestarts := 0
+	stuckRestart := livenessProbe{"stuck restart", func() bool { <-stuck; return true }, func() {
+		restartMu.Lock()
+		stuckRestarts++
+		restartMu.Unlock()
+		<-stuck
+	}}
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		if w.check(stuckRestart) {
+			t.Error("check of a stalled probe = true")
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("check with a stuck restart took %v", d)
+		}
+	}
+	restartMu.Lock()
+	defer restartMu.Unlock()
+	if stuckRestarts != 1 {
+		t.Errorf("stuck restart started %d times, want 1", stuckRestarts)
+	}
+}
+
+func TestLivenessWatchdogOnAlive(t *testing.T) {
+	logf := func(format string, args ...interface{}) {}
+	stuck := make(chan struct{})
+	defer close(stuck)
+	var mu sync.Mutex
+	stall := false
+	probe := livenessProbe{"maybe", func() bool {
+		mu.Lock()
+		s := stall
+		mu.Unlock()
+		if s {
+			<-stuck
+		}
+		return true
+	}, func() {}}
+
+	w := newLivenessWatchdog(logf, probe)
+	w.interval = 10 * time.Millisecond
+	w.timeout = 50 * time.Millisecond
+	alive := make(chan bool, 1)
+	w.setOnAlive(func() {
+		select {
+		case alive <- true:
+		default:
+		}
+	})
+	go w.run()
+	defer w.close()
+
+	select {
+	case <-alive:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onAlive not called with a live probe")
+	}
+
+	mu.Lock()
+	stall = true
+	mu.Unlock()
+	// Drain a call from a round that started before the stall.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-alive:
+	default:
+	}
+	select {
+	case <-alive:
+		t.Error("onAlive called with a stalled probe")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
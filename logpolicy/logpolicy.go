@@ -11,6 +11,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -38,6 +39,8 @@ type Policy struct {
 	Logtail logtail.Logger
 	// PublicID is the logger's instance identifier.
 	PublicID logtail.PublicID
+
+	file *rotatingFile // from TeeToFile, if any
 }
 
 // ToBytes returns the JSON representation of c.
@@ -111,6 +114,24 @@ func logsDir() string {
 // New returns a new log policy (a logger and its instance ID) for a
 // given collection name.
 func New(collection string) *Policy {
+	return newPolicy(collection, version.CmdName(), true)
+}
+
+// NewNamed is like New, but names its files on disk, the log ID's
+// config and the upload buffer, after name instead of the program,
+// so that several instances of one program keep them apart.
+func NewNamed(collection, name string) *Policy {
+	return newPolicy(collection, name, true)
+}
+
+// NewInMemory is like New, but keeps nothing on disk, for nodes that
+// must leave no trace: the instance gets a new ID on every run, and
+// logs not yet uploaded are lost when the process exits.
+func NewInMemory(collection string) *Policy {
+	return newPolicy(collection, version.CmdName(), false)
+}
+
+func newPolicy(collection, name string, onDisk bool) *Policy {
 	var lflags int
 	if terminal.IsTerminal(2) || runtime.GOOS == "windows" {
 		lflags = 0
@@ -120,16 +141,14 @@ func New(collection string) *Policy {
 	console := log.New(stderrWriter{}, "", lflags)
 
 	dir := logsDir()
-	cfgPath := filepath.Join(dir, fmt.Sprintf("%s.log.conf", version.CmdName()))
-	var oldc *Config
-	data, err := ioutil.ReadFile(cfgPath)
-	if err != nil {
-		log.Printf("logpolicy.Read %v: %v\n", cfgPath, err)
-		oldc = &Config{}
-		oldc.Collection = collection
-	} else {
-		oldc, err = ConfigFromBytes(data)
+	cfgPath := filepath.Join(dir, fmt.Sprintf("%s.log.conf", name))
+	oldc := &Config{Collection: collection}
+	var err error
+	if onDisk {
+		data, err := ioutil.ReadFile(cfgPath)
 		if err != nil {
+			log.Printf("logpolicy.Read %v: %v\n", cfgPath, err)
+		} else if oldc, err = ConfigFromBytes(data); err != nil {
 			log.Printf("logpolicy.Config unmarshal: %v\n", err)
 			oldc = &Config{}
 		}
@@ -150,7 +169,7 @@ func New(collection string) *Policy {
 		}
 	}
 	newc.PublicID = newc.PrivateID.Public()
-	if newc != *oldc {
+	if newc != *oldc && onDisk {
 		if err := newc.save(cfgPath); err != nil {
 			log.Printf("logpolicy.Config.Save: %v\n", err)
 		}
@@ -169,9 +188,14 @@ func New(collection string) *Policy {
 		},
 	}
 
-	filchBuf, filchErr := filch.New(filepath.Join(dir, version.CmdName()), filch.Options{})
-	if filchBuf != nil {
-		c.Buffer = filchBuf
+	// Without filch, logtail buffers in memory.
+	var filchErr error
+	if onDisk {
+		var filchBuf *filch.Filch
+		filchBuf, filchErr = filch.New(filepath.Join(dir, name), filch.Options{})
+		if filchBuf != nil {
+			c.Buffer = filchBuf
+		}
 	}
 	lw := logtail.Log(c)
 	log.SetFlags(0) // other logflags are set on console, not here
@@ -180,7 +204,7 @@ func New(collection string) *Policy {
 	log.Printf("Program starting: v%v: %#v\n", version.LONG, os.Args)
 	log.Printf("LogID: %v\n", newc.PublicID)
 	if filchErr != nil {
-		log.Printf("filch failed: %v", err)
+		log.Printf("filch failed: %v", filchErr)
 	}
 
 	return &Policy{
@@ -189,6 +213,21 @@ func New(collection string) *Policy {
 	}
 }
 
+// TeeToFile makes the logs also go to the local file at path, with
+// timestamps, rotated whenever it would grow past maxSize bytes. The
+// file doesn't depend on logtail, so it has the logs even where they
+// can't be uploaded.
+func (p *Policy) TeeToFile(path string, maxSize int64) error {
+	f, err := openRotatingFile(path, maxSize)
+	if err != nil {
+		return err
+	}
+	p.file = f
+	fileLog := log.New(f, "", log.LstdFlags|log.Lmicroseconds)
+	log.SetOutput(io.MultiWriter(log.Writer(), logWriter{fileLog}))
+	return nil
+}
+
 // Close immediately shuts down the logger.
 func (p *Policy) Close() {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -199,6 +238,9 @@ func (p *Policy) Close() {
 // Shutdown gracefully shuts down the logger, finishing any current
 // log upload if it can be done before ctx is canceled.
 func (p *Policy) Shutdown(ctx context.Context) error {
+	if p.file != nil {
+		defer p.file.Close()
+	}
 	if p.Logtail != nil {
 		log.Printf("flushing log.\n")
 		return p.Logtail.Shutdown(ctx)
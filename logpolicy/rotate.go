@@ -0,0 +1,108 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotateKeep is how many old log files a rotatingFile keeps, as
+// path.1 (the newest) to path.3.
+const rotateKeep = 3
+
+// rotatingFile is an io.Writer that appends to a local log file,
+// independently of logtail, for machines that can't upload logs or
+// where uploading is off. When the file would grow past its size
+// limit, it's renamed to path.1, moving older ones along, and a new
+// one is started. So at most (rotateKeep+1) times the limit is used.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// openRotatingFile opens the log file at path, creating it if needed,
+// and rotates it whenever it would grow past maxSize bytes.
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid log file size %d", maxSize)
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// rotate moves the current file to path.1, and older ones along, and
+// starts a new one. r.mu must be held.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	for i := rotateKeep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// Write appends buf, which should be whole lines, to the file. Lines
+// aren't split across files.
+func (r *rotatingFile) Write(buf []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.f == nil {
+		// Not open, after a failed rotation; try again.
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.size > 0 && r.size+int64(len(buf)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(buf)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tailscaled.log")
+
+	r, err := openRotatingFile(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10 lines of 20 bytes fill 2 files, and start a third.
+	for i := 0; i < 11; i++ {
+		fmt.Fprintf(r, "line %014d\n", i)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"tailscaled.log":   "line 00000000000010\n",
+		"tailscaled.log.1": "line 00000000000005\nline 00000000000006\nline 00000000000007\nline 00000000000008\nline 00000000000009\n",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	// Reopening appends, and counts what's there.
+	r, err = openRotatingFile(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.size != 20 {
+		t.Errorf("reopened size = %d, want 20", r.size)
+	}
+	if _, err := os.Stat(path + ".4"); !os.IsNotExist(err) {
+		t.Errorf("more than %d old files kept", rotateKeep)
+	}
+}
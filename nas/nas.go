@@ -0,0 +1,187 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nas detects the NAS operating systems that tailscaled runs
+// on as an installed package, Synology DSM and QNAP QTS, and does
+// what it needs there that a regular Linux distribution does for it:
+// it knows where the package keeps its state, makes the TUN device
+// that their kernels don't create, and lets tailscaled's traffic
+// through their built-in firewalls.
+package nas
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"tailscale.com/types/logger"
+)
+
+// Platform is a NAS operating system.
+type Platform string
+
+const (
+	None     = Platform("")         // not a NAS, or one we don't know
+	Synology = Platform("synology") // Synology DSM
+	QNAP     = Platform("qnap")     // QNAP QTS
+)
+
+var (
+	detectOnce sync.Once
+	detected   Platform
+)
+
+// Detect returns the NAS platform that this machine runs, or None.
+func Detect() Platform {
+	detectOnce.Do(func() { detected = detect("/") })
+	return detected
+}
+
+// detect is Detect, looking at the filesystem under root.
+func detect(root string) Platform {
+	have := func(path string) bool {
+		_, err := os.Stat(filepath.Join(root, path))
+		return err == nil
+	}
+	switch {
+	case have("etc.defaults/VERSION") && have("etc/synoinfo.conf"):
+		return Synology
+	case have("etc/config/uLinux.conf"):
+		return QNAP
+	}
+	return None
+}
+
+// StatePath returns where tailscaled keeps its state on p, in the
+// package's own directory, or "" if p is None.
+func (p Platform) StatePath() string {
+	dir := p.dir("/")
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "tailscaled.state")
+}
+
+// SocketPath returns where tailscaled listens for the CLI on p, or ""
+// if p is None.
+func (p Platform) SocketPath() string {
+	switch p {
+	case Synology:
+		return filepath.Join(p.dir("/"), "tailscaled.sock")
+	case QNAP:
+		// QTS has no /run.
+		return "/var/run/tailscale/tailscaled.sock"
+	}
+	return ""
+}
+
+// dir returns the directory of the package's own files on p, with
+// the filesystem under root.
+func (p Platform) dir(root string) string {
+	switch p {
+	case Synology:
+		// DSM 7 only lets packages write to their var
+		// directory; DSM 6 packages kept state in etc.
+		vars := readConf(filepath.Join(root, "etc.defaults/VERSION"), "")
+		if major, err := strconv.Atoi(vars["majorversion"]); err == nil && major < 7 {
+			return "/var/packages/Tailscale/etc"
+		}
+		return "/var/packages/Tailscale/var"
+	case QNAP:
+		// Packages are installed on whichever volume the user
+		// chose, as recorded in qpkg.conf.
+		dir := readConf(filepath.Join(root, "etc/config/qpkg.conf"), "Tailscale")["Install_Path"]
+		if dir == "" {
+			dir = "/share/CACHEDEV1_DATA/.qpkg/Tailscale"
+		}
+		return filepath.Join(dir, "state")
+	}
+	return ""
+}
+
+// readConf reads the key=value lines of the shell-style or INI-style
+// config file at path, those in [section] if section isn't empty.
+// Values lose their quotes. A missing file has no keys.
+func readConf(path, section string) map[string]string {
+	ret := map[string]string{}
+	f, err := os.Open(path)
+	if err != nil {
+		return ret
+	}
+	defer f.Close()
+	in := section == ""
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			in = section != "" && line[1:len(line)-1] == section
+			continue
+		}
+		i := strings.Index(line, "=")
+		if !in || i < 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		ret[k] = strings.Trim(v, `"`)
+	}
+	return ret
+}
+
+// iptables runs iptables with args, and returns its combined output.
+// Tests replace it.
+var iptables = func(args ...string) ([]byte, error) {
+	return exec.Command("iptables", args...).CombinedOutput()
+}
+
+// firewallRules are the iptables rules that let tailscaled's traffic
+// through a NAS firewall: everything over the tunnel interface
+// tunname, and WireGuard's UDP packets on port, unless it's 0, for
+// an automatically chosen port.
+func firewallRules(tunname string, port uint16) [][]string {
+	rules := [][]string{
+		{"INPUT", "-i", tunname, "-j", "ACCEPT"},
+		{"OUTPUT", "-o", tunname, "-j", "ACCEPT"},
+	}
+	if port != 0 {
+		p := strconv.Itoa(int(port))
+		rules = append(rules,
+			[]string{"INPUT", "-p", "udp", "--dport", p, "-j", "ACCEPT"},
+			[]string{"OUTPUT", "-p", "udp", "--sport", p, "-j", "ACCEPT"},
+		)
+	}
+	return rules
+}
+
+// AllowFirewall puts exceptions for tailscaled's traffic, over
+// tunname and on UDP port, at the top of the firewall's rules, where
+// the NAS's own rules can't drop it first. Rules that are already
+// there, such as after a crash, aren't added again. The returned
+// func removes the rules that were added.
+func AllowFirewall(logf logger.Logf, tunname string, port uint16) (remove func()) {
+	var added [][]string
+	for _, rule := range firewallRules(tunname, port) {
+		if _, err := iptables(append([]string{"-C"}, rule...)...); err == nil {
+			continue
+		}
+		if out, err := iptables(append([]string{"-I"}, rule...)...); err != nil {
+			logf("nas: adding firewall rule %v: %v\n%s", rule, err, out)
+			continue
+		}
+		added = append(added, rule)
+	}
+	if port == 0 {
+		logf("nas: no fixed --port, so the firewall may drop direct connections from peers\n")
+	}
+	return func() {
+		for _, rule := range added {
+			if out, err := iptables(append([]string{"-D"}, rule...)...); err != nil {
+				logf("nas: removing firewall rule %v: %v\n%s", rule, err, out)
+			}
+		}
+	}
+}
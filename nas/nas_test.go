@@ -0,0 +1,138 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nas
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeRoot returns a temporary directory holding files, by path
+// relative to it.
+func fakeRoot(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root, err := ioutil.TempDir("", "nas-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    Platform
+		wantDir string
+	}{
+		{
+			name:  "linux",
+			files: map[string]string{"etc/os-release": "ID=debian\n"},
+			want:  None,
+		},
+		{
+			name: "dsm7",
+			files: map[string]string{
+				"etc.defaults/VERSION": "majorversion=\"7\"\nminorversion=\"0\"\n",
+				"etc/synoinfo.conf":    "",
+			},
+			want:    Synology,
+			wantDir: "/var/packages/Tailscale/var",
+		},
+		{
+			name: "dsm6",
+			files: map[string]string{
+				"etc.defaults/VERSION": "majorversion=\"6\"\nminorversion=\"2\"\n",
+				"etc/synoinfo.conf":    "",
+			},
+			want:    Synology,
+			wantDir: "/var/packages/Tailscale/etc",
+		},
+		{
+			name: "qnap",
+			files: map[string]string{
+				"etc/config/uLinux.conf": "",
+				"etc/config/qpkg.conf":   "[Other]\nInstall_Path = /share/X/.qpkg/Other\n\n[Tailscale]\nName = Tailscale\nInstall_Path = /share/MD0_DATA/.qpkg/Tailscale\n",
+			},
+			want:    QNAP,
+			wantDir: "/share/MD0_DATA/.qpkg/Tailscale/state",
+		},
+		{
+			name:    "qnap-unregistered",
+			files:   map[string]string{"etc/config/uLinux.conf": ""},
+			want:    QNAP,
+			wantDir: "/share/CACHEDEV1_DATA/.qpkg/Tailscale/state",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := fakeRoot(t, tt.files)
+			defer os.RemoveAll(root)
+			p := detect(root)
+			if p != tt.want {
+				t.Fatalf("detect = %q, want %q", p, tt.want)
+			}
+			if got := p.dir(root); got != tt.wantDir {
+				t.Errorf("dir = %q, want %q", got, tt.wantDir)
+			}
+		})
+	}
+	if None.StatePath() != "" || None.SocketPath() != "" {
+		t.Errorf("None has paths")
+	}
+}
+
+func TestAllowFirewall(t *testing.T) {
+	have := map[string]bool{"INPUT -i tailscale0 -j ACCEPT": true} // left by a crash
+	var log []string
+	defer func(old func(...string) ([]byte, error)) { iptables = old }(iptables)
+	iptables = func(args ...string) ([]byte, error) {
+		rule := strings.Join(args[1:], " ")
+		log = append(log, strings.Join(args, " "))
+		switch args[0] {
+		case "-C":
+			if !have[rule] {
+				return nil, errors.New("no such rule")
+			}
+		case "-I":
+			have[rule] = true
+		case "-D":
+			delete(have, rule)
+		}
+		return nil, nil
+	}
+
+	remove := AllowFirewall(t.Logf, "tailscale0", 41641)
+	if len(have) != 4 {
+		t.Errorf("after AllowFirewall, rules are %v, want 4", have)
+	}
+	remove()
+	want := map[string]bool{"INPUT -i tailscale0 -j ACCEPT": true}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("after removing, rules are %v, want only the one that was there before", have)
+	}
+
+	log = nil
+	AllowFirewall(t.Logf, "tailscale0", 0)
+	for _, l := range log {
+		if strings.Contains(l, "udp") {
+			t.Errorf("with port 0, ran %q", l)
+		}
+	}
+}
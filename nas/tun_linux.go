@@ -0,0 +1,46 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nas
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"tailscale.com/types/logger"
+)
+
+// tunDevice is the device number of /dev/net/tun: major 10, minor
+// 200.
+const tunDevice = 10<<8 | 200
+
+// EnsureTUN makes /dev/net/tun usable, if it isn't already: NAS
+// kernels ship the tun module without loading it, and without the
+// device node. It loads the module, unless it's built in, and creates
+// the node.
+func EnsureTUN(logf logger.Logf) error {
+	if _, err := os.Stat("/dev/net/tun"); err == nil {
+		return nil
+	}
+	for _, args := range [][]string{
+		{"modprobe", "tun"},
+		{"insmod", "/lib/modules/tun.ko"},
+	} {
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err == nil {
+			break
+		}
+		logf("[v1] nas: %v: %v\n%s", args, err, out)
+	}
+	if err := os.MkdirAll("/dev/net", 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mknod("/dev/net/tun", syscall.S_IFCHR|0600, tunDevice); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("creating /dev/net/tun: %v", err)
+	}
+	logf("nas: created /dev/net/tun\n")
+	return nil
+}
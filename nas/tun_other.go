@@ -0,0 +1,12 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package nas
+
+import "tailscale.com/types/logger"
+
+// EnsureTUN does nothing: the NAS platforms are all Linux.
+func EnsureTUN(logf logger.Logf) error { return nil }
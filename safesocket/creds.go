@@ -0,0 +1,23 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import "errors"
+
+// Creds identifies the user on one end of a local socket connection.
+type Creds struct {
+	// UID is the user's numeric uid on unix, or their SID string on
+	// Windows.
+	UID string
+	// PID is the process ID, or 0 if unknown.
+	PID int
+	// Admin is whether the user is a system administrator: root on
+	// unix, or LocalSystem or an elevated process on Windows.
+	Admin bool
+}
+
+// ErrNoCreds is returned by PeerCreds when the platform or the kind
+// of connection can't identify the peer.
+var ErrNoCreds = errors.New("safesocket: peer credentials not available")
@@ -0,0 +1,64 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build darwin freebsd
+
+package safesocket
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// LOCAL_PEERCRED, at level SOL_LOCAL, has the same value on macOS
+// and FreeBSD; getpeereid is built on it.
+const (
+	solLocal      = 0
+	localPeerCred = 1
+)
+
+// xucred is struct xucred from <sys/ucred.h>. The trailing word is
+// FreeBSD's cr_pid union, which macOS lacks.
+type xucred struct {
+	version uint32
+	uid     uint32
+	ngroups int16
+	groups  [16]uint32
+	_       uintptr
+}
+
+// PeerCreds returns the credentials of the process on the other end
+// of c, which must be a connection accepted from Listen.
+func PeerCreds(c net.Conn) (*Creds, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, ErrNoCreds
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred xucred
+	var cerr error
+	err = raw.Control(func(fd uintptr) {
+		n := uint32(unsafe.Sizeof(cred))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, solLocal, localPeerCred,
+			uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&n)), 0)
+		if errno != 0 {
+			cerr = errno
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cerr != nil {
+		return nil, cerr
+	}
+	return &Creds{
+		UID:   strconv.Itoa(int(cred.uid)),
+		Admin: cred.uid == 0,
+	}, nil
+}
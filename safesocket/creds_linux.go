@@ -0,0 +1,116 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PeerCreds returns the credentials of the process on the other end
+// of c, which must be a connection accepted from Listen, or a TCP
+// connection from the same machine's loopback address. For the
+// latter, only the user is known, not the PID.
+func PeerCreds(c net.Conn) (*Creds, error) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		return loopbackCreds(tc)
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, ErrNoCreds
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var cerr error
+	err = raw.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cerr != nil {
+		return nil, cerr
+	}
+	return &Creds{
+		UID:   strconv.Itoa(int(cred.Uid)),
+		PID:   int(cred.Pid),
+		Admin: cred.Uid == 0,
+	}, nil
+}
+
+// loopbackCreds returns the credentials of the user owning the other
+// end of c, a loopback TCP connection, from the kernel's socket
+// tables.
+func loopbackCreds(c *net.TCPConn) (*Creds, error) {
+	local, ok1 := c.LocalAddr().(*net.TCPAddr)
+	remote, ok2 := c.RemoteAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 || !remote.IP.IsLoopback() {
+		return nil, ErrNoCreds
+	}
+	// The peer's socket is the one whose local address is c's
+	// remote one, and the other way around. An IPv4 connection
+	// from a dual-stack socket is in the IPv6 table.
+	tables := []string{"/proc/net/tcp6"}
+	if remote.IP.To4() != nil {
+		tables = append(tables, "/proc/net/tcp")
+	}
+	for _, table := range tables {
+		uid, err := socketUID(table, procNetAddr(remote, table), procNetAddr(local, table))
+		if err != nil {
+			return nil, err
+		}
+		if uid != "" {
+			return &Creds{UID: uid, Admin: uid == "0"}, nil
+		}
+	}
+	return nil, ErrNoCreds
+}
+
+// socketUID returns the uid owning the socket from local to remote
+// in table, a /proc/net/tcp file, or "" if there's none.
+func socketUID(table, local, remote string) (string, error) {
+	f, err := os.Open(table)
+	if os.IsNotExist(err) {
+		return "", nil // no IPv6
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid ...
+		f := strings.Fields(s.Text())
+		if len(f) > 7 && strings.EqualFold(f[1], local) && strings.EqualFold(f[2], remote) {
+			return f[7], nil
+		}
+	}
+	return "", s.Err()
+}
+
+// procNetAddr formats a as in table: the address as 32-bit words in
+// host byte order, which is little-endian on the platforms Tailscale
+// runs Linux on, then the port, in hex.
+func procNetAddr(a *net.TCPAddr, table string) string {
+	ip := a.IP.To16()
+	if !strings.HasSuffix(table, "6") {
+		ip = a.IP.To4()
+	}
+	var sb strings.Builder
+	for i := 0; i+4 <= len(ip); i += 4 {
+		fmt.Fprintf(&sb, "%08X", binary.LittleEndian.Uint32(ip[i:]))
+	}
+	fmt.Fprintf(&sb, ":%04X", a.Port)
+	return sb.String()
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!windows,!darwin,!freebsd
+
+package safesocket
+
+import "net"
+
+// PeerCreds returns the credentials of the process on the other end
+// of c. It isn't implemented on this platform yet, and always
+// returns ErrNoCreds.
+//
+// TODO: use getpeereid on OpenBSD and NetBSD.
+func PeerCreds(c net.Conn) (*Creds, error) {
+	return nil, ErrNoCreds
+}
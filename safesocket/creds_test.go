@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerCreds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "safesocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, _, err := Listen(filepath.Join(dir, "sock"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := Connect(filepath.Join(dir, "sock"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	creds, err := PeerCreds(s)
+	if err == ErrNoCreds {
+		t.Skip("peer credentials not supported here")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := SelfCreds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.UID != self.UID || creds.Admin != self.Admin {
+		t.Errorf("PeerCreds = %+v, want user of %+v", creds, self)
+	}
+	if creds.PID != os.Getpid() {
+		t.Errorf("PeerCreds PID = %d, want %d", creds.PID, os.Getpid())
+	}
+}
+
+func TestPeerCredsLoopbackTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	creds, err := PeerCreds(s)
+	if err == ErrNoCreds {
+		t.Skip("loopback TCP peer credentials not supported here")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := SelfCreds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.UID != self.UID || creds.Admin != self.Admin {
+		t.Errorf("PeerCreds = %+v, want user of %+v", creds, self)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// PeerCreds returns the credentials of the process on the other end
+// of c, which must be a named pipe connection accepted from Listen.
+// TCP connections can't be identified and return ErrNoCreds.
+func PeerCreds(c net.Conn) (*Creds, error) {
+	pc, ok := c.(*pipeConn)
+	if !ok || !pc.server {
+		return nil, ErrNoCreds
+	}
+	var pid uint32
+	if err := getNamedPipeClientProcessID(pc.h, &pid); err != nil {
+		return nil, err
+	}
+	ph, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(ph)
+	var tok windows.Token
+	if err := windows.OpenProcessToken(ph, windows.TOKEN_QUERY, &tok); err != nil {
+		return nil, err
+	}
+	defer tok.Close()
+	return tokenCreds(tok, int(pid))
+}
+
+// SelfCreds returns the credentials of the current process.
+func SelfCreds() (*Creds, error) {
+	tok, err := windows.OpenCurrentProcessToken()
+	if err != nil {
+		return nil, err
+	}
+	defer tok.Close()
+	return tokenCreds(tok, os.Getpid())
+}
+
+func tokenCreds(tok windows.Token, pid int) (*Creds, error) {
+	tu, err := tok.GetTokenUser()
+	if err != nil {
+		return nil, err
+	}
+	sid := tu.User.Sid
+	return &Creds{
+		UID:   sid.String(),
+		PID:   pid,
+		Admin: sid.IsWellKnown(windows.WinLocalSystemSid) || tok.IsElevated(),
+	}, nil
+}
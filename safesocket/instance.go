@@ -0,0 +1,75 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Several tailscaled instances can run on one machine, each in its
+// own tailnet, as long as each has its own socket, state, tunnel
+// interface and port. The default instance has no name; others are
+// named, and their sockets are found by name in SocketDir.
+
+// SocketDir is the directory of tailscaled's sockets on Unix systems.
+const SocketDir = "/run/tailscale"
+
+// maxInstanceName bounds the length of an instance name, so that
+// names derived from it, such as its interface's "ts-" plus the
+// name, fit the OS's limits.
+const maxInstanceName = 12
+
+// CheckInstanceName returns an error unless name can name a
+// tailscaled instance: 1 to 12 lowercase letters, digits and dashes,
+// starting with a letter or digit.
+func CheckInstanceName(name string) error {
+	if name == "" || len(name) > maxInstanceName {
+		return fmt.Errorf("instance name %q must be 1 to %d characters", name, maxInstanceName)
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case r == '-' && i > 0:
+		default:
+			return fmt.Errorf("instance name %q may only have lowercase letters, digits and dashes, and can't start with a dash", name)
+		}
+	}
+	return nil
+}
+
+// InstanceSocket returns the socket path of the instance name, or of
+// the default instance if name is empty.
+func InstanceSocket(name string) string {
+	if name == "" {
+		return filepath.Join(SocketDir, "tailscaled.sock")
+	}
+	return filepath.Join(SocketDir, "tailscaled-"+name+".sock")
+}
+
+// Instances returns the names of the named instances with a socket
+// in SocketDir, sorted. Sockets may be left over from instances that
+// have stopped; connect to find out.
+func Instances() ([]string, error) {
+	return instancesIn(SocketDir)
+}
+
+func instancesIn(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "tailscaled-*.sock"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, p := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), "tailscaled-"), ".sock")
+		if CheckInstanceName(name) == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckInstanceName(t *testing.T) {
+	for _, good := range []string{"a", "work", "home-2", "0abc", "abcdefghijkl"} {
+		if err := CheckInstanceName(good); err != nil {
+			t.Errorf("CheckInstanceName(%q): %v", good, err)
+		}
+	}
+	for _, bad := range []string{"", "-a", "Work", "a_b", "a.b", "a/b", "abcdefghijklm"} {
+		if err := CheckInstanceName(bad); err == nil {
+			t.Errorf("CheckInstanceName(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestInstances(t *testing.T) {
+	if got, want := InstanceSocket(""), filepath.FromSlash("/run/tailscale/tailscaled.sock"); got != want {
+		t.Errorf("default socket = %q, want %q", got, want)
+	}
+	if got, want := InstanceSocket("work"), filepath.FromSlash("/run/tailscale/tailscaled-work.sock"); got != want {
+		t.Errorf("work socket = %q, want %q", got, want)
+	}
+
+	dir, err := ioutil.TempDir("", "instances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"tailscaled.sock", "tailscaled-work.sock", "tailscaled-home.sock", "tailscaled-Bad.sock", "other-x.sock"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := instancesIn(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"home", "work"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("instances = %q, want %q", got, want)
+	}
+}
@@ -6,30 +6,70 @@ package safesocket
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
 )
 
 func path(vendor, name string, port uint16) string {
 	return fmt.Sprintf("127.0.0.1:%v", port)
 }
 
+// pipePrefix is the namespace of local named pipes.
+const pipePrefix = `\\.\pipe\`
+
+// pipeSDDL is the security descriptor of the listening pipe: full
+// access for SYSTEM and administrators, read/write for interactively
+// logged-in users, so that the GUI can connect.
+const pipeSDDL = "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GRGW;;;IU)"
+
+// pipeBusyTimeout is how long Connect retries while every instance
+// of the pipe is busy accepting another client.
+const pipeBusyTimeout = 5 * time.Second
+
+// pipeName returns the named pipe to use for path: path itself if it
+// is already a pipe name, otherwise a pipe named after its last
+// element, so that the unix socket path defaults also work here.
+func pipeName(path string) string {
+	if strings.HasPrefix(path, pipePrefix) {
+		return path
+	}
+	return pipePrefix + filepath.Base(path)
+}
+
 func ConnCloseRead(c net.Conn) error {
-	return c.(*net.TCPConn).CloseRead()
+	if tc, ok := c.(*net.TCPConn); ok {
+		return tc.CloseRead()
+	}
+	// Pipes can't be half-closed.
+	return c.Close()
 }
 
 func ConnCloseWrite(c net.Conn) error {
-	return c.(*net.TCPConn).CloseWrite()
+	if tc, ok := c.(*net.TCPConn); ok {
+		return tc.CloseWrite()
+	}
+	return c.Close()
 }
 
+// Connect connects to the backend listening on the named pipe for
+// path, or on localhost TCP port port if it's non-zero.
+//
 // TODO(apenwarr): handle magic cookie auth
 func Connect(path string, port uint16) (net.Conn, error) {
-	pipe, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
-	if err != nil {
-		return nil, err
+	if port != 0 {
+		return net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	}
-	return pipe, err
+	return dialPipe(pipeName(path))
 }
 
 func setFlags(network, address string, c syscall.RawConn) error {
@@ -39,13 +79,17 @@ func setFlags(network, address string, c syscall.RawConn) error {
 	})
 }
 
-// TODO(apenwarr): use named pipes instead of sockets?
-//   I tried to use winio.ListenPipe() here, but that code is a disaster,
-//   built on top of an API that's a disaster. So for now we'll hack it by
-//   just always using a TCP session on a fixed port on localhost. As a
-//   result, on Windows we ignore the vendor and name strings.
+// Listen listens on the named pipe for path. If port is non-zero, it
+// instead listens on that localhost TCP port, for frontends that
+// predate named pipe support; on TCP, any local user can connect,
+// but can't be identified, and so only gets read-only access.
+//
 // TODO(apenwarr): handle magic cookie auth
 func Listen(path string, port uint16) (net.Listener, uint16, error) {
+	if port == 0 {
+		ln, err := listenPipe(pipeName(path))
+		return ln, 0, err
+	}
 	lc := net.ListenConfig{
 		Control: setFlags,
 	}
@@ -55,3 +99,295 @@ func Listen(path string, port uint16) (net.Listener, uint16, error) {
 	}
 	return pipe, uint16(pipe.Addr().(*net.TCPAddr).Port), err
 }
+
+var errClosed = errors.New("safesocket: use of closed pipe")
+
+// timeoutError is returned by pipe reads and writes that run past
+// the connection's deadline.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// waitIO waits for the pending overlapped operation ov on h to
+// finish, or cancels it at deadline, and stores the number of bytes
+// transferred in n.
+func waitIO(h windows.Handle, ov *windows.Overlapped, n *uint32, deadline time.Time) error {
+	timeout := uint32(windows.INFINITE)
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d < 0 {
+			d = 0
+		}
+		timeout = uint32(d / time.Millisecond)
+	}
+	ev, err := windows.WaitForSingleObject(ov.HEvent, timeout)
+	if err != nil || ev == syscall.WAIT_TIMEOUT {
+		// The kernel still owns ov and the buffer until the
+		// cancelled operation completes.
+		windows.CancelIoEx(h, ov)
+		windows.GetOverlappedResult(h, ov, n, true)
+		if err != nil {
+			return err
+		}
+		return timeoutError{}
+	}
+	return windows.GetOverlappedResult(h, ov, n, false)
+}
+
+// doIO runs fn, which starts an overlapped operation on h using ov,
+// and waits for it.
+func doIO(h windows.Handle, deadline time.Time, fn func(ov *windows.Overlapped) error) (int, error) {
+	ev, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(ev)
+
+	ov := windows.Overlapped{HEvent: ev}
+	var n uint32
+	err = fn(&ov)
+	if err == windows.ERROR_IO_PENDING {
+		err = waitIO(h, &ov, &n, deadline)
+	} else if err == nil {
+		err = windows.GetOverlappedResult(h, &ov, &n, false)
+	}
+	return int(n), err
+}
+
+// pipeConn is one end of a named pipe connection, opened for
+// overlapped I/O so that reads can time out and be cancelled.
+type pipeConn struct {
+	h      windows.Handle
+	addr   pipeAddr
+	server bool // disconnect the client when closing
+
+	mu            sync.Mutex
+	closed        bool
+	inflight      sync.WaitGroup // reads and writes using h
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// begin registers a read or write on c and returns its deadline. It
+// returns false if c is closed.
+func (c *pipeConn) begin(write bool) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return time.Time{}, false
+	}
+	c.inflight.Add(1)
+	if write {
+		return c.writeDeadline, true
+	}
+	return c.readDeadline, true
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	deadline, ok := c.begin(false)
+	if !ok {
+		return 0, errClosed
+	}
+	defer c.inflight.Done()
+
+	n, err := doIO(c.h, deadline, func(ov *windows.Overlapped) error {
+		var done uint32
+		return windows.ReadFile(c.h, b, &done, ov)
+	})
+	switch err {
+	case nil:
+		return n, nil
+	case windows.ERROR_BROKEN_PIPE, windows.ERROR_PIPE_NOT_CONNECTED:
+		return n, io.EOF
+	case windows.ERROR_OPERATION_ABORTED:
+		return n, errClosed
+	}
+	return n, err
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	deadline, ok := c.begin(true)
+	if !ok {
+		return 0, errClosed
+	}
+	defer c.inflight.Done()
+
+	n, err := doIO(c.h, deadline, func(ov *windows.Overlapped) error {
+		var done uint32
+		return windows.WriteFile(c.h, b, &done, ov)
+	})
+	if err == windows.ERROR_OPERATION_ABORTED {
+		err = errClosed
+	}
+	return n, err
+}
+
+// Close closes c, cancelling any reads and writes in progress.
+func (c *pipeConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	windows.CancelIoEx(c.h, nil)
+	c.inflight.Wait()
+	if c.server {
+		disconnectNamedPipe(c.h)
+	}
+	return windows.CloseHandle(c.h)
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+// The deadlines apply to reads and writes started after they're set.
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+func dialPipe(name string) (net.Conn, error) {
+	p, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(pipeBusyTimeout)
+	for {
+		h, err := windows.CreateFile(p, windows.GENERIC_READ|windows.GENERIC_WRITE,
+			0, nil, windows.OPEN_EXISTING, windows.FILE_FLAG_OVERLAPPED, 0)
+		if err == nil {
+			return &pipeConn{h: h, addr: pipeAddr(name)}, nil
+		}
+		if err != windows.ERROR_PIPE_BUSY || time.Now().After(deadline) {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pipeListener accepts connections on a named pipe. Between calls to
+// Accept, it keeps one pipe instance open, so that clients arriving
+// meanwhile wait in the queue rather than failing. Only one Accept
+// may run at a time.
+type pipeListener struct {
+	name string
+	sa   *windows.SecurityAttributes
+
+	mu        sync.Mutex
+	next      windows.Handle // instance for the next client
+	accepting bool           // an Accept is waiting on next
+	closed    bool
+}
+
+func listenPipe(name string) (*pipeListener, error) {
+	sd, err := windows.SecurityDescriptorFromString(pipeSDDL)
+	if err != nil {
+		return nil, err
+	}
+	ln := &pipeListener{name: name}
+	ln.sa = &windows.SecurityAttributes{SecurityDescriptor: sd}
+	ln.sa.Length = uint32(unsafe.Sizeof(*ln.sa))
+	// The first instance fails if another backend already owns
+	// the pipe name.
+	ln.next, err = ln.newInstance(windows.FILE_FLAG_FIRST_PIPE_INSTANCE)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	return ln, nil
+}
+
+func (ln *pipeListener) newInstance(flags uint32) (windows.Handle, error) {
+	p, err := windows.UTF16PtrFromString(ln.name)
+	if err != nil {
+		return 0, err
+	}
+	return windows.CreateNamedPipe(p,
+		windows.PIPE_ACCESS_DUPLEX|windows.FILE_FLAG_OVERLAPPED|flags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES, 64<<10, 64<<10, 0, ln.sa)
+}
+
+func (ln *pipeListener) Accept() (net.Conn, error) {
+	ln.mu.Lock()
+	if ln.closed {
+		ln.mu.Unlock()
+		return nil, errClosed
+	}
+	h := ln.next
+	ln.accepting = true
+	ln.mu.Unlock()
+
+	_, err := doIO(h, time.Time{}, func(ov *windows.Overlapped) error {
+		return windows.ConnectNamedPipe(h, ov)
+	})
+	if err == windows.ERROR_PIPE_CONNECTED {
+		// The client connected before we started waiting.
+		err = nil
+	}
+
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.accepting = false
+	if ln.closed {
+		windows.CloseHandle(h)
+		return nil, errClosed
+	}
+	next, nerr := ln.newInstance(0)
+	if nerr != nil {
+		// Keep the current instance for another try.
+		if err == nil {
+			disconnectNamedPipe(h)
+		}
+		return nil, nerr
+	}
+	ln.next = next
+	if err != nil {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	return &pipeConn{h: h, addr: pipeAddr(ln.name), server: true}, nil
+}
+
+// Close stops the listener, interrupting any Accept in progress.
+func (ln *pipeListener) Close() error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.closed {
+		return nil
+	}
+	ln.closed = true
+	if ln.accepting {
+		// Accept closes the handle once it wakes up.
+		return windows.CancelIoEx(ln.next, nil)
+	}
+	return windows.CloseHandle(ln.next)
+}
+
+func (ln *pipeListener) Addr() net.Addr { return pipeAddr(ln.name) }
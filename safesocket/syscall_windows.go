@@ -0,0 +1,35 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Named pipe calls that golang.org/x/sys/windows doesn't wrap.
+var (
+	modkernel32 = windows.NewLazySystemDLL("kernel32.dll")
+
+	procDisconnectNamedPipe         = modkernel32.NewProc("DisconnectNamedPipe")
+	procGetNamedPipeClientProcessId = modkernel32.NewProc("GetNamedPipeClientProcessId")
+)
+
+func disconnectNamedPipe(h windows.Handle) error {
+	r, _, err := procDisconnectNamedPipe.Call(uintptr(h))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func getNamedPipeClientProcessID(h windows.Handle, pid *uint32) error {
+	r, _, err := procGetNamedPipeClientProcessId.Call(uintptr(h), uintptr(unsafe.Pointer(pid)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
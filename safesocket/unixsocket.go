@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 )
 
 func ConnCloseRead(c net.Conn) error {
@@ -20,6 +21,12 @@ func ConnCloseWrite(c net.Conn) error {
 	return c.(*net.UnixConn).CloseWrite()
 }
 
+// SelfCreds returns the credentials of the current process.
+func SelfCreds() (*Creds, error) {
+	uid := os.Getuid()
+	return &Creds{UID: strconv.Itoa(uid), PID: os.Getpid(), Admin: uid == 0}, nil
+}
+
 // TODO(apenwarr): handle magic cookie auth
 func Connect(path string, port uint16) (net.Conn, error) {
 	pipe, err := net.Dial("unix", path)
@@ -51,6 +58,8 @@ func Listen(path string, port uint16) (net.Listener, uint16, error) {
 	if err != nil {
 		return nil, 0, err
 	}
+	// Anyone may connect; the server decides what each peer may do
+	// based on its PeerCreds.
 	os.Chmod(path, 0666)
 	return pipe, 0, err
 }
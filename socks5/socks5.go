@@ -0,0 +1,214 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package socks5 is a SOCKS5 proxy server, RFC 1928, for giving local
+// applications access to the tailnet. It only supports the CONNECT
+// command without authentication, which is what browsers and curl
+// use.
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+const (
+	socks5Version = 5
+
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xff
+
+	cmdConnect = 0x01
+
+	addrIPv4   = 0x01
+	addrDomain = 0x03
+	addrIPv6   = 0x04
+
+	replySucceeded          = 0x00
+	replyHostUnreachable    = 0x04
+	replyCommandUnsupported = 0x07
+	replyAddrUnsupported    = 0x08
+)
+
+// handshakeTimeout bounds how long a client may take to send its
+// request, so idle connections don't pile up.
+const handshakeTimeout = 30 * time.Second
+
+// Server is a SOCKS5 proxy server.
+type Server struct {
+	// Logf logs connection errors. If nil, they're not logged.
+	Logf logger.Logf
+	// Dial connects to the requested address. If nil, it's
+	// net.Dialer.DialContext.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Serve accepts and serves connections on ln until it fails, and
+// returns that error.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			if err := s.serveConn(c); err != nil {
+				s.logf("socks5: %v: %v\n", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func (s *Server) serveConn(c net.Conn) error {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := negotiate(c); err != nil {
+		return err
+	}
+	addr, err := readRequest(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	out, err := s.dial(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		writeReply(c, replyHostUnreachable, nil)
+		return fmt.Errorf("dial %s: %v", addr, err)
+	}
+	defer out.Close()
+	if err := writeReply(c, replySucceeded, out.LocalAddr()); err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(out, c)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(c, out)
+		errc <- err
+	}()
+	// Either direction finishing ends the connection.
+	return <-errc
+}
+
+// negotiate reads the client's greeting and picks no authentication,
+// the only method Server supports.
+func negotiate(c net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+	for _, m := range methods {
+		if m == methodNoAuth {
+			_, err := c.Write([]byte{socks5Version, methodNoAuth})
+			return err
+		}
+	}
+	c.Write([]byte{socks5Version, methodNoAcceptable})
+	return errors.New("client requires authentication")
+}
+
+// readRequest reads a CONNECT request and returns its destination as
+// a host:port string.
+func readRequest(c net.Conn) (string, error) {
+	var hdr [4]byte // version, command, reserved, address type
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	if hdr[1] != cmdConnect {
+		writeReply(c, replyCommandUnsupported, nil)
+		return "", fmt.Errorf("unsupported command %d", hdr[1])
+	}
+
+	var host string
+	switch hdr[3] {
+	case addrIPv4, addrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == addrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case addrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeReply(c, replyAddrUnsupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", hdr[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeReply sends the reply code rep, with bound as the address the
+// proxy connected from, or all zeros if it's nil.
+func writeReply(c net.Conn, rep byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if ta, ok := bound.(*net.TCPAddr); ok {
+		ip = ta.IP
+		port = ta.Port
+	}
+	b := []byte{socks5Version, rep, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, addrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, addrIPv6)
+		b = append(b, ip.To16()...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	_, err := c.Write(b)
+	return err
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+func TestConnect(t *testing.T) {
+	echo := listen(t)
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	dialed := make(chan string, 1)
+	proxy := listen(t)
+	defer proxy.Close()
+	s := &Server{
+		Logf: t.Logf,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			var d net.Dialer
+			return d.DialContext(ctx, network, echo.Addr().String())
+		},
+	}
+	go s.Serve(proxy)
+
+	c, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Write([]byte{5, 1, methodNoAuth})
+	got := make([]byte, 2)
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{5, methodNoAuth}) {
+		t.Fatalf("method reply = %v", got)
+	}
+
+	req := []byte{5, cmdConnect, 0, addrDomain, byte(len("server1"))}
+	req = append(req, "server1"...)
+	req = append(req, 0, 80)
+	c.Write(req)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != replySucceeded {
+		t.Fatalf("reply code = %d", reply[1])
+	}
+	if addr := <-dialed; addr != "server1:80" {
+		t.Errorf("dialed %q, want server1:80", addr)
+	}
+
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("echo = %q", buf)
+	}
+}
+
+func TestNoAcceptableMethod(t *testing.T) {
+	proxy := listen(t)
+	defer proxy.Close()
+	go (&Server{}).Serve(proxy)
+
+	c, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{5, 1, 0x02}) // username/password only
+	got := make([]byte, 2)
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if got[1] != methodNoAcceptable {
+		t.Errorf("method = %#x, want %#x", got[1], methodNoAcceptable)
+	}
+}
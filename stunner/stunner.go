@@ -35,12 +35,19 @@ type Stunner struct {
 	Resolver *net.Resolver
 	Logf     func(format string, args ...interface{})
 
+	// Latency, if non-nil, is called with the round-trip time of
+	// each server that replies.
+	Latency func(server string, d time.Duration)
+
 	sessions map[string]*session
 }
 
 type session struct {
 	replied chan struct{} // closed when server responds
 	tIDs    [][12]byte    // transaction IDs sent to a server
+
+	mu   sync.Mutex
+	sent []time.Time // when each of tIDs was sent, or zero
 }
 
 // Receive delivers a STUN packet to the stunner.
@@ -58,7 +65,7 @@ func (s *Stunner) Receive(p []byte, fromAddr *net.UDPAddr) {
 
 	// Accept any of the tIDs from any of the active sessions.
 	for server, session := range s.sessions {
-		for _, tID := range session.tIDs {
+		for i, tID := range session.tIDs {
 			if bytes.Equal(tID[:], responseTID[:]) {
 				select {
 				case <-session.replied:
@@ -67,6 +74,13 @@ func (s *Stunner) Receive(p []byte, fromAddr *net.UDPAddr) {
 				}
 				close(session.replied)
 
+				session.mu.Lock()
+				sent := session.sent[i]
+				session.mu.Unlock()
+				if s.Latency != nil && !sent.IsZero() {
+					s.Latency(server, time.Since(sent))
+				}
+
 				// TODO(crawshaw): use different endpoints returned from
 				// different STUN servers to detect NAT types.
 				portStr := fmt.Sprintf("%d", port)
@@ -102,6 +116,7 @@ func (s *Stunner) Run(ctx context.Context) error {
 		s.sessions[server] = &session{
 			replied: make(chan struct{}),
 			tIDs:    tIDs,
+			sent:    make([]time.Time, len(tIDs)),
 		}
 	}
 	// after this point, the s.sessions map is read-only
@@ -177,6 +192,14 @@ func (s *Stunner) sendSTUN(ctx context.Context, tID [12]byte, server string) err
 	}
 
 	req := stun.Request(tID)
+	sess := s.sessions[server]
+	sess.mu.Lock()
+	for i := range sess.tIDs {
+		if sess.tIDs[i] == tID {
+			sess.sent[i] = time.Now()
+		}
+	}
+	sess.mu.Unlock()
 	if _, err := s.Send(req, addr); err != nil {
 		return fmt.Errorf("send: %v", err)
 	}
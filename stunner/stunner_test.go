@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"reflect"
 	"sort"
 	"testing"
 	"time"
@@ -32,6 +33,7 @@ func TestStun(t *testing.T) {
 	}
 
 	epCh := make(chan string, 16)
+	latCh := make(chan string, 16)
 
 	localConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
 	if err != nil {
@@ -42,6 +44,12 @@ func TestStun(t *testing.T) {
 		Send:     localConn.WriteTo,
 		Endpoint: func(ep string) { epCh <- ep },
 		Servers:  stunServers,
+		Latency: func(server string, d time.Duration) {
+			if d <= 0 {
+				t.Errorf("latency of %s = %v", server, d)
+			}
+			latCh <- server
+		},
 	}
 
 	stun1Err := make(chan error)
@@ -82,6 +90,16 @@ func TestStun(t *testing.T) {
 	if err := <-errCh; err != nil {
 		t.Fatal(err)
 	}
+	close(latCh)
+	var lats []string
+	for server := range latCh {
+		lats = append(lats, server)
+	}
+	sort.Strings(lats)
+	sort.Strings(stunServers)
+	if !reflect.DeepEqual(lats, stunServers) {
+		t.Errorf("latencies reported for %q, want %q", lats, stunServers)
+	}
 }
 
 func startSTUNDrop1(conn net.PacketConn, writeTo func([]byte, *net.UDPAddr)) error {
@@ -116,7 +116,9 @@ type Node struct {
 	Endpoints  []string     `json:",omitempty"` // IP+port (public via STUN, and local LANs)
 	Hostinfo   Hostinfo
 	Created    time.Time
-	LastSeen   *time.Time `json:",omitempty"`
+	LastSeen   *time.Time `json:",omitempty"` // when the node was last connected to control
+	Online     *bool      `json:",omitempty"` // whether the node is connected to control; nil if unknown
+	Tags       []string   `json:",omitempty"` // ACL tags applied to this node, e.g. "tag:server"
 
 	MachineAuthorized bool // TODO(crawshaw): replace with MachineStatus
 
@@ -137,6 +139,11 @@ func (n *Node) Copy() (res *Node) {
 		lastSeen := *res.LastSeen
 		res.LastSeen = &lastSeen
 	}
+	if res.Online != nil {
+		online := *res.Online
+		res.Online = &online
+	}
+	res.Tags = append([]string(nil), res.Tags...)
 	res.Hostinfo = *res.Hostinfo.Copy()
 	return res
 }
@@ -218,6 +225,17 @@ type Hostinfo struct {
 	Hostname      string       // name of the host the client runs on
 	RoutableIPs   []wgcfg.CIDR `json:",omitempty"` // set of IP ranges this client can route
 	Services      []Service    `json:",omitempty"` // services advertised by this machine
+	RequestTags   []string     `json:",omitempty"` // ACL tags requested for this node, see CheckTag
+
+	// DNSProxy is whether the node answers other nodes' DNS
+	// queries at port 53 of its Tailscale IPs, forwarding them to
+	// its own nameservers, as exit nodes do for the nodes using
+	// them; see ipn.Prefs.ExitNodeDNS. It's set once the node's
+	// resolver is listening. The packet filter still decides which
+	// nodes may reach it: the ACLs must accept their UDP and TCP
+	// traffic to the node's port 53, which the usual exit node rule
+	// for Internet destinations doesn't.
+	DNSProxy bool `json:",omitempty"`
 
 	// NOTE: any new fields containing pointers in this type
 	//       require changes to Hostinfo.Copy and Hostinfo.Equal.
@@ -231,14 +249,62 @@ func (hinfo *Hostinfo) Copy() (res *Hostinfo) {
 
 	res.RoutableIPs = append([]wgcfg.CIDR{}, res.RoutableIPs...)
 	res.Services = append([]Service{}, res.Services...)
+	res.RequestTags = append([]string(nil), res.RequestTags...)
 	return res
 }
 
+// CheckTag validates an ACL tag name, such as "tag:server".
+//
+// A node requests tags in Hostinfo.RequestTags; the server grants
+// them only if the node's owner is allowed to use them, and reports
+// the result in Node.Tags.
+func CheckTag(tag string) error {
+	if !strings.HasPrefix(tag, "tag:") {
+		return fmt.Errorf("tag %q must start with \"tag:\"", tag)
+	}
+	name := tag[len("tag:"):]
+	if name == "" {
+		return fmt.Errorf("tag %q has an empty name", tag)
+	}
+	for _, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-':
+		default:
+			return fmt.Errorf("tag %q: invalid character %q, only letters, digits and dashes are allowed", tag, r)
+		}
+	}
+	return nil
+}
+
 // Equal reports whether h and h2 are equal.
 func (h *Hostinfo) Equal(h2 *Hostinfo) bool {
 	return reflect.DeepEqual(h, h2)
 }
 
+// CapabilityVersion is the level of the control protocol a client
+// understands. It goes up by one each time the client learns to
+// handle new message fields, so that the control server can send
+// those fields only to clients that know what to do with them.
+//
+// Version 5 added support for delta peer updates in
+// MapResponse.PeersChanged and MapResponse.PeersRemoved.
+// Version 6 added MapResponse.OnlineChange and LastSeenChange.
+// Version 7 added MapRequest.Health.
+// Version 8 added MapResponse.DERPMap.
+// Version 9 added RegisterRequest.Capability, and MinCapability in
+// responses.
+// Version 10 added the profiles of peers' owners to
+// MapResponse.UserProfiles, sent incrementally in delta responses.
+// Version 11 added MapRequest.NetInfo.
+// Version 12 added MapResponse.PeersDelta, which marks delta peer
+// updates; before, a nil Peers did, which an empty full list can look
+// like.
+// Version 13 added DERPNode.STUNPort and NetInfo.DERPLatency.
+type CapabilityVersion int
+
+// CurrentCapabilityVersion is the capability version of this code.
+const CurrentCapabilityVersion CapabilityVersion = 13
+
 // RegisterRequest is sent by a client to register the key for a node.
 // It is encoded to JSON, encrypted with golang.org/x/crypto/nacl/box,
 // using the local machine key, and sent to:
@@ -250,12 +316,28 @@ type RegisterRequest struct {
 	Auth       struct {
 		Provider  string
 		LoginName string
-		// One of LoginName or Oauth2Token is set.
+		// One of LoginName, Oauth2Token, or AuthKey is set.
 		Oauth2Token *oauth2.Token
+		// AuthKey is a pre-authorized key, generated by an admin,
+		// that lets a node register without an interactive login.
+		AuthKey string `json:",omitempty"`
 	}
-	Expiry   time.Time // requested key expiry, server policy may override
+	Expiry   time.Time // requested key expiry, server policy may override; a past time logs out
 	Followup string    // response waits until AuthURL is visited
 	Hostinfo Hostinfo
+
+	// Ephemeral requests that the server remove the node
+	// automatically once it goes offline.
+	Ephemeral bool `json:",omitempty"`
+
+	// NewMachineKey, if set, asks the server to move this node to a
+	// new machine key. The request itself is sent under the old
+	// machine key, which proves the client owns the node.
+	NewMachineKey *MachineKey `json:",omitempty"`
+
+	// Capability is the client's capability version. Clients
+	// before version 9 don't send it.
+	Capability CapabilityVersion `json:",omitempty"`
 }
 
 // Copy makes a deep copy of RegisterRequest.
@@ -267,6 +349,10 @@ func (req *RegisterRequest) Copy() *RegisterRequest {
 		tok := *res.Auth.Oauth2Token
 		res.Auth.Oauth2Token = &tok
 	}
+	if res.NewMachineKey != nil {
+		k := *res.NewMachineKey
+		res.NewMachineKey = &k
+	}
 	return &res
 }
 
@@ -277,6 +363,11 @@ type RegisterResponse struct {
 	NodeKeyExpired    bool   // if true, the NodeKey needs to be replaced
 	MachineAuthorized bool   // TODO(crawshaw): move to using MachineStatus
 	AuthURL           string // if set, authorization pending
+
+	// MinCapability, if non-zero, is the oldest client capability
+	// version the server still supports. Older clients can't use
+	// the server and should ask to be updated.
+	MinCapability CapabilityVersion `json:",omitempty"`
 }
 
 // MapRequest is sent by a client to start a long-poll network map updates.
@@ -287,13 +378,77 @@ type RegisterResponse struct {
 // using the local machine key, and sent to:
 //	https://login.tailscale.com/machine/<mkey hex>/map
 type MapRequest struct {
-	Version   int    // current version is 4
-	Compress  string // "zstd" or "" (no compression)
-	KeepAlive bool   // server sends keep-alives
+	Version   CapabilityVersion // the client's capability version
+	Compress  string            // "zstd" or "" (no compression)
+	KeepAlive bool              // server sends keep-alives
 	NodeKey   NodeKey
 	Endpoints []string
 	Stream    bool // if true, multiple MapResponse objects are returned
 	Hostinfo  Hostinfo
+
+	// Health, if non-nil, summarizes the client's health. Clients
+	// that opt in send it at most every few minutes, so most map
+	// requests don't carry it.
+	Health *HealthReport `json:",omitempty"`
+
+	// NetInfo, if non-nil, is the client's latest view of its
+	// network, for the server's DERP and peering decisions.
+	NetInfo *NetInfo `json:",omitempty"`
+}
+
+// NetInfo summarizes the network conditions a client found in its
+// most recent endpoint discovery. Besides informing the control
+// server's decisions, it lets support debug a node's connectivity
+// without access to the node.
+type NetInfo struct {
+	// NATType is the mapping behavior of the NAT in front of the
+	// client: "none", "easy", "hard" or "unknown".
+	NATType string
+	// UDPBlocked reports that no STUN server replied, so outbound
+	// UDP is probably blocked and the client relies on DERP.
+	UDPBlocked bool
+	// PreferredDERP is the ID of the DERP region the client is
+	// homed on, or 0 if it has none.
+	PreferredDERP int
+	// STUNLatency is the round-trip time, in seconds, to each STUN
+	// server that replied, keyed by its "host:port".
+	STUNLatency map[string]float64 `json:",omitempty"`
+	// DERPLatency is the round-trip time, in seconds, to each DERP
+	// region, keyed by its ID: that of the fastest of its nodes'
+	// STUN servers. Regions none of which replied are left out.
+	DERPLatency map[int]float64 `json:",omitempty"`
+}
+
+// BasicallyEqual reports whether ni and ni2 are equal, ignoring
+// latencies, which change a little with every measurement.
+func (ni *NetInfo) BasicallyEqual(ni2 *NetInfo) bool {
+	if ni == nil || ni2 == nil {
+		return ni == ni2
+	}
+	return ni.NATType == ni2.NATType &&
+		ni.UDPBlocked == ni2.UDPBlocked &&
+		ni.PreferredDERP == ni2.PreferredDERP
+}
+
+// HealthReport is a summary of a client's health, for operators to
+// spot broken nodes across a network.
+type HealthReport struct {
+	Version         string   // client version
+	Problems        []string `json:",omitempty"` // current problems, see package health
+	EngineErrors    int      // engine errors since the backend started
+	LastEngineError string   `json:",omitempty"`
+
+	// LivePeers is the number of peers with a recent handshake,
+	// and DERPPeers how many of those are reached through a DERP
+	// relay rather than directly. A high ratio of DERPPeers to
+	// LivePeers usually means NAT traversal is failing.
+	LivePeers int
+	DERPPeers int
+
+	// NATType and DERPHome are the client's latest network check
+	// results.
+	NATType  string // "none", "easy", "hard" or "unknown"
+	DERPHome string // hostname of the home DERP server
 }
 
 type MapResponse struct {
@@ -301,19 +456,125 @@ type MapResponse struct {
 
 	// Networking
 	Node        Node
-	Peers       []Node
 	DNS         []wgcfg.IP
 	SearchPaths []string
 
+	// DNSConfig, if non-nil, is the node's DNS configuration for
+	// its own resolver; it's sent in full. Older servers send only
+	// DNS and SearchPaths, which the OS is configured with directly.
+	DNSConfig *DNSConfig `json:",omitempty"`
+
+	// Peers is the complete list of peers, unless PeersDelta is
+	// set. The first response of a poll always has it.
+	//
+	// Later responses in a stream may instead set PeersDelta and
+	// list only the differences from the previous peer list, in
+	// PeersChanged and PeersRemoved, leaving Peers nil. The other
+	// fields are always sent in full.
+	Peers        []Node
+	PeersDelta   bool      `json:",omitempty"`
+	PeersChanged []Node    `json:",omitempty"` // new peers, or peers with any field changed
+	PeersRemoved []NodeKey `json:",omitempty"` // peers no longer in the network map
+
+	// OnlineChange and LastSeenChange update just those fields of
+	// existing peers, for the frequent case where nothing else
+	// about them changed. They apply after Peers or PeersChanged.
+	OnlineChange   map[NodeKey]bool      `json:",omitempty"`
+	LastSeenChange map[NodeKey]time.Time `json:",omitempty"`
+
+	// DERPMap, if non-nil, replaces the DERP servers the client
+	// uses. It's only sent when it changes, so nil means to keep
+	// the last one.
+	DERPMap *DERPMap `json:",omitempty"`
+
+	// MinCapability is as in RegisterResponse. It's always sent in
+	// full, so zero means the server has no minimum.
+	MinCapability CapabilityVersion `json:",omitempty"`
+
 	// ACLs
 	Domain       string
 	PacketFilter filter.Matches
+	// UserProfiles are the profiles of this node's user and of the
+	// users owning its peers, so that clients can show who owns
+	// each machine. Unlike the other fields, in a delta response,
+	// one with Peers nil, it lists only the profiles that are new
+	// or changed since the previous response.
 	UserProfiles []UserProfile
 	Roles        []Role
 	// TODO: Groups       []Group
 	// TODO: Capabilities []Capability
 }
 
+// DNSConfig is the DNS configuration of a node's resolver, which
+// answers for the tailnet's names (MagicDNS) and sends other queries
+// on according to Routes and Nameservers.
+type DNSConfig struct {
+	// Proxied is whether the OS should resolve through the node's
+	// resolver. If not, the OS is configured with MapResponse.DNS
+	// directly, and the rest of DNSConfig is unused.
+	Proxied bool `json:",omitempty"`
+
+	// Domains are the tailnet's domains. Names under them are the
+	// tailnet's nodes, by their Node.Name, answered by the
+	// resolver itself.
+	Domains []string `json:",omitempty"`
+
+	// Routes maps DNS domains, such as "corp.example.com", to the
+	// nameservers that answer for names under them: split DNS. The
+	// nameservers are often reached over the tailnet.
+	//
+	// A nameserver is an IP or IP:port, queried over UDP; an
+	// "https://" URL, queried with DNS-over-HTTPS; or "tls://host"
+	// or "tls://host:port", queried with DNS-over-TLS.
+	Routes map[string][]string `json:",omitempty"`
+
+	// Nameservers, in the same forms as in Routes, answer for names
+	// that no route covers. If empty, the system's own nameservers
+	// are used.
+	Nameservers []string `json:",omitempty"`
+
+	// SearchDomains are the domains that single-label names, such
+	// as "wiki", are tried under, in order. The OS is configured
+	// with them in place of MapResponse.SearchPaths, and the
+	// resolver expands single-label queries with them too, for
+	// the programs that send those as they are.
+	SearchDomains []string `json:",omitempty"`
+
+	// RestrictedDomains are domains, normally among Routes, whose
+	// names must never be sent to any nameserver but their
+	// routes', such as internal ones reached over the tailnet: not
+	// to Nameservers, nor the system's, nor by the OS to its other
+	// interfaces' nameservers where it can be kept from doing so.
+	RestrictedDomains []string `json:",omitempty"`
+}
+
+// DERPMap describes the DERP relay servers available to a node.
+type DERPMap struct {
+	// Regions are the DERP regions, keyed by RegionID. Peers
+	// reachable through a region have the fake endpoint
+	// 127.3.3.40:<RegionID>.
+	Regions map[int]*DERPRegion
+}
+
+// DERPRegion is a set of DERP servers in one place, any of which
+// relays for the others.
+type DERPRegion struct {
+	RegionID   int         // at least 1
+	RegionCode string      // short name, such as "nyc"
+	Nodes      []*DERPNode // in order of preference
+}
+
+// DERPNode is a single DERP server.
+type DERPNode struct {
+	Name     string // unique within the DERPMap, such as "1a"
+	HostName string // serves DERP over HTTPS at /derp
+
+	// STUNPort is the UDP port of the STUN server on HostName,
+	// which clients measure their latency to the region with. Zero
+	// means the standard 3478, and -1 that the node runs none.
+	STUNPort int `json:",omitempty"`
+}
+
 func (k MachineKey) String() string { return fmt.Sprintf("mkey:%x", k[:]) }
 
 func (k MachineKey) MarshalText() ([]byte, error) {
@@ -394,5 +655,7 @@ func (n *Node) Equal(n2 *Node) bool {
 		reflect.DeepEqual(n.Hostinfo, n2.Hostinfo) &&
 		n.Created.Equal(n2.Created) &&
 		reflect.DeepEqual(n.LastSeen, n2.LastSeen) &&
+		reflect.DeepEqual(n.Online, n2.Online) &&
+		reflect.DeepEqual(n.Tags, n2.Tags) &&
 		n.MachineAuthorized == n2.MachineAuthorized
 }
@@ -20,7 +20,7 @@ func fieldsOf(t reflect.Type) (fields []string) {
 }
 
 func TestHostinfoEqual(t *testing.T) {
-	hiHandles := []string{"IPNVersion", "FrontendLogID", "BackendLogID", "OS", "Hostname", "RoutableIPs", "Services"}
+	hiHandles := []string{"IPNVersion", "FrontendLogID", "BackendLogID", "OS", "Hostname", "RoutableIPs", "Services", "RequestTags", "DNSProxy"}
 	if have := fieldsOf(reflect.TypeOf(Hostinfo{})); !reflect.DeepEqual(have, hiHandles) {
 		t.Errorf("Hostinfo.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, hiHandles)
@@ -147,6 +147,21 @@ func TestHostinfoEqual(t *testing.T) {
 			&Hostinfo{Services: []Service{Service{TCP, 1234, "foo"}}},
 			true,
 		},
+		{
+			&Hostinfo{RequestTags: []string{"tag:a"}},
+			&Hostinfo{RequestTags: []string{"tag:b"}},
+			false,
+		},
+		{
+			&Hostinfo{RequestTags: []string{"tag:a"}},
+			&Hostinfo{RequestTags: []string{"tag:a"}},
+			true,
+		},
+		{
+			&Hostinfo{DNSProxy: true},
+			&Hostinfo{},
+			false,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.a.Equal(tt.b)
@@ -157,7 +172,7 @@ func TestHostinfoEqual(t *testing.T) {
 }
 
 func TestNodeEqual(t *testing.T) {
-	nodeHandles := []string{"ID", "Name", "User", "Key", "KeyExpiry", "Machine", "Addresses", "AllowedIPs", "Endpoints", "Hostinfo", "Created", "LastSeen", "MachineAuthorized"}
+	nodeHandles := []string{"ID", "Name", "User", "Key", "KeyExpiry", "Machine", "Addresses", "AllowedIPs", "Endpoints", "Hostinfo", "Created", "LastSeen", "Online", "Tags", "MachineAuthorized"}
 	if have := fieldsOf(reflect.TypeOf(Node{})); !reflect.DeepEqual(have, nodeHandles) {
 		t.Errorf("Node.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, nodeHandles)
@@ -173,6 +188,7 @@ func TestNodeEqual(t *testing.T) {
 	}
 	n1 := newPublicKey(t)
 	now := time.Now()
+	yes, no := true, false
 
 	tests := []struct {
 		a, b *Node
@@ -293,6 +309,31 @@ func TestNodeEqual(t *testing.T) {
 			&Node{LastSeen: &now},
 			true,
 		},
+		{
+			&Node{Online: &yes},
+			&Node{Online: nil},
+			false,
+		},
+		{
+			&Node{Online: &yes},
+			&Node{Online: &no},
+			false,
+		},
+		{
+			&Node{Online: &yes},
+			&Node{Online: &yes},
+			true,
+		},
+		{
+			&Node{Tags: []string{"tag:a"}},
+			&Node{Tags: []string{"tag:b"}},
+			false,
+		},
+		{
+			&Node{Tags: []string{"tag:a"}},
+			&Node{Tags: []string{"tag:a"}},
+			true,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.a.Equal(tt.b)
@@ -301,3 +342,50 @@ func TestNodeEqual(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckTag(t *testing.T) {
+	for _, tag := range []string{"tag:server", "tag:web-1", "tag:A"} {
+		if err := CheckTag(tag); err != nil {
+			t.Errorf("CheckTag(%q) = %v, want nil", tag, err)
+		}
+	}
+	for _, tag := range []string{"", "server", "tag:", "tag:a b", "tag:a:b", "Tag:x"} {
+		if err := CheckTag(tag); err == nil {
+			t.Errorf("CheckTag(%q) = nil, want error", tag)
+		}
+	}
+}
+
+func TestNetInfoBasicallyEqual(t *testing.T) {
+	niHandles := []string{"NATType", "UDPBlocked", "PreferredDERP", "STUNLatency", "DERPLatency"}
+	if have := fieldsOf(reflect.TypeOf(NetInfo{})); !reflect.DeepEqual(have, niHandles) {
+		t.Errorf("NetInfo.BasicallyEqual check might be out of sync\nfields: %q\nhandled: %q\n",
+			have, niHandles)
+	}
+
+	tests := []struct {
+		a, b *NetInfo
+		want bool
+	}{
+		{nil, nil, true},
+		{&NetInfo{}, nil, false},
+		{&NetInfo{NATType: "easy"}, &NetInfo{NATType: "hard"}, false},
+		{&NetInfo{UDPBlocked: true}, &NetInfo{}, false},
+		{&NetInfo{PreferredDERP: 1}, &NetInfo{PreferredDERP: 2}, false},
+		{
+			&NetInfo{NATType: "easy", STUNLatency: map[string]float64{"stun:3478": 0.010}},
+			&NetInfo{NATType: "easy", STUNLatency: map[string]float64{"stun:3478": 0.012}},
+			true,
+		},
+		{
+			&NetInfo{PreferredDERP: 1, DERPLatency: map[int]float64{1: 0.010}},
+			&NetInfo{PreferredDERP: 1, DERPLatency: map[int]float64{1: 0.012, 2: 0.030}},
+			true,
+		},
+	}
+	for i, tt := range tests {
+		if got := tt.a.BasicallyEqual(tt.b); got != tt.want {
+			t.Errorf("%d. BasicallyEqual = %v; want %v", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A log line whose format has a verbosity tag, "[v1] " or "[v2] " and
+// so on, is only logged when its component's level is at least that
+// high. The component is the word before the line's first ": ", and
+// the tag comes either before it, as in "[v1] magicsock: ...", or
+// right after it, as in "control: [v1] ...", which is how a line
+// looks once a component's Logf has added its prefix. Untagged lines
+// are always logged.
+
+// Levels holds the verbosity level of each component, which a Logf
+// from Filter checks. The zero value logs no verbose lines. It may be
+// changed at any time.
+type Levels struct {
+	mu   sync.Mutex
+	def  int            // for components not in comp
+	comp map[string]int // by component name
+}
+
+// ParseLevels parses s, either a level for every component, such as
+// "1", or a comma-separated list of component=level pairs, such as
+// "magicsock=2,control=1", where the component "*" means every other
+// one.
+func ParseLevels(s string) (def int, comp map[string]int, err error) {
+	comp = map[string]int{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		name := "*"
+		if i := strings.Index(f, "="); i >= 0 {
+			name, f = f[:i], f[i+1:]
+		}
+		lvl, err := strconv.Atoi(f)
+		if err != nil || lvl < 0 {
+			return 0, nil, fmt.Errorf("invalid log level %q", f)
+		}
+		if name == "" || strings.ContainsAny(name, " :") {
+			return 0, nil, fmt.Errorf("invalid component name %q", name)
+		}
+		if name == "*" {
+			def = lvl
+		} else {
+			comp[name] = lvl
+		}
+	}
+	return def, comp, nil
+}
+
+// Set replaces all the levels in l with those in s, in the form
+// ParseLevels takes.
+func (l *Levels) Set(s string) error {
+	def, comp, err := ParseLevels(s)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.def, l.comp = def, comp
+	return nil
+}
+
+// String returns l in the form ParseLevels takes.
+func (l *Levels) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := []string{strconv.Itoa(l.def)}
+	var names []string
+	for name := range l.comp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ret = append(ret, fmt.Sprintf("%s=%d", name, l.comp[name]))
+	}
+	return strings.Join(ret, ",")
+}
+
+// Level returns the verbosity level of component.
+func (l *Levels) Level(component string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lvl, ok := l.comp[component]; ok {
+		return lvl
+	}
+	return l.def
+}
+
+// Filter returns a Logf that passes lines on to logf, except for
+// verbose ones above their component's level in l. A nil l filters
+// nothing.
+func (l *Levels) Filter(logf Logf) Logf {
+	if l == nil {
+		return logf
+	}
+	return func(format string, args ...interface{}) {
+		if lvl, comp := parse(format); lvl > 0 && lvl > l.Level(comp) {
+			return
+		}
+		logf(format, args...)
+	}
+}
+
+// parse returns the level of format's verbosity tag, or 0 if it has
+// none, and the component it's from, or "" if it doesn't say.
+func parse(format string) (lvl int, comp string) {
+	if lvl, rest := verbosity(format); lvl > 0 {
+		return lvl, component(rest)
+	}
+	comp = component(format)
+	if comp == "" {
+		return 0, ""
+	}
+	lvl, _ = verbosity(format[len(comp)+len(": "):])
+	return lvl, comp
+}
+
+// verbosity returns the level of the verbosity tag format starts with,
+// or 0 if it has none, and the rest of format.
+func verbosity(format string) (int, string) {
+	if !strings.HasPrefix(format, "[v") {
+		return 0, format
+	}
+	end := strings.Index(format, "] ")
+	if end < 0 {
+		return 0, format
+	}
+	lvl, err := strconv.Atoi(format[2:end])
+	if err != nil || lvl < 0 {
+		return 0, format
+	}
+	return lvl, format[end+2:]
+}
+
+// component returns the word before format's first ": ", or "" if
+// there's more than one word before it.
+func component(format string) string {
+	i := strings.Index(format, ": ")
+	if i < 0 || strings.ContainsAny(format[:i], " []") {
+		return ""
+	}
+	return format[:i]
+}
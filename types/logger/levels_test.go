@@ -0,0 +1,103 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLevelsFilter(t *testing.T) {
+	var l Levels
+	var got []string
+	logf := l.Filter(func(format string, args ...interface{}) {
+		got = append(got, fmt.Sprintf(format, args...))
+	})
+	// control lines get their prefix from ipn's wrapper, as in
+	// LocalBackend.Start.
+	controlf := func(format string, args ...interface{}) {
+		logf("control: "+format, args...)
+	}
+	log := func() {
+		logf("magicsock: link change, binding new connection\n")
+		logf("[v1] magicsock: rx %s from roaming address %s, set as new priority", "[pk]", "1.2.3.4:41641")
+		logf("[v2] magicsock: %s", "a line only the most verbose level logs")
+		logf("[v1] magicsock: CreateEndpoint: key=%s: %s", "[pk]", "1.2.3.4:41641")
+		controlf("[v1] cancelMapSafely: synced=%v\n", true)
+		controlf("[v1] PollNetMap: stream=%v :%v %v\n", -1, 41641, "[]")
+		controlf("Hostinfo: %v\n", "{}")
+		logf("[v1] wgengine: Reconfig done\n")
+	}
+	tests := []struct {
+		levels string
+		want   int // lines logged
+	}{
+		{"0", 2},
+		{"1", 7},
+		{"2", 8},
+		{"magicsock=2", 5},
+		{"control=1", 4},
+		{"1,magicsock=0", 5},
+		{"control=1,magicsock=1", 6},
+	}
+	for _, tt := range tests {
+		if err := l.Set(tt.levels); err != nil {
+			t.Fatal(err)
+		}
+		got = nil
+		log()
+		if len(got) != tt.want {
+			t.Errorf("levels %q: logged %q, want %d lines", tt.levels, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		format string
+		lvl    int
+		comp   string
+	}{
+		{"magicsock: plain", 0, "magicsock"},
+		{"[v1] magicsock: rx %s", 1, "magicsock"},
+		{"control: [v2] cancelMapSafely: synced=%v", 2, "control"},
+		{"control: Hostinfo: %v", 0, "control"},
+		{"[v1] map response: %v", 1, ""},
+		{"direct.TryLogout()", 0, ""},
+	}
+	for _, tt := range tests {
+		lvl, comp := parse(tt.format)
+		if lvl != tt.lvl || comp != tt.comp {
+			t.Errorf("parse(%q) = %d, %q; want %d, %q", tt.format, lvl, comp, tt.lvl, tt.comp)
+		}
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	for _, bad := range []string{"", "x", "-1", "magicsock=", "=1", "a b=1"} {
+		if _, _, err := ParseLevels(bad); err == nil {
+			t.Errorf("ParseLevels(%q) succeeded", bad)
+		}
+	}
+	var l Levels
+	if err := l.Set("magicsock=2, *=1,control=0"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := l.String(), "1,control=0,magicsock=2"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got := l.Level("derp"); got != 1 {
+		t.Errorf("Level(derp) = %d, want 1", got)
+	}
+}
+
+func TestNilLevels(t *testing.T) {
+	var l *Levels
+	n := 0
+	l.Filter(func(string, ...interface{}) { n++ })("[v3] magicsock: x")
+	if n != 1 {
+		t.Errorf("nil Levels dropped a line")
+	}
+}
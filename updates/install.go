@@ -0,0 +1,223 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package updates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/nas"
+)
+
+// packageManager is a package manager that tailscale may have been
+// installed with.
+type packageManager struct {
+	name    string
+	query   []string   // succeeds if tailscale was installed with it
+	upgrade [][]string // commands that upgrade tailscale
+}
+
+// packageManagers are the package managers of each OS, in the order
+// they're tried.
+var packageManagers = map[string][]packageManager{
+	"linux": {
+		{"apt", []string{"dpkg-query", "-W", "tailscale"}, [][]string{
+			{"apt-get", "update"},
+			{"apt-get", "install", "-y", "--only-upgrade", "tailscale"},
+		}},
+		{"dnf", []string{"rpm", "-q", "tailscale"}, [][]string{
+			{"dnf", "upgrade", "-y", "--refresh", "tailscale"},
+		}},
+		{"yum", []string{"rpm", "-q", "tailscale"}, [][]string{
+			{"yum", "upgrade", "-y", "tailscale"},
+		}},
+		{"apk", []string{"apk", "info", "-e", "tailscale"}, [][]string{
+			{"apk", "update"},
+			{"apk", "add", "--upgrade", "tailscale"},
+		}},
+		{"pacman", []string{"pacman", "-Q", "tailscale"}, [][]string{
+			{"pacman", "-Sy", "--noconfirm", "tailscale"},
+		}},
+	},
+	"freebsd": {
+		{"pkg", []string{"pkg", "info", "tailscale"}, [][]string{
+			{"pkg", "upgrade", "-y", "tailscale"},
+		}},
+	},
+}
+
+// findPackageManager returns the first of goos's package managers
+// that is present, as reported by have, and that installed tailscale,
+// as reported by running its query with run. It returns nil if there
+// is none.
+func findPackageManager(goos string, have func(cmd string) bool, run func(args []string) error) *packageManager {
+	for _, pm := range packageManagers[goos] {
+		pm := pm
+		if have(pm.upgrade[0][0]) && have(pm.query[0]) && run(pm.query) == nil {
+			return &pm
+		}
+	}
+	return nil
+}
+
+// msiURL returns the URL of the Windows installer of version on track
+// for arch.
+func msiURL(track, version, arch string) string {
+	return fmt.Sprintf("%s/%s/tailscale-setup-%s-%s.msi", pkgsURL, track, version, arch)
+}
+
+// Install upgrades tailscale to info.Latest, or as near as the
+// package manager gets, the way it was installed: with a package
+// manager on Linux and FreeBSD, or by running the new installer on
+// Windows. It needs root, or Administrator. Progress and the output
+// of the commands run go to out. Installs that it can't upgrade, such
+// as the macOS app, get an error saying what to do instead.
+func Install(ctx context.Context, info *ipnstate.UpdateInfo, out io.Writer) error {
+	switch runtime.GOOS {
+	case "windows":
+		return installMSI(ctx, info, out)
+	case "darwin":
+		return errors.New("on macOS, Tailscale is updated through the App Store, or by the standalone app itself")
+	}
+	if p := nas.Detect(); p != nas.None {
+		return fmt.Errorf("on %s, Tailscale is updated from the NAS's package center", p)
+	}
+	have := func(cmd string) bool {
+		_, err := exec.LookPath(cmd)
+		return err == nil
+	}
+	query := func(args []string) error {
+		return exec.CommandContext(ctx, args[0], args[1:]...).Run()
+	}
+	pm := findPackageManager(runtime.GOOS, have, query)
+	if pm == nil {
+		return fmt.Errorf("tailscale wasn't installed with a known package manager; download version %s from %s/%s/", info.Latest, pkgsURL, info.Track)
+	}
+	for _, args := range pm.upgrade {
+		fmt.Fprintf(out, "+ %v\n", args)
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdout, cmd.Stderr = out, out
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %v", pm.name, err)
+		}
+	}
+	return nil
+}
+
+// installMSI downloads the Windows installer of info.Latest, checks
+// its signature, and runs it. The installer stops the service,
+// replaces it and starts it again.
+func installMSI(ctx context.Context, info *ipnstate.UpdateInfo, out io.Writer) error {
+	u := msiURL(info.Track, info.Latest, runtime.GOARCH)
+	fmt.Fprintf(out, "Downloading %s\n", u)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: %s", u, res.Status)
+	}
+	dir, err := ioutil.TempDir("", "tailscale-update")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, filepath.Base(u))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, res.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("downloading %s: %v", u, err)
+	}
+
+	fmt.Fprintf(out, "Checking the installer's signature\n")
+	if err := verifyMSI(ctx, path); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Running the installer\n")
+	cmd := exec.CommandContext(ctx, "msiexec.exe", "/i", path, "/quiet", "/norestart")
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("msiexec: %v", err)
+	}
+	return nil
+}
+
+// msiSigner is the name on the code signing certificate of
+// Tailscale's Windows installers.
+const msiSigner = "Tailscale Inc."
+
+// verifyMSI returns an error unless the installer at path has a valid
+// Authenticode signature by msiSigner. Windows checks the signature
+// and the certificate's chain, through PowerShell's
+// Get-AuthenticodeSignature, which prints the result's status and
+// then the certificate's subject for checkSignature.
+func verifyMSI(ctx context.Context, path string) error {
+	script := fmt.Sprintf("$s = Get-AuthenticodeSignature -LiteralPath '%s'; $s.Status.ToString(); $s.SignerCertificate.Subject",
+		strings.Replace(path, "'", "''", -1))
+	out, err := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script).Output()
+	if err != nil {
+		return fmt.Errorf("checking the installer's signature: %v", err)
+	}
+	return checkSignature(string(out))
+}
+
+// checkSignature checks verifyMSI's PowerShell output: a signature
+// status, which must be "Valid", and the signing certificate's
+// subject, whose common name must be msiSigner.
+func checkSignature(out string) error {
+	lines := strings.Split(strings.TrimSpace(strings.Replace(out, "\r\n", "\n", -1)), "\n")
+	if status := strings.TrimSpace(lines[0]); status != "Valid" {
+		return fmt.Errorf("the installer's signature isn't valid: %s", status)
+	}
+	var cn string
+	if len(lines) > 1 {
+		cn = commonName(strings.TrimSpace(lines[1]))
+	}
+	if cn != msiSigner {
+		return fmt.Errorf("the installer is signed by %q, not %q", cn, msiSigner)
+	}
+	return nil
+}
+
+// commonName returns the CN of a certificate subject in the form
+// Windows prints, such as `CN="Tailscale Inc.", O="Tailscale Inc.",
+// C=CA`, or "" if it has none.
+func commonName(subject string) string {
+	if !strings.HasPrefix(subject, "CN=") {
+		return ""
+	}
+	s := subject[len("CN="):]
+	if strings.HasPrefix(s, `"`) {
+		if i := strings.Index(s[1:], `"`); i >= 0 {
+			return s[1 : i+1]
+		}
+		return ""
+	}
+	if i := strings.Index(s, ", "); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
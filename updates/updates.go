@@ -0,0 +1,150 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package updates finds out whether a newer release of Tailscale is
+// out, and installs it the way the running one was installed.
+//
+// Releases come in two tracks: "stable", whose minor version numbers
+// are even, and "unstable", whose minor version numbers are odd. A
+// node follows the track of the version it runs, unless told
+// otherwise.
+package updates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// pkgsURL is where releases are published, with one directory per
+// track.
+var pkgsURL = "https://pkgs.tailscale.com"
+
+// maxReleaseInfo bounds the size of a track's release description.
+const maxReleaseInfo = 1 << 20
+
+// Tracks are the release tracks, see the package comment.
+var Tracks = []string{"stable", "unstable"}
+
+// CheckTrack returns an error unless track is one of Tracks.
+func CheckTrack(track string) error {
+	for _, t := range Tracks {
+		if track == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown release track %q; want %s", track, strings.Join(Tracks, " or "))
+}
+
+// parseVersion parses the major, minor and patch numbers at the start
+// of v, such as "1.2.3" or "1.2.3-45-gabcdef".
+func parseVersion(v string) (ret [3]int, ok bool) {
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	f := strings.Split(v, ".")
+	if len(f) != 3 {
+		return ret, false
+	}
+	for i, s := range f {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return ret, false
+		}
+		ret[i] = n
+	}
+	return ret, true
+}
+
+// Compare returns -1, 0 or 1 as release version a is older than, the
+// same as, or newer than b. Only the major, minor and patch numbers
+// count. It returns an error if either can't be parsed, as with
+// development builds.
+func Compare(a, b string) (int, error) {
+	va, ok := parseVersion(a)
+	if !ok {
+		return 0, fmt.Errorf("can't compare unreleased version %q", a)
+	}
+	vb, ok := parseVersion(b)
+	if !ok {
+		return 0, fmt.Errorf("can't compare unreleased version %q", b)
+	}
+	for i := range va {
+		switch {
+		case va[i] < vb[i]:
+			return -1, nil
+		case va[i] > vb[i]:
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// TrackOf returns the release track of version v, or "stable" if v
+// isn't a release version.
+func TrackOf(v string) string {
+	if pv, ok := parseVersion(v); ok && pv[1]%2 == 1 {
+		return "unstable"
+	}
+	return "stable"
+}
+
+// Latest returns the newest release version on track.
+func Latest(ctx context.Context, track string) (string, error) {
+	if err := CheckTrack(track); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", pkgsURL+"/"+track+"/?mode=json", nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s releases: %s", track, res.Status)
+	}
+	var rel struct {
+		Version string
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxReleaseInfo)).Decode(&rel); err != nil {
+		return "", fmt.Errorf("fetching %s releases: %v", track, err)
+	}
+	if _, ok := parseVersion(rel.Version); !ok {
+		return "", fmt.Errorf("fetching %s releases: invalid version %q", track, rel.Version)
+	}
+	return rel.Version, nil
+}
+
+// Check returns whether a release newer than current is out on track,
+// or on current's own track if track is empty.
+func Check(ctx context.Context, current, track string) (*ipnstate.UpdateInfo, error) {
+	if track == "" {
+		track = TrackOf(current)
+	}
+	latest, err := Latest(ctx, track)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Compare(current, latest)
+	if err != nil {
+		return nil, err
+	}
+	return &ipnstate.UpdateInfo{
+		Current:   current,
+		Latest:    latest,
+		Track:     track,
+		Available: c < 0,
+		CheckedAt: time.Now(),
+	}, nil
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package updates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2.3-45-gabcdef", "1.2.3", 0},
+		{"1.2.3", "1.2.4", -1},
+		{"1.10.0", "1.9.9", 1},
+		{"0.100.0-12", "1.0.0", -1},
+		{"2.0.0", "1.99.99", 1},
+	}
+	for _, tt := range tests {
+		got, err := Compare(tt.a, tt.b)
+		if err != nil || got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d, %v; want %d", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"LONGVER-TODO", "1.2", "1.2.x", "1.-2.3", ""} {
+		if _, err := Compare(bad, "1.2.3"); err == nil {
+			t.Errorf("Compare(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestTrackOf(t *testing.T) {
+	for v, want := range map[string]string{
+		"1.2.3":        "stable",
+		"1.3.0-5-gabc": "unstable",
+		"0.99.1":       "unstable",
+		"LONGVER-TODO": "stable",
+	} {
+		if got := TrackOf(v); got != want {
+			t.Errorf("TrackOf(%q) = %q, want %q", v, got, want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("mode") != "json" {
+			http.Error(w, "want mode=json", 400)
+			return
+		}
+		switch r.URL.Path {
+		case "/stable/":
+			fmt.Fprintf(w, `{"Version": "1.4.2", "Tarballs": {}}`)
+		case "/unstable/":
+			fmt.Fprintf(w, `{"Version": "1.5.7"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	defer func(old string) { pkgsURL = old }(pkgsURL)
+	pkgsURL = ts.URL
+
+	ctx := context.Background()
+	tests := []struct {
+		current, track string
+		latest         string
+		available      bool
+	}{
+		{"1.4.0", "", "1.4.2", true},
+		{"1.4.2-3-gabc", "", "1.4.2", false},
+		{"1.5.1", "", "1.5.7", true},
+		{"1.4.2", "unstable", "1.5.7", true},
+		{"1.6.0", "stable", "1.4.2", false},
+	}
+	for _, tt := range tests {
+		info, err := Check(ctx, tt.current, tt.track)
+		if err != nil {
+			t.Errorf("Check(%q, %q): %v", tt.current, tt.track, err)
+			continue
+		}
+		if info.Latest != tt.latest || info.Available != tt.available || info.Current != tt.current {
+			t.Errorf("Check(%q, %q) = %+v; want latest %s, available %v", tt.current, tt.track, info, tt.latest, tt.available)
+		}
+	}
+	if _, err := Check(ctx, "1.4.0", "nightly"); err == nil {
+		t.Errorf("Check with an unknown track succeeded")
+	}
+	if _, err := Check(ctx, "LONGVER-TODO", ""); err == nil {
+		t.Errorf("Check of a development build succeeded")
+	}
+}
+
+func TestFindPackageManager(t *testing.T) {
+	tests := []struct {
+		goos      string
+		tools     []string
+		installed string // tool whose query succeeds
+		want      string
+	}{
+		{"linux", []string{"apt-get", "dpkg-query"}, "dpkg-query", "apt"},
+		{"linux", []string{"apt-get", "dpkg-query", "rpm", "dnf"}, "rpm", "dnf"},
+		{"linux", []string{"rpm", "yum"}, "rpm", "yum"},
+		{"linux", []string{"apt-get", "dpkg-query"}, "", ""},
+		{"linux", []string{"dpkg-query"}, "dpkg-query", ""},
+		{"freebsd", []string{"pkg"}, "pkg", "pkg"},
+		{"darwin", []string{"brew"}, "brew", ""},
+	}
+	for _, tt := range tests {
+		have := func(cmd string) bool {
+			for _, tool := range tt.tools {
+				if cmd == tool {
+					return true
+				}
+			}
+			return false
+		}
+		run := func(args []string) error {
+			if args[0] == tt.installed {
+				return nil
+			}
+			return errors.New("not installed")
+		}
+		var got string
+		if pm := findPackageManager(tt.goos, have, run); pm != nil {
+			got = pm.name
+		}
+		if got != tt.want {
+			t.Errorf("%s with %v: got %q, want %q", tt.goos, tt.tools, got, tt.want)
+		}
+	}
+}
+
+func TestMSIURL(t *testing.T) {
+	got := msiURL("stable", "1.4.2", "amd64")
+	want := "https://pkgs.tailscale.com/stable/tailscale-setup-1.4.2-amd64.msi"
+	if got != want {
+		t.Errorf("msiURL = %q, want %q", got, want)
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	tests := []struct {
+		out    string
+		wantOK bool
+	}{
+		{"Valid\r\nCN=\"Tailscale Inc.\", O=\"Tailscale Inc.\", L=Toronto, S=Ontario, C=CA\r\n", true},
+		{"Valid\nCN=Tailscale Inc., O=Tailscale Inc., C=CA\n", true},
+		{"Valid\r\nCN=Someone Else, O=Tailscale Inc.\r\n", false},
+		{"Valid\r\nO=Tailscale Inc., CN=Tailscale Inc.\r\n", false},
+		{"Valid\r\nCN=\"Tailscale Inc. Evil\"\r\n", false},
+		{"HashMismatch\r\nCN=\"Tailscale Inc.\"\r\n", false},
+		{"NotSigned\r\n\r\n", false},
+		{"Valid\r\n", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := checkSignature(tt.out); (err == nil) != tt.wantOK {
+			t.Errorf("checkSignature(%q) = %v, want ok=%v", tt.out, err, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/magicsock"
+	"tailscale.com/wgengine/tsdns"
+)
+
+// NewAsyncReconfig wraps an Engine so that callers of Reconfig and
+// SetFilter don't queue up behind a slow one.
+//
+// Updates are handed to a single worker goroutine that applies them
+// to the wrapped Engine in order. If new updates arrive while the
+// worker is busy (for instance, in a slow router or DNS operation),
+// only the most recent config and filter are kept: the latest
+// update always wins and intermediate ones are skipped.
+//
+// SetFilter doesn't block. Reconfig waits for its config, or the one
+// that replaced it, to be applied, and returns the wrapped Reconfig's
+// error for it, so that callers know what state the engine is in.
+func NewAsyncReconfig(logf logger.Logf, e Engine) Engine {
+	ae := &asyncEngine{
+		logf: logf,
+		wrap: e,
+		kick: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go ae.run()
+	return ae
+}
+
+type asyncEngine struct {
+	logf logger.Logf
+	wrap Engine
+	kick chan struct{} // non-blocking signal that an update is pending
+	quit chan struct{} // closed by Close
+	done chan struct{} // closed when run exits
+
+	mu         sync.Mutex // guards following fields
+	haveCfg    bool
+	cfg        *wgcfg.Config
+	dnsDomains []string
+	waiters    []chan error // Reconfig calls waiting for cfg
+	haveFilt   bool
+	filt       *filter.Filter
+	closed     bool
+}
+
+func (e *asyncEngine) run() {
+	defer close(e.done)
+	for {
+		select {
+		case <-e.quit:
+			return
+		case <-e.kick:
+		}
+
+		e.mu.Lock()
+		haveCfg, cfg, dnsDomains := e.haveCfg, e.cfg, e.dnsDomains
+		waiters := e.waiters
+		haveFilt, filt := e.haveFilt, e.filt
+		e.haveCfg, e.cfg, e.dnsDomains, e.waiters = false, nil, nil, nil
+		e.haveFilt, e.filt = false, nil
+		e.mu.Unlock()
+
+		if haveFilt {
+			e.wrap.SetFilter(filt)
+		}
+		if haveCfg {
+			err := e.wrap.Reconfig(cfg, dnsDomains)
+			if err != nil {
+				e.logf("wgengine: async Reconfig: %v\n", err)
+			}
+			for _, w := range waiters {
+				w <- err // buffered
+			}
+		}
+	}
+}
+
+// poke wakes up the worker goroutine, if it's not already awake.
+func (e *asyncEngine) poke() {
+	select {
+	case e.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (e *asyncEngine) Reconfig(cfg *wgcfg.Config, dnsDomains []string) error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return errAsyncClosed
+	}
+	done := make(chan error, 1)
+	e.haveCfg, e.cfg, e.dnsDomains = true, cfg, dnsDomains
+	e.waiters = append(e.waiters, done)
+	e.mu.Unlock()
+	e.poke()
+	select {
+	case err := <-done:
+		return err
+	case <-e.done:
+		select {
+		case err := <-done:
+			return err
+		default:
+			// Closed before the config was applied.
+			return errAsyncClosed
+		}
+	}
+}
+
+var errAsyncClosed = errors.New("wgengine: engine closed")
+
+func (e *asyncEngine) SetFilter(filt *filter.Filter) {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.haveFilt, e.filt = true, filt
+	e.mu.Unlock()
+	e.poke()
+}
+
+// SetDNSConfig isn't deferred: it doesn't block, and Reconfig, which
+// starts the resolver listening, comes after it either way.
+func (e *asyncEngine) SetDNSConfig(cfg *tsdns.Config) {
+	e.wrap.SetDNSConfig(cfg)
+}
+
+func (e *asyncEngine) SetStatusCallback(cb StatusCallback) {
+	e.wrap.SetStatusCallback(cb)
+}
+func (e *asyncEngine) RequestStatus() {
+	e.wrap.RequestStatus()
+}
+func (e *asyncEngine) LinkChange(isExpensive bool) {
+	e.wrap.LinkChange(isExpensive)
+}
+func (e *asyncEngine) Pause() {
+	e.wrap.Pause()
+}
+func (e *asyncEngine) Resume() {
+	e.wrap.Resume()
+}
+func (e *asyncEngine) ReSTUN() {
+	e.wrap.ReSTUN()
+}
+func (e *asyncEngine) SetDERPMap(dm *tailcfg.DERPMap) {
+	e.wrap.SetDERPMap(dm)
+}
+func (e *asyncEngine) LogState() {
+	e.wrap.LogState()
+}
+func (e *asyncEngine) Ping(ctx context.Context, peer wgcfg.Key) (*magicsock.PingResult, error) {
+	return e.wrap.Ping(ctx, peer)
+}
+
+// Close stops the worker goroutine, discarding any update that
+// hasn't been applied yet, then closes the wrapped Engine.
+func (e *asyncEngine) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	e.mu.Unlock()
+
+	close(e.quit)
+	<-e.done
+	e.wrap.Close()
+}
+func (e *asyncEngine) Wait() {
+	e.wrap.Wait()
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// blockingEngine is an Engine whose Reconfig blocks until unblocked,
+// and returns the error it's unblocked with.
+type blockingEngine struct {
+	Engine // nil; only the methods below are used
+
+	started chan *wgcfg.Config
+	unblock chan error
+	closed  bool
+}
+
+func (e *blockingEngine) Reconfig(cfg *wgcfg.Config, dnsDomains []string) error {
+	e.started <- cfg
+	return <-e.unblock
+}
+
+func (e *blockingEngine) Close() { e.closed = true }
+
+func TestAsyncReconfig(t *testing.T) {
+	be := &blockingEngine{
+		started: make(chan *wgcfg.Config, 10),
+		unblock: make(chan error),
+	}
+	e := NewAsyncReconfig(t.Logf, be)
+	ae := e.(*asyncEngine)
+
+	cfg1 := &wgcfg.Config{Name: "one"}
+	cfg2 := &wgcfg.Config{Name: "two"}
+	cfg3 := &wgcfg.Config{Name: "three"}
+
+	// reconfig calls e.Reconfig on another goroutine and returns the
+	// channel its result will arrive on.
+	reconfig := func(cfg *wgcfg.Config) chan error {
+		res := make(chan error, 1)
+		go func() { res <- e.Reconfig(cfg, nil) }()
+		return res
+	}
+	// waitPending waits for cfg to be the pending config.
+	waitPending := func(cfg *wgcfg.Config) {
+		for {
+			ae.mu.Lock()
+			pending := ae.cfg == cfg
+			ae.mu.Unlock()
+			if pending {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	res1 := reconfig(cfg1)
+	if got := <-be.started; got != cfg1 {
+		t.Fatalf("first Reconfig got %q, want %q", got.Name, cfg1.Name)
+	}
+
+	// The wrapped engine is now blocked. Further updates wait, and
+	// only the latest one is applied.
+	res2 := reconfig(cfg2)
+	waitPending(cfg2)
+	res3 := reconfig(cfg3)
+	waitPending(cfg3)
+	select {
+	case err := <-res1:
+		t.Fatalf("Reconfig returned %v before it was applied", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	be.unblock <- nil
+	if err := <-res1; err != nil {
+		t.Errorf("first Reconfig = %v", err)
+	}
+	if got := <-be.started; got != cfg3 {
+		t.Fatalf("coalesced Reconfig got %q, want %q", got.Name, cfg3.Name)
+	}
+	// Both waiting callers get the error of the config applied.
+	failed := errors.New("router failed")
+	be.unblock <- failed
+	if err := <-res2; err != failed {
+		t.Errorf("superseded Reconfig = %v, want %v", err, failed)
+	}
+	if err := <-res3; err != failed {
+		t.Errorf("coalesced Reconfig = %v, want %v", err, failed)
+	}
+
+	e.Close()
+	if !be.closed {
+		t.Error("wrapped engine not closed")
+	}
+	select {
+	case cfg := <-be.started:
+		t.Errorf("unexpected extra Reconfig %q", cfg.Name)
+	default:
+	}
+	if err := e.Reconfig(cfg1, nil); err == nil {
+		t.Error("Reconfig after Close succeeded")
+	}
+}
@@ -7,10 +7,13 @@ package filter
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/groupcache/lru"
+	"tailscale.com/clientmetrics"
 	"tailscale.com/ratelimit"
 	"tailscale.com/wgengine/packet"
 )
@@ -18,8 +21,22 @@ import (
 type Filter struct {
 	matches Matches
 
-	udpMu  sync.Mutex
-	udplru *lru.Cache
+	// exempt are the local IP:ports that take new TCP connections
+	// whatever matches says, see Exempt.
+	exempt []IPPortRange
+
+	// udp is the state of outgoing UDP flows, so that replies
+	// get in, sharded by flow so that wireguard-go's workers, one
+	// per CPU, don't all queue on one lock.
+	udp [udpShards]udpShard
+
+	logf func(format string, args ...interface{})
+
+	dropMu    sync.Mutex
+	drops     map[int]int      // rule index, or NoRule => number of packets dropped
+	dropFlows map[dropFlow]int // drops not logged one by one, for the next summary
+	dropOther int              // the same, of flows beyond maxDropFlows
+	dropTimer *time.Timer      // logs the summary; nil if none is due
 }
 
 type Response int
@@ -61,6 +78,23 @@ type tuple struct {
 
 const LRU_MAX = 512 // max entries in UDP LRU cache
 
+// udpShards is the number of shards of a Filter's UDP state, each
+// holding up to LRU_MAX/udpShards flows.
+const udpShards = 16
+
+type udpShard struct {
+	mu  sync.Mutex
+	lru *lru.Cache
+}
+
+// udpShard returns the shard of f's UDP state holding t.
+func (f *Filter) udpShard(t tuple) *udpShard {
+	h := uint32(t.SrcIP) ^ uint32(t.DstIP) ^ uint32(t.SrcPort)<<16 ^ uint32(t.DstPort)
+	h ^= h >> 16
+	h ^= h >> 8
+	return &f.udp[h%udpShards]
+}
+
 var MatchAllowAll = Matches{
 	Match{[]IPPortRange{IPPortRangeAny}, []IP{IPAny}},
 }
@@ -75,12 +109,38 @@ func NewAllowNone() *Filter {
 
 func New(matches Matches) *Filter {
 	f := &Filter{
-		matches: matches,
-		udplru:  lru.New(LRU_MAX),
+		matches:   matches,
+		logf:      log.Printf,
+		drops:     make(map[int]int),
+		dropFlows: make(map[dropFlow]int),
+	}
+	for i := range f.udp {
+		f.udp[i].lru = lru.New(LRU_MAX / udpShards)
 	}
 	return f
 }
 
+// Exempt makes f accept new TCP connections to port on each of the
+// local IPs in dsts, whatever its matches say. It's for services of
+// tailscaled's own, such as the peer API, which check who's asking
+// themselves. Exempt ports don't open ICMP, nor count as open for
+// Check. It must be called before f is in use.
+func (f *Filter) Exempt(dsts []IP, port uint16) {
+	for _, ip := range dsts {
+		f.exempt = append(f.exempt, IPPortRange{ip, PortRange{port, port}})
+	}
+}
+
+// isExempt reports whether q is to one of f's exempt IP:ports.
+func (f *Filter) isExempt(q *packet.QDecode) bool {
+	for _, e := range f.exempt {
+		if q.DstIP == e.IP && q.DstPort == e.Ports.First {
+			return true
+		}
+	}
+	return false
+}
+
 func maybeHexdump(flag RunFlags, b []byte) string {
 	if flag != 0 {
 		return packet.Hexdump(b) + "\n"
@@ -103,40 +163,211 @@ var dropBucket = ratelimit.Bucket{
 	FillInterval: 5 * time.Second,
 }
 
-func logRateLimit(runflags RunFlags, b []byte, q *packet.QDecode, r Response, why string) {
-	if r == Drop && (runflags&LogDrops) != 0 && dropBucket.TryGet() > 0 {
+// dropSummaryInterval is how long drops that dropBucket keeps from
+// being logged one by one are collected, before they're logged as a
+// summary with a count per flow.
+const dropSummaryInterval = 10 * time.Second
+
+// maxDropFlows is the most flows a drop summary lists. Drops of any
+// others are only counted together.
+const maxDropFlows = 32
+
+// NoRule is the DropCounts key for drops that no rule had a say in:
+// packets to a destination no rule covers, and malformed ones.
+const NoRule = -1
+
+// DropCounts returns the number of packets dropped so far by f, keyed
+// by the index in its Matches of the rule that blocked them: the
+// first whose destinations cover the packet's, but whose sources
+// don't include its sender. Drops no rule covers are under NoRule.
+func (f *Filter) DropCounts() map[int]int {
+	f.dropMu.Lock()
+	defer f.dropMu.Unlock()
+
+	ret := make(map[int]int, len(f.drops))
+	for rule, n := range f.drops {
+		ret[rule] = n
+	}
+	return ret
+}
+
+// dropRule returns the DropCounts key for the dropped packet q.
+func (f *Filter) dropRule(q *packet.QDecode) int {
+	if q == nil {
+		return NoRule
+	}
+	switch q.IPProto {
+	case packet.ICMP:
+		return blockingRule(f.matches, q, false)
+	case packet.TCP, packet.UDP:
+		return blockingRule(f.matches, q, true)
+	}
+	return NoRule
+}
+
+// dropFlow is what drop summaries count drops by.
+type dropFlow struct {
+	proto   packet.IPProto
+	src     IP
+	dst     IP
+	dstPort uint16 // of TCP and UDP only
+	rule    int    // DropCounts key
+}
+
+func (k dropFlow) String() string {
+	var port string
+	if k.proto == packet.TCP || k.proto == packet.UDP {
+		port = fmt.Sprintf(":%d", k.dstPort)
+	}
+	rule := "no rule"
+	if k.rule != NoRule {
+		rule = fmt.Sprintf("rule %d", k.rule)
+	}
+	return fmt.Sprintf("%v %v -> %v%s (%s)", k.proto, k.src, k.dst, port, rule)
+}
+
+// countDrop records a dropped packet and reports whether it should
+// be logged now. Those that dropBucket doesn't leave room for are
+// added to the next drop summary instead.
+func (f *Filter) countDrop(runflags RunFlags, q *packet.QDecode) (doLog bool) {
+	rule := f.dropRule(q)
+
+	f.dropMu.Lock()
+	defer f.dropMu.Unlock()
+
+	f.drops[rule]++
+	if (runflags & LogDrops) == 0 {
+		return false
+	}
+	if dropBucket.TryGet() > 0 {
+		return true
+	}
+	k := dropFlow{rule: rule}
+	if q != nil {
+		k.proto, k.src, k.dst = q.IPProto, q.SrcIP, q.DstIP
+		if k.proto == packet.TCP || k.proto == packet.UDP {
+			k.dstPort = q.DstPort
+		}
+	}
+	if _, ok := f.dropFlows[k]; ok || len(f.dropFlows) < maxDropFlows {
+		f.dropFlows[k]++
+	} else {
+		f.dropOther++
+	}
+	if f.dropTimer == nil {
+		f.dropTimer = time.AfterFunc(dropSummaryInterval, f.logDropSummary)
+	}
+	return false
+}
+
+// logDropSummary logs, and forgets, the drops that countDrop didn't
+// log one by one, busiest flows first.
+func (f *Filter) logDropSummary() {
+	f.dropMu.Lock()
+	flows, other := f.dropFlows, f.dropOther
+	f.dropFlows = make(map[dropFlow]int)
+	f.dropOther = 0
+	if f.dropTimer != nil {
+		f.dropTimer.Stop()
+		f.dropTimer = nil
+	}
+	f.dropMu.Unlock()
+
+	if len(flows) == 0 {
+		return
+	}
+	keys := make([]dropFlow, 0, len(flows))
+	for k := range flows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if flows[keys[i]] != flows[keys[j]] {
+			return flows[keys[i]] > flows[keys[j]]
+		}
+		return keys[i].String() < keys[j].String()
+	})
+	parts := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%v x%d", k, flows[k]))
+	}
+	if other > 0 {
+		parts = append(parts, fmt.Sprintf("other flows x%d", other))
+	}
+	f.logf("Drop summary: %s\n", strings.Join(parts, "; "))
+}
+
+func (f *Filter) logRateLimit(runflags RunFlags, b []byte, q *packet.QDecode, r Response, why string) {
+	if r == Drop {
+		if !f.countDrop(runflags, q) {
+			return
+		}
 		var qs string
 		if q == nil {
 			qs = fmt.Sprintf("(%d bytes)", len(b))
 		} else {
 			qs = q.String()
 		}
-		log.Printf("Drop: %v %v %s\n%s", qs, len(b), why, maybeHexdump(runflags&HexdumpDrops, b))
-	} else if r == Accept && (runflags&LogAccepts) != 0 && acceptBucket.TryGet() > 0 {
-		log.Printf("Accept: %v %v %s\n%s", q, len(b), why, maybeHexdump(runflags&HexdumpAccepts, b))
+		f.logf("Drop: %v %v %s\n%s", qs, len(b), why, maybeHexdump(runflags&HexdumpDrops, b))
+	} else if r == Accept && (runflags&LogAccepts) != 0 && opensFlow(why) && acceptBucket.TryGet() > 0 {
+		f.logf("Accept: %v %v %s\n%s", q, len(b), why, maybeHexdump(runflags&HexdumpAccepts, b))
 	}
 }
 
-func (f *Filter) RunIn(b []byte, q *packet.QDecode, rf RunFlags) Response {
-	r := pre(b, q, rf)
-	if r == Accept || r == Drop {
-		// already logged
-		return r
+// opensFlow reports whether a packet accepted for reason why starts a
+// new connection or flow, rather than continuing one. Only those are
+// worth logging, and checking for no others keeps the bulk of the
+// traffic off acceptBucket's lock.
+func opensFlow(why string) bool {
+	switch why {
+	case "tcp non-syn", "udp cached", "fragment":
+		return false
 	}
+	return true
+}
 
-	r, why := f.runIn(q)
-	logRateLimit(rf, b, q, r, why)
+var (
+	metricInAccepted = clientmetrics.NewCounter("filter_in_accepted", "Inbound packets the packet filter let through.")
+	metricInDropped  = clientmetrics.NewCounter("filter_in_dropped", "Inbound packets the packet filter dropped.")
+)
+
+func (f *Filter) RunIn(b []byte, q *packet.QDecode, rf RunFlags) Response {
+	r := f.pre(b, q, rf)
+	if r == noVerdict {
+		var why string
+		r, why = f.runIn(q)
+		if r == Drop && q.IPProto == packet.TCP && f.isExempt(q) {
+			r, why = Accept, "tcp exempt"
+		}
+		f.logRateLimit(rf, b, q, r, why)
+	} // else already logged
+	if r == Accept {
+		metricInAccepted.Add(1)
+	} else {
+		metricInDropped.Add(1)
+	}
 	return r
 }
 
 func (f *Filter) RunOut(b []byte, q *packet.QDecode, rf RunFlags) Response {
-	r := pre(b, q, rf)
+	r := f.pre(b, q, rf)
 	if r == Drop || r == Accept {
 		// already logged
 		return r
 	}
 	r, why := f.runOut(q)
-	logRateLimit(rf, b, q, r, why)
+	f.logRateLimit(rf, b, q, r, why)
+	return r
+}
+
+// Check returns the verdict f would give a packet of protocol proto
+// arriving from src for dst:dstPort, as the first packet of a new
+// connection, without counting or logging it.
+func (f *Filter) Check(proto packet.IPProto, src, dst IP, dstPort uint16) Response {
+	q := &packet.QDecode{IPProto: proto, SrcIP: src, DstIP: dst, DstPort: dstPort}
+	if proto == packet.TCP {
+		q.TCPFlags = packet.TCPSyn
+	}
+	r, _ := f.runIn(q)
 	return r
 }
 
@@ -165,9 +396,10 @@ func (f *Filter) runIn(q *packet.QDecode) (r Response, why string) {
 	case packet.UDP:
 		t := tuple{q.SrcIP, q.DstIP, q.SrcPort, q.DstPort}
 
-		f.udpMu.Lock()
-		_, ok := f.udplru.Get(t)
-		f.udpMu.Unlock()
+		sh := f.udpShard(t)
+		sh.mu.Lock()
+		_, ok := sh.lru.Get(t)
+		sh.mu.Unlock()
 
 		if ok {
 			return Accept, "udp cached"
@@ -182,35 +414,47 @@ func (f *Filter) runIn(q *packet.QDecode) (r Response, why string) {
 }
 
 func (f *Filter) runOut(q *packet.QDecode) (r Response, why string) {
-	if q.IPProto == packet.UDP {
+	switch q.IPProto {
+	case packet.UDP:
 		t := tuple{q.DstIP, q.SrcIP, q.DstPort, q.SrcPort}
 
-		f.udpMu.Lock()
-		f.udplru.Add(t, t)
-		f.udpMu.Unlock()
+		sh := f.udpShard(t)
+		sh.mu.Lock()
+		_, ok := sh.lru.Get(t) // Get refreshes t too
+		if !ok {
+			sh.lru.Add(t, t)
+		}
+		sh.mu.Unlock()
+		if ok {
+			return Accept, "udp cached"
+		}
+	case packet.TCP:
+		if !q.IsTCPSyn() {
+			return Accept, "tcp non-syn"
+		}
 	}
 	return Accept, "ok out"
 }
 
-func pre(b []byte, q *packet.QDecode, rf RunFlags) Response {
+func (f *Filter) pre(b []byte, q *packet.QDecode, rf RunFlags) Response {
 	if len(b) == 0 {
 		// wireguard keepalive packet, always permit.
 		return Accept
 	}
 	if len(b) < 20 {
-		logRateLimit(rf, b, nil, Drop, "too short")
+		f.logRateLimit(rf, b, nil, Drop, "too short")
 		return Drop
 	}
 	q.Decode(b)
 
 	if q.IPProto == packet.Junk {
 		// Junk packets are dangerous; always drop them.
-		logRateLimit(rf, b, q, Drop, "junk!")
+		f.logRateLimit(rf, b, q, Drop, "junk!")
 		return Drop
 	} else if q.IPProto == packet.Fragment {
 		// Fragments after the first always need to be passed through.
 		// Very small fragments are considered Junk by QDecode.
-		logRateLimit(rf, b, q, Accept, "fragment")
+		f.logRateLimit(rf, b, q, Accept, "fragment")
 		return Accept
 	}
 
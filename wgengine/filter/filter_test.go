@@ -7,7 +7,11 @@ package filter
 import (
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"net"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 
 	"tailscale.com/wgengine/packet"
@@ -103,14 +107,214 @@ func TestPreFilter(t *testing.T) {
 		{"udp", noVerdict, rawpacket(UDP, 200)},
 		{"icmp", noVerdict, rawpacket(ICMP, 200)},
 	}
+	f := NewAllowNone()
 	for _, testPacket := range packets {
-		got := pre([]byte(testPacket.b), &QDecode{}, LogDrops|LogAccepts)
+		got := f.pre([]byte(testPacket.b), &QDecode{}, LogDrops|LogAccepts)
 		if got != testPacket.want {
 			t.Errorf("%q got=%v want=%v packet:\n%s", testPacket.desc, got, testPacket.want, packet.Hexdump(testPacket.b))
 		}
 	}
 }
 
+func TestDropCounts(t *testing.T) {
+	f := New(Matches{
+		{SrcIPs: []IP{0x08010101}, DstPorts: ippr(0x01020304, 22, 22)},
+		{SrcIPs: []IP{0x08020202}, DstPorts: ippr(0x01020304, 80, 80)},
+	})
+	in := func(proto packet.IPProto, src IP, dstPort uint16) {
+		b := rawpacket(proto, 200)
+		binary.BigEndian.PutUint32(b[12:16], uint32(src))
+		binary.BigEndian.PutUint32(b[16:20], 0x01020304)
+		binary.BigEndian.PutUint16(b[22:24], dstPort)
+		b[33] = packet.TCPSyn
+		var q QDecode
+		f.RunIn(b, &q, 0)
+	}
+	var q QDecode
+	f.RunIn([]byte("short"), &q, 0)
+	f.RunIn(rawpacket(Junk, 10), &q, 0)
+	in(TCP, 0x08020202, 22)
+	in(TCP, 0x08020202, 22)
+	in(UDP, 0x08010101, 80)
+	in(TCP, 0x08010101, 443)
+	in(TCP, 0x08010101, 22)
+	in(ICMP, 0x09090909, 0)
+
+	got := f.DropCounts()
+	want := map[int]int{
+		0:      3,
+		1:      1,
+		NoRule: 3,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for rule, n := range want {
+		if got[rule] != n {
+			t.Errorf("drops[%d] = %d, want %d", rule, got[rule], n)
+		}
+	}
+}
+
+func TestDropSummary(t *testing.T) {
+	f := New(Matches{
+		{SrcIPs: []IP{0x08010101}, DstPorts: ippr(0x01020304, 22, 22)},
+	})
+	var logged []string
+	f.logf = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	in := func(src IP, dstPort uint16) {
+		b := rawpacket(TCP, 200)
+		binary.BigEndian.PutUint32(b[12:16], uint32(src))
+		binary.BigEndian.PutUint32(b[16:20], 0x01020304)
+		binary.BigEndian.PutUint16(b[22:24], dstPort)
+		b[33] = packet.TCPSyn
+		var q QDecode
+		f.RunIn(b, &q, LogDrops)
+	}
+	// More drops than dropBucket lets through one by one.
+	for i := 0; i < 30; i++ {
+		in(0x08020202, 22)
+	}
+	for i := 0; i < 5; i++ {
+		in(0x08030303, 80)
+	}
+	single := len(logged)
+	f.logDropSummary()
+	if len(logged) != single+1 {
+		t.Fatalf("logged %q, want one summary after the single drops", logged)
+	}
+	summary := logged[single]
+
+	// Every drop is either logged by itself or counted in the
+	// summary, by flow.
+	re := regexp.MustCompile(`TCP (\S+) -> 1\.2\.3\.4:(\d+) \((.*?)\) x(\d+)`)
+	counts := map[string]int{}
+	for _, m := range re.FindAllStringSubmatch(summary, -1) {
+		n, _ := strconv.Atoi(m[4])
+		counts[m[1]+":"+m[2]+" "+m[3]] = n
+	}
+	singles := map[string]int{}
+	for _, l := range logged[:single] {
+		switch {
+		case strings.Contains(l, "8.2.2.2"):
+			singles["8.2.2.2:22 rule 0"]++
+		case strings.Contains(l, "8.3.3.3"):
+			singles["8.3.3.3:80 no rule"]++
+		default:
+			t.Errorf("unexpected log line %q", l)
+		}
+	}
+	for flow, want := range map[string]int{"8.2.2.2:22 rule 0": 30, "8.3.3.3:80 no rule": 5} {
+		if got := counts[flow] + singles[flow]; got != want {
+			t.Errorf("%s: logged %d + summarized %d drops, want %d in all; summary: %s", flow, singles[flow], counts[flow], want, summary)
+		}
+	}
+	if counts["8.2.2.2:22 rule 0"] == 0 {
+		t.Errorf("summary %q lacks the busy flow", summary)
+	}
+
+	// Nothing's left for the next summary.
+	f.logDropSummary()
+	if len(logged) != single+1 {
+		t.Errorf("second summary logged %q", logged[single+1:])
+	}
+}
+
+func TestCheck(t *testing.T) {
+	f := New(Matches{
+		{SrcIPs: []IP{0x08010101}, DstPorts: ippr(0x01020304, 22, 22)},
+	})
+	tests := []struct {
+		proto   packet.IPProto
+		src     IP
+		dstPort uint16
+		want    Response
+	}{
+		{TCP, 0x08010101, 22, Accept},
+		{TCP, 0x08010101, 80, Drop},
+		{ICMP, 0x08010101, 0, Accept},
+		{TCP, 0x08020202, 22, Drop},
+		{ICMP, 0x08020202, 0, Drop},
+		{UDP, 0x08010101, 22, Accept},
+	}
+	for _, tt := range tests {
+		if got := f.Check(tt.proto, tt.src, 0x01020304, tt.dstPort); got != tt.want {
+			t.Errorf("Check(%v, %v, %d) = %v, want %v", tt.proto, tt.src, tt.dstPort, got, tt.want)
+		}
+	}
+	if drops := f.DropCounts(); len(drops) != 0 {
+		t.Errorf("Check counted drops: %v", drops)
+	}
+}
+
+func TestExempt(t *testing.T) {
+	f := NewAllowNone()
+	f.Exempt([]IP{0x08080808}, 53)
+	syn := func(proto packet.IPProto) []byte {
+		b := rawpacket(proto, 200)
+		b[33] = packet.TCPSyn // rawpacket's IP header is 20 bytes
+		return b
+	}
+	var q QDecode
+	if got := f.RunIn(syn(TCP), &q, 0); got != Accept {
+		t.Errorf("TCP SYN to exempt port: got %v, want Accept", got)
+	}
+	if got := f.RunIn(syn(UDP), &q, 0); got != Drop {
+		t.Errorf("UDP to exempt port: got %v, want Drop", got)
+	}
+	if got := f.RunIn(rawpacket(ICMP, 200), &q, 0); got != Drop {
+		t.Errorf("ICMP to exempt IP: got %v, want Drop", got)
+	}
+	if got := f.Check(TCP, 0x08080808, 0x08080808, 53); got != Drop {
+		t.Errorf("Check of exempt port = %v, want Drop", got)
+	}
+
+	f = NewAllowNone()
+	f.Exempt([]IP{0x01020304}, 53)
+	if got := f.RunIn(syn(TCP), &q, 0); got != Drop {
+		t.Errorf("TCP SYN to another IP: got %v, want Drop", got)
+	}
+}
+
+// BenchmarkFilter measures the per-packet cost of the filter on the
+// WireGuard worker path. It runs in parallel, since wireguard-go
+// calls the filter from one worker goroutine per CPU.
+func BenchmarkFilter(b *testing.B) {
+	f := New(Matches{
+		{SrcIPs: []IP{0x08080808}, DstPorts: ippr(IPAny, 53, 53)},
+	})
+	tcp := rawpacket(TCP, 200)
+	udp := rawpacket(UDP, 200)
+	// The flags wgengine runs the filter with.
+	const rf = LogDrops | LogAccepts
+	in := func(b []byte, q *QDecode) Response { return f.RunIn(b, q, rf) }
+	out := func(b []byte, q *QDecode) Response { return f.RunOut(b, q, rf) }
+
+	for _, bench := range []struct {
+		name string
+		run  func([]byte, *QDecode) Response
+		pkt  []byte
+	}{
+		{"in-tcp", in, tcp},
+		{"in-udp", in, udp},
+		{"out-tcp", out, tcp},
+		{"out-udp", out, udp},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bench.pkt)))
+			b.RunParallel(func(pb *testing.PB) {
+				var q QDecode
+				for pb.Next() {
+					bench.run(bench.pkt, &q)
+				}
+			})
+		})
+	}
+}
+
 func qdecode(proto packet.IPProto, src, dst packet.IP, sport, dport uint16) QDecode {
 	return QDecode{
 		IPProto:  proto,
@@ -119,3 +119,24 @@ func matchIPWithoutPorts(mm Matches, q *packet.QDecode) bool {
 	}
 	return false
 }
+
+// blockingRule returns the index in mm of the first rule whose
+// destinations cover q's, ignoring ports if !ports, but whose sources
+// don't include q's, or NoRule if there's none.
+func blockingRule(mm Matches, q *packet.QDecode, ports bool) int {
+	for i, acl := range mm {
+		for _, dst := range acl.DstPorts {
+			if dst.IP != IPAny && dst.IP != q.DstIP {
+				continue
+			}
+			if ports && (q.DstPort < dst.Ports.First || q.DstPort > dst.Ports.Last) {
+				continue
+			}
+			if !ipInList(q.SrcIP, acl.SrcIPs) {
+				return i
+			}
+			break
+		}
+	}
+	return NoRule
+}
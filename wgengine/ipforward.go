@@ -0,0 +1,21 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+// CheckIPForwarding reports whether the operating system is
+// configured to forward IP packets between interfaces, which is
+// required for this node to act as a subnet router.
+//
+// It returns nil if forwarding is enabled, or if the current
+// platform doesn't let us tell.
+func CheckIPForwarding() error {
+	return checkIPForwarding()
+}
+
+// EnableIPForwarding turns on IP forwarding in the operating system,
+// for both IPv4 and IPv6 where supported. It requires root.
+func EnableIPForwarding() error {
+	return enableIPForwarding()
+}
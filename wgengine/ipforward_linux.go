@@ -0,0 +1,49 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+var ipForwardSysctls = []struct {
+	name string // sysctl name, for error messages
+	path string // file in /proc/sys
+}{
+	{"net.ipv4.ip_forward", "/proc/sys/net/ipv4/ip_forward"},
+	{"net.ipv6.conf.all.forwarding", "/proc/sys/net/ipv6/conf/all/forwarding"},
+}
+
+func checkIPForwarding() error {
+	for _, s := range ipForwardSysctls {
+		bs, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// IPv6 disabled in the kernel, most likely.
+				continue
+			}
+			return fmt.Errorf("couldn't check %s: %v", s.name, err)
+		}
+		if string(bytes.TrimSpace(bs)) != "1" {
+			return fmt.Errorf("%s is disabled; subnet routing won't work", s.name)
+		}
+	}
+	return nil
+}
+
+func enableIPForwarding() error {
+	for _, s := range ipForwardSysctls {
+		if _, err := os.Stat(s.path); os.IsNotExist(err) {
+			continue
+		}
+		if err := ioutil.WriteFile(s.path, []byte("1\n"), 0644); err != nil {
+			return fmt.Errorf("setting %s=1: %v", s.name, err)
+		}
+	}
+	return nil
+}
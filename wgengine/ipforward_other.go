@@ -0,0 +1,20 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package wgengine
+
+import (
+	"errors"
+	"runtime"
+)
+
+// checkIPForwarding assumes forwarding is configured correctly,
+// since we don't know how to check it on this platform.
+func checkIPForwarding() error { return nil }
+
+func enableIPForwarding() error {
+	return errors.New("enabling IP forwarding is not supported on " + runtime.GOOS)
+}
@@ -7,43 +7,158 @@ package magicsock
 import (
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
+
+	"tailscale.com/tailcfg"
 )
 
 // derpFakeIPStr is a fake WireGuard endpoint IP address that means
 // to use DERP. When used, the port number of the WireGuard endpoint
-// is the DERP server number to use.
+// is the DERP region ID to use.
 const derpMagicIPStr = "127.3.3.40"       // 3340 are above the keys DERP on the keyboard
 var derpMagicIP = net.IPv4(127, 3, 3, 40) // net.IP version of above
 
-var (
-	derpHostOfIndex = map[int]string{} // index (fake port number) -> hostname
-	derpIndexOfHost = map[string]int{} // derpHostOfIndex reversed
-)
+// defaultDERPMap is the DERP map a Conn uses until SetDERPMap gives
+// it another, normally one from the control server.
+var defaultDERPMap = &tailcfg.DERPMap{
+	Regions: map[int]*tailcfg.DERPRegion{
+		1: {
+			RegionID:   1,
+			RegionCode: "default",
+			Nodes:      []*tailcfg.DERPNode{{Name: "1a", HostName: "derp.tailscale.com", STUNPort: -1}},
+		},
+	},
+}
 
-func init() {
-	// Just one zone for now:
-	addDerper(1, "derp.tailscale.com")
+// derpRegionHost returns the hostname of the preferred server of
+// region id in dm, or "" if there's none.
+func derpRegionHost(dm *tailcfg.DERPMap, id int) string {
+	if dm == nil {
+		return ""
+	}
+	r := dm.Regions[id]
+	if r == nil {
+		return ""
+	}
+	for _, n := range r.Nodes {
+		if n != nil && n.HostName != "" {
+			return n.HostName
+		}
+	}
+	return ""
 }
 
-func addDerper(i int, host string) {
-	if other, dup := derpHostOfIndex[i]; dup {
-		panic(fmt.Sprintf("duplicate DERP index %v (host %q and %q)", i, other, host))
+// derpSTUNServers returns the "host:port" of each STUN server run by
+// a node in dm, mapped to the ID of the node's region.
+func derpSTUNServers(dm *tailcfg.DERPMap) map[string]int {
+	ret := make(map[string]int)
+	if dm == nil {
+		return ret
+	}
+	for id, r := range dm.Regions {
+		if r == nil {
+			continue
+		}
+		for _, n := range r.Nodes {
+			if n == nil || n.HostName == "" || n.STUNPort < 0 {
+				continue
+			}
+			port := n.STUNPort
+			if port == 0 {
+				port = 3478
+			}
+			ret[net.JoinHostPort(n.HostName, strconv.Itoa(port))] = id
+		}
+	}
+	return ret
+}
+
+// homeSwitchRatio is how much faster than the current home region
+// another must be, by latency, to become the home region instead.
+// It keeps noise in the measurements from moving the node back and
+// forth, and its peers' DERP connections with it.
+const homeSwitchRatio = 0.7
+
+// homeRegion returns the ID of the region in dm this node is reached
+// through, which it reports to control as NetInfo.PreferredDERP for
+// peers to use: the one with the lowest latency, as measured by its
+// STUN servers, or if there's none, the lowest-numbered region with a
+// server. It stays cur, the current home, unless another is clearly
+// faster. It returns 0 if dm has no servers.
+func homeRegion(dm *tailcfg.DERPMap, latency map[int]float64, cur int) int {
+	var ids []int
+	if dm != nil {
+		for id := range dm.Regions {
+			if derpRegionHost(dm, id) != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return 0
+	}
+	sort.Ints(ids)
+	best, bestLat := 0, 0.0
+	for _, id := range ids {
+		if lat, ok := latency[id]; ok && (best == 0 || lat < bestLat) {
+			best, bestLat = id, lat
+		}
+	}
+	curOK := derpRegionHost(dm, cur) != ""
+	if best == 0 {
+		if curOK {
+			return cur
+		}
+		return ids[0]
+	}
+	if curLat, ok := latency[cur]; curOK && ok && bestLat > curLat*homeSwitchRatio {
+		return cur
+	}
+	return best
+}
+
+// derpHost returns the hostname of the DERP server for region i (a
+// fake port number used with derpMagicIP), or "" if c's DERP map
+// doesn't have the region.
+func (c *Conn) derpHost(i int) string {
+	c.derpMu.Lock()
+	defer c.derpMu.Unlock()
+	return derpRegionHost(c.derpMap, i)
+}
+
+// DERPHostOfAddr reports whether addr, an "ip:port" string, is the
+// fake address of a DERP server, and if so returns its hostname.
+// Regions missing from the DERP map are named by their ID.
+func (c *Conn) DERPHostOfAddr(addr string) (host string, ok bool) {
+	h, p, err := net.SplitHostPort(addr)
+	if err != nil || h != derpMagicIPStr {
+		return "", false
+	}
+	i, err := strconv.Atoi(p)
+	if err != nil {
+		return "", false
 	}
-	if other, dup := derpIndexOfHost[host]; dup {
-		panic(fmt.Sprintf("duplicate DERP host %q (index %v and %v)", host, other, i))
+	if host := c.derpHost(i); host != "" {
+		return host, true
 	}
-	derpHostOfIndex[i] = host
-	derpIndexOfHost[host] = i
+	return fmt.Sprintf("derp-region-%d", i), true
 }
 
-// derpHost returns the hostname of a DERP server index (a fake port
-// number used with derpMagicIP). It always returns a non-empty string.
-func derpHost(i int) string {
-	if h, ok := derpHostOfIndex[i]; ok {
-		return h
+// SetDERPMap replaces the DERP servers c relays through with those
+// in dm, or the default ones if dm is nil. Connections to servers no
+// longer in the map are closed; the new ones are dialed on first use.
+func (c *Conn) SetDERPMap(dm *tailcfg.DERPMap) {
+	if dm == nil {
+		dm = defaultDERPMap
 	}
-	if 1 <= i && i <= 64<<10 {
-		return fmt.Sprintf("derp%v.tailscale.com", i)
+	c.derpMu.Lock()
+	defer c.derpMu.Unlock()
+	c.derpMap = dm
+	for id, ad := range c.activeDerp {
+		if host := derpRegionHost(dm, id); host != ad.host {
+			c.logf("magicsock: DERP region %d moved from %q to %q, closing connection", id, ad.host, host)
+			c.closeDerpLocked(id)
+		}
 	}
-	return "derp.tailscale.com"
 }
@@ -24,11 +24,14 @@ import (
 	"github.com/tailscale/wireguard-go/conn"
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/clientmetrics"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/stun"
 	"tailscale.com/stunner"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
 )
 
 // A Conn routes UDP packets and actively manages a list of its endpoints.
@@ -36,11 +39,14 @@ import (
 type Conn struct {
 	pconn         *RebindingUDPConn
 	pconnPort     uint16
+	dscp          uint8 // DiffServ code point set on new sockets, or zero
+	recvBuf       int   // SO_RCVBUF to request on new sockets, or zero
+	sendBuf       int   // SO_SNDBUF to request on new sockets, or zero
 	privateKey    key.Private
 	stunServers   []string
 	startEpUpdate chan struct{} // send to trigger endpoint update
 	epFunc        func(endpoints []string)
-	logf          func(format string, args ...interface{})
+	logf          logger.Logf
 	donec         chan struct{} // closed on Conn.Close
 
 	epUpdateCtx    context.Context // endpoint updater context
@@ -67,9 +73,20 @@ type Conn struct {
 	udpRecvCh  chan udpReadResult
 	derpRecvCh chan derpReadResult
 
-	derpMu      sync.Mutex
-	derpConn    map[int]*derphttp.Client // magic derp port (see derpmap.go) to its client
-	derpWriteCh map[int]chan<- derpWriteRequest
+	derpMu     sync.Mutex
+	derpMap    *tailcfg.DERPMap   // current DERP servers, see SetDERPMap
+	activeDerp map[int]activeDerp // DERP region ID (magic port, see derpmap.go) to its connection
+	paused     bool               // no DERP or STUN traffic, see SetPaused
+	derpLat    map[int]float64    // region ID to latency, from the last endpoint update
+	home       int                // home DERP region, see homeRegion
+
+	epMu          sync.Mutex
+	lastEndpoints []string         // last endpoints reported to epFunc
+	natType       NATType          // NAT classification from the last endpoint update
+	netInfo       *tailcfg.NetInfo // summary of the last endpoint update, or nil
+
+	pingMu sync.Mutex
+	pings  map[pingTx]chan<- *net.UDPAddr // outstanding path pings, see ping.go
 }
 
 // udpAddr is the key in the indexedAddrs map.
@@ -87,6 +104,12 @@ type indexedAddrSet struct {
 	index int // index of map key in addr.Addrs
 }
 
+// DefaultSocketBufferSize is the default size in bytes requested for
+// the UDP socket receive and send buffers. The OS defaults (often
+// around 200KB) are small enough to drop packets during bursts
+// on fast links.
+const DefaultSocketBufferSize = 4 << 20
+
 // DefaultPort is the default port to listen on.
 // The current default (zero) means to auto-select a random free port.
 const DefaultPort = 0
@@ -107,6 +130,45 @@ type Options struct {
 	// EndpointsFunc optionally provides a func to be called when
 	// endpoints change. The called func does not own the slice.
 	EndpointsFunc func(endpoint []string)
+
+	// DSCP optionally specifies the DiffServ code point (0-63) to
+	// mark outgoing UDP packets with, so that networks can classify
+	// or prioritize tunnel traffic. Zero leaves the OS default.
+	//
+	// Only the outer header is marked; the DSCP of the encapsulated
+	// packet isn't visible here, as wireguard-go hands us only the
+	// encrypted datagram.
+	DSCP uint8
+
+	// RecvBufferSize and SendBufferSize are the sizes in bytes to
+	// request for the UDP socket buffers. Zero means
+	// DefaultSocketBufferSize; a negative value leaves the OS
+	// default alone. The OS may clamp the request (on Linux, to
+	// net.core.rmem_max and wmem_max); the effective sizes are
+	// logged at startup.
+	RecvBufferSize int
+	SendBufferSize int
+
+	// Logf logs the Conn's events, its chattier lines tagged as
+	// verbose for logger.Levels. If nil, it's log.Printf.
+	Logf logger.Logf
+}
+
+func (o *Options) logf() logger.Logf {
+	if o.Logf == nil {
+		return log.Printf
+	}
+	return o.Logf
+}
+
+func bufferSize(n int) int {
+	switch {
+	case n == 0:
+		return DefaultSocketBufferSize
+	case n < 0:
+		return 0
+	}
+	return n
 }
 
 func (o *Options) endpointsFunc() func([]string) {
@@ -120,48 +182,90 @@ func (o *Options) endpointsFunc() func([]string) {
 // As the set of possible endpoints for a Conn changes, the
 // callback opts.EndpointsFunc is called.
 func Listen(opts Options) (*Conn, error) {
-	var packetConn net.PacketConn
-	var err error
-	if opts.Port == 0 {
-		// Our choice of port. Start with DefaultPort.
-		// If unavailable, pick any port.
-		want := fmt.Sprintf(":%d", DefaultPort)
-		log.Printf("magicsock: bind: trying %v\n", want)
-		packetConn, err = net.ListenPacket("udp4", want)
-		if err != nil {
-			want = ":0"
-			log.Printf("magicsock: bind: falling back to %v (%v)\n", want, err)
-			packetConn, err = net.ListenPacket("udp4", want)
-		}
-	} else {
-		packetConn, err = net.ListenPacket("udp4", fmt.Sprintf(":%d", opts.Port))
+	if opts.DSCP > 63 {
+		return nil, fmt.Errorf("magicsock.Listen: invalid DSCP %d", opts.DSCP)
 	}
-	if err != nil {
-		return nil, fmt.Errorf("magicsock.Listen: %v", err)
-	}
-
 	epUpdateCtx, epUpdateCancel := context.WithCancel(context.Background())
 	c := &Conn{
 		pconn:          new(RebindingUDPConn),
 		pconnPort:      opts.Port,
+		dscp:           opts.DSCP,
+		recvBuf:        bufferSize(opts.RecvBufferSize),
+		sendBuf:        bufferSize(opts.SendBufferSize),
 		donec:          make(chan struct{}),
 		stunServers:    append([]string{}, opts.STUN...),
 		startEpUpdate:  make(chan struct{}, 1),
 		epUpdateCtx:    epUpdateCtx,
 		epUpdateCancel: epUpdateCancel,
 		epFunc:         opts.endpointsFunc(),
-		logf:           log.Printf,
+		logf:           opts.logf(),
 		indexedAddrs:   make(map[udpAddr]indexedAddrSet),
 		derpRecvCh:     make(chan derpReadResult),
 		udpRecvCh:      make(chan udpReadResult),
+		derpMap:        defaultDERPMap,
+	}
+
+	var packetConn *net.UDPConn
+	var err error
+	if opts.Port == 0 {
+		// Our choice of port. Start with DefaultPort.
+		// If unavailable, pick any port.
+		want := fmt.Sprintf(":%d", DefaultPort)
+		c.logf("[v1] magicsock: bind: trying %v\n", want)
+		packetConn, err = c.listenPacket(want)
+		if err != nil {
+			want = ":0"
+			c.logf("magicsock: bind: falling back to %v (%v)\n", want, err)
+			packetConn, err = c.listenPacket(want)
+		}
+	} else {
+		packetConn, err = c.listenPacket(fmt.Sprintf(":%d", opts.Port))
+	}
+	if err != nil {
+		epUpdateCancel()
+		return nil, fmt.Errorf("magicsock.Listen: %v", err)
+	}
+	if c.dscp != 0 {
+		c.logf("magicsock: marking outgoing packets with DSCP %d\n", c.dscp)
 	}
+	if rcv, snd, err := socketBufferSizes(packetConn); err == nil {
+		c.logf("magicsock: socket buffers: rcv=%d snd=%d (requested %d/%d)\n", rcv, snd, c.recvBuf, c.sendBuf)
+	}
+
 	c.ignoreSTUNPackets()
-	c.pconn.Reset(packetConn.(*net.UDPConn))
-	c.reSTUN()
+	c.pconn.Reset(packetConn)
+	c.ReSTUN()
 	go c.epUpdate(epUpdateCtx)
 	return c, nil
 }
 
+// listenPacket opens a UDP socket on addr, like
+// net.ListenPacket("udp4", addr), and applies c's socket options to it.
+func (c *Conn) listenPacket(addr string) (*net.UDPConn, error) {
+	packetConn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	uc := packetConn.(*net.UDPConn)
+	if c.recvBuf > 0 {
+		if err := uc.SetReadBuffer(c.recvBuf); err != nil {
+			c.logf("magicsock: setting receive buffer to %d: %v", c.recvBuf, err)
+		}
+	}
+	if c.sendBuf > 0 {
+		if err := uc.SetWriteBuffer(c.sendBuf); err != nil {
+			c.logf("magicsock: setting send buffer to %d: %v", c.sendBuf, err)
+		}
+	}
+	if c.dscp != 0 {
+		if err := setDSCP(uc, c.dscp); err != nil {
+			// Not fatal: the traffic still flows, just unmarked.
+			c.logf("magicsock: setting DSCP %d: %v", c.dscp, err)
+		}
+	}
+	return uc, nil
+}
+
 // ignoreSTUNPackets sets a STUN packet processing func that does nothing.
 func (c *Conn) ignoreSTUNPackets() {
 	c.stunReceiveFunc.Store(func([]byte, *net.UDPAddr) {})
@@ -205,6 +309,9 @@ func (c *Conn) epUpdate(ctx context.Context) {
 				return
 			}
 			lastEndpoints = endpoints
+			c.epMu.Lock()
+			c.lastEndpoints = endpoints
+			c.epMu.Unlock()
 			c.epFunc(endpoints)
 		}()
 	}
@@ -217,10 +324,12 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]string, error) {
 		alreadyMu sync.Mutex
 		already   = make(map[string]bool) // endpoint -> true
 	)
-	var eps []string // unique endpoints
+	var eps []string     // unique endpoints
+	var stunEps []string // one per STUN reply, for NAT classification
+	var localEps []string
 
 	addAddr := func(s, reason string) {
-		log.Printf("magicsock: found local %s (%s)\n", s, reason)
+		c.logf("[v1] magicsock: found local %s (%s)\n", s, reason)
 
 		alreadyMu.Lock()
 		defer alreadyMu.Unlock()
@@ -230,10 +339,36 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]string, error) {
 		}
 	}
 
+	onSTUN := func(s string) {
+		alreadyMu.Lock()
+		stunEps = append(stunEps, s)
+		alreadyMu.Unlock()
+		addAddr(s, "stun")
+	}
+	latency := map[string]float64{}
+	onLatency := func(server string, d time.Duration) {
+		alreadyMu.Lock()
+		latency[server] = d.Seconds()
+		alreadyMu.Unlock()
+	}
+
+	// Besides the configured STUN servers, ask the DERP nodes',
+	// to measure the latency to each region.
+	c.derpMu.Lock()
+	derpSTUN := derpSTUNServers(c.derpMap)
+	c.derpMu.Unlock()
+	servers := append([]string(nil), c.stunServers...)
+	for server := range derpSTUN {
+		if !stringsContain(servers, server) {
+			servers = append(servers, server)
+		}
+	}
+
 	s := &stunner.Stunner{
 		Send:     c.pconn.WriteTo,
-		Endpoint: func(s string) { addAddr(s, "stun") },
-		Servers:  c.stunServers,
+		Endpoint: onSTUN,
+		Latency:  onLatency,
+		Servers:  servers,
 		Logf:     c.logf,
 	}
 
@@ -248,6 +383,7 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]string, error) {
 	if localAddr := c.pconn.LocalAddr(); localAddr.IP.IsUnspecified() {
 		localPort := fmt.Sprintf("%d", localAddr.Port)
 		loopbacks, err := localAddresses(localPort, func(s string) {
+			localEps = append(localEps, s)
 			addAddr(s, "localAddresses")
 		})
 		if err != nil {
@@ -265,9 +401,43 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]string, error) {
 	} else {
 		// Our local endpoint is bound to a particular address.
 		// Do not offer addresses on other local interfaces.
+		localEps = append(localEps, localAddr.String())
 		addAddr(localAddr.String(), "socket")
 	}
 
+	nat := classifyNAT(stunEps, localEps)
+	alreadyMu.Lock()
+	ni := &tailcfg.NetInfo{
+		NATType:     nat.String(),
+		UDPBlocked:  len(servers) > 0 && len(stunEps) == 0,
+		STUNLatency: make(map[string]float64, len(latency)),
+		DERPLatency: make(map[int]float64),
+	}
+	// A late reply may still add to latency.
+	for server, d := range latency {
+		ni.STUNLatency[server] = d
+		id, ok := derpSTUN[server]
+		if !ok {
+			continue
+		}
+		if old, ok := ni.DERPLatency[id]; !ok || d < old {
+			ni.DERPLatency[id] = d
+		}
+	}
+	alreadyMu.Unlock()
+	c.derpMu.Lock()
+	c.derpLat = ni.DERPLatency
+	c.home = homeRegion(c.derpMap, c.derpLat, c.home)
+	ni.PreferredDERP = c.home
+	c.derpMu.Unlock()
+	c.epMu.Lock()
+	if nat != c.natType {
+		c.logf("magicsock: NAT type: %v (STUN saw %v)", nat, stunEps)
+	}
+	c.natType = nat
+	c.netInfo = ni
+	c.epMu.Unlock()
+
 	// Note: the endpoints are intentionally returned in priority order,
 	// from "farthest but most reliable" to "closest but least
 	// reliable." Addresses returned from STUN should be globally
@@ -281,6 +451,15 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]string, error) {
 	return eps, nil
 }
 
+func stringsContain(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 func stringsEqual(x, y []string) bool {
 	if len(x) != len(y) {
 		return false
@@ -417,23 +596,39 @@ func appendDests(dsts []*net.UDPAddr, as *AddrSet, b []byte) (_ []*net.UDPAddr,
 		}
 	}
 
-	// Pick our destination address(es).
+	// Pick our destination address(es), skipping any that are
+	// backing off after persistent send errors.
 	roamAddr = as.roamAddr
-	if roamAddr != nil {
+	if roamAddr != nil && !as.backedOffLocked(roamAddr, now) {
 		dsts = append(dsts, roamAddr)
 		if !spray {
 			return dsts, roamAddr
 		}
 	}
+	// If the current address is backing off, fall back to the
+	// best address that isn't.
+	anyAddr := as.curAddr == -1 || as.backedOffLocked(&as.addrs[as.curAddr], now)
 	for i := len(as.addrs) - 1; i >= 0; i-- {
 		addr := &as.addrs[i]
-		if spray || as.curAddr == -1 || as.curAddr == i {
+		if as.backedOffLocked(addr, now) {
+			continue
+		}
+		if spray || anyAddr || as.curAddr == i {
 			dsts = append(dsts, addr)
 		}
 		if !spray && len(dsts) != 0 {
 			break
 		}
 	}
+	if len(dsts) == 0 && len(as.addrs) > 0 {
+		// Everything is backing off. Keep trying the
+		// highest-priority address rather than going silent.
+		i := as.curAddr
+		if i == -1 {
+			i = len(as.addrs) - 1
+		}
+		dsts = append(dsts, &as.addrs[i])
+	}
 	if logPacketDests {
 		log.Printf("spray=%v; roam=%v; dests=%v", spray, roamAddr, dsts)
 	}
@@ -470,8 +665,13 @@ func (c *Conn) Send(b []byte, ep conn.Endpoint) error {
 		} else if ret == nil {
 			ret = err
 		}
-		if err != nil && addr != roamAddr {
-			log.Printf("magicsock: Conn.Send(%v): %v", addr, err)
+		d, quiet := as.noteSendResult(addr, err, time.Now())
+		switch {
+		case quiet:
+		case d > 0:
+			c.logf("magicsock: Conn.Send(%v): %v; backing off for %v", addr, err, d)
+		case err != nil && addr != roamAddr:
+			c.logf("magicsock: Conn.Send(%v): %v", addr, err)
 		}
 	}
 	if success {
@@ -484,28 +684,58 @@ var errConnClosed = errors.New("Conn closed")
 
 var errDropDerpPacket = errors.New("too many DERP packets queued; dropping")
 
+var errNoDerpRegion = errors.New("DERP region not in the DERP map")
+
+var errDerpClosed = errors.New("DERP connection closed")
+
+var errDerpPaused = errors.New("DERP paused")
+
+var (
+	metricSendUDP         = clientmetrics.NewCounter("magicsock_send_udp", "Packets sent directly to peers over UDP.")
+	metricSendDERP        = clientmetrics.NewCounter("magicsock_send_derp", "Packets sent to peers through DERP.")
+	metricSendDERPDropped = clientmetrics.NewCounter("magicsock_send_derp_dropped", "Packets dropped because too many were queued for a DERP server.")
+	metricRecvUDP         = clientmetrics.NewCounter("magicsock_recv_udp", "Packets received directly from peers over UDP.")
+	metricRecvDERP        = clientmetrics.NewCounter("magicsock_recv_derp", "Packets received from peers through DERP.")
+	metricDERPConns       = clientmetrics.NewGauge("magicsock_derp_connections", "Open connections to DERP servers.")
+)
+
 // sendAddr sends packet b to addr, which is either a real UDP address
 // or a fake UDP address representing a DERP server (see derpmap.go).
 // The provided public key identifies the recipient.
 func (c *Conn) sendAddr(addr *net.UDPAddr, pubKey key.Public, b []byte) error {
-	if ch := c.derpWriteChanOfAddr(addr); ch != nil {
+	if addr.IP.Equal(derpMagicIP) {
+		ad, err := c.derpConnOfAddr(addr)
+		if err != nil {
+			return err
+		}
 		errc := make(chan error, 1)
 		select {
 		case <-c.donec:
 			return errConnClosed
-		case ch <- derpWriteRequest{addr, pubKey, b, errc}:
+		case <-ad.done:
+			return errDerpClosed
+		case ad.writeCh <- derpWriteRequest{addr, pubKey, b, errc}:
 			select {
 			case <-c.donec:
 				return errConnClosed
+			case <-ad.done:
+				return errDerpClosed
 			case err := <-errc:
+				if err == nil {
+					metricSendDERP.Add(1)
+				}
 				return err // usually nil
 			}
 		default:
 			// Too many writes queued. Drop packet.
+			metricSendDERPDropped.Add(1)
 			return errDropDerpPacket
 		}
 	}
 	_, err := c.pconn.WriteTo(b, addr)
+	if err == nil {
+		metricSendUDP.Add(1)
+	}
 	return err
 }
 
@@ -516,36 +746,65 @@ func (c *Conn) sendAddr(addr *net.UDPAddr, pubKey key.Public, b []byte) error {
 // TODO: this is currently arbitrary. Figure out something better?
 const bufferedDerpWritesBeforeDrop = 4
 
-// derpWriteChanOfAddr returns a DERP client for fake UDP addresses that
-// represent DERP servers, creating them as necessary. For real UDP
-// addresses, it returns nil.
-func (c *Conn) derpWriteChanOfAddr(addr *net.UDPAddr) chan<- derpWriteRequest {
-	if !addr.IP.Equal(derpMagicIP) {
-		return nil
-	}
+// activeDerp is a connection to the DERP server of one region.
+type activeDerp struct {
+	c       *derphttp.Client
+	host    string
+	writeCh chan<- derpWriteRequest
+	done    chan struct{} // closed when the connection is dropped
+}
+
+// derpConnOfAddr returns the DERP connection for addr, a fake UDP
+// address representing a DERP region, dialing it as necessary. It
+// fails if the region isn't in the DERP map, or c is paused.
+func (c *Conn) derpConnOfAddr(addr *net.UDPAddr) (activeDerp, error) {
 	c.derpMu.Lock()
 	defer c.derpMu.Unlock()
-	ch, ok := c.derpWriteCh[addr.Port]
-	if !ok {
-		if c.derpWriteCh == nil {
-			c.derpWriteCh = make(map[int]chan<- derpWriteRequest)
-			c.derpConn = make(map[int]*derphttp.Client)
-		}
-		host := derpHost(addr.Port)
-		dc, err := derphttp.NewClient(c.privateKey, "https://"+host+"/derp", log.Printf)
-		if err != nil {
-			log.Printf("derphttp.NewClient: port %d, host %q invalid? err: %v", addr.Port, host, err)
-			return nil
-		}
+	if c.paused {
+		return activeDerp{}, errDerpPaused
+	}
+	ad, ok := c.activeDerp[addr.Port]
+	if ok {
+		return ad, nil
+	}
+	host := derpRegionHost(c.derpMap, addr.Port)
+	if host == "" {
+		return activeDerp{}, errNoDerpRegion
+	}
+	dc, err := derphttp.NewClient(c.privateKey, "https://"+host+"/derp", c.logf)
+	if err != nil {
+		c.logf("magicsock: derphttp.NewClient: region %d, host %q invalid? err: %v", addr.Port, host, err)
+		return activeDerp{}, errNoDerpRegion
+	}
 
-		bidiCh := make(chan derpWriteRequest, bufferedDerpWritesBeforeDrop)
-		ch = bidiCh
-		c.derpConn[addr.Port] = dc
-		c.derpWriteCh[addr.Port] = ch
-		go c.runDerpReader(addr, dc)
-		go c.runDerpWriter(addr, dc, bidiCh)
+	bidiCh := make(chan derpWriteRequest, bufferedDerpWritesBeforeDrop)
+	ad = activeDerp{
+		c:       dc,
+		host:    host,
+		writeCh: bidiCh,
+		done:    make(chan struct{}),
 	}
-	return ch
+	if c.activeDerp == nil {
+		c.activeDerp = make(map[int]activeDerp)
+	}
+	c.activeDerp[addr.Port] = ad
+	metricDERPConns.Add(1)
+	go c.runDerpReader(addr, dc, ad.done)
+	go c.runDerpWriter(addr, dc, bidiCh, ad.done)
+	return ad, nil
+}
+
+// closeDerpLocked drops the connection to the DERP server of region
+// id. c.derpMu must be held.
+func (c *Conn) closeDerpLocked(id int) {
+	ad, ok := c.activeDerp[id]
+	if !ok {
+		return
+	}
+	delete(c.activeDerp, id)
+	metricDERPConns.Add(-1)
+	close(ad.done)
+	ad.c.Close()
 }
 
 // derpReadResult is the type sent by runDerpClient to ReceiveIPv4
@@ -560,11 +819,29 @@ type derpReadResult struct {
 	copyBuf func(dst []byte) int
 }
 
-var logDerpVerbose, _ = strconv.ParseBool(os.Getenv("DEBUG_DERP_VERBOSE"))
+// verboseLogging is 1 if every packet received from DERP is logged.
+// It starts out set from $DEBUG_DERP_VERBOSE.
+var verboseLogging int32
+
+func init() {
+	if v, _ := strconv.ParseBool(os.Getenv("DEBUG_DERP_VERBOSE")); v {
+		verboseLogging = 1
+	}
+}
+
+// SetVerboseLogging turns on or off logging of every packet received
+// from DERP, for debugging relayed connections at runtime.
+func SetVerboseLogging(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&verboseLogging, v)
+}
 
 // runDerpReader runs in a goroutine for the life of a DERP
 // connection, handling received packets.
-func (c *Conn) runDerpReader(derpFakeAddr *net.UDPAddr, dc *derphttp.Client) {
+func (c *Conn) runDerpReader(derpFakeAddr *net.UDPAddr, dc *derphttp.Client, done <-chan struct{}) {
 	didCopy := make(chan struct{}, 1)
 	var buf [derp.MaxPacketSize]byte
 	var bufValid int // bytes in buf that are valid
@@ -583,9 +860,11 @@ func (c *Conn) runDerpReader(derpFakeAddr *net.UDPAddr, dc *derphttp.Client) {
 			select {
 			case <-c.donec:
 				return
+			case <-done:
+				return
 			default:
 			}
-			log.Printf("derp.Recv: %v", err)
+			c.logf("magicsock: derp.Recv: %v", err)
 			time.Sleep(250 * time.Millisecond)
 			continue
 		}
@@ -597,12 +876,20 @@ func (c *Conn) runDerpReader(derpFakeAddr *net.UDPAddr, dc *derphttp.Client) {
 			// TODO: handle endpoint notification messages.
 			continue
 		}
-		if logDerpVerbose {
-			log.Printf("got derp %v packet: %q", derpFakeAddr, buf[:bufValid])
+		// Not tagged with a level: SetVerboseLogging is this
+		// line's switch, and it shouldn't take a log level too.
+		if atomic.LoadInt32(&verboseLogging) == 1 {
+			c.logf("magicsock: got derp %v packet: %q", derpFakeAddr, buf[:bufValid])
+		}
+		if isPathPing(buf[:bufValid]) {
+			c.handlePathPing(buf[:bufValid], derpFakeAddr)
+			continue
 		}
 		select {
 		case <-c.donec:
 			return
+		case <-done:
+			return
 		case c.derpRecvCh <- derpReadResult{derpFakeAddr, bufValid, copyFn}:
 			<-didCopy
 		}
@@ -618,20 +905,24 @@ type derpWriteRequest struct {
 
 // runDerpWriter runs in a goroutine for the life of a DERP
 // connection, handling received packets.
-func (c *Conn) runDerpWriter(derpFakeAddr *net.UDPAddr, dc *derphttp.Client, ch <-chan derpWriteRequest) {
+func (c *Conn) runDerpWriter(derpFakeAddr *net.UDPAddr, dc *derphttp.Client, ch <-chan derpWriteRequest, done <-chan struct{}) {
 	for {
 		select {
 		case <-c.donec:
 			return
+		case <-done:
+			return
 		case wr := <-ch:
 			err := dc.Send(wr.pubKey, wr.b)
 			if err != nil {
-				log.Printf("magicsock: derp.Send(%v): %v", wr.addr, err)
+				c.logf("magicsock: derp.Send(%v): %v", wr.addr, err)
 			}
 			select {
 			case wr.errc <- err:
 			case <-c.donec:
 				return
+			case <-done:
+				return
 			}
 		}
 	}
@@ -682,6 +973,10 @@ func (c *Conn) ReceiveIPv4(b []byte) (n int, ep conn.Endpoint, addr *net.UDPAddr
 
 			addr := pAddr.(*net.UDPAddr)
 			addr.IP = addr.IP.To4()
+			if isPathPing(b[:n]) {
+				c.handlePathPing(b[:n], addr)
+				continue
+			}
 			select {
 			case c.udpRecvCh <- udpReadResult{n: n, addr: addr}:
 			case <-c.donec:
@@ -712,15 +1007,22 @@ func (c *Conn) ReceiveIPv4(b []byte) (n int, ep conn.Endpoint, addr *net.UDPAddr
 		ncopy := dm.copyBuf(b)
 		if ncopy != n {
 			err = fmt.Errorf("received DERP packet of length %d that's too big for WireGuard ReceiveIPv4 buf size %d", n, ncopy)
-			log.Printf("magicsock: %v", err)
+			c.logf("magicsock: %v", err)
 			return 0, nil, nil, err
 		}
+		metricRecvDERP.Add(1)
 
 	case um := <-c.udpRecvCh:
 		if um.err != nil {
-			return 0, nil, nil, err
+			return 0, nil, nil, um.err
 		}
 		n, addr = um.n, um.addr
+		metricRecvUDP.Add(1)
+
+	case <-c.donec:
+		// The read goroutine may have given up sending its error
+		// once c was closed.
+		return 0, nil, nil, errors.New("Conn closed")
 	}
 
 	addrSet, _ := c.findIndexedAddrSet(addr)
@@ -755,51 +1057,169 @@ func (c *Conn) Close() error {
 	}
 	close(c.donec)
 	c.epUpdateCancel()
-	for _, dc := range c.derpConn {
-		dc.Close()
+	c.derpMu.Lock()
+	for id := range c.activeDerp {
+		c.closeDerpLocked(id)
 	}
+	c.derpMu.Unlock()
 	return c.pconn.Close()
 }
 
-func (c *Conn) reSTUN() {
+// ReSTUN triggers an immediate endpoint update, rediscovering this
+// node's public endpoints via STUN. It does nothing while c is
+// paused.
+func (c *Conn) ReSTUN() {
+	if c.isPaused() {
+		return
+	}
 	select {
 	case c.startEpUpdate <- struct{}{}:
 	case <-c.epUpdateCtx.Done():
 	}
 }
 
+// ReconnectDERP drops c's connections to DERP servers so that they
+// are redialed on next use.
+func (c *Conn) ReconnectDERP() {
+	c.derpMu.Lock()
+	defer c.derpMu.Unlock()
+	for _, ad := range c.activeDerp {
+		ad.c.Reconnect()
+	}
+}
+
+// SetPaused stops or restarts c's traffic to infrastructure servers.
+// While paused, c drops its DERP connections and doesn't redial
+// them, so packets to DERP addresses fail, and it sends no STUN
+// requests. Direct UDP traffic to peers is left alone.
+//
+// Unpausing doesn't rediscover endpoints by itself; callers
+// normally follow it with LinkChange or ReSTUN.
+func (c *Conn) SetPaused(paused bool) {
+	c.derpMu.Lock()
+	defer c.derpMu.Unlock()
+	c.paused = paused
+	if paused {
+		for id := range c.activeDerp {
+			c.closeDerpLocked(id)
+		}
+	}
+}
+
+func (c *Conn) isPaused() bool {
+	c.derpMu.Lock()
+	defer c.derpMu.Unlock()
+	return c.paused
+}
+
+// NATType returns the classification of the NAT in front of c's
+// socket, as of the most recent endpoint update.
+func (c *Conn) NATType() NATType {
+	c.epMu.Lock()
+	defer c.epMu.Unlock()
+	return c.natType
+}
+
+// NetInfo returns the network conditions found by the most recent
+// endpoint update, or nil if there hasn't been one.
+func (c *Conn) NetInfo() *tailcfg.NetInfo {
+	c.epMu.Lock()
+	defer c.epMu.Unlock()
+	return c.netInfo
+}
+
+// LogState writes a summary of c's current state to its log: the
+// local port, the last discovered endpoints, active DERP connections
+// and the address sets of known peers. It is meant for debugging.
+func (c *Conn) LogState() {
+	c.epMu.Lock()
+	eps := append([]string(nil), c.lastEndpoints...)
+	nat := c.natType
+	c.epMu.Unlock()
+	c.logf("magicsock: state: port=%d endpoints=%v nat=%v", c.LocalPort(), eps, nat)
+
+	c.derpMu.Lock()
+	for id, ad := range c.activeDerp {
+		c.logf("magicsock: state: derp %d (%s) connected", id, ad.host)
+	}
+	c.derpMu.Unlock()
+
+	for _, as := range c.addrSets() {
+		pk := wgcfg.Key(as.publicKey)
+		c.logf("magicsock: state: peer %s %s", pk.ShortString(), as)
+	}
+}
+
+// addrSets returns the AddrSets of all peers c knows about.
+func (c *Conn) addrSets() []*AddrSet {
+	c.indexedAddrsMu.Lock()
+	defer c.indexedAddrsMu.Unlock()
+	seen := make(map[*AddrSet]bool)
+	var sets []*AddrSet
+	for _, ia := range c.indexedAddrs {
+		if !seen[ia.addr] {
+			seen[ia.addr] = true
+			sets = append(sets, ia.addr)
+		}
+	}
+	return sets
+}
+
+// HomeDERP returns the hostname of the DERP server through which c
+// is reachable when no direct path to it works.
+func (c *Conn) HomeDERP() string {
+	c.derpMu.Lock()
+	defer c.derpMu.Unlock()
+	return derpRegionHost(c.derpMap, homeRegion(c.derpMap, c.derpLat, c.home))
+}
+
+// CurAddrs returns, for each peer that has sent us a valid packet,
+// the "ip:port" address we're currently sending to. DERP servers
+// appear as their fake addresses; use DERPHostOfAddr to tell them
+// apart from direct paths.
+func (c *Conn) CurAddrs() map[wgcfg.Key]string {
+	m := make(map[wgcfg.Key]string)
+	for _, as := range c.addrSets() {
+		if addr := as.curAddrString(); addr != "" {
+			m[wgcfg.Key(as.publicKey)] = addr
+		}
+	}
+	return m
+}
+
 func (c *Conn) LinkChange() {
-	defer c.reSTUN()
+	defer c.ReSTUN()
 
 	if c.pconnPort != 0 {
 		c.pconn.mu.Lock()
 		if err := c.pconn.pconn.Close(); err != nil {
-			log.Printf("magicsock: link change close failed: %v", err)
+			c.logf("magicsock: link change close failed: %v", err)
 		}
-		packetConn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", c.pconnPort))
+		packetConn, err := c.listenPacket(fmt.Sprintf(":%d", c.pconnPort))
 		if err == nil {
-			log.Printf("magicsock: link change rebound port: %d", c.pconnPort)
-			c.pconn.pconn = packetConn.(*net.UDPConn)
+			c.logf("magicsock: link change rebound port: %d", c.pconnPort)
+			c.pconn.pconn = packetConn
 			c.pconn.mu.Unlock()
 			return
 		}
-		log.Printf("magicsock: link change unable to bind fixed port %d: %v, falling back to random port", c.pconnPort, err)
+		c.logf("magicsock: link change unable to bind fixed port %d: %v, falling back to random port", c.pconnPort, err)
 		c.pconn.mu.Unlock()
 	}
 
-	log.Printf("magicsock: link change, binding new port")
-	packetConn, err := net.ListenPacket("udp4", ":0")
+	c.logf("magicsock: link change, binding new port")
+	packetConn, err := c.listenPacket(":0")
 	if err != nil {
-		log.Printf("magicsock: link change failed to bind new port: %v", err)
+		c.logf("magicsock: link change failed to bind new port: %v", err)
 		return
 	}
-	c.pconn.Reset(packetConn.(*net.UDPConn))
+	c.pconn.Reset(packetConn)
 }
 
 // AddrSet is a set of UDP addresses that implements wireguard/conn.Endpoint.
 type AddrSet struct {
 	publicKey key.Public    // peer public key used for DERP communication
 	addrs     []net.UDPAddr // ordered priority list (low to high) provided by wgengine
+	logf      logger.Logf   // the Conn's, or nil for log.Printf
 
 	mu sync.Mutex // guards following fields
 
@@ -821,6 +1241,11 @@ type AddrSet struct {
 
 	// lastSpray is the lsat time we sprayed a packet.
 	lastSpray time.Time
+
+	// sendErrs holds the backoff state of endpoints that recently
+	// failed with persistent send errors, keyed by UDPAddr.String().
+	// See sendbackoff.go.
+	sendErrs map[string]*sendBackoff
 }
 
 var noAddr = &net.UDPAddr{
@@ -845,6 +1270,21 @@ func (a *AddrSet) dst() *net.UDPAddr {
 	return &a.addrs[i]
 }
 
+// curAddrString returns the address a has chosen to send to, or the
+// empty string if it hasn't received a valid packet on any address.
+func (a *AddrSet) curAddrString() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case a.roamAddr != nil:
+		return a.roamAddr.String()
+	case a.curAddr >= 0:
+		return a.addrs[a.curAddr].String()
+	}
+	return ""
+}
+
 // packUDPAddr packs a UDPAddr in the form wanted by WireGuard.
 func packUDPAddr(ua *net.UDPAddr) []byte {
 	ip := ua.IP.To4()
@@ -896,6 +1336,10 @@ func (a *AddrSet) UpdateDst(new *net.UDPAddr) error {
 		}
 	}
 
+	logf := a.logf
+	if logf == nil {
+		logf = log.Printf
+	}
 	publicKey := wgcfg.Key(a.publicKey)
 	pk := publicKey.ShortString()
 	old := "<none>"
@@ -906,26 +1350,26 @@ func (a *AddrSet) UpdateDst(new *net.UDPAddr) error {
 	switch {
 	case index == -1:
 		if a.roamAddr == nil {
-			log.Printf("magicsock: rx %s from roaming address %s, set as new priority", pk, new)
+			logf("[v1] magicsock: rx %s from roaming address %s, set as new priority", pk, new)
 		} else {
-			log.Printf("magicsock: rx %s from roaming address %s, replaces roaming address %s", pk, new, a.roamAddr)
+			logf("[v1] magicsock: rx %s from roaming address %s, replaces roaming address %s", pk, new, a.roamAddr)
 		}
 		a.roamAddr = new
 
 	case a.roamAddr != nil:
-		log.Printf("magicsock: rx %s from known %s (%d), replaces roaming address %s", pk, new, index, a.roamAddr)
+		logf("[v1] magicsock: rx %s from known %s (%d), replaces roaming address %s", pk, new, index, a.roamAddr)
 		a.roamAddr = nil
 		a.curAddr = index
 
 	case a.curAddr == -1:
-		log.Printf("magicsock: rx %s from %s (%d/%d), set as new priority", pk, new, index, len(a.addrs))
+		logf("[v1] magicsock: rx %s from %s (%d/%d), set as new priority", pk, new, index, len(a.addrs))
 		a.curAddr = index
 
 	case index < a.curAddr:
-		log.Printf("magicsock: rx %s from low-pri %s (%d), keeping current %s (%d)", pk, new, index, old, a.curAddr)
+		logf("[v1] magicsock: rx %s from low-pri %s (%d), keeping current %s (%d)", pk, new, index, old, a.curAddr)
 
 	default: // index > a.curAddr
-		log.Printf("magicsock: rx %s from %s (%d/%d), replaces old priority %s", pk, new, index, len(a.addrs), old)
+		logf("[v1] magicsock: rx %s from %s (%d/%d), replaces old priority %s", pk, new, index, len(a.addrs), old)
 		a.curAddr = index
 	}
 
@@ -984,10 +1428,11 @@ func (a *AddrSet) Addrs() []wgcfg.Endpoint {
 // comma-separated list of UDP ip:ports.
 func (c *Conn) CreateEndpoint(key [32]byte, addrs string) (conn.Endpoint, error) {
 	pk := wgcfg.Key(key)
-	log.Printf("magicsock: CreateEndpoint: key=%s: %s", pk.ShortString(), addrs)
+	c.logf("[v1] magicsock: CreateEndpoint: key=%s: %s", pk.ShortString(), addrs)
 	a := &AddrSet{
 		publicKey: key,
 		curAddr:   -1,
+		logf:      c.logf,
 	}
 
 	if addrs != "" {
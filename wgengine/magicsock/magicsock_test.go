@@ -5,11 +5,19 @@
 package magicsock
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"os"
+	"reflect"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 )
 
 func TestListen(t *testing.T) {
@@ -77,3 +85,207 @@ func TestDerpIPConstant(t *testing.T) {
 		t.Errorf("str %q != IP %v", derpMagicIPStr, derpMagicIP)
 	}
 }
+
+func TestListenInvalidDSCP(t *testing.T) {
+	c, err := Listen(Options{DSCP: 64})
+	if err == nil {
+		c.Close()
+		t.Fatal("Listen with DSCP 64 succeeded, want error")
+	}
+}
+
+func TestClassifyNAT(t *testing.T) {
+	local := []string{"192.168.1.2:41641", "10.0.0.5:41641"}
+	tests := []struct {
+		name    string
+		stunEps []string
+		want    NATType
+	}{
+		{"no_replies", nil, NATUnknown},
+		{"one_reply", []string{"1.2.3.4:41641"}, NATUnknown},
+		{"public_ip", []string{"10.0.0.5:41641"}, NATNone},
+		{"easy", []string{"1.2.3.4:5000", "1.2.3.4:5000"}, NATEasy},
+		{"hard_port", []string{"1.2.3.4:5000", "1.2.3.4:5001"}, NATHard},
+		{"hard_ip", []string{"1.2.3.4:5000", "1.2.3.5:5000"}, NATHard},
+	}
+	for _, tt := range tests {
+		if got := classifyNAT(tt.stunEps, local); got != tt.want {
+			t.Errorf("%s: classifyNAT = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSendBackoff(t *testing.T) {
+	hi := net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1000}
+	lo := net.UDPAddr{IP: derpMagicIP, Port: 1}
+	as := &AddrSet{
+		addrs:   []net.UDPAddr{lo, hi},
+		curAddr: 1,
+	}
+	pkt := []byte("data")
+
+	dests := func() []*net.UDPAddr {
+		dsts, _ := appendDests(nil, as, pkt)
+		return dsts
+	}
+	if got := dests(); len(got) != 1 || !equalUDPAddr(got[0], &hi) {
+		t.Fatalf("before errors: dests = %v; want [%v]", got, &hi)
+	}
+
+	unreach := &net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EHOSTUNREACH)}
+	now := time.Now()
+	if d, quiet := as.noteSendResult(&hi, unreach, now); d != minSendBackoff || quiet {
+		t.Fatalf("first error: backoff %v, quiet %v; want %v, false", d, quiet, minSendBackoff)
+	}
+	if got := dests(); len(got) != 1 || !equalUDPAddr(got[0], &lo) {
+		t.Fatalf("in backoff: dests = %v; want fallback [%v]", got, &lo)
+	}
+	if _, quiet := as.noteSendResult(&hi, unreach, now); !quiet {
+		t.Errorf("error during backoff not quiet")
+	}
+	if d, _ := as.noteSendResult(&hi, unreach, now.Add(time.Hour)); d != 2*minSendBackoff {
+		t.Errorf("second backoff = %v; want %v", d, 2*minSendBackoff)
+	}
+
+	as.noteSendResult(&hi, nil, now)
+	if got := dests(); len(got) != 1 || !equalUDPAddr(got[0], &hi) {
+		t.Fatalf("after success: dests = %v; want [%v]", got, &hi)
+	}
+}
+
+func TestHomeRegion(t *testing.T) {
+	node := func(id int) *tailcfg.DERPRegion {
+		return &tailcfg.DERPRegion{RegionID: id, Nodes: []*tailcfg.DERPNode{{Name: "n", HostName: "derp.example.com"}}}
+	}
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{1: node(1), 2: node(2), 3: node(3)}}
+	tests := []struct {
+		name    string
+		latency map[int]float64
+		cur     int
+		want    int
+	}{
+		{"unmeasured", nil, 0, 1},
+		{"unmeasured keeps home", nil, 3, 3},
+		{"fastest", map[int]float64{1: 0.050, 2: 0.010, 3: 0.030}, 0, 2},
+		{"slightly faster keeps home", map[int]float64{1: 0.050, 2: 0.010, 3: 0.012}, 3, 3},
+		{"clearly faster moves", map[int]float64{1: 0.050, 2: 0.010, 3: 0.030}, 3, 2},
+		{"unmeasured home moves", map[int]float64{2: 0.010}, 3, 2},
+		{"home gone", map[int]float64{4: 0.001}, 4, 1},
+	}
+	for _, tt := range tests {
+		if got := homeRegion(dm, tt.latency, tt.cur); got != tt.want {
+			t.Errorf("%s: homeRegion = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if got := homeRegion(&tailcfg.DERPMap{}, nil, 1); got != 0 {
+		t.Errorf("homeRegion of an empty map = %d, want 0", got)
+	}
+}
+
+func TestDERPSTUNServers(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{
+			{Name: "1a", HostName: "derp1a.example.com"},
+			{Name: "1b", HostName: "derp1b.example.com", STUNPort: 3479},
+		}},
+		2: {RegionID: 2, Nodes: []*tailcfg.DERPNode{{Name: "2a", HostName: "derp2a.example.com", STUNPort: -1}}},
+	}}
+	got := derpSTUNServers(dm)
+	want := map[string]int{
+		"derp1a.example.com:3478": 1,
+		"derp1b.example.com:3479": 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("derpSTUNServers = %v, want %v", got, want)
+	}
+}
+
+func TestDERPMap(t *testing.T) {
+	c := &Conn{derpMap: defaultDERPMap, logf: t.Logf}
+	if got := c.HomeDERP(); got != "derp.tailscale.com" {
+		t.Errorf("default HomeDERP = %q", got)
+	}
+
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		3: {RegionID: 3, Nodes: []*tailcfg.DERPNode{{Name: "3a", HostName: "derp3.example.com"}}},
+		2: {RegionID: 2, Nodes: []*tailcfg.DERPNode{{Name: "2a"}, {Name: "2b", HostName: "derp2b.example.com"}}},
+	}}
+	c.SetDERPMap(dm)
+	if got := c.HomeDERP(); got != "derp2b.example.com" {
+		t.Errorf("HomeDERP = %q, want the lowest region's", got)
+	}
+	for addr, want := range map[string]string{
+		"127.3.3.40:3": "derp3.example.com",
+		"127.3.3.40:1": "derp-region-1",
+		"1.2.3.4:3":    "",
+	} {
+		host, ok := c.DERPHostOfAddr(addr)
+		if host != want || ok != (want != "") {
+			t.Errorf("DERPHostOfAddr(%q) = %q, %v; want %q", addr, host, ok, want)
+		}
+	}
+	if err := c.sendAddr(&net.UDPAddr{IP: derpMagicIP, Port: 1}, key.Public{}, nil); err != errNoDerpRegion {
+		t.Errorf("sending to a region not in the map: %v", err)
+	}
+
+	c.SetDERPMap(nil)
+	if got := c.derpHost(3); got != "" {
+		t.Errorf("region 3 still known after resetting to the default map: %q", got)
+	}
+}
+
+func TestPathPing(t *testing.T) {
+	newConn := func() (*Conn, key.Public) {
+		c, err := Listen(Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, err := wgcfg.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetPrivateKey(priv)
+		go func() {
+			var pkt [64 << 10]byte
+			for {
+				if _, _, _, err := c.ReceiveIPv4(pkt[:]); err != nil {
+					return
+				}
+			}
+		}()
+		return c, key.Private(priv).Public()
+	}
+	c1, k1 := newConn()
+	defer c1.Close()
+	c2, k2 := newConn()
+	defer c2.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c1.Ping(ctx, wgcfg.Key(k2)); err != errNoPeerPath {
+		t.Fatalf("ping to unknown peer: %v, want errNoPeerPath", err)
+	}
+
+	addr2 := fmt.Sprintf("127.0.0.1:%d", c2.LocalPort())
+	if _, err := c1.CreateEndpoint(k2, addr2); err != nil {
+		t.Fatal(err)
+	}
+
+	// c2 doesn't know c1 yet, so it stays silent.
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	if _, err := c1.Ping(short, wgcfg.Key(k2)); err != context.DeadlineExceeded {
+		t.Fatalf("ping to a peer that doesn't know us: %v, want timeout", err)
+	}
+
+	if _, err := c2.CreateEndpoint(k1, fmt.Sprintf("127.0.0.1:%d", c1.LocalPort())); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c1.Ping(ctx, wgcfg.Key(k2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Addr != addr2 || res.DERP != "" {
+		t.Errorf("pong via %q/%q, want direct from %s", res.Addr, res.DERP, addr2)
+	}
+}
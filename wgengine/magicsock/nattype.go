@@ -0,0 +1,70 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+// NATType classifies the mapping behavior of the NAT, if any, between
+// a Conn's UDP socket and the internet, as observed via STUN.
+//
+// The classification is based on whether different STUN servers see
+// the same public ip:port for the socket. Filtering behavior is not
+// classified: measuring it needs STUN servers that can reply from
+// another address, which plain STUN servers don't do.
+type NATType int
+
+const (
+	// NATUnknown means there weren't enough STUN replies (at
+	// least two servers must answer) to classify the NAT.
+	NATUnknown NATType = iota
+	// NATNone means the public endpoint seen by STUN is one of the
+	// socket's own addresses: there is no address translation.
+	NATNone
+	// NATEasy means all STUN servers saw the same public endpoint
+	// (endpoint-independent mapping). Peers can usually reach
+	// this node directly once it knows its public endpoint.
+	NATEasy
+	// NATHard means STUN servers saw different public endpoints
+	// (address- or port-dependent mapping). The endpoint a peer
+	// would need to use can't be predicted, so direct connections
+	// often fail and traffic falls back to DERP.
+	NATHard
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATNone:
+		return "none"
+	case NATEasy:
+		return "easy"
+	case NATHard:
+		return "hard"
+	default:
+		return "unknown"
+	}
+}
+
+// classifyNAT classifies the NAT given the public endpoints reported
+// by each responding STUN server (one per server, duplicates
+// included) and the socket's local endpoints.
+func classifyNAT(stunEps, localEps []string) NATType {
+	if len(stunEps) == 0 {
+		return NATUnknown
+	}
+	for _, s := range stunEps {
+		for _, l := range localEps {
+			if s == l {
+				return NATNone
+			}
+		}
+	}
+	if len(stunEps) < 2 {
+		return NATUnknown
+	}
+	for _, s := range stunEps[1:] {
+		if s != stunEps[0] {
+			return NATHard
+		}
+	}
+	return NATEasy
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/clientmetrics"
+	"tailscale.com/types/key"
+)
+
+// Path pings test the paths to a peer beneath WireGuard. A ping goes
+// out to each of the peer's endpoints and through DERP at once, and
+// the peer answers each one on the path it came in on, so the first
+// pong back shows the best working path.
+//
+// A ping is pingMagic, a random transaction ID and the sender's public
+// key; a pong is pongMagic and the transaction ID. The magic can't
+// start a WireGuard message, whose first byte is a small message
+// type, so older peers hand pings to WireGuard, which drops them.
+const (
+	pingMagic = "tsping"
+	pongMagic = "tspong"
+	pingTxLen = 12
+	pingLen   = len(pingMagic) + pingTxLen + len(key.Public{})
+	pongLen   = len(pongMagic) + pingTxLen
+)
+
+type pingTx [pingTxLen]byte
+
+// PingResult is the outcome of a path ping.
+type PingResult struct {
+	Latency time.Duration
+	// Addr is the "ip:port" of the path the pong came back on.
+	// For DERP it's a fake address, and DERP is the server's
+	// hostname.
+	Addr string
+	DERP string
+}
+
+var errNoPeerPath = errors.New("no known path to peer")
+
+var metricPathPingsAnswered = clientmetrics.NewCounter("magicsock_path_pings_answered", "Path pings from peers that were answered.")
+
+// isPathPing reports whether b is a path ping or pong.
+func isPathPing(b []byte) bool {
+	if len(b) < len(pingMagic) {
+		return false
+	}
+	magic := string(b[:len(pingMagic)])
+	return (magic == pingMagic && len(b) == pingLen) || (magic == pongMagic && len(b) == pongLen)
+}
+
+// Ping sends a path ping to peer on every path c knows for it, and
+// waits for the first pong, or for ctx to be done.
+func (c *Conn) Ping(ctx context.Context, peer wgcfg.Key) (*PingResult, error) {
+	as := c.addrSetOf(key.Public(peer))
+	if as == nil {
+		return nil, errNoPeerPath
+	}
+	var tx pingTx
+	if _, err := rand.Read(tx[:]); err != nil {
+		return nil, err
+	}
+	pong := make(chan *net.UDPAddr, 1)
+	c.pingMu.Lock()
+	if c.pings == nil {
+		c.pings = make(map[pingTx]chan<- *net.UDPAddr)
+	}
+	c.pings[tx] = pong
+	c.pingMu.Unlock()
+	defer func() {
+		c.pingMu.Lock()
+		delete(c.pings, tx)
+		c.pingMu.Unlock()
+	}()
+
+	pub := c.privateKey.Public()
+	pkt := make([]byte, 0, pingLen)
+	pkt = append(pkt, pingMagic...)
+	pkt = append(pkt, tx[:]...)
+	pkt = append(pkt, pub[:]...)
+
+	start := time.Now()
+	var sent int
+	var err error
+	for i := range as.addrs {
+		if err = c.sendAddr(&as.addrs[i], as.publicKey, pkt); err == nil {
+			sent++
+		}
+	}
+	if sent == 0 {
+		if err == nil {
+			err = errNoPeerPath
+		}
+		return nil, err
+	}
+
+	select {
+	case from := <-pong:
+		res := &PingResult{Latency: time.Since(start), Addr: from.String()}
+		res.DERP, _ = c.DERPHostOfAddr(res.Addr)
+		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.donec:
+		return nil, errConnClosed
+	}
+}
+
+// handlePathPing handles b, a path ping or pong that arrived from
+// addr. Pings are answered only for known peers, so that c doesn't
+// reveal itself to strangers.
+func (c *Conn) handlePathPing(b []byte, addr *net.UDPAddr) {
+	var tx pingTx
+	copy(tx[:], b[len(pingMagic):])
+	if string(b[:len(pongMagic)]) == pongMagic {
+		c.pingMu.Lock()
+		ch := c.pings[tx]
+		c.pingMu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- addr:
+			default:
+				// Already answered on a faster path.
+			}
+		}
+		return
+	}
+
+	var sender key.Public
+	copy(sender[:], b[len(pingMagic)+pingTxLen:])
+	if c.addrSetOf(sender) == nil {
+		return
+	}
+	pkt := make([]byte, 0, pongLen)
+	pkt = append(pkt, pongMagic...)
+	pkt = append(pkt, tx[:]...)
+	addr = &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+	metricPathPingsAnswered.Add(1)
+	// DERP replies may block, and b belongs to the caller.
+	go c.sendAddr(addr, sender, pkt)
+}
+
+// addrSetOf returns the AddrSet of the peer with key k, or nil if c
+// doesn't know of one.
+func (c *Conn) addrSetOf(k key.Public) *AddrSet {
+	for _, as := range c.addrSets() {
+		if as.publicKey == k {
+			return as
+		}
+	}
+	return nil
+}
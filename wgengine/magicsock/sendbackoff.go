@@ -0,0 +1,87 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Send errors that mean an endpoint is unreachable from this host
+// (no route, or a local firewall refusing it) put that endpoint in
+// backoff: for a while it's skipped in favor of the peer's other
+// endpoints or DERP, rather than retried on every packet.
+const (
+	minSendBackoff = 1 * time.Second
+	maxSendBackoff = 1 * time.Minute
+)
+
+// sendBackoff is the backoff state of one endpoint of an AddrSet.
+type sendBackoff struct {
+	fails int       // consecutive persistent send errors
+	until time.Time // don't send to the endpoint before this time
+}
+
+// isPersistentSendErr reports whether err, returned by a UDP write,
+// is likely to happen again on every write to the same destination.
+func isPersistentSendErr(err error) bool {
+	return errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EPERM) ||
+		errors.Is(err, syscall.EACCES)
+}
+
+// backedOffLocked reports whether sends to addr should currently be
+// skipped. a.mu must be held.
+func (a *AddrSet) backedOffLocked(addr *net.UDPAddr, now time.Time) bool {
+	if addr == nil || len(a.sendErrs) == 0 {
+		return false
+	}
+	bo, ok := a.sendErrs[addr.String()]
+	return ok && now.Before(bo.until)
+}
+
+// noteSendResult records the outcome of a send to addr.
+//
+// If err is a persistent error, addr enters backoff (or has its
+// backoff extended) and the new backoff duration d is returned. If
+// addr was already backing off (because it was tried anyway, all
+// alternatives being in backoff too), quiet is true and the error
+// needn't be logged again.
+func (a *AddrSet) noteSendResult(addr *net.UDPAddr, err error, now time.Time) (d time.Duration, quiet bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := addr.String()
+	if err == nil {
+		if a.sendErrs != nil {
+			delete(a.sendErrs, key)
+		}
+		return 0, false
+	}
+	if !isPersistentSendErr(err) {
+		return 0, false
+	}
+	if a.sendErrs == nil {
+		a.sendErrs = make(map[string]*sendBackoff)
+	}
+	bo := a.sendErrs[key]
+	if bo == nil {
+		bo = new(sendBackoff)
+		a.sendErrs[key] = bo
+	}
+	if now.Before(bo.until) {
+		return 0, true
+	}
+	bo.fails++
+	d = minSendBackoff << uint(bo.fails-1)
+	if d > maxSendBackoff || d <= 0 {
+		d = maxSendBackoff
+	}
+	bo.until = now.Add(d)
+	return d, false
+}
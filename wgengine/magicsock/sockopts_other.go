@@ -0,0 +1,21 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!darwin,!freebsd,!openbsd
+
+package magicsock
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func setDSCP(pconn *net.UDPConn, dscp uint8) error {
+	return fmt.Errorf("DSCP marking not supported on %s", runtime.GOOS)
+}
+
+func socketBufferSizes(pconn *net.UDPConn) (rcv, snd int, err error) {
+	return 0, 0, fmt.Errorf("socket buffer sizes not available on %s", runtime.GOOS)
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin freebsd openbsd
+
+package magicsock
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDSCP sets the DiffServ code point of packets sent on pconn.
+// The DSCP occupies the upper six bits of the IPv4 TOS byte.
+func setDSCP(pconn *net.UDPConn, dscp uint8) error {
+	rc, err := pconn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, int(dscp)<<2)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// socketBufferSizes reports the effective receive and send buffer
+// sizes of pconn, as reported by the kernel.
+func socketBufferSizes(pconn *net.UDPConn) (rcv, snd int, err error) {
+	rc, err := pconn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var rcvErr, sndErr error
+	err = rc.Control(func(fd uintptr) {
+		rcv, rcvErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		snd, sndErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if rcvErr != nil {
+		return 0, 0, rcvErr
+	}
+	return rcv, snd, sndErr
+}
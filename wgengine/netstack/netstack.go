@@ -0,0 +1,328 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package netstack runs gVisor's TCP/IP stack inside the daemon, for
+// reaching the tailnet without a TUN device
+// (tailscaled --tun=userspace-networking).
+//
+// A Stack stands in for the TUN device that wireguard-go reads
+// outgoing packets from and writes incoming packets to, and its Dial
+// and Listen make connections over it. gVisor answers pings to the
+// Stack's address itself.
+package netstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine"
+)
+
+// mtu is the MTU the Stack reports to wireguard-go, small enough for
+// its packets to fit in a WireGuard packet on any path.
+const mtu = 1280
+
+// outQueue is how many outgoing packets the Stack holds for
+// wireguard-go before dropping them, as a full NIC queue would.
+const outQueue = 512
+
+// nicID is the Stack's one NIC, which wireguard-go is on the other
+// end of.
+const nicID tcpip.NICID = 1
+
+var errNoAddr = errors.New("no tailnet address yet")
+
+// Stack is a gVisor TCP/IP stack that exchanges packets with
+// wireguard-go as its tun.Device.
+type Stack struct {
+	logf      logger.Logf
+	ipstack   *stack.Stack
+	linkEP    *channel.Endpoint
+	events    chan tun.Event
+	ctx       context.Context // canceled by Close, to end Read
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	addr   tcpip.ProtocolAddress // our address, or zero until the Router sets it
+	routes []*net.IPNet          // destinations the tunnel reaches
+}
+
+// NewStack returns a Stack with no address. Use its Router as the
+// engine's RouterGen to have the engine set it.
+func NewStack(logf logger.Logf) *Stack {
+	ipstack := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+	})
+	linkEP := channel.New(outQueue, mtu, "")
+	if err := ipstack.CreateNIC(nicID, linkEP); err != nil {
+		// Only possible with a duplicate NIC ID.
+		panic(fmt.Sprintf("netstack: CreateNIC: %v", err))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Stack{
+		logf:    logf,
+		ipstack: ipstack,
+		linkEP:  linkEP,
+		events:  make(chan tun.Event, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	s.events <- tun.EventUp
+	return s
+}
+
+// File implements tun.Device. A Stack has no file.
+func (s *Stack) File() *os.File { return nil }
+
+// Read implements tun.Device, returning the next packet to send.
+func (s *Stack) Read(buf []byte, offset int) (int, error) {
+	pkt := s.linkEP.ReadContext(s.ctx)
+	if pkt == nil {
+		return 0, io.EOF
+	}
+	defer pkt.DecRef()
+	v := pkt.ToView()
+	defer v.Release()
+	return v.Read(buf[offset:])
+}
+
+// Write implements tun.Device, taking in a received packet.
+func (s *Stack) Write(buf []byte, offset int) (int, error) {
+	if s.ctx.Err() != nil {
+		return 0, io.EOF
+	}
+	b := buf[offset:]
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var proto tcpip.NetworkProtocolNumber
+	switch b[0] >> 4 {
+	case 4:
+		proto = ipv4.ProtocolNumber
+	case 6:
+		proto = ipv6.ProtocolNumber
+	default:
+		return len(b), nil
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(b),
+	})
+	s.linkEP.InjectInbound(proto, pkt)
+	pkt.DecRef()
+	return len(b), nil
+}
+
+// Flush implements tun.Device.
+func (s *Stack) Flush() error { return nil }
+
+// MTU implements tun.Device.
+func (s *Stack) MTU() (int, error) { return mtu, nil }
+
+// Name implements tun.Device.
+func (s *Stack) Name() (string, error) { return "userspace-networking", nil }
+
+// Events implements tun.Device.
+func (s *Stack) Events() chan tun.Event { return s.events }
+
+// Close implements tun.Device, and aborts all connections.
+func (s *Stack) Close() error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		close(s.events)
+		s.ipstack.Close()
+		s.linkEP.Close()
+		s.ipstack.Wait()
+	})
+	return nil
+}
+
+// Router is a wgengine.RouterGen whose Router hands s the address and
+// routes the engine sets, rather than configuring the OS.
+func (s *Stack) Router(logf logger.Logf, _ *device.Device, _ tun.Device) (wgengine.Router, error) {
+	return router{s}, nil
+}
+
+type router struct {
+	s *Stack
+}
+
+func (r router) Up() error { return nil }
+
+func (r router) SetRoutes(rs wgengine.RouteSettings) error {
+	var addr tcpip.ProtocolAddress
+	var routes []*net.IPNet
+	if !rs.LocalAddr.IP.IP().IsUnspecified() {
+		addr = protocolAddress(rs.LocalAddr)
+		routes = append(routes, ipNet(rs.LocalAddr))
+	}
+	if rs.Cfg != nil {
+		for _, p := range rs.Cfg.Peers {
+			for _, cidr := range p.AllowedIPs {
+				routes = append(routes, ipNet(cidr))
+			}
+		}
+	}
+	var table []tcpip.Route
+	for _, r := range routes {
+		prefix, _ := r.Mask.Size()
+		table = append(table, tcpip.Route{
+			Destination: tcpip.AddressWithPrefix{
+				Address:   tcpip.AddrFromSlice(ipBytes(r.IP)),
+				PrefixLen: prefix,
+			}.Subnet(),
+			NIC: nicID,
+		})
+	}
+
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if addr != s.addr {
+		s.logf("netstack: address %v\n", addr.AddressWithPrefix)
+		if s.addr.Protocol != 0 {
+			if err := s.ipstack.RemoveAddress(nicID, s.addr.AddressWithPrefix.Address); err != nil {
+				return fmt.Errorf("netstack: removing %v: %v", s.addr.AddressWithPrefix, err)
+			}
+		}
+		s.addr = tcpip.ProtocolAddress{}
+		if addr.Protocol != 0 {
+			if err := s.ipstack.AddProtocolAddress(nicID, addr, stack.AddressProperties{}); err != nil {
+				return fmt.Errorf("netstack: adding %v: %v", addr.AddressWithPrefix, err)
+			}
+		}
+		s.addr = addr
+	}
+	s.ipstack.SetRouteTable(table)
+	s.routes = routes
+	return nil
+}
+
+func (r router) Close() error { return nil }
+
+func ipNet(cidr wgcfg.CIDR) *net.IPNet {
+	bits := 128
+	if cidr.IP.Is4() {
+		bits = 32
+	}
+	ip := cidr.IP.IP()
+	mask := net.CIDRMask(int(cidr.Mask), bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// protocolAddress returns the node's address in cidr as gVisor's
+// host address; the route table covers the rest of cidr, if any.
+func protocolAddress(cidr wgcfg.CIDR) tcpip.ProtocolAddress {
+	ip := ipBytes(cidr.IP.IP())
+	proto := ipv6.ProtocolNumber
+	if len(ip) == net.IPv4len {
+		proto = ipv4.ProtocolNumber
+	}
+	return tcpip.ProtocolAddress{
+		Protocol: proto,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFromSlice(ip),
+			PrefixLen: len(ip) * 8,
+		},
+	}
+}
+
+// ipBytes returns ip in 4 bytes if it's an IPv4 address, as gVisor
+// wants, and in 16 otherwise.
+func ipBytes(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// Reaches reports whether the engine routes ip through the tunnel,
+// to a tailnet address, a subnet route or an exit node.
+func (s *Stack) Reaches(ip net.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.routes {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dial connects to address, a host:port, over TCP or UDP. Host names
+// are looked up with the OS's resolver.
+func (s *Stack) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("netstack: unsupported network %q", network)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("netstack: bad port in %q", address)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("netstack: no address for %q", host)
+		}
+		ip = addrs[0].IP
+	}
+
+	s.mu.Lock()
+	hasAddr := s.addr.Protocol != 0
+	s.mu.Unlock()
+	if !hasAddr {
+		return nil, errNoAddr
+	}
+	ip = ipBytes(ip)
+	proto := ipv6.ProtocolNumber
+	if len(ip) == net.IPv4len {
+		proto = ipv4.ProtocolNumber
+	}
+	remote := tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(ip), Port: uint16(port)}
+	if network[:3] == "udp" {
+		return gonet.DialUDP(s.ipstack, nil, &remote, proto)
+	}
+	return gonet.DialContextTCP(ctx, s.ipstack, remote, proto)
+}
+
+// Listen accepts TCP connections to port on the Stack's address,
+// whether IPv4 or IPv6.
+func (s *Stack) Listen(port uint16) (net.Listener, error) {
+	ln, err := gonet.ListenTCP(s.ipstack, tcpip.FullAddress{NIC: nicID, Port: port}, ipv6.ProtocolNumber)
+	if err != nil {
+		return nil, fmt.Errorf("netstack: %v", err)
+	}
+	return ln, nil
+}
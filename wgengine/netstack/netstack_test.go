@@ -0,0 +1,283 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/packet"
+)
+
+func parseCIDR(t *testing.T, s string) wgcfg.CIDR {
+	t.Helper()
+	c, err := wgcfg.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *c
+}
+
+// newStack returns a Stack at the CIDR addr, routing to the CIDR
+// peers.
+func newStack(t *testing.T, addr, peers string) *Stack {
+	t.Helper()
+	s := NewStack(t.Logf)
+	r, err := s.Router(t.Logf, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.SetRoutes(wgengine.RouteSettings{
+		LocalAddr: parseCIDR(t, addr),
+		Cfg: &wgcfg.Config{
+			Peers: []wgcfg.Peer{{AllowedIPs: []wgcfg.CIDR{parseCIDR(t, peers)}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// link carries packets from one Stack to the other, as wireguard-go
+// would, dropping those drop says to.
+func link(from, to *Stack, drop func() bool) {
+	go func() {
+		buf := make([]byte, 2000)
+		for {
+			n, err := from.Read(buf, 0)
+			if err != nil {
+				return
+			}
+			if drop != nil && drop() {
+				continue
+			}
+			to.Write(buf[:n], 0)
+		}
+	}()
+}
+
+// everyNth returns a drop func for link that drops every nth packet.
+func everyNth(n int) func() bool {
+	var mu sync.Mutex
+	i := 0
+	return func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		i++
+		return i%n == 0
+	}
+}
+
+func pair(t *testing.T, dropAB, dropBA func() bool) (a, b *Stack) {
+	a = newStack(t, "100.64.0.1/32", "100.64.0.2/32")
+	b = newStack(t, "100.64.0.2/32", "100.64.0.1/32")
+	link(a, b, dropAB)
+	link(b, a, dropBA)
+	return a, b
+}
+
+// echo serves ln by echoing each connection back until EOF.
+func echo(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(c, c)
+			c.Close()
+		}()
+	}
+}
+
+func testEcho(t *testing.T, a, b *Stack, addr string, size int) {
+	ln, err := b.Listen(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := a.Dial(ctx, "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got, want := c.RemoteAddr().String(), addr; got != want {
+		t.Errorf("RemoteAddr = %v, want %v", got, want)
+	}
+
+	want := make([]byte, size)
+	rand.Read(want)
+	go c.Write(want)
+	c.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got := make([]byte, size)
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("echoed data differs")
+	}
+}
+
+func TestEcho(t *testing.T) {
+	a, b := pair(t, nil, nil)
+	defer a.Close()
+	defer b.Close()
+	testEcho(t, a, b, "100.64.0.2:80", 1<<20)
+}
+
+func TestEchoIPv6(t *testing.T) {
+	a := newStack(t, "fd7a:115c:a1e0::1/128", "fd7a:115c:a1e0::2/128")
+	b := newStack(t, "fd7a:115c:a1e0::2/128", "fd7a:115c:a1e0::1/128")
+	defer a.Close()
+	defer b.Close()
+	link(a, b, nil)
+	link(b, a, nil)
+	testEcho(t, a, b, "[fd7a:115c:a1e0::2]:80", 64<<10)
+}
+
+func TestEchoLoss(t *testing.T) {
+	a, b := pair(t, everyNth(23), everyNth(29))
+	defer a.Close()
+	defer b.Close()
+	testEcho(t, a, b, "100.64.0.2:80", 256<<10)
+}
+
+func TestClose(t *testing.T) {
+	a, b := pair(t, nil, nil)
+	defer a.Close()
+	defer b.Close()
+	ln, err := b.Listen(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("hello"))
+		c.Close()
+	}()
+
+	c, err := a.Dial(context.Background(), "tcp", "100.64.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("read %q, want %q", got, "hello")
+	}
+	c.Close()
+}
+
+func TestRefused(t *testing.T) {
+	a, b := pair(t, nil, nil)
+	defer a.Close()
+	defer b.Close()
+	_, err := a.Dial(context.Background(), "tcp", "100.64.0.2:81")
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("Dial = %v, want connection refused", err)
+	}
+}
+
+func TestDialCanceled(t *testing.T) {
+	a := newStack(t, "100.64.0.1/32", "100.64.0.2/32") // with nothing on the other end
+	defer a.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := a.Dial(ctx, "tcp", "100.64.0.2:80"); err != context.DeadlineExceeded {
+		t.Fatalf("Dial = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDialUnrouted(t *testing.T) {
+	a := newStack(t, "100.64.0.1/32", "100.64.0.2/32")
+	defer a.Close()
+	if _, err := a.Dial(context.Background(), "tcp", "8.8.8.8:53"); err == nil {
+		t.Fatal("Dial to an address the tunnel doesn't reach succeeded")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	a, b := pair(t, nil, nil)
+	defer a.Close()
+	defer b.Close()
+	ln, err := b.Listen(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+
+	c, err := a.Dial(context.Background(), "tcp", "100.64.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Read = %v, want a timeout", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := newStack(t, "100.64.0.1/32", "100.64.0.2/32")
+	defer s.Close()
+	src := packet.NewIP(net.ParseIP("100.64.0.2"))
+	dst := packet.NewIP(net.ParseIP("100.64.0.1"))
+	req := packet.GenICMP(src, dst, 1, packet.EchoRequest, 0, []byte("\x00\x01\x00\x01ping"))
+	s.Write(req, 0)
+
+	buf := make([]byte, 2000)
+	n, err := s.Read(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var q packet.QDecode
+	q.Decode(buf[:n])
+	if q.IPProto != packet.ICMP || q.SrcIP != dst || q.DstIP != src || q.Sub(0, 1)[0] != packet.EchoReply {
+		t.Fatalf("got %v, want an echo reply", q)
+	}
+}
+
+func TestReaches(t *testing.T) {
+	s := newStack(t, "100.64.0.1/32", "10.1.0.0/16")
+	defer s.Close()
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"100.64.0.1", true},
+		{"10.1.2.3", true},
+		{"10.2.2.3", false},
+		{"8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		if got := s.Reaches(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Reaches(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
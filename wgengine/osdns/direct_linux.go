@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/types/logger"
+)
+
+// The files of the direct mode. Variables for tests.
+var (
+	tsConf     = "/etc/resolv.tailscale.conf"
+	backupConf = "/etc/resolv.pre-tailscale-backup.conf"
+	resolvConf = "/etc/resolv.conf"
+)
+
+// resolvConfContents returns cfg as a resolv.conf(5) file.
+func resolvConfContents(cfg Config) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# resolv.conf(5) file generated by tailscale\n")
+	fmt.Fprintf(buf, "#     DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN\n\n")
+	for _, ns := range cfg.Nameservers {
+		fmt.Fprintf(buf, "nameserver %s\n", ns)
+	}
+	if len(cfg.Domains) > 0 {
+		fmt.Fprintf(buf, "search %s\n", strings.Join(cfg.Domains, " "))
+	}
+	return buf.Bytes()
+}
+
+// directManager manages DNS on systems where nothing else does, by
+// replacing /etc/resolv.conf with a symlink to its own file, keeping
+// the original to put back.
+type directManager struct {
+	logf logger.Logf
+}
+
+func (m *directManager) Set(cfg Config) error {
+	if cfg.IsZero() {
+		return m.Close()
+	}
+
+	// First write the tsConf file.
+	f, err := ioutil.TempFile(filepath.Dir(tsConf), filepath.Base(tsConf)+".*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := atomicfile.WriteFile(f.Name(), resolvConfContents(cfg), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	os.Chmod(f.Name(), 0644) // ioutil.TempFile creates the file with 0600
+	if err := os.Rename(f.Name(), tsConf); err != nil {
+		return err
+	}
+
+	if linkPath, err := os.Readlink(resolvConf); err != nil {
+		// Remove any old backup that may exist.
+		os.Remove(backupConf)
+
+		// Backup the existing /etc/resolv.conf file.
+		contents, err := ioutil.ReadFile(resolvConf)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := atomicfile.WriteFile(backupConf, contents, 0644); err != nil {
+				return err
+			}
+		}
+	} else if linkPath != tsConf {
+		// Backup the existing symlink.
+		os.Remove(backupConf)
+		if err := os.Symlink(linkPath, backupConf); err != nil {
+			return err
+		}
+	} else {
+		// Nothing to do, resolvConf already points to tsConf.
+		return nil
+	}
+
+	os.Remove(resolvConf)
+	return os.Symlink(tsConf, resolvConf)
+}
+
+// Close puts back the original resolv.conf, if it was replaced.
+func (m *directManager) Close() error {
+	if ln, err := os.Readlink(resolvConf); err != nil || ln != tsConf {
+		return nil // not ours
+	}
+	if _, err := os.Lstat(backupConf); os.IsNotExist(err) {
+		// There was no resolv.conf before.
+		os.Remove(resolvConf)
+	} else if err := os.Rename(backupConf, resolvConf); err != nil {
+		return err
+	}
+	os.Remove(tsConf) // best effort removal of tsConf file
+	return nil
+}
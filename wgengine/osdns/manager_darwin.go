@@ -0,0 +1,310 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// savedKey is where the DNS settings of the service whose resolver
+// Tailscale overrode are kept, to put back. It outlives tailscaled,
+// so that cleanup can restore them after a crash.
+const savedKey = "State:/Network/Tailscale/SavedDNS"
+
+// The entries scManager adds to the dictionaries it writes, which
+// configd ignores: savedService names the service savedKey's
+// settings belong to, and overrideMark marks the settings that
+// replace them.
+const (
+	savedService = "TailscaleService"
+	overrideMark = "TailscaleOverride"
+)
+
+// recheckInterval is how often scManager checks that its settings
+// are still in place. configd rewrites a service's settings when its
+// DHCP lease renews, and a network location change makes another
+// service primary.
+const recheckInterval = 10 * time.Second
+
+// scutil runs the scutil(8) commands in script. A variable for tests.
+var scutil = func(script string) (string, error) {
+	cmd := exec.Command("scutil")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("scutil: %v: %s", err, out)
+	}
+	return string(out), nil
+}
+
+// scutilGet returns the dictionary at key, or nil if there isn't one.
+func scutilGet(key string) (scutilDict, error) {
+	out, err := scutil("show " + key + "\n")
+	if err != nil {
+		return nil, err
+	}
+	return parseScutilDict(out), nil
+}
+
+func scutilRemove(key string) error {
+	_, err := scutil("remove " + key + "\n")
+	return err
+}
+
+// serviceDNSKey returns the key of the DNS settings in use for the
+// network service id.
+func serviceDNSKey(id string) string {
+	return "State:/Network/Service/" + id + "/DNS"
+}
+
+// primaryService returns the ID of the network service with the
+// default route, whose resolver answers names no other resolver is
+// scoped to.
+func primaryService() (string, error) {
+	d, err := scutilGet("State:/Network/Global/IPv4")
+	if err != nil {
+		return "", err
+	}
+	if v := d["PrimaryService"]; !v.Array && len(v.Vals) == 1 {
+		return v.Vals[0], nil
+	}
+	return "", errors.New("no primary network service")
+}
+
+// scManager manages DNS on macOS through the SystemConfiguration
+// dynamic store. It adds a service of its own whose resolver is
+// scoped to MatchDomains or, without them, to Domains and
+// RestrictedDomains, leaving other names to the system's resolvers.
+// Only a Global config overrides the primary service's resolver,
+// saving its settings to put back, and scopes its own service's
+// resolver to RestrictedDomains, which configd then prefers to any
+// other for their names.
+type scManager struct {
+	logf    logger.Logf
+	service string // our service's DNS key
+
+	mu         sync.Mutex
+	cfg        Config
+	overridden string        // service whose resolver is overridden, or ""
+	stop       chan struct{} // closed to stop recheck, nil if not running
+}
+
+func newManager(logf logger.Logf, iface string) Manager {
+	return &scManager{
+		logf:    logf,
+		service: serviceDNSKey("tailscale-" + iface),
+	}
+}
+
+func (m *scManager) Set(cfg Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg = cfg
+	if cfg.IsZero() {
+		m.stopLocked()
+	} else if m.stop == nil {
+		m.stop = make(chan struct{})
+		go m.recheck(m.stop)
+	}
+	return m.applyLocked()
+}
+
+func (m *scManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopLocked()
+	m.cfg = Config{}
+	return m.applyLocked()
+}
+
+func (m *scManager) stopLocked() {
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
+
+// applyLocked writes m.cfg to the dynamic store.
+func (m *scManager) applyLocked() error {
+	if m.cfg.IsZero() {
+		err := m.restoreLocked()
+		if err2 := scutilRemove(m.service); err == nil {
+			err = err2
+		}
+		return err
+	}
+	domains, scoped := m.scopeLocked()
+	if scoped {
+		if err := m.restoreLocked(); err != nil {
+			return err
+		}
+	}
+	var err error
+	if len(domains) > 0 {
+		cfg := m.cfg
+		cfg.MatchDomains = domains
+		_, err = scutil(dnsDict(cfg).setScript(m.service))
+	} else {
+		err = scutilRemove(m.service)
+	}
+	if err != nil || scoped {
+		return err
+	}
+	return m.overrideLocked()
+}
+
+// scopeLocked returns the domains that m.cfg's own service's resolver
+// is scoped to, and whether that's all of m.cfg, rather than it also
+// overriding the primary service's resolver.
+func (m *scManager) scopeLocked() (domains []string, scoped bool) {
+	switch {
+	case len(m.cfg.MatchDomains) > 0:
+		return m.cfg.MatchDomains, true
+	case !m.cfg.Global:
+		// Not asked to take over all names.
+		return append(append([]string(nil), m.cfg.Domains...), m.cfg.RestrictedDomains...), true
+	}
+	return m.cfg.RestrictedDomains, false
+}
+
+// overrideLocked replaces the primary service's resolver with
+// m.cfg's, saving the settings it replaces, unless they're saved
+// already.
+func (m *scManager) overrideLocked() error {
+	primary, err := primaryService()
+	if err != nil {
+		return err
+	}
+	if primary != m.overridden {
+		if err := m.restoreLocked(); err != nil {
+			return err
+		}
+	}
+	cur, err := scutilGet(serviceDNSKey(primary))
+	if err != nil {
+		return err
+	}
+	if _, ours := cur[overrideMark]; !ours {
+		// The service's own settings, first seen or rewritten by
+		// configd since.
+		saved := scutilDict{savedService: {Vals: []string{primary}}}
+		for k, v := range cur {
+			saved[k] = v
+		}
+		if _, err := scutil(saved.setScript(savedKey)); err != nil {
+			return err
+		}
+		m.overridden = primary
+	}
+	saved, err := scutilGet(savedKey)
+	if err != nil {
+		return err
+	}
+
+	// Names the service's search domains complete still resolve,
+	// now through our nameservers.
+	d := dnsDict(m.cfg)
+	d["SearchDomains"] = scutilValue{Array: true, Vals: append(append([]string(nil), m.cfg.Domains...), saved["SearchDomains"].Vals...)}
+	d[overrideMark] = scutilValue{Vals: []string{"1"}}
+	_, err = scutil(d.setScript(serviceDNSKey(primary)))
+	return err
+}
+
+// restoreLocked puts back the settings of the service whose resolver
+// was overridden, if any.
+func (m *scManager) restoreLocked() error {
+	if err := restoreSaved(); err != nil {
+		return err
+	}
+	m.overridden = ""
+	return nil
+}
+
+// restoreSaved puts back the settings in savedKey, if there are any,
+// and removes them.
+func restoreSaved() error {
+	saved, err := scutilGet(savedKey)
+	if err != nil || saved == nil {
+		return err
+	}
+	v := saved[savedService]
+	delete(saved, savedService)
+	if len(v.Vals) == 1 {
+		key := serviceDNSKey(v.Vals[0])
+		if len(saved) == 0 {
+			// The service had no settings in the State: domain,
+			// leaving configd to use its Setup: ones.
+			err = scutilRemove(key)
+		} else {
+			_, err = scutil(saved.setScript(key))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return scutilRemove(savedKey)
+}
+
+// recheck reapplies m's configuration whenever the dynamic store no
+// longer has it, until stop is closed.
+func (m *scManager) recheck(stop chan struct{}) {
+	t := time.NewTicker(recheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		m.mu.Lock()
+		if m.stop == stop && m.needsApplyLocked() {
+			if err := m.applyLocked(); err != nil {
+				m.logf("dns: reapplying settings: %v", err)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// needsApplyLocked reports whether m.cfg is missing from the dynamic
+// store.
+func (m *scManager) needsApplyLocked() bool {
+	domains, scoped := m.scopeLocked()
+	if len(domains) > 0 {
+		d, err := scutilGet(m.service)
+		if err == nil && d == nil {
+			return true
+		}
+	}
+	if scoped {
+		return false
+	}
+	primary, err := primaryService()
+	if err != nil {
+		return false
+	}
+	if primary != m.overridden {
+		return true
+	}
+	d, err := scutilGet(serviceDNSKey(primary))
+	_, ours := d[overrideMark]
+	return err == nil && !ours
+}
+
+func cleanup(logf logger.Logf, iface string) {
+	if err := restoreSaved(); err != nil {
+		logf("dns: restoring saved settings: %v", err)
+	}
+	if err := scutilRemove(serviceDNSKey("tailscale-" + iface)); err != nil {
+		logf("dns: removing settings: %v", err)
+	}
+}
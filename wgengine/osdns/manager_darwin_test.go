@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSCManagerGlobal(t *testing.T) {
+	// A fake dynamic store, with an en0 service that's primary.
+	const primaryKey = "State:/Network/Service/en0/DNS"
+	store := map[string]string{
+		"State:/Network/Global/IPv4": "<dictionary> {\n  PrimaryService : en0\n}\n",
+		primaryKey:                   "<dictionary> {\n  ServerAddresses : <array> {\n    0 : 192.168.1.1\n  }\n}\n",
+	}
+	var touched []string // keys set or removed
+	defer func(f func(string) (string, error)) { scutil = f }(scutil)
+	scutil = func(script string) (string, error) {
+		for _, line := range strings.Split(script, "\n") {
+			f := strings.Fields(line)
+			if len(f) != 2 {
+				continue
+			}
+			switch f[0] {
+			case "show":
+				if d, ok := store[f[1]]; ok {
+					return d, nil
+				}
+				return "  No such key\n", nil
+			case "set", "remove":
+				touched = append(touched, f[1])
+			}
+		}
+		return "", nil
+	}
+	touchedPrimary := func() bool {
+		for _, k := range touched {
+			if k == primaryKey {
+				return true
+			}
+		}
+		return false
+	}
+
+	m := newManager(t.Logf, "utun3").(*scManager)
+	defer m.Close()
+	cfg := Config{
+		Nameservers: []net.IP{net.ParseIP("100.100.100.100")},
+		Domains:     []string{"example.com.beta.tailscale.net"},
+	}
+	if err := m.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if touchedPrimary() {
+		t.Errorf("without Global, the primary service's resolver was overridden")
+	}
+	if got, _ := m.scopeLocked(); len(got) != 1 || got[0] != cfg.Domains[0] {
+		t.Errorf("without Global, scoped to %q, want the search domain", got)
+	}
+
+	cfg.Global = true
+	if err := m.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !touchedPrimary() {
+		t.Errorf("with Global, the primary service's resolver wasn't overridden")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"tailscale.com/types/logger"
+)
+
+// The ways Linux systems manage DNS, in the order detect looks for
+// them. Each has its own Manager: changing resolv.conf under any of
+// the others gets it overwritten, or breaks them.
+const (
+	modeResolved   = "systemd-resolved"
+	modeNM         = "NetworkManager"
+	modeResolvconf = "resolvconf"
+	modeDirect     = "direct"
+)
+
+// haveCmd reports whether cmd is in $PATH.
+func haveCmd(cmd string) bool {
+	_, err := exec.LookPath(cmd)
+	return err == nil
+}
+
+// detect returns the mode that manages DNS, judging by the
+// resolv.conf at path, which each names or links into, and the
+// commands that have, as reported by have, to talk to it.
+func detect(path string, have func(cmd string) bool) string {
+	target, _ := os.Readlink(path)
+	b, _ := ioutil.ReadFile(path)
+	contents := string(b)
+	switch {
+	case (strings.HasPrefix(target, "/run/systemd/resolve/") || strings.Contains(contents, "systemd-resolved")) && have("busctl"):
+		return modeResolved
+	case strings.Contains(contents, "Generated by NetworkManager") && have("nmcli"):
+		return modeNM
+	case (strings.Contains(target, "/resolvconf/") || strings.Contains(contents, "resolvconf")) && have("resolvconf"):
+		return modeResolvconf
+	}
+	return modeDirect
+}
+
+func newManager(logf logger.Logf, iface string) Manager {
+	mode := detect(resolvConf, haveCmd)
+	logf("dns: using %s", mode)
+	switch mode {
+	case modeResolved:
+		return &resolvedManager{logf: logf, iface: iface}
+	case modeNM:
+		return &nmManager{logf: logf, iface: iface}
+	case modeResolvconf:
+		return newResolvconfManager(logf, iface)
+	}
+	return &directManager{logf: logf}
+}
+
+func cleanup(logf logger.Logf, iface string) {
+	// Settings made through systemd-resolved and NetworkManager are
+	// for the interface, and went away with it. Those in files
+	// stay.
+	if haveCmd("resolvconf") {
+		newResolvconfManager(logf, iface).Close()
+	}
+	if err := (&directManager{logf: logf}).Close(); err != nil {
+		logf("dns: restoring resolv.conf: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osdns-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	haveAll := func(string) bool { return true }
+	haveNone := func(string) bool { return false }
+
+	tests := []struct {
+		name     string
+		contents string
+		link     string
+		have     func(string) bool
+		want     string
+	}{
+		{"resolved-link", "nameserver 127.0.0.53\n", "/run/systemd/resolve/stub-resolv.conf", haveAll, modeResolved},
+		{"resolved-file", "# This file is managed by man:systemd-resolved(8). Do not edit.\nnameserver 127.0.0.53\n", "", haveAll, modeResolved},
+		{"resolved-nobusctl", "# This file is managed by man:systemd-resolved(8). Do not edit.\n", "", haveNone, modeDirect},
+		{"nm", "# Generated by NetworkManager\nnameserver 192.168.1.1\n", "", haveAll, modeNM},
+		{"openresolv", "# Generated by resolvconf\nnameserver 192.168.1.1\n", "", haveAll, modeResolvconf},
+		{"debian-resolvconf", "nameserver 192.168.1.1\n", "/run/resolvconf/resolv.conf", haveAll, modeResolvconf},
+		{"plain", "nameserver 192.168.1.1\n", "", haveAll, modeDirect},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		var err error
+		if tt.link != "" {
+			// Links are judged by their target's name; it
+			// needn't exist.
+			err = os.Symlink(tt.link, path)
+		} else {
+			err = ioutil.WriteFile(path, []byte(tt.contents), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := detect(path, tt.have); got != tt.want {
+			t.Errorf("%s: detect = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDirect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osdns-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(a, b, c string) { tsConf, backupConf, resolvConf = a, b, c }(tsConf, backupConf, resolvConf)
+	tsConf = filepath.Join(dir, "resolv.tailscale.conf")
+	backupConf = filepath.Join(dir, "resolv.pre-tailscale-backup.conf")
+	resolvConf = filepath.Join(dir, "resolv.conf")
+	const orig = "nameserver 192.168.1.1\n"
+	if err := ioutil.WriteFile(resolvConf, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &directManager{logf: t.Logf}
+	cfg := Config{Nameservers: []net.IP{net.ParseIP("100.64.0.1")}, Domains: []string{"example.com"}}
+	for i := 0; i < 2; i++ { // the second time finds it already set
+		if err := m.Set(cfg); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(resolvConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), "nameserver 100.64.0.1\nsearch example.com\n") {
+			t.Errorf("resolv.conf = %q", b)
+		}
+	}
+	if err := m.Set(Config{}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(resolvConf)
+	if err != nil || string(b) != orig {
+		t.Errorf("after restoring, resolv.conf = %q, %v; want %q", b, err, orig)
+	}
+	if _, err := os.Stat(tsConf); !os.IsNotExist(err) {
+		t.Errorf("%s left behind", tsConf)
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("Close after restoring: %v", err)
+	}
+}
+
+func TestResolvedArgs(t *testing.T) {
+	got := setLinkDNSArgs(7, []net.IP{net.ParseIP("100.64.0.1"), net.ParseIP("fd7a::1")})
+	want := strings.Fields("SetLinkDNS ia(iay) 7 2 2 4 100 64 0 1 10 16 253 122 0 0 0 0 0 0 0 0 0 0 0 0 0 1")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("setLinkDNSArgs = %q, want %q", got, want)
+	}
+	got = setLinkDomainsArgs(7, []string{"example.com"}, []string{"."})
+	want = strings.Fields("SetLinkDomains ia(sb) 7 2 example.com false . true")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("setLinkDomainsArgs = %q, want %q", got, want)
+	}
+
+	ns := []net.IP{net.ParseIP("100.64.0.1")}
+	routingTests := []struct {
+		cfg  Config
+		want []string
+	}{
+		{Config{Domains: []string{"example.com"}}, nil},
+		{Config{Nameservers: ns}, []string{"."}},
+		{Config{Nameservers: ns, RestrictedDomains: []string{"corp.example.com"}}, []string{".", "corp.example.com"}},
+		{Config{Nameservers: ns, MatchDomains: []string{"corp.example.com", "lab.example.com"}, RestrictedDomains: []string{"corp.example.com"}}, []string{"corp.example.com", "lab.example.com"}},
+	}
+	for _, tt := range routingTests {
+		if got := routingDomains(tt.cfg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("routingDomains(%+v) = %q, want %q", tt.cfg, got, tt.want)
+		}
+	}
+}
+
+func TestNM(t *testing.T) {
+	var ran [][]string
+	defer func(old func(...string) error) { nmcli = old }(nmcli)
+	nmcli = func(args ...string) error {
+		ran = append(ran, args)
+		return nil
+	}
+	m := &nmManager{logf: t.Logf, iface: "tailscale0"}
+	if err := m.Set(Config{}); err != nil || len(ran) != 0 {
+		t.Errorf("clearing an unmanaged interface ran %q, %v", ran, err)
+	}
+	if err := m.Set(Config{Nameservers: []net.IP{net.ParseIP("100.64.0.1")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var cmds []string
+	for _, args := range ran {
+		cmds = append(cmds, strings.Join(args, " "))
+	}
+	want := []string{
+		"device set tailscale0 managed yes",
+		"device modify tailscale0 ipv4.dns 100.64.0.1 ipv4.dns-search  ipv4.dns-priority -1 ipv6.dns  ipv6.dns-search  ipv6.dns-priority -1",
+		"device modify tailscale0 ipv4.dns  ipv4.dns-search  ipv4.dns-priority -1 ipv6.dns  ipv6.dns-search  ipv6.dns-priority -1",
+		"device set tailscale0 managed no",
+	}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Errorf("ran:\n%s\nwant:\n%s", strings.Join(cmds, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestResolvconf(t *testing.T) {
+	var ran []string
+	var stdin string
+	defer func(old func([]byte, ...string) error) { resolvconf = old }(resolvconf)
+	resolvconf = func(in []byte, args ...string) error {
+		ran = append(ran, strings.Join(args, " "))
+		stdin = string(in)
+		return nil
+	}
+	for _, openresolv := range []bool{true, false} {
+		ran = nil
+		m := &resolvconfManager{logf: t.Logf, record: "tailscale0", openresolv: openresolv}
+		if err := m.Set(Config{Nameservers: []net.IP{net.ParseIP("100.64.0.1")}}); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(stdin, "nameserver 100.64.0.1\n") {
+			t.Errorf("stdin = %q", stdin)
+		}
+		m.Set(Config{})
+		want := []string{"-a tailscale0", "-d tailscale0"}
+		if openresolv {
+			want = []string{"-m 0 -x -a tailscale0", "-f -d tailscale0"}
+		}
+		if !reflect.DeepEqual(ran, want) {
+			t.Errorf("openresolv=%v: ran %q, want %q", openresolv, ran, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"os/exec"
+
+	"golang.org/x/sys/windows/registry"
+	"tailscale.com/types/logger"
+)
+
+// The registry keys holding NRPT rules; see nrpt.go.
+const (
+	nrptLocalKey  = `SYSTEM\CurrentControlSet\Services\Dnscache\Parameters\DnsPolicyConfig`
+	nrptPolicyKey = `SOFTWARE\Policies\Microsoft\Windows NT\DNSClient\DnsPolicyConfig`
+)
+
+// nrptManager manages split DNS on Windows, with an NRPT rule.
+// Nameservers for all names are set on the interface, by the router,
+// so it only handles configurations with MatchDomains or, as Windows
+// otherwise asks every interface's nameservers, RestrictedDomains.
+type nrptManager struct {
+	logf logger.Logf
+}
+
+func newManager(logf logger.Logf, iface string) Manager {
+	return &nrptManager{logf: logf}
+}
+
+func (m *nrptManager) Set(cfg Config) error {
+	domains := cfg.MatchDomains
+	if len(domains) == 0 {
+		domains = cfg.RestrictedDomains
+	}
+	if len(domains) == 0 || len(cfg.Nameservers) == 0 {
+		return m.Close()
+	}
+	names, servers := nrptNames(domains), nrptServers(cfg.Nameservers)
+	if err := writeNRPTRule(nrptLocalKey, names, servers); err != nil {
+		return err
+	}
+	if policyHasNRPTRules() {
+		// The policy's rules hide the local ones, so ours goes
+		// among them. A policy refresh may remove it again, until
+		// the next Set.
+		if err := writeNRPTRule(nrptPolicyKey, names, servers); err != nil {
+			return err
+		}
+	} else if err := deleteNRPTRule(nrptPolicyKey); err != nil {
+		return err
+	}
+	flushDNS(m.logf)
+	return nil
+}
+
+func (m *nrptManager) Close() error {
+	err := deleteNRPTRule(nrptLocalKey)
+	if err2 := deleteNRPTRule(nrptPolicyKey); err == nil {
+		err = err2
+	}
+	flushDNS(m.logf)
+	return err
+}
+
+// writeNRPTRule writes Tailscale's NRPT rule under the key base,
+// sending the names under the namespaces names to servers.
+func writeNRPTRule(base string, names []string, servers string) error {
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, base+`\`+nrptRuleName, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+	if err := k.SetDWordValue("Version", 2); err != nil {
+		return err
+	}
+	if err := k.SetStringsValue("Name", names); err != nil {
+		return err
+	}
+	if err := k.SetStringValue("GenericDNSServers", servers); err != nil {
+		return err
+	}
+	if err := k.SetDWordValue("ConfigOptions", 0x8); err != nil { // use GenericDNSServers
+		return err
+	}
+	if err := k.SetStringValue("IPSECCARestriction", ""); err != nil {
+		return err
+	}
+	return k.SetStringValue("Comment", "Tailscale")
+}
+
+// deleteNRPTRule deletes Tailscale's NRPT rule under the key base,
+// if it's there.
+func deleteNRPTRule(base string) error {
+	err := registry.DeleteKey(registry.LOCAL_MACHINE, base+`\`+nrptRuleName)
+	if err == registry.ErrNotExist {
+		return nil
+	}
+	return err
+}
+
+// policyHasNRPTRules reports whether group policy sets NRPT rules,
+// other than Tailscale's.
+func policyHasNRPTRules() bool {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, nrptPolicyKey, registry.READ)
+	if err != nil {
+		return false
+	}
+	defer k.Close()
+	rules, _ := k.ReadSubKeyNames(-1)
+	for _, r := range rules {
+		if r != nrptRuleName {
+			return true
+		}
+	}
+	return false
+}
+
+// flushDNS empties the DNS client's cache, so that answers from
+// before a rule changed aren't used.
+func flushDNS(logf logger.Logf) {
+	if out, err := exec.Command("ipconfig", "/flushdns").CombinedOutput(); err != nil {
+		logf("dns: ipconfig /flushdns: %v: %s", err, out)
+	}
+}
+
+func cleanup(logf logger.Logf, iface string) {
+	if err := (&nrptManager{logf: logf}).Close(); err != nil {
+		logf("dns: removing NRPT rule: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"tailscale.com/types/logger"
+)
+
+// nmPriority is the DNS priority of the Tailscale interface's
+// settings in NetworkManager. Negative priorities exclude the
+// settings of interfaces with higher ones, so that all queries go
+// to Tailscale's nameservers, as they do in the other modes.
+const nmPriority = "-1"
+
+// nmcli runs NetworkManager's command-line client. It's a variable
+// for tests.
+var nmcli = func(args ...string) error {
+	out, err := exec.Command("nmcli", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nmcli %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// nmManager manages DNS through NetworkManager, which writes
+// resolv.conf from the settings of the interfaces it manages. The
+// Tailscale interface is set managed, with its DNS settings applied
+// to it directly, not saved in a connection profile.
+type nmManager struct {
+	logf    logger.Logf
+	iface   string
+	managed bool // the interface was set managed
+}
+
+func (m *nmManager) Set(cfg Config) error {
+	if !m.managed {
+		if cfg.IsZero() {
+			return nil
+		}
+		if err := nmcli("device", "set", m.iface, "managed", "yes"); err != nil {
+			return err
+		}
+		m.managed = true
+	}
+	return nmcli(nmModifyArgs(m.iface, cfg)...)
+}
+
+func (m *nmManager) Close() error {
+	if !m.managed {
+		return nil
+	}
+	err := nmcli(nmModifyArgs(m.iface, Config{})...)
+	if err2 := nmcli("device", "set", m.iface, "managed", "no"); err == nil {
+		err = err2
+	}
+	m.managed = false
+	return err
+}
+
+// nmModifyArgs returns the nmcli arguments that give iface the DNS
+// settings cfg.
+func nmModifyArgs(iface string, cfg Config) []string {
+	var dns4, dns6 []string
+	for _, ip := range cfg.Nameservers {
+		if ip.To4() != nil {
+			dns4 = append(dns4, ip.String())
+		} else {
+			dns6 = append(dns6, ip.String())
+		}
+	}
+	search := strings.Join(cfg.Domains, ",")
+	return []string{"device", "modify", iface,
+		"ipv4.dns", strings.Join(dns4, ","),
+		"ipv4.dns-search", search,
+		"ipv4.dns-priority", nmPriority,
+		"ipv6.dns", strings.Join(dns6, ","),
+		"ipv6.dns-search", search,
+		"ipv6.dns-priority", nmPriority,
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"net"
+	"strings"
+)
+
+// Windows splits DNS with the Name Resolution Policy Table (NRPT): a
+// set of rules, each sending the names under some domains to its own
+// nameservers. Rules are registry keys, under a local key and, if any
+// group policy sets NRPT rules, a policy key; when the policy key has
+// rules, Windows ignores the local ones. Tailscale adds one rule of
+// its own, by a fixed name, alongside whatever rules are there.
+
+// nrptRuleName is the name of the registry key of Tailscale's NRPT
+// rule.
+//lint:ignore U1000 only used on Windows, but kept with the rest of
+// the NRPT rule's description here.
+const nrptRuleName = "{5abe529b-675b-4486-8459-25a634dacc23}"
+
+// nrptNames returns the domains as the namespaces of an NRPT rule,
+// which match names under a domain if it starts with a dot.
+func nrptNames(domains []string) []string {
+	var names []string
+	for _, d := range domains {
+		d = strings.TrimSuffix(d, ".")
+		if d == "" {
+			continue
+		}
+		names = append(names, "."+strings.TrimPrefix(d, "."))
+	}
+	return names
+}
+
+// nrptServers returns the nameservers ns in the form of an NRPT
+// rule's GenericDNSServers value.
+func nrptServers(ns []net.IP) string {
+	var s []string
+	for _, ip := range ns {
+		s = append(s, ip.String())
+	}
+	return strings.Join(s, "; ")
+}
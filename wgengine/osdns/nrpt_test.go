@@ -0,0 +1,22 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNRPT(t *testing.T) {
+	got := nrptNames([]string{"example.com.beta.tailscale.net", ".corp.example.com.", "", "."})
+	want := []string{".example.com.beta.tailscale.net", ".corp.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nrptNames = %q, want %q", got, want)
+	}
+	if got, want := nrptServers([]net.IP{net.ParseIP("100.64.0.1"), net.ParseIP("fd7a::1")}), "100.64.0.1; fd7a::1"; got != want {
+		t.Errorf("nrptServers = %q, want %q", got, want)
+	}
+}
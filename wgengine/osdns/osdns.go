@@ -0,0 +1,68 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package osdns configures the operating system's DNS resolution to
+// use the tailnet's nameservers, through whichever mechanism owns the
+// system's DNS settings.
+package osdns
+
+import (
+	"net"
+
+	"tailscale.com/types/logger"
+)
+
+// Config is the DNS configuration to give the OS for the Tailscale
+// interface.
+type Config struct {
+	Nameservers []net.IP
+	Domains     []string // search domains
+
+	// MatchDomains, if non-empty, limits Nameservers to names
+	// under these domains (split DNS), on systems that can do so;
+	// other names resolve as they did before. Others send all
+	// names to Nameservers.
+	MatchDomains []string
+
+	// RestrictedDomains are domains whose names go to Nameservers
+	// alone, never to the nameservers of other interfaces, on
+	// systems that can be told so. With MatchDomains, they're
+	// among them.
+	RestrictedDomains []string
+
+	// Global, without MatchDomains, asks for all names to go to
+	// Nameservers in place of the system's own resolvers. Systems
+	// that can scope a resolver, such as macOS, only take over all
+	// names when it's set; otherwise they send Nameservers just the
+	// names under Domains and RestrictedDomains.
+	Global bool
+}
+
+// IsZero reports whether c sets nothing, which restores the OS's
+// own configuration.
+func (c Config) IsZero() bool {
+	return len(c.Nameservers) == 0 && len(c.Domains) == 0
+}
+
+// Manager sets the OS's DNS configuration.
+type Manager interface {
+	// Set replaces the configuration Tailscale gave the OS. The
+	// zero Config removes it.
+	Set(Config) error
+
+	// Close removes the configuration Tailscale gave the OS.
+	Close() error
+}
+
+// New returns the Manager for this system's DNS, adding configuration
+// for the Tailscale interface iface.
+func New(logf logger.Logf, iface string) Manager {
+	return newManager(logf, iface)
+}
+
+// Cleanup removes the configuration a tailscaled that didn't shut
+// down cleanly may have left for iface.
+func Cleanup(logf logger.Logf, iface string) {
+	cleanup(logf, iface)
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!windows,!darwin
+
+package osdns
+
+import "tailscale.com/types/logger"
+
+// noopManager is the Manager of systems whose DNS is set elsewhere,
+// by their router.
+type noopManager struct{}
+
+func (noopManager) Set(Config) error { return nil }
+func (noopManager) Close() error     { return nil }
+
+func newManager(logf logger.Logf, iface string) Manager {
+	return noopManager{}
+}
+
+func cleanup(logf logger.Logf, iface string) {}
@@ -0,0 +1,73 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"tailscale.com/types/logger"
+)
+
+// resolvconf runs resolvconf(8) with args and stdin. It's a variable
+// for tests.
+var resolvconf = func(stdin []byte, args ...string) error {
+	cmd := exec.Command("resolvconf", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resolvconf %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// resolvconfManager manages DNS through resolvconf, which writes
+// resolv.conf from a record per interface. There are two programs by
+// that name: openresolv, and Debian's resolvconf.
+type resolvconfManager struct {
+	logf       logger.Logf
+	record     string // name of the record for the Tailscale interface
+	openresolv bool
+}
+
+func newResolvconfManager(logf logger.Logf, iface string) *resolvconfManager {
+	out, _ := exec.Command("resolvconf", "--version").CombinedOutput()
+	m := &resolvconfManager{
+		logf:       logf,
+		openresolv: bytes.Contains(out, []byte("openresolv")),
+	}
+	if m.openresolv {
+		m.record = iface
+	} else {
+		// Debian's orders records by the patterns in
+		// /etc/resolvconf/interface-order, which put "tun*"
+		// right after loopback ones.
+		m.record = "tun." + iface
+	}
+	return m
+}
+
+func (m *resolvconfManager) Set(cfg Config) error {
+	if cfg.IsZero() {
+		return m.Close()
+	}
+	args := []string{"-a", m.record}
+	if m.openresolv {
+		// Exclusive, and first: all queries go to Tailscale's
+		// nameservers, as they do in the other modes.
+		args = []string{"-m", "0", "-x", "-a", m.record}
+	}
+	return resolvconf(resolvConfContents(cfg), args...)
+}
+
+func (m *resolvconfManager) Close() error {
+	args := []string{"-d", m.record}
+	if m.openresolv {
+		args = []string{"-f", "-d", m.record} // -f: no error if missing
+	}
+	return resolvconf(nil, args...)
+}
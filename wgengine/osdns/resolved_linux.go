@@ -0,0 +1,118 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+
+	"tailscale.com/types/logger"
+)
+
+// systemd-resolved's D-Bus API; see org.freedesktop.resolve1(5).
+const (
+	resolvedDest  = "org.freedesktop.resolve1"
+	resolvedPath  = "/org/freedesktop/resolve1"
+	resolvedIface = "org.freedesktop.resolve1.Manager"
+)
+
+// busctl calls a method of systemd-resolved over D-Bus with busctl,
+// systemd's D-Bus client, which is present wherever resolved is.
+// args are the method's name, signature and arguments. It's a
+// variable for tests.
+var busctl = func(args ...string) error {
+	out, err := exec.Command("busctl", append([]string{"call", resolvedDest, resolvedPath, resolvedIface}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", args[0], err, out)
+	}
+	return nil
+}
+
+// resolvedManager manages DNS through systemd-resolved, which keeps
+// DNS settings per interface: Tailscale's nameservers and domains go
+// on its own interface, and leave the others' alone.
+type resolvedManager struct {
+	logf  logger.Logf
+	iface string
+}
+
+func (m *resolvedManager) Set(cfg Config) error {
+	ifi, err := net.InterfaceByName(m.iface)
+	if err != nil {
+		return err
+	}
+	if cfg.IsZero() {
+		return busctl("RevertLink", "i", strconv.Itoa(ifi.Index))
+	}
+	if err := busctl(setLinkDNSArgs(ifi.Index, cfg.Nameservers)...); err != nil {
+		return err
+	}
+	if err := busctl(setLinkDomainsArgs(ifi.Index, cfg.Domains, routingDomains(cfg))...); err != nil {
+		return err
+	}
+	// Older resolveds lack SetLinkDefaultRoute, and default to it.
+	defaultRoute := strconv.FormatBool(len(cfg.MatchDomains) == 0)
+	if err := busctl("SetLinkDefaultRoute", "ib", strconv.Itoa(ifi.Index), defaultRoute); err != nil {
+		m.logf("dns: %v", err)
+	}
+	return nil
+}
+
+func (m *resolvedManager) Close() error {
+	ifi, err := net.InterfaceByName(m.iface)
+	if err != nil {
+		return nil // gone, and its settings with it
+	}
+	return busctl("RevertLink", "i", strconv.Itoa(ifi.Index))
+}
+
+// routingDomains returns the routing domains of the Tailscale
+// interface for cfg.
+func routingDomains(cfg Config) []string {
+	switch {
+	case len(cfg.Nameservers) == 0:
+		return nil
+	case len(cfg.MatchDomains) > 0:
+		return cfg.MatchDomains
+	}
+	// All names, of which the restricted ones go nowhere else:
+	// resolved sends a name only to the links with its most
+	// specific routing domain.
+	return append([]string{"."}, cfg.RestrictedDomains...)
+}
+
+// setLinkDNSArgs returns the busctl arguments of a SetLinkDNS call
+// giving interface index the nameservers ns.
+func setLinkDNSArgs(index int, ns []net.IP) []string {
+	args := []string{"SetLinkDNS", "ia(iay)", strconv.Itoa(index), strconv.Itoa(len(ns))}
+	for _, ip := range ns {
+		family, b := "10", ip.To16() // AF_INET6
+		if ip4 := ip.To4(); ip4 != nil {
+			family, b = "2", ip4 // AF_INET
+		}
+		args = append(args, family, strconv.Itoa(len(b)))
+		for _, c := range b {
+			args = append(args, strconv.Itoa(int(c)))
+		}
+	}
+	return args
+}
+
+// setLinkDomainsArgs returns the busctl arguments of a SetLinkDomains
+// call giving interface index the search domains, and the routing
+// domains, whose names are sent only to it. The routing domain "."
+// sends it all names.
+func setLinkDomainsArgs(index int, domains, routing []string) []string {
+	args := []string{"SetLinkDomains", "ia(sb)", strconv.Itoa(index), strconv.Itoa(len(domains) + len(routing))}
+	for _, d := range domains {
+		args = append(args, d, "false")
+	}
+	for _, d := range routing {
+		args = append(args, d, "true")
+	}
+	return args
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// scutilDict is a dictionary in macOS's SystemConfiguration dynamic
+// store, such as a network service's DNS settings, as scutil(8) shows
+// and sets them. The values that matter for DNS are strings and
+// arrays of strings.
+type scutilDict map[string]scutilValue
+
+// scutilValue is a value in a scutilDict.
+type scutilValue struct {
+	Array bool
+	Vals  []string // exactly one if not Array
+}
+
+// parseScutilDict parses scutil's output for "show KEY", returning nil
+// if there's no such key. Nested dictionaries, which DNS settings
+// don't use, are skipped.
+func parseScutilDict(out string) scutilDict {
+	s := bufio.NewScanner(strings.NewReader(out))
+	if !s.Scan() || !strings.HasPrefix(strings.TrimSpace(s.Text()), "<dictionary>") {
+		return nil
+	}
+	d := make(scutilDict)
+	var arrayKey string // the array being read, if any
+	skip := 0           // depth within a skipped dictionary
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "}" {
+			switch {
+			case skip > 0:
+				skip--
+			case arrayKey != "":
+				arrayKey = ""
+			}
+			continue
+		}
+		i := strings.Index(line, " : ")
+		if i < 0 {
+			continue
+		}
+		k, v := line[:i], line[i+3:]
+		switch {
+		case skip > 0:
+			if strings.HasPrefix(v, "<dictionary>") || strings.HasPrefix(v, "<array>") {
+				skip++
+			}
+		case arrayKey != "":
+			val := d[arrayKey]
+			val.Vals = append(val.Vals, v)
+			d[arrayKey] = val
+		case strings.HasPrefix(v, "<array>"):
+			arrayKey = k
+			d[k] = scutilValue{Array: true}
+		case strings.HasPrefix(v, "<dictionary>"):
+			skip = 1
+		default:
+			d[k] = scutilValue{Vals: []string{v}}
+		}
+	}
+	return d
+}
+
+// setScript returns the scutil commands that set key to d.
+func (d scutilDict) setScript(key string) string {
+	var keys []string
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("d.init\n")
+	for _, k := range keys {
+		v := d[k]
+		if v.Array {
+			if len(v.Vals) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "d.add %s * %s\n", k, strings.Join(v.Vals, " "))
+		} else if len(v.Vals) > 0 {
+			fmt.Fprintf(&b, "d.add %s %s\n", k, v.Vals[0])
+		}
+	}
+	fmt.Fprintf(&b, "set %s\n", key)
+	return b.String()
+}
+
+// dnsDict returns cfg as a service's DNS settings dictionary.
+func dnsDict(cfg Config) scutilDict {
+	d := make(scutilDict)
+	var ns []string
+	for _, ip := range cfg.Nameservers {
+		ns = append(ns, ip.String())
+	}
+	d["ServerAddresses"] = scutilValue{Array: true, Vals: ns}
+	d["SearchDomains"] = scutilValue{Array: true, Vals: cfg.Domains}
+	if len(cfg.MatchDomains) > 0 {
+		d["SupplementalMatchDomains"] = scutilValue{Array: true, Vals: cfg.MatchDomains}
+	}
+	return d
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package osdns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseScutilDict(t *testing.T) {
+	d := parseScutilDict(`<dictionary> {
+  DomainName : lan
+  SearchDomains : <array> {
+    0 : lan
+    1 : example.com
+  }
+  ServerAddresses : <array> {
+    0 : 192.168.1.1
+  }
+  __Nested__ : <dictionary> {
+    Inner : <array> {
+      0 : x
+    }
+  }
+  After : y
+}
+`)
+	want := scutilDict{
+		"DomainName":      {Vals: []string{"lan"}},
+		"SearchDomains":   {Array: true, Vals: []string{"lan", "example.com"}},
+		"ServerAddresses": {Array: true, Vals: []string{"192.168.1.1"}},
+		"After":           {Vals: []string{"y"}},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("parsed %v, want %v", d, want)
+	}
+	if d := parseScutilDict("  No such key\n"); d != nil {
+		t.Errorf("missing key parsed as %v", d)
+	}
+
+	const script = `d.init
+d.add DomainName lan
+d.add SearchDomains * lan example.com
+d.add ServerAddresses * 192.168.1.1
+set State:/Network/Service/x/DNS
+`
+	delete(want, "After")
+	if got := want.setScript("State:/Network/Service/x/DNS"); got != script {
+		t.Errorf("script:\n%s\nwant:\n%s", got, script)
+	}
+}
+
+func TestDNSDict(t *testing.T) {
+	d := dnsDict(Config{
+		Nameservers:  []net.IP{net.ParseIP("100.64.0.1")},
+		Domains:      []string{"example.com"},
+		MatchDomains: []string{"example.com.beta.tailscale.net"},
+	})
+	const want = `d.init
+d.add SearchDomains * example.com
+d.add ServerAddresses * 100.64.0.1
+d.add SupplementalMatchDomains * example.com.beta.tailscale.net
+set K
+`
+	if got := d.setScript("K"); got != want {
+		t.Errorf("script:\n%s\nwant:\n%s", got, want)
+	}
+}
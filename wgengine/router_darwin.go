@@ -8,10 +8,13 @@ import (
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/osdns"
 )
 
 type darwinRouter struct {
+	logf    logger.Logf
 	tunname string
+	dns     osdns.Manager
 }
 
 func newUserspaceRouter(logf logger.Logf, _ *device.Device, tundev tun.Device) (Router, error) {
@@ -19,7 +22,11 @@ func newUserspaceRouter(logf logger.Logf, _ *device.Device, tundev tun.Device) (
 	if err != nil {
 		return nil, err
 	}
-	return &darwinRouter{tunname: tunname}, nil
+	return &darwinRouter{
+		logf:    logf,
+		tunname: tunname,
+		dns:     osdns.New(logf, tunname),
+	}, nil
 }
 
 func (r *darwinRouter) Up() error {
@@ -28,11 +35,39 @@ func (r *darwinRouter) Up() error {
 
 func (r *darwinRouter) SetRoutes(rs RouteSettings) error {
 	if SetRoutesFunc != nil {
+		// The app configures DNS along with the routes.
 		return SetRoutesFunc(rs)
 	}
+	dns := osdns.Config{
+		Domains:           rs.DNSDomains,
+		MatchDomains:      rs.DNSMatchDomains,
+		RestrictedDomains: rs.DNSRestrictedDomains,
+		Global:            rs.DNSGlobal,
+	}
+	for _, ip := range rs.DNS {
+		dns.Nameservers = append(dns.Nameservers, ip.IP())
+	}
+	if err := r.dns.Set(dns); err != nil {
+		r.logf("setting DNS failed: %v", err)
+		return err
+	}
 	return nil
 }
 
 func (r *darwinRouter) Close() error {
+	if SetRoutesFunc != nil {
+		// The app set DNS, and removes it.
+		return nil
+	}
+	if err := r.dns.Close(); err != nil {
+		r.logf("failed to restore system DNS: %v", err)
+		return err
+	}
 	return nil
 }
+
+func cleanup(logf logger.Logf, tunname string) {
+	// The utun interface, and its routes, go away with the process
+	// that opened it. DNS settings are in configd, which doesn't.
+	osdns.Cleanup(logf, tunname)
+}
@@ -15,3 +15,5 @@ import (
 func newUserspaceRouter(logf logger.Logf, tunname string, dev *device.Device, tuntap tun.Device, netChanged func()) Router {
 	return NewFakeRouter(logf, tunname, dev, tuntap, netChanged)
 }
+
+func cleanup(logf logger.Logf, tunname string) {}
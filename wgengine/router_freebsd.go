@@ -151,6 +151,13 @@ func (r *freebsdRouter) Close() error {
 	return nil
 }
 
+func cleanup(logf logger.Logf, tunname string) {
+	// Destroying the interface removes its addresses and routes.
+	if out, err := cmd("ifconfig", tunname, "destroy").CombinedOutput(); err != nil {
+		logf("ifconfig %s destroy: %v\n%s", tunname, err, out)
+	}
+}
+
 // TODO(mbaillie): these are no-ops for now. They could re-use the Linux funcs
 // (sans systemd parts), but I note Linux DNS is disabled(?) so leaving for now.
 func (r *freebsdRouter) replaceResolvConf(_ []wgcfg.IP, _ []string) error { return nil }
@@ -5,20 +5,15 @@
 package wgengine
 
 import (
-	"bytes"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
 	"os/exec"
-	"path/filepath"
-	"strings"
 
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
 	"github.com/tailscale/wireguard-go/wgcfg"
-	"tailscale.com/atomicfile"
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/osdns"
 )
 
 type linuxRouter struct {
@@ -26,6 +21,7 @@ type linuxRouter struct {
 	tunname string
 	local   wgcfg.CIDR
 	routes  map[wgcfg.CIDR]struct{}
+	dns     osdns.Manager
 }
 
 func newUserspaceRouter(logf logger.Logf, _ *device.Device, tunDev tun.Device) (Router, error) {
@@ -37,6 +33,7 @@ func newUserspaceRouter(logf logger.Logf, _ *device.Device, tunDev tun.Device) (
 	return &linuxRouter{
 		logf:    logf,
 		tunname: tunname,
+		dns:     osdns.New(logf, tunname),
 	}, nil
 }
 
@@ -55,7 +52,7 @@ func (r *linuxRouter) Up() error {
 		log.Fatalf("running ip link failed: %v\n%s", err, out)
 	}
 
-	// TODO(apenwarr): This never cleans up after itself!
+	// Close deletes this rule, and cleanup any left behind by a crash.
 	out, err = cmd("iptables",
 		"-A", "FORWARD",
 		"-i", r.tunname,
@@ -111,19 +108,8 @@ func (r *linuxRouter) SetRoutes(rs RouteSettings) error {
 	}
 	for route := range r.routes {
 		if _, keep := newRoutes[route]; !keep {
-			net := route.IPNet()
-			nip := net.IP.Mask(net.Mask)
-			nstr := fmt.Sprintf("%v/%d", nip, route.Mask)
-			addrdel := []string{"ip", "route",
-				"del", nstr,
-				"via", r.local.IP.String(),
-				"dev", r.tunname}
-			out, err := cmd(addrdel...).CombinedOutput()
-			if err != nil {
-				r.logf("addr del failed: %v: %v\n%s", addrdel, err, out)
-				if errq == nil {
-					errq = err
-				}
+			if err := r.delRoute(route); err != nil && errq == nil {
+				errq = err
 			}
 		}
 	}
@@ -149,119 +135,97 @@ func (r *linuxRouter) SetRoutes(rs RouteSettings) error {
 	r.local = rs.LocalAddr
 	r.routes = newRoutes
 
-	// TODO: this:
-	if false {
-		if err := r.replaceResolvConf(rs.DNS, rs.DNSDomains); err != nil {
-			errq = fmt.Errorf("replacing resolv.conf failed: %v", err)
+	dns := osdns.Config{
+		Domains:           rs.DNSDomains,
+		MatchDomains:      rs.DNSMatchDomains,
+		RestrictedDomains: rs.DNSRestrictedDomains,
+	}
+	for _, ip := range rs.DNS {
+		dns.Nameservers = append(dns.Nameservers, ip.IP())
+	}
+	if err := r.dns.Set(dns); err != nil {
+		r.logf("setting DNS failed: %v", err)
+		if errq == nil {
+			errq = err
 		}
 	}
 	return errq
 }
 
+// delRoute deletes route, via r.local, from the routing table.
+func (r *linuxRouter) delRoute(route wgcfg.CIDR) error {
+	net := route.IPNet()
+	nip := net.IP.Mask(net.Mask)
+	nstr := fmt.Sprintf("%v/%d", nip, route.Mask)
+	addrdel := []string{"ip", "route",
+		"del", nstr,
+		"via", r.local.IP.String(),
+		"dev", r.tunname}
+	out, err := cmd(addrdel...).CombinedOutput()
+	if err != nil {
+		r.logf("addr del failed: %v: %v\n%s", addrdel, err, out)
+	}
+	return err
+}
+
+// Close undoes what Up and SetRoutes did: it removes the routes, the
+// interface's address and the iptables rules, and restores the
+// system's DNS settings. The interface itself goes away when the engine closes
+// the TUN device.
 func (r *linuxRouter) Close() error {
 	var ret error
-	if err := r.restoreResolvConf(); err != nil {
-		r.logf("failed to restore system resolv.conf: %v", err)
-		if ret == nil {
+	for route := range r.routes {
+		if err := r.delRoute(route); err != nil && ret == nil {
 			ret = err
 		}
 	}
-	// TODO(apenwarr): clean up iptables etc.
-	return ret
-}
-
-const (
-	tsConf     = "/etc/resolv.tailscale.conf"
-	backupConf = "/etc/resolv.pre-tailscale-backup.conf"
-	resolvConf = "/etc/resolv.conf"
-)
-
-func (r *linuxRouter) replaceResolvConf(servers []wgcfg.IP, domains []string) error {
-	if len(servers) == 0 {
-		return r.restoreResolvConf()
-	}
-
-	// First write the tsConf file.
-	buf := new(bytes.Buffer)
-	fmt.Fprintf(buf, "# resolv.conf(5) file generated by tailscale\n")
-	fmt.Fprintf(buf, "#     DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN\n\n")
-	for _, ns := range servers {
-		fmt.Fprintf(buf, "nameserver %s\n", ns)
-	}
-	if len(domains) > 0 {
-		fmt.Fprintf(buf, "search "+strings.Join(domains, " ")+"\n")
-	}
-	f, err := ioutil.TempFile(filepath.Dir(tsConf), filepath.Base(tsConf)+".*")
-	if err != nil {
-		return err
-	}
-	f.Close()
-	if err := atomicfile.WriteFile(f.Name(), buf.Bytes(), 0644); err != nil {
-		return err
-	}
-	os.Chmod(f.Name(), 0644) // ioutil.TempFile creates the file with 0600
-	if err := os.Rename(f.Name(), tsConf); err != nil {
-		return err
-	}
-
-	if linkPath, err := os.Readlink(resolvConf); err != nil {
-		// Remove any old backup that may exist.
-		os.Remove(backupConf)
-
-		// Backup the existing /etc/resolv.conf file.
-		contents, err := ioutil.ReadFile(resolvConf)
-		if os.IsNotExist(err) {
-			// No existing /etc/resolv.conf file to backup.
-			// Nothing to do.
-			return nil
-		} else if err != nil {
-			return err
-		}
-		if err := atomicfile.WriteFile(backupConf, contents, 0644); err != nil {
-			return err
+	r.routes = nil
+	if r.local != (wgcfg.CIDR{}) {
+		addrdel := []string{"ip", "addr", "del", r.local.String(), "dev", r.tunname}
+		if out, err := cmd(addrdel...).CombinedOutput(); err != nil {
+			r.logf("addr del failed: %v: %v\n%s", addrdel, err, out)
+			if ret == nil {
+				ret = err
+			}
 		}
-	} else if linkPath != tsConf {
-		// Backup the existing symlink.
-		os.Remove(backupConf)
-		if err := os.Symlink(linkPath, backupConf); err != nil {
-			return err
+		r.local = wgcfg.CIDR{}
+	}
+	// Up appended one of each rule.
+	for _, rule := range [][]string{
+		{"iptables", "-D", "FORWARD", "-i", r.tunname, "-j", "ACCEPT"},
+		{"iptables", "-t", "nat", "-D", "POSTROUTING", "-o", "eth0", "-j", "MASQUERADE"},
+	} {
+		if out, err := cmd(rule...).CombinedOutput(); err != nil {
+			r.logf("%v: %v\n%s", rule, err, out)
 		}
-	} else {
-		// Nothing to do, resolvConf already points to tsConf.
-		return nil
-	}
-
-	os.Remove(resolvConf)
-	if err := os.Symlink(tsConf, resolvConf); err != nil {
-		return nil
 	}
-
-	out, _ := exec.Command("service", "systemd-resolved", "restart").CombinedOutput()
-	if len(out) > 0 {
-		r.logf("service systemd-resolved restart: %s", out)
+	if err := r.dns.Close(); err != nil {
+		r.logf("failed to restore system DNS: %v", err)
+		if ret == nil {
+			ret = err
+		}
 	}
-	return nil
+	return ret
 }
 
-func (r *linuxRouter) restoreResolvConf() error {
-	if _, err := os.Stat(backupConf); err != nil {
-		if os.IsNotExist(err) {
-			return nil // no backup resolv.conf to restore
+func cleanup(logf logger.Logf, tunname string) {
+	// Deleting the interface deletes its addresses and routes.
+	if out, err := cmd("ip", "link", "del", tunname).CombinedOutput(); err != nil {
+		logf("ip link del %s: %v\n%s", tunname, err, out)
+	}
+	// Up appends its rules on every start, so a crash loop leaves
+	// several copies; delete each until none are left. The nat rule
+	// doesn't name the interface, so an identical one of the admin's
+	// own goes too, as it would on Close.
+	for _, rule := range [][]string{
+		{"iptables", "-D", "FORWARD", "-i", tunname, "-j", "ACCEPT"},
+		{"iptables", "-t", "nat", "-D", "POSTROUTING", "-o", "eth0", "-j", "MASQUERADE"},
+	} {
+		for i := 0; i < 100; i++ {
+			if err := cmd(rule...).Run(); err != nil {
+				break
+			}
 		}
-		return err
-	}
-	if ln, err := os.Readlink(resolvConf); err != nil {
-		return err
-	} else if ln != tsConf {
-		return fmt.Errorf("resolv.conf is not a symlink to %s", tsConf)
 	}
-	if err := os.Rename(backupConf, resolvConf); err != nil {
-		return err
-	}
-	os.Remove(tsConf) // best effort removal of tsConf file
-	out, _ := exec.Command("service", "systemd-resolved", "restart").CombinedOutput()
-	if len(out) > 0 {
-		r.logf("service systemd-resolved restart: %s", out)
-	}
-	return nil
+	osdns.Cleanup(logf, tunname)
 }
@@ -170,6 +170,17 @@ func (r *openbsdRouter) Close() error {
 	return nil
 }
 
+func cleanup(logf logger.Logf, tunname string) {
+	// Destroying the interface removes its addresses and routes.
+	if out, err := cmd("ifconfig", tunname, "destroy").CombinedOutput(); err != nil {
+		logf("ifconfig %s destroy: %v\n%s", tunname, err, out)
+	}
+	r := &openbsdRouter{logf: logf, tunname: tunname}
+	if err := r.restoreResolvConf(); err != nil {
+		logf("failed to restore system resolv.conf: %v", err)
+	}
+}
+
 const (
 	tsConf     = "/etc/resolv.tailscale.conf"
 	backupConf = "/etc/resolv.pre-tailscale-backup.conf"
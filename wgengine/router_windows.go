@@ -11,6 +11,7 @@ import (
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/osdns"
 )
 
 type winRouter struct {
@@ -19,6 +20,7 @@ type winRouter struct {
 	nativeTun           *tun.NativeTun
 	wgdev               *device.Device
 	routeChangeCallback *winipcfg.RouteChangeCallback
+	dns                 osdns.Manager
 }
 
 func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
@@ -31,6 +33,7 @@ func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Devic
 		wgdev:     wgdev,
 		tunname:   tunname,
 		nativeTun: tundev.(*tun.NativeTun),
+		dns:       osdns.New(logf, tunname),
 	}, nil
 }
 
@@ -46,11 +49,30 @@ func (r *winRouter) Up() error {
 }
 
 func (r *winRouter) SetRoutes(rs RouteSettings) error {
-	err := ConfigureInterface(rs.Cfg, r.nativeTun, rs.DNS, rs.DNSDomains)
+	dns := osdns.Config{
+		Domains:           rs.DNSDomains,
+		MatchDomains:      rs.DNSMatchDomains,
+		RestrictedDomains: rs.DNSRestrictedDomains,
+	}
+	for _, ip := range rs.DNS {
+		dns.Nameservers = append(dns.Nameservers, ip.IP())
+	}
+	ifaceDNS := rs.DNS
+	if len(rs.DNSMatchDomains) > 0 {
+		// The NRPT rule sends the matching names to the
+		// nameservers. Without them on the interface, other
+		// names resolve as they did before.
+		ifaceDNS = nil
+	}
+	err := ConfigureInterface(rs.Cfg, r.nativeTun, ifaceDNS, rs.DNSDomains)
 	if err != nil {
 		r.logf("ConfigureInterface: %v\n", err)
 		return err
 	}
+	if err := r.dns.Set(dns); err != nil {
+		r.logf("setting DNS: %v\n", err)
+		return err
+	}
 	return nil
 }
 
@@ -58,5 +80,12 @@ func (r *winRouter) Close() error {
 	if r.routeChangeCallback != nil {
 		r.routeChangeCallback.Unregister()
 	}
-	return nil
+	return r.dns.Close()
+}
+
+func cleanup(logf logger.Logf, tunname string) {
+	// Addresses, routes and DNS settings all live on the Wintun
+	// adapter, which is recreated on the next start, except for
+	// the NRPT rule, in the registry.
+	osdns.Cleanup(logf, tunname)
 }
@@ -0,0 +1,187 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// maxCacheEntries is how many responses the cache holds; the
+	// least recently used goes first.
+	maxCacheEntries = 1000
+
+	// maxCacheTTL and maxNegativeTTL bound how long answers, and
+	// answers that there's no such name or record, are cached,
+	// whatever their TTLs.
+	maxCacheTTL    = time.Hour
+	maxNegativeTTL = 5 * time.Minute
+)
+
+// cache holds the responses of upstream nameservers for their TTLs.
+// Its zero value is not usable; use newCache.
+type cache struct {
+	now func() time.Time // time.Now, except in tests
+
+	mu  sync.Mutex
+	lru *lru.Cache // of cacheKey to *cacheEntry
+	gen int        // incremented by flush
+}
+
+// cacheKey is the question a cached response answers.
+type cacheKey struct {
+	name  string // canonical
+	typ   dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type cacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+func newCache() *cache {
+	return &cache{
+		now: time.Now,
+		lru: lru.New(maxCacheEntries),
+	}
+}
+
+// get returns the response to the query with header h and question
+// q, if one is cached, with its TTLs reduced by the time it's been
+// cached and capped at the time it has left. It also returns the
+// cache's generation, for putting the response once it's been
+// forwarded.
+func (c *cache) get(h dnsmessage.Header, q dnsmessage.Question) (resp []byte, gen int) {
+	key := cacheKey{canonName(q.Name.String()), q.Type, q.Class}
+	now := c.now()
+	c.mu.Lock()
+	gen = c.gen
+	v, ok := c.lru.Get(key)
+	if !ok {
+		c.mu.Unlock()
+		return nil, gen
+	}
+	e := v.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.lru.Remove(key)
+		c.mu.Unlock()
+		return nil, gen
+	}
+	c.mu.Unlock()
+
+	age := uint32(now.Sub(e.stored) / time.Second)
+	left := uint32(e.expires.Sub(now) / time.Second)
+	m := e.msg
+	m.Header.ID = h.ID
+	m.Header.RecursionDesired = h.RecursionDesired
+	m.Questions = []dnsmessage.Question{q} // with the query's own case
+	m.Answers = aged(m.Answers, age, left)
+	m.Authorities = aged(m.Authorities, age, left)
+	m.Additionals = aged(m.Additionals, age, left)
+	resp, err := m.Pack()
+	if err != nil {
+		return nil, gen
+	}
+	return resp, gen
+}
+
+// aged returns a copy of rrs with their TTLs reduced by age seconds,
+// and at most max.
+func aged(rrs []dnsmessage.Resource, age, max uint32) []dnsmessage.Resource {
+	ret := make([]dnsmessage.Resource, len(rrs))
+	for i, rr := range rrs {
+		if rr.Header.Type != dnsmessage.TypeOPT { // whose TTL isn't one
+			if rr.Header.TTL > age {
+				rr.Header.TTL -= age
+			} else {
+				rr.Header.TTL = 0
+			}
+			if rr.Header.TTL > max {
+				rr.Header.TTL = max
+			}
+		}
+		ret[i] = rr
+	}
+	return ret
+}
+
+// put caches resp, an upstream nameserver's response, if it can be
+// and the cache hasn't been flushed since generation gen, when the
+// query was sent.
+func (c *cache) put(gen int, resp []byte) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return
+	}
+	if m.Header.Truncated || len(m.Questions) != 1 {
+		return
+	}
+	ttl := cacheTTL(&m)
+	if ttl <= 0 {
+		return
+	}
+	q := m.Questions[0]
+	key := cacheKey{canonName(q.Name.String()), q.Type, q.Class}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	c.lru.Add(key, &cacheEntry{msg: m, stored: now, expires: now.Add(ttl)})
+}
+
+// flush empties the cache.
+func (c *cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Clear()
+	c.gen++
+}
+
+// cacheTTL returns how long m may be cached: the least TTL of its
+// answers, or, if it says there's no such name or record, the time
+// its SOA gives for that (RFC 2308). Other responses, such as
+// failures, aren't cached, and get zero.
+func cacheTTL(m *dnsmessage.Message) time.Duration {
+	switch m.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+		if len(m.Answers) > 0 {
+			ttl := m.Answers[0].Header.TTL
+			for _, a := range m.Answers[1:] {
+				if a.Header.TTL < ttl {
+					ttl = a.Header.TTL
+				}
+			}
+			return minDuration(time.Duration(ttl)*time.Second, maxCacheTTL)
+		}
+	case dnsmessage.RCodeNameError:
+	default:
+		return 0
+	}
+	for _, a := range m.Authorities {
+		if soa, ok := a.Body.(*dnsmessage.SOAResource); ok {
+			ttl := a.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return minDuration(time.Duration(ttl)*time.Second, maxNegativeTTL)
+		}
+	}
+	return 0
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// upstreamResponse returns a nameserver's response to query, with
+// rcode, an A record with ttl if it's a success and ttl is non-zero,
+// and an SOA with negTTL if there's no A record and negTTL is
+// non-zero.
+func upstreamResponse(t *testing.T, query []byte, rcode dnsmessage.RCode, ttl, negTTL uint32) []byte {
+	t.Helper()
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RCode: rcode})
+	b.StartQuestions()
+	b.Question(q)
+	if rcode == dnsmessage.RCodeSuccess && ttl > 0 {
+		b.StartAnswers()
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl}
+		b.AResource(rh, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	} else if negTTL > 0 {
+		b.StartAuthorities()
+		rh := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600}
+		b.SOAResource(rh, dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.example.com."),
+			MBox:   dnsmessage.MustNewName("admin.example.com."),
+			MinTTL: negTTL,
+		})
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestCache(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	r := New(t.Logf)
+	r.cache.now = func() time.Time { return now }
+	forwarded := 0
+	r.forward = func(ctx context.Context, addr string, q []byte) ([]byte, error) {
+		forwarded++
+		var p dnsmessage.Parser
+		p.Start(q)
+		qq, _ := p.Question()
+		switch qq.Name.String() {
+		case "www.example.com.":
+			return upstreamResponse(t, q, dnsmessage.RCodeSuccess, 300, 0), nil
+		case "gone.example.com.":
+			return upstreamResponse(t, q, dnsmessage.RCodeNameError, 0, 60), nil
+		case "nosoa.example.com.":
+			return upstreamResponse(t, q, dnsmessage.RCodeNameError, 0, 0), nil
+		}
+		return upstreamResponse(t, q, dnsmessage.RCodeServerFailure, 0, 0), nil
+	}
+	r.SetConfig(Config{Nameservers: []string{"10.0.0.1"}})
+
+	// resolve resolves name, and reports whether it was forwarded and
+	// the TTL of its answer or SOA.
+	resolve := func(name string) (wasForwarded bool, ttl uint32) {
+		t.Helper()
+		before := forwarded
+		resp, err := r.Resolve(context.Background(), query(t, name, dnsmessage.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(resp); err != nil {
+			t.Fatal(err)
+		}
+		if m.Header.ID != 1234 || len(m.Questions) != 1 || m.Questions[0].Name.String() != name {
+			t.Errorf("%s: response %+v doesn't match the query", name, m)
+		}
+		for _, rr := range append(m.Answers, m.Authorities...) {
+			ttl = rr.Header.TTL
+		}
+		return forwarded > before, ttl
+	}
+
+	tests := []struct {
+		advance   time.Duration
+		name      string
+		forwarded bool
+		ttl       uint32
+	}{
+		{0, "www.example.com.", true, 300},
+		{100 * time.Second, "WWW.example.com.", false, 200},
+		{200 * time.Second, "www.example.com.", true, 300},
+		{0, "gone.example.com.", true, 3600},
+		{20 * time.Second, "gone.example.com.", false, 40},
+		{40 * time.Second, "gone.example.com.", true, 3600},
+		{0, "nosoa.example.com.", true, 0},
+		{0, "nosoa.example.com.", true, 0},
+		{0, "broken.example.com.", true, 0},
+		{0, "broken.example.com.", true, 0},
+	}
+	for i, tt := range tests {
+		now = now.Add(tt.advance)
+		fwd, ttl := resolve(tt.name)
+		if fwd != tt.forwarded || ttl != tt.ttl {
+			t.Errorf("%d. %s: forwarded %v with TTL %d; want %v with TTL %d", i, tt.name, fwd, ttl, tt.forwarded, tt.ttl)
+		}
+	}
+
+	// The same config again, as with every netmap, keeps the cache;
+	// new nameservers flush it.
+	r.SetConfig(Config{Nameservers: []string{"10.0.0.1"}})
+	if fwd, _ := resolve("www.example.com."); fwd {
+		t.Errorf("unchanged config flushed the cache")
+	}
+	r.SetConfig(Config{Nameservers: []string{"10.0.0.2"}})
+	if fwd, _ := resolve("www.example.com."); !fwd {
+		t.Errorf("cached answer survived new nameservers")
+	}
+}
+
+func TestCacheLimits(t *testing.T) {
+	c := newCache()
+	for i := 0; i < maxCacheEntries+1; i++ {
+		q := query(t, fmt.Sprintf("host%d.example.com.", i), dnsmessage.TypeA)
+		c.put(0, upstreamResponse(t, q, dnsmessage.RCodeSuccess, 300, 0))
+	}
+	if n := c.lru.Len(); n != maxCacheEntries {
+		t.Errorf("cache holds %d entries, want %d", n, maxCacheEntries)
+	}
+	h := dnsmessage.Header{ID: 1}
+	oldest := dnsmessage.Question{Name: dnsmessage.MustNewName("host0.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	if resp, _ := c.get(h, oldest); resp != nil {
+		t.Errorf("least recently used entry not evicted")
+	}
+
+	// Long TTLs are capped, and responses to flushed generations
+	// aren't cached.
+	q := query(t, "long.example.com.", dnsmessage.TypeA)
+	var m dnsmessage.Message
+	m.Unpack(upstreamResponse(t, q, dnsmessage.RCodeSuccess, 86400, 0))
+	if got := cacheTTL(&m); got != maxCacheTTL {
+		t.Errorf("cacheTTL = %v, want %v", got, maxCacheTTL)
+	}
+	c.flush()
+	c.put(0, upstreamResponse(t, q, dnsmessage.RCodeSuccess, 300, 0))
+	long := dnsmessage.Question{Name: dnsmessage.MustNewName("long.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	if resp, gen := c.get(h, long); resp != nil || gen != 1 {
+		t.Errorf("get = %x, generation %d; want nothing, generation 1", resp, gen)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// maxMessageSize is the largest DNS message, the limit of both UDP
+// and the TCP length prefix.
+const maxMessageSize = 65535
+
+// exchange sends query to the nameserver at addr over UDP, and
+// returns its response. If the response is truncated, the query is
+// sent again over TCP, which has room for the whole response.
+func exchange(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("short query")
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	setDeadline(ctx, c)
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := buf[:n]
+		// Skip stray responses, such as late ones to an earlier
+		// query that was on the same port.
+		if n < 12 || resp[0] != query[0] || resp[1] != query[1] {
+			continue
+		}
+		if resp[2]&0x02 != 0 { // TC: truncated
+			return exchangeTCP(ctx, addr, query)
+		}
+		return append([]byte(nil), resp...), nil
+	}
+}
+
+// exchangeTCP is exchange over TCP.
+func exchangeTCP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	setDeadline(ctx, c)
+	return exchangeStream(c, query)
+}
+
+// exchangeStream sends query on c, a stream connection to a
+// nameserver, with its two-byte length prefix, and returns the
+// response.
+func exchangeStream(c io.ReadWriter, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := c.Write(msg); err != nil {
+		return nil, err
+	}
+	var n [2]byte
+	if _, err := io.ReadFull(c, n[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// setDeadline sets c's deadline to ctx's, if it has one.
+func setDeadline(ctx context.Context, c net.Conn) {
+	if t, ok := ctx.Deadline(); ok {
+		c.SetDeadline(t)
+	} else {
+		c.SetDeadline(time.Now().Add(forwardTimeout))
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"context"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolveForPeer answers query for another node of the tailnet, which
+// sends its DNS through this one, its exit node, so that its queries
+// leave from where its traffic does. The query goes to this node's
+// default nameservers, or the system's, as Resolve sends names with no
+// route: the peer resolves its own tailnet's names, and this node's
+// routes, and its cache of their answers, are for this node alone.
+// Names under this node's restricted domains, and the reverse names
+// of tailnet addresses, get "no such name".
+func (r *Resolver) resolveForPeer(ctx context.Context, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil, errNotQuery
+	}
+	q, err := p.Question()
+	if err != nil {
+		return response(h, nil, dnsmessage.RCodeFormatError, nil)
+	}
+	if h.OpCode != 0 {
+		return response(h, &q, dnsmessage.RCodeNotImplemented, nil)
+	}
+	name := canonName(q.Name.String())
+
+	r.mu.Lock()
+	private := r.restrictedLocked(name)
+	for _, d := range r.local {
+		private = private || under(name, d)
+	}
+	nameservers := r.defaults
+	r.mu.Unlock()
+	if ip, ok := parseReverse(name); ok && inTailnetRanges(ip) {
+		private = true
+	}
+	if private {
+		return response(h, &q, dnsmessage.RCodeNameError, nil)
+	}
+
+	if len(nameservers) == 0 {
+		nameservers = r.systemNameservers()
+	}
+	if resp, ok := r.forwardTo(ctx, nameservers, q, name, query); ok {
+		return resp, nil
+	}
+	return response(h, &q, dnsmessage.RCodeServerFailure, nil)
+}
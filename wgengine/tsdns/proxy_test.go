@@ -0,0 +1,90 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolveForPeer(t *testing.T) {
+	r := New(t.Logf)
+	var forwardedTo []string
+	r.forward = func(ctx context.Context, addr string, q []byte) ([]byte, error) {
+		forwardedTo = append(forwardedTo, addr)
+		return upstreamResponse(t, q, dnsmessage.RCodeSuccess, 300, 0), nil
+	}
+	r.system = func() []string { return []string{"192.168.1.1:53"} }
+	r.SetConfig(Config{
+		Hosts: map[string][]net.IP{
+			"exit.example.beta.tailscale.net": {net.ParseIP("100.64.0.1")},
+		},
+		LocalDomains:      []string{"example.beta.tailscale.net"},
+		Routes:            map[string][]string{"corp.example.com": {"10.0.0.1"}, "lab.example.com": {"10.0.0.2"}},
+		RestrictedDomains: []string{"corp.example.com"},
+		ServePeers:        true,
+	})
+
+	tests := []struct {
+		name      string
+		rcode     dnsmessage.RCode
+		forwarded []string
+	}{
+		{"www.example.com.", dnsmessage.RCodeSuccess, []string{"192.168.1.1:53"}},
+		{"wiki.lab.example.com.", dnsmessage.RCodeSuccess, []string{"192.168.1.1:53"}},
+		{"wiki.corp.example.com.", dnsmessage.RCodeNameError, nil},
+		{"exit.example.beta.tailscale.net.", dnsmessage.RCodeNameError, nil},
+		{"1.0.64.100.in-addr.arpa.", dnsmessage.RCodeNameError, nil},
+	}
+	for _, tt := range tests {
+		forwardedTo = nil
+		resp, err := r.resolveForPeer(context.Background(), query(t, tt.name, dnsmessage.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(resp); err != nil {
+			t.Fatal(err)
+		}
+		if m.Header.RCode != tt.rcode || !reflect.DeepEqual(forwardedTo, tt.forwarded) {
+			t.Errorf("%s = %v, forwarded to %v; want %v, forwarded to %v", tt.name, m.Header.RCode, forwardedTo, tt.rcode, tt.forwarded)
+		}
+	}
+}
+
+func TestResolverFor(t *testing.T) {
+	r := New(t.Logf)
+	self := net.ParseIP("100.64.0.1")
+	tests := []struct {
+		src        string
+		servePeers bool
+		want       string // "self", "peer" or ""
+	}{
+		{"100.64.0.1", false, "self"},
+		{"127.0.0.1", false, "self"},
+		{"100.64.0.2", false, ""},
+		{"100.64.0.2", true, "peer"},
+		{"fd7a:115c:a1e0::2", true, "peer"},
+		{"192.168.1.2", true, ""},
+	}
+	for _, tt := range tests {
+		r.SetConfig(Config{ServePeers: tt.servePeers})
+		got := ""
+		switch f := r.resolverFor(net.ParseIP(tt.src), self); {
+		case f == nil:
+		case reflect.ValueOf(f).Pointer() == reflect.ValueOf(r.Resolve).Pointer():
+			got = "self"
+		default:
+			got = "peer"
+		}
+		if got != tt.want {
+			t.Errorf("resolverFor(%s), ServePeers=%v: %q, want %q", tt.src, tt.servePeers, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// tailnetRanges are the addresses control hands out to nodes, whose
+// reverse names the resolver answers itself.
+var tailnetRanges = func() []*net.IPNet {
+	var ret []*net.IPNet
+	for _, s := range []string{"100.64.0.0/10", "fd7a:115c:a1e0::/48"} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}()
+
+// reverseZones are the in-addr.arpa and ip6.arpa domains of
+// tailnetRanges, which the OS sends the resolver with split DNS.
+var reverseZones = func() []string {
+	var ret []string
+	// 100.64.0.0/10 is 100.64.x.x through 100.127.x.x.
+	for i := 64; i < 128; i++ {
+		ret = append(ret, strconv.Itoa(i)+".100.in-addr.arpa")
+	}
+	return append(ret, "0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa")
+}()
+
+// inTailnetRanges reports whether ip is a tailnet address.
+func inTailnetRanges(ip net.IP) bool {
+	for _, n := range tailnetRanges {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReverse returns the IP whose reverse name is name, canonical,
+// such as "4.3.2.1.in-addr.arpa" for 1.2.3.4. It reports false if
+// name isn't a complete reverse name.
+func parseReverse(name string) (net.IP, bool) {
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != net.IPv4len {
+			return nil, false
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, l := range labels {
+			b, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return nil, false
+			}
+			ip[net.IPv4len-1-i] = byte(b)
+		}
+		return ip, true
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil, false
+		}
+		var nibbles strings.Builder
+		for i := len(labels) - 1; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return nil, false
+			}
+			nibbles.WriteString(labels[i])
+		}
+		ip, err := hex.DecodeString(nibbles.String())
+		if err != nil {
+			return nil, false
+		}
+		return net.IP(ip), true
+	}
+	return nil, false
+}
+
+// ptrResponse returns the response to the query with header h and
+// question q, for a reverse name, naming target if q is a PTR
+// question.
+func ptrResponse(h dnsmessage.Header, q *dnsmessage.Question, target string) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		Authoritative:      true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(*q); err != nil {
+		return nil, err
+	}
+	if q.Type != dnsmessage.TypePTR {
+		return b.Finish()
+	}
+	name, err := dnsmessage.NewName(target + ".")
+	if err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: localTTL}
+	if err := b.PTRResource(rh, dnsmessage.PTRResource{PTR: name}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
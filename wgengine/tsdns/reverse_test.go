@@ -0,0 +1,105 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseReverse(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // empty if not a reverse name
+	}{
+		{"4.3.2.1.in-addr.arpa", "1.2.3.4"},
+		{"3.102.101.100.in-addr.arpa", "100.101.102.3"},
+		{"3.2.1.in-addr.arpa", ""},
+		{"300.2.1.100.in-addr.arpa", ""},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa", "fd7a:115c:a1e0::1"},
+		{"0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa", ""},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.g.ip6.arpa", ""},
+		{"example.com", ""},
+	}
+	for _, tt := range tests {
+		ip, ok := parseReverse(tt.name)
+		got := ""
+		if ok {
+			got = ip.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseReverse(%q) = %q, %v; want %q", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestResolvePTR(t *testing.T) {
+	r := New(t.Logf)
+	forwarded := 0
+	r.forward = func(ctx context.Context, addr string, q []byte) ([]byte, error) {
+		forwarded++
+		return upstreamResponse(t, q, dnsmessage.RCodeNameError, 0, 0), nil
+	}
+	r.SetConfig(Config{
+		Hosts: map[string][]net.IP{
+			"alpha.example.beta.tailscale.net.": {net.ParseIP("100.101.102.103"), net.ParseIP("fd7a:115c:a1e0::1")},
+			"a.example.beta.tailscale.net":      {net.ParseIP("100.101.102.103")},
+			"lan.example.beta.tailscale.net":    {net.ParseIP("192.168.1.2")},
+		},
+		Nameservers: []string{"10.0.0.1"},
+	})
+
+	tests := []struct {
+		name      string
+		typ       dnsmessage.Type
+		rcode     dnsmessage.RCode
+		ptr       string
+		forwarded bool
+	}{
+		{"103.102.101.100.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, "a.example.beta.tailscale.net.", false},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, "alpha.example.beta.tailscale.net.", false},
+		{"103.102.101.100.in-addr.arpa.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, "", false},
+		{"1.1.64.100.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, "", false},
+		{"2.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, "", true},
+	}
+	for _, tt := range tests {
+		before := forwarded
+		resp, err := r.Resolve(context.Background(), query(t, tt.name, tt.typ))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(resp); err != nil {
+			t.Fatal(err)
+		}
+		ptr := ""
+		for _, a := range m.Answers {
+			if p, ok := a.Body.(*dnsmessage.PTRResource); ok {
+				ptr = p.PTR.String()
+			}
+		}
+		if m.Header.RCode != tt.rcode || ptr != tt.ptr || (forwarded > before) != tt.forwarded {
+			t.Errorf("%s %v = %v %q, forwarded %v; want %v %q, forwarded %v",
+				tt.name, tt.typ, m.Header.RCode, ptr, forwarded > before, tt.rcode, tt.ptr, tt.forwarded)
+		}
+	}
+
+	cfg := Config{
+		Hosts:        map[string][]net.IP{"a.example.com": {net.ParseIP("100.64.0.1")}},
+		LocalDomains: []string{"example.com"},
+	}
+	if n := len(cfg.MatchDomains()); n != 1+len(reverseZones) || len(reverseZones) != 65 {
+		t.Errorf("MatchDomains has %d domains, want example.com and the %d reverse zones", n, len(reverseZones))
+	}
+	// With no domains of its own, the resolver gets all names, not
+	// just the reverse ones.
+	cfg.LocalDomains = nil
+	if got := cfg.MatchDomains(); len(got) != 0 {
+		t.Errorf("without domains, MatchDomains = %q, want all names", got)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// queryTimeout bounds how long the answer to one query may take.
+const queryTimeout = 5 * time.Second
+
+// Listen starts answering queries sent to UDP port 53 at ip, this
+// node's Tailscale address, where the OS is told its DNS server is.
+// Only queries from this machine are answered, unless the Config has
+// ServePeers; the port isn't otherwise a resolver for the tailnet's
+// other nodes. If the resolver was listening at another address, it
+// stops. Listening at the same address again does nothing.
+func (r *Resolver) Listen(ip net.IP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pc != nil && r.self.Equal(ip) {
+		return nil
+	}
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(ip.String(), "53"))
+	if err != nil {
+		return err
+	}
+	if r.pc != nil {
+		r.pc.Close()
+	}
+	r.pc, r.self = pc, ip
+	go r.serve(pc, ip)
+	return nil
+}
+
+// Close stops the resolver listening, if it was, and closes its idle
+// connections to nameservers.
+func (r *Resolver) Close() error {
+	r.up.close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pc == nil {
+		return nil
+	}
+	err := r.pc.Close()
+	r.pc, r.self = nil, nil
+	return err
+}
+
+// serve answers the queries that arrive on pc, bound to self, until
+// it's closed.
+func (r *Resolver) serve(pc net.PacketConn, self net.IP) {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return // closed
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		resolve := r.resolverFor(ua.IP, self)
+		if resolve == nil {
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+			defer cancel()
+			resp, err := resolve(ctx, query)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(resp, addr)
+		}()
+	}
+}
+
+// resolverFor returns how to answer a query from src to the resolver
+// at self: with Resolve for this machine, with resolveForPeer for the
+// tailnet's other nodes if the resolver serves them, and not at all,
+// nil, otherwise.
+func (r *Resolver) resolverFor(src, self net.IP) func(ctx context.Context, query []byte) ([]byte, error) {
+	if src.Equal(self) || src.IsLoopback() {
+		return r.Resolve
+	}
+	r.mu.Lock()
+	peers := r.peers
+	r.mu.Unlock()
+	if peers && inTailnetRanges(src) {
+		return r.resolveForPeer
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// parseResolvConf returns the nameservers in the resolv.conf(5) file
+// r, as "ip:port" addresses.
+func parseResolvConf(r io.Reader) []string {
+	var ns []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) >= 2 && f[0] == "nameserver" {
+			ns = append(ns, f[1])
+		}
+	}
+	return nameserverAddrs(ns)
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package tsdns
+
+import "os"
+
+// resolvConfs are where the system's nameservers are found, in order.
+// When tailscaled replaces /etc/resolv.conf, it keeps the system's own
+// in the backup, as named by osdns. With systemd-resolved,
+// /etc/resolv.conf lists only resolved itself, which would send the
+// queries back, and the nameservers it uses are in its own file.
+var resolvConfs = []string{
+	"/etc/resolv.pre-tailscale-backup.conf",
+	"/run/systemd/resolve/resolv.conf",
+	"/etc/resolv.conf",
+}
+
+// systemNameservers returns the nameservers the system had before
+// tailscaled changed them.
+func systemNameservers() []string {
+	for _, path := range resolvConfs {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		ns := parseResolvConf(f)
+		f.Close()
+		return ns
+	}
+	return nil
+}
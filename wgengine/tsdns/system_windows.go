@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// interfaceKeys hold the per-interface TCP/IP settings, whose values
+// include each interface's nameservers.
+var interfaceKeys = []string{
+	`SYSTEM\CurrentControlSet\Services\Tcpip\Parameters\Interfaces`,
+	`SYSTEM\CurrentControlSet\Services\Tcpip6\Parameters\Interfaces`,
+}
+
+// systemNameservers returns the nameservers of the system's
+// interfaces: each one's static NameServer if it has one, and its
+// DhcpNameServer otherwise. tailscaled only sets those of its own
+// interface, which is the resolver itself.
+func systemNameservers() []string {
+	var ns []string
+	for _, path := range interfaceKeys {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.READ)
+		if err != nil {
+			continue
+		}
+		ifaces, _ := k.ReadSubKeyNames(-1)
+		k.Close()
+		for _, iface := range ifaces {
+			ik, err := registry.OpenKey(registry.LOCAL_MACHINE, path+`\`+iface, registry.READ)
+			if err != nil {
+				continue
+			}
+			v, _, _ := ik.GetStringValue("NameServer")
+			if v == "" {
+				v, _, _ = ik.GetStringValue("DhcpNameServer")
+			}
+			ik.Close()
+			ns = append(ns, strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })...)
+		}
+	}
+	return nameserverAddrs(ns)
+}
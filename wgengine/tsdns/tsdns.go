@@ -0,0 +1,518 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tsdns is tailscaled's DNS resolver. It answers the names of
+// the tailnet's nodes itself, from the network map, and forwards other
+// queries upstream: queries under a routed domain to that domain's
+// nameservers, such as a company's internal ones reached over the
+// tailnet, and everything else to the default nameservers.
+package tsdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/logger"
+)
+
+// Config is the configuration of a Resolver.
+//
+// Names and domains are compared case-insensitively, and may have a
+// trailing dot or not. Nameservers are IP addresses, with an optional
+// port that defaults to 53, or DoH or DoT servers; see upstreamAddr.
+type Config struct {
+	// Hosts are the names the resolver answers itself, such as the
+	// tailnet's nodes, with their addresses. The reverse names of
+	// their tailnet addresses are answered too.
+	Hosts map[string][]net.IP
+
+	// LocalDomains are the domains whose names are all in Hosts.
+	// Queries for other names under them get a "no such name"
+	// answer rather than being forwarded.
+	LocalDomains []string
+
+	// Routes maps domains to the nameservers that answer for names
+	// under them. A name under several routed domains uses the most
+	// specific.
+	Routes map[string][]string
+
+	// Nameservers are the nameservers for the names that no route
+	// covers. If empty, the system's own nameservers, as they were
+	// before tailscaled changed them, are used.
+	Nameservers []string
+
+	// SearchDomains are the domains single-label names are tried
+	// under, in order, before being resolved as they are.
+	SearchDomains []string
+
+	// RestrictedDomains are domains, normally among Routes, whose
+	// names must only ever go to their routes' nameservers. When
+	// those fail, the answer is "no such name", not a failure that
+	// would send the OS to its other nameservers; and DoH or DoT
+	// hosts under them aren't looked up with the system's
+	// nameservers. A restricted domain without a route resolves
+	// nothing.
+	RestrictedDomains []string
+
+	// ServePeers makes the resolver a DNS proxy for the tailnet's
+	// other nodes, as exit nodes are, answering their queries too;
+	// see resolveForPeer.
+	ServePeers bool
+}
+
+// MatchDomains returns the domains whose names the OS needs to send
+// to a resolver with configuration c: none, meaning all names, if c
+// has its own default nameservers; otherwise just the local and
+// routed domains, and the tailnet's reverse zones if there are
+// Hosts, leaving other names to the system's nameservers. A c with
+// none of those domains gets all names too, reverse zones included.
+func (c Config) MatchDomains() []string {
+	if len(c.Nameservers) > 0 {
+		return nil
+	}
+	domains := append([]string(nil), c.LocalDomains...)
+	for d := range c.Routes {
+		domains = append(domains, d)
+	}
+	for _, d := range c.RestrictedDomains {
+		if _, ok := c.Routes[d]; !ok {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) > 0 && len(c.Hosts) > 0 {
+		domains = append(domains, reverseZones...)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// localTTL is the TTL of the answers the resolver makes itself.
+const localTTL = 600
+
+// forwardTimeout bounds how long a query waits for each nameserver
+// before the next is tried.
+const forwardTimeout = 2 * time.Second
+
+// Resolver is a DNS resolver configured with a Config. The zero
+// value is not usable; use New.
+type Resolver struct {
+	logf logger.Logf
+
+	// forward sends query to the nameserver at addr, as from
+	// upstreamAddr, and returns its response. It's up.exchange,
+	// except in tests.
+	forward func(ctx context.Context, addr string, query []byte) ([]byte, error)
+	up      *upstreams
+
+	// system returns the system's nameservers; see Config.Nameservers.
+	system func() []string
+
+	// cache holds upstream responses. It's flushed with each new
+	// Config, which may route names differently.
+	cache *cache
+
+	mu       sync.Mutex
+	hosts    map[string][]net.IP
+	ptrs     map[string]string // tailnet IP to the host with it
+	local    []string
+	routes   []route // most specific first
+	defaults []string
+	search   []string
+	restrict []string
+	peers    bool           // ServePeers
+	pc       net.PacketConn // what Listen listens on, or nil
+	self     net.IP         // the address pc is bound to
+
+	lastSystem []string // last non-empty systemNameservers
+}
+
+// route is a domain and the nameservers that answer for it.
+type route struct {
+	domain      string
+	nameservers []string
+}
+
+// New returns a Resolver with an empty Config, which forwards all
+// queries to the system's nameservers.
+func New(logf logger.Logf) *Resolver {
+	r := &Resolver{
+		logf:   logf,
+		system: systemNameservers,
+		cache:  newCache(),
+	}
+	r.up = &upstreams{
+		logf:      logf,
+		bootstrap: r.systemNameservers,
+		private:   r.restricted,
+		plain:     exchange,
+	}
+	r.forward = r.up.exchange
+	return r
+}
+
+// systemNameservers returns the system's nameservers, other than the
+// resolver itself. Some DNS managers, once told to, list only the
+// resolver; then the last nameservers seen before are used.
+func (r *Resolver) systemNameservers() []string {
+	r.mu.Lock()
+	self := r.self
+	r.mu.Unlock()
+	ns := withoutSelf(r.system(), self)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(ns) > 0 {
+		r.lastSystem = ns
+	}
+	return r.lastSystem
+}
+
+// SetConfig replaces the resolver's configuration. If the new one
+// sends names anywhere else than the old one did, the upstream answers
+// cached under the old one are forgotten. Queries already being
+// answered finish with the old one.
+func (r *Resolver) SetConfig(cfg Config) {
+	hosts := make(map[string][]net.IP, len(cfg.Hosts))
+	ptrs := make(map[string]string)
+	for name, ips := range cfg.Hosts {
+		name = canonName(name)
+		hosts[name] = ips
+		for _, ip := range ips {
+			if !inTailnetRanges(ip) {
+				continue
+			}
+			// Of several names for an IP, the same one every
+			// time: the shortest, then the first.
+			k := ip.String()
+			if old, ok := ptrs[k]; !ok || len(name) < len(old) || len(name) == len(old) && name < old {
+				ptrs[k] = name
+			}
+		}
+	}
+	var local []string
+	for _, d := range cfg.LocalDomains {
+		local = append(local, canonName(d))
+	}
+	var routes []route
+	routed := make(map[string]bool)
+	for d, ns := range cfg.Routes {
+		routes = append(routes, route{canonName(d), nameserverAddrs(ns)})
+		routed[canonName(d)] = true
+	}
+	var restrict []string
+	for _, d := range cfg.RestrictedDomains {
+		d = canonName(d)
+		restrict = append(restrict, d)
+		if !routed[d] {
+			r.logf("tsdns: restricted domain %q has no route", d)
+			routes = append(routes, route{domain: d})
+			routed[d] = true
+		}
+	}
+	// A longer domain is more specific than any domain it's under.
+	sort.Slice(routes, func(i, j int) bool {
+		if len(routes[i].domain) != len(routes[j].domain) {
+			return len(routes[i].domain) > len(routes[j].domain)
+		}
+		return routes[i].domain < routes[j].domain
+	})
+
+	defaults := nameserverAddrs(cfg.Nameservers)
+
+	r.mu.Lock()
+	// Control sends the DNS config with every netmap, mostly
+	// unchanged.
+	changed := !reflect.DeepEqual(hosts, r.hosts) ||
+		!reflect.DeepEqual(local, r.local) ||
+		!reflect.DeepEqual(routes, r.routes) ||
+		!reflect.DeepEqual(restrict, r.restrict) ||
+		!reflect.DeepEqual(defaults, r.defaults)
+	r.hosts, r.ptrs, r.local, r.routes = hosts, ptrs, local, routes
+	r.restrict = restrict
+	r.peers = cfg.ServePeers
+	r.defaults = defaults
+	r.search = nil
+	for _, d := range cfg.SearchDomains {
+		if d := canonName(d); d != "" {
+			r.search = append(r.search, d)
+		}
+	}
+	listening := r.pc != nil
+	r.mu.Unlock()
+	if changed {
+		r.cache.flush()
+	}
+
+	if !listening {
+		// Note the system's nameservers while they're still
+		// its own, before the OS is pointed at the resolver.
+		r.systemNameservers()
+	}
+}
+
+// canonName returns name in lowercase, without a trailing dot.
+func canonName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// under reports whether name is domain or a name under it. Both must
+// be canonical.
+func under(name, domain string) bool {
+	return name == domain || domain == "" || strings.HasSuffix(name, "."+domain)
+}
+
+// nameserverAddrs returns the nameservers ns in canonical form, as
+// from upstreamAddr, skipping any that aren't valid.
+func nameserverAddrs(ns []string) []string {
+	var addrs []string
+	for _, s := range ns {
+		if addr, ok := upstreamAddr(s); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// withoutSelf returns the nameservers addrs without those at IP self,
+// which, in the system's config, are this resolver itself.
+func withoutSelf(addrs []string, self net.IP) []string {
+	var ret []string
+	for _, a := range addrs {
+		host, _, _ := net.SplitHostPort(a) // system ones are plain
+
+		if self == nil || !self.Equal(net.ParseIP(host)) {
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
+
+// errNotQuery is returned by Resolve for messages that aren't DNS
+// queries at all, which get no response.
+var errNotQuery = errors.New("not a DNS query")
+
+// Resolve answers the DNS query, a DNS message as sent over UDP, and
+// returns the response to send back. A single-label name is tried
+// under each search domain in turn, and answered as an alias of the
+// first name found, before it's resolved as it is. Failures to
+// resolve are reported in the response, with a SERVFAIL; the error
+// is only for messages that don't deserve a response.
+func (r *Resolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil, errNotQuery
+	}
+	q, err := p.Question()
+	if err != nil {
+		return response(h, nil, dnsmessage.RCodeFormatError, nil)
+	}
+	if h.OpCode != 0 {
+		return response(h, &q, dnsmessage.RCodeNotImplemented, nil)
+	}
+	name := canonName(q.Name.String())
+
+	r.mu.Lock()
+	search := r.search
+	r.mu.Unlock()
+	if name != "" && !strings.Contains(name, ".") {
+		for _, d := range search {
+			if resp, ok := r.resolveUnder(ctx, h, q, name+"."+d); ok {
+				return resp, nil
+			}
+		}
+	}
+	return r.resolve(ctx, h, q, name, query)
+}
+
+// resolve answers query, with header h and question q for the
+// canonical name, locally or by forwarding it.
+func (r *Resolver) resolve(ctx context.Context, h dnsmessage.Header, q dnsmessage.Question, name string, query []byte) ([]byte, error) {
+	r.mu.Lock()
+	ips, isHost := r.hosts[name]
+	ptr, isPTR, isReverse := "", false, false
+	if ip, ok := parseReverse(name); ok && inTailnetRanges(ip) {
+		isReverse = true
+		ptr, isPTR = r.ptrs[ip.String()]
+	}
+	isLocal := false
+	for _, d := range r.local {
+		isLocal = isLocal || under(name, d)
+	}
+	nameservers := r.defaults
+	routed := false
+	for _, rt := range r.routes {
+		if under(name, rt.domain) {
+			nameservers, routed = rt.nameservers, true
+			break
+		}
+	}
+	restricted := r.restrictedLocked(name)
+	r.mu.Unlock()
+
+	switch {
+	case isPTR:
+		return ptrResponse(h, &q, ptr)
+	case isReverse:
+		// Tailnet addresses aren't for upstream nameservers to
+		// know, or hear about.
+		return response(h, &q, dnsmessage.RCodeNameError, nil)
+	case isHost:
+		return response(h, &q, dnsmessage.RCodeSuccess, ips)
+	case isLocal:
+		return response(h, &q, dnsmessage.RCodeNameError, nil)
+	}
+	resp, gen := r.cache.get(h, q)
+	if resp != nil {
+		return resp, nil
+	}
+	if !routed && len(nameservers) == 0 {
+		nameservers = r.systemNameservers()
+	}
+	if resp, ok := r.forwardTo(ctx, nameservers, q, name, query); ok {
+		r.cache.put(gen, resp)
+		return resp, nil
+	}
+	if restricted {
+		// A SERVFAIL would have stub resolvers ask their next
+		// nameserver, if the OS lists one after the resolver.
+		return response(h, &q, dnsmessage.RCodeNameError, nil)
+	}
+	return response(h, &q, dnsmessage.RCodeServerFailure, nil)
+}
+
+// forwardTo sends query, for question q about the canonical name, to
+// each of nameservers in turn until one responds, and returns the
+// response.
+func (r *Resolver) forwardTo(ctx context.Context, nameservers []string, q dnsmessage.Question, name string, query []byte) ([]byte, bool) {
+	for _, ns := range nameservers {
+		fctx, cancel := context.WithTimeout(ctx, forwardTimeout)
+		resp, err := r.forward(fctx, ns, query)
+		cancel()
+		if err == nil {
+			return resp, true
+		}
+		r.logf("tsdns: forwarding %s query for %q to %s: %v", q.Type, name, ns, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, false
+}
+
+// restricted reports whether name is under a restricted domain.
+func (r *Resolver) restricted(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.restrictedLocked(canonName(name))
+}
+
+// restrictedLocked is restricted, for a canonical name, with r.mu
+// held.
+func (r *Resolver) restrictedLocked(name string) bool {
+	for _, d := range r.restrict {
+		if under(name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveUnder resolves the single-label question q as fqdn, the name
+// under one of the search domains. If fqdn exists, it returns the
+// response to q, with fqdn as the alias of q's name; if not, it
+// reports false.
+func (r *Resolver) resolveUnder(ctx context.Context, h dnsmessage.Header, q dnsmessage.Question, fqdn string) ([]byte, bool) {
+	eq := q
+	var err error
+	if eq.Name, err = dnsmessage.NewName(fqdn + "."); err != nil {
+		return nil, false
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, RecursionDesired: h.RecursionDesired})
+	b.StartQuestions()
+	b.Question(eq)
+	query, err := b.Finish()
+	if err != nil {
+		return nil, false
+	}
+	resp, err := r.resolve(ctx, h, eq, fqdn, query)
+	if err != nil {
+		return nil, false
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil || m.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, false
+	}
+	if len(m.Answers) > 0 {
+		ttl := m.Answers[0].Header.TTL
+		for _, a := range m.Answers[1:] {
+			if a.Header.TTL < ttl {
+				ttl = a.Header.TTL
+			}
+		}
+		alias := dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: q.Class, TTL: ttl},
+			Body:   &dnsmessage.CNAMEResource{CNAME: eq.Name},
+		}
+		m.Answers = append([]dnsmessage.Resource{alias}, m.Answers...)
+	}
+	// With no answers, fqdn has no records of q's type, but exists;
+	// the search stops there, as it does for stub resolvers.
+	m.Header.ID = h.ID
+	m.Questions = []dnsmessage.Question{q}
+	resp, err = m.Pack()
+	return resp, err == nil
+}
+
+// response returns the response to the query with header h and
+// question q, with rcode and, for an A or AAAA question, those of ips
+// of its address family as answers.
+func response(h dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, ips []net.IP) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		Authoritative:      rcode == dnsmessage.RCodeSuccess || rcode == dnsmessage.RCodeNameError,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if q == nil {
+		return b.Finish()
+	}
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(*q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: localTTL}
+	for _, ip := range ips {
+		var err error
+		switch ip4 := ip.To4(); {
+		case q.Type == dnsmessage.TypeA && ip4 != nil:
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			err = b.AResource(rh, a)
+		case q.Type == dnsmessage.TypeAAAA && ip4 == nil && len(ip) == net.IPv6len:
+			var a dnsmessage.AAAAResource
+			copy(a.AAAA[:], ip)
+			err = b.AAAAResource(rh, a)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
@@ -0,0 +1,348 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// query returns a DNS query for name and typ.
+func query(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  typ,
+		Class: dnsmessage.ClassINET,
+	})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// answer parses the response resp, returning its rcode and the
+// addresses in its answers.
+func answer(t *testing.T, resp []byte) (dnsmessage.RCode, []string) {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.ID != 1234 || !m.Header.Response {
+		t.Errorf("header = %+v, want a response to query 1234", m.Header)
+	}
+	var ips []string
+	for _, a := range m.Answers {
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(b.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(b.AAAA[:]).String())
+		}
+	}
+	return m.Header.RCode, ips
+}
+
+func TestResolve(t *testing.T) {
+	r := New(t.Logf)
+	var forwardedTo []string
+	r.forward = func(ctx context.Context, addr string, q []byte) ([]byte, error) {
+		forwardedTo = append(forwardedTo, addr)
+		if strings.HasPrefix(addr, "10.0.0.9") {
+			return nil, errors.New("down")
+		}
+		return response(dnsmessage.Header{ID: 1234}, nil, dnsmessage.RCodeSuccess, nil)
+	}
+	r.system = func() []string { return []string{"192.168.1.1:53"} }
+	r.SetConfig(Config{
+		Hosts: map[string][]net.IP{
+			"Alpha.Example.Beta.TailScale.net.": {net.ParseIP("100.101.102.103"), net.ParseIP("fd7a:115c:a1e0::1")},
+		},
+		LocalDomains: []string{"example.beta.tailscale.net"},
+		Routes: map[string][]string{
+			"corp.example.com":     {"10.0.0.1"},
+			"lab.corp.example.com": {"10.0.0.9", "10.0.0.2:5353"},
+		},
+	})
+
+	tests := []struct {
+		name      string
+		typ       dnsmessage.Type
+		rcode     dnsmessage.RCode
+		ips       []string
+		forwarded []string
+	}{
+		{"alpha.example.beta.tailscale.net.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"100.101.102.103"}, nil},
+		{"ALPHA.example.beta.tailscale.net.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"fd7a:115c:a1e0::1"}, nil},
+		{"alpha.example.beta.tailscale.net.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, nil, nil},
+		{"gone.example.beta.tailscale.net.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, nil},
+		{"wiki.corp.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, []string{"10.0.0.1:53"}},
+		{"corp.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, []string{"10.0.0.1:53"}},
+		{"build.lab.corp.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, []string{"10.0.0.9:53", "10.0.0.2:5353"}},
+		{"notcorp.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, []string{"192.168.1.1:53"}},
+	}
+	for _, tt := range tests {
+		forwardedTo = nil
+		resp, err := r.Resolve(context.Background(), query(t, tt.name, tt.typ))
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.name, tt.typ, err)
+			continue
+		}
+		rcode, ips := answer(t, resp)
+		if rcode != tt.rcode || !reflect.DeepEqual(ips, tt.ips) || !reflect.DeepEqual(forwardedTo, tt.forwarded) {
+			t.Errorf("%s %v = %v %v, forwarded to %v; want %v %v, forwarded to %v",
+				tt.name, tt.typ, rcode, ips, forwardedTo, tt.rcode, tt.ips, tt.forwarded)
+		}
+	}
+
+	// With default nameservers, the system's aren't used, and when
+	// they all fail the answer is SERVFAIL.
+	r.SetConfig(Config{Nameservers: []string{"10.0.0.9", "[fd00::9]:53"}})
+	forwardedTo = nil
+	r.forward = func(ctx context.Context, addr string, q []byte) ([]byte, error) {
+		forwardedTo = append(forwardedTo, addr)
+		return nil, errors.New("down")
+	}
+	resp, err := r.Resolve(context.Background(), query(t, "example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode, _ := answer(t, resp); rcode != dnsmessage.RCodeServerFailure {
+		t.Errorf("rcode = %v, want SERVFAIL", rcode)
+	}
+	if want := []string{"10.0.0.9:53", "[fd00::9]:53"}; !reflect.DeepEqual(forwardedTo, want) {
+		t.Errorf("forwarded to %v, want %v", forwardedTo, want)
+	}
+
+	if _, err := r.Resolve(context.Background(), []byte("junk")); err == nil {
+		t.Errorf("junk query resolved")
+	}
+}
+
+func TestWithoutSelf(t *testing.T) {
+	got := withoutSelf([]string{"100.64.1.2:53", "192.168.1.1:53"}, net.ParseIP("100.64.1.2"))
+	if want := []string{"192.168.1.1:53"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("withoutSelf = %v, want %v", got, want)
+	}
+}
+
+func TestParseResolvConf(t *testing.T) {
+	got := parseResolvConf(strings.NewReader(`# generated
+nameserver 192.168.1.1
+nameserver fe80::1
+search example.com
+nameserver bogus
+`))
+	want := []string{"192.168.1.1:53", "[fe80::1]:53"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseResolvConf = %v, want %v", got, want)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	// A nameserver whose UDP responses are truncated, so that
+	// exchange has to retry over TCP.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	addr := pc.LocalAddr().String()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("TCP port of %s taken: %v", addr, err)
+	}
+	defer ln.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := append([]byte(nil), buf[:n]...)
+		resp[2] |= 0x80 | 0x02 // QR, TC
+		pc.WriteTo(resp, from)
+	}()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var n [2]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(c, make([]byte, binary.BigEndian.Uint16(n[:]))); err != nil {
+			return
+		}
+		resp, _ := response(dnsmessage.Header{ID: 1234}, nil, dnsmessage.RCodeSuccess, nil)
+		binary.BigEndian.PutUint16(n[:], uint16(len(resp)))
+		c.Write(append(n[:], resp...))
+	}()
+
+	resp, err := exchange(context.Background(), addr, query(t, "example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode, _ := answer(t, resp); rcode != dnsmessage.RCodeSuccess {
+		t.Errorf("rcode = %v", rcode)
+	}
+}
+
+func TestSystemNameserversRemembered(t *testing.T) {
+	r := New(t.Logf)
+	system := []string{"192.168.1.1:53"}
+	r.system = func() []string { return system }
+	r.SetConfig(Config{})
+	// Once the OS lists only the resolver, its earlier nameservers
+	// are still used.
+	r.self = net.ParseIP("100.64.0.1")
+	system = []string{"100.64.0.1:53"}
+	if got, want := r.systemNameservers(), []string{"192.168.1.1:53"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("systemNameservers = %v, want %v", got, want)
+	}
+}
+
+func TestMatchDomains(t *testing.T) {
+	cfg := Config{
+		LocalDomains: []string{"example.com.beta.tailscale.net"},
+		Routes:       map[string][]string{"corp.example.com": {"10.0.0.1"}},
+	}
+	want := []string{"corp.example.com", "example.com.beta.tailscale.net"}
+	if got := cfg.MatchDomains(); !reflect.DeepEqual(got, want) {
+		t.Errorf("MatchDomains = %q, want %q", got, want)
+	}
+	cfg.Nameservers = []string{"8.8.8.8"}
+	if got := cfg.MatchDomains(); got != nil {
+		t.Errorf("with default nameservers, MatchDomains = %q, want all names", got)
+	}
+}
+
+func TestSearchDomains(t *testing.T) {
+	r := New(t.Logf)
+	var forwarded []string
+	r.forward = func(ctx context.Context, addr string, q []byte) ([]byte, error) {
+		var p dnsmessage.Parser
+		p.Start(q)
+		qq, _ := p.Question()
+		forwarded = append(forwarded, qq.Name.String())
+		if qq.Name.String() == "wiki.corp.example.com." {
+			return upstreamResponse(t, q, dnsmessage.RCodeSuccess, 300, 0), nil
+		}
+		return upstreamResponse(t, q, dnsmessage.RCodeNameError, 0, 0), nil
+	}
+	r.SetConfig(Config{
+		Hosts: map[string][]net.IP{
+			"alpha.example.beta.tailscale.net": {net.ParseIP("100.101.102.103")},
+		},
+		LocalDomains:  []string{"example.beta.tailscale.net"},
+		Nameservers:   []string{"10.0.0.1"},
+		SearchDomains: []string{"example.beta.tailscale.net", "corp.example.com."},
+	})
+
+	tests := []struct {
+		name      string
+		rcode     dnsmessage.RCode
+		alias     string
+		ips       []string
+		forwarded []string
+	}{
+		{"alpha.", dnsmessage.RCodeSuccess, "alpha.example.beta.tailscale.net.", []string{"100.101.102.103"}, nil},
+		{"wiki.", dnsmessage.RCodeSuccess, "wiki.corp.example.com.", []string{"192.0.2.1"}, []string{"wiki.corp.example.com."}},
+		{"nothing.", dnsmessage.RCodeNameError, "", nil, []string{"nothing.corp.example.com.", "nothing."}},
+		{"host.example.com.", dnsmessage.RCodeNameError, "", nil, []string{"host.example.com."}},
+	}
+	for _, tt := range tests {
+		forwarded = nil
+		resp, err := r.Resolve(context.Background(), query(t, tt.name, dnsmessage.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rcode, ips := answer(t, resp)
+		var m dnsmessage.Message
+		m.Unpack(resp)
+		alias := ""
+		for _, a := range m.Answers {
+			if c, ok := a.Body.(*dnsmessage.CNAMEResource); ok && a.Header.Name.String() == tt.name {
+				alias = c.CNAME.String()
+			}
+		}
+		if len(m.Questions) != 1 || m.Questions[0].Name.String() != tt.name {
+			t.Errorf("%s: questions = %v", tt.name, m.Questions)
+		}
+		if rcode != tt.rcode || alias != tt.alias || !reflect.DeepEqual(ips, tt.ips) || !reflect.DeepEqual(forwarded, tt.forwarded) {
+			t.Errorf("%s = %v %q %v, forwarded %v; want %v %q %v, forwarded %v",
+				tt.name, rcode, alias, ips, forwarded, tt.rcode, tt.alias, tt.ips, tt.forwarded)
+		}
+	}
+}
+
+func TestRestrictedDomains(t *testing.T) {
+	r := New(t.Logf)
+	var forwardedTo []string
+	r.forward = func(ctx context.Context, addr string, q []byte) ([]byte, error) {
+		forwardedTo = append(forwardedTo, addr)
+		if addr == "10.0.0.1:53" {
+			return nil, errors.New("down")
+		}
+		return upstreamResponse(t, q, dnsmessage.RCodeSuccess, 300, 0), nil
+	}
+	r.SetConfig(Config{
+		Routes: map[string][]string{
+			"corp.example.com": {"10.0.0.1"},
+			"lab.example.com":  {"10.0.0.1"},
+		},
+		Nameservers:       []string{"8.8.8.8"},
+		RestrictedDomains: []string{"corp.example.com", "secret.example.com."},
+	})
+
+	tests := []struct {
+		name      string
+		rcode     dnsmessage.RCode
+		forwarded []string
+	}{
+		{"wiki.corp.example.com.", dnsmessage.RCodeNameError, []string{"10.0.0.1:53"}},
+		{"wiki.lab.example.com.", dnsmessage.RCodeServerFailure, []string{"10.0.0.1:53"}},
+		{"x.secret.example.com.", dnsmessage.RCodeNameError, nil},
+		{"www.example.com.", dnsmessage.RCodeSuccess, []string{"8.8.8.8:53"}},
+	}
+	for _, tt := range tests {
+		forwardedTo = nil
+		resp, err := r.Resolve(context.Background(), query(t, tt.name, dnsmessage.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m dnsmessage.Message
+		m.Unpack(resp)
+		if m.Header.RCode != tt.rcode || !reflect.DeepEqual(forwardedTo, tt.forwarded) {
+			t.Errorf("%s = %v, forwarded to %v; want %v, forwarded to %v", tt.name, m.Header.RCode, forwardedTo, tt.rcode, tt.forwarded)
+		}
+	}
+
+	if _, err := r.up.lookup(context.Background(), "doh.corp.example.com"); err == nil {
+		t.Errorf("bootstrap lookup of a restricted name didn't fail")
+	}
+
+	cfg := Config{
+		Routes:            map[string][]string{"corp.example.com": {"10.0.0.1"}},
+		RestrictedDomains: []string{"corp.example.com", "secret.example.com"},
+	}
+	if got, want := cfg.MatchDomains(), []string{"corp.example.com", "secret.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MatchDomains = %q, want %q", got, want)
+	}
+}
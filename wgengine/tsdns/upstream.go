@@ -0,0 +1,351 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/logger"
+)
+
+// Nameservers may be given as plain IP or IP:port, sent queries over
+// UDP; as a DNS-over-HTTPS (RFC 8484) URL, "https://host/path"; or as
+// a DNS-over-TLS (RFC 7858) server, "tls://host" or "tls://host:port".
+// DoH and DoT hosts may be names, which are looked up ("bootstrapped")
+// with the system's nameservers, in the clear; give an IP to avoid
+// that. Hosts under a restricted domain must be given as IPs.
+
+const (
+	dotPort = "853"
+
+	// maxIdleDoT is how many idle connections to keep to each DoT
+	// server.
+	maxIdleDoT = 2
+
+	// minBootstrapTTL is the least time a bootstrap lookup is
+	// cached, whatever its TTL.
+	minBootstrapTTL = time.Minute
+)
+
+// upstreamAddr returns the nameserver s in canonical form: "ip:port",
+// "tls://host:port", or a DoH URL. It reports false if s is none of
+// those.
+func upstreamAddr(s string) (string, bool) {
+	switch {
+	case strings.HasPrefix(s, "https://"):
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return "", false
+		}
+		return s, true
+	case strings.HasPrefix(s, "tls://"):
+		hostport := strings.TrimPrefix(s, "tls://")
+		if _, _, err := net.SplitHostPort(hostport); err != nil {
+			hostport = net.JoinHostPort(strings.Trim(hostport, "[]"), dotPort)
+		}
+		host, _, _ := net.SplitHostPort(hostport)
+		if host == "" {
+			return "", false
+		}
+		return "tls://" + hostport, true
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, "53"
+	}
+	if net.ParseIP(host) == nil {
+		return "", false
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+// upstreams sends queries to nameservers by each one's protocol, and
+// keeps the DoH and DoT connections open for the queries that follow.
+type upstreams struct {
+	logf logger.Logf
+
+	// bootstrap returns the nameservers that DoH and DoT host names
+	// are looked up with.
+	bootstrap func() []string
+	// private, if non-nil, reports whether a host name mustn't be
+	// sent to the bootstrap nameservers.
+	private func(host string) bool
+	// plain is exchange, except in tests.
+	plain func(ctx context.Context, addr string, query []byte) ([]byte, error)
+	// rootCAs, if non-nil, replaces the system's roots, for tests.
+	rootCAs *x509.CertPool
+
+	mu      sync.Mutex
+	httpc   *http.Client              // for DoH, made on first use
+	idleDoT map[string][]*tls.Conn    // by "host:port"
+	hosts   map[string]bootstrapEntry // by host name
+}
+
+// bootstrapEntry is the result of a bootstrap lookup.
+type bootstrapEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// exchange sends query to the nameserver upstream, in the form
+// returned by upstreamAddr, and returns its response.
+func (u *upstreams) exchange(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(upstream, "https://"):
+		return u.exchangeDoH(ctx, upstream, query)
+	case strings.HasPrefix(upstream, "tls://"):
+		return u.exchangeDoT(ctx, strings.TrimPrefix(upstream, "tls://"), query)
+	}
+	return u.plain(ctx, upstream, query)
+}
+
+// client returns the HTTP client for DoH, which dials through the
+// bootstrap lookup and keeps connections to reuse.
+func (u *upstreams) client() *http.Client {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.httpc == nil {
+		u.httpc = &http.Client{
+			Transport: &http.Transport{
+				DialContext:         u.dial,
+				TLSClientConfig:     &tls.Config{RootCAs: u.rootCAs},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: forwardTimeout,
+			},
+		}
+	}
+	return u.httpc
+}
+
+func (u *upstreams) exchangeDoH(ctx context.Context, url string, query []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := u.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH: %s", res.Status)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "application/dns-message" {
+		return nil, fmt.Errorf("DoH: response is %q", ct)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, maxMessageSize))
+}
+
+func (u *upstreams) exchangeDoT(ctx context.Context, hostport string, query []byte) ([]byte, error) {
+	for {
+		c, reused, err := u.getDoT(ctx, hostport)
+		if err != nil {
+			return nil, err
+		}
+		setDeadline(ctx, c)
+		resp, err := exchangeStream(c, query)
+		if err != nil {
+			c.Close()
+			if reused && ctx.Err() == nil {
+				// The server may have closed it while idle.
+				continue
+			}
+			return nil, err
+		}
+		u.putDoT(hostport, c)
+		return resp, nil
+	}
+}
+
+// getDoT returns an idle connection to the DoT server hostport, or a
+// new one, reporting which.
+func (u *upstreams) getDoT(ctx context.Context, hostport string) (c *tls.Conn, reused bool, err error) {
+	u.mu.Lock()
+	if idle := u.idleDoT[hostport]; len(idle) > 0 {
+		c = idle[len(idle)-1]
+		u.idleDoT[hostport] = idle[:len(idle)-1]
+	}
+	u.mu.Unlock()
+	if c != nil {
+		return c, true, nil
+	}
+
+	host, _, _ := net.SplitHostPort(hostport)
+	tc, err := u.dial(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, false, err
+	}
+	c = tls.Client(tc, &tls.Config{ServerName: host, RootCAs: u.rootCAs})
+	setDeadline(ctx, c)
+	if err := c.Handshake(); err != nil {
+		tc.Close()
+		return nil, false, err
+	}
+	return c, false, nil
+}
+
+// putDoT keeps c, a connection to hostport, for reuse.
+func (u *upstreams) putDoT(hostport string, c *tls.Conn) {
+	c.SetDeadline(time.Time{})
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.idleDoT[hostport]) >= maxIdleDoT {
+		c.Close()
+		return
+	}
+	if u.idleDoT == nil {
+		u.idleDoT = make(map[string][]*tls.Conn)
+	}
+	u.idleDoT[hostport] = append(u.idleDoT[hostport], c)
+}
+
+// close closes the idle DoT and DoH connections.
+func (u *upstreams) close() {
+	u.mu.Lock()
+	for _, idle := range u.idleDoT {
+		for _, c := range idle {
+			c.Close()
+		}
+	}
+	u.idleDoT = nil
+	if u.httpc != nil {
+		u.httpc.Transport.(*http.Transport).CloseIdleConnections()
+	}
+	u.mu.Unlock()
+}
+
+// dial connects to addr, whose host may be a name to bootstrap.
+func (u *upstreams) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := u.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	for _, ip := range ips {
+		var c net.Conn
+		c, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+// lookup returns the addresses of host, an IP or a name, looking
+// names up with the bootstrap nameservers.
+func (u *upstreams) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	host = canonName(host)
+	if u.private != nil && u.private(host) {
+		return nil, fmt.Errorf("%s is under a restricted domain; give its IP", host)
+	}
+	u.mu.Lock()
+	e, ok := u.hosts[host]
+	u.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ips, nil
+	}
+
+	var ips []net.IP
+	ttl := uint32(0)
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		got, gotTTL, err := u.lookupType(ctx, host, typ)
+		if err != nil {
+			u.logf("tsdns: bootstrap lookup of %s %v: %v", host, typ, err)
+		}
+		ips = append(ips, got...)
+		if len(got) > 0 && (ttl == 0 || gotTTL < ttl) {
+			ttl = gotTTL
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	expiry := time.Duration(ttl) * time.Second
+	if expiry < minBootstrapTTL {
+		expiry = minBootstrapTTL
+	}
+	u.mu.Lock()
+	if u.hosts == nil {
+		u.hosts = make(map[string]bootstrapEntry)
+	}
+	u.hosts[host] = bootstrapEntry{ips, time.Now().Add(expiry)}
+	u.mu.Unlock()
+	return ips, nil
+}
+
+var errNoBootstrap = errors.New("no nameservers to look up DoH and DoT hosts with")
+
+// lookupType asks the bootstrap nameservers for host's addresses of
+// typ, A or AAAA, returning them and their least TTL.
+func (u *upstreams) lookupType(ctx context.Context, host string, typ dnsmessage.Type) ([]net.IP, uint32, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(time.Now().UnixNano()), RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: typ, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+	err = errNoBootstrap
+	for _, ns := range u.bootstrap() {
+		var resp []byte
+		resp, err = u.plain(ctx, ns, query)
+		if err != nil {
+			continue
+		}
+		var m dnsmessage.Message
+		if err = m.Unpack(resp); err != nil {
+			continue
+		}
+		if m.Header.RCode != dnsmessage.RCodeSuccess {
+			return nil, 0, fmt.Errorf("%v", m.Header.RCode)
+		}
+		var ips []net.IP
+		var ttl uint32
+		for _, a := range m.Answers {
+			switch r := a.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, net.IP(r.A[:]))
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, net.IP(r.AAAA[:]))
+			default:
+				continue // such as the CNAMEs leading to them
+			}
+			if ttl == 0 || a.Header.TTL < ttl {
+				ttl = a.Header.TTL
+			}
+		}
+		return ips, ttl, nil
+	}
+	return nil, 0, err
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestUpstreamAddr(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // empty if invalid
+	}{
+		{"8.8.8.8", "8.8.8.8:53"},
+		{"8.8.8.8:5353", "8.8.8.8:5353"},
+		{"2001:4860:4860::8888", "[2001:4860:4860::8888]:53"},
+		{"dns.google", ""},
+		{"https://dns.google/dns-query", "https://dns.google/dns-query"},
+		{"https:///dns-query", ""},
+		{"tls://dns.google", "tls://dns.google:853"},
+		{"tls://1.1.1.1:8853", "tls://1.1.1.1:8853"},
+		{"tls://[2606:4700:4700::1111]", "tls://[2606:4700:4700::1111]:853"},
+		{"tls://", ""},
+	}
+	for _, tt := range tests {
+		got, ok := upstreamAddr(tt.in)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("upstreamAddr(%q) = %q, %v; want %q", tt.in, got, ok, tt.want)
+		}
+	}
+}
+
+// echoResponse returns query, marked as a response.
+func echoResponse(query []byte) []byte {
+	resp := append([]byte(nil), query...)
+	resp[2] |= 0x80 // QR
+	return resp
+}
+
+// certPool returns a pool trusting srv's certificate.
+func certPool(srv *httptest.Server) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return pool
+}
+
+func TestDoH(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(echoResponse(query))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	u := &upstreams{logf: t.Logf, rootCAs: certPool(srv)}
+	defer u.close()
+	addr, ok := upstreamAddr(srv.URL + "/dns-query")
+	if !ok {
+		t.Fatalf("bad URL %q", srv.URL)
+	}
+	for i := 0; i < 2; i++ {
+		q := query(t, "example.com.", dnsmessage.TypeA)
+		resp, err := u.exchange(context.Background(), addr, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp, echoResponse(q)) {
+			t.Errorf("response = %x, want %x", resp, echoResponse(q))
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("made %d connections, want 1", n)
+	}
+}
+
+func TestDoT(t *testing.T) {
+	// Borrow httptest's certificate, for 127.0.0.1.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var conns int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				defer c.Close()
+				for {
+					var n [2]byte
+					if _, err := io.ReadFull(c, n[:]); err != nil {
+						return
+					}
+					q := make([]byte, binary.BigEndian.Uint16(n[:]))
+					if _, err := io.ReadFull(c, q); err != nil {
+						return
+					}
+					c.Write(append(n[:], echoResponse(q)...))
+				}
+			}()
+		}
+	}()
+
+	u := &upstreams{logf: t.Logf, rootCAs: certPool(srv)}
+	defer u.close()
+	addr, _ := upstreamAddr("tls://" + ln.Addr().String())
+	for i := 0; i < 3; i++ {
+		q := query(t, "example.com.", dnsmessage.TypeA)
+		resp, err := u.exchange(context.Background(), addr, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp, echoResponse(q)) {
+			t.Errorf("response = %x, want %x", resp, echoResponse(q))
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("made %d connections, want 1", n)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	var asked []string
+	u := &upstreams{
+		logf:      t.Logf,
+		bootstrap: func() []string { return []string{"192.168.1.1:53"} },
+		plain: func(ctx context.Context, addr string, q []byte) ([]byte, error) {
+			var p dnsmessage.Parser
+			h, _ := p.Start(q)
+			qq, _ := p.Question()
+			asked = append(asked, qq.Name.String()+" "+qq.Type.String())
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true})
+			b.StartQuestions()
+			b.Question(qq)
+			b.StartAnswers()
+			if qq.Type == dnsmessage.TypeA {
+				rh := dnsmessage.ResourceHeader{Name: qq.Name, Type: qq.Type, Class: dnsmessage.ClassINET, TTL: 300}
+				b.AResource(rh, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+			}
+			return b.Finish()
+		},
+	}
+	for i := 0; i < 2; i++ {
+		ips, err := u.lookup(context.Background(), "DNS.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("lookup = %v, want [192.0.2.1]", ips)
+		}
+	}
+	if want := []string{"dns.example. TypeA", "dns.example. TypeAAAA"}; !reflect.DeepEqual(asked, want) {
+		t.Errorf("asked %q, want %q (once, then cached)", asked, want)
+	}
+	if ips, _ := u.lookup(context.Background(), "10.0.0.1"); len(ips) != 1 || len(asked) != 2 {
+		t.Errorf("looking up an IP asked the nameservers")
+	}
+}
@@ -6,8 +6,10 @@ package wgengine
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,6 +25,7 @@ import (
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/packet"
+	"tailscale.com/wgengine/tsdns"
 )
 
 type userspaceEngine struct {
@@ -35,14 +38,22 @@ type userspaceEngine struct {
 	router         Router
 	magicConn      *magicsock.Conn
 	linkMon        *monitor.Mon
+	resolver       *tsdns.Resolver
 
 	wgLock       sync.Mutex // serializes all wgdev operations
 	lastReconfig string
 	lastRoutes   string
+	filt         *filter.Filter
 
 	mu           sync.Mutex
 	peerSequence []wgcfg.Key
 	endpoints    []string
+	paused       bool
+	dnsOn        bool     // SetDNSConfig was given a config
+	dnsMatch     []string // its MatchDomains
+	dnsRestrict  []string // its RestrictedDomains
+	dnsPeers     bool     // its ServePeers
+	dnsGlobal    bool     // whether it has its own default nameservers
 }
 
 type Loggify struct {
@@ -60,9 +71,29 @@ func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error)
 	return NewUserspaceEngineAdvanced(logf, tun, NewFakeRouter, listenPort)
 }
 
+// Tuning contains optional low-level settings for a userspace engine.
+// The zero value selects the defaults.
+type Tuning struct {
+	// DSCP, if non-zero, is the DiffServ code point (0-63) set on
+	// outgoing encapsulated UDP packets.
+	DSCP uint8
+
+	// SocketBufferSize is the size in bytes to request for the UDP
+	// socket receive and send buffers. Zero means
+	// magicsock.DefaultSocketBufferSize; negative leaves the OS
+	// default.
+	SocketBufferSize int
+}
+
 // NewUserspaceEngine creates the named tun device and returns a Tailscale Engine
 // running on it.
 func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16) (Engine, error) {
+	return NewUserspaceEngineWithTuning(logf, tunname, listenPort, Tuning{})
+}
+
+// NewUserspaceEngineWithTuning is like NewUserspaceEngine but applies
+// the given low-level settings.
+func NewUserspaceEngineWithTuning(logf logger.Logf, tunname string, listenPort uint16, tuning Tuning) (Engine, error) {
 	logf("Starting userspace wireguard engine.")
 	logf("external packet routing via --tun=%s enabled", tunname)
 
@@ -77,7 +108,7 @@ func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16) (En
 	}
 	logf("CreateTUN ok.\n")
 
-	e, err := NewUserspaceEngineAdvanced(logf, tundev, newUserspaceRouter, listenPort)
+	e, err := newUserspaceEngineAdvanced(logf, tundev, newUserspaceRouter, listenPort, tuning)
 	if err != nil {
 		logf("NewUserspaceEngineAdv: %v\n", err)
 		tundev.Close()
@@ -89,16 +120,23 @@ func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16) (En
 // NewUserspaceEngineAdvanced is like NewUserspaceEngine but takes a pre-created TUN device and allows specifing
 // a custom router constructor and listening port.
 func NewUserspaceEngineAdvanced(logf logger.Logf, tundev tun.Device, routerGen RouterGen, listenPort uint16) (Engine, error) {
-	return newUserspaceEngineAdvanced(logf, tundev, routerGen, listenPort)
+	return newUserspaceEngineAdvanced(logf, tundev, routerGen, listenPort, Tuning{})
 }
 
-func newUserspaceEngineAdvanced(logf logger.Logf, tundev tun.Device, routerGen RouterGen, listenPort uint16) (_ Engine, reterr error) {
+// NewUserspaceEngineAdvancedWithTuning is like
+// NewUserspaceEngineAdvanced but applies the given low-level settings.
+func NewUserspaceEngineAdvancedWithTuning(logf logger.Logf, tundev tun.Device, routerGen RouterGen, listenPort uint16, tuning Tuning) (Engine, error) {
+	return newUserspaceEngineAdvanced(logf, tundev, routerGen, listenPort, tuning)
+}
+
+func newUserspaceEngineAdvanced(logf logger.Logf, tundev tun.Device, routerGen RouterGen, listenPort uint16, tuning Tuning) (_ Engine, reterr error) {
 	e := &userspaceEngine{
 		logf:   logf,
 		reqCh:  make(chan struct{}, 1),
 		waitCh: make(chan struct{}),
 		tundev: tundev,
 	}
+	e.resolver = tsdns.New(logf)
 
 	mon, err := monitor.New(logf, func() { e.LinkChange(false) })
 	if err != nil {
@@ -114,9 +152,13 @@ func newUserspaceEngineAdvanced(logf logger.Logf, tundev tun.Device, routerGen R
 		e.RequestStatus()
 	}
 	magicsockOpts := magicsock.Options{
-		Port:          listenPort,
-		STUN:          magicsock.DefaultSTUN,
-		EndpointsFunc: endpointsFn,
+		Port:           listenPort,
+		STUN:           magicsock.DefaultSTUN,
+		EndpointsFunc:  endpointsFn,
+		DSCP:           tuning.DSCP,
+		RecvBufferSize: tuning.SocketBufferSize,
+		SendBufferSize: tuning.SocketBufferSize,
+		Logf:           logf,
 	}
 	e.magicConn, err = magicsock.Listen(magicsockOpts)
 	if err != nil {
@@ -159,6 +201,11 @@ func newUserspaceEngineAdvanced(logf logger.Logf, tundev tun.Device, routerGen R
 		SkipBindUpdate: true,
 	}
 
+	// wireguard-go starts one encryption and one decryption worker
+	// per CPU, each calling the filter funcs above for its packets,
+	// so those keep off shared locks and allocations. Log what we're
+	// running with so throughput reports can be interpreted.
+	logf("wgengine: %d CPUs, GOMAXPROCS=%d\n", runtime.NumCPU(), runtime.GOMAXPROCS(0))
 	e.wgdev = device.NewDevice(e.tundev, opts)
 	defer func() {
 		if reterr != nil {
@@ -225,7 +272,14 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, dnsDomains []string) error
 		return err
 	}
 
-	rc := uapi + "\x00" + strings.Join(dnsDomains, "\x00")
+	e.mu.Lock()
+	dnsOn, dnsMatch, dnsRestrict, dnsPeers, dnsGlobal := e.dnsOn, e.dnsMatch, e.dnsRestrict, e.dnsPeers, e.dnsGlobal
+	e.mu.Unlock()
+
+	// The UAPI config doesn't include DNS, which can change on its
+	// own, e.g. when the user stops accepting DNS settings, or starts
+	// serving peers as an exit node.
+	rc := uapi + "\x00" + fmt.Sprint(cfg.DNS, dnsOn, dnsMatch, dnsRestrict, dnsPeers, dnsGlobal) + "\x00" + strings.Join(dnsDomains, "\x00")
 	if rc == e.lastReconfig {
 		e.logf("...unchanged config, skipping.\n")
 		return nil
@@ -255,6 +309,10 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, dnsDomains []string) error
 		Cfg:        cfg,
 		DNS:        cfg.DNS,
 		DNSDomains: dnsDomains,
+
+		DNSMatchDomains:      dnsMatch,
+		DNSRestrictedDomains: dnsRestrict,
+		DNSGlobal:            dnsGlobal,
 	}
 	e.logf("Reconfiguring router. la=%v dns=%v dom=%v\n",
 		rs.LocalAddr, rs.DNS, rs.DNSDomains)
@@ -270,14 +328,46 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, dnsDomains []string) error
 	e.logf("New routes: %v\n", rss)
 	if rss == e.lastRoutes {
 		e.logf("...unchanged routes, skipping.\n")
-		return nil
+	} else {
+		e.lastRoutes = rss
+		err = e.router.SetRoutes(rs)
+	}
+	if err == nil && dnsOn && len(cfg.Addresses) > 0 {
+		// The address is only ours once the router has set it.
+		// Listening again at the same address does nothing.
+		if lerr := e.resolver.Listen(cfg.Addresses[0].IP.IP()); lerr != nil {
+			e.logf("wgengine: DNS resolver: %v\n", lerr)
+			if dnsPeers {
+				// Try again with the next Reconfig, even if
+				// it's the same.
+				e.lastReconfig = ""
+				err = fmt.Errorf("%w: %v", ErrDNSProxyFailed, lerr)
+			}
+		}
 	}
-	e.lastRoutes = rss
-	err = e.router.SetRoutes(rs)
 	e.logf("Reconfig() done.\n")
 	return err
 }
 
+func (e *userspaceEngine) SetDNSConfig(cfg *tsdns.Config) {
+	e.mu.Lock()
+	e.dnsOn = cfg != nil
+	e.dnsMatch, e.dnsRestrict, e.dnsPeers, e.dnsGlobal = nil, nil, false, false
+	if cfg != nil {
+		e.dnsMatch, e.dnsRestrict, e.dnsPeers = cfg.MatchDomains(), cfg.RestrictedDomains, cfg.ServePeers
+		// Default nameservers, from control or the exit node, are
+		// the tailnet asking for all names.
+		e.dnsGlobal = len(cfg.Nameservers) > 0
+	}
+	e.mu.Unlock()
+	if cfg == nil {
+		e.resolver.Close()
+		e.resolver.SetConfig(tsdns.Config{})
+		return
+	}
+	e.resolver.SetConfig(*cfg)
+}
+
 func (e *userspaceEngine) SetFilter(filt *filter.Filter) {
 	var filtin, filtout func(b []byte) device.FilterResult
 	if filt == nil {
@@ -289,7 +379,8 @@ func (e *userspaceEngine) SetFilter(filt *filter.Filter) {
 			//runf |= filter.HexdumpDrops
 			runf |= filter.LogAccepts
 			//runf |= filter.HexdumpAccepts
-			q := &packet.QDecode{}
+			q := getQDecode()
+			defer putQDecode(q)
 			if filt.RunIn(b, q, runf) == filter.Accept {
 				// Only in fake mode, answer any incoming pings
 				if ft_ok && q.IsEchoRequest() {
@@ -308,7 +399,8 @@ func (e *userspaceEngine) SetFilter(filt *filter.Filter) {
 			//runf |= filter.HexdumpDrops
 			runf |= filter.LogAccepts
 			//runf |= filter.HexdumpAccepts
-			q := &packet.QDecode{}
+			q := getQDecode()
+			defer putQDecode(q)
 			if filt.RunOut(b, q, runf) == filter.Accept {
 				return device.FilterAccept
 			}
@@ -320,6 +412,18 @@ func (e *userspaceEngine) SetFilter(filt *filter.Filter) {
 	defer e.wgLock.Unlock()
 
 	e.wgdev.SetFilterInOut(filtin, filtout)
+	e.filt = filt
+}
+
+// qdecodes holds the QDecodes the filter funcs decode packets into,
+// to spare wireguard-go's workers an allocation per packet.
+var qdecodes = sync.Pool{New: func() interface{} { return new(packet.QDecode) }}
+
+func getQDecode() *packet.QDecode { return qdecodes.Get().(*packet.QDecode) }
+
+func putQDecode(q *packet.QDecode) {
+	*q = packet.QDecode{} // drop the reference to the packet
+	qdecodes.Put(q)
 }
 
 func (e *userspaceEngine) SetStatusCallback(cb StatusCallback) {
@@ -401,6 +505,8 @@ func (e *userspaceEngine) getStatus() (*Status, error) {
 		}
 	}
 
+	curAddrs := e.magicConn.CurAddrs()
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
@@ -410,6 +516,10 @@ func (e *userspaceEngine) getStatus() (*Status, error) {
 		if p == nil {
 			p = &PeerStatus{}
 		}
+		p.CurAddr = curAddrs[pk]
+		if host, ok := e.magicConn.DERPHostOfAddr(p.CurAddr); ok {
+			p.DERP = host
+		}
 		peers = append(peers, *p)
 	}
 
@@ -419,6 +529,9 @@ func (e *userspaceEngine) getStatus() (*Status, error) {
 
 	return &Status{
 		LocalAddrs: append([]string(nil), e.endpoints...),
+		NATType:    e.magicConn.NATType().String(),
+		DERPHome:   e.magicConn.HomeDERP(),
+		NetInfo:    e.magicConn.NetInfo(),
 		Peers:      peers,
 	}, nil
 }
@@ -461,8 +574,16 @@ func (e *userspaceEngine) Close() {
 	r := bufio.NewReader(strings.NewReader(""))
 	e.wgdev.IpcSetOperation(r)
 	e.linkMon.Close()
-	e.router.Close()
+	// Stop talking to peers and DERP before taking down the routes
+	// and DNS settings, so that nothing is sent into a half-removed
+	// interface. Closing the device closes the TUN, which removes
+	// the interface on most systems.
 	e.magicConn.Close()
+	e.resolver.Close()
+	if err := e.router.Close(); err != nil {
+		e.logf("wgengine: router.Close: %v\n", err)
+	}
+	e.wgdev.Close()
 	close(e.waitCh)
 }
 
@@ -471,6 +592,18 @@ func (e *userspaceEngine) Wait() {
 }
 
 func (e *userspaceEngine) LinkChange(isExpensive bool) {
+	e.mu.Lock()
+	paused := e.paused
+	e.mu.Unlock()
+	if paused {
+		// Resume rebinds anyway.
+		e.logf("LinkChange(isExpensive=%v): paused, ignoring", isExpensive)
+		return
+	}
+	e.linkChange(isExpensive)
+}
+
+func (e *userspaceEngine) linkChange(isExpensive bool) {
 	e.logf("LinkChange(isExpensive=%v): rebinding socket", isExpensive)
 	e.wgLock.Lock()
 	defer e.wgLock.Unlock()
@@ -490,3 +623,71 @@ func (e *userspaceEngine) LinkChange(isExpensive bool) {
 		e.logf("IpcSetOperation: %v\n", err)
 	}
 }
+
+func (e *userspaceEngine) Pause() {
+	e.mu.Lock()
+	if e.paused {
+		e.mu.Unlock()
+		return
+	}
+	e.paused = true
+	e.mu.Unlock()
+
+	e.logf("Pause: stopping WireGuard device, DERP and STUN")
+	e.wgLock.Lock()
+	e.wgdev.Down()
+	e.wgLock.Unlock()
+	e.magicConn.SetPaused(true)
+}
+
+func (e *userspaceEngine) Resume() {
+	e.mu.Lock()
+	if !e.paused {
+		e.mu.Unlock()
+		return
+	}
+	e.paused = false
+	e.mu.Unlock()
+
+	e.logf("Resume: restarting WireGuard device")
+	e.wgLock.Lock()
+	e.wgdev.Up()
+	e.wgLock.Unlock()
+
+	// DERP connections are redialed as peers need them.
+	e.magicConn.SetPaused(false)
+	// Rebinds, re-STUNs, and reapplies the peer config, which
+	// makes WireGuard handshake again with every peer.
+	e.linkChange(false)
+	e.RequestStatus()
+}
+
+func (e *userspaceEngine) ReSTUN() {
+	e.logf("ReSTUN: rediscovering endpoints")
+	e.magicConn.ReSTUN()
+}
+
+func (e *userspaceEngine) SetDERPMap(dm *tailcfg.DERPMap) {
+	e.magicConn.SetDERPMap(dm)
+}
+
+func (e *userspaceEngine) Ping(ctx context.Context, peer wgcfg.Key) (*magicsock.PingResult, error) {
+	return e.magicConn.Ping(ctx, peer)
+}
+
+func (e *userspaceEngine) LogState() {
+	e.mu.Lock()
+	numPeers := len(e.peerSequence)
+	e.mu.Unlock()
+
+	e.wgLock.Lock()
+	routes := e.lastRoutes
+	filt := e.filt
+	e.wgLock.Unlock()
+
+	e.logf("engine state: %d peers, routes: %v", numPeers, routes)
+	if filt != nil {
+		e.logf("engine state: filter drops: %v", filt.DropCounts())
+	}
+	e.magicConn.LogState()
+}
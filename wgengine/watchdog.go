@@ -5,13 +5,17 @@
 package wgengine
 
 import (
+	"context"
 	"log"
 	"runtime/pprof"
 	"strings"
 	"time"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/magicsock"
+	"tailscale.com/wgengine/tsdns"
 )
 
 // NewWatchdog wraps an Engine and makes sure that all methods complete
@@ -66,6 +70,9 @@ func (e *watchdogEngine) Reconfig(cfg *wgcfg.Config, dnsDomains []string) error
 func (e *watchdogEngine) SetFilter(filt *filter.Filter) {
 	e.watchdog("SetFilter", func() { e.wrap.SetFilter(filt) })
 }
+func (e *watchdogEngine) SetDNSConfig(cfg *tsdns.Config) {
+	e.watchdog("SetDNSConfig", func() { e.wrap.SetDNSConfig(cfg) })
+}
 func (e *watchdogEngine) SetStatusCallback(cb StatusCallback) {
 	e.watchdog("SetStatusCallback", func() { e.wrap.SetStatusCallback(cb) })
 }
@@ -75,6 +82,26 @@ func (e *watchdogEngine) RequestStatus() {
 func (e *watchdogEngine) LinkChange(isExpensive bool) {
 	e.watchdog("LinkChange", func() { e.wrap.LinkChange(isExpensive) })
 }
+func (e *watchdogEngine) Pause() {
+	e.watchdog("Pause", e.wrap.Pause)
+}
+func (e *watchdogEngine) Resume() {
+	e.watchdog("Resume", e.wrap.Resume)
+}
+func (e *watchdogEngine) ReSTUN() {
+	e.watchdog("ReSTUN", e.wrap.ReSTUN)
+}
+func (e *watchdogEngine) SetDERPMap(dm *tailcfg.DERPMap) {
+	e.watchdog("SetDERPMap", func() { e.wrap.SetDERPMap(dm) })
+}
+func (e *watchdogEngine) LogState() {
+	e.watchdog("LogState", e.wrap.LogState)
+}
+func (e *watchdogEngine) Ping(ctx context.Context, peer wgcfg.Key) (*magicsock.PingResult, error) {
+	// Ping waits as long as ctx says, so the watchdog's deadline
+	// doesn't apply.
+	return e.wrap.Ping(ctx, peer)
+}
 func (e *watchdogEngine) Close() {
 	e.watchdog("Close", e.wrap.Close)
 }
@@ -67,5 +67,7 @@ func TestWatchdog(t *testing.T) {
 		case <-time.After(3 * time.Second):
 			t.Fatalf("watchdog failed to fire")
 		}
+		usEngine.wgLock.Unlock()
+		usEngine.Close()
 	})
 }
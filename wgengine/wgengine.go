@@ -5,6 +5,8 @@
 package wgengine
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -14,6 +16,8 @@ import (
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/magicsock"
+	"tailscale.com/wgengine/tsdns"
 )
 
 // ByteCount is the number of bytes that have been sent or received.
@@ -26,12 +30,17 @@ type PeerStatus struct {
 	TxBytes, RxBytes ByteCount
 	LastHandshake    time.Time
 	NodeKey          tailcfg.NodeKey
+	CurAddr          string // "ip:port" packets are sent to; empty if not yet known
+	DERP             string // if CurAddr is a DERP server, its hostname
 }
 
 // Status is the Engine status.
 type Status struct {
 	Peers      []PeerStatus
-	LocalAddrs []string // TODO(crawshaw): []wgcfg.Endpoint?
+	LocalAddrs []string         // TODO(crawshaw): []wgcfg.Endpoint?
+	NATType    string           // NAT mapping behavior: "none", "easy", "hard" or "unknown"
+	DERPHome   string           // hostname of the DERP server we're reachable through
+	NetInfo    *tailcfg.NetInfo // latest network conditions, or nil
 }
 
 // StatusCallback is the type of status callbacks used by
@@ -40,6 +49,12 @@ type Status struct {
 // Exactly one of Status or error is non-nil.
 type StatusCallback func(*Status, error)
 
+// ErrDNSProxyFailed is wrapped by the error Reconfig returns when
+// the engine's DNS resolver couldn't listen for the tailnet's other
+// nodes, as asked by the ServePeers of the config given to
+// SetDNSConfig. The rest of the config was applied.
+var ErrDNSProxyFailed = errors.New("DNS proxy for peers failed to start")
+
 // RouteSettings is the full WireGuard config data (set of peers keys,
 // IP, etc in wgcfg.Config) plus the things that WireGuard doesn't do
 // itself, like DNS stuff.
@@ -48,6 +63,19 @@ type RouteSettings struct {
 	DNS        []wgcfg.IP
 	DNSDomains []string
 	Cfg        *wgcfg.Config
+
+	// DNSMatchDomains, if non-empty, are the only domains to use
+	// DNS for, where the OS can split DNS; see osdns.Config.
+	DNSMatchDomains []string
+
+	// DNSRestrictedDomains are domains to use only DNS for, where
+	// the OS can keep them from other nameservers.
+	DNSRestrictedDomains []string
+
+	// DNSGlobal, without DNSMatchDomains, is whether DNS was asked
+	// to take over all names from the OS's own resolvers; see
+	// osdns.Config.
+	DNSGlobal bool
 }
 
 // OnlyRelevantParts returns a string minimally describing the route settings.
@@ -56,8 +84,8 @@ func (rs *RouteSettings) OnlyRelevantParts() string {
 	for _, p := range rs.Cfg.Peers {
 		peers = append(peers, p.AllowedIPs)
 	}
-	return fmt.Sprintf("%v %v %v %v",
-		rs.LocalAddr, rs.DNS, rs.DNSDomains, peers)
+	return fmt.Sprintf("%v %v %v %v %v %v %v",
+		rs.LocalAddr, rs.DNS, rs.DNSDomains, rs.DNSMatchDomains, rs.DNSRestrictedDomains, rs.DNSGlobal, peers)
 }
 
 // NewUserspaceRouter returns a new Router for the current platform, using the provided tun device.
@@ -65,6 +93,15 @@ func NewUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Devic
 	return newUserspaceRouter(logf, wgdev, tundev)
 }
 
+// Cleanup removes what a tailscaled that didn't shut down cleanly
+// may have left behind for the tunnel interface tunname: the
+// interface itself, with its addresses and routes, firewall rules
+// and DNS configuration. Things that are already gone are skipped,
+// so it's safe to run at any time tailscaled isn't.
+func Cleanup(logf logger.Logf, tunname string) {
+	cleanup(logf, tunname)
+}
+
 // RouterGen is the signature for the two funcs that create Router implementations:
 // NewUserspaceRouter (which varies by operating system) and NewFakeRouter.
 type RouterGen func(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error)
@@ -100,6 +137,14 @@ type Engine interface {
 	// SetFilter updates the packet filter.
 	SetFilter(*filter.Filter)
 
+	// SetDNSConfig configures the engine's DNS resolver, which the
+	// OS is pointed at by listing the node's own address in the DNS
+	// servers given to Reconfig. The resolver listens there once
+	// Reconfig has set the address up; if it can't and the config
+	// has ServePeers, Reconfig's error wraps ErrDNSProxyFailed. A nil
+	// cfg turns it off.
+	SetDNSConfig(cfg *tsdns.Config)
+
 	// SetStatusCallback sets the function to call when the
 	// WireGuard status changes.
 	SetStatusCallback(StatusCallback)
@@ -108,9 +153,11 @@ type Engine interface {
 	// away, sent to the callback registered via SetStatusCallback.
 	RequestStatus()
 
-	// Close shuts down this wireguard instance, remove any routes
-	// it added, etc. To bring it up again later, you'll need a
-	// new Engine.
+	// Close shuts down this wireguard instance: it closes its
+	// connections to peers and DERP, then removes the routes,
+	// addresses, firewall rules and DNS settings it added, then
+	// closes the TUN device. To bring it up again later, you'll
+	// need a new Engine.
 	Close()
 
 	// Wait waits until the Engine's Close method is called or the
@@ -123,4 +170,37 @@ type Engine interface {
 	// where sending packets uses substantial power or money,
 	// such as mobile data on a phone.
 	LinkChange(isExpensive bool)
+
+	// ReSTUN requests an immediate rediscovery of the engine's
+	// public endpoints, without waiting for a link change.
+	ReSTUN()
+
+	// SetDERPMap replaces the DERP servers the engine relays
+	// through. Connections to servers no longer in the map are
+	// dropped. A nil map restores the built-in default.
+	SetDERPMap(dm *tailcfg.DERPMap)
+
+	// Pause quiesces the engine, before the system suspends or
+	// while the backend is paused: it stops WireGuard's timers and
+	// keepalives, drops its DERP connections, sends no STUN
+	// requests, and ignores link changes until Resume.
+	Pause()
+
+	// Resume undoes Pause. Rather than waiting for timeouts to
+	// notice that the network changed underneath it, such as
+	// while the system slept, the engine immediately rebinds its
+	// socket, rediscovers its endpoints, reconnects to DERP and
+	// starts new handshakes with its peers.
+	Resume()
+
+	// LogState writes a summary of the engine's internal state,
+	// such as its endpoints and peer paths, to its log. It is
+	// intended for debugging connectivity problems at runtime.
+	LogState()
+
+	// Ping sends a path ping to the peer with public key peer,
+	// beneath WireGuard, on each of its endpoints and through DERP,
+	// and reports the path the first answer came back on. It
+	// returns when one does, or when ctx is done.
+	Ping(ctx context.Context, peer wgcfg.Key) (*magicsock.PingResult, error)
 }